@@ -8,6 +8,7 @@ import (
 	"github.com/project-receptor/receptor/pkg/controlsvc"
 	_ "github.com/project-receptor/receptor/pkg/controlsvc"
 	"github.com/project-receptor/receptor/pkg/logger"
+	_ "github.com/project-receptor/receptor/pkg/metrics"
 	"github.com/project-receptor/receptor/pkg/netceptor"
 	_ "github.com/project-receptor/receptor/pkg/services"
 	"github.com/project-receptor/receptor/pkg/workceptor"
@@ -17,10 +18,31 @@ import (
 	"time"
 )
 
+// rootCtx is the context shared by the node's subsystems.  Cancelling it, as the shutdown control
+// command does, shuts the node down cleanly.
+var rootCtx, rootCancel = context.WithCancel(context.Background())
+
 type nodeCfg struct {
-	ID           string `description:"Node ID. Defaults to local hostname." barevalue:"yes"`
-	AllowedPeers string `description:"Comma separated list of peer node-IDs to allow"`
-	DataDir      string `description:"Directory in which to store node data"`
+	ID               string `description:"Node ID. Defaults to local hostname." barevalue:"yes"`
+	AllowedPeers     string `description:"Comma separated list of peer node-IDs to allow. Entries may be glob patterns like worker-*, or regular expressions prefixed with re:"`
+	AllowedPeersFile string `description:"File listing the peer node-IDs to allow, one per line. Overrides allowedpeers, and can be reloaded at runtime."`
+	DeniedPeers      string `description:"Comma separated list of peer node-IDs or patterns to refuse, even if they are allowed"`
+	DataDir          string `description:"Directory in which to store node data"`
+	WorkStorage      string `description:"Where to store work units (filesystem or memory)" default:"filesystem"`
+	UnknownWorkType  string `description:"Policy for restarted work units of an unregistered work type (pending or fail)" default:"pending"`
+	ServiceQueries   bool   `description:"Answer requests from remote nodes for our list of services" default:"true"`
+	RelayServices    string `description:"Comma separated list of service names to relay transit traffic, and the replies to it, for. Defaults to all."`
+	HandshakeTimeout int    `description:"Seconds a new backend session has to complete its TLS and node handshakes (0 for no limit)" default:"30"`
+	VerifyWork       bool   `description:"Check the integrity of stored work units before restarting them" default:"false"`
+	WorkTTLMins      int    `description:"Minutes to keep completed work units before releasing them automatically (0 to keep them until released)" default:"0"`
+	WorkSweepMins    int    `description:"Minutes between checks for completed work units older than workttlmins" default:"10"`
+	SendQueueSize    int    `description:"Number of forwarded messages each backend session queues while its backend is busy" default:"128"`
+	SendQueuePolicy  string `description:"What to do when a session's send queue is full: block, drop-oldest or drop-newest" default:"block"`
+	Compression      string `description:"Compress messages to peers that support it with this algorithm (none or zlib)" default:"none"`
+	CompressionMin   int    `description:"Messages shorter than this many bytes are sent uncompressed" default:"512"`
+	KeepaliveSecs    int    `description:"Seconds between keepalives sent to peers" default:"10"`
+	KeepaliveMissed  int    `description:"Number of a peer's keepalives that may be missed before its link is declared dead" default:"2"`
+	Chaos            bool   `description:"Allow faults to be injected into backend sessions for resilience testing. Never use in production." default:"false"`
 }
 
 func (cfg nodeCfg) Init() error {
@@ -42,13 +64,69 @@ func (cfg nodeCfg) Init() error {
 	var allowedPeers []string
 	if cfg.AllowedPeers != "" {
 		allowedPeers = strings.Split(cfg.AllowedPeers, ",")
+		err = netceptor.ValidatePeerPatterns(allowedPeers)
+		if err != nil {
+			return err
+		}
 	}
-	netceptor.MainInstance = netceptor.New(context.Background(), cfg.ID, allowedPeers)
-	workceptor.MainInstance, err = workceptor.New(context.Background(), netceptor.MainInstance, cfg.DataDir)
+	netceptor.MainInstance = netceptor.New(rootCtx, cfg.ID, allowedPeers)
+	if cfg.DeniedPeers != "" {
+		err = netceptor.MainInstance.SetDeniedPeers(strings.Split(cfg.DeniedPeers, ","))
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.AllowedPeersFile != "" {
+		err = netceptor.MainInstance.LoadAllowedPeersFile(cfg.AllowedPeersFile)
+		if err != nil {
+			return err
+		}
+	}
+	netceptor.MainInstance.SetServiceQueriesAllowed(cfg.ServiceQueries)
+	if cfg.RelayServices != "" {
+		netceptor.MainInstance.SetRelayAllowedServices(strings.Split(cfg.RelayServices, ","))
+	}
+	netceptor.MainInstance.SetHandshakeTimeout(time.Duration(cfg.HandshakeTimeout) * time.Second)
+	err = netceptor.MainInstance.SetSendQueue(cfg.SendQueueSize, strings.ToLower(cfg.SendQueuePolicy))
+	if err != nil {
+		return err
+	}
+	err = netceptor.MainInstance.SetCompression(strings.ToLower(cfg.Compression), cfg.CompressionMin)
+	if err != nil {
+		return err
+	}
+	err = netceptor.MainInstance.SetKeepalive(time.Duration(cfg.KeepaliveSecs)*time.Second, cfg.KeepaliveMissed)
+	if err != nil {
+		return err
+	}
+	if cfg.Chaos {
+		logger.Warning("Fault injection is enabled on this node\n")
+		netceptor.MainInstance.EnableChaos()
+	}
+	switch strings.ToLower(cfg.WorkStorage) {
+	case "filesystem":
+		workceptor.MainInstance, err = workceptor.New(rootCtx, netceptor.MainInstance, cfg.DataDir)
+	case "memory":
+		workceptor.MainInstance, err = workceptor.NewWithStorage(rootCtx, netceptor.MainInstance,
+			workceptor.NewMemoryStorage())
+	default:
+		err = fmt.Errorf("unknown work storage %s", cfg.WorkStorage)
+	}
+	if err != nil {
+		return err
+	}
+	err = workceptor.MainInstance.SetUnknownWorkTypePolicy(cfg.UnknownWorkType)
+	if err != nil {
+		return err
+	}
+	workceptor.MainInstance.SetVerifyOnStartup(cfg.VerifyWork)
+	err = workceptor.MainInstance.SetRetention(time.Duration(cfg.WorkTTLMins)*time.Minute,
+		time.Duration(cfg.WorkSweepMins)*time.Minute)
 	if err != nil {
 		return err
 	}
 	controlsvc.MainInstance = controlsvc.New(true, netceptor.MainInstance)
+	controlsvc.MainInstance.SetShutdownFunc(rootCancel)
 	err = workceptor.MainInstance.RegisterWithControlService(controlsvc.MainInstance)
 	if err != nil {
 		return err
@@ -74,6 +152,7 @@ func (cfg nullBackendCfg) Run() error {
 	if err != nil {
 		return err
 	}
+	controlsvc.MainInstance.SetLocalOnly(true)
 	return nil
 }
 
@@ -90,7 +169,10 @@ func main() {
 	}()
 	select {
 	case <-done:
-		if netceptor.MainInstance.BackendCount() > 0 {
+		if rootCtx.Err() != nil {
+			logger.Info("Shutdown complete\n")
+			os.Exit(0)
+		} else if netceptor.MainInstance.BackendCount() > 0 {
 			logger.Error("All backends have failed. Exiting.\n")
 			os.Exit(1)
 		} else {
@@ -100,6 +182,19 @@ func main() {
 		}
 	case <-time.After(100 * time.Millisecond):
 	}
+	for _, f := range netceptor.MainInstance.ValidateConfig() {
+		switch f.Severity {
+		case netceptor.FindingError:
+			logger.Error("Config validation (%s): %s\n", f.Subsystem, f.Message)
+		case netceptor.FindingWarning:
+			logger.Warning("Config validation (%s): %s\n", f.Subsystem, f.Message)
+		}
+	}
 	logger.Info("Initialization complete\n")
 	<-done
+	if rootCtx.Err() != nil {
+		// Let control sessions finish the commands they are running
+		controlsvc.MainInstance.Wait()
+		logger.Info("Shutdown complete\n")
+	}
 }
@@ -0,0 +1,423 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"github.com/project-receptor/receptor/pkg/framer"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/utils"
+	"net"
+	"sync"
+	"time"
+)
+
+// quicALPN is the application protocol negotiated by QUIC backend connections
+const quicALPN = "receptor-backend"
+
+// quicHandshakeTimeout is how long a QUIC backend connection has to complete its TLS handshake
+const quicHandshakeTimeout = 15 * time.Second
+
+// DefaultQUICIdleTimeout is how long a QUIC backend connection may go without hearing from its peer
+const DefaultQUICIdleTimeout = 30 * time.Second
+
+// quicSessionCacheSize is how many TLS sessions a QUIC dialer keeps for resumption
+const quicSessionCacheSize = 16
+
+// quicConfig returns the QUIC settings of a backend
+func quicConfig(idleTimeout time.Duration) *quic.Config {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultQUICIdleTimeout
+	}
+	return &quic.Config{
+		HandshakeTimeout: quicHandshakeTimeout,
+		MaxIdleTimeout:   idleTimeout,
+		KeepAlive:        true,
+	}
+}
+
+// quicTLSConfig returns a copy of a TLS config that negotiates the QUIC backend protocol
+func quicTLSConfig(tlscfg *tls.Config) *tls.Config {
+	return netceptor.WithNextProtos(tlscfg, quicALPN)
+}
+
+// QUICDialer implements Backend for outbound QUIC
+type QUICDialer struct {
+	address     string
+	redial      bool
+	reconnect   ReconnectPolicy
+	tls         *tls.Config
+	idleTimeout time.Duration
+}
+
+// NewQUICDialer instantiates a new QUIC backend.  QUIC always uses TLS, so a TLS config is
+// required.  Redials resume the previous TLS session, skipping the certificate exchange, if the
+// TLS config allows session tickets and the listener accepts them.
+func NewQUICDialer(address string, redial bool, tlscfg *tls.Config, idleTimeout time.Duration) (*QUICDialer, error) {
+	if tlscfg == nil {
+		return nil, fmt.Errorf("QUIC backends require a TLS config")
+	}
+	tlscfg = quicTLSConfig(tlscfg)
+	if tlscfg.ClientSessionCache == nil {
+		tlscfg.ClientSessionCache = tls.NewLRUClientSessionCache(quicSessionCacheSize)
+	}
+	qd := QUICDialer{
+		address:     address,
+		redial:      redial,
+		reconnect:   DefaultReconnectPolicy,
+		tls:         tlscfg,
+		idleTimeout: idleTimeout,
+	}
+	return &qd, nil
+}
+
+// SetReconnectPolicy sets how the backend backs off between attempts to redial its peer
+func (b *QUICDialer) SetReconnectPolicy(policy ReconnectPolicy) {
+	b.reconnect = policy
+}
+
+// Start runs the given session function over this backend service
+func (b *QUICDialer) Start(ctx context.Context) (chan netceptor.BackendSession, error) {
+	return dialerSession(ctx, b.redial, b.reconnect,
+		func(closeChan chan struct{}) (netceptor.BackendSession, error) {
+			qs, err := quic.DialAddrContext(ctx, b.address, b.tls, quicConfig(b.idleTimeout))
+			if err != nil {
+				return nil, err
+			}
+			stream, err := qs.OpenStreamSync(ctx)
+			if err != nil {
+				_ = qs.CloseWithError(0, "")
+				return nil, err
+			}
+			return newQUICSession(qs, stream, closeChan), nil
+		})
+}
+
+// QUICListener implements Backend for inbound QUIC
+type QUICListener struct {
+	address     string
+	tls         *tls.Config
+	idleTimeout time.Duration
+	li          quic.Listener
+	accepted    chan *QUICSession
+}
+
+// NewQUICListener instantiates a new QUICListener backend.  QUIC always uses TLS, so a TLS config
+// is required.
+func NewQUICListener(address string, tlscfg *tls.Config, idleTimeout time.Duration) (*QUICListener, error) {
+	if tlscfg == nil {
+		return nil, fmt.Errorf("QUIC backends require a TLS config")
+	}
+	ql := QUICListener{
+		address:     address,
+		tls:         quicTLSConfig(tlscfg),
+		idleTimeout: idleTimeout,
+		li:          nil,
+	}
+	return &ql, nil
+}
+
+// Addr returns the network address the listener is listening on
+func (b *QUICListener) Addr() net.Addr {
+	if b.li == nil {
+		return nil
+	}
+	return b.li.Addr()
+}
+
+// acceptStreams accepts QUIC connections, and passes on each one once its peer opens a stream.
+// Connections are handled in the background, so a slow peer does not hold up the others.
+func (b *QUICListener) acceptStreams(ctx context.Context) {
+	defer close(b.accepted)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		qs, err := b.li.Accept(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				sublogger.Error("Error accepting QUIC connection: %s\n", err)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sctx, cancel := context.WithTimeout(ctx, quicHandshakeTimeout)
+			stream, err := qs.AcceptStream(sctx)
+			cancel()
+			if err != nil {
+				sublogger.Warning("QUIC peer %s did not open a stream: %s\n", qs.RemoteAddr(), err)
+				_ = qs.CloseWithError(0, "")
+				return
+			}
+			select {
+			case b.accepted <- newQUICSession(qs, stream, nil):
+			case <-ctx.Done():
+				_ = stream.Close()
+				_ = qs.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+// Start runs the given session function over the QUICListener backend
+func (b *QUICListener) Start(ctx context.Context) (chan netceptor.BackendSession, error) {
+	sessChan, err := listenerSession(ctx,
+		func() error {
+			var err error
+			b.li, err = quic.ListenAddr(b.address, b.tls, quicConfig(b.idleTimeout))
+			if err != nil {
+				return err
+			}
+			b.accepted = make(chan *QUICSession)
+			go b.acceptStreams(ctx)
+			return nil
+		}, func() (netceptor.BackendSession, error) {
+			qs, ok := <-b.accepted
+			if !ok {
+				return nil, fmt.Errorf("QUIC listener closed")
+			}
+			return qs, nil
+		}, func() {
+			_ = b.li.Close()
+		})
+	if err == nil {
+		sublogger.Debug("Listening on QUIC %s\n", b.Addr().String())
+	}
+	return sessChan, err
+}
+
+// QUICSession implements BackendSession for the QUIC backend.  Each session is a single stream of
+// a QUIC connection.
+type QUICSession struct {
+	qs              quic.Session
+	stream          quic.Stream
+	framer          framer.Framer
+	closeChan       chan struct{}
+	closeChanCloser sync.Once
+}
+
+// newQUICSession allocates a new QUICSession
+func newQUICSession(qs quic.Session, stream quic.Stream, closeChan chan struct{}) *QUICSession {
+	return &QUICSession{
+		qs:              qs,
+		stream:          stream,
+		framer:          framer.New(),
+		closeChan:       closeChan,
+		closeChanCloser: sync.Once{},
+	}
+}
+
+// Send sends data over the session
+func (ns *QUICSession) Send(data []byte) error {
+	buf := ns.framer.SendData(data)
+	n, err := ns.stream.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return fmt.Errorf("partial data sent")
+	}
+	return nil
+}
+
+// Recv receives data via the session
+func (ns *QUICSession) Recv(timeout time.Duration) ([]byte, error) {
+	buf := make([]byte, netceptor.MTU)
+	for {
+		if ns.framer.MessageReady() {
+			break
+		}
+		err := ns.stream.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return nil, err
+		}
+		n, err := ns.stream.Read(buf)
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil, netceptor.ErrTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
+		ns.framer.RecvData(buf[:n])
+	}
+	buf, err := ns.framer.GetMessage()
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Close closes the session
+func (ns *QUICSession) Close() error {
+	ns.closeChanCloser.Do(func() {
+		if ns.closeChan != nil {
+			close(ns.closeChan)
+		}
+	})
+	_ = ns.stream.Close()
+	return ns.qs.CloseWithError(0, "")
+}
+
+// SessionInfo describes the connection of the session.  QUIC connections always use TLS.
+func (ns *QUICSession) SessionInfo() netceptor.SessionInfo {
+	si := netceptor.SessionInfo{
+		Direction:        netceptor.DirectionInbound,
+		RemoteAddr:       ns.qs.RemoteAddr().String(),
+		TLS:              true,
+		PeerCertificates: ns.qs.ConnectionState().PeerCertificates,
+	}
+	if ns.closeChan != nil {
+		si.Direction = netceptor.DirectionOutbound
+	}
+	return si
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// QUICListenerCfg is the cmdline configuration object for a QUIC listener
+type QUICListenerCfg struct {
+	BindAddr      string             `description:"Local address to bind to" default:"0.0.0.0"`
+	Port          int                `description:"Local UDP port to listen on" barevalue:"yes" required:"yes"`
+	TLS           string             `description:"Name of TLS server config" required:"yes"`
+	IdleTimeout   int                `description:"Seconds a connection may go without hearing from its peer" default:"30"`
+	Cost          float64            `description:"Connection cost (weight)" default:"1.0"`
+	ReceiveCost   float64            `description:"Cost of the peer sending to this node, if different from the connection cost" default:"0"`
+	RateLimit     int                `description:"Maximum bytes per second to send, and to receive, over this backend"`
+	RateBurst     int                `description:"Bytes that may be sent or received at once above the rate limit (default one second's worth)"`
+	BandwidthCost bool               `description:"Derive the connection cost from the rate limit, so routing prefers faster links"`
+	Name          string             `description:"Name used to refer to this backend in control commands"`
+	NodeCost      map[string]float64 `description:"Per-node costs"`
+}
+
+// Prepare verifies the parameters are correct
+func (cfg QUICListenerCfg) Prepare() error {
+	_, err := newCosts(cfg.Cost, cfg.ReceiveCost, cfg.NodeCost)
+	if err != nil {
+		return err
+	}
+	if cfg.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative")
+	}
+	_, _, err = newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Run runs the action
+func (cfg QUICListenerCfg) Run() error {
+	address := utils.JoinHostPort(cfg.BindAddr, cfg.Port)
+	tlscfg, err := netceptor.MainInstance.GetServerTLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+	b, err := NewQUICListener(address, tlscfg, time.Duration(cfg.IdleTimeout)*time.Second)
+	if err != nil {
+		sublogger.Error("Error creating listener %s: %s\n", address, err)
+		return err
+	}
+	limit, cost, err := newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	costs, err := newCosts(cost, cfg.ReceiveCost, cfg.NodeCost)
+	if err != nil {
+		return err
+	}
+	err = netceptor.MainInstance.AddBackendWithCosts(cfg.Name, b, costs, limit)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// QUICDialerCfg is the cmdline configuration object for a QUIC dialer
+type QUICDialerCfg struct {
+	Address          string  `description:"Remote address (Host:Port) to connect to" barevalue:"yes" required:"yes"`
+	Redial           bool    `description:"Keep redialing on lost connection" default:"true"`
+	RedialDelay      int     `description:"Seconds to wait before the first redial" default:"5"`
+	RedialMaxDelay   int     `description:"Maximum seconds to wait between redials" default:"20"`
+	RedialMultiplier float64 `description:"Factor the redial delay grows by after each attempt" default:"1.5"`
+	RedialJitter     float64 `description:"Fraction by which each redial delay is randomized" default:"0.2"`
+	RedialResetAfter int     `description:"Seconds a connection must stay up for the redial delay to reset" default:"30"`
+	TLS              string  `description:"Name of TLS client config (if unset, the peer is verified against the system CAs)"`
+	IdleTimeout      int     `description:"Seconds a connection may go without hearing from its peer" default:"30"`
+	Cost             float64 `description:"Connection cost (weight)" default:"1.0"`
+	ReceiveCost      float64 `description:"Cost of the peer sending to this node, if different from the connection cost" default:"0"`
+	RateLimit        int     `description:"Maximum bytes per second to send, and to receive, over this backend"`
+	RateBurst        int     `description:"Bytes that may be sent or received at once above the rate limit (default one second's worth)"`
+	BandwidthCost    bool    `description:"Derive the connection cost from the rate limit, so routing prefers faster links"`
+	Name             string  `description:"Name used to refer to this backend in control commands"`
+}
+
+// Prepare verifies the parameters are correct
+func (cfg QUICDialerCfg) Prepare() error {
+	_, err := newCosts(cfg.Cost, cfg.ReceiveCost, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative")
+	}
+	_, err = newReconnectPolicy(cfg.RedialDelay, cfg.RedialMaxDelay, cfg.RedialMultiplier, cfg.RedialJitter, cfg.RedialResetAfter)
+	if err != nil {
+		return err
+	}
+	_, _, err = newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Run runs the action
+func (cfg QUICDialerCfg) Run() error {
+	sublogger.Debug("Running QUIC peer connection %s\n", cfg.Address)
+	host, _, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return err
+	}
+	tlsCfgName := cfg.TLS
+	if tlsCfgName == "" {
+		tlsCfgName = "default"
+	}
+	tlscfg, err := netceptor.MainInstance.GetClientTLSConfig(tlsCfgName, host)
+	if err != nil {
+		return err
+	}
+	b, err := NewQUICDialer(cfg.Address, cfg.Redial, tlscfg, time.Duration(cfg.IdleTimeout)*time.Second)
+	if err != nil {
+		sublogger.Error("Error creating peer %s: %s\n", cfg.Address, err)
+		return err
+	}
+	policy, err := newReconnectPolicy(cfg.RedialDelay, cfg.RedialMaxDelay, cfg.RedialMultiplier, cfg.RedialJitter, cfg.RedialResetAfter)
+	if err != nil {
+		return err
+	}
+	b.SetReconnectPolicy(policy)
+	netceptor.MainInstance.AddConfigCheck("backends", addressCheck("udp", cfg.Address))
+	limit, cost, err := newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	costs, err := newCosts(cost, cfg.ReceiveCost, nil)
+	if err != nil {
+		return err
+	}
+	err = netceptor.MainInstance.AddBackendWithCosts(cfg.Name, b, costs, limit)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	cmdline.AddConfigType("quic-listener", "Run a backend listener on a UDP port using QUIC", QUICListenerCfg{}, false, false, false, false, backendSection)
+	cmdline.AddConfigType("quic-peer", "Make an outbound backend connection to a QUIC peer", QUICDialerCfg{}, false, false, false, false, backendSection)
+}
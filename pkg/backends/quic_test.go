@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestTLSConfigs returns a server config with a self-signed certificate for localhost, and a
+// client config that trusts it
+func newTestTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-1 * time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	serverCfg := &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}
+	clientCfg := &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+	}
+	return serverCfg, clientCfg
+}
+
+func TestQUICTwoNodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	serverCfg, clientCfg := newTestTLSConfigs(t)
+
+	n1 := netceptor.New(context.Background(), "node1", nil)
+	n2 := netceptor.New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	li, err := NewQUICListener("127.0.0.1:0", serverCfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.AddBackend(li, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewQUICDialer(li.Addr().String(), false, clientCfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n2.AddBackend(d, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the nodes to find each other over the QUIC backend
+	for {
+		if n2.Status().RoutingTable["node1"] == "node1" && n1.Status().RoutingTable["node2"] == "node2" {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("nodes did not connect over QUIC")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Echo a message from node2 to a service on node1.  The listener and connection are left for
+	// the nodes to clean up when they shut down.
+	li1, err := n1.Listen("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := li1.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := n2.DialContext(ctx, "node1", "echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("received %q", buf)
+	}
+}
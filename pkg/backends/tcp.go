@@ -6,8 +6,9 @@ import (
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/cmdline"
 	"github.com/project-receptor/receptor/pkg/framer"
-	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/utils"
+	"golang.org/x/net/proxy"
 	"io"
 	"net"
 	"sync"
@@ -16,37 +17,97 @@ import (
 
 // TCPDialer implements Backend for outbound TCP
 type TCPDialer struct {
-	address string
-	redial  bool
-	tls     *tls.Config
+	address   string
+	redial    bool
+	reconnect ReconnectPolicy
+	tls       *tls.Config
+	socks     proxy.ContextDialer
 }
 
+// tcpHandshakeTimeout bounds how long a TLS handshake with a peer may take
+const tcpHandshakeTimeout = 15 * time.Second
+
 // NewTCPDialer instantiates a new TCP backend
 func NewTCPDialer(address string, redial bool, tls *tls.Config) (*TCPDialer, error) {
 	td := TCPDialer{
-		address: address,
-		redial:  redial,
-		tls:     tls,
+		address:   address,
+		redial:    redial,
+		reconnect: DefaultReconnectPolicy,
+		tls:       tls,
 	}
 	return &td, nil
 }
 
+// SetReconnectPolicy sets how the backend backs off between attempts to redial its peer
+func (b *TCPDialer) SetReconnectPolicy(policy ReconnectPolicy) {
+	b.reconnect = policy
+}
+
+// SetSOCKS5Proxy makes the backend connect to its peer through a SOCKS5 proxy.  The proxy only
+// relays the TCP connection, so the TLS handshake, if any, is still made with the peer itself.
+// The username and password are optional.
+func (b *TCPDialer) SetSOCKS5Proxy(address string, username string, password string) error {
+	var auth *proxy.Auth
+	if username != "" || password != "" {
+		auth = &proxy.Auth{
+			User:     username,
+			Password: password,
+		}
+	}
+	dialer, err := proxy.SOCKS5("tcp", address, auth, &net.Dialer{})
+	if err != nil {
+		return err
+	}
+	socks, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return fmt.Errorf("SOCKS5 dialer does not support contexts")
+	}
+	b.socks = socks
+	return nil
+}
+
+// dial opens a TCP connection to the peer, through the SOCKS5 proxy if one is set
+func (b *TCPDialer) dial(ctx context.Context) (net.Conn, error) {
+	if b.socks != nil {
+		return b.socks.DialContext(ctx, "tcp", b.address)
+	}
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", b.address)
+}
+
 // Start runs the given session function over this backend service
 func (b *TCPDialer) Start(ctx context.Context) (chan netceptor.BackendSession, error) {
-	return dialerSession(ctx, b.redial, 5*time.Second,
+	return dialerSession(ctx, b.redial, b.reconnect,
 		func(closeChan chan struct{}) (netceptor.BackendSession, error) {
-			var conn net.Conn
-			var err error
-			dialer := &net.Dialer{}
-			if b.tls == nil {
-				conn, err = dialer.DialContext(ctx, "tcp", b.address)
-			} else {
-				dialer.Timeout = 15 * time.Second // tls library does not have a DialContext equivalent
-				conn, err = tls.DialWithDialer(dialer, "tcp", b.address, b.tls)
-			}
+			conn, err := b.dial(ctx)
 			if err != nil {
 				return nil, err
 			}
+			if b.tls != nil {
+				tlscfg := b.tls
+				if tlscfg.ServerName == "" {
+					// As tls.Dial does, verify the peer against the host it was dialed by
+					host, _, err := net.SplitHostPort(b.address)
+					if err == nil {
+						tlscfg = tlscfg.Clone()
+						tlscfg.ServerName = host
+					}
+				}
+				// tls library does not have a HandshakeContext equivalent
+				tlsConn := tls.Client(conn, tlscfg)
+				err = tlsConn.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+				if err == nil {
+					err = tlsConn.Handshake()
+				}
+				if err == nil {
+					err = tlsConn.SetDeadline(time.Time{})
+				}
+				if err != nil {
+					_ = conn.Close()
+					return nil, err
+				}
+				conn = tlsConn
+			}
 			return newTCPSession(conn, closeChan), nil
 		})
 }
@@ -127,7 +188,7 @@ func (b *TCPListener) Start(ctx context.Context) (chan netceptor.BackendSession,
 			_ = b.li.Close()
 		})
 	if err == nil {
-		logger.Debug("Listening on TCP %s\n", b.Addr().String())
+		sublogger.Debug("Listening on TCP %s\n", b.Addr().String())
 	}
 	return sessChan, err
 }
@@ -202,45 +263,63 @@ func (ns *TCPSession) Close() error {
 	return ns.conn.Close()
 }
 
+// SessionInfo describes the connection of the session
+func (ns *TCPSession) SessionInfo() netceptor.SessionInfo {
+	return connSessionInfo(ns.conn, ns.closeChan)
+}
+
 // **************************************************************************
 // Command line
 // **************************************************************************
 
 // TCPListenerCfg is the cmdline configuration object for a TCP listener
 type TCPListenerCfg struct {
-	BindAddr string             `description:"Local address to bind to" default:"0.0.0.0"`
-	Port     int                `description:"Local TCP port to listen on" barevalue:"yes" required:"yes"`
-	TLS      string             `description:"Name of TLS server config"`
-	Cost     float64            `description:"Connection cost (weight)" default:"1.0"`
-	NodeCost map[string]float64 `description:"Per-node costs"`
+	BindAddr      string             `description:"Local address to bind to" default:"0.0.0.0"`
+	Port          int                `description:"Local TCP port to listen on" barevalue:"yes" required:"yes"`
+	TLS           string             `description:"Name of TLS server config"`
+	Cost          float64            `description:"Connection cost (weight)" default:"1.0"`
+	ReceiveCost   float64            `description:"Cost of the peer sending to this node, if different from the connection cost" default:"0"`
+	RateLimit     int                `description:"Maximum bytes per second to send, and to receive, over this backend"`
+	RateBurst     int                `description:"Bytes that may be sent or received at once above the rate limit (default one second's worth)"`
+	BandwidthCost bool               `description:"Derive the connection cost from the rate limit, so routing prefers faster links"`
+	Name          string             `description:"Name used to refer to this backend in control commands"`
+	NodeCost      map[string]float64 `description:"Per-node costs"`
 }
 
 // Prepare verifies the parameters are correct
 func (cfg TCPListenerCfg) Prepare() error {
-	if cfg.Cost <= 0.0 {
-		return fmt.Errorf("connection cost must be positive")
+	_, err := newCosts(cfg.Cost, cfg.ReceiveCost, cfg.NodeCost)
+	if err != nil {
+		return err
 	}
-	for node, cost := range cfg.NodeCost {
-		if cost <= 0.0 {
-			return fmt.Errorf("connection cost must be positive for %s", node)
-		}
+	_, _, err = newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
 // Run runs the action
 func (cfg TCPListenerCfg) Run() error {
-	address := fmt.Sprintf("%s:%d", cfg.BindAddr, cfg.Port)
+	address := utils.JoinHostPort(cfg.BindAddr, cfg.Port)
 	tlscfg, err := netceptor.MainInstance.GetServerTLSConfig(cfg.TLS)
 	if err != nil {
 		return err
 	}
 	b, err := NewTCPListener(address, tlscfg)
 	if err != nil {
-		logger.Error("Error creating listener %s: %s\n", address, err)
+		sublogger.Error("Error creating listener %s: %s\n", address, err)
+		return err
+	}
+	limit, cost, err := newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	costs, err := newCosts(cost, cfg.ReceiveCost, cfg.NodeCost)
+	if err != nil {
 		return err
 	}
-	err = netceptor.MainInstance.AddBackend(b, cfg.Cost, cfg.NodeCost)
+	err = netceptor.MainInstance.AddBackendWithCosts(cfg.Name, b, costs, limit)
 	if err != nil {
 		return err
 	}
@@ -249,23 +328,55 @@ func (cfg TCPListenerCfg) Run() error {
 
 // TCPDialerCfg is the cmdline configuration object for a TCP dialer
 type TCPDialerCfg struct {
-	Address string  `description:"Remote address (Host:Port) to connect to" barevalue:"yes" required:"yes"`
-	Redial  bool    `description:"Keep redialing on lost connection" default:"true"`
-	TLS     string  `description:"Name of TLS client config"`
-	Cost    float64 `description:"Connection cost (weight)" default:"1.0"`
+	Address          string  `description:"Remote address (Host:Port) to connect to" barevalue:"yes" required:"yes"`
+	Redial           bool    `description:"Keep redialing on lost connection" default:"true"`
+	RedialDelay      int     `description:"Seconds to wait before the first redial" default:"5"`
+	RedialMaxDelay   int     `description:"Maximum seconds to wait between redials" default:"20"`
+	RedialMultiplier float64 `description:"Factor the redial delay grows by after each attempt" default:"1.5"`
+	RedialJitter     float64 `description:"Fraction by which each redial delay is randomized" default:"0.2"`
+	RedialResetAfter int     `description:"Seconds a connection must stay up for the redial delay to reset" default:"30"`
+	TLS              string  `description:"Name of TLS client config"`
+	SOCKS5Proxy      string  `description:"Address (Host:Port) of a SOCKS5 proxy to connect through"`
+	SOCKS5Username   string  `description:"Username to authenticate to the SOCKS5 proxy with"`
+	SOCKS5Password   string  `description:"Password to authenticate to the SOCKS5 proxy with"`
+	Cost             float64 `description:"Connection cost (weight)" default:"1.0"`
+	ReceiveCost      float64 `description:"Cost of the peer sending to this node, if different from the connection cost" default:"0"`
+	RateLimit        int     `description:"Maximum bytes per second to send, and to receive, over this backend"`
+	RateBurst        int     `description:"Bytes that may be sent or received at once above the rate limit (default one second's worth)"`
+	BandwidthCost    bool    `description:"Derive the connection cost from the rate limit, so routing prefers faster links"`
+	Name             string  `description:"Name used to refer to this backend in control commands"`
 }
 
 // Prepare verifies the parameters are correct
 func (cfg TCPDialerCfg) Prepare() error {
-	if cfg.Cost <= 0.0 {
-		return fmt.Errorf("connection cost must be positive")
+	_, err := newCosts(cfg.Cost, cfg.ReceiveCost, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.SOCKS5Proxy == "" {
+		if cfg.SOCKS5Username != "" || cfg.SOCKS5Password != "" {
+			return fmt.Errorf("SOCKS5 credentials given without a SOCKS5 proxy")
+		}
+	} else {
+		_, _, err := net.SplitHostPort(cfg.SOCKS5Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid SOCKS5 proxy address %s: %s", cfg.SOCKS5Proxy, err)
+		}
+	}
+	_, err = newReconnectPolicy(cfg.RedialDelay, cfg.RedialMaxDelay, cfg.RedialMultiplier, cfg.RedialJitter, cfg.RedialResetAfter)
+	if err != nil {
+		return err
+	}
+	_, _, err = newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
 // Run runs the action
 func (cfg TCPDialerCfg) Run() error {
-	logger.Debug("Running TCP peer connection %s\n", cfg.Address)
+	sublogger.Debug("Running TCP peer connection %s\n", cfg.Address)
 	host, _, err := net.SplitHostPort(cfg.Address)
 	if err != nil {
 		return err
@@ -276,10 +387,33 @@ func (cfg TCPDialerCfg) Run() error {
 	}
 	b, err := NewTCPDialer(cfg.Address, cfg.Redial, tlscfg)
 	if err != nil {
-		logger.Error("Error creating peer %s: %s\n", cfg.Address, err)
+		sublogger.Error("Error creating peer %s: %s\n", cfg.Address, err)
+		return err
+	}
+	policy, err := newReconnectPolicy(cfg.RedialDelay, cfg.RedialMaxDelay, cfg.RedialMultiplier, cfg.RedialJitter, cfg.RedialResetAfter)
+	if err != nil {
+		return err
+	}
+	b.SetReconnectPolicy(policy)
+	if cfg.SOCKS5Proxy == "" {
+		netceptor.MainInstance.AddConfigCheck("backends", addressCheck("tcp", cfg.Address))
+	} else {
+		// The proxy resolves the peer's address, which may not resolve from here
+		err = b.SetSOCKS5Proxy(cfg.SOCKS5Proxy, cfg.SOCKS5Username, cfg.SOCKS5Password)
+		if err != nil {
+			return err
+		}
+		netceptor.MainInstance.AddConfigCheck("backends", addressCheck("tcp", cfg.SOCKS5Proxy))
+	}
+	limit, cost, err := newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	costs, err := newCosts(cost, cfg.ReceiveCost, nil)
+	if err != nil {
 		return err
 	}
-	err = netceptor.MainInstance.AddBackend(b, cfg.Cost, nil)
+	err = netceptor.MainInstance.AddBackendWithCosts(cfg.Name, b, costs, limit)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,299 @@
+package backends
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/utils"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTCPIPv6Literal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	probe, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %s", err)
+	}
+	_ = probe.Close()
+
+	li, err := NewTCPListener(utils.JoinHostPort("[::1]", 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liSessions, err := li.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := li.Addr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "::1" {
+		t.Fatalf("listener bound to %s instead of ::1", host)
+	}
+
+	d, err := NewTCPDialer(addr, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dSessions, err := d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sess := <-dSessions:
+		err = sess.Send([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("dialer did not connect to the IPv6 listener")
+	}
+	select {
+	case sess := <-liSessions:
+		data, err := sess.Recv(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("received %q", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("listener did not accept the dialer's session")
+	}
+}
+
+// socks5Server is a minimal SOCKS5 proxy that only accepts username/password authentication and
+// the CONNECT command
+type socks5Server struct {
+	li       net.Listener
+	username string
+	password string
+	// results receives the target of each relayed connection, or the error that ended the request
+	results chan string
+}
+
+// newSOCKS5Server starts a SOCKS5 proxy on the loopback interface
+func newSOCKS5Server(t *testing.T, username string, password string) *socks5Server {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5Server{
+		li:       li,
+		username: username,
+		password: password,
+		results:  make(chan string, 10),
+	}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				target, err := s.handle(conn)
+				if err != nil {
+					s.results <- err.Error()
+					_ = conn.Close()
+					return
+				}
+				s.results <- target
+			}()
+		}
+	}()
+	return s
+}
+
+// readSOCKSString reads a string preceded by its one byte length
+func readSOCKSString(r io.Reader) (string, error) {
+	var length [1]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, length[0])
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// handle authenticates a client and relays its connection to the requested target
+func (s *socks5Server) handle(conn net.Conn) (string, error) {
+	var header [2]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", err
+	}
+	offered := false
+	for _, m := range methods {
+		if m == 0x02 {
+			offered = true
+		}
+	}
+	if !offered {
+		_, _ = conn.Write([]byte{0x05, 0xff})
+		return "", fmt.Errorf("no acceptable authentication method")
+	}
+	_, err = conn.Write([]byte{0x05, 0x02})
+	if err != nil {
+		return "", err
+	}
+	var version [1]byte
+	_, err = io.ReadFull(conn, version[:])
+	if err != nil {
+		return "", err
+	}
+	username, err := readSOCKSString(conn)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSOCKSString(conn)
+	if err != nil {
+		return "", err
+	}
+	if username != s.username || password != s.password {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("authentication failed")
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	if err != nil {
+		return "", err
+	}
+	var request [4]byte
+	_, err = io.ReadFull(conn, request[:])
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch request[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		_, err = io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		host, err = readSOCKSString(conn)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	if err != nil {
+		return "", err
+	}
+	var port [2]byte
+	_, err = io.ReadFull(conn, port[:])
+	if err != nil {
+		return "", err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		_, _ = conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return "", err
+	}
+	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		_ = upstream.Close()
+		return "", err
+	}
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		_ = upstream.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	}()
+	return target, nil
+}
+
+func TestTCPSOCKS5Proxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	socks := newSOCKS5Server(t, "receptor", "secret")
+	defer socks.li.Close()
+
+	li, err := NewTCPListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liSessions, err := li.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := li.Addr().String()
+
+	d, err := NewTCPDialer(addr, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetSOCKS5Proxy(socks.li.Addr().String(), "receptor", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dSessions, err := d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sess := <-dSessions:
+		err = sess.Send([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("dialer did not connect through the proxy")
+	}
+	select {
+	case sess := <-liSessions:
+		data, err := sess.Recv(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("received %q", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("listener did not accept the proxied session")
+	}
+	result := <-socks.results
+	if result != addr {
+		t.Fatalf("proxy connected to %s instead of %s", result, addr)
+	}
+
+	// A wrong password is rejected by the proxy, so the dialer gives up without a session
+	d, err = NewTCPDialer(addr, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetSOCKS5Proxy(socks.li.Addr().String(), "receptor", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dSessions, err = d.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sess, ok := <-dSessions:
+		if ok {
+			_ = sess.Close()
+			t.Fatal("dialer connected through the proxy with a wrong password")
+		}
+	case <-ctx.Done():
+		t.Fatal("dialer did not give up after the proxy rejected it")
+	}
+	result = <-socks.results
+	if result != "authentication failed" {
+		t.Fatalf("expected the proxy to fail authentication, got %q", result)
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/cmdline"
-	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/utils"
 	"net"
 	"sync"
 	"time"
@@ -16,8 +16,9 @@ const UDPMaxPacketLen = 65507
 
 // UDPDialer implements Backend for outbound UDP
 type UDPDialer struct {
-	address string
-	redial  bool
+	address   string
+	redial    bool
+	reconnect ReconnectPolicy
 }
 
 // NewUDPDialer instantiates a new UDPDialer backend
@@ -27,15 +28,21 @@ func NewUDPDialer(address string, redial bool) (*UDPDialer, error) {
 		return nil, err
 	}
 	nd := UDPDialer{
-		address: address,
-		redial:  redial,
+		address:   address,
+		redial:    redial,
+		reconnect: DefaultReconnectPolicy,
 	}
 	return &nd, nil
 }
 
+// SetReconnectPolicy sets how the backend backs off between attempts to redial its peer
+func (b *UDPDialer) SetReconnectPolicy(policy ReconnectPolicy) {
+	b.reconnect = policy
+}
+
 // Start runs the given session function over this backend service
 func (b *UDPDialer) Start(ctx context.Context) (chan netceptor.BackendSession, error) {
-	return dialerSession(ctx, b.redial, 5*time.Second,
+	return dialerSession(ctx, b.redial, b.reconnect,
 		func(closeChan chan struct{}) (netceptor.BackendSession, error) {
 			dialer := net.Dialer{}
 			conn, err := dialer.DialContext(ctx, "udp", b.address)
@@ -105,6 +112,14 @@ func (ns *UDPDialerSession) Close() error {
 	return ns.conn.Close()
 }
 
+// SessionInfo describes the connection of the session
+func (ns *UDPDialerSession) SessionInfo() netceptor.SessionInfo {
+	return netceptor.SessionInfo{
+		Direction:  netceptor.DirectionOutbound,
+		RemoteAddr: ns.conn.RemoteAddr().String(),
+	}
+}
+
 // UDPListener implements Backend for inbound UDP
 type UDPListener struct {
 	laddr           *net.UDPAddr
@@ -156,7 +171,7 @@ func (b *UDPListener) Start(ctx context.Context) (chan netceptor.BackendSession,
 			}
 			err := b.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
 			if err != nil {
-				logger.Error("Error setting UDP timeout: %s\n", err)
+				sublogger.Error("Error setting UDP timeout: %s\n", err)
 				return
 			}
 			n, addr, err := b.conn.ReadFromUDP(buf)
@@ -164,7 +179,7 @@ func (b *UDPListener) Start(ctx context.Context) (chan netceptor.BackendSession,
 				continue
 			}
 			if err != nil {
-				logger.Error("UDP read error: %s\n", err)
+				sublogger.Error("UDP read error: %s\n", err)
 				return
 			}
 			data := make([]byte, n)
@@ -198,7 +213,7 @@ func (b *UDPListener) Start(ctx context.Context) (chan netceptor.BackendSession,
 		}
 	}()
 	if b.conn != nil {
-		logger.Debug("Listening on UDP %s\n", b.LocalAddr().String())
+		sublogger.Debug("Listening on UDP %s\n", b.LocalAddr().String())
 	}
 	return sessChan, nil
 }
@@ -239,42 +254,63 @@ func (ns *UDPListenerSession) Close() error {
 	return nil
 }
 
+// SessionInfo describes the connection of the session
+func (ns *UDPListenerSession) SessionInfo() netceptor.SessionInfo {
+	return netceptor.SessionInfo{
+		Direction:  netceptor.DirectionInbound,
+		RemoteAddr: ns.raddr.String(),
+	}
+}
+
 // **************************************************************************
 // Command line
 // **************************************************************************
 
 // UDPListenerCfg is the cmdline configuration object for a UDP listener
 type UDPListenerCfg struct {
-	BindAddr string             `description:"Local address to bind to" default:"0.0.0.0"`
-	Port     int                `description:"Local UDP port to listen on" barevalue:"yes" required:"yes"`
-	Cost     float64            `description:"Connection cost (weight)" default:"1.0"`
-	NodeCost map[string]float64 `description:"Per-node costs"`
+	BindAddr      string             `description:"Local address to bind to" default:"0.0.0.0"`
+	Port          int                `description:"Local UDP port to listen on" barevalue:"yes" required:"yes"`
+	Cost          float64            `description:"Connection cost (weight)" default:"1.0"`
+	ReceiveCost   float64            `description:"Cost of the peer sending to this node, if different from the connection cost" default:"0"`
+	RateLimit     int                `description:"Maximum bytes per second to send, and to receive, over this backend"`
+	RateBurst     int                `description:"Bytes that may be sent or received at once above the rate limit (default one second's worth)"`
+	BandwidthCost bool               `description:"Derive the connection cost from the rate limit, so routing prefers faster links"`
+	Name          string             `description:"Name used to refer to this backend in control commands"`
+	NodeCost      map[string]float64 `description:"Per-node costs"`
 }
 
 // Prepare verifies the parameters are correct
 func (cfg UDPListenerCfg) Prepare() error {
-	if cfg.Cost <= 0.0 {
-		return fmt.Errorf("connection cost must be positive")
+	_, err := newCosts(cfg.Cost, cfg.ReceiveCost, cfg.NodeCost)
+	if err != nil {
+		return err
 	}
-	for node, cost := range cfg.NodeCost {
-		if cost <= 0.0 {
-			return fmt.Errorf("connection cost must be positive for %s", node)
-		}
+	_, _, err = newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
 // Run runs the action
 func (cfg UDPListenerCfg) Run() error {
-	address := fmt.Sprintf("%s:%d", cfg.BindAddr, cfg.Port)
+	address := utils.JoinHostPort(cfg.BindAddr, cfg.Port)
 	b, err := NewUDPListener(address)
 	if err != nil {
-		logger.Error("Error creating listener %s: %s\n", address, err)
+		sublogger.Error("Error creating listener %s: %s\n", address, err)
+		return err
+	}
+	limit, cost, err := newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	costs, err := newCosts(cost, cfg.ReceiveCost, cfg.NodeCost)
+	if err != nil {
 		return err
 	}
-	err = netceptor.MainInstance.AddBackend(b, cfg.Cost, cfg.NodeCost)
+	err = netceptor.MainInstance.AddBackendWithCosts(cfg.Name, b, costs, limit)
 	if err != nil {
-		logger.Error("Error creating backend for %s: %s\n", address, err)
+		sublogger.Error("Error creating backend for %s: %s\n", address, err)
 		return err
 	}
 	return nil
@@ -282,30 +318,63 @@ func (cfg UDPListenerCfg) Run() error {
 
 // UDPDialerCfg is the cmdline configuration object for a UDP listener
 type UDPDialerCfg struct {
-	Address string  `description:"Host:Port to connect to" barevalue:"yes" required:"yes"`
-	Redial  bool    `description:"Keep redialing on lost connection" default:"true"`
-	Cost    float64 `description:"Connection cost (weight)" default:"1.0"`
+	Address          string  `description:"Host:Port to connect to" barevalue:"yes" required:"yes"`
+	Redial           bool    `description:"Keep redialing on lost connection" default:"true"`
+	RedialDelay      int     `description:"Seconds to wait before the first redial" default:"5"`
+	RedialMaxDelay   int     `description:"Maximum seconds to wait between redials" default:"20"`
+	RedialMultiplier float64 `description:"Factor the redial delay grows by after each attempt" default:"1.5"`
+	RedialJitter     float64 `description:"Fraction by which each redial delay is randomized" default:"0.2"`
+	RedialResetAfter int     `description:"Seconds a connection must stay up for the redial delay to reset" default:"30"`
+	Cost             float64 `description:"Connection cost (weight)" default:"1.0"`
+	ReceiveCost      float64 `description:"Cost of the peer sending to this node, if different from the connection cost" default:"0"`
+	RateLimit        int     `description:"Maximum bytes per second to send, and to receive, over this backend"`
+	RateBurst        int     `description:"Bytes that may be sent or received at once above the rate limit (default one second's worth)"`
+	BandwidthCost    bool    `description:"Derive the connection cost from the rate limit, so routing prefers faster links"`
+	Name             string  `description:"Name used to refer to this backend in control commands"`
 }
 
 // Prepare verifies the parameters are correct
 func (cfg UDPDialerCfg) Prepare() error {
-	if cfg.Cost <= 0.0 {
-		return fmt.Errorf("connection cost must be positive")
+	_, err := newCosts(cfg.Cost, cfg.ReceiveCost, nil)
+	if err != nil {
+		return err
+	}
+	_, err = newReconnectPolicy(cfg.RedialDelay, cfg.RedialMaxDelay, cfg.RedialMultiplier, cfg.RedialJitter, cfg.RedialResetAfter)
+	if err != nil {
+		return err
+	}
+	_, _, err = newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
 // Run runs the action
 func (cfg UDPDialerCfg) Run() error {
-	logger.Debug("Running UDP peer connection %s\n", cfg.Address)
+	sublogger.Debug("Running UDP peer connection %s\n", cfg.Address)
 	b, err := NewUDPDialer(cfg.Address, cfg.Redial)
 	if err != nil {
-		logger.Error("Error creating peer %s: %s\n", cfg.Address, err)
+		sublogger.Error("Error creating peer %s: %s\n", cfg.Address, err)
+		return err
+	}
+	policy, err := newReconnectPolicy(cfg.RedialDelay, cfg.RedialMaxDelay, cfg.RedialMultiplier, cfg.RedialJitter, cfg.RedialResetAfter)
+	if err != nil {
+		return err
+	}
+	b.SetReconnectPolicy(policy)
+	netceptor.MainInstance.AddConfigCheck("backends", addressCheck("udp", cfg.Address))
+	limit, cost, err := newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	costs, err := newCosts(cost, cfg.ReceiveCost, nil)
+	if err != nil {
 		return err
 	}
-	err = netceptor.MainInstance.AddBackend(b, cfg.Cost, nil)
+	err = netceptor.MainInstance.AddBackendWithCosts(cfg.Name, b, costs, limit)
 	if err != nil {
-		logger.Error("Error creating backend for %s: %s\n", cfg.Address, err)
+		sublogger.Error("Error creating backend for %s: %s\n", cfg.Address, err)
 		return err
 	}
 	return nil
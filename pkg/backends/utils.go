@@ -2,30 +2,87 @@ package backends
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
 	"github.com/project-receptor/receptor/pkg/utils"
+	"net"
 	"time"
 )
 
-const (
-	maxRedialDelay = 20 * time.Second
-)
+// sublogger sends the log messages of the backends subsystem
+var sublogger = logger.Named("backends")
+
+// ReconnectPolicy is how a dialing backend backs off between attempts to redial its peer.  The
+// delay starts at InitialDelay and is multiplied by Multiplier after each attempt, up to MaxDelay.
+// Each delay is randomized by up to the Jitter fraction in either direction, so that nodes
+// restarted together do not redial in lockstep.  The delay goes back to InitialDelay once a
+// connection has stayed up for ResetAfter.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64
+	ResetAfter   time.Duration
+}
+
+// DefaultReconnectPolicy is the reconnect policy of dialing backends that are not given one
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: 5 * time.Second,
+	MaxDelay:     20 * time.Second,
+	Multiplier:   1.5,
+	Jitter:       0.2,
+	ResetAfter:   30 * time.Second,
+}
+
+// Validate checks that a reconnect policy makes sense
+func (p ReconnectPolicy) Validate() error {
+	if p.InitialDelay <= 0 {
+		return fmt.Errorf("initial redial delay must be positive")
+	}
+	if p.MaxDelay < p.InitialDelay {
+		return fmt.Errorf("maximum redial delay must not be less than the initial delay")
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("redial delay multiplier must be at least 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("redial jitter must be between 0 and 1")
+	}
+	if p.ResetAfter < 0 {
+		return fmt.Errorf("redial reset time must not be negative")
+	}
+	return nil
+}
+
+// newReconnectPolicy builds a reconnect policy from the redial options of a dialer's configuration
+func newReconnectPolicy(delay int, maxDelay int, multiplier float64, jitter float64, resetAfter int) (ReconnectPolicy, error) {
+	p := ReconnectPolicy{
+		InitialDelay: time.Duration(delay) * time.Second,
+		MaxDelay:     time.Duration(maxDelay) * time.Second,
+		Multiplier:   multiplier,
+		Jitter:       jitter,
+		ResetAfter:   time.Duration(resetAfter) * time.Second,
+	}
+	return p, p.Validate()
+}
 
 type dialerFunc func(chan struct{}) (netceptor.BackendSession, error)
 
 // dialerSession is a convenience function for backends that use dial/retry logic
-func dialerSession(ctx context.Context, redial bool, redialDelay time.Duration,
+func dialerSession(ctx context.Context, redial bool, policy ReconnectPolicy,
 	df dialerFunc) (chan netceptor.BackendSession, error) {
 	sessChan := make(chan netceptor.BackendSession)
 	go func() {
 		defer close(sessChan)
-		redialDelayInc := utils.NewIncrementalDuration(redialDelay, maxRedialDelay, 1.5)
+		redialDelayInc := utils.NewIncrementalDuration(policy.InitialDelay, policy.MaxDelay, policy.Multiplier)
+		redialDelayInc.SetJitter(policy.Jitter)
 		for {
 			closeChan := make(chan struct{})
 			sess, err := df(closeChan)
 			if err == nil {
-				redialDelayInc.Reset()
+				connected := time.Now()
 				select {
 				case sessChan <- sess:
 					// continue
@@ -39,6 +96,10 @@ func dialerSession(ctx context.Context, redial bool, redialDelay time.Duration,
 					_ = sess.Close()
 					return
 				}
+				// A connection that drops straight away counts as a failure, so the backoff continues
+				if time.Since(connected) >= policy.ResetAfter {
+					redialDelayInc.Reset()
+				}
 			}
 			done := false
 			select {
@@ -48,9 +109,9 @@ func dialerSession(ctx context.Context, redial bool, redialDelay time.Duration,
 			}
 			if redial && !done {
 				if err != nil {
-					logger.Warning("Backend connection failed (will retry): %s\n", err)
+					sublogger.Warning("Backend connection failed (will retry): %s\n", err)
 				} else {
-					logger.Warning("Backend connection exited (will retry)\n")
+					sublogger.Warning("Backend connection exited (will retry)\n")
 				}
 				select {
 				case <-redialDelayInc.NextTimeout():
@@ -60,9 +121,9 @@ func dialerSession(ctx context.Context, redial bool, redialDelay time.Duration,
 				}
 			} else {
 				if err != nil {
-					logger.Error("Backend connection failed: %s\n", err)
+					sublogger.Error("Backend connection failed: %s\n", err)
 				} else if !done {
-					logger.Error("Backend connection exited\n")
+					sublogger.Error("Backend connection exited\n")
 				}
 				return
 			}
@@ -95,7 +156,7 @@ func listenerSession(ctx context.Context, lf listenFunc, af acceptFunc, lcf list
 			default:
 			}
 			if err != nil {
-				logger.Error("Error accepting connection: %s\n", err)
+				sublogger.Error("Error accepting connection: %s\n", err)
 				return
 			}
 			select {
@@ -107,3 +168,75 @@ func listenerSession(ctx context.Context, lf listenFunc, af acceptFunc, lcf list
 	}()
 	return sessChan, nil
 }
+
+// addressCheck returns a config check that the remote address of a dialing backend still resolves
+func addressCheck(network string, address string) netceptor.ConfigCheck {
+	return func() []netceptor.ConfigFinding {
+		var err error
+		switch network {
+		case "udp":
+			_, err = net.ResolveUDPAddr(network, address)
+		default:
+			_, err = net.ResolveTCPAddr(network, address)
+		}
+		if err != nil {
+			return []netceptor.ConfigFinding{{
+				Severity: netceptor.FindingError,
+				Message:  fmt.Sprintf("invalid %s peer address %s: %s", network, address, err),
+			}}
+		}
+		return nil
+	}
+}
+
+// newRateLimit builds the rate limit of a backend from its cmdline settings.  If bandwidthCost is
+// set, the returned connection cost is derived from the rate limit instead of being cost.
+func newRateLimit(rateLimit int, rateBurst int, bandwidthCost bool, cost float64) (netceptor.BackendRateLimit, float64, error) {
+	limit := netceptor.BackendRateLimit{
+		BytesPerSec: int64(rateLimit),
+		Burst:       int64(rateBurst),
+	}
+	err := limit.Validate()
+	if err != nil {
+		return limit, 0, err
+	}
+	if bandwidthCost {
+		cost, err = netceptor.BandwidthCost(limit.BytesPerSec)
+		if err != nil {
+			return limit, 0, err
+		}
+	}
+	return limit, cost, nil
+}
+
+// newCosts builds the routing costs of a backend from its cmdline settings
+func newCosts(cost float64, receiveCost float64, nodeCost map[string]float64) (netceptor.BackendCosts, error) {
+	costs := netceptor.BackendCosts{
+		Cost:        cost,
+		ReceiveCost: receiveCost,
+		NodeCost:    nodeCost,
+	}
+	err := costs.Validate()
+	if err != nil {
+		return costs, err
+	}
+	return costs, nil
+}
+
+// connSessionInfo describes a session over a network connection, which may be a TLS connection.
+// Only sessions made by a dialer have a closeChan, so it also gives the direction.
+func connSessionInfo(conn net.Conn, closeChan chan struct{}) netceptor.SessionInfo {
+	si := netceptor.SessionInfo{
+		Direction:  netceptor.DirectionInbound,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if closeChan != nil {
+		si.Direction = netceptor.DirectionOutbound
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if ok {
+		si.TLS = true
+		si.PeerCertificates = tlsConn.ConnectionState().PeerCertificates
+	}
+	return si
+}
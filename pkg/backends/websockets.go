@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/project-receptor/receptor/pkg/cmdline"
-	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/utils"
 	"net"
 	"net/http"
 	"net/url"
@@ -21,6 +21,7 @@ type WebsocketDialer struct {
 	address     string
 	origin      string
 	redial      bool
+	reconnect   ReconnectPolicy
 	tlscfg      *tls.Config
 	extraHeader string
 }
@@ -39,15 +40,21 @@ func NewWebsocketDialer(address string, tlscfg *tls.Config, extraHeader string,
 		address:     address,
 		origin:      fmt.Sprintf("%s://%s", httpScheme, addrURL.Host),
 		redial:      redial,
+		reconnect:   DefaultReconnectPolicy,
 		tlscfg:      tlscfg,
 		extraHeader: extraHeader,
 	}
 	return &wd, nil
 }
 
+// SetReconnectPolicy sets how the backend backs off between attempts to redial its peer
+func (b *WebsocketDialer) SetReconnectPolicy(policy ReconnectPolicy) {
+	b.reconnect = policy
+}
+
 // Start runs the given session function over this backend service
 func (b *WebsocketDialer) Start(ctx context.Context) (chan netceptor.BackendSession, error) {
-	return dialerSession(ctx, b.redial, 5*time.Second,
+	return dialerSession(ctx, b.redial, b.reconnect,
 		func(closeChan chan struct{}) (netceptor.BackendSession, error) {
 			dialer := websocket.Dialer{
 				TLSClientConfig: b.tlscfg,
@@ -71,6 +78,7 @@ func (b *WebsocketDialer) Start(ctx context.Context) (chan netceptor.BackendSess
 // WebsocketListener implements Backend for inbound Websocket
 type WebsocketListener struct {
 	address string
+	path    string
 	tlscfg  *tls.Config
 	li      net.Listener
 	server  *http.Server
@@ -80,12 +88,20 @@ type WebsocketListener struct {
 func NewWebsocketListener(address string, tlscfg *tls.Config) (*WebsocketListener, error) {
 	ul := WebsocketListener{
 		address: address,
+		path:    "/",
 		tlscfg:  tlscfg,
 		li:      nil,
 	}
 	return &ul, nil
 }
 
+// SetPath sets the URL path under which the listener accepts websocket connections, so that it can
+// share a host with other HTTP handlers behind a proxy.  Requests outside the path are answered with
+// 404 Not Found.  The default path is /, which accepts connections on any path.
+func (b *WebsocketListener) SetPath(path string) {
+	b.path = "/" + strings.Trim(path, "/")
+}
+
 // Addr returns the network address the listener is listening on
 func (b *WebsocketListener) Addr() net.Addr {
 	if b.li == nil {
@@ -99,16 +115,21 @@ func (b *WebsocketListener) Start(ctx context.Context) (chan netceptor.BackendSe
 	var err error
 	sessChan := make(chan netceptor.BackendSession)
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
 		var upgrader = websocket.Upgrader{}
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			logger.Error("Error upgrading websocket connection: %s\n", err)
+			sublogger.Error("Error upgrading websocket connection: %s\n", err)
 			return
 		}
 		ws := newWebsocketSession(conn, nil)
 		sessChan <- ws
-	})
+	}
+	mux.HandleFunc(b.path, handler)
+	if b.path != "/" {
+		// Accept the path itself, and anything beneath it
+		mux.HandleFunc(b.path+"/", handler)
+	}
 	b.li, err = net.Listen("tcp", b.address)
 	if err != nil {
 		return nil, err
@@ -126,7 +147,7 @@ func (b *WebsocketListener) Start(ctx context.Context) (chan netceptor.BackendSe
 			err = b.server.ServeTLS(b.li, "", "")
 		}
 		if err != nil && err != http.ErrServerClosed {
-			logger.Error("HTTP server error: %s\n", err)
+			sublogger.Error("HTTP server error: %s\n", err)
 		}
 	}()
 	go func() {
@@ -134,7 +155,7 @@ func (b *WebsocketListener) Start(ctx context.Context) (chan netceptor.BackendSe
 		_ = b.server.Close()
 	}()
 	if err == nil {
-		logger.Debug("Listening on Websocket %s\n", b.Addr().String())
+		sublogger.Debug("Listening on Websocket %s path %s\n", b.Addr().String(), b.path)
 	}
 	return sessChan, nil
 }
@@ -207,45 +228,65 @@ func (ns *WebsocketSession) Close() error {
 	return ns.conn.Close()
 }
 
+// SessionInfo describes the connection of the session
+func (ns *WebsocketSession) SessionInfo() netceptor.SessionInfo {
+	return connSessionInfo(ns.conn.UnderlyingConn(), ns.closeChan)
+}
+
 // **************************************************************************
 // Command line
 // **************************************************************************
 
 // WebsocketListenerCfg is the cmdline configuration object for a websocket listener
 type WebsocketListenerCfg struct {
-	BindAddr string             `description:"Local address to bind to" default:"0.0.0.0"`
-	Port     int                `description:"Local TCP port to run http server on" barevalue:"yes" required:"yes"`
-	TLS      string             `description:"Name of TLS server config"`
-	Cost     float64            `description:"Connection cost (weight)" default:"1.0"`
-	NodeCost map[string]float64 `description:"Per-node costs"`
+	BindAddr      string             `description:"Local address to bind to" default:"0.0.0.0"`
+	Port          int                `description:"Local TCP port to run http server on" barevalue:"yes" required:"yes"`
+	Path          string             `description:"URL path to accept websocket connections on" default:"/"`
+	TLS           string             `description:"Name of TLS server config"`
+	Cost          float64            `description:"Connection cost (weight)" default:"1.0"`
+	ReceiveCost   float64            `description:"Cost of the peer sending to this node, if different from the connection cost" default:"0"`
+	RateLimit     int                `description:"Maximum bytes per second to send, and to receive, over this backend"`
+	RateBurst     int                `description:"Bytes that may be sent or received at once above the rate limit (default one second's worth)"`
+	BandwidthCost bool               `description:"Derive the connection cost from the rate limit, so routing prefers faster links"`
+	Name          string             `description:"Name used to refer to this backend in control commands"`
+	NodeCost      map[string]float64 `description:"Per-node costs"`
 }
 
 // Prepare verifies the parameters are correct
 func (cfg WebsocketListenerCfg) Prepare() error {
-	if cfg.Cost <= 0.0 {
-		return fmt.Errorf("connection cost must be positive")
+	_, err := newCosts(cfg.Cost, cfg.ReceiveCost, cfg.NodeCost)
+	if err != nil {
+		return err
 	}
-	for node, cost := range cfg.NodeCost {
-		if cost <= 0.0 {
-			return fmt.Errorf("connection cost must be positive for %s", node)
-		}
+	_, _, err = newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
 // Run runs the action
 func (cfg WebsocketListenerCfg) Run() error {
-	address := fmt.Sprintf("%s:%d", cfg.BindAddr, cfg.Port)
+	address := utils.JoinHostPort(cfg.BindAddr, cfg.Port)
 	tlscfg, err := netceptor.MainInstance.GetServerTLSConfig(cfg.TLS)
 	if err != nil {
 		return err
 	}
 	b, err := NewWebsocketListener(address, tlscfg)
 	if err != nil {
-		logger.Error("Error creating listener %s: %s\n", address, err)
+		sublogger.Error("Error creating listener %s: %s\n", address, err)
+		return err
+	}
+	b.SetPath(cfg.Path)
+	limit, cost, err := newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	costs, err := newCosts(cost, cfg.ReceiveCost, cfg.NodeCost)
+	if err != nil {
 		return err
 	}
-	err = netceptor.MainInstance.AddBackend(b, cfg.Cost, cfg.NodeCost)
+	err = netceptor.MainInstance.AddBackendWithCosts(cfg.Name, b, costs, limit)
 	if err != nil {
 		return err
 	}
@@ -254,31 +295,50 @@ func (cfg WebsocketListenerCfg) Run() error {
 
 // WebsocketDialerCfg is the cmdline configuration object for a Websocket listener
 type WebsocketDialerCfg struct {
-	Address     string  `description:"URL to connect to" barevalue:"yes" required:"yes"`
-	Redial      bool    `description:"Keep redialing on lost connection" default:"true"`
-	ExtraHeader string  `description:"Sends extra HTTP header on initial connection"`
-	TLS         string  `description:"Name of TLS client config"`
-	Cost        float64 `description:"Connection cost (weight)" default:"1.0"`
+	Address          string  `description:"URL to connect to" barevalue:"yes" required:"yes"`
+	Redial           bool    `description:"Keep redialing on lost connection" default:"true"`
+	RedialDelay      int     `description:"Seconds to wait before the first redial" default:"5"`
+	RedialMaxDelay   int     `description:"Maximum seconds to wait between redials" default:"20"`
+	RedialMultiplier float64 `description:"Factor the redial delay grows by after each attempt" default:"1.5"`
+	RedialJitter     float64 `description:"Fraction by which each redial delay is randomized" default:"0.2"`
+	RedialResetAfter int     `description:"Seconds a connection must stay up for the redial delay to reset" default:"30"`
+	ExtraHeader      string  `description:"Sends extra HTTP header on initial connection"`
+	TLS              string  `description:"Name of TLS client config"`
+	Cost             float64 `description:"Connection cost (weight)" default:"1.0"`
+	ReceiveCost      float64 `description:"Cost of the peer sending to this node, if different from the connection cost" default:"0"`
+	RateLimit        int     `description:"Maximum bytes per second to send, and to receive, over this backend"`
+	RateBurst        int     `description:"Bytes that may be sent or received at once above the rate limit (default one second's worth)"`
+	BandwidthCost    bool    `description:"Derive the connection cost from the rate limit, so routing prefers faster links"`
+	Name             string  `description:"Name used to refer to this backend in control commands"`
 }
 
 // Prepare verifies that we are reasonably ready to go
 func (cfg WebsocketDialerCfg) Prepare() error {
-	if cfg.Cost <= 0.0 {
-		return fmt.Errorf("connection cost must be positive")
+	_, err := newCosts(cfg.Cost, cfg.ReceiveCost, nil)
+	if err != nil {
+		return err
 	}
-	_, err := url.Parse(cfg.Address)
+	_, err = url.Parse(cfg.Address)
 	if err != nil {
 		return fmt.Errorf("address %s is not a valid URL: %s", cfg.Address, err)
 	}
 	if cfg.ExtraHeader != "" && !strings.Contains(cfg.ExtraHeader, ":") {
 		return fmt.Errorf("extra header must be in the form key:value")
 	}
+	_, err = newReconnectPolicy(cfg.RedialDelay, cfg.RedialMaxDelay, cfg.RedialMultiplier, cfg.RedialJitter, cfg.RedialResetAfter)
+	if err != nil {
+		return err
+	}
+	_, _, err = newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 // Run runs the action
 func (cfg WebsocketDialerCfg) Run() error {
-	logger.Debug("Running Websocket peer connection %s\n", cfg.Address)
+	sublogger.Debug("Running Websocket peer connection %s\n", cfg.Address)
 	u, err := url.Parse(cfg.Address)
 	if err != nil {
 		return err
@@ -293,10 +353,31 @@ func (cfg WebsocketDialerCfg) Run() error {
 	}
 	b, err := NewWebsocketDialer(cfg.Address, tlscfg, cfg.ExtraHeader, cfg.Redial)
 	if err != nil {
-		logger.Error("Error creating peer %s: %s\n", cfg.Address, err)
+		sublogger.Error("Error creating peer %s: %s\n", cfg.Address, err)
+		return err
+	}
+	policy, err := newReconnectPolicy(cfg.RedialDelay, cfg.RedialMaxDelay, cfg.RedialMultiplier, cfg.RedialJitter, cfg.RedialResetAfter)
+	if err != nil {
+		return err
+	}
+	b.SetReconnectPolicy(policy)
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	netceptor.MainInstance.AddConfigCheck("backends", addressCheck("tcp", net.JoinHostPort(u.Hostname(), port)))
+	limit, cost, err := newRateLimit(cfg.RateLimit, cfg.RateBurst, cfg.BandwidthCost, cfg.Cost)
+	if err != nil {
+		return err
+	}
+	costs, err := newCosts(cost, cfg.ReceiveCost, nil)
+	if err != nil {
 		return err
 	}
-	err = netceptor.MainInstance.AddBackend(b, cfg.Cost, nil)
+	err = netceptor.MainInstance.AddBackendWithCosts(cfg.Name, b, costs, limit)
 	if err != nil {
 		return err
 	}
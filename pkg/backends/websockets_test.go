@@ -0,0 +1,80 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebsocketPath(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	li, err := NewWebsocketListener("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	li.SetPath("/receptor/")
+	liSessions, err := li.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := li.Addr().String()
+
+	// The backend dialer connects on the path itself and beneath it
+	for _, path := range []string{"/receptor", "/receptor/mesh"} {
+		d, err := NewWebsocketDialer(fmt.Sprintf("ws://%s%s", addr, path), nil, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dSessions, err := d.Start(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case sess := <-dSessions:
+			err = sess.Send([]byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sess.Close()
+		case <-ctx.Done():
+			t.Fatalf("dialer did not connect on path %s", path)
+		}
+		select {
+		case sess := <-liSessions:
+			data, err := sess.Recv(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "hello" {
+				t.Fatalf("received %q on path %s", data, path)
+			}
+			defer sess.Close()
+		case <-ctx.Done():
+			t.Fatalf("listener did not accept a session on path %s", path)
+		}
+	}
+
+	// Other paths, including ones that merely start with the same characters, are not found
+	for _, path := range []string{"/", "/other", "/receptorx"} {
+		conn, resp, err := websocket.DefaultDialer.DialContext(ctx, fmt.Sprintf("ws://%s%s", addr, path), nil)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("websocket connection accepted on path %s", path)
+		}
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404 for a websocket connection on path %s, got %v", path, resp)
+		}
+		resp, err = http.Get(fmt.Sprintf("http://%s%s", addr, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404 for a request on path %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+)
+
+type adcacheCommandType struct{}
+type adcacheCommand struct {
+	subcommand string
+	node       string
+}
+
+func (t *adcacheCommandType) Description() string {
+	return "Inspect or clear the routing advertisement cache of this node"
+}
+
+func (t *adcacheCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no adcache subcommand")
+	}
+	c := &adcacheCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	switch c.subcommand {
+	case "list":
+		if len(tokens) > 1 {
+			return nil, fmt.Errorf("adcache list does not take parameters")
+		}
+	case "clear":
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("adcache clear requires a node ID")
+		}
+		c.node = tokens[1]
+	default:
+		return nil, fmt.Errorf("unknown adcache subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (t *adcacheCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no adcache subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("adcache subcommand must be string")
+	}
+	c := &adcacheCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	switch c.subcommand {
+	case "list":
+	case "clear":
+		node, ok := config["node"]
+		if !ok {
+			return nil, fmt.Errorf("adcache clear requires a node ID")
+		}
+		nodeStr, ok := node.(string)
+		if !ok {
+			return nil, fmt.Errorf("adcache node must be string")
+		}
+		c.node = nodeStr
+	default:
+		return nil, fmt.Errorf("unknown adcache subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+// Mutates returns true when the cache is being cleared
+func (c *adcacheCommand) Mutates() bool {
+	return c.subcommand == "clear"
+}
+
+func (c *adcacheCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	switch c.subcommand {
+	case "list":
+		for _, entry := range nc.AdvertisementCache() {
+			cfr[entry.NodeID] = map[string]interface{}{
+				"Epoch":        entry.Epoch,
+				"Sequence":     entry.Sequence,
+				"LastReceived": entry.LastReceived,
+				"Age":          entry.Age,
+				"AgeStr":       fmt.Sprintf("%s", entry.Age),
+				"ReceivedFrom": entry.ReceivedFrom,
+				"Connections":  entry.Connections,
+			}
+		}
+	case "clear":
+		err := nc.ClearAdvertisement(c.node)
+		if err != nil {
+			cfr["Success"] = false
+			cfr["Error"] = err.Error()
+		} else {
+			cfr["Success"] = true
+		}
+		cfr["Node"] = c.node
+	}
+	return cfr, nil
+}
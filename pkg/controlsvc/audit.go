@@ -0,0 +1,184 @@
+package controlsvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RedactedValue replaces secrets in the parameters of audited commands
+const RedactedValue = "[REDACTED]"
+
+// auditQueueSize is how many records can wait for a slow audit logger before records are dropped
+const auditQueueSize = 1024
+
+// AuditRecord describes a control command that was run, and its outcome
+type AuditRecord struct {
+	Time    time.Time
+	Command string
+	// Params are the parameters of a command sent as a line of text
+	Params string
+	// JSON is the request of a command sent as JSON
+	JSON map[string]interface{}
+	// Listener is the listener the command arrived on, such as unix:<filename> or service:<name>
+	Listener   string
+	RemoteAddr string
+	NodeID     string
+	// PeerCertificate is the subject of the client's verified TLS certificate
+	PeerCertificate string
+	UnixCredentials *UnixCredentials
+	Success         bool
+	Error           string
+}
+
+// AuditLogger records a control command.  It is called in the background, one record at a time.
+type AuditLogger func(record *AuditRecord)
+
+// RedactingCommandType is a ControlCommandType whose parameters can contain secrets, such as keys.
+// Implementing it is optional.  Before a command is audited, Redact is given its text parameters
+// and a copy of its JSON request, either of which may be empty, and returns them with any secrets
+// replaced by RedactedValue.
+type RedactingCommandType interface {
+	ControlCommandType
+	Redact(params string, config map[string]interface{}) (string, map[string]interface{})
+}
+
+// auditQueue passes audit records to an audit logger in the background, so that a slow
+// destination does not hold up the commands being audited
+type auditQueue struct {
+	records chan *AuditRecord
+	stop    chan struct{}
+	dropped uint64
+}
+
+// newAuditQueue starts a queue that passes records to an audit logger
+func newAuditQueue(logger AuditLogger) *auditQueue {
+	aq := &auditQueue{
+		records: make(chan *AuditRecord, auditQueueSize),
+		stop:    make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case <-aq.stop:
+				return
+			case record := <-aq.records:
+				logger(record)
+				dropped := atomic.SwapUint64(&aq.dropped, 0)
+				if dropped > 0 {
+					sublogger.Warning("The audit log could not keep up, so %d records were dropped\n", dropped)
+				}
+			}
+		}
+	}()
+	return aq
+}
+
+// add queues a record, dropping it if the queue is full
+func (aq *auditQueue) add(record *AuditRecord) {
+	select {
+	case aq.records <- record:
+	default:
+		atomic.AddUint64(&aq.dropped, 1)
+	}
+}
+
+// SetAuditLogger sets a function that records every command run on the control service, along
+// with the identity of the client and the outcome.  A nil logger turns auditing off.
+func (s *Server) SetAuditLogger(logger AuditLogger) {
+	s.controlFuncLock.Lock()
+	defer s.controlFuncLock.Unlock()
+	if s.audit != nil {
+		close(s.audit.stop)
+		s.audit = nil
+	}
+	if logger != nil {
+		s.audit = newAuditQueue(logger)
+	}
+}
+
+// auditCommand queues an audit record for a command that has finished
+func (s *Server) auditCommand(ct ControlCommandType, cmd string, params string, config map[string]interface{},
+	connInfo *ConnectionInfo, started time.Time, cfr map[string]interface{}, cmdErr error) {
+	s.controlFuncLock.RLock()
+	audit := s.audit
+	s.controlFuncLock.RUnlock()
+	if audit == nil {
+		return
+	}
+	var configCopy map[string]interface{}
+	if config != nil {
+		configCopy = make(map[string]interface{}, len(config))
+		for k, v := range config {
+			configCopy[k] = v
+		}
+	}
+	if rct, ok := ct.(RedactingCommandType); ok {
+		params, configCopy = rct.Redact(params, configCopy)
+	}
+	record := &AuditRecord{
+		Time:            started,
+		Command:         cmd,
+		Params:          params,
+		JSON:            configCopy,
+		Listener:        connInfo.Listener,
+		RemoteAddr:      connInfo.RemoteAddr,
+		NodeID:          connInfo.NodeID,
+		UnixCredentials: connInfo.UnixCredentials,
+		Success:         cmdErr == nil,
+	}
+	if connInfo.PeerCertificate != nil {
+		record.PeerCertificate = connInfo.PeerCertificate.Subject.String()
+	}
+	if cmdErr != nil {
+		record.Error = cmdErr.Error()
+	} else if success, ok := cfr["Success"].(bool); ok && !success {
+		record.Success = false
+		record.Error = fmt.Sprintf("%v", cfr["Error"])
+	}
+	audit.add(record)
+}
+
+// RedactTokens returns a copy of the text parameters of a command, with the tokens at the given
+// positions replaced by RedactedValue
+func RedactTokens(params string, positions ...int) string {
+	tokens := strings.Fields(params)
+	for _, pos := range positions {
+		if pos < len(tokens) {
+			tokens[pos] = RedactedValue
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// RedactFields replaces the values of the given fields of a JSON request with RedactedValue
+func RedactFields(config map[string]interface{}, fields ...string) map[string]interface{} {
+	for _, field := range fields {
+		if _, ok := config[field]; ok {
+			config[field] = RedactedValue
+		}
+	}
+	return config
+}
+
+// NewAuditFileLogger returns an audit logger that appends each record to a file as a line of JSON
+func NewAuditFileLogger(filename string) (AuditLogger, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %s", err)
+	}
+	return func(record *AuditRecord) {
+		data, err := json.Marshal(record)
+		if err != nil {
+			sublogger.Error("Error encoding audit record: %s\n", err)
+			return
+		}
+		_, err = f.Write(append(data, '\n'))
+		if err != nil {
+			sublogger.Error("Error writing audit log: %s\n", err)
+		}
+	}, nil
+}
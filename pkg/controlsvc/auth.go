@@ -0,0 +1,145 @@
+package controlsvc
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"net"
+	"strings"
+)
+
+// ConnectionInfo describes the client connection that a control command arrived on
+type ConnectionInfo struct {
+	// Listener is the listener the connection arrived on, such as unix:<filename> or service:<name>
+	Listener string
+	// RemoteAddr is the address of the client, if known
+	RemoteAddr string
+	// PeerCertificate is the verified TLS certificate of the client.  It is nil if the connection
+	// did not use TLS, as with Unix sockets, or if the client did not present a certificate.
+	PeerCertificate *x509.Certificate
+	// PeerChain is the verified certificate chain of the client, starting with PeerCertificate
+	PeerChain []*x509.Certificate
+	// NodeID is the node the client connected from, for connections over the Receptor network
+	NodeID string
+	// UnixCredentials are the credentials of the client process, for Unix socket connections on
+	// platforms that support them
+	UnixCredentials *UnixCredentials
+}
+
+// UnixCredentials are the credentials of the process at the other end of a Unix socket
+type UnixCredentials struct {
+	PID int
+	UID int
+	GID int
+}
+
+// newConnectionInfo collects the metadata of a control service connection
+func newConnectionInfo(conn net.Conn, listener string) *ConnectionInfo {
+	info := &ConnectionInfo{
+		Listener: listener,
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		info.RemoteAddr = addr.String()
+	}
+	switch c := conn.(type) {
+	case *netceptor.Conn:
+		info.PeerChain = c.VerifiedPeerChain()
+		info.PeerCertificate = c.VerifiedPeerCertificate()
+		addr, ok := c.RemoteAddr().(netceptor.Addr)
+		if ok {
+			info.NodeID = addr.Node()
+		}
+	case *net.UnixConn:
+		info.UnixCredentials = peerCredentials(c)
+	}
+	return info
+}
+
+// AuthRequest is a control command that is waiting to be authorized
+type AuthRequest struct {
+	// Command is the name of the command
+	Command string
+	// Params are the parameters of a command sent as a line of text
+	Params string
+	// JSON is the request of a command sent as JSON, or nil for a command sent as text
+	JSON map[string]interface{}
+	// Conn describes the connection the command arrived on
+	Conn *ConnectionInfo
+}
+
+// Authorizer decides whether a control command is permitted to run
+type Authorizer func(req *AuthRequest) bool
+
+// errPermissionDenied is returned to clients that run a command they are not authorized for
+var errPermissionDenied = fmt.Errorf("permission denied")
+
+// errMaintenanceMode is returned to clients that run a command that would change the node while it
+// is in maintenance mode
+var errMaintenanceMode = fmt.Errorf("node is in maintenance mode")
+
+// MutatingCommand is a ControlCommand that can change the configuration or state of the node.
+// Implementing it is optional.  While the node is in maintenance mode, commands whose Mutates
+// method returns true are refused, so the node is not changed underneath the operator working on
+// it.  The command that turns maintenance mode off must not report itself as mutating.
+type MutatingCommand interface {
+	ControlCommand
+	Mutates() bool
+}
+
+// checkMaintenance returns an error if a command would change the node while it is in maintenance mode
+func checkMaintenance(nc *netceptor.Netceptor, cc ControlCommand) error {
+	mc, ok := cc.(MutatingCommand)
+	if ok && mc.Mutates() && nc.MaintenanceMode() {
+		return errMaintenanceMode
+	}
+	return nil
+}
+
+// SetAuthorizer sets an authorizer that is consulted for every command.  Commands added with
+// their own authorizer must be permitted by both.  A nil authorizer permits every command.
+func (s *Server) SetAuthorizer(auth Authorizer) {
+	s.controlFuncLock.Lock()
+	defer s.controlFuncLock.Unlock()
+	s.authorizer = auth
+}
+
+// AddControlFuncWithAuth registers a function that can be used from a control socket, but only
+// runs when the authorizer permits it
+func (s *Server) AddControlFuncWithAuth(name string, cType ControlCommandType, auth Authorizer) error {
+	s.controlFuncLock.Lock()
+	defer s.controlFuncLock.Unlock()
+	_, ok := s.controlTypes[name]
+	if ok {
+		return fmt.Errorf("control function named %s already exists", name)
+	}
+	s.controlTypes[name] = cType
+	if auth != nil {
+		s.controlAuth[name] = auth
+	}
+	return nil
+}
+
+// authorize returns an error if a command is not permitted by the authorizers that apply to it,
+// including that of the listener it arrived on
+func (s *Server) authorize(req *AuthRequest, listenerAuth Authorizer) error {
+	s.controlFuncLock.RLock()
+	authorizers := []Authorizer{s.authorizer, s.controlAuth[req.Command], listenerAuth}
+	s.controlFuncLock.RUnlock()
+	for _, auth := range authorizers {
+		if auth != nil && !auth(req) {
+			return errPermissionDenied
+		}
+	}
+	return nil
+}
+
+// AllowCommands returns an authorizer that only permits the named commands
+func AllowCommands(commands []string) Authorizer {
+	allowed := make(map[string]bool)
+	for _, cmd := range commands {
+		allowed[strings.ToLower(strings.TrimSpace(cmd))] = true
+	}
+	return func(req *AuthRequest) bool {
+		return allowed[req.Command]
+	}
+}
@@ -0,0 +1,96 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+)
+
+type backendCommandType struct{}
+type backendCommand struct {
+	subcommand string
+	name       string
+}
+
+func (t *backendCommandType) Description() string {
+	return "List or manage the backends of this node"
+}
+
+func (t *backendCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no backend subcommand")
+	}
+	c := &backendCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	switch c.subcommand {
+	case "list":
+		if len(tokens) > 1 {
+			return nil, fmt.Errorf("backend list does not take parameters")
+		}
+	case "enable", "disable":
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("backend %s requires a backend name", c.subcommand)
+		}
+		c.name = tokens[1]
+	default:
+		return nil, fmt.Errorf("unknown backend subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (t *backendCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no backend subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("backend subcommand must be string")
+	}
+	c := &backendCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	switch c.subcommand {
+	case "list":
+	case "enable", "disable":
+		name, ok := config["name"]
+		if !ok {
+			return nil, fmt.Errorf("backend %s requires a backend name", c.subcommand)
+		}
+		nameStr, ok := name.(string)
+		if !ok {
+			return nil, fmt.Errorf("backend name must be string")
+		}
+		c.name = nameStr
+	default:
+		return nil, fmt.Errorf("unknown backend subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+// Mutates returns true for the subcommands that enable or disable a backend
+func (c *backendCommand) Mutates() bool {
+	return c.subcommand != "list"
+}
+
+func (c *backendCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	switch c.subcommand {
+	case "list":
+		for _, bs := range nc.BackendStatus() {
+			cfr[bs.Name] = bs
+		}
+	case "enable", "disable":
+		err := nc.SetBackendEnabled(c.name, c.subcommand == "enable")
+		if err != nil {
+			cfr["Success"] = false
+			cfr["Error"] = err.Error()
+		} else {
+			cfr["Success"] = true
+		}
+		cfr["Name"] = c.name
+	}
+	return cfr, nil
+}
@@ -0,0 +1,57 @@
+package controlsvc
+
+import (
+	"fmt"
+	"sync"
+)
+
+// bridgeRegistry counts the bridged connections opened through the control service, per target service
+type bridgeRegistry struct {
+	lock   *sync.RWMutex
+	limit  int
+	active map[string]int
+}
+
+// newBridgeRegistry allocates a new bridgeRegistry.  A limit of zero means no limit.
+func newBridgeRegistry(limit int) *bridgeRegistry {
+	return &bridgeRegistry{
+		lock:   &sync.RWMutex{},
+		limit:  limit,
+		active: make(map[string]int),
+	}
+}
+
+// setLimit changes the per-service limit.  Bridges already open are not affected.
+func (br *bridgeRegistry) setLimit(limit int) {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	br.limit = limit
+}
+
+// acquire registers a new bridge to a service, returning an error if the service is at its limit
+func (br *bridgeRegistry) acquire(service string) error {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if br.limit > 0 && br.active[service] >= br.limit {
+		return fmt.Errorf("too many connections to %s (limit %d)", service, br.limit)
+	}
+	br.active[service]++
+	return nil
+}
+
+// release unregisters a bridge to a service
+func (br *bridgeRegistry) release(service string) {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	br.active[service]--
+	if br.active[service] <= 0 {
+		delete(br.active, service)
+	}
+}
+
+// count returns the number of open bridges to a service
+func (br *bridgeRegistry) count(service string) int {
+	br.lock.RLock()
+	defer br.lock.RUnlock()
+	return br.active[service]
+}
@@ -0,0 +1,153 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type chaosCommandType struct{}
+type chaosCommand struct {
+	subcommand string
+	backend    string
+	rate       float64
+	latency    time.Duration
+}
+
+// requiredChaosParams returns how many parameters, including the backend name, a chaos subcommand takes
+func requiredChaosParams(subcommand string) (int, error) {
+	switch subcommand {
+	case "list":
+		return 0, nil
+	case "fail", "clear":
+		return 1, nil
+	case "drop", "latency":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown chaos subcommand %s", subcommand)
+}
+
+func (t *chaosCommandType) Description() string {
+	return "Inject faults into backends, for resilience testing"
+}
+
+func (t *chaosCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no chaos subcommand")
+	}
+	c := &chaosCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	nParams, err := requiredChaosParams(c.subcommand)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens)-1 != nParams {
+		return nil, fmt.Errorf("chaos %s requires %d parameters", c.subcommand, nParams)
+	}
+	if nParams > 0 {
+		c.backend = tokens[1]
+	}
+	switch c.subcommand {
+	case "drop":
+		c.rate, err = strconv.ParseFloat(tokens[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid drop rate %s", tokens[2])
+		}
+	case "latency":
+		c.latency, err = time.ParseDuration(tokens[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency %s", tokens[2])
+		}
+	}
+	return c, nil
+}
+
+func (t *chaosCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no chaos subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("chaos subcommand must be string")
+	}
+	c := &chaosCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	nParams, err := requiredChaosParams(c.subcommand)
+	if err != nil {
+		return nil, err
+	}
+	if nParams > 0 {
+		c.backend, ok = config["backend"].(string)
+		if !ok {
+			return nil, fmt.Errorf("chaos %s requires string parameter backend", c.subcommand)
+		}
+	}
+	switch c.subcommand {
+	case "drop":
+		c.rate, ok = config["rate"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("chaos drop requires numeric parameter rate")
+		}
+	case "latency":
+		latencyStr, ok := config["latency"].(string)
+		if !ok {
+			return nil, fmt.Errorf("chaos latency requires string parameter latency")
+		}
+		c.latency, err = time.ParseDuration(latencyStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency %s", latencyStr)
+		}
+	}
+	return c, nil
+}
+
+// Mutates returns true for the subcommands that inject or clear faults
+func (c *chaosCommand) Mutates() bool {
+	return c.subcommand != "list"
+}
+
+func (c *chaosCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	if c.subcommand == "list" {
+		cfr["Enabled"] = nc.ChaosEnabled()
+		faults := make(map[string]interface{})
+		for name, f := range nc.BackendFaults() {
+			faults[name] = map[string]interface{}{
+				"DropRate":   f.DropRate,
+				"Latency":    f.Latency,
+				"LatencyStr": f.Latency.String(),
+				"Fail":       f.Fail,
+			}
+		}
+		cfr["Faults"] = faults
+		return cfr, nil
+	}
+	var err error
+	if c.subcommand == "clear" {
+		err = nc.ClearBackendFault(c.backend)
+	} else {
+		fault := nc.BackendFaults()[c.backend]
+		switch c.subcommand {
+		case "drop":
+			fault.DropRate = c.rate
+		case "latency":
+			fault.Latency = c.latency
+		case "fail":
+			fault.Fail = true
+		}
+		err = nc.SetBackendFault(c.backend, fault)
+	}
+	if err != nil {
+		cfr["Success"] = false
+		cfr["Error"] = err.Error()
+	} else {
+		cfr["Success"] = true
+	}
+	return cfr, nil
+}
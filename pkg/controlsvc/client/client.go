@@ -0,0 +1,517 @@
+// Package client is a Go client for the protocol of the Receptor control service.
+package client
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/controlsvc"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/utils"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandError is an error reported by the control service in response to a command
+type CommandError struct {
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return e.Message
+}
+
+// Client is a session with a control service.  It runs one command at a time.
+type Client struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	greeting   *controlsvc.Greeting
+	lock       *sync.Mutex
+	takenOver  bool
+	closeOnce  sync.Once
+	closeError error
+}
+
+// New starts a client session on a connection to a control service, reading the service's greeting
+func New(conn net.Conn) (*Client, error) {
+	c := &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		lock:   &sync.Mutex{},
+	}
+	line, err := readLine(c.reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading control service greeting: %s", err)
+	}
+	c.greeting, err = controlsvc.ParseGreeting(line)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialUnix connects to a control service listening on a Unix socket, which may be an abstract
+// socket named @name
+func DialUnix(filename string) (*Client, error) {
+	conn, err := utils.UnixSocketDial(filename)
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialNetceptor connects to a control service running as a Receptor service on a node
+func DialNetceptor(ctx context.Context, nc *netceptor.Netceptor, node string, service string, tlscfg *tls.Config) (*Client, error) {
+	conn, err := nc.DialContext(ctx, node, service, tlscfg)
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NodeID returns the ID of the node the control service runs on, from its greeting
+func (c *Client) NodeID() string {
+	return c.greeting.NodeID
+}
+
+// ProtocolVersion returns the version of the control protocol the service speaks, from its greeting
+func (c *Client) ProtocolVersion() int {
+	return c.greeting.ProtocolVersion
+}
+
+// HasCapability returns true if the control service listed a capability, such as
+// controlsvc.CapabilityFraming, in its greeting.  Services only list their capabilities if they
+// are configured to, so a missing capability does not mean the service lacks it.
+func (c *Client) HasCapability(capability string) bool {
+	return c.greeting.HasCapability(capability)
+}
+
+// Close ends the session
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeError = c.conn.Close()
+	})
+	return c.closeError
+}
+
+// readLine reads a line, without its newline
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readBlock reads the data following a header line giving its length, such as "GZIP 123"
+func readBlock(r *bufio.Reader, header string, prefix string) ([]byte, error) {
+	length, err := strconv.Atoi(strings.TrimPrefix(header, prefix))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid response header %q", header)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// gzipBlocks reads the data of a compressed response, which is sent as a series of "GZIP <length>"
+// blocks ending with "GZIP 0"
+type gzipBlocks struct {
+	r       *bufio.Reader
+	pending []byte
+	ended   bool
+}
+
+// Read returns the data of the blocks, and io.EOF once the last block has been read
+func (b *gzipBlocks) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.ended {
+			return 0, io.EOF
+		}
+		header, err := readLine(b.r)
+		if err != nil {
+			return 0, err
+		}
+		if !strings.HasPrefix(header, "GZIP ") {
+			return 0, fmt.Errorf("invalid response header %q", header)
+		}
+		b.pending, err = readBlock(b.r, header, "GZIP ")
+		if err != nil {
+			return 0, err
+		}
+		b.ended = len(b.pending) == 0
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+// readResponse reads a response in any of the encodings and compressions of the protocol.  An error
+// line is returned as a CommandError.
+func readResponse(r *bufio.Reader) (map[string]interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(line, "ERROR: "):
+		return nil, &CommandError{Message: strings.TrimPrefix(line, "ERROR: ")}
+	case strings.HasPrefix(line, "GZIP "):
+		blocks := &gzipBlocks{r: r}
+		blocks.pending, err = readBlock(r, line, "GZIP ")
+		if err != nil {
+			return nil, err
+		}
+		blocks.ended = len(blocks.pending) == 0
+		gr, err := gzip.NewReader(blocks)
+		if err != nil {
+			return nil, err
+		}
+		cfr, err := readResponse(bufio.NewReader(gr))
+		if err != nil {
+			return nil, err
+		}
+		// Read up to the end of the blocks, so the next response starts after them
+		_, err = io.Copy(ioutil.Discard, gr)
+		if err != nil {
+			return nil, err
+		}
+		return cfr, nil
+	case strings.HasPrefix(line, "MSGPACK "):
+		data, err := readBlock(r, line, "MSGPACK ")
+		if err != nil {
+			return nil, err
+		}
+		cfr := make(map[string]interface{})
+		err = msgpack.Unmarshal(data, &cfr)
+		if err != nil {
+			return nil, err
+		}
+		return cfr, nil
+	}
+	cfr := make(map[string]interface{})
+	err = json.Unmarshal([]byte(line), &cfr)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected response from control service: %q", line)
+	}
+	return cfr, nil
+}
+
+// send writes a command as a line of JSON
+func (c *Client) send(name string, params map[string]interface{}) error {
+	if c.takenOver {
+		return fmt.Errorf("the session has been taken over by a connect command")
+	}
+	request := make(map[string]interface{}, len(params)+1)
+	for k, v := range params {
+		request[k] = v
+	}
+	request["command"] = name
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+// commandFailure returns a CommandError if a response reports that its command failed
+func commandFailure(cfr map[string]interface{}) error {
+	success, ok := cfr["Success"].(bool)
+	if !ok || success {
+		return nil
+	}
+	message, _ := cfr["Error"].(string)
+	if message == "" {
+		message = "command failed"
+	}
+	return &CommandError{Message: message}
+}
+
+// Command runs a command, with its parameters sent as JSON, and returns its response.  If the
+// command fails, the error is a CommandError, and the response is returned as well if there was one.
+func (c *Client) Command(name string, params map[string]interface{}) (map[string]interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.send(name, params)
+	if err != nil {
+		return nil, err
+	}
+	cfr, err := readResponse(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	return cfr, commandFailure(cfr)
+}
+
+// CommandStream runs a streaming command, such as work tail, calling frameFunc with each frame it
+// sends, and returns its final response.  If frameFunc returns an error, the session is closed,
+// which stops the command.
+func (c *Client) CommandStream(name string, params map[string]interface{},
+	frameFunc func(frame map[string]interface{}) error) (map[string]interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.send(name, params)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		cfr, err := readResponse(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		complete, _ := cfr[controlsvc.StreamCompleteKey].(bool)
+		if complete {
+			return cfr, commandFailure(cfr)
+		}
+		err = frameFunc(cfr)
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+}
+
+// decodeResponse converts a response to a typed result
+func decodeResponse(cfr map[string]interface{}, result interface{}) error {
+	data, err := json.Marshal(cfr)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
+// PingResult is the reply to a ping
+type PingResult struct {
+	// From is the node that replied
+	From string
+	// Time is the round trip time
+	Time time.Duration
+	// TimeStr is the round trip time as text
+	TimeStr string
+}
+
+// Ping pings a node from the node the control service runs on
+func (c *Client) Ping(node string) (*PingResult, error) {
+	cfr, err := c.Command("ping", map[string]interface{}{"target": node})
+	if err != nil {
+		return nil, err
+	}
+	result := &PingResult{}
+	err = decodeResponse(cfr, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PingStats is the outcome of a series of pings
+type PingStats struct {
+	// Target is the node that was pinged
+	Target string
+	// Sent is the number of probes sent
+	Sent int
+	// Received is the number of probes that got a reply
+	Received int
+	// Loss is the percentage of probes that got no reply
+	Loss float64
+	// MinTime is the shortest round trip time
+	MinTime time.Duration
+	// AvgTime is the average round trip time
+	AvgTime time.Duration
+	// MaxTime is the longest round trip time
+	MaxTime time.Duration
+	// StdDevTime is the standard deviation of the round trip times
+	StdDevTime time.Duration
+}
+
+// PingSeries pings a node count times, interval apart, calling probeFunc with the result of each
+// probe as it arrives, if it is not nil.  A probe that gets no reply is passed with its error.
+func (c *Client) PingSeries(node string, count int, interval time.Duration,
+	probeFunc func(seq int, result *PingResult, err error)) (*PingStats, error) {
+	params := map[string]interface{}{
+		"target":   node,
+		"count":    count,
+		"interval": interval.String(),
+		"frames":   true,
+	}
+	cfr, err := c.CommandStream("ping", params, func(frame map[string]interface{}) error {
+		if probeFunc == nil {
+			return nil
+		}
+		seq, _ := frame["Seq"].(float64)
+		result := &PingResult{}
+		err := decodeResponse(frame, result)
+		if err != nil {
+			return err
+		}
+		var probeErr error
+		if message, ok := frame["Error"].(string); ok {
+			probeErr = &CommandError{Message: message}
+		}
+		probeFunc(int(seq), result, probeErr)
+		return nil
+	})
+	if cfr == nil {
+		return nil, err
+	}
+	stats := &PingStats{}
+	decodeErr := decodeResponse(cfr, stats)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return stats, err
+}
+
+// Status returns the status of the node the control service runs on, and of the network
+func (c *Client) Status() (*netceptor.Status, error) {
+	cfr, err := c.Command("status", nil)
+	if err != nil {
+		return nil, err
+	}
+	status := &netceptor.Status{}
+	err = decodeResponse(cfr, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// TracerouteHop is one hop of a traceroute
+type TracerouteHop struct {
+	// Hop is the number of hops from the node the control service runs on
+	Hop int
+	// From is the node that replied
+	From string
+	// Time is the average round trip time to the node
+	Time time.Duration
+	// TimeStr is the average round trip time as text
+	TimeStr string
+	// MinTime is the shortest round trip time to the node
+	MinTime time.Duration
+	// MinTimeStr is the shortest round trip time as text
+	MinTimeStr string
+	// MaxTime is the longest round trip time to the node
+	MaxTime time.Duration
+	// MaxTimeStr is the longest round trip time as text
+	MaxTimeStr string
+	// Probes is the number of probes sent to the hop
+	Probes int
+	// Lost is the number of probes that got no reply
+	Lost int
+	// MTU is the largest message the hop's links carry, if it replied
+	MTU int
+	// Error is the error the hop reported, if it got no reply or the trace ended with one
+	Error string
+}
+
+// Traceroute traces the route to a node, returning the hops in order
+func (c *Client) Traceroute(node string) ([]*TracerouteHop, error) {
+	return c.TracerouteProbes(node, 0, 0)
+}
+
+// TracerouteProbes traces the route to a node, sending count probes to each hop and waiting up to
+// hopTimeout for each reply.  A count or hopTimeout of zero uses the server's default.
+func (c *Client) TracerouteProbes(node string, count int, hopTimeout time.Duration) ([]*TracerouteHop, error) {
+	params := map[string]interface{}{"target": node}
+	if count > 0 {
+		params["count"] = count
+	}
+	if hopTimeout > 0 {
+		params["hoptimeout"] = hopTimeout.String()
+	}
+	cfr, err := c.Command("traceroute", params)
+	if err != nil {
+		return nil, err
+	}
+	hops := make([]*TracerouteHop, 0, len(cfr))
+	for key, value := range cfr {
+		hopNum, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		valueMap, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid traceroute hop %s", key)
+		}
+		hop := &TracerouteHop{}
+		err = decodeResponse(valueMap, hop)
+		if err != nil {
+			return nil, err
+		}
+		hop.Hop = hopNum
+		hops = append(hops, hop)
+	}
+	sort.Slice(hops, func(i, j int) bool {
+		return hops[i].Hop < hops[j].Hop
+	})
+	return hops, nil
+}
+
+// bufferedConn is a connection whose reads start with data already buffered from it
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.reader.Read(b)
+}
+
+// Connect connects the session to a service on a node, using the named TLS client config of the
+// node the control service runs on, if tlsName is not empty.  The returned connection carries the
+// data of the service, and the client cannot run any more commands.  Closing the connection
+// closes the client.
+func (c *Client) Connect(node string, service string, tlsName string) (net.Conn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	params := map[string]interface{}{
+		"node":    node,
+		"service": service,
+	}
+	if tlsName != "" {
+		params["tls"] = tlsName
+	}
+	err := c.send("connect", params)
+	if err != nil {
+		return nil, err
+	}
+	line, err := readLine(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(line, "ERROR: ") {
+		return nil, &CommandError{Message: strings.TrimPrefix(line, "ERROR: ")}
+	}
+	if line != "Connecting" {
+		return nil, fmt.Errorf("unexpected response to connect: %q", line)
+	}
+	c.takenOver = true
+	return &bufferedConn{
+		Conn:   c.conn,
+		reader: c.reader,
+	}, nil
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/controlsvc"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// countCommandType is a streaming control command that sends a number of frames
+type countCommandType struct{}
+
+func (t *countCommandType) InitFromString(params string) (controlsvc.ControlCommand, error) {
+	return t, nil
+}
+
+func (t *countCommandType) InitFromJSON(config map[string]interface{}) (controlsvc.ControlCommand, error) {
+	return t, nil
+}
+
+func (t *countCommandType) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.ControlFuncOperations) (map[string]interface{}, error) {
+	return controlsvc.CollectFrames(t, nc, cfo)
+}
+
+func (t *countCommandType) StreamFunc(nc *netceptor.Netceptor, cfo controlsvc.ControlFuncOperations,
+	frames chan<- map[string]interface{}) (map[string]interface{}, error) {
+	for i := 0; i < 3; i++ {
+		frames <- map[string]interface{}{"Count": i}
+	}
+	return map[string]interface{}{"Total": 3}, nil
+}
+
+func newTestClient(t *testing.T, s *controlsvc.Server) *Client {
+	server, client := net.Pipe()
+	go s.RunControlSession(server)
+	c, err := New(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := controlsvc.New(true, nc)
+	err := s.AddControlFunc("count", &countCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+	defer c.Close()
+	if c.NodeID() != "node1" {
+		t.Fatalf("unexpected node ID %s from greeting", c.NodeID())
+	}
+	if c.ProtocolVersion() != controlsvc.ProtocolVersion || c.HasCapability(controlsvc.CapabilityFraming) {
+		t.Fatalf("unexpected protocol version %d from greeting", c.ProtocolVersion())
+	}
+	s.SetGreetingCapabilities(true)
+	capsClient := newTestClient(t, s)
+	defer capsClient.Close()
+	if capsClient.NodeID() != "node1" || !capsClient.HasCapability(controlsvc.CapabilityStreaming) {
+		t.Fatal("greeting did not list the capabilities of the service")
+	}
+
+	status, err := c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.NodeID != "node1" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	ping, err := c.Ping("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping.From != "node1" || ping.Time <= 0 || ping.TimeStr == "" {
+		t.Fatalf("unexpected ping result %+v", ping)
+	}
+
+	probes := 0
+	stats, err := c.PingSeries("node1", 2, 10*time.Millisecond, func(seq int, result *PingResult, err error) {
+		if seq == probes && err == nil && result.From == "node1" {
+			probes++
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probes != 2 || stats.Sent != 2 || stats.Received != 2 || stats.Loss != 0 || stats.MaxTime <= 0 {
+		t.Fatalf("unexpected ping series result %+v after %d probes", stats, probes)
+	}
+
+	hops, err := c.Traceroute("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 1 || hops[0].Hop != 0 || hops[0].From != "node1" || hops[0].Error != "" {
+		t.Fatalf("unexpected traceroute result %+v", hops)
+	}
+
+	_, err = c.Command("bogus", nil)
+	if _, ok := err.(*CommandError); !ok {
+		t.Fatalf("expected a command error for an unknown command, got %v", err)
+	}
+	_, err = c.Command("loglevel", map[string]interface{}{"level": "verbose"})
+	if _, ok := err.(*CommandError); !ok {
+		t.Fatalf("expected a command error for an invalid parameter, got %v", err)
+	}
+
+	_, err = c.Command("status", map[string]interface{}{"compression": "gzip"})
+	if _, ok := err.(*CommandError); !ok {
+		t.Fatalf("expected a command error for compression that was not offered, got %v", err)
+	}
+	cfr, err := capsClient.Command("status", map[string]interface{}{"encoding": "msgpack", "compression": "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["NodeID"] != "node1" {
+		t.Fatalf("unexpected compressed msgpack response %v", cfr)
+	}
+	cfr, err = capsClient.Command("status", map[string]interface{}{"compression": "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["NodeID"] != "node1" {
+		t.Fatalf("unexpected compressed response %v", cfr)
+	}
+
+	counts := make([]interface{}, 0)
+	cfr, err = c.CommandStream("count", nil, func(frame map[string]interface{}) error {
+		counts = append(counts, frame["Count"])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 3 || counts[2] != float64(2) || cfr["Total"] != float64(3) {
+		t.Fatalf("unexpected stream: frames %v, response %v", counts, cfr)
+	}
+}
+
+func TestClientConnect(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	li, err := nc.ListenAndAdvertise("echo", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	s := controlsvc.New(true, nc)
+	c := newTestClient(t, s)
+	defer c.Close()
+
+	_, err = c.Connect("node1", "nonexistent", "")
+	if err == nil {
+		t.Fatal("connected to a service that does not exist")
+	}
+	conn, err := c.Connect("node1", "echo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected echo %q", buf)
+	}
+	_, err = c.Status()
+	if err == nil {
+		t.Fatal("ran a command after the session was taken over")
+	}
+}
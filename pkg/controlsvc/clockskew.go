@@ -0,0 +1,61 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"time"
+)
+
+// defaultClockSkewTimeout is how long clockskew waits for a reply, unless the command is cancelled first
+const defaultClockSkewTimeout = 10 * time.Second
+
+type clockskewCommandType struct{}
+type clockskewCommand struct {
+	target string
+}
+
+func (t *clockskewCommandType) Description() string {
+	return "Estimate the clock skew between this node and a remote node"
+}
+
+func (t *clockskewCommandType) InitFromString(params string) (ControlCommand, error) {
+	if params == "" {
+		return nil, fmt.Errorf("no clockskew target")
+	}
+	c := &clockskewCommand{
+		target: params,
+	}
+	return c, nil
+}
+
+func (t *clockskewCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	target, ok := config["target"]
+	if !ok {
+		return nil, fmt.Errorf("no clockskew target")
+	}
+	targetStr, ok := target.(string)
+	if !ok {
+		return nil, fmt.Errorf("clockskew target must be string")
+	}
+	c := &clockskewCommand{
+		target: targetStr,
+	}
+	return c, nil
+}
+
+func (c *clockskewCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	offset, rtt, err := nc.MeasureClockSkew(commandContext(cfo), c.target, defaultClockSkewTimeout)
+	cfr := make(map[string]interface{})
+	if err == nil {
+		cfr["Success"] = true
+		cfr["From"] = c.target
+		cfr["Skew"] = offset
+		cfr["SkewStr"] = fmt.Sprintf("%s", offset)
+		cfr["RTT"] = rtt
+		cfr["RTTStr"] = fmt.Sprintf("%s", rtt)
+	} else {
+		cfr["Success"] = false
+		cfr["Error"] = err.Error()
+	}
+	return cfr, nil
+}
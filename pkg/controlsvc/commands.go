@@ -0,0 +1,65 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"sort"
+	"strings"
+)
+
+type commandsCommandType struct {
+	s *Server
+}
+type commandsCommand struct {
+	s *Server
+}
+
+func (t *commandsCommandType) Description() string {
+	return "List the commands available on this control service"
+}
+
+func (t *commandsCommandType) InitFromString(params string) (ControlCommand, error) {
+	if strings.TrimSpace(params) != "" {
+		return nil, fmt.Errorf("commands does not take parameters")
+	}
+	return &commandsCommand{s: t.s}, nil
+}
+
+func (t *commandsCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return &commandsCommand{s: t.s}, nil
+}
+
+// CommandDescriptions returns the names of the registered control commands, with the description
+// of each command that provides one
+func (s *Server) CommandDescriptions() map[string]string {
+	s.controlFuncLock.RLock()
+	defer s.controlFuncLock.RUnlock()
+	descriptions := make(map[string]string)
+	for name, ct := range s.controlTypes {
+		descriptions[name] = ""
+		dct, ok := ct.(DescribedCommandType)
+		if ok {
+			descriptions[name] = dct.Description()
+		}
+	}
+	return descriptions
+}
+
+func (c *commandsCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	descriptions := c.s.CommandDescriptions()
+	names := make([]string, 0, len(descriptions))
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	commands := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		commands = append(commands, map[string]interface{}{
+			"Name":        name,
+			"Description": descriptions[name],
+		})
+	}
+	cfr := make(map[string]interface{})
+	cfr["Commands"] = commands
+	return cfr, nil
+}
@@ -1,16 +1,34 @@
 package controlsvc
 
 import (
+	"context"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/netceptor"
 	"strings"
+	"time"
 )
 
-type connectCommandType struct{}
+// testConnectTimeout is how long a testconnect command waits for the connection to be established
+const testConnectTimeout = 15 * time.Second
+
+// connectCommandType is used for both the connect and testconnect commands.  A testconnect
+// establishes the connection and immediately closes it, instead of bridging it.
+type connectCommandType struct {
+	dryRun bool
+}
 type connectCommand struct {
 	targetNode    string
 	targetService string
 	tlsConfigName string
+	serverName    string
+	dryRun        bool
+}
+
+func (t *connectCommandType) Description() string {
+	if t.dryRun {
+		return "Check that a service on a node accepts connections, without bridging to it"
+	}
+	return "Connect this session to a service on a node"
 }
 
 func (t *connectCommandType) InitFromString(params string) (ControlCommand, error) {
@@ -18,17 +36,23 @@ func (t *connectCommandType) InitFromString(params string) (ControlCommand, erro
 	if len(tokens) < 2 {
 		return nil, fmt.Errorf("no connect target")
 	}
-	if len(tokens) > 3 {
+	if len(tokens) > 4 {
 		return nil, fmt.Errorf("too many parameters")
 	}
 	var tlsConfigName string
-	if len(tokens) == 3 {
+	if len(tokens) > 2 {
 		tlsConfigName = tokens[2]
 	}
+	var serverName string
+	if len(tokens) > 3 {
+		serverName = tokens[3]
+	}
 	c := &connectCommand{
 		targetNode:    tokens[0],
 		targetService: tokens[1],
 		tlsConfigName: tlsConfigName,
+		serverName:    serverName,
+		dryRun:        t.dryRun,
 	}
 	return c, nil
 }
@@ -60,24 +84,85 @@ func (t *connectCommandType) InitFromJSON(config map[string]interface{}) (Contro
 	} else {
 		tlsConfigStr = ""
 	}
+	var serverNameStr string
+	serverName, ok := config["servername"]
+	if ok {
+		serverNameStr, ok = serverName.(string)
+		if !ok {
+			return nil, fmt.Errorf("connect server name must be string")
+		}
+		if tlsConfigStr == "" {
+			return nil, fmt.Errorf("connect server name requires a TLS config")
+		}
+	}
 	c := &connectCommand{
 		targetNode:    targetNodeStr,
 		targetService: targetServiceStr,
 		tlsConfigName: tlsConfigStr,
+		serverName:    serverNameStr,
+		dryRun:        t.dryRun,
 	}
 	return c, nil
 }
 
-func (c *connectCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
-	tlscfg, err := nc.GetClientTLSConfig(c.tlsConfigName, c.targetNode)
+// dial connects to the target service.  With a TLS config, the TLS handshake is complete when it
+// returns, and the server's certificate has been verified against the server name, which is the
+// target node unless another was given.
+func (c *connectCommand) dial(ctx context.Context, nc *netceptor.Netceptor) (*netceptor.Conn, error) {
+	serverName := c.serverName
+	if serverName == "" {
+		serverName = c.targetNode
+	}
+	tlscfg, err := nc.GetClientTLSConfig(c.tlsConfigName, serverName)
 	if err != nil {
 		return nil, err
 	}
-	rc, err := nc.Dial(c.targetNode, c.targetService, tlscfg)
+	rc, err := nc.DialContext(ctx, c.targetNode, c.targetService, tlscfg)
+	if err != nil && tlscfg != nil {
+		return nil, fmt.Errorf("error connecting to %s:%s with TLS config %s: %s",
+			c.targetNode, c.targetService, c.tlsConfigName, err)
+	}
+	return rc, err
+}
+
+// testConnect connects to the target service and immediately disconnects, reporting the result
+func (c *connectCommand) testConnect(nc *netceptor.Netceptor) map[string]interface{} {
+	cfr := make(map[string]interface{})
+	cfr["Node"] = c.targetNode
+	cfr["Service"] = c.targetService
+	ctx, cancel := context.WithTimeout(nc.Context(), testConnectTimeout)
+	defer cancel()
+	startTime := time.Now()
+	rc, err := c.dial(ctx, nc)
+	latency := time.Since(startTime)
+	if err != nil {
+		cfr["Success"] = false
+		cfr["Error"] = err.Error()
+		return cfr
+	}
+	if c.tlsConfigName != "" {
+		cfr["TLS"] = c.tlsConfigName
+		cert := rc.VerifiedPeerCertificate()
+		if cert != nil {
+			cfr["TLSPeer"] = cert.Subject.String()
+		}
+	}
+	_ = rc.Close()
+	cfr["Success"] = true
+	cfr["Latency"] = latency
+	cfr["LatencyStr"] = fmt.Sprintf("%s", latency)
+	return cfr
+}
+
+func (c *connectCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	if c.dryRun {
+		return c.testConnect(nc), nil
+	}
+	rc, err := c.dial(commandContext(cfo), nc)
 	if err != nil {
 		return nil, err
 	}
-	err = cfo.BridgeConn("Connecting\n", rc, "connected service")
+	err = cfo.BridgeConn("Connecting\n", rc, fmt.Sprintf("%s:%s", c.targetNode, c.targetService))
 	if err != nil {
 		return nil, err
 	}
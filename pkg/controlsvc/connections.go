@@ -0,0 +1,55 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"time"
+)
+
+type connectionsCommandType struct{}
+type connectionsCommand struct{}
+
+func (t *connectionsCommandType) Description() string {
+	return "Show the established backend sessions of this node and their traffic"
+}
+
+func (t *connectionsCommandType) InitFromString(params string) (ControlCommand, error) {
+	if params != "" {
+		return nil, fmt.Errorf("connections command does not take parameters")
+	}
+	c := &connectionsCommand{}
+	return c, nil
+}
+
+func (t *connectionsCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	c := &connectionsCommand{}
+	return c, nil
+}
+
+func (c *connectionsCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	now := time.Now()
+	conns := make([]interface{}, 0)
+	for _, cs := range nc.Connections() {
+		uptime := now.Sub(cs.Established)
+		conns = append(conns, map[string]interface{}{
+			"NodeID":           cs.NodeID,
+			"Backend":          cs.Backend,
+			"Direction":        cs.Direction,
+			"RemoteAddr":       cs.RemoteAddr,
+			"Established":      cs.Established,
+			"Uptime":           uptime.Seconds(),
+			"UptimeStr":        uptime.Round(time.Second).String(),
+			"Cost":             cs.Cost,
+			"ReceiveCost":      cs.ReceiveCost,
+			"BytesSent":        cs.BytesSent,
+			"BytesReceived":    cs.BytesReceived,
+			"MessagesSent":     cs.MessagesSent,
+			"MessagesReceived": cs.MessagesReceived,
+			"TLS":              cs.TLS,
+			"TLSPeer":          cs.TLSPeer,
+		})
+	}
+	cfr := make(map[string]interface{})
+	cfr["Connections"] = conns
+	return cfr, nil
+}
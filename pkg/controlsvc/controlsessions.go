@@ -0,0 +1,183 @@
+package controlsvc
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ControlSessionInfo describes a client connected to the control service
+type ControlSessionInfo struct {
+	ID int
+	// Remote is the address of the client
+	Remote string
+	// Identity is the subject of the client's TLS certificate, if it presented one
+	Identity string
+	// Listener is the listener the client connected to
+	Listener  string
+	Connected time.Time
+	// Command is the command currently running in the session, or blank if it is idle
+	Command        string
+	CommandStarted time.Time
+}
+
+// controlSessionRegistry tracks the sessions connected to a control service
+type controlSessionRegistry struct {
+	lock      *sync.RWMutex
+	nextID    int
+	sessions  map[int]*ControlSessionInfo
+	conns     map[int]net.Conn
+	draining  map[int]bool
+	listeners map[string]bool // Listeners whose sessions are being drained
+}
+
+// newControlSessionRegistry allocates a new, empty controlSessionRegistry
+func newControlSessionRegistry() *controlSessionRegistry {
+	return &controlSessionRegistry{
+		lock:      &sync.RWMutex{},
+		nextID:    1,
+		sessions:  make(map[int]*ControlSessionInfo),
+		conns:     make(map[int]net.Conn),
+		draining:  make(map[int]bool),
+		listeners: make(map[string]bool),
+	}
+}
+
+// peerIdentity returns the subject of the TLS client certificate presented on a connection, if any
+func peerIdentity(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.String()
+}
+
+// add registers a new session, returning its ID
+func (cr *controlSessionRegistry) add(conn net.Conn, listener string) int {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	id := cr.nextID
+	cr.nextID++
+	remote := ""
+	if conn.RemoteAddr() != nil {
+		remote = conn.RemoteAddr().String()
+	}
+	cr.sessions[id] = &ControlSessionInfo{
+		ID:        id,
+		Remote:    remote,
+		Identity:  peerIdentity(conn),
+		Listener:  listener,
+		Connected: time.Now(),
+	}
+	cr.conns[id] = conn
+	if cr.listeners[listener] {
+		cr.draining[id] = true
+	}
+	return id
+}
+
+// remove unregisters a session
+func (cr *controlSessionRegistry) remove(id int) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	delete(cr.sessions, id)
+	delete(cr.conns, id)
+	delete(cr.draining, id)
+}
+
+// drain marks the sessions of the listeners as draining, so that each ends once it is not running
+// a command, and returns their IDs.  Sessions that are waiting for a command have their read
+// interrupted, so they end straight away.  Sessions that start later on the listeners are marked
+// as draining too, until undrain is called.
+func (cr *controlSessionRegistry) drain(listeners []string) []int {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	for _, listener := range listeners {
+		cr.listeners[listener] = true
+	}
+	ids := make([]int, 0)
+	for id, cs := range cr.sessions {
+		if !cr.listeners[cs.Listener] {
+			continue
+		}
+		cr.draining[id] = true
+		ids = append(ids, id)
+		if cs.Command == "" {
+			_ = cr.conns[id].SetReadDeadline(time.Now())
+		}
+	}
+	return ids
+}
+
+// undrain stops marking new sessions of the listeners as draining
+func (cr *controlSessionRegistry) undrain(listeners []string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	for _, listener := range listeners {
+		delete(cr.listeners, listener)
+	}
+}
+
+// isDraining returns true if a session should end once it is not running a command
+func (cr *controlSessionRegistry) isDraining(id int) bool {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.draining[id]
+}
+
+// closeSessions closes the connections of the sessions that are still running, returning how many
+// there were
+func (cr *controlSessionRegistry) closeSessions(ids []int) int {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	closed := 0
+	for _, id := range ids {
+		conn, ok := cr.conns[id]
+		if ok {
+			_ = conn.Close()
+			closed++
+		}
+	}
+	return closed
+}
+
+// setCommand records the command a session is running, or that it is idle if the command is blank
+func (cr *controlSessionRegistry) setCommand(id int, command string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cs, ok := cr.sessions[id]
+	if !ok {
+		return
+	}
+	cs.Command = command
+	if command == "" {
+		cs.CommandStarted = time.Time{}
+	} else {
+		cs.CommandStarted = time.Now()
+	}
+}
+
+// list returns a copy of the information about each session, sorted by ID
+func (cr *controlSessionRegistry) list() []ControlSessionInfo {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	sessions := make([]ControlSessionInfo, 0, len(cr.sessions))
+	for _, cs := range cr.sessions {
+		sessions = append(sessions, *cs)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// ControlSessions returns the clients currently connected to the control service
+func (s *Server) ControlSessions() []ControlSessionInfo {
+	return s.sessions.list()
+}
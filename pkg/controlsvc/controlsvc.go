@@ -3,26 +3,42 @@ package controlsvc
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/cmdline"
 	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/tracing"
 	"github.com/project-receptor/receptor/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
 	"io"
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// sublogger sends the log messages of the controlsvc subsystem
+var sublogger = logger.Named("controlsvc")
+
 // ControlCommandType is a type of command that can be run from the control service
 type ControlCommandType interface {
 	InitFromString(string) (ControlCommand, error)
 	InitFromJSON(map[string]interface{}) (ControlCommand, error)
 }
 
+// DescribedCommandType is a ControlCommandType that can describe itself to clients listing the
+// available commands.  Implementing it is optional.
+type DescribedCommandType interface {
+	ControlCommandType
+	Description() string
+}
+
 // ControlCommand is an instance of a command that is being run from the control service
 type ControlCommand interface {
 	ControlFunc(*netceptor.Netceptor, ControlFuncOperations) (map[string]interface{}, error)
@@ -32,60 +48,379 @@ type ControlCommand interface {
 type ControlFuncOperations interface {
 	BridgeConn(message string, bc io.ReadWriteCloser, bcName string) error
 	ReadFromConn(message string, out io.Writer) error
+	ReadChunksFromConn(message string, out io.Writer) error
 	WriteToConn(message string, in chan []byte) error
+	WriteStreamToConn(message string, in chan []byte, errChan chan error) error
+	WriteChunksToConn(message string, in chan []byte, errChan chan error) error
+	ConnectionInfo() *ConnectionInfo
+	Context() context.Context
+	SetFlushPolicy(mode string, size int, interval time.Duration) error
+	AfterResponse(f func())
 	Close() error
+	Done() <-chan struct{}
 }
 
+// Write error handling defaults
+const (
+	DefaultWriteRetries    = 3                      // Number of times a transient write error is retried
+	DefaultWriteRetryDelay = 100 * time.Millisecond // Time to wait before retrying a write
+)
+
+// errMultiplexedTakeover is returned when a command with a request ID tries to take over the
+// connection, since the connection could then no longer carry the responses to other requests
+var errMultiplexedTakeover = fmt.Errorf("commands with a request ID cannot take over the connection")
+
 // sockControl implements the ControlFuncOperations interface that is passed back to control functions
 type sockControl struct {
-	conn net.Conn
+	conn       net.Conn
+	lines      *lineReader
+	done       chan struct{}
+	cancelOnce *sync.Once
+	bridges    *bridgeRegistry
+	flush      flushPolicy
+	connInfo   *ConnectionInfo
+	// multiplexed is set while running a command with a request ID, which cannot take over the connection
+	multiplexed bool
+	// afterResponse, if set by a command, is run in the background once the command's response is written
+	afterResponse func()
+	// deadline is the deadline of the running command
+	deadline *commandDeadline
+	// framed is set once the client has switched the session to length-prefixed framing
+	framed bool
+	// writeRetries and writeRetryDelay say how transient write errors are retried
+	writeRetries    int
+	writeRetryDelay time.Duration
+}
+
+// newSockControl allocates a new sockControl for a connection
+func newSockControl(conn net.Conn) *sockControl {
+	lines := newLineReader(conn, DefaultMaxLineLength)
+	return &sockControl{
+		conn:       lines,
+		lines:      lines,
+		done:       make(chan struct{}),
+		cancelOnce: &sync.Once{},
+		flush: flushPolicy{
+			mode: FlushImmediate,
+		},
+		writeRetries:    DefaultWriteRetries,
+		writeRetryDelay: DefaultWriteRetryDelay,
+	}
 }
 
-// BridgeConn bridges the socket to another socket
+// Done returns a channel that is closed when the session can no longer be used, either because the
+// client went away or because the session ended.  Commands that run in the background, or that
+// hold subscriptions, should watch it in order to clean up.
+func (s *sockControl) Done() <-chan struct{} {
+	return s.done
+}
+
+// AfterResponse sets a function to run in the background once the response of the running command
+// has been written, so a command can act on a request only after confirming it to the client
+func (s *sockControl) AfterResponse(f func()) {
+	s.afterResponse = f
+}
+
+// ConnectionInfo returns the identity of the client, such as its verified TLS certificate chain and
+// node ID, or its Unix socket credentials, so that commands can apply identity-based policy
+func (s *sockControl) ConnectionInfo() *ConnectionInfo {
+	return s.connInfo
+}
+
+// Context returns a context that is cancelled when the running command passes its deadline.  Once
+// the command takes over the connection, such as by bridging it, the deadline no longer applies.
+func (s *sockControl) Context() context.Context {
+	if s.deadline == nil {
+		return context.Background()
+	}
+	return s.deadline.ctx
+}
+
+// takeOver disarms the deadline of the running command, which has taken over the connection and
+// runs for as long as the client keeps it open
+func (s *sockControl) takeOver() {
+	if s.deadline != nil {
+		s.deadline.disarm()
+	}
+}
+
+// cancel notifies any running command that the session has ended
+func (s *sockControl) cancel() {
+	s.cancelOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// isTransientWriteError returns true if a write error might succeed if retried
+func isTransientWriteError(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// write writes data to the connection, retrying transient errors.  If the write fails permanently,
+// the session is cancelled so the running command can clean up.
+func (s *sockControl) write(data []byte) error {
+	for retries := 0; ; retries++ {
+		n, err := s.conn.Write(data)
+		if err == nil {
+			return nil
+		}
+		data = data[n:]
+		if retries < s.writeRetries && isTransientWriteError(err) {
+			time.Sleep(s.writeRetryDelay)
+			continue
+		}
+		s.cancel()
+		return err
+	}
+}
+
+// BridgeConn bridges the socket to another socket.  Bridges are counted by bcName, and if the
+// session has a bridge registry with a limit, bridges beyond the limit are rejected.
 func (s *sockControl) BridgeConn(message string, bc io.ReadWriteCloser, bcName string) error {
+	if s.multiplexed {
+		_ = bc.Close()
+		return errMultiplexedTakeover
+	}
+	if s.bridges != nil {
+		err := s.bridges.acquire(bcName)
+		if err != nil {
+			_ = bc.Close()
+			return err
+		}
+		defer s.bridges.release(bcName)
+	}
+	s.takeOver()
 	if message != "" {
-		_, err := s.conn.Write([]byte(message))
+		err := s.writeMessage(message)
 		if err != nil {
 			return err
 		}
 	}
-	utils.BridgeConns(s.conn, "control service", bc, bcName)
+	result := utils.BridgeConns(s.conn, "control service", bc, bcName)
+	sublogger.Info("Closed connection to %s: %d bytes sent, %d bytes received\n", bcName, result.C1ToC2, result.C2ToC1)
 	return nil
 }
 
 // ReadFromConn copies from the socket to an io.Writer, until EOF
 func (s *sockControl) ReadFromConn(message string, out io.Writer) error {
+	if s.multiplexed {
+		return errMultiplexedTakeover
+	}
+	s.takeOver()
 	if message != "" {
-		_, err := s.conn.Write([]byte(message))
+		err := s.writeMessage(message)
 		if err != nil {
 			return err
 		}
 	}
 	_, err := io.Copy(out, s.conn)
 	if err != nil {
+		s.cancel()
 		return err
 	}
 	return nil
 }
 
-// WriteToConn writes an initial string, and then messages to a channel, to the connection
+// ReadChunksFromConn copies length-prefixed chunks from the socket to an io.Writer.  Each chunk is
+// a line containing the decimal length of the chunk, followed by that many bytes of data, or in a
+// framed session, a frame.  A chunk of length zero marks the end of the data.  Unlike ReadFromConn,
+// the connection remains usable afterwards, so the client can read the command's response without
+// half-closing the socket.
+func (s *sockControl) ReadChunksFromConn(message string, out io.Writer) error {
+	if s.multiplexed {
+		return errMultiplexedTakeover
+	}
+	s.takeOver()
+	if message != "" {
+		err := s.writeMessage(message)
+		if err != nil {
+			return err
+		}
+	}
+	if s.framed {
+		return s.readFramedChunks(out)
+	}
+	for {
+		line, err := s.lines.readLine()
+		if err != nil {
+			s.cancel()
+			return err
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid chunk length %q", line)
+		}
+		if size == 0 {
+			return nil
+		}
+		_, err = io.CopyN(out, s.conn, size)
+		if err != nil {
+			s.cancel()
+			return err
+		}
+	}
+}
+
+// readFramedChunks copies frames from the socket to an io.Writer, until a frame of length zero
+func (s *sockControl) readFramedChunks(out io.Writer) error {
+	for {
+		var header [frameHeaderLength]byte
+		_, err := io.ReadFull(s.conn, header[:])
+		if err != nil {
+			s.cancel()
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:]))
+		if size == 0 {
+			return nil
+		}
+		_, err = io.CopyN(out, s.conn, size)
+		if err != nil {
+			s.cancel()
+			return err
+		}
+	}
+}
+
+// WriteToConn writes an initial string, and then messages to a channel, to the connection.  The
+// messages are buffered according to the session's flush policy.
 func (s *sockControl) WriteToConn(message string, in chan []byte) error {
+	return s.WriteStreamToConn(message, in, nil)
+}
+
+// StreamErrorKey is the key in the trailer of a stream that failed partway
+const StreamErrorKey = "StreamError"
+
+// streamMode is how a stream's data is delimited on the connection
+type streamMode int
+
+const (
+	// streamRaw writes the data as it is.  The end of the stream is only marked by closing the
+	// connection, so errors cannot be reported.
+	streamRaw streamMode = iota
+	// streamChunked writes the data as chunks, each a line containing the decimal length of the
+	// chunk followed by that many bytes of data
+	streamChunked
+	// streamFramed writes the data as length-prefixed frames
+	streamFramed
+)
+
+// WriteStreamToConn is like WriteToConn, but the producer of the messages can also report an
+// error that ends the stream.  In a newline-delimited session, the data is written as it is, so
+// an error just ends the stream early.  In a framed session, the data is written as frames, the
+// end of the data is marked by a frame of length zero, and it is followed by a trailer frame, as
+// described for WriteChunksToConn.
+func (s *sockControl) WriteStreamToConn(message string, in chan []byte, errChan chan error) error {
+	if s.multiplexed {
+		return errMultiplexedTakeover
+	}
+	mode := streamRaw
+	if s.framed {
+		mode = streamFramed
+	}
+	return s.writeStream(message, in, errChan, mode)
+}
+
+// WriteChunksToConn is like WriteStreamToConn, but writes the data as length-prefixed chunks,
+// the same way ReadChunksFromConn reads them, so the client can tell a stream that failed from
+// one that completed normally.  A chunk of length zero marks the end of the data.  It is followed
+// by a trailer: a line containing a JSON object, with the error under StreamErrorKey if the
+// stream failed.  Since the trailer comes after the end of the data, it cannot be mistaken for
+// data, whatever the stream contains.  In a framed session, the chunks and the trailer are frames.
+func (s *sockControl) WriteChunksToConn(message string, in chan []byte, errChan chan error) error {
+	if s.multiplexed {
+		return errMultiplexedTakeover
+	}
+	mode := streamChunked
+	if s.framed {
+		mode = streamFramed
+	}
+	return s.writeStream(message, in, errChan, mode)
+}
+
+// appendChunk appends data to buf as a length-prefixed chunk
+func appendChunk(buf []byte, data []byte) []byte {
+	buf = strconv.AppendInt(buf, int64(len(data)), 10)
+	buf = append(buf, '\n')
+	return append(buf, data...)
+}
+
+// streamTrailer returns the trailer that follows the data of a delimited stream
+func streamTrailer(streamErr error) ([]byte, error) {
+	trailer := make(map[string]string)
+	if streamErr != nil {
+		trailer[StreamErrorKey] = streamErr.Error()
+	}
+	return json.Marshal(trailer)
+}
+
+// writeStream writes a stream to the connection, delimiting the data according to the mode
+func (s *sockControl) writeStream(message string, in chan []byte, errChan chan error, mode streamMode) error {
+	s.takeOver()
 	if message != "" {
-		_, err := s.conn.Write([]byte(message))
+		err := s.writeMessage(message)
 		if err != nil {
 			return err
 		}
 	}
-	for bytes := range in {
-		_, err := s.conn.Write(bytes)
+	sb := newStreamBuffer(s.flush, func(data []byte) error {
+		switch {
+		case len(data) == 0:
+			// An empty chunk or frame would end the stream
+			return nil
+		case mode == streamChunked:
+			return s.write(appendChunk(nil, data))
+		case mode == streamFramed:
+			return s.write(appendFrame(nil, data))
+		}
+		return s.write(data)
+	})
+	endStream := func(streamErr error) error {
+		err := sb.flush()
+		if err != nil {
+			return err
+		}
+		if mode == streamRaw {
+			if streamErr != nil {
+				sublogger.Warning("Stream ended early: %s\n", streamErr)
+			}
+			return nil
+		}
+		trailer, err := streamTrailer(streamErr)
 		if err != nil {
 			return err
 		}
+		if mode == streamFramed {
+			return s.write(appendFrame(appendFrame(nil, nil), trailer))
+		}
+		return s.write(append(appendChunk(nil, nil), append(trailer, '\n')...))
+	}
+	for {
+		select {
+		case bytes, ok := <-in:
+			if !ok {
+				return endStream(nil)
+			}
+			err := sb.add(bytes)
+			if err != nil {
+				return err
+			}
+		case streamErr := <-errChan:
+			return endStream(streamErr)
+		case <-sb.expired():
+			err := sb.flush()
+			if err != nil {
+				return err
+			}
+		case <-s.done:
+			return fmt.Errorf("control session ended")
+		}
 	}
-	return nil
 }
 
 func (s *sockControl) Close() error {
+	s.cancel()
 	return s.conn.Close()
 }
 
@@ -94,6 +429,30 @@ type Server struct {
 	nc              *netceptor.Netceptor
 	controlFuncLock sync.RWMutex
 	controlTypes    map[string]ControlCommandType
+	controlAuth     map[string]Authorizer
+	authorizer      Authorizer
+	bridges         *bridgeRegistry
+	commandStats    *commandStatsRegistry
+	latency         *latencyRegistry
+	sessions        *controlSessionRegistry
+	sessionSlots    *sessionSlots
+	maxLineLength   int32
+	drainers        []namedDrainer
+	healthChecks    []namedHealthCheck
+	localOnly       int32
+	activeListeners int32
+	greetingCaps    int32
+	shutdownFunc    func()
+	shuttingDown    int32
+	rateLimit       rateLimitPolicy
+	commandTimeout  int64
+	idleTimeout     int64
+	sessionGrace    int64
+	writeRetries    int32
+	writeRetryDelay int64
+	listenerWait    sync.WaitGroup
+	audit           *auditQueue
+	metrics         controlMetrics
 }
 
 // New returns a new instance of a control service.
@@ -102,12 +461,49 @@ func New(stdServices bool, nc *netceptor.Netceptor) *Server {
 		nc:              nc,
 		controlFuncLock: sync.RWMutex{},
 		controlTypes:    make(map[string]ControlCommandType),
+		controlAuth:     make(map[string]Authorizer),
+		bridges:         newBridgeRegistry(0),
+		commandStats:    newCommandStatsRegistry(),
+		latency:         newLatencyRegistry(),
+		sessions:        newControlSessionRegistry(),
+		sessionSlots:    newSessionSlots(),
+		maxLineLength:   DefaultMaxLineLength,
+		sessionGrace:    int64(DefaultSessionGracePeriod),
+		writeRetries:    DefaultWriteRetries,
+		writeRetryDelay: int64(DefaultWriteRetryDelay),
+		metrics: controlMetrics{
+			since: time.Now(),
+		},
 	}
 	if stdServices {
 		s.controlTypes["ping"] = &pingCommandType{}
 		s.controlTypes["status"] = &statusCommandType{}
 		s.controlTypes["connect"] = &connectCommandType{}
+		s.controlTypes["testconnect"] = &connectCommandType{dryRun: true}
 		s.controlTypes["traceroute"] = &tracerouteCommandType{}
+		s.controlTypes["loss"] = &lossCommandType{}
+		s.controlTypes["backend"] = &backendCommandType{}
+		s.controlTypes["neighbors"] = &neighborsCommandType{}
+		s.controlTypes["connections"] = &connectionsCommandType{}
+		s.controlTypes["disconnect"] = &disconnectCommandType{}
+		s.controlTypes["clockskew"] = &clockskewCommandType{}
+		s.controlTypes["services"] = &servicesCommandType{}
+		s.controlTypes["adcache"] = &adcacheCommandType{}
+		s.controlTypes["stats"] = &statsCommandType{s: s}
+		s.controlTypes["route"] = &routeCommandType{}
+		s.controlTypes["sessions"] = &sessionsCommandType{s: s}
+		s.controlTypes["hmac"] = &hmacCommandType{}
+		s.controlTypes["session"] = &sessionCommandType{}
+		s.controlTypes["loglevel"] = &loglevelCommandType{}
+		s.controlTypes["chaos"] = &chaosCommandType{}
+		s.controlTypes["peers"] = &peersCommandType{}
+		s.controlTypes["validate"] = &validateCommandType{}
+		s.controlTypes["commands"] = &commandsCommandType{s: s}
+		s.controlTypes["shutdown"] = &shutdownCommandType{s: s}
+		s.controlTypes["reload"] = &reloadCommandType{}
+		s.controlTypes["metrics"] = &metricsCommandType{s: s}
+		s.controlTypes["routing-updates"] = &routingUpdatesCommandType{}
+		s.controlTypes["healthz"] = &healthzCommandType{s: s}
 	}
 	return s
 }
@@ -115,82 +511,200 @@ func New(stdServices bool, nc *netceptor.Netceptor) *Server {
 // MainInstance is the global instance of the control service instantiated by the command-line main() function
 var MainInstance *Server
 
+// SetMaxBridges sets the maximum number of concurrent connections to any one service that can be
+// opened through the control service.  Zero means no limit.
+func (s *Server) SetMaxBridges(limit int) {
+	s.bridges.setLimit(limit)
+}
+
+// SetMaxLineLength sets the longest command line a client can send.  Longer lines are rejected
+// with an error.  The limit applies to sessions that start afterwards.
+func (s *Server) SetMaxLineLength(length int) error {
+	if length < 1 {
+		return fmt.Errorf("maximum line length must be positive")
+	}
+	atomic.StoreInt32(&s.maxLineLength, int32(length))
+	return nil
+}
+
+// SetWriteRetryPolicy sets how many times, and after what delay, a write to a client that fails with
+// a transient error is retried before the session is given up.  The policy applies to sessions that
+// start afterwards.
+func (s *Server) SetWriteRetryPolicy(retries int, delay time.Duration) error {
+	if retries < 0 {
+		return fmt.Errorf("write retries must not be negative")
+	}
+	if delay < 0 {
+		return fmt.Errorf("write retry delay must not be negative")
+	}
+	atomic.StoreInt32(&s.writeRetries, int32(retries))
+	atomic.StoreInt64(&s.writeRetryDelay, int64(delay))
+	return nil
+}
+
 // AddControlFunc registers a function that can be used from a control socket.
 func (s *Server) AddControlFunc(name string, cType ControlCommandType) error {
-	s.controlFuncLock.Lock()
-	defer s.controlFuncLock.Unlock()
-	_, ok := s.controlTypes[name]
-	if ok {
-		return fmt.Errorf("control function named %s already exists", name)
+	return s.AddControlFuncWithAuth(name, cType, nil)
+}
+
+// isJSONCommand returns true if a command line is JSON rather than text.  Arrays are taken to be
+// JSON too, so that they are rejected as malformed commands rather than run as unknown ones.
+func isJSONCommand(line string) bool {
+	line = strings.TrimLeft(line, " \t")
+	return strings.HasPrefix(line, "{") || strings.HasPrefix(line, "[")
+}
+
+// parseJSONCommand parses a command sent as a JSON object.  If the object parses, it is returned
+// even if the command in it is not valid, so that the error can carry its request ID.
+func parseJSONCommand(data []byte) (map[string]interface{}, string, error) {
+	var jsonData map[string]interface{}
+	err := json.Unmarshal(data, &jsonData)
+	if _, ok := err.(*json.UnmarshalTypeError); ok {
+		return nil, "", fmt.Errorf("JSON command must be an object")
+	} else if err != nil {
+		return nil, "", fmt.Errorf("invalid JSON command: %s", err)
 	}
-	s.controlTypes[name] = cType
-	return nil
+	cmdIf, ok := jsonData["command"]
+	if !ok {
+		return jsonData, "", fmt.Errorf("JSON did not contain a command")
+	}
+	cmd, ok := cmdIf.(string)
+	if !ok {
+		return jsonData, "", fmt.Errorf("command must be a string")
+	}
+	return jsonData, cmd, nil
 }
 
 // RunControlSession runs the server protocol on the given connection
 func (s *Server) RunControlSession(conn net.Conn) {
-	logger.Info("Client connected to control service\n")
+	s.runControlSession(conn, "direct", nil)
+}
+
+// runControlSession runs the server protocol on a connection that arrived on the named listener,
+// which may have its own authorizer
+func (s *Server) runControlSession(conn net.Conn, listener string, listenerAuth Authorizer) {
+	sublogger.Info("Client connected to control service\n")
+	cfo := newSockControl(conn)
+	cfo.bridges = s.bridges
+	cfo.writeRetries = int(atomic.LoadInt32(&s.writeRetries))
+	cfo.writeRetryDelay = time.Duration(atomic.LoadInt64(&s.writeRetryDelay))
 	defer func() {
-		logger.Info("Client disconnected from control service\n")
+		sublogger.Info("Client disconnected from control service\n")
+		cfo.cancel()
 		err := conn.Close()
 		if err != nil {
-			logger.Error("Error closing connection: %s\n", err)
+			sublogger.Error("Error closing connection: %s\n", err)
 		}
 	}()
-	_, err := conn.Write([]byte(fmt.Sprintf("Receptor Control, node %s\n", s.nc.NodeID())))
+	greeting := s.greeting()
+	err := cfo.write([]byte(greeting.String() + "\n"))
 	if err != nil {
-		logger.Error("Write error in control service: %s\n", err)
+		sublogger.Error("Write error in control service: %s\n", err)
 		return
 	}
+	sessionID := s.sessions.add(conn, listener)
+	defer s.sessions.remove(sessionID)
+	s.countSession()
+	connInfo := newConnectionInfo(conn, listener)
+	cfo.connInfo = connInfo
+	cfo.lines.maxLength = int(atomic.LoadInt32(&s.maxLineLength))
+	limiter, delay := s.newSessionLimiter()
 	done := false
+	firstLine := true
 	for !done {
-		// Inefficiently read one line from the socket - we can't use bufio
-		// because we cannot read ahead beyond the newline character
-		cmdBytes := make([]byte, 0)
-		buf := make([]byte, 1)
-		for {
-			n, err := conn.Read(buf)
-			if err == io.EOF {
-				logger.Info("Control service closed\n")
-				done = true
-				break
-			} else if err != nil {
-				logger.Error("Read error in control service: %s\n", err)
+		if s.sessions.isDraining(sessionID) {
+			sublogger.Info("Closing control session: the control service is stopping\n")
+			return
+		}
+		var line string
+		idleTimeout := time.Duration(atomic.LoadInt64(&s.idleTimeout))
+		if idleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		if cfo.framed {
+			var payload []byte
+			payload, err = cfo.lines.readFrame()
+			line = string(payload)
+		} else {
+			line, err = cfo.lines.readLine()
+		}
+		if idleTimeout > 0 {
+			// The command, and anything it reads from the connection, is not bound by the idle timeout
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+		if err != nil && s.sessions.isDraining(sessionID) {
+			sublogger.Info("Closing control session: the control service is stopping\n")
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && idleTimeout > 0 {
+			sublogger.Warning("Closing control session: no command received in %s\n", idleTimeout)
+			return
+		}
+		if _, ok := err.(*lineTooLongError); ok {
+			err = (&responseFormat{framed: cfo.framed}).writeError(cfo.write, err)
+			if err != nil {
+				sublogger.Error("Write error in control service: %s\n", err)
 				return
 			}
-			if n == 1 {
-				if buf[0] == '\n' {
-					break
-				}
-				cmdBytes = append(cmdBytes, buf[0])
-			}
+			continue
+		} else if err == io.EOF {
+			sublogger.Info("Control service closed\n")
+			done = true
+		} else if err != nil {
+			sublogger.Error("Read error in control service: %s\n", err)
+			return
 		}
+		cmdBytes := []byte(line)
 		if len(cmdBytes) == 0 {
 			continue
 		}
+		if firstLine && strings.TrimSpace(line) == FramedHandshake {
+			err = cfo.write([]byte(FramedHandshake + "\n"))
+			if err != nil {
+				sublogger.Error("Write error in control service: %s\n", err)
+				return
+			}
+			cfo.framed = true
+			continue
+		}
+		firstLine = false
 		var cmd string
 		var params string
 		var jsonData map[string]interface{}
-		if cmdBytes[0] == '{' {
-			err = json.Unmarshal(cmdBytes, &jsonData)
+		format := &responseFormat{
+			encoding:    EncodingJSON,
+			compression: CompressionNone,
+			framed:      cfo.framed,
+		}
+		timeout := time.Duration(atomic.LoadInt64(&s.commandTimeout))
+		if isJSONCommand(line) {
+			jsonData, cmd, err = parseJSONCommand(cmdBytes)
+			if jsonData != nil {
+				format.requestID = jsonData[RequestIDKey]
+			}
+			// The format only takes the requested settings once they are all valid, so that errors
+			// are sent in a format the client can read
+			encoding, compression := EncodingJSON, CompressionNone
 			if err == nil {
-				cmdIf, ok := jsonData["command"]
-				if ok {
-					cmd, ok = cmdIf.(string)
-					if !ok {
-						err = fmt.Errorf("command must be a string")
-					}
-				} else {
-					err = fmt.Errorf("JSON did not contain a command")
-				}
+				encoding, err = encodingFromRequest(jsonData)
+			}
+			if err == nil {
+				compression, err = compressionFromRequest(jsonData, greeting.HasCapability(CapabilityGzip))
+			}
+			if err == nil {
+				timeout, err = commandTimeoutFromRequest(jsonData, timeout)
 			}
 			if err != nil {
-				_, err = conn.Write([]byte(fmt.Sprintf("ERROR: %s\n", err)))
+				s.countCommand(true, false)
+				err = format.writeError(cfo.write, err)
 				if err != nil {
-					logger.Error("Write error in control service: %s\n", err)
+					sublogger.Error("Write error in control service: %s\n", err)
 					return
 				}
+				continue
 			}
+			format.encoding = encoding
+			format.compression = compression
 		} else {
 			tokens := strings.SplitN(string(cmdBytes), " ", 2)
 			if len(tokens) > 0 {
@@ -200,6 +714,16 @@ func (s *Server) RunControlSession(conn net.Conn) {
 				}
 			}
 		}
+		err = waitForRateLimit(limiter, delay, cfo.done)
+		if err != nil {
+			s.countCommand(true, false)
+			err = format.writeError(cfo.write, err)
+			if err != nil {
+				sublogger.Error("Write error in control service: %s\n", err)
+				return
+			}
+			continue
+		}
 		s.controlFuncLock.RLock()
 		var ct ControlCommandType
 		for f := range s.controlTypes {
@@ -209,119 +733,216 @@ func (s *Server) RunControlSession(conn net.Conn) {
 			}
 		}
 		s.controlFuncLock.RUnlock()
+		received := time.Now()
 		if ct != nil {
-			cfo := &sockControl{
-				conn: conn,
-			}
 			var cfr map[string]interface{}
 			var cc ControlCommand
-			if jsonData == nil {
+			_, span := tracing.StartSpan(context.Background(), "control "+cmd,
+				attribute.String("receptor.node", s.nc.NodeID()),
+				attribute.String("receptor.command", cmd))
+			err = s.authorize(&AuthRequest{
+				Command: cmd,
+				Params:  params,
+				JSON:    jsonData,
+				Conn:    connInfo,
+			}, listenerAuth)
+			if err == nil && jsonData == nil {
 				cc, err = ct.InitFromString(params)
-			} else {
+			} else if err == nil {
 				cc, err = ct.InitFromJSON(jsonData)
 			}
 			if err == nil {
-				cfr, err = cc.ControlFunc(s.nc, cfo)
+				err = checkMaintenance(s.nc, cc)
+			}
+			if err == nil {
+				s.sessions.setCommand(sessionID, cmd)
+				cfo.multiplexed = format.requestID != nil
+				started := time.Now()
+				cfo.deadline = newCommandDeadline(timeout)
+				if sc, ok := cc.(StreamingCommand); ok {
+					cfr, err = cfo.runStreamingCommand(s.nc, sc, format)
+				} else {
+					cfr, err = cc.ControlFunc(s.nc, cfo)
+				}
+				if cfo.deadline.end() {
+					cfr, err = nil, errCommandTimedOut
+				}
+				cfo.deadline = nil
+				s.latency.record(cmd, time.Since(started), time.Now())
+				s.sessions.setCommand(sessionID, "")
 			}
+			tracing.EndSpan(span, err)
+			s.commandStats.count(cmd, err != nil)
+			s.countCommand(err != nil, false)
+			s.auditCommand(ct, cmd, params, jsonData, connInfo, received, cfr, err)
 			if err != nil {
-				_, err = conn.Write([]byte(fmt.Sprintf("ERROR: %s\n", err)))
+				err = format.writeError(cfo.write, err)
 				if err != nil {
-					logger.Error("Write error in control service: %s\n", err)
+					sublogger.Error("Write error in control service: %s\n", err)
 					return
 				}
 			} else {
 				if cfr != nil {
-					rbytes, err := json.Marshal(cfr)
-					if err != nil {
-						_, err = conn.Write([]byte(fmt.Sprintf("ERROR: could not convert response to JSON: %s\n", err)))
-						if err != nil {
-							logger.Error("Write error in control service: %s\n", err)
-							return
-						}
-					}
-					rbytes = append(rbytes, '\n')
-					_, err = conn.Write(rbytes)
-					if err != nil {
-						logger.Error("Write error in control service: %s\n", err)
-						return
-					}
+					err = format.writeResult(cfo.write, cfr)
+				}
+				if cfo.afterResponse != nil {
+					go cfo.afterResponse()
+					cfo.afterResponse = nil
+				}
+				if err != nil {
+					sublogger.Error("Write error in control service: %s\n", err)
+					return
 				}
 			}
 		} else {
-			_, err = conn.Write([]byte(fmt.Sprintf("ERROR: Unknown command\n")))
+			err = fmt.Errorf("Unknown command")
+			s.countCommand(true, true)
+			s.auditCommand(nil, cmd, params, jsonData, connInfo, received, nil, err)
+			err = format.writeError(cfo.write, err)
 			if err != nil {
-				logger.Error("Write error in control service: %s\n", err)
+				sublogger.Error("Write error in control service: %s\n", err)
 				return
 			}
 		}
 	}
 }
 
+// ListenerConfig is the configuration of one of the listeners of a control service.  A server can
+// run several listeners at once, each with its own TLS config and authorization policy.
+type ListenerConfig struct {
+	// Service is the Receptor service name to listen on, or empty for none
+	Service string
+	// TLS is the TLS server config of the Receptor listener, or nil for none
+	TLS *tls.Config
+	// UnixSocket is the filename of a local Unix socket to listen on, or empty for none
+	UnixSocket string
+	// UnixSocketPermissions are the file permissions of the Unix socket
+	UnixSocketPermissions os.FileMode
+	// Authorizer, if set, must permit every command run by clients of this listener, in addition to
+	// the authorizers of the server and the command
+	Authorizer Authorizer
+	// UnixPeers, if set, restricts the local users that may connect to the Unix socket.  Clients it
+	// does not allow are sent an error and disconnected before their session starts.  It is only
+	// supported on Linux.
+	UnixPeers *UnixPeerPolicy
+}
+
 // RunControlSvc runs the main accept loop of the control service
 func (s *Server) RunControlSvc(ctx context.Context, service string, tlscfg *tls.Config,
 	unixSocket string, unixSocketPermissions os.FileMode) error {
+	return s.RunListener(ctx, ListenerConfig{
+		Service:               service,
+		TLS:                   tlscfg,
+		UnixSocket:            unixSocket,
+		UnixSocketPermissions: unixSocketPermissions,
+	})
+}
+
+// RunListener starts accepting control sessions on a listener.  The listener's sockets are closed,
+// and the lock on its Unix socket released, when the context is cancelled.  Its sessions are then
+// drained: they end once they finish the command they are running, or are closed once the session
+// grace period is up.  Wait blocks until the draining is done.
+func (s *Server) RunListener(ctx context.Context, cfg ListenerConfig) error {
+	if cfg.UnixPeers != nil && !peerCredentialsSupported {
+		return fmt.Errorf("Unix socket peer credentials are not supported on this platform")
+	}
 	var uli net.Listener
 	var lock *utils.FLock
 	var err error
-	if unixSocket != "" {
-		uli, lock, err = utils.UnixSocketListen(unixSocket, unixSocketPermissions)
+	if cfg.UnixSocket != "" {
+		uli, lock, err = utils.UnixSocketListen(cfg.UnixSocket, cfg.UnixSocketPermissions)
 		if err != nil {
 			return fmt.Errorf("error opening Unix socket: %s", err)
 		}
-	} else {
-		uli = nil
 	}
 	var li *netceptor.Listener
-	if service != "" {
-		li, err = s.nc.ListenAndAdvertise(service, tlscfg, nil)
+	if cfg.Service != "" {
+		li, err = s.nc.ListenAndAdvertise(cfg.Service, cfg.TLS, nil)
 		if err != nil {
-			return fmt.Errorf("error opening Unix socket: %s", err)
+			if uli != nil {
+				_ = uli.Close()
+				_ = lock.Unlock()
+			}
+			return fmt.Errorf("error listening on service %s: %s", cfg.Service, err)
 		}
-	} else {
-		li = nil
 	}
 	if uli == nil && li == nil {
 		return fmt.Errorf("no listeners specified")
 	}
-	logger.Info("Running control service %s\n", service)
+	sublogger.Info("Running control service %s\n", cfg.Service)
+	names := make([]string, 0, 2)
+	accepting := &sync.WaitGroup{}
+	sessions := &sync.WaitGroup{}
+	if uli != nil {
+		names = append(names, "unix:"+cfg.UnixSocket)
+		accepting.Add(1)
+		var admit func(net.Conn) error
+		if cfg.UnixPeers != nil {
+			admit = cfg.UnixPeers.admit
+		}
+		go s.acceptSessions(ctx, uli, "unix:"+cfg.UnixSocket, cfg.Authorizer, admit, accepting, sessions)
+	}
+	if li != nil {
+		names = append(names, "service:"+cfg.Service)
+		accepting.Add(1)
+		go s.acceptSessions(ctx, li, "service:"+cfg.Service, cfg.Authorizer, nil, accepting, sessions)
+	}
+	atomic.AddInt32(&s.activeListeners, 1)
+	s.listenerWait.Add(1)
 	go func() {
-		select {
-		case <-ctx.Done():
-			if uli != nil {
-				_ = uli.Close()
-				_ = lock.Unlock()
-			}
-			if li != nil {
-				_ = li.Close()
-			}
-			return
+		defer s.listenerWait.Done()
+		<-ctx.Done()
+		if uli != nil {
+			_ = uli.Close()
+			_ = lock.Unlock()
 		}
+		if li != nil {
+			_ = li.Close()
+		}
+		atomic.AddInt32(&s.activeListeners, -1)
+		accepting.Wait()
+		s.drainSessions(names, sessions)
 	}()
-	if uli != nil {
-		go func() {
-			for {
-				conn, err := uli.Accept()
-				if err != nil {
-					logger.Error("Error accepting Unix socket connection: %s. Closing socket.\n", err)
-					return
-				}
-				go s.RunControlSession(conn)
+	return nil
+}
+
+// acceptSessions runs control sessions on the connections accepted by a listener, until it is
+// closed, counting the sessions in the sessions wait group.  Connections that admit, if set,
+// returns an error for are rejected.  While the session limit is reached, connections are queued,
+// which stops accepting more until a session ends, or rejected.
+func (s *Server) acceptSessions(ctx context.Context, li net.Listener, name string, auth Authorizer,
+	admit func(net.Conn) error, accepting *sync.WaitGroup, sessions *sync.WaitGroup) {
+	defer accepting.Done()
+	for {
+		conn, err := li.Accept()
+		if err != nil {
+			sublogger.Error("Error accepting connection on %s: %s. Closing socket.\n", name, err)
+			return
+		}
+		if admit != nil {
+			err = admit(conn)
+			if err != nil {
+				go rejectConnection(conn, name, err)
+				continue
 			}
-		}()
-	}
-	if li != nil {
-		go func() {
-			for {
-				conn, err := li.Accept()
-				if err != nil {
-					logger.Error("Error accepting connection: %s. Closing socket.\n", err)
-					return
-				}
-				go s.RunControlSession(conn)
+		}
+		if !s.sessionSlots.acquire(ctx.Done()) {
+			if ctx.Err() != nil {
+				_ = conn.Close()
+			} else {
+				go rejectConnection(conn, name, errTooManySessions)
 			}
+			continue
+		}
+		sessions.Add(1)
+		go func() {
+			defer func() {
+				s.sessionSlots.release()
+				sessions.Done()
+			}()
+			s.runControlSession(conn, name, auth)
 		}()
 	}
-	return nil
 }
 
 // **************************************************************************
@@ -330,25 +951,139 @@ func (s *Server) RunControlSvc(ctx context.Context, service string, tlscfg *tls.
 
 // CmdlineConfigWindows is the cmdline configuration object for a control service on Windows
 type CmdlineConfigWindows struct {
-	Service string `description:"Receptor service name to listen on" default:"control"`
-	TLS     string `description:"Name of TLS server config for the Receptor listener"`
+	Service              string  `description:"Receptor service name to listen on" default:"control"`
+	TLS                  string  `description:"Name of TLS server config for the Receptor listener"`
+	ClientAuth           string  `description:"Client authentication for the Receptor listener (require, optional or none), overriding the TLS config"`
+	MaxBridges           int     `description:"Maximum concurrent connections to any one service via the connect command (0 for no limit)" default:"0"`
+	MaxLineLength        int     `description:"Maximum length in bytes of a single command line" default:"65536"`
+	MaxSessions          int     `description:"Maximum client sessions the listeners run at once (0 for no limit)" default:"0"`
+	QueueSessions        bool    `description:"Queue connections over the session limit until a session ends, rather than rejecting them" default:"false"`
+	MaxCommandsPerSecond float64 `description:"Maximum commands per second each client session may send (0 for no limit)" default:"0"`
+	CommandBurst         int     `description:"Number of commands a client session may send at once before the rate limit applies. Defaults to the rate limit rounded up." default:"0"`
+	RateLimitDelay       bool    `description:"Delay commands over the rate limit until they are allowed, rather than rejecting them" default:"false"`
+	CommandTimeout       int     `description:"Seconds a command may run before it is cancelled (0 for no limit). Only commands that wait on the network, such as ping, traceroute and connect, stop early." default:"0"`
+	IdleTimeout          int     `description:"Seconds a client may wait between commands before it is disconnected (0 for no limit)" default:"0"`
+	SessionGracePeriod   int     `description:"Seconds client sessions may take to finish their commands when the node shuts down, before they are closed" default:"10"`
+	WriteRetries         int     `description:"Number of times a write to a client that fails with a transient error is retried" default:"3"`
+	WriteRetryDelay      int     `description:"Milliseconds to wait before retrying a write to a client" default:"100"`
+	GreetingCapabilities bool    `description:"List the control protocol features the service supports in the greeting sent to clients" default:"false"`
+	AuditLog             string  `description:"File to append a line of JSON to for every command run, for auditing"`
+	AllowedCommands      string  `description:"Comma separated list of the commands clients of this control service may run. Defaults to all."`
 }
 
 // CmdlineConfigUnix is the cmdline configuration object for a control service on Unix
 type CmdlineConfigUnix struct {
-	Service     string `description:"Receptor service name to listen on" default:"control"`
-	Filename    string `description:"Filename of local Unix socket to bind to the service"`
-	Permissions int    `description:"Socket file permissions" default:"0600"`
-	TLS         string `description:"Name of TLS server config for the Receptor listener"`
+	Service              string  `description:"Receptor service name to listen on" default:"control"`
+	Filename             string  `description:"Filename of local Unix socket to bind to the service, or @name for a Linux abstract socket"`
+	Permissions          int     `description:"Socket file permissions, not used for abstract sockets" default:"0600"`
+	AllowedUIDs          string  `description:"Comma separated list of user IDs whose processes may connect to the socket file. Defaults to any that the permissions allow."`
+	AllowedGIDs          string  `description:"Comma separated list of group IDs whose processes may connect to the socket file, checking their primary group only"`
+	TLS                  string  `description:"Name of TLS server config for the Receptor listener"`
+	ClientAuth           string  `description:"Client authentication for the Receptor listener (require, optional or none), overriding the TLS config"`
+	MaxBridges           int     `description:"Maximum concurrent connections to any one service via the connect command (0 for no limit)" default:"0"`
+	MaxLineLength        int     `description:"Maximum length in bytes of a single command line" default:"65536"`
+	MaxSessions          int     `description:"Maximum client sessions the listeners run at once (0 for no limit)" default:"0"`
+	QueueSessions        bool    `description:"Queue connections over the session limit until a session ends, rather than rejecting them" default:"false"`
+	MaxCommandsPerSecond float64 `description:"Maximum commands per second each client session may send (0 for no limit)" default:"0"`
+	CommandBurst         int     `description:"Number of commands a client session may send at once before the rate limit applies. Defaults to the rate limit rounded up." default:"0"`
+	RateLimitDelay       bool    `description:"Delay commands over the rate limit until they are allowed, rather than rejecting them" default:"false"`
+	CommandTimeout       int     `description:"Seconds a command may run before it is cancelled (0 for no limit). Only commands that wait on the network, such as ping, traceroute and connect, stop early." default:"0"`
+	IdleTimeout          int     `description:"Seconds a client may wait between commands before it is disconnected (0 for no limit)" default:"0"`
+	SessionGracePeriod   int     `description:"Seconds client sessions may take to finish their commands when the node shuts down, before they are closed" default:"10"`
+	WriteRetries         int     `description:"Number of times a write to a client that fails with a transient error is retried" default:"3"`
+	WriteRetryDelay      int     `description:"Milliseconds to wait before retrying a write to a client" default:"100"`
+	GreetingCapabilities bool    `description:"List the control protocol features the service supports in the greeting sent to clients" default:"false"`
+	AuditLog             string  `description:"File to append a line of JSON to for every command run, for auditing"`
+	AllowedCommands      string  `description:"Comma separated list of the commands clients of this control service may run. Defaults to all."`
 }
 
-// Run runs the action
+// Run runs the action.  A control service can be configured more than once, with each block
+// creating its own listeners.  Settings that apply to the whole server, such as the rate limit,
+// are only changed by the blocks that set them.
 func (cfg CmdlineConfigUnix) Run() error {
-	tlscfg, err := netceptor.MainInstance.GetServerTLSConfig(cfg.TLS)
+	tlscfg, err := netceptor.MainInstance.GetServerTLSConfigWithClientAuth(cfg.TLS, cfg.ClientAuth)
 	if err != nil {
 		return err
 	}
-	err = MainInstance.RunControlSvc(context.Background(), cfg.Service, tlscfg, cfg.Filename, os.FileMode(cfg.Permissions))
+	if cfg.MaxBridges != 0 {
+		MainInstance.SetMaxBridges(cfg.MaxBridges)
+	}
+	if cfg.MaxLineLength != DefaultMaxLineLength {
+		err = MainInstance.SetMaxLineLength(cfg.MaxLineLength)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.MaxSessions != 0 {
+		err = MainInstance.SetMaxSessions(cfg.MaxSessions, cfg.QueueSessions)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.MaxCommandsPerSecond != 0 {
+		err = MainInstance.SetRateLimit(cfg.MaxCommandsPerSecond, cfg.CommandBurst, cfg.RateLimitDelay)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.CommandTimeout != 0 {
+		err = MainInstance.SetCommandTimeout(time.Duration(cfg.CommandTimeout) * time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.IdleTimeout != 0 {
+		err = MainInstance.SetIdleTimeout(time.Duration(cfg.IdleTimeout) * time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.SessionGracePeriod != int(DefaultSessionGracePeriod/time.Second) {
+		err = MainInstance.SetSessionGracePeriod(time.Duration(cfg.SessionGracePeriod) * time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.WriteRetries != DefaultWriteRetries || cfg.WriteRetryDelay != int(DefaultWriteRetryDelay/time.Millisecond) {
+		err = MainInstance.SetWriteRetryPolicy(cfg.WriteRetries, time.Duration(cfg.WriteRetryDelay)*time.Millisecond)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.GreetingCapabilities {
+		MainInstance.SetGreetingCapabilities(true)
+	}
+	if cfg.AuditLog != "" {
+		auditLogger, err := NewAuditFileLogger(cfg.AuditLog)
+		if err != nil {
+			return err
+		}
+		MainInstance.SetAuditLogger(auditLogger)
+	}
+	lcfg := ListenerConfig{
+		Service:               cfg.Service,
+		TLS:                   tlscfg,
+		UnixSocket:            cfg.Filename,
+		UnixSocketPermissions: os.FileMode(cfg.Permissions),
+	}
+	if cfg.AllowedCommands != "" {
+		lcfg.Authorizer = AllowCommands(strings.Split(cfg.AllowedCommands, ","))
+	}
+	if cfg.AllowedUIDs != "" || cfg.AllowedGIDs != "" {
+		uids, err := parseIDList(cfg.AllowedUIDs)
+		if err != nil {
+			return fmt.Errorf("invalid allowed user IDs: %s", err)
+		}
+		gids, err := parseIDList(cfg.AllowedGIDs)
+		if err != nil {
+			return fmt.Errorf("invalid allowed group IDs: %s", err)
+		}
+		lcfg.UnixPeers = &UnixPeerPolicy{
+			UIDs: uids,
+			GIDs: gids,
+		}
+	}
+	err = MainInstance.RunListener(netceptor.MainInstance.Context(), lcfg)
 	if err != nil {
 		return err
 	}
@@ -358,8 +1093,24 @@ func (cfg CmdlineConfigUnix) Run() error {
 // Run runs the action
 func (cfg CmdlineConfigWindows) Run() error {
 	return CmdlineConfigUnix{
-		Service: cfg.Service,
-		TLS:     cfg.TLS,
+		Service:              cfg.Service,
+		TLS:                  cfg.TLS,
+		ClientAuth:           cfg.ClientAuth,
+		MaxBridges:           cfg.MaxBridges,
+		MaxLineLength:        cfg.MaxLineLength,
+		MaxSessions:          cfg.MaxSessions,
+		QueueSessions:        cfg.QueueSessions,
+		MaxCommandsPerSecond: cfg.MaxCommandsPerSecond,
+		CommandBurst:         cfg.CommandBurst,
+		RateLimitDelay:       cfg.RateLimitDelay,
+		CommandTimeout:       cfg.CommandTimeout,
+		IdleTimeout:          cfg.IdleTimeout,
+		SessionGracePeriod:   cfg.SessionGracePeriod,
+		WriteRetries:         cfg.WriteRetries,
+		WriteRetryDelay:      cfg.WriteRetryDelay,
+		GreetingCapabilities: cfg.GreetingCapabilities,
+		AuditLog:             cfg.AuditLog,
+		AllowedCommands:      cfg.AllowedCommands,
 	}.Run()
 }
 
@@ -0,0 +1,3520 @@
+package controlsvc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/prep/socketpair"
+	"github.com/project-receptor/receptor/pkg/logger"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/tracing"
+	"github.com/project-receptor/receptor/pkg/utils"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLine reads a single newline-terminated line from a connection, without reading ahead, so
+// that tests can go on to read the raw connection
+func readLine(conn net.Conn) (string, error) {
+	lineBytes := make([]byte, 0)
+	buf := make([]byte, 1)
+	for {
+		n, err := conn.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				return string(lineBytes), nil
+			}
+			lineBytes = append(lineBytes, buf[0])
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func TestReadChunksFromConn(t *testing.T) {
+	payload := make([]byte, 5*1024*1024+123)
+	_, err := rand.Read(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+
+	go func() {
+		prompt, err := readLine(client)
+		if err != nil || prompt != "Send data" {
+			_ = client.Close()
+			return
+		}
+		chunkSize := 64 * 1024
+		for pos := 0; pos < len(payload); pos += chunkSize {
+			end := pos + chunkSize
+			if end > len(payload) {
+				end = len(payload)
+			}
+			_, err = client.Write([]byte(fmt.Sprintf("%d\n", end-pos)))
+			if err == nil {
+				_, err = client.Write(payload[pos:end])
+			}
+			if err != nil {
+				return
+			}
+		}
+		_, _ = client.Write([]byte("0\nnext command\n"))
+	}()
+
+	sc := newSockControl(server)
+	out := &bytes.Buffer{}
+	err = sc.ReadChunksFromConn("Send data\n", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Fatalf("received %d bytes that do not match the %d byte payload", out.Len(), len(payload))
+	}
+
+	// The connection must still be usable after the terminating chunk
+	line, err := sc.lines.readLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "next command" {
+		t.Fatalf("unexpected data after payload: %q", line)
+	}
+}
+
+func TestReadChunksFromConnBadLength(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+	go func() {
+		_, _ = client.Write([]byte("not-a-number\n"))
+	}()
+	sc := newSockControl(server)
+	err := sc.ReadChunksFromConn("", &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("invalid chunk length was accepted")
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+	go func() {
+		// Send everything at once, so that lines arrive in the same read
+		_, _ = client.Write([]byte("first\n" + strings.Repeat("x", 100) + "\nsecond\nraw data"))
+		_ = client.Close()
+	}()
+	r := newLineReader(server, 50)
+	line, err := r.readLine()
+	if err != nil || line != "first" {
+		t.Fatalf("unexpected first line %q, error %v", line, err)
+	}
+	_, err = r.readLine()
+	if _, ok := err.(*lineTooLongError); !ok {
+		t.Fatalf("overlong line was not rejected: %v", err)
+	}
+	line, err = r.readLine()
+	if err != nil || line != "second" {
+		t.Fatalf("line after overlong line was not read: %q, error %v", line, err)
+	}
+
+	// Bytes buffered past the last line are returned by Read, for commands that take over the connection
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "raw data" {
+		t.Fatalf("buffered data was lost: %q", rest)
+	}
+}
+
+// uploadCommandType is a control command that reads chunked data from the client
+type uploadCommandType struct {
+	received chan []byte
+}
+
+func (t *uploadCommandType) InitFromString(params string) (ControlCommand, error) {
+	return t, nil
+}
+
+func (t *uploadCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return t, nil
+}
+
+func (t *uploadCommandType) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	out := &bytes.Buffer{}
+	err := cfo.ReadChunksFromConn("", out)
+	if err != nil {
+		return nil, err
+	}
+	t.received <- out.Bytes()
+	cfr := make(map[string]interface{})
+	cfr["Success"] = true
+	return cfr, nil
+}
+
+func TestCommandLineLimits(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err := s.SetMaxLineLength(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := &uploadCommandType{received: make(chan []byte, 1)}
+	err = s.AddControlFunc("upload", upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An overlong command is rejected without ending the session
+	_, err = client.Write([]byte(`{"command": "status", "padding": "` + strings.Repeat("x", 2048) + `"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "ERROR: ") || !strings.Contains(line, "maximum length") {
+		t.Fatalf("overlong command was not rejected: %q", line)
+	}
+
+	// Data sent in the same write as the command line still reaches the command
+	_, err = client.Write([]byte("upload\n5\nhello0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-upload.received:
+		if string(data) != "hello" {
+			t.Fatalf("command received %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command did not receive its data")
+	}
+	line, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, "Success") {
+		t.Fatalf("unexpected upload response %q", line)
+	}
+}
+
+func TestDebugMemstats(t *testing.T) {
+	ct := &debugCommandType{}
+	cc, err := ct.InitFromString("memstats gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cc.ControlFunc(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"Alloc", "TotalAlloc", "Sys", "HeapAlloc", "HeapSys", "HeapInuse",
+		"HeapObjects", "NumGC", "PauseTotalNs", "LastPauseNs", "NumGoroutine", "GCTriggered"} {
+		_, ok := cfr[key]
+		if !ok {
+			t.Fatalf("memstats result is missing %s", key)
+		}
+	}
+	if cfr["GCTriggered"] != true || cfr["NumGC"].(uint32) == 0 {
+		t.Fatal("memstats did not report the triggered garbage collection")
+	}
+	if cfr["HeapAlloc"].(uint64) == 0 || cfr["Sys"].(uint64) < cfr["HeapAlloc"].(uint64) {
+		t.Fatalf("implausible memory stats: heap %d, sys %d", cfr["HeapAlloc"], cfr["Sys"])
+	}
+
+	_, err = ct.InitFromString("memstats now")
+	if err == nil {
+		t.Fatal("invalid memstats parameter was accepted")
+	}
+	_, err = ct.InitFromJSON(map[string]interface{}{"subcommand": "memstats", "gc": "yes"})
+	if err == nil {
+		t.Fatal("non-boolean gc parameter was accepted")
+	}
+}
+
+// streamCommandType is a control command that streams data until the session goes away
+type streamCommandType struct {
+	cleanup chan struct{}
+}
+
+type streamCommand struct {
+	cleanup chan struct{}
+}
+
+func (t *streamCommandType) InitFromString(params string) (ControlCommand, error) {
+	return &streamCommand{cleanup: t.cleanup}, nil
+}
+
+func (t *streamCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return &streamCommand{cleanup: t.cleanup}, nil
+}
+
+func (c *streamCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	dataChan := make(chan []byte)
+	go func() {
+		defer close(c.cleanup)
+		for {
+			select {
+			case dataChan <- []byte("data\n"):
+			case <-cfo.Done():
+				return
+			}
+		}
+	}()
+	err := cfo.WriteToConn("Streaming\n", dataChan)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func TestStreamClientDisappears(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(false, nc)
+	cleanup := make(chan struct{})
+	err := s.AddControlFunc("stream", &streamCommandType{cleanup: cleanup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	go s.RunControlSession(server)
+
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte("stream\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = client.Close()
+
+	select {
+	case <-cleanup:
+	case <-time.After(5 * time.Second):
+		t.Fatal("streaming command did not clean up after the client went away")
+	}
+}
+
+func TestWriteCancelsSession(t *testing.T) {
+	server, client := net.Pipe()
+	_ = client.Close()
+	sc := newSockControl(server)
+	err := sc.write([]byte("hello\n"))
+	if err == nil {
+		t.Fatal("write to a closed connection succeeded")
+	}
+	select {
+	case <-sc.Done():
+	default:
+		t.Fatal("failed write did not cancel the session")
+	}
+}
+
+// timeoutError is a transient network error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// flakyConn is a connection whose first writes fail with a transient error
+type flakyConn struct {
+	net.Conn
+	failures int
+	writes   int
+}
+
+func (fc *flakyConn) Write(b []byte) (int, error) {
+	fc.writes++
+	if fc.failures > 0 {
+		fc.failures--
+		return 0, timeoutError{}
+	}
+	return len(b), nil
+}
+
+func TestWriteRetryPolicy(t *testing.T) {
+	s := New(false, nil)
+	err := s.SetWriteRetryPolicy(-1, time.Millisecond)
+	if err == nil {
+		t.Fatal("negative write retries were accepted")
+	}
+	err = s.SetWriteRetryPolicy(2, -time.Millisecond)
+	if err == nil {
+		t.Fatal("negative write retry delay was accepted")
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	sc := newSockControl(server)
+	sc.writeRetryDelay = time.Millisecond
+	fc := &flakyConn{Conn: server, failures: 2}
+	sc.conn = fc
+	sc.writeRetries = 2
+	err = sc.write([]byte("hello\n"))
+	if err != nil {
+		t.Fatalf("write failed within the retry limit: %s", err)
+	}
+	if fc.writes != 3 {
+		t.Fatalf("expected 3 write attempts, got %d", fc.writes)
+	}
+
+	fc = &flakyConn{Conn: server, failures: 2}
+	sc.conn = fc
+	sc.writeRetries = 1
+	err = sc.write([]byte("hello\n"))
+	if err == nil {
+		t.Fatal("write succeeded beyond the retry limit")
+	}
+	if fc.writes != 2 {
+		t.Fatalf("expected 2 write attempts, got %d", fc.writes)
+	}
+	select {
+	case <-sc.Done():
+	default:
+		t.Fatal("failed write did not cancel the session")
+	}
+}
+
+func TestBridgeLimit(t *testing.T) {
+	br := newBridgeRegistry(2)
+	conns := make([]net.Conn, 0)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	// startBridge bridges a new control session to a new remote connection and returns the BridgeConn error
+	startBridge := func(service string) chan error {
+		server, client := net.Pipe()
+		remote, remoteClient := net.Pipe()
+		conns = append(conns, server, client, remote, remoteClient)
+		sc := newSockControl(server)
+		sc.bridges = br
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- sc.BridgeConn("", remote, service)
+		}()
+		return errChan
+	}
+	waitForCount := func(service string, count int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for br.count(service) != count {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s has %d bridges, expected %d", service, br.count(service), count)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	startBridge("node1:svcA")
+	startBridge("node1:svcA")
+	waitForCount("node1:svcA", 2)
+	select {
+	case err := <-startBridge("node1:svcA"):
+		if err == nil {
+			t.Fatal("bridge beyond the limit was accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge beyond the limit was not rejected")
+	}
+	waitForCount("node1:svcA", 2)
+
+	errChan := startBridge("node1:svcB")
+	waitForCount("node1:svcB", 1)
+	select {
+	case err := <-errChan:
+		t.Fatalf("bridge to another service ended early: %v", err)
+	default:
+	}
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	waitForCount("node1:svcA", 0)
+	waitForCount("node1:svcB", 0)
+}
+
+func TestCommandStatsReset(t *testing.T) {
+	s := New(true, nil)
+	s.commandStats.count("ping", false)
+	s.commandStats.count("ping", true)
+	s.commandStats.count("status", false)
+	stats := s.CommandStats()
+	if stats["ping"].Invocations != 2 || stats["ping"].Errors != 1 || stats["status"].Invocations != 1 {
+		t.Fatalf("unexpected command stats %v", stats)
+	}
+
+	ct := &statsCommandType{s: s}
+	cc, err := ct.InitFromString("reset command ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cc.ControlFunc(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["Success"] != true {
+		t.Fatalf("stats reset failed: %v", cfr)
+	}
+	stats = s.CommandStats()
+	if stats["ping"].Invocations != 0 || stats["ping"].Errors != 0 || stats["status"].Invocations != 1 {
+		t.Fatalf("unexpected command stats after reset %v", stats)
+	}
+
+	err = s.ResetCommandStats("nonexistent")
+	if err == nil {
+		t.Fatal("reset of an unknown command succeeded")
+	}
+	err = s.ResetCommandStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.CommandStats()) != 0 {
+		t.Fatal("command stats were not reset")
+	}
+
+	_, err = ct.InitFromString("reset node ping")
+	if err == nil {
+		t.Fatal("invalid stats reset scope was accepted")
+	}
+	_, err = ct.InitFromJSON(map[string]interface{}{"subcommand": "reset", "backend": "b1", "command": "ping"})
+	if err == nil {
+		t.Fatal("stats reset scoped to both a backend and a command was accepted")
+	}
+}
+
+func TestGlobalLogLevel(t *testing.T) {
+	defer logger.SetLogLevel(logger.GetLogLevel())
+	ct := &loglevelCommandType{}
+	cc, err := ct.InitFromString("DEBUG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cc.ControlFunc(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["Success"] != true || cfr["Global"] != "debug" || logger.GetLogLevel() != logger.DebugLevel {
+		t.Fatalf("global log level was not set: %v", cfr)
+	}
+	if cfr["New"] != "debug" {
+		t.Fatalf("unexpected new level in %v", cfr)
+	}
+
+	cc, err = ct.InitFromJSON(map[string]interface{}{"level": "warning"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err = cc.ControlFunc(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger.GetLogLevel() != logger.WarningLevel {
+		t.Fatal("global log level was not set from JSON")
+	}
+	if cfr["Previous"] != "debug" || cfr["New"] != "warning" {
+		t.Fatalf("unexpected previous and new levels in %v", cfr)
+	}
+
+	logger.Named("loglevel-test")
+	cc, err = ct.InitFromString("loglevel-test debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err = cc.ControlFunc(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["Previous"] != "warning" || cfr["New"] != "debug" {
+		t.Fatalf("unexpected previous and new subsystem levels in %v", cfr)
+	}
+	cc, _ = ct.InitFromString("loglevel-test default")
+	cfr, _ = cc.ControlFunc(nil, nil)
+	if cfr["Previous"] != "debug" || cfr["New"] != "warning" {
+		t.Fatalf("unexpected levels after resetting a subsystem in %v", cfr)
+	}
+
+	_, err = ct.InitFromString("verbose")
+	if err == nil {
+		t.Fatal("invalid global log level was accepted")
+	}
+	_, err = ct.InitFromString("default")
+	if err == nil {
+		t.Fatal("default was accepted as a global log level")
+	}
+}
+
+// greetingUploadCommandType is a control command that asks for chunked data with a greeting, like
+// work submit
+type greetingUploadCommandType struct{}
+
+func (t *greetingUploadCommandType) InitFromString(params string) (ControlCommand, error) {
+	return t, nil
+}
+
+func (t *greetingUploadCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return t, nil
+}
+
+func (t *greetingUploadCommandType) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	out := &bytes.Buffer{}
+	err := cfo.ReadChunksFromConn("Send data as chunks.\n", out)
+	if err != nil {
+		return nil, err
+	}
+	cfr := make(map[string]interface{})
+	cfr["Received"] = out.Len()
+	return cfr, nil
+}
+
+func TestRunScript(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err := s.AddControlFunc("upload", &greetingUploadCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := make([]string, 0)
+	s.SetAuthorizer(func(req *AuthRequest) bool {
+		listeners = append(listeners, req.Conn.Listener)
+		return true
+	})
+	script := `# Startup script
+
+loglevel
+bogus
+upload
+{"command": "loglevel", "level": "verbose"}
+  loglevel
+`
+	results, err := s.RunScript(context.Background(), strings.NewReader(script), false, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	expected := []struct {
+		line    int
+		command string
+		failed  bool
+	}{
+		{3, "loglevel", false},
+		{4, "bogus", true},
+		{5, "upload", false},
+		{6, "", true},
+		{7, "loglevel", false},
+	}
+	for i, e := range expected {
+		r := results[i]
+		if r.Line != e.line || (e.command != "" && r.Command != e.command) || (r.Err != nil) != e.failed {
+			t.Errorf("unexpected result %d: line %d, command %q, error %v", i, r.Line, r.Command, r.Err)
+		}
+	}
+	if results[2].Result["Received"] != float64(0) {
+		t.Errorf("upload command did not get empty input: %v", results[2].Result)
+	}
+	for _, l := range listeners {
+		if l != ScriptListener {
+			t.Errorf("script command ran on listener %s", l)
+		}
+	}
+
+	results, err = s.RunScript(context.Background(), strings.NewReader("loglevel\nbogus\nloglevel\n"), true, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected the script to fail on line 2, got %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("script did not stop at the failing command: %d results", len(results))
+	}
+
+	_, err = s.RunScript(context.Background(), strings.NewReader(strings.Repeat("x", DefaultMaxLineLength+1)), false, 0)
+	if err == nil {
+		t.Fatal("script with an overlong line was accepted")
+	}
+}
+
+// newTestTLSConfigs returns a server TLS config with a self-signed certificate for a host name, and
+// a client TLS config that trusts it
+func newTestTLSConfigs(t *testing.T, hostName string) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName: hostName,
+		},
+		DNSNames:  []string{hostName},
+		NotBefore: time.Now().Add(-1 * time.Minute),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	client := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	return server, client
+}
+
+// linkNodes connects two nodes over a socket pair, using a new external backend on each node, and
+// waits until the first node has a route to the second.  If name is not empty, both backends are
+// added with that name, so they can be managed by name.
+func linkNodes(t *testing.T, n1 *netceptor.Netceptor, n2 *netceptor.Netceptor, name string, cost float64) {
+	addBackend := func(n *netceptor.Netceptor) *netceptor.ExternalBackend {
+		b, err := netceptor.NewExternalBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "" {
+			err = n.AddBackend(b, cost, nil)
+		} else {
+			err = n.AddNamedBackend(name, b, cost, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	b1 := addBackend(n1)
+	b2 := addBackend(n2)
+	c1, c2, err := socketpair.New("unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1.NewConnection(c1, true)
+	b2.NewConnection(c2, true)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, ok := n1.Status().RoutingTable[n2.NodeID()]
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for route to %s", n2.NodeID())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestTestConnect(t *testing.T) {
+	n1 := netceptor.New(context.Background(), "node1", nil)
+	n2 := netceptor.New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	li, err := n2.Listen("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	linkNodes(t, n1, n2, "", 1.0)
+
+	ct := &connectCommandType{dryRun: true}
+	cc, err := ct.InitFromString("node2 echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cc.ControlFunc(n1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["Success"] != true || cfr["Latency"].(time.Duration) <= 0 {
+		t.Fatalf("testconnect to a running service failed: %v", cfr)
+	}
+
+	cc, err = ct.InitFromJSON(map[string]interface{}{"node": "node2", "service": "nothing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err = cc.ControlFunc(n1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["Success"] != false || !strings.Contains(cfr["Error"].(string), "unreachable") {
+		t.Fatalf("testconnect to a missing service did not report why it failed: %v", cfr)
+	}
+
+	// A TLS service is only reached once its certificate is verified against the server name
+	serverTLS, clientTLS := newTestTLSConfigs(t, "secure.example")
+	tli, err := n2.Listen("secure", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tli.Close()
+	go func() {
+		for {
+			conn, err := tli.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	err = n1.SetClientTLSConfig("secure", clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ct.InitFromJSON(map[string]interface{}{"node": "node2", "service": "secure", "servername": "secure.example"})
+	if err == nil {
+		t.Fatal("server name without a TLS config was accepted")
+	}
+	cc, err = ct.InitFromString("node2 secure secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err = cc.ControlFunc(n1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["Success"] != false || !strings.Contains(cfr["Error"].(string), "TLS config secure") {
+		t.Fatalf("testconnect with the wrong server name did not fail: %v", cfr)
+	}
+	cc, err = ct.InitFromString("node2 secure secure secure.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err = cc.ControlFunc(n1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["Success"] != true || cfr["TLS"] != "secure" || cfr["TLSPeer"] != "CN=secure.example" {
+		t.Fatalf("testconnect with TLS failed: %v", cfr)
+	}
+}
+
+func TestCommandSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	oldProvider := tracing.TracerProvider()
+	tracing.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer tracing.SetTracerProvider(oldProvider)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(false, nc)
+	err := s.AddControlFunc("debug", &debugCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{"debug memstats", "debug nothing"} {
+		_, err = client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only look at command spans, not at those of the node's own netceptor traffic
+	spans := make(tracetest.SpanStubs, 0)
+	for _, span := range exporter.GetSpans() {
+		if strings.HasPrefix(span.Name, "control ") {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != 2 {
+		t.Fatalf("expected one span per command, got %d", len(spans))
+	}
+	for i, span := range spans {
+		if span.Name != "control debug" || !span.EndTime.After(span.StartTime) {
+			t.Fatalf("unexpected span %s from %s to %s", span.Name, span.StartTime, span.EndTime)
+		}
+		commandAttr := false
+		for _, attr := range span.Attributes {
+			if attr.Key == "receptor.command" && attr.Value.AsString() == "debug" {
+				commandAttr = true
+			}
+		}
+		if !commandAttr {
+			t.Fatalf("span %s does not record the command name", span.Name)
+		}
+		failed := span.Status.Code != codes.Unset
+		if failed != (i == 1) {
+			t.Fatalf("span %d has status %v", i, span.Status)
+		}
+	}
+}
+
+func TestMsgpackResponse(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+
+	_, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte(`{"command": "status", "encoding": "msgpack"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(header, "MSGPACK ") {
+		t.Fatalf("unexpected response header %q", header)
+	}
+	length, err := strconv.Atoi(strings.TrimPrefix(header, "MSGPACK "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(client, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]interface{})
+	err = msgpack.Unmarshal(data, &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status["NodeID"] != "node1" {
+		t.Fatalf("unexpected status response %v", status)
+	}
+
+	_, err = client.Write([]byte(`{"command": "status", "encoding": "xml"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "ERROR: ") {
+		t.Fatalf("unknown encoding was accepted: %q", line)
+	}
+}
+
+// graphCommandType is a control command that returns the routing graph of a large mesh
+type graphCommandType struct {
+	nodes int
+}
+
+type graphCommand struct {
+	nodes int
+}
+
+func (t *graphCommandType) InitFromString(params string) (ControlCommand, error) {
+	return &graphCommand{nodes: t.nodes}, nil
+}
+
+func (t *graphCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return &graphCommand{nodes: t.nodes}, nil
+}
+
+func (c *graphCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	graph := make(map[string]interface{})
+	for i := 0; i < c.nodes; i++ {
+		graph[fmt.Sprintf("node%d", i)] = map[string]interface{}{
+			fmt.Sprintf("node%d", (i+1)%c.nodes): 1.0,
+			fmt.Sprintf("node%d", (i+7)%c.nodes): 2.5,
+		}
+	}
+	cfr := make(map[string]interface{})
+	cfr["KnownConnectionCosts"] = graph
+	return cfr, nil
+}
+
+// readTestGzipBlocks reads the "GZIP <length>" blocks of a compressed response, returning the
+// gzip data and the number of blocks it was sent in
+func readTestGzipBlocks(conn net.Conn) ([]byte, int, error) {
+	data := make([]byte, 0)
+	blocks := 0
+	for {
+		header, err := readLine(conn)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !strings.HasPrefix(header, "GZIP ") {
+			return nil, 0, fmt.Errorf("unexpected response header %q", header)
+		}
+		length, err := strconv.Atoi(strings.TrimPrefix(header, "GZIP "))
+		if err != nil {
+			return nil, 0, err
+		}
+		if length == 0 {
+			return data, blocks, nil
+		}
+		block := make([]byte, length)
+		_, err = io.ReadFull(conn, block)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = append(data, block...)
+		blocks++
+	}
+}
+
+func TestCompressedResponse(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err := s.AddControlFunc("graph", &graphCommandType{nodes: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte(`{"command": "graph", "compression": "gzip"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "ERROR: ") {
+		t.Fatalf("compression was accepted without being offered in the greeting: %q", line)
+	}
+	client.Close()
+
+	s.SetGreetingCapabilities(true)
+	server, client = net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Write([]byte(`{"command": "graph"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Write([]byte(`{"command": "graph", "compression": "gzip"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, blocks, err := readTestGzipBlocks(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(plain) {
+		t.Fatalf("compressed response of %d bytes is not smaller than %d bytes", len(data), len(plain))
+	}
+	if blocks < 2 {
+		t.Fatalf("compressed response of %d bytes was not streamed in blocks", len(plain))
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decompressed) != plain+"\n" {
+		t.Fatal("decompressed response does not match the uncompressed response")
+	}
+
+	_, err = client.Write([]byte(`{"command": "graph", "compression": "lz4"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "ERROR: ") {
+		t.Fatalf("unknown compression was accepted: %q", line)
+	}
+}
+
+func TestCompressedFramedResponse(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	s.SetGreetingCapabilities(true)
+	err := s.AddControlFunc("graph", &graphCommandType{nodes: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte(FramedHandshake + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Write(appendFrame(nil, []byte(`{"command": "graph"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := readTestFrame(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write(appendFrame(nil, []byte(`{"command": "graph", "compression": "gzip"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 0)
+	for {
+		frame, err := readTestFrame(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) == 0 {
+			break
+		}
+		data = append(data, frame...)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, plain) {
+		t.Fatal("decompressed response does not match the uncompressed response")
+	}
+}
+
+// recordsCommandType is a control command that streams the records sent to each channel it is given
+type recordsCommandType struct {
+	streams chan chan []byte
+}
+
+type recordsCommand struct {
+	records chan []byte
+}
+
+func (t *recordsCommandType) InitFromString(params string) (ControlCommand, error) {
+	return &recordsCommand{records: <-t.streams}, nil
+}
+
+func (t *recordsCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return &recordsCommand{records: <-t.streams}, nil
+}
+
+func (c *recordsCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	return nil, cfo.WriteToConn("", c.records)
+}
+
+func TestFlushPolicy(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(false, nc)
+	streams := make(chan chan []byte, 1)
+	err := s.AddControlFunc("records", &recordsCommandType{streams: streams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddControlFunc("session", &sessionCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	runCommand := func(command string) {
+		_ = client.SetReadDeadline(time.Time{})
+		_, err := client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(line, `"Success":true`) {
+			t.Fatalf("%s failed: %s", command, line)
+		}
+	}
+	readRecords := func() string {
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	// In immediate mode, each record arrives before the next one is produced
+	runCommand("session flush immediate")
+	records := make(chan []byte)
+	streams <- records
+	_, err = client.Write([]byte("records\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"one\n", "two\n"} {
+		records <- []byte(rec)
+		got := readRecords()
+		if got != rec {
+			t.Fatalf("expected %q to be delivered on its own, got %q", rec, got)
+		}
+	}
+	close(records)
+
+	// In batch mode, records produced within the interval are coalesced into one write
+	runCommand("session flush batch 1024 300ms")
+	records = make(chan []byte)
+	streams <- records
+	_, err = client.Write([]byte("records\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for _, rec := range []string{"one\n", "two\n", "three\n"} {
+		records <- []byte(rec)
+	}
+	got := readRecords()
+	if got != "one\ntwo\nthree\n" {
+		t.Fatalf("expected the records to be coalesced, got %q", got)
+	}
+	if time.Since(start) < 250*time.Millisecond {
+		t.Fatal("batch was written before its interval elapsed")
+	}
+	close(records)
+
+	_, err = client.Write([]byte("session flush sometimes\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "ERROR: ") {
+		t.Fatalf("unknown flush mode was accepted: %q", line)
+	}
+}
+
+func TestSessionsList(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	cleanup := make(chan struct{})
+	err := s.AddControlFunc("stream", &streamCommandType{cleanup: cleanup})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamServer, streamClient := net.Pipe()
+	go s.RunControlSession(streamServer)
+	_, err = readLine(streamClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = streamClient.Write([]byte("stream\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readLine(streamClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte("sessions list\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]map[string]ControlSessionInfo)
+	err = json.Unmarshal([]byte(line), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := result["Sessions"]
+	if len(sessions) != 2 {
+		t.Fatalf("expected two sessions, got %v", sessions)
+	}
+	commands := make(map[string]bool)
+	for _, cs := range sessions {
+		commands[cs.Command] = true
+		if cs.Listener != "direct" || cs.Connected.IsZero() {
+			t.Fatalf("unexpected session information %v", cs)
+		}
+	}
+	if !commands["stream"] || !commands["sessions"] {
+		t.Fatalf("running commands were not listed: %v", sessions)
+	}
+
+	_ = streamClient.Close()
+	select {
+	case <-cleanup:
+	case <-time.After(5 * time.Second):
+		t.Fatal("streaming command did not clean up after the client went away")
+	}
+}
+
+type sleepCommandType struct {
+	delay time.Duration
+}
+
+type sleepCommand struct {
+	delay time.Duration
+}
+
+func (t *sleepCommandType) InitFromString(params string) (ControlCommand, error) {
+	return &sleepCommand{delay: t.delay}, nil
+}
+
+func (t *sleepCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return &sleepCommand{delay: t.delay}, nil
+}
+
+func (c *sleepCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	ctx := commandContext(cfo)
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	cfr := make(map[string]interface{})
+	cfr["Success"] = true
+	return cfr, nil
+}
+
+func TestCommandsList(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err := s.AddControlFunc("sleep", &sleepCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte("commands\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := struct {
+		Commands []struct {
+			Name        string
+			Description string
+		}
+	}{}
+	err = json.Unmarshal([]byte(line), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptions := make(map[string]string)
+	for i, c := range result.Commands {
+		if i > 0 && result.Commands[i-1].Name >= c.Name {
+			t.Fatalf("commands are not sorted: %s before %s", result.Commands[i-1].Name, c.Name)
+		}
+		descriptions[c.Name] = c.Description
+	}
+	for _, name := range []string{"ping", "status", "commands"} {
+		if descriptions[name] == "" {
+			t.Fatalf("built-in command %s is not listed with a description", name)
+		}
+	}
+	description, ok := descriptions["sleep"]
+	if !ok {
+		t.Fatal("added command is not listed")
+	}
+	if description != "" {
+		t.Fatalf("command without a description was described as %q", description)
+	}
+}
+
+func TestCommandAuthorization(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	requests := make([]*AuthRequest, 0)
+	s.SetAuthorizer(func(req *AuthRequest) bool {
+		requests = append(requests, req)
+		return req.Command != "connect"
+	})
+	err := s.AddControlFuncWithAuth("sleep", &sleepCommandType{}, func(req *AuthRequest) bool {
+		return req.JSON != nil && req.JSON["reason"] == "testing"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(command string) string {
+		_, err := client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+
+	if line := run("connect node2 control"); line != "ERROR: permission denied" {
+		t.Fatalf("command denied by the server authorizer ran: %q", line)
+	}
+	if line := run("ping node1"); strings.HasPrefix(line, "ERROR: permission denied") {
+		t.Fatal("command permitted by the server authorizer was denied")
+	}
+	if line := run("sleep"); line != "ERROR: permission denied" {
+		t.Fatalf("command denied by its own authorizer ran: %q", line)
+	}
+	if line := run(`{"command": "sleep", "reason": "testing"}`); !strings.Contains(line, "Success") {
+		t.Fatalf("command permitted by both authorizers did not run: %q", line)
+	}
+
+	if len(requests) != 4 {
+		t.Fatalf("server authorizer was called %d times", len(requests))
+	}
+	if requests[0].Params != "node2 control" || requests[3].JSON == nil {
+		t.Fatal("authorizer did not receive the command parameters")
+	}
+	for _, req := range requests {
+		if req.Conn == nil || req.Conn.Listener != "direct" {
+			t.Fatalf("authorizer did not receive the connection metadata: %v", req.Conn)
+		}
+		if req.Conn.PeerCertificate != nil {
+			t.Fatal("non-TLS connection has a peer certificate")
+		}
+	}
+}
+
+func TestMaintenanceModeRefusesMutations(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(command string) string {
+		_, err := client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+
+	nc.SetMaintenanceMode(true)
+	for _, command := range []string{"route interval 5s", "hmac add key1 secret", `{"command": "chaos", "subcommand": "fail", "backend": "b1"}`} {
+		if line := run(command); line != "ERROR: node is in maintenance mode" {
+			t.Fatalf("mutating command %s ran in maintenance mode: %q", command, line)
+		}
+	}
+	if nc.RouteUpdateInterval() == 5*time.Second {
+		t.Fatal("route interval was changed in maintenance mode")
+	}
+	if line := run("route interval"); strings.HasPrefix(line, "ERROR") {
+		t.Fatalf("read-only command was refused in maintenance mode: %q", line)
+	}
+
+	nc.SetMaintenanceMode(false)
+	if line := run("route interval 5s"); strings.HasPrefix(line, "ERROR") {
+		t.Fatalf("mutating command was refused after maintenance mode ended: %q", line)
+	}
+	if nc.RouteUpdateInterval() != 5*time.Second {
+		t.Fatal("route interval was not changed after maintenance mode ended")
+	}
+}
+
+// whoamiCommandType is a control command that reports the identity of the client
+type whoamiCommandType struct{}
+
+func (t *whoamiCommandType) InitFromString(params string) (ControlCommand, error) {
+	return t, nil
+}
+
+func (t *whoamiCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return t, nil
+}
+
+func (t *whoamiCommandType) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	info := cfo.ConnectionInfo()
+	cfr := make(map[string]interface{})
+	cfr["Listener"] = info.Listener
+	cfr["HasCertificate"] = info.PeerCertificate != nil
+	if info.UnixCredentials != nil {
+		cfr["UID"] = info.UnixCredentials.UID
+		cfr["PID"] = info.UnixCredentials.PID
+	}
+	return cfr, nil
+}
+
+func TestUnixPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(false, nc)
+	err = s.AddControlFunc("whoami", &whoamiCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filename := path.Join(tmpdir, "control.sock")
+	err = s.RunControlSvc(ctx, "", nil, filename, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte("whoami\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := struct {
+		Listener       string
+		HasCertificate bool
+		UID            *int
+		PID            *int
+	}{}
+	err = json.Unmarshal([]byte(line), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Listener != "unix:"+filename || result.HasCertificate {
+		t.Fatalf("unexpected connection info %q", line)
+	}
+	if result.UID == nil || *result.UID != os.Getuid() || result.PID == nil || *result.PID != os.Getpid() {
+		t.Fatalf("peer credentials do not match this process: %q", line)
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	li, err := nc.Listen("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	s := New(true, nc)
+	err = s.AddControlFunc("sleep", &sleepCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pipeline several commands, then match up the responses
+	go func() {
+		_, _ = client.Write([]byte(`{"command": "sleep", "id": 1}` + "\n" +
+			`{"command": "sleep", "id": "second"}` + "\n" +
+			`{"command": "nonexistent", "id": 3}` + "\n" +
+			`{"command": "connect", "node": "node1", "service": "echo", "id": 4}` + "\n" +
+			`{"command": "sleep"}` + "\n"))
+	}()
+	responses := make([]map[string]interface{}, 0)
+	for i := 0; i < 5; i++ {
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := make(map[string]interface{})
+		err = json.Unmarshal([]byte(line), &response)
+		if err != nil {
+			t.Fatalf("response %d is not JSON: %q", i, line)
+		}
+		responses = append(responses, response)
+	}
+	if responses[0]["id"] != 1.0 || responses[0]["Success"] != true {
+		t.Fatalf("unexpected first response %v", responses[0])
+	}
+	if responses[1]["id"] != "second" || responses[1]["Success"] != true {
+		t.Fatalf("unexpected second response %v", responses[1])
+	}
+	if responses[2]["id"] != 3.0 || responses[2]["Error"] != "Unknown command" {
+		t.Fatalf("error response did not carry the request ID: %v", responses[2])
+	}
+	errStr, _ := responses[3]["Error"].(string)
+	if responses[3]["id"] != 4.0 || !strings.Contains(errStr, "request ID") {
+		t.Fatalf("bridging command with a request ID was not rejected: %v", responses[3])
+	}
+	_, ok := responses[4]["id"]
+	if ok || responses[4]["Success"] != true {
+		t.Fatalf("response to a command without an ID has one: %v", responses[4])
+	}
+}
+
+func TestMultiplexedTakeover(t *testing.T) {
+	sc := newSockControl(nil)
+	sc.multiplexed = true
+	bc, other := net.Pipe()
+	defer other.Close()
+	in := make(chan []byte)
+	takeovers := map[string]func() error{
+		"BridgeConn": func() error {
+			return sc.BridgeConn("", bc, "test")
+		},
+		"ReadFromConn": func() error {
+			return sc.ReadFromConn("", &bytes.Buffer{})
+		},
+		"ReadChunksFromConn": func() error {
+			return sc.ReadChunksFromConn("", &bytes.Buffer{})
+		},
+		"WriteToConn": func() error {
+			return sc.WriteToConn("", in)
+		},
+		"WriteStreamToConn": func() error {
+			return sc.WriteStreamToConn("", in, make(chan error))
+		},
+		"WriteChunksToConn": func() error {
+			return sc.WriteChunksToConn("", in, make(chan error))
+		},
+	}
+	for name, takeover := range takeovers {
+		err := takeover()
+		if err != errMultiplexedTakeover {
+			t.Fatalf("%s did not reject a command with a request ID: %v", name, err)
+		}
+	}
+}
+
+func TestCommandLatency(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	delay := 20 * time.Millisecond
+	err := s.AddControlFunc("sleep", &sleepCommandType{delay: delay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := 10
+	for i := 0; i < runs; i++ {
+		_, err = client.Write([]byte("sleep\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = client.Write([]byte("stats latency\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := struct {
+		Commands map[string]LatencyHistogram
+	}{}
+	err = json.Unmarshal([]byte(line), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := result.Commands["sleep"]
+	if !ok {
+		t.Fatalf("no latency histogram for sleep: %s", line)
+	}
+	if h.Count != runs {
+		t.Fatalf("expected %d runs, got %d", runs, h.Count)
+	}
+	if h.P50 < delay || h.P50 > h.P95 || h.P95 > h.P99 || h.P99 > h.Max || h.Max > delay+time.Second {
+		t.Fatalf("implausible latency histogram %+v", h)
+	}
+
+	// Samples drop out of the histogram once they are older than the window
+	lr := newLatencyRegistry()
+	now := time.Now()
+	lr.record("old", time.Second, now.Add(-2*LatencyWindow))
+	for i := 1; i <= 100; i++ {
+		lr.record("new", time.Duration(i)*time.Millisecond, now)
+	}
+	hists := lr.histograms(now)
+	if _, ok := hists["old"]; ok {
+		t.Fatal("samples outside the window were included")
+	}
+	if hists["new"].P50 != 50*time.Millisecond || hists["new"].P99 != 99*time.Millisecond || hists["new"].Max != 100*time.Millisecond {
+		t.Fatalf("unexpected percentiles %+v", hists["new"])
+	}
+}
+
+type failingStreamCommandType struct{}
+
+type failingStreamCommand struct{}
+
+func (t *failingStreamCommandType) InitFromString(params string) (ControlCommand, error) {
+	return &failingStreamCommand{}, nil
+}
+
+func (t *failingStreamCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return &failingStreamCommand{}, nil
+}
+
+func (c *failingStreamCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	records := make(chan []byte)
+	errChan := make(chan error, 1)
+	go func() {
+		records <- []byte("one\n")
+		// Data that looks like a trailer must not end the stream
+		records <- []byte(`{"StreamError": "not really"}` + "\n")
+		records <- []byte("two")
+		errChan <- fmt.Errorf("disk on fire")
+	}()
+	err := cfo.WriteChunksToConn("Streaming\n", records, errChan)
+	if err != nil {
+		return nil, err
+	}
+	return nil, cfo.Close()
+}
+
+// readTestChunk reads a length-prefixed chunk written by WriteChunksToConn
+func readTestChunk(conn net.Conn) ([]byte, error) {
+	line, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.Atoi(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk length %q", line)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(conn, data)
+	return data, err
+}
+
+func TestStreamTerminalError(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(false, nc)
+	err := s.AddControlFunc("failing", &failingStreamCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, framed := range []bool{false, true} {
+		server, client := net.Pipe()
+		go s.RunControlSession(server)
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Messages and the trailer are lines, or frames in a framed session
+		readChunk, readMessage := readTestChunk, func(conn net.Conn) ([]byte, error) {
+			line, err := readLine(conn)
+			return []byte(line), err
+		}
+		if framed {
+			_, err = client.Write([]byte(FramedHandshake + "\n"))
+			if err == nil {
+				_, err = readLine(client)
+			}
+			if err == nil {
+				_, err = client.Write(appendFrame(nil, []byte("failing")))
+			}
+			readChunk, readMessage = readTestFrame, readTestFrame
+		} else {
+			_, err = client.Write([]byte("failing\n"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := readMessage(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(message)) != "Streaming" {
+			t.Fatalf("framed=%t: unexpected stream message %q", framed, message)
+		}
+		data := make([]byte, 0)
+		for {
+			chunk, err := readChunk(client)
+			if err != nil {
+				t.Fatalf("framed=%t: %s", framed, err)
+			}
+			if len(chunk) == 0 {
+				break
+			}
+			data = append(data, chunk...)
+		}
+		if string(data) != "one\n{\"StreamError\": \"not really\"}\ntwo" {
+			t.Fatalf("framed=%t: unexpected stream data %q", framed, data)
+		}
+		trailer, err := readMessage(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := make(map[string]string)
+		err = json.Unmarshal(trailer, &record)
+		if err != nil {
+			t.Fatalf("framed=%t: trailer %q is not JSON: %s", framed, trailer, err)
+		}
+		if record[StreamErrorKey] != "disk on fire" {
+			t.Fatalf("framed=%t: unexpected trailer %q", framed, trailer)
+		}
+		_ = client.Close()
+	}
+}
+
+func TestPeersAllowed(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", []string{"node2"})
+	defer nc.Shutdown()
+	ct := &peersCommandType{}
+	runPeers := func(params string) map[string]interface{} {
+		cc, err := ct.InitFromString(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfr, err := cc.ControlFunc(nc, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfr["Success"] != true {
+			t.Fatalf("peers %s failed: %v", params, cfr)
+		}
+		return cfr
+	}
+	checkPeers := func(cfr map[string]interface{}, source string, peers ...string) {
+		if cfr["Source"] != source {
+			t.Fatalf("expected source %s, got %v", source, cfr["Source"])
+		}
+		allowed := cfr["AllowedPeers"].([]string)
+		if strings.Join(allowed, ",") != strings.Join(peers, ",") {
+			t.Fatalf("expected allowed peers %v, got %v", peers, allowed)
+		}
+	}
+	checkPeers(runPeers("allowed"), netceptor.AllowedPeersSourceConfig, "node2")
+
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	filename := path.Join(tmpdir, "peers")
+	err = ioutil.WriteFile(filename, []byte("# allowed peers\nnode3\n\nnode4\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nc.LoadAllowedPeersFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPeers(runPeers("allowed"), netceptor.AllowedPeersSourceFile, "node3", "node4")
+
+	err = ioutil.WriteFile(filename, []byte("node5\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPeers(runPeers("reload"), netceptor.AllowedPeersSourceFile, "node5")
+
+	nc.SetAllowedPeers(nil)
+	cfr := runPeers("allowed")
+	checkPeers(cfr, netceptor.AllowedPeersSourceNone)
+	if cfr["AllowAll"] != true {
+		t.Fatalf("all peers are not allowed after clearing the list: %v", cfr)
+	}
+
+	_, err = ct.InitFromString("set node6")
+	if err == nil {
+		t.Fatal("peers set should not be accepted from a control client")
+	}
+	_, err = ct.InitFromJSON(map[string]interface{}{"subcommand": "set", "peers": "*"})
+	if err == nil {
+		t.Fatal("peers set should not be accepted from a JSON control client")
+	}
+}
+
+func TestLossMeasurement(t *testing.T) {
+	n1 := netceptor.New(context.Background(), "node1", nil)
+	n2 := netceptor.New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	n1.EnableChaos()
+	linkNodes(t, n1, n2, "link", 1.0)
+
+	lr, err := measureLoss(n1, "node2", netceptor.MaxForwardingHops, 50, 5*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.Sent != 50 || lr.Received != 50 || lr.Loss != 0 || lr.From != "node2" {
+		t.Fatalf("unexpected result on a clean link: %+v", lr)
+	}
+
+	// Frames are dropped in both directions, so a probe and its reply both survive with
+	// probability (1 - 0.2)^2, for an expected loss of 36%
+	err = n1.SetBackendFault("link", netceptor.BackendFault{DropRate: 0.2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr, err = measureLoss(n1, "node2", netceptor.MaxForwardingHops, 300, 5*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.Loss < 24 || lr.Loss > 48 {
+		t.Fatalf("expected about 36%% loss, got %+v", lr)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	release := make(chan struct{})
+	drained := make(chan struct{})
+	s.AddShutdownDrainer("test", func(ctx context.Context) error {
+		defer close(drained)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	shutdown := make(chan struct{})
+	s.SetShutdownFunc(func() {
+		close(shutdown)
+	})
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte("shutdown drain 10s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]interface{})
+	err = json.Unmarshal([]byte(line), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["Success"] != true || result["Drain"] != true || result["Timeout"] != "10s" {
+		t.Fatalf("unexpected shutdown response %s", line)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("node shut down before work was drained")
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = client.Write([]byte("shutdown\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, "already in progress") {
+		t.Fatalf("second shutdown was not rejected: %s", line)
+	}
+	close(release)
+	<-drained
+	select {
+	case <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not shut down after work was drained")
+	}
+
+	// A drain that times out still shuts the node down
+	s = New(true, nc)
+	s.AddShutdownDrainer("stuck", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	shutdown = make(chan struct{})
+	s.SetShutdownFunc(func() {
+		close(shutdown)
+	})
+	cc, err := (&shutdownCommandType{s: s}).InitFromJSON(map[string]interface{}{
+		"drain":   true,
+		"timeout": float64(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newSockControl(nil)
+	_, err = cc.ControlFunc(nc, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sc.afterResponse()
+	select {
+	case <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not force-close after the drain timeout")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		ok, _ := b.take(now)
+		if !ok {
+			t.Fatalf("command %d of the burst was limited", i)
+		}
+	}
+	ok, wait := b.take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms after the burst, got %v %s", ok, wait)
+	}
+	ok, _ = b.take(now.Add(500 * time.Millisecond))
+	if !ok {
+		t.Fatal("command was limited after the bucket refilled")
+	}
+	ok, _ = b.take(now.Add(time.Hour))
+	if !ok {
+		t.Fatal("command was limited after a long idle time")
+	}
+	for i := 0; i < 2; i++ {
+		ok, _ = b.take(now.Add(time.Hour))
+		if !ok {
+			t.Fatal("the bucket refilled to less than its burst size")
+		}
+	}
+	ok, _ = b.take(now.Add(time.Hour))
+	if ok {
+		t.Fatal("the bucket refilled beyond its burst size")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err := s.SetRateLimit(-1, 0, false)
+	if err == nil {
+		t.Fatal("negative rate limit was accepted")
+	}
+	err = s.SetRateLimit(0.1, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startSession := func() net.Conn {
+		server, client := net.Pipe()
+		go s.RunControlSession(server)
+		_, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	runCommand := func(client net.Conn) string {
+		_, err := client.Write([]byte("commands\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	noisy := startSession()
+	defer noisy.Close()
+	for i := 0; i < 2; i++ {
+		line := runCommand(noisy)
+		if strings.HasPrefix(line, "ERROR") {
+			t.Fatalf("command %d within the burst failed: %s", i, line)
+		}
+	}
+	line := runCommand(noisy)
+	if line != "ERROR: rate limited" {
+		t.Fatalf("command over the limit was not rejected: %s", line)
+	}
+
+	// Another session has its own limit
+	quiet := startSession()
+	defer quiet.Close()
+	line = runCommand(quiet)
+	if strings.HasPrefix(line, "ERROR") {
+		t.Fatalf("command on another session was limited: %s", line)
+	}
+
+	// With delay set, commands over the limit wait rather than fail
+	err = s.SetRateLimit(20, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delayed := startSession()
+	defer delayed.Close()
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		line = runCommand(delayed)
+		if strings.HasPrefix(line, "ERROR") {
+			t.Fatalf("delayed command %d failed: %s", i, line)
+		}
+	}
+	if time.Since(started) < 90*time.Millisecond {
+		t.Fatalf("commands were not delayed by the rate limit")
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err := s.AddControlFunc("sleep", &sleepCommandType{delay: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetCommandTimeout(-time.Second)
+	if err == nil {
+		t.Fatal("negative command timeout was accepted")
+	}
+	err = s.SetCommandTimeout(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(command string) string {
+		_, err := client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	if line := run("sleep"); line != "ERROR: command timed out" {
+		t.Fatalf("command past its deadline did not time out: %s", line)
+	}
+	if line := run(`{"command": "sleep", "commandtimeout": "5s"}`); strings.HasPrefix(line, "ERROR") {
+		t.Fatalf("command with a longer timeout failed: %s", line)
+	}
+	if line := run(`{"command": "sleep", "commandtimeout": 0.05}`); line != "ERROR: command timed out" {
+		t.Fatalf("command with a shorter timeout did not time out: %s", line)
+	}
+	if line := run(`{"command": "sleep", "commandtimeout": "soon"}`); !strings.HasPrefix(line, "ERROR: invalid timeout") {
+		t.Fatalf("invalid timeout was accepted: %s", line)
+	}
+	line := run(`{"command": "sleep", "id": 7}`)
+	result := make(map[string]interface{})
+	err = json.Unmarshal([]byte(line), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["id"] != float64(7) || result["Error"] != "command timed out" {
+		t.Fatalf("unexpected timeout response to a request with an ID: %s", line)
+	}
+}
+
+// countCommandType is a streaming command that sends a frame for each number up to its count, or
+// forever if the count is 0
+type countCommandType struct {
+	stopped chan error
+}
+
+type countCommand struct {
+	count   int
+	stopped chan error
+}
+
+func (t *countCommandType) InitFromString(params string) (ControlCommand, error) {
+	count, err := strconv.Atoi(params)
+	if err != nil {
+		return nil, err
+	}
+	return &countCommand{count: count, stopped: t.stopped}, nil
+}
+
+func (t *countCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return &countCommand{count: int(config["count"].(float64)), stopped: t.stopped}, nil
+}
+
+func (c *countCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	return CollectFrames(c, nc, cfo)
+}
+
+func (c *countCommand) StreamFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations,
+	frames chan<- map[string]interface{}) (map[string]interface{}, error) {
+	ctx := commandContext(cfo)
+	for i := 1; c.count == 0 || i <= c.count; i++ {
+		select {
+		case frames <- map[string]interface{}{"N": i}:
+		case <-ctx.Done():
+			if c.stopped != nil {
+				c.stopped <- ctx.Err()
+			}
+			return nil, ctx.Err()
+		}
+	}
+	return map[string]interface{}{"Success": true, "Count": c.count}, nil
+}
+
+func TestStreamingCommand(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	stopped := make(chan error, 1)
+	err := s.AddControlFunc("count", &countCommandType{stopped: stopped})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte(`{"command": "count", "count": 5, "id": "c1"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 6; i++ {
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := make(map[string]interface{})
+		err = json.Unmarshal([]byte(line), &frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame["id"] != "c1" {
+			t.Fatalf("frame does not carry the request ID: %s", line)
+		}
+		if i <= 5 && (frame["N"] != float64(i) || frame[StreamCompleteKey] != nil) {
+			t.Fatalf("unexpected frame %d: %s", i, line)
+		}
+		if i == 6 && (frame[StreamCompleteKey] != true || frame["Count"] != float64(5)) {
+			t.Fatalf("unexpected final response: %s", line)
+		}
+	}
+
+	// The session can still run commands after a stream
+	_, err = client.Write([]byte("commands\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, `{"Commands"`) {
+		t.Fatalf("unexpected response after a stream: %s", line)
+	}
+
+	// A client going away stops an endless stream
+	_, err = client.Write([]byte("count 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	select {
+	case err = <-stopped:
+		if err != context.Canceled {
+			t.Fatalf("stream stopped with unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not stop when the client went away")
+	}
+
+	cc, err := (&countCommandType{}).InitFromString("3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cc.ControlFunc(nc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := cfr["Frames"].([]map[string]interface{}); len(frames) != 3 || frames[2]["N"] != 3 {
+		t.Fatalf("unexpected collected frames %v", cfr["Frames"])
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	records := make(chan *AuditRecord, 10)
+	s.SetAuditLogger(func(record *AuditRecord) {
+		records <- record
+	})
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(command string) {
+		_, err := client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	nextRecord := func() *AuditRecord {
+		select {
+		case record := <-records:
+			return record
+		case <-time.After(5 * time.Second):
+			t.Fatal("command was not audited")
+		}
+		return nil
+	}
+	run("hmac add key1 topsecret")
+	record := nextRecord()
+	if record.Command != "hmac" || !record.Success || record.Listener != "direct" {
+		t.Fatalf("unexpected audit record %+v", record)
+	}
+	if record.Params != "add key1 "+RedactedValue {
+		t.Fatalf("key was not redacted from the audit record: %s", record.Params)
+	}
+	run(`{"command": "hmac", "subcommand": "add", "keyid": "key2", "key": "topsecret"}`)
+	record = nextRecord()
+	if record.JSON["key"] != RedactedValue || record.JSON["keyid"] != "key2" {
+		t.Fatalf("key was not redacted from the audit record: %v", record.JSON)
+	}
+	run("nosuchcommand")
+	record = nextRecord()
+	if record.Command != "nosuchcommand" || record.Success || record.Error != "Unknown command" {
+		t.Fatalf("unexpected audit record for an unknown command %+v", record)
+	}
+
+	// A stuck audit logger does not hold up commands
+	stuck := make(chan struct{})
+	defer close(stuck)
+	s.SetAuditLogger(func(record *AuditRecord) {
+		<-stuck
+	})
+	for i := 0; i < auditQueueSize+10; i++ {
+		run("hmac list")
+	}
+
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	filename := path.Join(tmpdir, "audit.log")
+	logger, err := NewAuditFileLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger(&AuditRecord{Command: "ping", Params: "node2", Success: true})
+	logger(&AuditRecord{Command: "status", Success: true})
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in the audit log, got %d", len(lines))
+	}
+	logged := &AuditRecord{}
+	err = json.Unmarshal([]byte(lines[0]), logged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged.Command != "ping" || logged.Params != "node2" {
+		t.Fatalf("unexpected audit log line %s", lines[0])
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not available on Windows")
+	}
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fullSocket := path.Join(tmpdir, "full.sock")
+	err = s.RunListener(ctx, ListenerConfig{
+		UnixSocket:            fullSocket,
+		UnixSocketPermissions: 0600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnlySocket := path.Join(tmpdir, "readonly.sock")
+	err = s.RunListener(ctx, ListenerConfig{
+		UnixSocket:            readOnlySocket,
+		UnixSocketPermissions: 0600,
+		Authorizer:            AllowCommands([]string{"commands", " status"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RunListener(ctx, ListenerConfig{
+		UnixSocket:            fullSocket,
+		UnixSocketPermissions: 0600,
+	})
+	if err == nil {
+		t.Fatal("second listener on the same Unix socket was allowed")
+	}
+	run := func(filename string, command string) string {
+		client, err := net.Dial("unix", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		_, err = readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	for _, filename := range []string{fullSocket, readOnlySocket} {
+		if line := run(filename, "commands"); strings.HasPrefix(line, "ERROR") {
+			t.Fatalf("commands failed on %s: %s", filename, line)
+		}
+	}
+	if line := run(fullSocket, "hmac list"); strings.HasPrefix(line, "ERROR") {
+		t.Fatalf("hmac failed on the full access listener: %s", line)
+	}
+	if line := run(readOnlySocket, "hmac list"); line != "ERROR: permission denied" {
+		t.Fatalf("hmac was not denied on the read-only listener: %s", line)
+	}
+
+	// Cancelling the context closes every listener and releases their locks
+	cancel()
+	for _, filename := range []string{fullSocket, readOnlySocket} {
+		var li net.Listener
+		var lock *utils.FLock
+		for i := 0; i < 50; i++ {
+			li, lock, err = utils.UnixSocketListen(filename, 0600)
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("%s was not released: %s", filename, err)
+		}
+		_ = li.Close()
+		_ = lock.Unlock()
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	cleanup := make(chan struct{})
+	err := s.AddControlFunc("stream", &streamCommandType{cleanup: cleanup})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamServer, streamClient := net.Pipe()
+	go s.RunControlSession(streamServer)
+	_, err = readLine(streamClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = streamClient.Write([]byte("stream\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readLine(streamClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLine := func(command string) string {
+		_, err := client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	run := func(command string) map[string]interface{} {
+		line := runLine(command)
+		result := make(map[string]interface{})
+		err := json.Unmarshal([]byte(line), &result)
+		if err != nil {
+			t.Fatalf("%s returned %s", command, line)
+		}
+		return result
+	}
+	if line := runLine("bogus"); line != "ERROR: Unknown command" {
+		t.Fatalf("unexpected response to an unknown command: %s", line)
+	}
+	metrics := run("metrics")
+	if metrics["ActiveSessions"] != float64(2) || metrics["SessionsTotal"] != float64(2) {
+		t.Fatalf("unexpected session counts %v", metrics)
+	}
+	if metrics["UnknownCommands"] != float64(1) || metrics["CommandErrors"] != float64(1) {
+		t.Fatalf("unexpected error counts %v", metrics)
+	}
+	longest, ok := metrics["LongestCommand"].(map[string]interface{})
+	if !ok || longest["Command"] != "stream" {
+		t.Fatalf("running stream command was not the longest running: %v", metrics)
+	}
+
+	metrics = run("metrics reset")
+	if metrics["Reset"] != true || metrics["UnknownCommands"] != float64(1) {
+		t.Fatalf("counters were not returned before being reset: %v", metrics)
+	}
+	metrics = run(`{"command": "metrics"}`)
+	if metrics["UnknownCommands"] != float64(0) || metrics["CommandsTotal"] != float64(1) {
+		t.Fatalf("counters were not reset: %v", metrics)
+	}
+	if line := runLine(`{"command": "metrics", "reset": "yes"}`); line != "ERROR: reset must be a boolean" {
+		t.Fatalf("non-boolean reset was accepted: %s", line)
+	}
+
+	_ = streamClient.Close()
+	select {
+	case <-cleanup:
+	case <-time.After(5 * time.Second):
+		t.Fatal("streaming command did not clean up after the client went away")
+	}
+}
+
+// readTestFrame reads a length-prefixed frame from a connection
+func readTestFrame(conn net.Conn) ([]byte, error) {
+	header := make([]byte, frameHeaderLength)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	_, err = io.ReadFull(conn, payload)
+	return payload, err
+}
+
+func TestFramedProtocol(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err := s.SetMaxLineLength(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := &uploadCommandType{received: make(chan []byte, 1)}
+	err = s.AddControlFunc("upload", upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddControlFunc("count", &countCommandType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte(FramedHandshake + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != FramedHandshake {
+		t.Fatalf("unexpected handshake response %q", line)
+	}
+	run := func(command string) map[string]interface{} {
+		_, err := client.Write(appendFrame(nil, []byte(command)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := readTestFrame(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[string]interface{})
+		err = json.Unmarshal(payload, &result)
+		if err != nil {
+			t.Fatalf("%s returned %q", command, payload)
+		}
+		return result
+	}
+
+	// Commands can contain newlines, and errors are framed responses
+	result := run("{\n\"command\": \"commands\"\n}")
+	if _, ok := result["Commands"]; !ok {
+		t.Fatalf("unexpected commands response %v", result)
+	}
+	result = run(`{"command": "nosuchcommand"}`)
+	if result["Success"] != false || result["Error"] != "Unknown command" {
+		t.Fatalf("unexpected unknown command response %v", result)
+	}
+	result = run(`{"command": "status", "padding": "` + strings.Repeat("x", 2048) + `"}`)
+	if !strings.Contains(fmt.Sprint(result["Error"]), "maximum length") {
+		t.Fatalf("overlong frame was not rejected: %v", result)
+	}
+
+	// Streaming commands send each frame of output as a frame of the protocol
+	_, err = client.Write(appendFrame(nil, []byte(`{"command": "count", "count": 2}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		payload, err := readTestFrame(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = make(map[string]interface{})
+		err = json.Unmarshal(payload, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 && result["N"] != float64(i) {
+			t.Fatalf("unexpected stream frame %v", result)
+		}
+	}
+	if result[StreamCompleteKey] != true {
+		t.Fatalf("stream did not complete: %v", result)
+	}
+
+	// Chunked uploads are sent as frames, ending with an empty frame
+	data := appendFrame(nil, []byte(`{"command": "upload"}`))
+	data = appendFrame(data, []byte("hel"))
+	data = appendFrame(data, []byte("lo"))
+	data = appendFrame(data, nil)
+	_, err = client.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case received := <-upload.received:
+		if string(received) != "hello" {
+			t.Fatalf("command received %q", received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command did not receive its data")
+	}
+	payload, err := readTestFrame(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), "Success") {
+		t.Fatalf("unexpected upload response %q", payload)
+	}
+}
+
+func TestRoutingUpdatesCommand(t *testing.T) {
+	ct := &routingUpdatesCommandType{}
+	for _, params := range []string{"x", "-1", "1 2"} {
+		_, err := ct.InitFromString(params)
+		if err == nil {
+			t.Fatalf("routing-updates accepted %q", params)
+		}
+	}
+	_, err := ct.InitFromJSON(map[string]interface{}{"count": 1.5})
+	if err == nil {
+		t.Fatal("routing-updates accepted a fractional count")
+	}
+
+	// Without a count, the updates never end, so they cannot be collected into one response
+	cc, err := ct.InitFromString("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cc.ControlFunc(nil, nil)
+	if err == nil {
+		t.Fatal("collected an endless stream of routing updates")
+	}
+}
+
+func TestDisconnectCommand(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	ct := &disconnectCommandType{}
+	for _, params := range []string{"", "node2 node3"} {
+		_, err := ct.InitFromString(params)
+		if err == nil {
+			t.Fatalf("disconnect accepted %q", params)
+		}
+	}
+	cc, err := ct.InitFromString("node2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cc.ControlFunc(nc, nil)
+	if err == nil {
+		t.Fatal("disconnected from a node that was not connected")
+	}
+	cc, err = ct.InitFromJSON(map[string]interface{}{"node": "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cc.ControlFunc(nc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes, ok := cfr["Disconnected"].([]string); !ok || len(nodes) != 0 {
+		t.Fatalf("unexpected result %v", cfr)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err := s.AddControlFunc("sleep", &sleepCommandType{delay: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetIdleTimeout(-time.Second)
+	if err == nil {
+		t.Fatal("negative idle timeout was accepted")
+	}
+	err = s.SetIdleTimeout(150 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A command that runs longer than the idle timeout, and prompt commands after it, keep the session open
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{"sleep", "loglevel", "sleep"} {
+		time.Sleep(50 * time.Millisecond)
+		_, err = client.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatalf("session was closed before %s: %s", command, err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatalf("no response to %s: %s", command, err)
+		}
+		if strings.HasPrefix(line, "ERROR") {
+			t.Fatalf("%s failed: %s", command, line)
+		}
+	}
+
+	// A client that stays silent is disconnected
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = readLine(client)
+	if err != io.EOF {
+		t.Fatalf("idle session was not closed: %v", err)
+	}
+}
+
+func TestTracerouteHops(t *testing.T) {
+	n1 := netceptor.New(context.Background(), "node1", nil)
+	n2 := netceptor.New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	n1.EnableChaos()
+	linkNodes(t, n1, n2, "link", 1.0)
+
+	tt := &tracerouteCommandType{}
+	for _, params := range []string{"", "node2 0", "node2 many", "node2 1 forever", "node2 1 2h", "node2 1 1s extra"} {
+		_, err := tt.InitFromString(params)
+		if err == nil {
+			t.Fatalf("invalid traceroute parameters %q were accepted", params)
+		}
+	}
+
+	cmd, err := tt.InitFromString("node2 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cmd.ControlFunc(n1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfr) != 2 {
+		t.Fatalf("expected 2 hops, got %v", cfr)
+	}
+	for hop, from := range []string{"node1", "node2"} {
+		result := cfr[strconv.Itoa(hop)].(map[string]interface{})
+		if result["From"] != from || result["Probes"] != 3 || result["Lost"] != 0 ||
+			result["MTU"] != netceptor.MTU || result["Error"] != nil {
+			t.Fatalf("unexpected result for hop %d: %v", hop, result)
+		}
+		minTime := result["MinTime"].(time.Duration)
+		avgTime := result["Time"].(time.Duration)
+		maxTime := result["MaxTime"].(time.Duration)
+		if minTime <= 0 || minTime > avgTime || avgTime > maxTime {
+			t.Fatalf("inconsistent times for hop %d: %v", hop, result)
+		}
+	}
+
+	// With every frame dropped, the hops past the first get no reply, and the trace gives up
+	// after a few of them instead of waiting on every hop
+	err = n1.SetBackendFault("link", netceptor.BackendFault{DropRate: 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err = tt.InitFromJSON(map[string]interface{}{"target": "node2", "count": 2.0, "hoptimeout": "100ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := time.Now()
+	cfr, err = cmd.ControlFunc(n1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(startTime) > 5*time.Second {
+		t.Fatalf("trace through a black hole took %s", time.Since(startTime))
+	}
+	if len(cfr) != maxSilentHops+1 {
+		t.Fatalf("expected %d hops, got %v", maxSilentHops+1, cfr)
+	}
+	for hop := 1; hop <= maxSilentHops; hop++ {
+		result := cfr[strconv.Itoa(hop)].(map[string]interface{})
+		if result["Lost"] != 2 || result["Error"] != "timeout" || result["MTU"] != nil {
+			t.Fatalf("unexpected result for silent hop %d: %v", hop, result)
+		}
+	}
+}
+
+func TestPingSeries(t *testing.T) {
+	minTime, avgTime, maxTime, stdDev := summarizeRTTs([]time.Duration{time.Millisecond, 3 * time.Millisecond})
+	if minTime != time.Millisecond || avgTime != 2*time.Millisecond || maxTime != 3*time.Millisecond ||
+		stdDev != time.Millisecond {
+		t.Fatalf("unexpected statistics %s/%s/%s/%s", minTime, avgTime, maxTime, stdDev)
+	}
+
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	pt := &pingCommandType{}
+	for _, params := range []string{"node1 0", "node1 many", "node1 3 1ms", "node1 3 1s 2h", "node1 1 1s 1s 1s"} {
+		_, err := pt.InitFromString(params)
+		if err == nil {
+			t.Fatalf("invalid ping parameters %q were accepted", params)
+		}
+	}
+	cmd, err := pt.InitFromString("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cmd.(*pingCommand); !ok {
+		t.Fatalf("ping with only a target is not a single ping: %T", cmd)
+	}
+
+	cmd, err = pt.InitFromString("node1 3 10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cmd.ControlFunc(nc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := cfr["Frames"].([]map[string]interface{})
+	if cfr["Success"] != true || cfr["Sent"] != 3 || cfr["Received"] != 3 || cfr["Loss"] != 0.0 || len(frames) != 3 {
+		t.Fatalf("unexpected ping statistics %v", cfr)
+	}
+	if cfr["MinTime"].(time.Duration) > cfr["AvgTime"].(time.Duration) ||
+		cfr["AvgTime"].(time.Duration) > cfr["MaxTime"].(time.Duration) {
+		t.Fatalf("inconsistent ping times %v", cfr)
+	}
+	for seq, frame := range frames {
+		if frame["Seq"] != seq || frame["Success"] != true || frame["From"] != "node1" {
+			t.Fatalf("unexpected probe result %v", frame)
+		}
+	}
+
+	// Probes that fail are each counted as lost, without ending the series
+	cmd, err = pt.InitFromJSON(map[string]interface{}{"target": "nonexistent", "count": 2.0,
+		"interval": "10ms", "probetimeout": "100ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err = cmd.ControlFunc(nc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames = cfr["Frames"].([]map[string]interface{})
+	if cfr["Success"] != false || cfr["Received"] != 0 || cfr["Loss"] != 100.0 || len(frames) != 2 ||
+		frames[1]["Error"] == nil {
+		t.Fatalf("unexpected ping statistics for an unreachable node %v", cfr)
+	}
+
+	// With frames, the result of each probe is streamed before the statistics
+	s := New(true, nc)
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err = readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte("ping node1 2 10ms frames\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := make(map[string]interface{})
+		err = json.Unmarshal([]byte(line), &response)
+		if err != nil {
+			t.Fatalf("unexpected response %q", line)
+		}
+		_, complete := response[StreamCompleteKey]
+		if complete != (i == 2) {
+			t.Fatalf("unexpected response %d: %v", i, response)
+		}
+		if complete && response["Received"] != float64(2) {
+			t.Fatalf("unexpected ping statistics %v", response)
+		}
+	}
+}
+
+func TestSessionDraining(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not available on Windows")
+	}
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err = s.AddControlFunc("sleep", &sleepCommandType{delay: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetSessionGracePeriod(-time.Second)
+	if err == nil {
+		t.Fatal("negative grace period was accepted")
+	}
+	dial := func(socket string) net.Conn {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = readLine(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// Idle sessions end at once, and a running command finishes and responds before its session ends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := path.Join(tmpdir, "drain.sock")
+	err = s.RunListener(ctx, ListenerConfig{UnixSocket: socket, UnixSocketPermissions: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := dial(socket)
+	defer idle.Close()
+	busy := dial(socket)
+	defer busy.Close()
+	_, err = busy.Write([]byte("sleep\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	startTime := time.Now()
+	_, err = readLine(idle)
+	if err != io.EOF || time.Since(startTime) > 300*time.Millisecond {
+		t.Fatalf("idle session was not closed at once: %v after %s", err, time.Since(startTime))
+	}
+	line, err := readLine(busy)
+	if err != nil || !strings.Contains(line, "Success") {
+		t.Fatalf("running command did not respond: %q %v", line, err)
+	}
+	_, err = readLine(busy)
+	if err != io.EOF {
+		t.Fatalf("draining session was not closed after its command: %v", err)
+	}
+	s.Wait()
+
+	// A command that runs past the grace period has its session closed
+	err = s.SetSessionGracePeriod(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	err = s.RunListener(ctx, ListenerConfig{UnixSocket: socket, UnixSocketPermissions: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy = dial(socket)
+	defer busy.Close()
+	_, err = busy.Write([]byte("sleep\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	_, err = readLine(busy)
+	if err != io.EOF {
+		t.Fatalf("session was not closed after the grace period: %v", err)
+	}
+	s.Wait()
+}
+
+func TestMaxSessions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not available on Windows")
+	}
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	err = s.SetMaxSessions(-1, false)
+	if err == nil {
+		t.Fatal("negative session limit was accepted")
+	}
+	err = s.SetMaxSessions(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := path.Join(tmpdir, "limit.sock")
+	err = s.RunListener(ctx, ListenerConfig{UnixSocket: socket, UnixSocketPermissions: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// Over the limit, connections are rejected
+	first := dial()
+	line, err := readLine(first)
+	if err != nil || !strings.HasPrefix(line, "Receptor Control") {
+		t.Fatalf("first session did not start: %q %v", line, err)
+	}
+	second := dial()
+	defer second.Close()
+	line, err = readLine(second)
+	if err != nil || line != "ERROR: "+errTooManySessions.Error() {
+		t.Fatalf("expected session to be rejected, got %q %v", line, err)
+	}
+	_, err = readLine(second)
+	if err != io.EOF {
+		t.Fatalf("rejected connection was not closed: %v", err)
+	}
+
+	// With queueing, connections wait for a session to end
+	err = s.SetMaxSessions(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := dial()
+	defer queued.Close()
+	_ = queued.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = readLine(queued)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("queued connection was not kept waiting: %v", err)
+	}
+	_ = first.Close()
+	_ = queued.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err = readLine(queued)
+	if err != nil || !strings.HasPrefix(line, "Receptor Control") {
+		t.Fatalf("queued session did not start: %q %v", line, err)
+	}
+}
+
+func TestUnixPeerPolicy(t *testing.T) {
+	ids, err := parseIDList(" 0, 1000,")
+	if err != nil || len(ids) != 2 || ids[0] != 0 || ids[1] != 1000 {
+		t.Fatalf("unexpected ID list %v %v", ids, err)
+	}
+	_, err = parseIDList("0,root")
+	if err == nil {
+		t.Fatal("invalid ID was accepted")
+	}
+	if (&UnixPeerPolicy{UIDs: []int{0}}).allows(nil) {
+		t.Fatal("client without credentials was allowed")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("Unix socket peer credentials are only supported on Linux")
+	}
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	firstLine := func(socket string) string {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		line, err := readLine(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	for i, policy := range []*UnixPeerPolicy{
+		{UIDs: []int{os.Getuid()}},
+		{UIDs: []int{os.Getuid() + 1}, GIDs: []int{os.Getgid()}},
+		{UIDs: []int{os.Getuid() + 1}, GIDs: []int{os.Getgid() + 1}},
+	} {
+		socket := path.Join(tmpdir, fmt.Sprintf("peers%d.sock", i))
+		err = s.RunListener(ctx, ListenerConfig{
+			UnixSocket:            socket,
+			UnixSocketPermissions: 0600,
+			UnixPeers:             policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := firstLine(socket)
+		allowed := i < 2
+		if allowed && !strings.HasPrefix(line, "Receptor Control") {
+			t.Fatalf("allowed client was rejected by %+v: %q", policy, line)
+		}
+		if !allowed && line != "ERROR: permission denied" {
+			t.Fatalf("client was not rejected by %+v: %q", policy, line)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	checkReady := func(hs *HealthStatus, ready bool, checks map[string]bool) {
+		if hs.Ready != ready || len(hs.Checks) != len(checks) {
+			t.Fatalf("unexpected health %+v", hs)
+		}
+		for _, hc := range hs.Checks {
+			expected, ok := checks[hc.Name]
+			if !ok || hc.Ready != expected || (!hc.Ready && hc.Detail == "") {
+				t.Fatalf("unexpected health check %+v", hc)
+			}
+		}
+	}
+	checkReady(s.Health(), false, map[string]bool{"netceptor": false, "controlsvc": false})
+
+	s.SetLocalOnly(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := s.RunListener(ctx, ListenerConfig{Service: "control"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReady(s.Health(), true, map[string]bool{"netceptor": true, "controlsvc": true})
+
+	loaded := false
+	s.AddHealthCheck("units", func() error {
+		if !loaded {
+			return fmt.Errorf("units are not loaded")
+		}
+		return nil
+	})
+	cc, err := (&healthzCommandType{s: s}).InitFromString("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cc.ControlFunc(nc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfr["NodeID"] != "node1" || cfr["Ready"] != false {
+		t.Fatalf("unexpected healthz response %v", cfr)
+	}
+	checkReady(&HealthStatus{Ready: false, Checks: cfr["Checks"].([]*HealthCheckResult)}, false,
+		map[string]bool{"netceptor": true, "controlsvc": true, "units": false})
+
+	handler := NewHealthHandler(s)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 when not ready, got %d", rec.Code)
+	}
+	loaded = true
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 when ready, got %d", rec.Code)
+	}
+	hs := &HealthStatus{}
+	err = json.Unmarshal(rec.Body.Bytes(), hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReady(hs, true, map[string]bool{"netceptor": true, "controlsvc": true, "units": true})
+
+	// A node whose listeners have stopped is no longer ready
+	cancel()
+	s.Wait()
+	checkReady(s.Health(), false, map[string]bool{"netceptor": true, "controlsvc": false, "units": true})
+}
+
+func TestGreeting(t *testing.T) {
+	tests := []struct {
+		line         string
+		nodeID       string
+		version      int
+		capabilities []string
+	}{
+		{"Receptor Control, node node1", "node1", 1, []string{}},
+		{"Receptor Control, node node1, protocol 2", "node1", 2, []string{}},
+		{"Receptor Control, node node1, protocol 2, capabilities framing gzip", "node1", 2, []string{"framing", "gzip"}},
+		{"Receptor Control, node node1, protocol x", "node1, protocol x", 1, []string{}},
+	}
+	for _, test := range tests {
+		g, err := ParseGreeting(test.line + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.NodeID != test.nodeID || g.ProtocolVersion != test.version ||
+			strings.Join(g.Capabilities, " ") != strings.Join(test.capabilities, " ") {
+			t.Fatalf("unexpected greeting %+v from %q", g, test.line)
+		}
+		if g.String() != test.line {
+			t.Fatalf("greeting %+v is %q, not %q", g, g.String(), test.line)
+		}
+	}
+	_, err := ParseGreeting("Hello")
+	if err == nil {
+		t.Fatal("parsed a greeting from another service")
+	}
+
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	greet := func() *Greeting {
+		server, client := net.Pipe()
+		defer client.Close()
+		go s.RunControlSession(server)
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := ParseGreeting(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	g := greet()
+	if g.NodeID != "node1" || g.ProtocolVersion != ProtocolVersion || len(g.Capabilities) != 0 {
+		t.Fatalf("unexpected greeting %+v", g)
+	}
+	s.SetGreetingCapabilities(true)
+	g = greet()
+	if !g.HasCapability(CapabilityFraming) || !g.HasCapability(CapabilityStreaming) || g.HasCapability("bogus") {
+		t.Fatalf("greeting %+v does not list the capabilities", g)
+	}
+}
+
+func TestMalformedJSONCommands(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	s := New(true, nc)
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.RunControlSession(server)
+	_, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each malformed command gets an error, and the session still runs the next command
+	cases := []struct {
+		command string
+		errText string
+	}{
+		{`{"command": "status"`, "invalid JSON command"},
+		{`{"command": "status"} trailing`, "invalid JSON command"},
+		{`{garbage`, "invalid JSON command"},
+		{`["status"]`, "must be an object"},
+		{`  [{"command": "status"}]`, "must be an object"},
+		{`{"command": ["status"]}`, "command must be a string"},
+		{`{"command": 5}`, "command must be a string"},
+		{`{"node": "node1"}`, "did not contain a command"},
+	}
+	for _, tc := range cases {
+		_, err = client.Write([]byte(tc.command + "\n"))
+		if err != nil {
+			t.Fatalf("session was closed before %s: %s", tc.command, err)
+		}
+		line, err := readLine(client)
+		if err != nil {
+			t.Fatalf("no response to %s: %s", tc.command, err)
+		}
+		if !strings.HasPrefix(line, "ERROR: ") || !strings.Contains(line, tc.errText) {
+			t.Fatalf("unexpected response to %s: %q", tc.command, line)
+		}
+		_, err = client.Write([]byte(`{"command": "status"}` + "\n"))
+		if err != nil {
+			t.Fatalf("session was closed after %s: %s", tc.command, err)
+		}
+		line, err = readLine(client)
+		if err != nil {
+			t.Fatalf("no response to status after %s: %s", tc.command, err)
+		}
+		if !strings.Contains(line, `"NodeID":"node1"`) {
+			t.Fatalf("session did not recover after %s: %q", tc.command, line)
+		}
+	}
+
+	// Invalid settings of a command with a request ID are reported with the ID, as JSON
+	_, err = client.Write([]byte(`{"command": "status", "id": 7, "encoding": "bogus"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := readLine(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make(map[string]interface{})
+	err = json.Unmarshal([]byte(line), &response)
+	if err != nil {
+		t.Fatalf("error response is not JSON: %q", line)
+	}
+	errStr, _ := response["Error"].(string)
+	if response["id"] != 7.0 || !strings.Contains(errStr, "unknown encoding") {
+		t.Fatalf("unexpected error response %v", response)
+	}
+}
@@ -0,0 +1,111 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"runtime"
+	"strings"
+)
+
+type debugCommandType struct{}
+type debugCommand struct {
+	subcommand string
+	gc         bool
+}
+
+func (t *debugCommandType) Description() string {
+	return "Show runtime debugging information for this node"
+}
+
+func (t *debugCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no debug subcommand")
+	}
+	c := &debugCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	switch c.subcommand {
+	case "memstats":
+		if len(tokens) > 2 || (len(tokens) == 2 && strings.ToLower(tokens[1]) != "gc") {
+			return nil, fmt.Errorf("debug memstats only takes an optional gc parameter")
+		}
+		c.gc = len(tokens) == 2
+	default:
+		return nil, fmt.Errorf("unknown debug subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (t *debugCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no debug subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("debug subcommand must be string")
+	}
+	c := &debugCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	switch c.subcommand {
+	case "memstats":
+		gc, ok := config["gc"]
+		if ok {
+			c.gc, ok = gc.(bool)
+			if !ok {
+				return nil, fmt.Errorf("debug memstats gc must be boolean")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown debug subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (c *debugCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	switch c.subcommand {
+	case "memstats":
+		if c.gc {
+			runtime.GC()
+		}
+		ms := &runtime.MemStats{}
+		runtime.ReadMemStats(ms)
+		cfr["GCTriggered"] = c.gc
+		cfr["Alloc"] = ms.Alloc
+		cfr["TotalAlloc"] = ms.TotalAlloc
+		cfr["Sys"] = ms.Sys
+		cfr["Mallocs"] = ms.Mallocs
+		cfr["Frees"] = ms.Frees
+		cfr["HeapAlloc"] = ms.HeapAlloc
+		cfr["HeapSys"] = ms.HeapSys
+		cfr["HeapIdle"] = ms.HeapIdle
+		cfr["HeapInuse"] = ms.HeapInuse
+		cfr["HeapObjects"] = ms.HeapObjects
+		cfr["NumGC"] = ms.NumGC
+		cfr["PauseTotalNs"] = ms.PauseTotalNs
+		cfr["LastPauseNs"] = ms.PauseNs[(ms.NumGC+255)%256]
+		cfr["NumGoroutine"] = runtime.NumGoroutine()
+	}
+	return cfr, nil
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// CmdlineConfigDebug is the cmdline configuration object for enabling debug commands
+type CmdlineConfigDebug struct{}
+
+// Run runs the action
+func (cfg CmdlineConfigDebug) Run() error {
+	return MainInstance.AddControlFunc("debug", &debugCommandType{})
+}
+
+func init() {
+	cmdline.AddConfigType("control-debug", "Enable debug commands, such as memstats, in the control service",
+		CmdlineConfigDebug{}, false, true, false, false, nil)
+}
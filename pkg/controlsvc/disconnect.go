@@ -0,0 +1,63 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+)
+
+type disconnectCommandType struct{}
+type disconnectCommand struct {
+	node string
+}
+
+func (t *disconnectCommandType) Description() string {
+	return "Close the backend session with a node, or with every node if given \"all\""
+}
+
+func (t *disconnectCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) != 1 {
+		return nil, fmt.Errorf("disconnect command requires a node ID or \"all\"")
+	}
+	c := &disconnectCommand{
+		node: tokens[0],
+	}
+	return c, nil
+}
+
+func (t *disconnectCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	node, ok := config["node"]
+	if !ok {
+		return nil, fmt.Errorf("no node specified")
+	}
+	nodeStr, ok := node.(string)
+	if !ok {
+		return nil, fmt.Errorf("node must be string")
+	}
+	c := &disconnectCommand{
+		node: nodeStr,
+	}
+	return c, nil
+}
+
+// Mutates returns true, because disconnecting closes backend sessions
+func (c *disconnectCommand) Mutates() bool {
+	return true
+}
+
+func (c *disconnectCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	var nodes []string
+	if c.node == "all" {
+		nodes = nc.DisconnectAll()
+	} else {
+		err := nc.Disconnect(c.node)
+		if err != nil {
+			return nil, err
+		}
+		nodes = []string{c.node}
+	}
+	cfr := make(map[string]interface{})
+	cfr["Disconnected"] = nodes
+	return cfr, nil
+}
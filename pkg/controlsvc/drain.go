@@ -0,0 +1,54 @@
+package controlsvc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSessionGracePeriod is how long the sessions of a stopping listener may take to finish
+// their commands before they are closed
+const DefaultSessionGracePeriod = 10 * time.Second
+
+// SetSessionGracePeriod sets how long the sessions of a listener may take to finish the commands
+// they are running once the listener's context is cancelled.  Sessions that are not running a
+// command end straight away, and the rest end as soon as their command has responded.  Sessions
+// still running after the grace period are closed.  A grace period of 0 closes them all at once.
+func (s *Server) SetSessionGracePeriod(grace time.Duration) error {
+	if grace < 0 {
+		return fmt.Errorf("session grace period must not be negative")
+	}
+	atomic.StoreInt64(&s.sessionGrace, int64(grace))
+	return nil
+}
+
+// Wait blocks until every listener started by RunListener or RunControlSvc has had its context
+// cancelled and finished draining its sessions.  It must be called after the listeners it should
+// wait for have been started.
+func (s *Server) Wait() {
+	s.listenerWait.Wait()
+}
+
+// drainSessions waits for the sessions of stopped listeners to finish, closing any still running
+// after the grace period.  The listeners must no longer be accepting connections.
+func (s *Server) drainSessions(listeners []string, sessions *sync.WaitGroup) {
+	defer s.sessions.undrain(listeners)
+	ids := s.sessions.drain(listeners)
+	finished := make(chan struct{})
+	go func() {
+		sessions.Wait()
+		close(finished)
+	}()
+	grace := time.Duration(atomic.LoadInt64(&s.sessionGrace))
+	select {
+	case <-finished:
+		return
+	case <-time.After(grace):
+	}
+	closed := s.sessions.closeSessions(ids)
+	if closed > 0 {
+		sublogger.Warning("Closed %d control sessions still running after %s\n", closed, grace)
+	}
+	<-finished
+}
@@ -0,0 +1,272 @@
+package controlsvc
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"strings"
+)
+
+// Response encodings supported by the control service.  JSON requests can ask for a response
+// encoding with an "encoding" field.
+const (
+	// EncodingJSON responses are a single line of JSON.  This is the default.
+	EncodingJSON = "json"
+	// EncodingMsgpack responses are a "MSGPACK <length>" line followed by that many bytes of msgpack.
+	EncodingMsgpack = "msgpack"
+)
+
+// encodingFromRequest returns the response encoding requested by a JSON command
+func encodingFromRequest(jsonData map[string]interface{}) (string, error) {
+	encIf, ok := jsonData["encoding"]
+	if !ok {
+		return EncodingJSON, nil
+	}
+	enc, ok := encIf.(string)
+	if !ok {
+		return "", fmt.Errorf("encoding must be a string")
+	}
+	enc = strings.ToLower(enc)
+	switch enc {
+	case EncodingJSON, EncodingMsgpack:
+		return enc, nil
+	}
+	return "", fmt.Errorf("unknown encoding %s", enc)
+}
+
+// Response compressions supported by the control service.  JSON requests can ask for a compressed
+// response with a "compression" field, if the server listed CapabilityGzip in its greeting.
+// Compression applies to the encoded response, so it can be combined with any encoding.
+const (
+	// CompressionNone responses are sent as encoded.  This is the default.
+	CompressionNone = "none"
+	// CompressionGzip responses are a series of "GZIP <length>" lines, each followed by that many
+	// bytes of gzip data, ending with "GZIP 0".  In framed sessions each block of gzip data is a
+	// frame, ending with an empty frame.  The gzip data decompresses to the response as it would
+	// have been sent uncompressed.
+	CompressionGzip = "gzip"
+)
+
+// compressionFromRequest returns the response compression requested by a JSON command, which can
+// only be gzip if the client was offered it in the greeting
+func compressionFromRequest(jsonData map[string]interface{}, gzipOffered bool) (string, error) {
+	compIf, ok := jsonData["compression"]
+	if !ok {
+		return CompressionNone, nil
+	}
+	comp, ok := compIf.(string)
+	if !ok {
+		return "", fmt.Errorf("compression must be a string")
+	}
+	comp = strings.ToLower(comp)
+	switch comp {
+	case CompressionNone:
+		return comp, nil
+	case CompressionGzip:
+		if !gzipOffered {
+			return "", fmt.Errorf("compression %s was not offered by the server", comp)
+		}
+		return comp, nil
+	}
+	return "", fmt.Errorf("unknown compression %s", comp)
+}
+
+const (
+	// compressFlushSize is how much data is compressed before the compressor is flushed, so that
+	// the client can start decompressing a large response before all of it is sent
+	compressFlushSize = 64 * 1024
+	// compressBlockSize is the most compressed data that is held before it is sent
+	compressBlockSize = 32 * 1024
+)
+
+// compressingWriter gzips everything written to it, and sends the compressed data to the client
+// in blocks as it is produced
+type compressingWriter struct {
+	gz      *gzip.Writer
+	pending []byte
+	write   func([]byte) error
+	framed  bool
+	err     error
+}
+
+// newCompressingWriter returns a compressingWriter that sends the compressed blocks using a write
+// function, as length-prefixed frames if the session is framed
+func newCompressingWriter(write func([]byte) error, framed bool) *compressingWriter {
+	w := &compressingWriter{
+		write:  write,
+		framed: framed,
+	}
+	w.gz = gzip.NewWriter(compressedSink{w})
+	return w
+}
+
+// compressedSink collects the output of the compressor
+type compressedSink struct {
+	w *compressingWriter
+}
+
+// Write adds compressed data to the pending block, sending the block once it is full
+func (s compressedSink) Write(data []byte) (int, error) {
+	s.w.pending = append(s.w.pending, data...)
+	if len(s.w.pending) >= compressBlockSize {
+		err := s.w.sendPending()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// sendBlock sends one block of compressed data.  An empty block ends the response.
+func (w *compressingWriter) sendBlock(data []byte) error {
+	if w.framed {
+		return w.write(appendFrame(nil, data))
+	}
+	header := []byte(fmt.Sprintf("GZIP %d\n", len(data)))
+	return w.write(append(header, data...))
+}
+
+// sendPending sends the pending block, if there is one
+func (w *compressingWriter) sendPending() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.pending) == 0 {
+		return nil
+	}
+	w.err = w.sendBlock(w.pending)
+	w.pending = w.pending[:0]
+	return w.err
+}
+
+// Write compresses data, flushing the compressor and sending what it has produced after every
+// compressFlushSize bytes
+func (w *compressingWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > compressFlushSize {
+			n = compressFlushSize
+		}
+		_, err := w.gz.Write(data[:n])
+		if err == nil {
+			err = w.gz.Flush()
+		}
+		if err == nil {
+			err = w.sendPending()
+		}
+		if err != nil {
+			return written, err
+		}
+		written += n
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// Close finishes the compressed data, sends what is left of it and ends the response
+func (w *compressingWriter) Close() error {
+	err := w.gz.Close()
+	if err == nil {
+		err = w.sendPending()
+	}
+	if err != nil {
+		return err
+	}
+	return w.sendBlock(nil)
+}
+
+// writeResponse sends an encoded response to the client, compressing it if requested
+func writeResponse(write func([]byte) error, rbytes []byte, compression string, framed bool) error {
+	if compression != CompressionGzip {
+		if framed {
+			return write(appendFrame(nil, rbytes))
+		}
+		return write(rbytes)
+	}
+	cw := newCompressingWriter(write, framed)
+	_, err := cw.Write(rbytes)
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// marshalResponse encodes a control function result for sending to the client.  Framed sessions
+// carry the length of each response in its frame, so the response is left bare.
+func marshalResponse(cfr map[string]interface{}, encoding string, framed bool) ([]byte, error) {
+	switch encoding {
+	case EncodingMsgpack:
+		data, err := msgpack.Marshal(cfr)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert response to msgpack: %s", err)
+		}
+		if framed {
+			return data, nil
+		}
+		return append([]byte(fmt.Sprintf("MSGPACK %d\n", len(data))), data...), nil
+	default:
+		data, err := json.Marshal(cfr)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert response to JSON: %s", err)
+		}
+		if framed {
+			return data, nil
+		}
+		return append(data, '\n'), nil
+	}
+}
+
+// RequestIDKey is the field of a JSON command whose value, if present, is echoed back in the
+// command's response.  Clients that send several commands on one connection without waiting can
+// use it to match responses to requests.
+const RequestIDKey = "id"
+
+// responseFormat is how the responses to a command are sent to the client
+type responseFormat struct {
+	encoding    string
+	compression string
+	requestID   interface{}
+	// framed is set if the session uses length-prefixed framing
+	framed bool
+}
+
+// writeResult sends the result of a command to the client
+func (rf *responseFormat) writeResult(write func([]byte) error, cfr map[string]interface{}) error {
+	if rf.requestID != nil {
+		cfr[RequestIDKey] = rf.requestID
+	}
+	rbytes, err := marshalResponse(cfr, rf.encoding, rf.framed)
+	if err != nil {
+		return rf.writeError(write, err)
+	}
+	return writeResponse(write, rbytes, rf.compression, rf.framed)
+}
+
+// writeError sends an error to the client.  Errors are normally a line starting with ERROR, but the
+// errors of commands with a request ID are sent as a response with the ID and an Error field, so
+// that the client can tell which command failed.  Framed sessions always get such a response.
+func (rf *responseFormat) writeError(write func([]byte) error, cmdErr error) error {
+	if rf.requestID != nil || rf.framed {
+		cfr := map[string]interface{}{
+			"Success": false,
+			"Error":   cmdErr.Error(),
+		}
+		if rf.requestID != nil {
+			cfr[RequestIDKey] = rf.requestID
+		}
+		rbytes, err := marshalResponse(cfr, rf.encoding, rf.framed)
+		if err == nil {
+			return writeResponse(write, rbytes, rf.compression, rf.framed)
+		}
+	}
+	if rf.framed {
+		rbytes, _ := marshalResponse(map[string]interface{}{
+			"Success": false,
+			"Error":   cmdErr.Error(),
+		}, EncodingJSON, true)
+		return write(appendFrame(nil, rbytes))
+	}
+	return write([]byte(fmt.Sprintf("ERROR: %s\n", cmdErr)))
+}
@@ -0,0 +1,255 @@
+package controlsvc
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flush policies for the output of streaming commands, such as work results
+const (
+	// FlushImmediate writes each record to the client as soon as it is produced.  This is the default.
+	FlushImmediate = "immediate"
+	// FlushLine writes only complete lines, holding back any partial line until it is finished
+	FlushLine = "line"
+	// FlushBatch collects records until a size is reached or an interval has passed since the first one
+	FlushBatch = "batch"
+)
+
+// Defaults for the batch flush policy
+const (
+	defaultFlushBatchSize     = 4096
+	defaultFlushBatchInterval = 200 * time.Millisecond
+	maxLineBufferSize         = 65536 // A partial line longer than this is written out anyway
+)
+
+// flushPolicy is a session's setting for how streamed output is buffered
+type flushPolicy struct {
+	mode     string
+	size     int
+	interval time.Duration
+}
+
+// streamBuffer buffers streamed output according to a flush policy
+type streamBuffer struct {
+	policy flushPolicy
+	write  func([]byte) error
+	buf    []byte
+	timer  *time.Timer
+}
+
+// newStreamBuffer allocates a streamBuffer that sends its output to the write function
+func newStreamBuffer(policy flushPolicy, write func([]byte) error) *streamBuffer {
+	return &streamBuffer{
+		policy: policy,
+		write:  write,
+	}
+}
+
+// add buffers a record, writing out whatever the policy says is ready
+func (sb *streamBuffer) add(data []byte) error {
+	switch sb.policy.mode {
+	case FlushLine:
+		sb.buf = append(sb.buf, data...)
+		if len(sb.buf) >= maxLineBufferSize {
+			return sb.flush()
+		}
+		eol := bytes.LastIndexByte(sb.buf, '\n')
+		if eol < 0 {
+			return nil
+		}
+		err := sb.write(sb.buf[:eol+1])
+		sb.buf = append([]byte{}, sb.buf[eol+1:]...)
+		return err
+	case FlushBatch:
+		if len(sb.buf) == 0 {
+			sb.timer = time.NewTimer(sb.policy.interval)
+		}
+		sb.buf = append(sb.buf, data...)
+		if len(sb.buf) >= sb.policy.size {
+			return sb.flush()
+		}
+		return nil
+	default:
+		return sb.write(data)
+	}
+}
+
+// expired returns a channel that fires when a batch has waited long enough, or nil if no batch is pending
+func (sb *streamBuffer) expired() <-chan time.Time {
+	if sb.timer == nil {
+		return nil
+	}
+	return sb.timer.C
+}
+
+// flush writes out everything that is buffered
+func (sb *streamBuffer) flush() error {
+	if sb.timer != nil {
+		sb.timer.Stop()
+		sb.timer = nil
+	}
+	if len(sb.buf) == 0 {
+		return nil
+	}
+	err := sb.write(sb.buf)
+	sb.buf = nil
+	return err
+}
+
+type sessionCommandType struct{}
+type sessionCommand struct {
+	subcommand string
+	policy     flushPolicy
+}
+
+// parseFlushPolicy validates a flush mode and its optional batch size and interval
+func parseFlushPolicy(mode string, size string, interval string) (flushPolicy, error) {
+	policy := flushPolicy{
+		mode:     strings.ToLower(mode),
+		size:     defaultFlushBatchSize,
+		interval: defaultFlushBatchInterval,
+	}
+	switch policy.mode {
+	case FlushImmediate, FlushLine:
+		if size != "" || interval != "" {
+			return policy, fmt.Errorf("only the batch flush mode takes a size and interval")
+		}
+	case FlushBatch:
+		if size != "" {
+			var err error
+			policy.size, err = strconv.Atoi(size)
+			if err != nil || policy.size <= 0 {
+				return policy, fmt.Errorf("invalid batch size %s", size)
+			}
+		}
+		if interval != "" {
+			var err error
+			policy.interval, err = time.ParseDuration(interval)
+			if err != nil || policy.interval <= 0 {
+				return policy, fmt.Errorf("invalid batch interval %s", interval)
+			}
+		}
+	default:
+		return policy, fmt.Errorf("unknown flush mode %s", mode)
+	}
+	return policy, nil
+}
+
+// SetFlushPolicy sets how the streamed output of later commands on this session is buffered.  The
+// size and interval only apply to the batch mode.
+func (s *sockControl) SetFlushPolicy(mode string, size int, interval time.Duration) error {
+	switch mode {
+	case FlushImmediate, FlushLine:
+	case FlushBatch:
+		if size <= 0 || interval <= 0 {
+			return fmt.Errorf("batch size and interval must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown flush mode %s", mode)
+	}
+	s.flush = flushPolicy{
+		mode:     mode,
+		size:     size,
+		interval: interval,
+	}
+	return nil
+}
+
+func (t *sessionCommandType) Description() string {
+	return "Set options, such as the flush policy, of this control session"
+}
+
+func (t *sessionCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no session subcommand")
+	}
+	c := &sessionCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	switch c.subcommand {
+	case "flush":
+		if len(tokens) < 2 || len(tokens) > 4 {
+			return nil, fmt.Errorf("session flush requires a mode, optionally followed by a batch size and interval")
+		}
+		var size, interval string
+		if len(tokens) > 2 {
+			size = tokens[2]
+		}
+		if len(tokens) > 3 {
+			interval = tokens[3]
+		}
+		var err error
+		c.policy, err = parseFlushPolicy(tokens[1], size, interval)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown session subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (t *sessionCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no session subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("session subcommand must be string")
+	}
+	c := &sessionCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	switch c.subcommand {
+	case "flush":
+		mode, ok := config["mode"].(string)
+		if !ok {
+			return nil, fmt.Errorf("session flush requires string parameter mode")
+		}
+		var size, interval string
+		sizeIf, ok := config["size"]
+		if ok {
+			sizeFloat, ok := sizeIf.(float64)
+			if !ok {
+				return nil, fmt.Errorf("size must be a number")
+			}
+			size = strconv.Itoa(int(sizeFloat))
+		}
+		intervalIf, ok := config["interval"]
+		if ok {
+			interval, ok = intervalIf.(string)
+			if !ok {
+				return nil, fmt.Errorf("interval must be a string")
+			}
+		}
+		var err error
+		c.policy, err = parseFlushPolicy(mode, size, interval)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown session subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (c *sessionCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	err := cfo.SetFlushPolicy(c.policy.mode, c.policy.size, c.policy.interval)
+	if err != nil {
+		return nil, err
+	}
+	cfr := make(map[string]interface{})
+	cfr["Success"] = true
+	cfr["Mode"] = c.policy.mode
+	if c.policy.mode == FlushBatch {
+		cfr["Size"] = c.policy.size
+		cfr["Interval"] = c.policy.interval.String()
+	}
+	return cfr, nil
+}
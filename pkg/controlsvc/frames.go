@@ -0,0 +1,106 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+)
+
+// StreamCompleteKey is set in the final response of a streaming command, marking the end of its frames
+const StreamCompleteKey = "StreamComplete"
+
+// StreamingCommand is a ControlCommand that sends frames of output while it runs, such as the
+// output of a work unit it is following.  Implementing it is optional.  A control session runs
+// StreamFunc instead of ControlFunc, and writes each frame sent on the frames channel to the client
+// as a response of its own.  Every frame is written before the command's final response, which has
+// StreamCompleteKey set.  StreamFunc must not close the frames channel, and should return once the
+// context of cfo is done, which happens when the client goes away.
+type StreamingCommand interface {
+	ControlCommand
+	StreamFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations, frames chan<- map[string]interface{}) (map[string]interface{}, error)
+}
+
+// errSessionEnded is returned when a stream cannot be written because the session has ended
+var errSessionEnded = fmt.Errorf("control session ended")
+
+// CollectFrames runs a streaming command to completion, returning its final response with the
+// frames it sent in a list under Frames.  Streaming commands can use it to implement ControlFunc.
+func CollectFrames(sc StreamingCommand, nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	frames := make(chan map[string]interface{})
+	collected := make([]map[string]interface{}, 0)
+	collectDone := make(chan struct{})
+	go func() {
+		defer close(collectDone)
+		for frame := range frames {
+			collected = append(collected, frame)
+		}
+	}()
+	cfr, err := sc.StreamFunc(nc, cfo, frames)
+	close(frames)
+	<-collectDone
+	if err != nil {
+		return nil, err
+	}
+	if cfr == nil {
+		cfr = make(map[string]interface{})
+	}
+	cfr["Frames"] = collected
+	return cfr, nil
+}
+
+// runStreamingCommand runs a streaming command, writing its frames to the client as a stream
+// while it runs.  It only returns once every frame has been written, so the frames
+// never interleave with the final response.  If the client goes away, the command's context is
+// cancelled, and any further frames are discarded until the command returns.
+func (s *sockControl) runStreamingCommand(nc *netceptor.Netceptor, sc StreamingCommand,
+	format *responseFormat) (map[string]interface{}, error) {
+	frames := make(chan map[string]interface{})
+	data := make(chan []byte)
+	writeDone := make(chan error, 1)
+	go func() {
+		// The frames are already encoded for the session, so they are written as they are
+		writeDone <- s.writeStream("", data, nil, streamRaw)
+	}()
+	encodeDone := make(chan struct{})
+	go func() {
+		defer close(encodeDone)
+		defer close(data)
+		send := func(b []byte) error {
+			select {
+			case data <- b:
+				return nil
+			case <-s.done:
+				return errSessionEnded
+			}
+		}
+		for frame := range frames {
+			_ = format.writeResult(send, frame)
+		}
+	}()
+	finished := make(chan struct{})
+	deadline := s.deadline
+	go func() {
+		select {
+		case <-s.done:
+			if deadline != nil {
+				deadline.cancel()
+			}
+		case <-finished:
+		}
+	}()
+	cfr, err := sc.StreamFunc(nc, s, frames)
+	close(finished)
+	close(frames)
+	<-encodeDone
+	writeErr := <-writeDone
+	if err != nil {
+		return nil, err
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	if cfr == nil {
+		cfr = make(map[string]interface{})
+	}
+	cfr[StreamCompleteKey] = true
+	return cfr, nil
+}
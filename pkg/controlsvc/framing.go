@@ -0,0 +1,62 @@
+package controlsvc
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+// FramedHandshake is the line a client sends as its first command to switch the session to
+// length-prefixed framing.  The server answers with the same line, after which every message in
+// either direction is a frame: a 4-byte big-endian length followed by that many bytes.  Requests
+// are framed commands, usually JSON, which may contain newlines.  Responses, including errors, are
+// framed encoded responses, without the trailing newline or the MSGPACK and GZIP header lines of
+// the newline-delimited protocol.  Compressed responses are a series of frames of gzip data ending
+// with an empty frame.  A server that does not support framing answers the handshake
+// with an unknown command error, and the session continues in newline-delimited mode.  Commands
+// that take over the connection, such as connect, carry raw bytes after their framed greeting.
+const FramedHandshake = "!framed-v1"
+
+// frameHeaderLength is the length of the header of a length-prefixed frame
+const frameHeaderLength = 4
+
+// appendFrame appends data to buf as a length-prefixed frame
+func appendFrame(buf []byte, data []byte) []byte {
+	var header [frameHeaderLength]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	buf = append(buf, header[:]...)
+	return append(buf, data...)
+}
+
+// readFrame returns the payload of the next length-prefixed frame.  A frame longer than the
+// maximum length is discarded, so the session can continue with the next frame.  If the
+// connection ends between frames, io.EOF is returned.
+func (r *lineReader) readFrame() ([]byte, error) {
+	var header [frameHeaderLength]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	if size > int64(r.maxLength) {
+		_, err = io.CopyN(ioutil.Discard, r, size)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &lineTooLongError{maxLength: r.maxLength}
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// writeMessage writes a message from a command to the client, as a frame if the session is framed
+func (s *sockControl) writeMessage(message string) error {
+	if s.framed {
+		return s.write(appendFrame(nil, []byte(message)))
+	}
+	return s.write([]byte(message))
+}
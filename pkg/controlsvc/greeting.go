@@ -0,0 +1,137 @@
+package controlsvc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ProtocolVersion is the version of the control protocol spoken by this server, which it sends in
+// its greeting.  Servers whose greeting has no version speak version 1, the newline-delimited
+// protocol.  Version 2 added length-prefixed framing, streaming commands, response encodings and
+// compression, and request IDs.
+const ProtocolVersion = 2
+
+// Capabilities of the control protocol that a server can list in its greeting
+const (
+	// CapabilityFraming means the server accepts the FramedHandshake
+	CapabilityFraming = "framing"
+	// CapabilityStreaming means the server can stream the frames of streaming commands
+	CapabilityStreaming = "streaming"
+	// CapabilityMsgpack means the server can send responses with EncodingMsgpack
+	CapabilityMsgpack = "msgpack"
+	// CapabilityGzip means the server can send responses with CompressionGzip
+	CapabilityGzip = "gzip"
+	// CapabilityRequestID means the server echoes the RequestIDKey field of JSON commands
+	CapabilityRequestID = "requestid"
+	// CapabilityChunkedOutput means the server can send the output of work results and work tail
+	// as chunks followed by a trailer, as written by WriteChunksToConn
+	CapabilityChunkedOutput = "chunkedoutput"
+)
+
+// serverCapabilities are the capabilities of this server, in the order listed in its greeting
+var serverCapabilities = []string{
+	CapabilityFraming,
+	CapabilityStreaming,
+	CapabilityMsgpack,
+	CapabilityGzip,
+	CapabilityRequestID,
+	CapabilityChunkedOutput,
+}
+
+// greetingPrefix starts the line a server sends when a client connects, followed by the node ID
+const greetingPrefix = "Receptor Control, node "
+
+// Greeting is the line a server sends when a client connects:
+//
+//	Receptor Control, node <node ID>, protocol <version>, capabilities <capability> ...
+//
+// The protocol version and the capabilities were added in protocol version 2, after the node ID,
+// so clients that only look for the node ID at the start of the line still work.  The capabilities
+// are only listed if the server is configured to.
+type Greeting struct {
+	NodeID          string
+	ProtocolVersion int
+	Capabilities    []string
+}
+
+// String returns the greeting line, without its newline
+func (g *Greeting) String() string {
+	line := greetingPrefix + g.NodeID
+	if g.ProtocolVersion > 1 {
+		line += fmt.Sprintf(", protocol %d", g.ProtocolVersion)
+		if len(g.Capabilities) > 0 {
+			line += ", capabilities " + strings.Join(g.Capabilities, " ")
+		}
+	}
+	return line
+}
+
+// HasCapability returns true if the server listed a capability in its greeting
+func (g *Greeting) HasCapability(capability string) bool {
+	for _, c := range g.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseGreeting parses the greeting line of a server.  Greetings without a valid protocol version
+// are from servers that speak version 1, and are taken to be followed by just the node ID.
+func ParseGreeting(line string) (*Greeting, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, greetingPrefix) {
+		return nil, fmt.Errorf("unexpected control service greeting: %q", line)
+	}
+	g := &Greeting{
+		NodeID:          strings.TrimPrefix(line, greetingPrefix),
+		ProtocolVersion: 1,
+		Capabilities:    make([]string, 0),
+	}
+	idx := strings.LastIndex(g.NodeID, ", protocol ")
+	if idx < 0 {
+		return g, nil
+	}
+	suffix := g.NodeID[idx+len(", protocol "):]
+	version := suffix
+	var capabilities []string
+	capIdx := strings.Index(suffix, ", capabilities ")
+	if capIdx >= 0 {
+		version = suffix[:capIdx]
+		capabilities = strings.Fields(suffix[capIdx+len(", capabilities "):])
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil || v < 2 {
+		return g, nil
+	}
+	g.NodeID = g.NodeID[:idx]
+	g.ProtocolVersion = v
+	if capabilities != nil {
+		g.Capabilities = capabilities
+	}
+	return g, nil
+}
+
+// SetGreetingCapabilities sets whether the greeting lists the capabilities of the server, for
+// clients that negotiate protocol features.  It applies to sessions that start afterwards.
+func (s *Server) SetGreetingCapabilities(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&s.greetingCaps, v)
+}
+
+// greeting returns the greeting the server sends when a client connects
+func (s *Server) greeting() *Greeting {
+	g := &Greeting{
+		NodeID:          s.nc.NodeID(),
+		ProtocolVersion: ProtocolVersion,
+	}
+	if atomic.LoadInt32(&s.greetingCaps) != 0 {
+		g.Capabilities = serverCapabilities
+	}
+	return g
+}
@@ -0,0 +1,219 @@
+package controlsvc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck reports whether a subsystem is ready, returning an error saying why if it is not.
+// Checks run on every health request, so they must be fast and must not block.
+type HealthCheck func() error
+
+// namedHealthCheck is a health check and the subsystem that contributed it
+type namedHealthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// HealthCheckResult is the outcome of the readiness check of one subsystem
+type HealthCheckResult struct {
+	Name   string
+	Ready  bool
+	Detail string
+}
+
+// HealthStatus is the readiness of a node.  The node is ready if all its checks are.
+type HealthStatus struct {
+	NodeID string
+	Ready  bool
+	Checks []*HealthCheckResult
+}
+
+// AddHealthCheck registers a check of a subsystem's readiness, which the healthz command and the
+// health server run after the built-in checks of the network and the control service
+func (s *Server) AddHealthCheck(name string, check HealthCheck) {
+	s.controlFuncLock.Lock()
+	defer s.controlFuncLock.Unlock()
+	s.healthChecks = append(s.healthChecks, namedHealthCheck{
+		name:  name,
+		check: check,
+	})
+}
+
+// SetLocalOnly marks the node as one that runs without backends, so it is ready without any
+// connections to other nodes
+func (s *Server) SetLocalOnly(localOnly bool) {
+	var v int32
+	if localOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&s.localOnly, v)
+}
+
+// checkNetwork checks that the node is running and, unless it is local-only, that at least one
+// of its backends has established a connection
+func (s *Server) checkNetwork() (string, error) {
+	if s.nc.Context().Err() != nil {
+		return "", fmt.Errorf("node is shutting down")
+	}
+	if atomic.LoadInt32(&s.localOnly) != 0 {
+		return "local-only node", nil
+	}
+	if s.nc.BackendCount() == 0 {
+		return "", fmt.Errorf("no backends are configured")
+	}
+	conns := 0
+	for _, bs := range s.nc.BackendStatus() {
+		conns += len(bs.Connections)
+	}
+	if conns == 0 {
+		return "", fmt.Errorf("no backend connections are established")
+	}
+	return fmt.Sprintf("%d backend connections", conns), nil
+}
+
+// checkControlService checks that at least one control service listener is running
+func (s *Server) checkControlService() (string, error) {
+	listeners := atomic.LoadInt32(&s.activeListeners)
+	if listeners == 0 {
+		return "", fmt.Errorf("no control service listeners are running")
+	}
+	return fmt.Sprintf("%d listeners", listeners), nil
+}
+
+// Health runs the readiness checks of the node.  It does not wait on the network, so it is cheap
+// enough for orchestrators to call often.
+func (s *Server) Health() *HealthStatus {
+	s.controlFuncLock.RLock()
+	checks := make([]namedHealthCheck, len(s.healthChecks))
+	copy(checks, s.healthChecks)
+	s.controlFuncLock.RUnlock()
+	hs := &HealthStatus{
+		NodeID: s.nc.NodeID(),
+		Ready:  true,
+		Checks: make([]*HealthCheckResult, 0, len(checks)+2),
+	}
+	addResult := func(name string, detail string, err error) {
+		result := &HealthCheckResult{
+			Name:   name,
+			Ready:  err == nil,
+			Detail: detail,
+		}
+		if err != nil {
+			result.Detail = err.Error()
+			hs.Ready = false
+		}
+		hs.Checks = append(hs.Checks, result)
+	}
+	detail, err := s.checkNetwork()
+	addResult("netceptor", detail, err)
+	detail, err = s.checkControlService()
+	addResult("controlsvc", detail, err)
+	for _, hc := range checks {
+		addResult(hc.name, "", hc.check())
+	}
+	return hs
+}
+
+type healthzCommandType struct {
+	s *Server
+}
+type healthzCommand struct {
+	s *Server
+}
+
+func (t *healthzCommandType) Description() string {
+	return "Show whether this node is ready, and the readiness of each of its subsystems"
+}
+
+func (t *healthzCommandType) InitFromString(params string) (ControlCommand, error) {
+	if params != "" {
+		return nil, fmt.Errorf("healthz command does not take parameters")
+	}
+	return &healthzCommand{s: t.s}, nil
+}
+
+func (t *healthzCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	return &healthzCommand{s: t.s}, nil
+}
+
+func (c *healthzCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	hs := c.s.Health()
+	cfr := make(map[string]interface{})
+	cfr["NodeID"] = hs.NodeID
+	cfr["Ready"] = hs.Ready
+	cfr["Checks"] = hs.Checks
+	return cfr, nil
+}
+
+// NewHealthHandler returns an HTTP handler that reports the readiness of a node as JSON, with a
+// status of 200 if it is ready or 503 if it is not
+func NewHealthHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hs := s.Health()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if hs.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if r.Method != http.MethodHead {
+			_ = json.NewEncoder(w).Encode(hs)
+		}
+	})
+}
+
+// ServeHealth serves the readiness of a node on a listener, at the given path, until the context
+// is done
+func ServeHealth(ctx context.Context, li net.Listener, path string, s *Server) {
+	mux := http.NewServeMux()
+	mux.Handle(path, NewHealthHandler(s))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		err := server.Serve(li)
+		if err != nil && err != http.ErrServerClosed {
+			sublogger.Error("Error serving health checks: %s\n", err)
+		}
+	}()
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// CmdlineConfigHealth is the cmdline configuration object for the health server
+type CmdlineConfigHealth struct {
+	Address string `required:"true" description:"Local address to serve the node's readiness on, such as :8080" barevalue:"yes"`
+	Path    string `description:"URL path of the readiness check" default:"/healthz"`
+}
+
+// Run runs the action
+func (cfg CmdlineConfigHealth) Run() error {
+	li, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return fmt.Errorf("error listening for health checks on %s: %s", cfg.Address, err)
+	}
+	sublogger.Info("Serving health checks on %s%s\n", li.Addr(), cfg.Path)
+	ServeHealth(netceptor.MainInstance.Context(), li, cfg.Path, MainInstance)
+	return nil
+}
+
+func init() {
+	cmdline.AddConfigType("health-server", "Serve the readiness of this node over HTTP, for orchestrator probes",
+		CmdlineConfigHealth{}, false, true, false, false, nil)
+}
@@ -0,0 +1,116 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+)
+
+type hmacCommandType struct{}
+type hmacCommand struct {
+	subcommand string
+	keyID      string
+	key        string
+}
+
+// hmacParamCounts is the number of parameters each hmac subcommand takes
+var hmacParamCounts = map[string]int{
+	"list":    0,
+	"add":     2,
+	"primary": 1,
+	"remove":  1,
+}
+
+func (t *hmacCommandType) Description() string {
+	return "Manage the pre-shared keys that sign backend frames"
+}
+
+// Redact hides the keys being added from the audit log
+func (t *hmacCommandType) Redact(params string, config map[string]interface{}) (string, map[string]interface{}) {
+	return RedactTokens(params, 2), RedactFields(config, "key")
+}
+
+func (t *hmacCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no hmac subcommand")
+	}
+	c := &hmacCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	count, ok := hmacParamCounts[c.subcommand]
+	if !ok {
+		return nil, fmt.Errorf("unknown hmac subcommand %s", c.subcommand)
+	}
+	if len(tokens)-1 != count {
+		return nil, fmt.Errorf("hmac %s takes %d parameters", c.subcommand, count)
+	}
+	if count > 0 {
+		c.keyID = tokens[1]
+	}
+	if count > 1 {
+		c.key = tokens[2]
+	}
+	return c, nil
+}
+
+func (t *hmacCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no hmac subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("hmac subcommand must be string")
+	}
+	c := &hmacCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	count, ok := hmacParamCounts[c.subcommand]
+	if !ok {
+		return nil, fmt.Errorf("unknown hmac subcommand %s", c.subcommand)
+	}
+	if count > 0 {
+		c.keyID, ok = config["keyid"].(string)
+		if !ok {
+			return nil, fmt.Errorf("hmac %s requires string parameter keyid", c.subcommand)
+		}
+	}
+	if count > 1 {
+		c.key, ok = config["key"].(string)
+		if !ok {
+			return nil, fmt.Errorf("hmac %s requires string parameter key", c.subcommand)
+		}
+	}
+	return c, nil
+}
+
+// Mutates returns true for the subcommands that change the keys
+func (c *hmacCommand) Mutates() bool {
+	return c.subcommand != "list"
+}
+
+func (c *hmacCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	var err error
+	switch c.subcommand {
+	case "list":
+		keyIDs, primary := nc.HMACKeys()
+		cfr["Keys"] = keyIDs
+		cfr["Primary"] = primary
+		return cfr, nil
+	case "add":
+		err = nc.AddHMACKey(c.keyID, []byte(c.key))
+	case "primary":
+		err = nc.SetPrimaryHMACKey(c.keyID)
+	case "remove":
+		err = nc.RemoveHMACKey(c.keyID)
+	}
+	if err != nil {
+		cfr["Success"] = false
+		cfr["Error"] = err.Error()
+	} else {
+		cfr["Success"] = true
+	}
+	return cfr, nil
+}
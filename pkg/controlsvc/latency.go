@@ -0,0 +1,127 @@
+package controlsvc
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits on the latency samples kept for each command
+const (
+	LatencyWindow     = 5 * time.Minute // Samples older than this are discarded
+	maxLatencySamples = 1000            // Only the most recent samples are kept beyond this
+)
+
+// LatencyHistogram summarizes how long a control command took over the latency window
+type LatencyHistogram struct {
+	Count int
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// latencySample is the duration of one run of a command
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// latencyRegistry keeps a rolling window of per-command latency samples
+type latencyRegistry struct {
+	lock    *sync.RWMutex
+	samples map[string][]latencySample
+}
+
+// newLatencyRegistry allocates a new, empty latencyRegistry
+func newLatencyRegistry() *latencyRegistry {
+	return &latencyRegistry{
+		lock:    &sync.RWMutex{},
+		samples: make(map[string][]latencySample),
+	}
+}
+
+// expire drops samples of a command that are older than the window, or beyond the sample limit
+func (lr *latencyRegistry) expire(command string, now time.Time) {
+	samples := lr.samples[command]
+	first := 0
+	for first < len(samples) && now.Sub(samples[first].at) > LatencyWindow {
+		first++
+	}
+	if len(samples)-first > maxLatencySamples {
+		first = len(samples) - maxLatencySamples
+	}
+	if first == len(samples) {
+		delete(lr.samples, command)
+		return
+	}
+	if first > 0 {
+		lr.samples[command] = append([]latencySample{}, samples[first:]...)
+	}
+}
+
+// record adds a sample for a command that finished at the given time
+func (lr *latencyRegistry) record(command string, duration time.Duration, now time.Time) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	lr.samples[command] = append(lr.samples[command], latencySample{
+		at:       now,
+		duration: duration,
+	})
+	lr.expire(command, now)
+}
+
+// percentile returns the nearest-rank percentile of a sorted list of durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// histograms summarizes the samples of each command that fall within the window as of the given time
+func (lr *latencyRegistry) histograms(now time.Time) map[string]LatencyHistogram {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	hists := make(map[string]LatencyHistogram)
+	for command := range lr.samples {
+		lr.expire(command, now)
+		samples, ok := lr.samples[command]
+		if !ok {
+			continue
+		}
+		durations := make([]time.Duration, 0, len(samples))
+		for _, s := range samples {
+			durations = append(durations, s.duration)
+		}
+		sort.Slice(durations, func(i, j int) bool {
+			return durations[i] < durations[j]
+		})
+		hists[command] = LatencyHistogram{
+			Count: len(durations),
+			P50:   percentile(durations, 50),
+			P95:   percentile(durations, 95),
+			P99:   percentile(durations, 99),
+			Max:   durations[len(durations)-1],
+		}
+	}
+	return hists
+}
+
+// reset discards the samples of a command, or of all commands if the name is blank
+func (lr *latencyRegistry) reset(command string) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	if command == "" {
+		lr.samples = make(map[string][]latencySample)
+	} else {
+		delete(lr.samples, command)
+	}
+}
+
+// CommandLatencies returns latency histograms of the commands run within the latency window
+func (s *Server) CommandLatencies() map[string]LatencyHistogram {
+	return s.latency.histograms(time.Now())
+}
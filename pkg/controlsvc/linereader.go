@@ -0,0 +1,94 @@
+package controlsvc
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// DefaultMaxLineLength is the default limit on the length of a single command line
+const DefaultMaxLineLength = 64 * 1024
+
+// lineReadChunk is how many bytes a lineReader reads from the connection at a time
+const lineReadChunk = 4096
+
+// lineTooLongError is returned when a command line exceeds the maximum line length.  The rest of
+// the line is discarded, so the session can continue with the next line.
+type lineTooLongError struct {
+	maxLength int
+}
+
+func (e *lineTooLongError) Error() string {
+	return fmt.Sprintf("command line exceeds the maximum length of %d bytes", e.maxLength)
+}
+
+// lineReader reads newline-terminated command lines from a connection in chunks, rather than a
+// byte at a time.  Bytes read past the end of a line are kept, and Read returns them before
+// reading from the connection again, so a command that takes over the raw connection (such as
+// connect) still sees any data the client sent straight after the command line.
+type lineReader struct {
+	net.Conn
+	buf       []byte
+	err       error
+	maxLength int
+}
+
+// newLineReader returns a lineReader for a connection
+func newLineReader(conn net.Conn, maxLength int) *lineReader {
+	return &lineReader{
+		Conn:      conn,
+		buf:       make([]byte, 0, lineReadChunk),
+		maxLength: maxLength,
+	}
+}
+
+// Read returns any buffered bytes, and otherwise reads from the connection
+func (r *lineReader) Read(p []byte) (int, error) {
+	if len(r.buf) > 0 {
+		n := copy(p, r.buf)
+		r.buf = r.buf[n:]
+		return n, nil
+	}
+	if r.err != nil {
+		err := r.err
+		r.err = nil
+		return 0, err
+	}
+	return r.Conn.Read(p)
+}
+
+// readLine returns the next line, without its newline.  If the connection ends part way through a
+// line, the partial line is returned along with the error.
+func (r *lineReader) readLine() (string, error) {
+	discarding := false
+	chunk := make([]byte, lineReadChunk)
+	for {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i >= 0 {
+			line := r.buf[:i]
+			r.buf = r.buf[i+1:]
+			if discarding || len(line) > r.maxLength {
+				return "", &lineTooLongError{maxLength: r.maxLength}
+			}
+			return string(line), nil
+		}
+		if len(r.buf) > r.maxLength {
+			// Stop buffering, but keep reading until the end of the line
+			discarding = true
+			r.buf = r.buf[:0]
+		}
+		if r.err != nil {
+			line := r.buf
+			r.buf = r.buf[:0]
+			err := r.err
+			r.err = nil
+			if discarding {
+				return "", err
+			}
+			return string(line), err
+		}
+		var n int
+		n, r.err = r.Conn.Read(chunk)
+		r.buf = append(r.buf, chunk[:n]...)
+	}
+}
@@ -0,0 +1,147 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/logger"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+)
+
+type loglevelCommandType struct{}
+type loglevelCommand struct {
+	subsystem string
+	level     string
+	global    bool
+}
+
+// validateLogLevel checks a level name, which may also be "default" to remove a subsystem's override
+func validateLogLevel(level string) (string, error) {
+	level = strings.ToLower(level)
+	if level == "default" {
+		return level, nil
+	}
+	_, err := logger.GetLogLevelByName(level)
+	if err != nil {
+		return "", err
+	}
+	return level, nil
+}
+
+func (t *loglevelCommandType) Description() string {
+	return "Show or set the global log level or the log levels of subsystems of this node"
+}
+
+func (t *loglevelCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	c := &loglevelCommand{}
+	switch len(tokens) {
+	case 0:
+	case 1:
+		level, err := logger.GetLogLevelByName(tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		c.global = true
+		c.level = logger.GetLogLevelName(level)
+	case 2:
+		c.subsystem = strings.ToLower(tokens[0])
+		var err error
+		c.level, err = validateLogLevel(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("loglevel takes either no parameters, a level, or a subsystem and a level")
+	}
+	return c, nil
+}
+
+func (t *loglevelCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	c := &loglevelCommand{}
+	subsystem, ok := config["subsystem"]
+	if !ok {
+		level, ok := config["level"]
+		if !ok {
+			return c, nil
+		}
+		levelStr, ok := level.(string)
+		if !ok {
+			return nil, fmt.Errorf("level must be string")
+		}
+		levelNum, err := logger.GetLogLevelByName(levelStr)
+		if err != nil {
+			return nil, err
+		}
+		c.global = true
+		c.level = logger.GetLogLevelName(levelNum)
+		return c, nil
+	}
+	c.subsystem, ok = subsystem.(string)
+	if !ok {
+		return nil, fmt.Errorf("subsystem must be string")
+	}
+	c.subsystem = strings.ToLower(c.subsystem)
+	level, ok := config["level"].(string)
+	if !ok {
+		return nil, fmt.Errorf("loglevel requires string parameter level")
+	}
+	var err error
+	c.level, err = validateLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Mutates returns true when a log level is being set
+func (c *loglevelCommand) Mutates() bool {
+	return c.global || c.subsystem != ""
+}
+
+func (c *loglevelCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	if c.global {
+		previous := logger.GetLogLevelName(logger.GetLogLevel())
+		err := logger.SetLevel(c.level)
+		if err != nil {
+			cfr["Success"] = false
+			cfr["Error"] = err.Error()
+			return cfr, nil
+		}
+		cfr["Success"] = true
+		cfr["Previous"] = previous
+		cfr["New"] = c.level
+		logger.Info("Global log level changed from %s to %s by control command\n", previous, c.level)
+	} else if c.subsystem != "" {
+		previousLevel, _ := logger.GetSubsystemLogLevel(c.subsystem)
+		var err error
+		if c.level == "default" {
+			err = logger.ResetSubsystemLogLevel(c.subsystem)
+		} else {
+			level, _ := logger.GetLogLevelByName(c.level)
+			err = logger.SetSubsystemLogLevel(c.subsystem, level)
+		}
+		if err != nil {
+			cfr["Success"] = false
+			cfr["Error"] = err.Error()
+			return cfr, nil
+		}
+		newLevel, _ := logger.GetSubsystemLogLevel(c.subsystem)
+		cfr["Success"] = true
+		cfr["Previous"] = logger.GetLogLevelName(previousLevel)
+		cfr["New"] = logger.GetLogLevelName(newLevel)
+		logger.Info("Log level of %s changed from %s to %s by control command\n", c.subsystem,
+			cfr["Previous"], cfr["New"])
+	}
+	cfr["Global"] = logger.GetLogLevelName(logger.GetLogLevel())
+	subsystems := make(map[string]interface{})
+	for _, name := range logger.Subsystems() {
+		level, overridden := logger.GetSubsystemLogLevel(name)
+		subsystems[name] = map[string]interface{}{
+			"Level":      logger.GetLogLevelName(level),
+			"Overridden": overridden,
+		}
+	}
+	cfr["Subsystems"] = subsystems
+	return cfr, nil
+}
@@ -0,0 +1,248 @@
+package controlsvc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for loss measurement
+const (
+	defaultLossProbes   = 20
+	maxLossProbes       = 1000
+	lossProbeInterval   = 50 * time.Millisecond
+	lossAggregateWindow = 2 * time.Second // How long to wait for replies after the last probe
+)
+
+type lossCommandType struct{}
+type lossCommand struct {
+	target string
+	count  int
+	perHop bool
+}
+
+// lossResult is the outcome of sending a burst of probes
+type lossResult struct {
+	From     string
+	Sent     int
+	Received int
+	Loss     float64
+}
+
+func (t *lossCommandType) Description() string {
+	return "Measure packet loss to a node, end to end or per hop"
+}
+
+func (t *lossCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no loss target")
+	}
+	if len(tokens) > 3 || (len(tokens) == 3 && strings.ToLower(tokens[2]) != "hops") {
+		return nil, fmt.Errorf("loss takes a target, optionally followed by a probe count and the word hops")
+	}
+	c := &lossCommand{
+		target: tokens[0],
+		count:  defaultLossProbes,
+		perHop: len(tokens) == 3,
+	}
+	if len(tokens) > 1 {
+		count, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe count %s", tokens[1])
+		}
+		c.count = count
+	}
+	if c.count < 1 || c.count > maxLossProbes {
+		return nil, fmt.Errorf("probe count must be between 1 and %d", maxLossProbes)
+	}
+	return c, nil
+}
+
+func (t *lossCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	target, ok := config["target"].(string)
+	if !ok {
+		return nil, fmt.Errorf("loss requires string parameter target")
+	}
+	c := &lossCommand{
+		target: target,
+		count:  defaultLossProbes,
+	}
+	countIf, ok := config["count"]
+	if ok {
+		count, ok := countIf.(float64)
+		if !ok {
+			return nil, fmt.Errorf("count must be a number")
+		}
+		c.count = int(count)
+	}
+	if c.count < 1 || c.count > maxLossProbes {
+		return nil, fmt.Errorf("probe count must be between 1 and %d", maxLossProbes)
+	}
+	perHopIf, ok := config["hops"]
+	if ok {
+		c.perHop, ok = perHopIf.(bool)
+		if !ok {
+			return nil, fmt.Errorf("hops must be a boolean")
+		}
+	}
+	return c, nil
+}
+
+// measureLoss sends a burst of probes to a node's ping service and counts the replies that arrive
+// before the aggregation window closes.  Each probe carries a sequence number, which the target
+// echoes back, so that duplicate replies are not counted twice.  If hopsToLive is too small for the
+// probes to reach the target, the replies counted are instead the expired-in-transit notices of
+// the node at that hop.
+func measureLoss(nc *netceptor.Netceptor, target string, hopsToLive byte, count int,
+	interval time.Duration, window time.Duration) (*lossResult, error) {
+	pc, err := nc.ListenPacket("")
+	if err != nil {
+		return nil, err
+	}
+	doneChan := make(chan struct{})
+	defer func() {
+		close(doneChan)
+		_ = pc.Close()
+	}()
+	pc.SetHopsToLive(hopsToLive)
+	lock := &sync.Mutex{}
+	result := &lossResult{}
+	seen := make(map[uint64]bool)
+	var problem string
+	msgCh := pc.SubscribeUnreachable()
+	go func() {
+		for {
+			select {
+			case <-doneChan:
+				pc.UnsubscribeUnreachable(msgCh)
+				return
+			case msg := <-msgCh:
+				lock.Lock()
+				if msg["Problem"] == netceptor.ProblemExpiredInTransit {
+					result.Received++
+					result.From = msg["ReceivedFromNode"]
+				} else {
+					problem = msg["Problem"]
+				}
+				lock.Unlock()
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 8)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			result.From = strings.TrimSuffix(addr.String(), ":ping")
+			if n == 8 {
+				seq := binary.BigEndian.Uint64(buf)
+				if !seen[seq] {
+					seen[seq] = true
+					result.Received++
+				}
+			} else {
+				// The target does not echo the sequence number, so every reply counts
+				result.Received++
+			}
+			lock.Unlock()
+		}
+	}()
+	probe := make([]byte, 8)
+	for seq := 0; seq < count; seq++ {
+		binary.BigEndian.PutUint64(probe, uint64(seq))
+		_, err = pc.WriteTo(probe, nc.NewAddr(target, "ping"))
+		if err != nil {
+			return nil, err
+		}
+		result.Sent++
+		time.Sleep(interval)
+	}
+	time.Sleep(window)
+	lock.Lock()
+	defer lock.Unlock()
+	if result.Received == 0 && problem != "" {
+		return nil, fmt.Errorf("%s", problem)
+	}
+	if result.Received > result.Sent {
+		result.Received = result.Sent
+	}
+	result.Loss = 100 * float64(result.Sent-result.Received) / float64(result.Sent)
+	copied := *result
+	return &copied, nil
+}
+
+// traceHop pings a target with a limited number of hops, returning true if the ping reached the
+// target rather than expiring on the way.  Pings are retried, since the path may be lossy.
+func traceHop(ctx context.Context, nc *netceptor.Netceptor, target string, hopsToLive byte) (bool, error) {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		_, _, err = ping(ctx, nc, target, hopsToLive, defaultPingTimeout)
+		if err == nil {
+			return true, nil
+		}
+		if err.Error() == netceptor.ProblemExpiredInTransit {
+			return false, nil
+		}
+	}
+	return false, err
+}
+
+// lossResultMap converts a lossResult to a control service response
+func lossResultMap(lr *lossResult) map[string]interface{} {
+	return map[string]interface{}{
+		"From":     lr.From,
+		"Sent":     lr.Sent,
+		"Received": lr.Received,
+		"Loss":     lr.Loss,
+	}
+}
+
+func (c *lossCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	if c.perHop {
+		// Find the path with a traceroute, then measure the loss to each hop along it
+		hops := make(map[string]interface{})
+		ctx := commandContext(cfo)
+		for i := 0; i <= netceptor.MaxForwardingHops; i++ {
+			reached, err := traceHop(ctx, nc, c.target, byte(i))
+			if err != nil {
+				cfr["Success"] = false
+				cfr["Error"] = fmt.Sprintf("error tracing hop %d: %s", i, err)
+				return cfr, nil
+			}
+			lr, err := measureLoss(nc, c.target, byte(i), c.count, lossProbeInterval, lossAggregateWindow)
+			if err != nil {
+				cfr["Success"] = false
+				cfr["Error"] = fmt.Sprintf("error measuring hop %d: %s", i, err)
+				return cfr, nil
+			}
+			hops[strconv.Itoa(i)] = lossResultMap(lr)
+			if reached {
+				break
+			}
+		}
+		cfr["Success"] = true
+		cfr["Hops"] = hops
+		return cfr, nil
+	}
+	lr, err := measureLoss(nc, c.target, netceptor.MaxForwardingHops, c.count, lossProbeInterval, lossAggregateWindow)
+	if err != nil {
+		cfr["Success"] = false
+		cfr["Error"] = err.Error()
+		return cfr, nil
+	}
+	for k, v := range lossResultMap(lr) {
+		cfr[k] = v
+	}
+	cfr["Success"] = true
+	return cfr, nil
+}
@@ -0,0 +1,171 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+	"time"
+)
+
+// controlMetrics are the counters of the control service as a whole, guarded by controlFuncLock
+type controlMetrics struct {
+	since           time.Time
+	sessionsTotal   uint64
+	commandsTotal   uint64
+	commandErrors   uint64
+	unknownCommands uint64
+}
+
+// ActiveCommand describes a command that is running in a control session
+type ActiveCommand struct {
+	SessionID int
+	Command   string
+	Started   time.Time
+	Elapsed   time.Duration
+}
+
+// ControlMetrics is a snapshot of the counters of a control service
+type ControlMetrics struct {
+	// Since is when the counters were last reset
+	Since          time.Time
+	ActiveSessions int
+	SessionsTotal  uint64
+	// CommandsTotal counts every command received, including unknown and rejected ones
+	CommandsTotal   uint64
+	CommandErrors   uint64
+	UnknownCommands uint64
+	Commands        map[string]CommandStats
+	// LongestCommand is the command that has been running the longest, or nil if all sessions are idle
+	LongestCommand *ActiveCommand
+}
+
+// countSession records that a control session started
+func (s *Server) countSession() {
+	s.controlFuncLock.Lock()
+	s.metrics.sessionsTotal++
+	s.controlFuncLock.Unlock()
+}
+
+// countCommand records that a command finished, failed or was not found
+func (s *Server) countCommand(failed bool, unknown bool) {
+	s.controlFuncLock.Lock()
+	s.metrics.commandsTotal++
+	if failed || unknown {
+		s.metrics.commandErrors++
+	}
+	if unknown {
+		s.metrics.unknownCommands++
+	}
+	s.controlFuncLock.Unlock()
+}
+
+// Metrics returns the counters of the control service
+func (s *Server) Metrics() ControlMetrics {
+	s.controlFuncLock.RLock()
+	m := s.metrics
+	s.controlFuncLock.RUnlock()
+	metrics := ControlMetrics{
+		Since:           m.since,
+		SessionsTotal:   m.sessionsTotal,
+		CommandsTotal:   m.commandsTotal,
+		CommandErrors:   m.commandErrors,
+		UnknownCommands: m.unknownCommands,
+		Commands:        s.commandStats.snapshot(),
+	}
+	now := time.Now()
+	for _, cs := range s.sessions.list() {
+		metrics.ActiveSessions++
+		if cs.Command == "" {
+			continue
+		}
+		if metrics.LongestCommand == nil || cs.CommandStarted.Before(metrics.LongestCommand.Started) {
+			metrics.LongestCommand = &ActiveCommand{
+				SessionID: cs.ID,
+				Command:   cs.Command,
+				Started:   cs.CommandStarted,
+				Elapsed:   now.Sub(cs.CommandStarted),
+			}
+		}
+	}
+	return metrics
+}
+
+// ResetMetrics zeroes the counters of the control service, including the per-command counters
+// shown by the stats command
+func (s *Server) ResetMetrics() {
+	s.controlFuncLock.Lock()
+	s.metrics = controlMetrics{
+		since: time.Now(),
+	}
+	s.controlFuncLock.Unlock()
+	s.commandStats.reset("")
+}
+
+type metricsCommandType struct {
+	s *Server
+}
+type metricsCommand struct {
+	s     *Server
+	reset bool
+}
+
+func (t *metricsCommandType) Description() string {
+	return "Show, and optionally reset, the session and command counters of the control service"
+}
+
+func (t *metricsCommandType) InitFromString(params string) (ControlCommand, error) {
+	c := &metricsCommand{
+		s: t.s,
+	}
+	switch strings.ToLower(strings.TrimSpace(params)) {
+	case "":
+	case "reset":
+		c.reset = true
+	default:
+		return nil, fmt.Errorf("metrics takes an optional reset keyword")
+	}
+	return c, nil
+}
+
+func (t *metricsCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	c := &metricsCommand{
+		s: t.s,
+	}
+	resetIf, ok := config["reset"]
+	if ok {
+		c.reset, ok = resetIf.(bool)
+		if !ok {
+			return nil, fmt.Errorf("reset must be a boolean")
+		}
+	}
+	return c, nil
+}
+
+func (c *metricsCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	m := c.s.Metrics()
+	if c.reset {
+		// The counters are returned as they were just before the reset, so none are lost
+		c.s.ResetMetrics()
+	}
+	cfr := make(map[string]interface{})
+	cfr["Since"] = m.Since
+	cfr["ActiveSessions"] = m.ActiveSessions
+	cfr["SessionsTotal"] = m.SessionsTotal
+	cfr["CommandsTotal"] = m.CommandsTotal
+	cfr["CommandErrors"] = m.CommandErrors
+	cfr["UnknownCommands"] = m.UnknownCommands
+	cfr["Commands"] = m.Commands
+	if m.LongestCommand != nil {
+		cfr["LongestCommand"] = map[string]interface{}{
+			"SessionID":  m.LongestCommand.SessionID,
+			"Command":    m.LongestCommand.Command,
+			"Started":    m.LongestCommand.Started,
+			"Elapsed":    m.LongestCommand.Elapsed.Seconds(),
+			"ElapsedStr": m.LongestCommand.Elapsed.String(),
+		}
+	} else {
+		cfr["LongestCommand"] = nil
+	}
+	cfr["Reset"] = c.reset
+	return cfr, nil
+}
@@ -0,0 +1,40 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+)
+
+type neighborsCommandType struct{}
+type neighborsCommand struct{}
+
+func (t *neighborsCommandType) Description() string {
+	return "Show the directly connected peers of this node"
+}
+
+func (t *neighborsCommandType) InitFromString(params string) (ControlCommand, error) {
+	if params != "" {
+		return nil, fmt.Errorf("neighbors command does not take parameters")
+	}
+	c := &neighborsCommand{}
+	return c, nil
+}
+
+func (t *neighborsCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	c := &neighborsCommand{}
+	return c, nil
+}
+
+func (c *neighborsCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	for _, n := range nc.Neighbors() {
+		cfr[n.NodeID] = map[string]interface{}{
+			"Backend":   n.Backend,
+			"Cost":      n.Cost,
+			"RTT":       n.RTT,
+			"RTTStr":    fmt.Sprintf("%s", n.RTT),
+			"LastHeard": n.LastHeard,
+		}
+	}
+	return cfr, nil
+}
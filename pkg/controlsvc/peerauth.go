@@ -0,0 +1,72 @@
+package controlsvc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// UnixPeerPolicy restricts the local users that may connect to the Unix socket of a listener, by the
+// credentials of the connecting process.  A connection is allowed if its user ID is one of UIDs, or
+// its group ID is one of GIDs.  Only the primary group of the process is checked.
+type UnixPeerPolicy struct {
+	UIDs []int
+	GIDs []int
+}
+
+// errPeerNotAllowed is sent to Unix socket clients whose credentials are not allowed
+var errPeerNotAllowed = fmt.Errorf("permission denied")
+
+// allows returns true if the policy permits a client with the given credentials.  A client whose
+// credentials could not be read is not permitted.
+func (p *UnixPeerPolicy) allows(creds *UnixCredentials) bool {
+	if creds == nil {
+		return false
+	}
+	for _, uid := range p.UIDs {
+		if creds.UID == uid {
+			return true
+		}
+	}
+	for _, gid := range p.GIDs {
+		if creds.GID == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// admit returns an error if a connection to a Unix socket is not permitted by the policy
+func (p *UnixPeerPolicy) admit(conn net.Conn) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errPeerNotAllowed
+	}
+	creds := peerCredentials(uc)
+	if !p.allows(creds) {
+		if creds != nil {
+			sublogger.Warning("Unix socket client with uid %d, gid %d and pid %d is not allowed\n",
+				creds.UID, creds.GID, creds.PID)
+		}
+		return errPeerNotAllowed
+	}
+	return nil
+}
+
+// parseIDList parses a comma separated list of numeric user or group IDs
+func parseIDList(list string) ([]int, error) {
+	ids := make([]int, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, err := strconv.Atoi(item)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid ID %s", item)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,33 @@
+//+build linux
+
+package controlsvc
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentialsSupported is true if the credentials of Unix socket clients can be read
+const peerCredentialsSupported = true
+
+// peerCredentials returns the credentials of the process at the other end of a Unix socket, using
+// SO_PEERCRED, or nil if they cannot be read
+func peerCredentials(conn *net.UnixConn) *UnixCredentials {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ucred *syscall.Ucred
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || sockErr != nil {
+		return nil
+	}
+	return &UnixCredentials{
+		PID: int(ucred.Pid),
+		UID: int(ucred.Uid),
+		GID: int(ucred.Gid),
+	}
+}
@@ -0,0 +1,15 @@
+//+build !linux
+
+package controlsvc
+
+import (
+	"net"
+)
+
+// peerCredentialsSupported is true if the credentials of Unix socket clients can be read
+const peerCredentialsSupported = false
+
+// peerCredentials returns nil, because reading Unix socket peer credentials is only supported on Linux
+func peerCredentials(conn *net.UnixConn) *UnixCredentials {
+	return nil
+}
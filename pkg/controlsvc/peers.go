@@ -0,0 +1,80 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+)
+
+type peersCommandType struct{}
+type peersCommand struct {
+	subcommand string
+}
+
+func (t *peersCommandType) Description() string {
+	return "Show or reload the peers allowed to connect to this node"
+}
+
+func (t *peersCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no peers subcommand")
+	}
+	c := &peersCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	switch c.subcommand {
+	case "allowed", "reload":
+		if len(tokens) != 1 {
+			return nil, fmt.Errorf("peers %s does not take parameters", c.subcommand)
+		}
+	default:
+		return nil, fmt.Errorf("unknown peers subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (t *peersCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no peers subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("peers subcommand must be string")
+	}
+	c := &peersCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	if c.subcommand != "allowed" && c.subcommand != "reload" {
+		return nil, fmt.Errorf("unknown peers subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+// Mutates returns true when the allowed peers are being reloaded
+func (c *peersCommand) Mutates() bool {
+	return c.subcommand == "reload"
+}
+
+func (c *peersCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	if c.subcommand == "reload" {
+		err := nc.ReloadAllowedPeers()
+		if err != nil {
+			cfr["Success"] = false
+			cfr["Error"] = err.Error()
+			return cfr, nil
+		}
+	}
+	peers, source := nc.AllowedPeers()
+	cfr["Success"] = true
+	cfr["AllowAll"] = peers == nil
+	if peers == nil {
+		peers = make([]string, 0)
+	}
+	cfr["AllowedPeers"] = peers
+	cfr["DeniedPeers"] = nc.DeniedPeers()
+	cfr["Source"] = source
+	return cfr, nil
+}
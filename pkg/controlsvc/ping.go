@@ -1,23 +1,38 @@
 package controlsvc
 
 import (
+	"context"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/netceptor"
 	"strings"
 	"time"
 )
 
+// defaultPingTimeout is how long a ping waits for a reply
+const defaultPingTimeout = 10 * time.Second
+
+// errPingTimeout is returned when a ping gets no reply in time
+var errPingTimeout = fmt.Errorf("timeout")
+
 type pingCommandType struct{}
 type pingCommand struct {
 	target string
 }
 
+func (t *pingCommandType) Description() string {
+	return "Ping a node, once or a number of times with statistics"
+}
+
 func (t *pingCommandType) InitFromString(params string) (ControlCommand, error) {
-	if params == "" {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
 		return nil, fmt.Errorf("no ping target")
 	}
+	if len(tokens) > 1 {
+		return parsePingSeriesString(tokens)
+	}
 	c := &pingCommand{
-		target: params,
+		target: tokens[0],
 	}
 	return c, nil
 }
@@ -31,14 +46,20 @@ func (t *pingCommandType) InitFromJSON(config map[string]interface{}) (ControlCo
 	if !ok {
 		return nil, fmt.Errorf("ping target must be string")
 	}
+	for _, key := range pingSeriesKeys {
+		if _, ok := config[key]; ok {
+			return parsePingSeriesJSON(targetStr, config)
+		}
+	}
 	c := &pingCommand{
 		target: targetStr,
 	}
 	return c, nil
 }
 
-// ping is the internal implementation of sending a single ping packet and waiting for a reply or error
-func ping(nc *netceptor.Netceptor, target string, hopsToLive byte) (time.Duration, string, error) {
+// ping is the internal implementation of sending a single ping packet and waiting for a reply or
+// error, for up to the timeout.  It gives up early if the context is done.
+func ping(ctx context.Context, nc *netceptor.Netceptor, target string, hopsToLive byte, timeout time.Duration) (time.Duration, string, error) {
 	doneChan := make(chan struct{})
 	pc, err := nc.ListenPacket("")
 	if err != nil {
@@ -105,13 +126,15 @@ func ping(nc *netceptor.Netceptor, target string, hopsToLive byte) (time.Duratio
 		return time.Since(startTime), errRes.fromNode, errRes.err
 	case remote := <-replyChan:
 		return time.Since(startTime), remote, nil
-	case <-time.After(10 * time.Second):
-		return time.Since(startTime), "", fmt.Errorf("timeout")
+	case <-time.After(timeout):
+		return time.Since(startTime), "", errPingTimeout
+	case <-ctx.Done():
+		return time.Since(startTime), "", ctx.Err()
 	}
 }
 
 func (c *pingCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
-	pingTime, pingRemote, err := ping(nc, c.target, netceptor.MaxForwardingHops)
+	pingTime, pingRemote, err := ping(commandContext(cfo), nc, c.target, netceptor.MaxForwardingHops, defaultPingTimeout)
 	cfr := make(map[string]interface{})
 	if err == nil {
 		cfr["Success"] = true
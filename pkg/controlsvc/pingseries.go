@@ -0,0 +1,255 @@
+package controlsvc
+
+import (
+	"context"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults and limits for a series of pings
+const (
+	defaultPingProbes   = 4
+	maxPingProbes       = 1000
+	defaultPingInterval = time.Second
+	minPingInterval     = 10 * time.Millisecond
+	maxPingTimeout      = 60 * time.Second
+)
+
+// pingSeriesKeys are the JSON parameters that make a ping command send a series of probes
+var pingSeriesKeys = []string{"count", "interval", "probetimeout", "frames"}
+
+// pingSeries is a number of pings sent to a node at an interval, each of which waits up to the
+// timeout for its reply
+type pingSeries struct {
+	target   string
+	count    int
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// pingStatsCommand sends a series of pings, returning the result of each probe under Frames
+// along with the statistics of the series
+type pingStatsCommand struct {
+	series *pingSeries
+}
+
+// pingStreamCommand sends a series of pings, streaming the result of each probe as a frame
+type pingStreamCommand struct {
+	series *pingSeries
+}
+
+// validate checks the parameters of a series
+func (ps *pingSeries) validate() error {
+	if ps.count < 1 || ps.count > maxPingProbes {
+		return fmt.Errorf("probe count must be between 1 and %d", maxPingProbes)
+	}
+	if ps.interval < minPingInterval {
+		return fmt.Errorf("interval must be at least %s", minPingInterval)
+	}
+	if ps.timeout > maxPingTimeout {
+		return fmt.Errorf("probe timeout must be at most %s", maxPingTimeout)
+	}
+	return nil
+}
+
+// command returns the command that runs a series, streaming it if frames is set
+func (ps *pingSeries) command(frames bool) (ControlCommand, error) {
+	err := ps.validate()
+	if err != nil {
+		return nil, err
+	}
+	if frames {
+		return &pingStreamCommand{series: ps}, nil
+	}
+	return &pingStatsCommand{series: ps}, nil
+}
+
+// parsePingSeriesString parses ping <target> [count [interval [timeout]]] [frames]
+func parsePingSeriesString(tokens []string) (ControlCommand, error) {
+	ps := &pingSeries{
+		target:   tokens[0],
+		count:    defaultPingProbes,
+		interval: defaultPingInterval,
+		timeout:  defaultPingTimeout,
+	}
+	frames := false
+	values := make([]string, 0, len(tokens)-1)
+	for _, token := range tokens[1:] {
+		if strings.ToLower(token) == "frames" {
+			frames = true
+		} else {
+			values = append(values, token)
+		}
+	}
+	if len(values) > 3 {
+		return nil, fmt.Errorf("ping takes a target, optionally followed by a probe count, an interval, " +
+			"a probe timeout and the word frames")
+	}
+	var err error
+	if len(values) > 0 {
+		ps.count, err = strconv.Atoi(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe count %s", values[0])
+		}
+	}
+	if len(values) > 1 {
+		ps.interval, err = parseTimeout(values[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval: %s", err)
+		}
+	}
+	if len(values) > 2 {
+		ps.timeout, err = parseTimeout(values[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe timeout: %s", err)
+		}
+	}
+	return ps.command(frames)
+}
+
+// parsePingSeriesJSON parses the count, interval, probetimeout and frames parameters of a ping
+func parsePingSeriesJSON(target string, config map[string]interface{}) (ControlCommand, error) {
+	ps := &pingSeries{
+		target:   target,
+		count:    defaultPingProbes,
+		interval: defaultPingInterval,
+		timeout:  defaultPingTimeout,
+	}
+	countIf, ok := config["count"]
+	if ok {
+		count, ok := countIf.(float64)
+		if !ok {
+			return nil, fmt.Errorf("count must be a number")
+		}
+		ps.count = int(count)
+	}
+	var err error
+	intervalIf, ok := config["interval"]
+	if ok {
+		ps.interval, err = parseTimeout(intervalIf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval: %s", err)
+		}
+	}
+	timeoutIf, ok := config["probetimeout"]
+	if ok {
+		ps.timeout, err = parseTimeout(timeoutIf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe timeout: %s", err)
+		}
+	}
+	frames := false
+	framesIf, ok := config["frames"]
+	if ok {
+		frames, ok = framesIf.(bool)
+		if !ok {
+			return nil, fmt.Errorf("frames must be a boolean")
+		}
+	}
+	return ps.command(frames)
+}
+
+// summarizeRTTs returns the minimum, average, maximum and standard deviation of round trip times
+func summarizeRTTs(times []time.Duration) (time.Duration, time.Duration, time.Duration, time.Duration) {
+	if len(times) == 0 {
+		return 0, 0, 0, 0
+	}
+	minTime := times[0]
+	maxTime := times[0]
+	var total float64
+	for _, t := range times {
+		if t < minTime {
+			minTime = t
+		}
+		if t > maxTime {
+			maxTime = t
+		}
+		total += float64(t)
+	}
+	avg := total / float64(len(times))
+	var variance float64
+	for _, t := range times {
+		variance += (float64(t) - avg) * (float64(t) - avg)
+	}
+	variance /= float64(len(times))
+	return minTime, time.Duration(avg), maxTime, time.Duration(math.Sqrt(variance))
+}
+
+// run sends the pings one at a time, sending the result of each on frames.  A probe that gets no
+// reply, or fails, is counted as lost and the series carries on.  It returns the statistics of
+// the series.
+func (ps *pingSeries) run(ctx context.Context, nc *netceptor.Netceptor,
+	frames chan<- map[string]interface{}) (map[string]interface{}, error) {
+	times := make([]time.Duration, 0, ps.count)
+	var lastStart time.Time
+	for seq := 0; seq < ps.count; seq++ {
+		if seq > 0 {
+			select {
+			case <-time.After(time.Until(lastStart.Add(ps.interval))):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		lastStart = time.Now()
+		pingTime, pingRemote, err := ping(ctx, nc, ps.target, netceptor.MaxForwardingHops, ps.timeout)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		frame := map[string]interface{}{
+			"Seq":     seq,
+			"Success": err == nil,
+			"From":    pingRemote,
+			"Time":    pingTime,
+			"TimeStr": fmt.Sprintf("%s", pingTime),
+		}
+		if err == nil {
+			times = append(times, pingTime)
+		} else {
+			frame["Error"] = err.Error()
+		}
+		select {
+		case frames <- frame:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	cfr := map[string]interface{}{
+		"Target":   ps.target,
+		"Sent":     ps.count,
+		"Received": len(times),
+		"Loss":     100 * float64(ps.count-len(times)) / float64(ps.count),
+		"Success":  len(times) > 0,
+	}
+	if len(times) == 0 {
+		cfr["Error"] = fmt.Sprintf("no replies from %s", ps.target)
+		return cfr, nil
+	}
+	minTime, avgTime, maxTime, stdDev := summarizeRTTs(times)
+	cfr["MinTime"] = minTime
+	cfr["MinTimeStr"] = fmt.Sprintf("%s", minTime)
+	cfr["AvgTime"] = avgTime
+	cfr["AvgTimeStr"] = fmt.Sprintf("%s", avgTime)
+	cfr["MaxTime"] = maxTime
+	cfr["MaxTimeStr"] = fmt.Sprintf("%s", maxTime)
+	cfr["StdDevTime"] = stdDev
+	cfr["StdDevTimeStr"] = fmt.Sprintf("%s", stdDev)
+	return cfr, nil
+}
+
+func (c *pingStatsCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	return CollectFrames(&pingStreamCommand{series: c.series}, nc, cfo)
+}
+
+func (c *pingStreamCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	return CollectFrames(c, nc, cfo)
+}
+
+// StreamFunc sends a frame with the result of each probe, then returns the statistics
+func (c *pingStreamCommand) StreamFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations,
+	frames chan<- map[string]interface{}) (map[string]interface{}, error) {
+	return c.series.run(commandContext(cfo), nc, frames)
+}
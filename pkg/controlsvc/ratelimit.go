@@ -0,0 +1,108 @@
+package controlsvc
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// errRateLimited is returned to clients that send commands faster than the rate limit allows
+var errRateLimited = fmt.Errorf("rate limited")
+
+// rateLimitPolicy is how fast each control session may send commands
+type rateLimitPolicy struct {
+	// rate is the number of commands per second a session may send, or 0 for no limit
+	rate float64
+	// burst is the number of commands a session may send at once after being idle
+	burst int
+	// delay holds commands over the limit until they are allowed, rather than rejecting them
+	delay bool
+}
+
+// tokenBucket is a token bucket rate limiter.  It is used by a single session, so is not locked.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full token bucket
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// take removes a token from the bucket.  If the bucket is empty, it returns false along with how
+// long it will be until a token is available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// SetRateLimit limits how many commands per second each control session may send.  Each session
+// has its own limit, so one busy client does not throttle the others.  If burst is 0, it defaults
+// to the rate rounded up.  Commands over the limit are rejected, or if delay is set, held until
+// they are allowed.  A rate of 0 removes the limit.  The limit applies to sessions that start
+// afterwards.
+func (s *Server) SetRateLimit(commandsPerSecond float64, burst int, delay bool) error {
+	if commandsPerSecond < 0 {
+		return fmt.Errorf("command rate limit must not be negative")
+	}
+	if burst < 0 {
+		return fmt.Errorf("command burst size must not be negative")
+	}
+	if burst == 0 {
+		burst = int(math.Max(1, math.Ceil(commandsPerSecond)))
+	}
+	s.controlFuncLock.Lock()
+	defer s.controlFuncLock.Unlock()
+	s.rateLimit = rateLimitPolicy{
+		rate:  commandsPerSecond,
+		burst: burst,
+		delay: delay,
+	}
+	return nil
+}
+
+// newSessionLimiter returns a token bucket for a new session, or nil if there is no rate limit
+func (s *Server) newSessionLimiter() (*tokenBucket, bool) {
+	s.controlFuncLock.RLock()
+	policy := s.rateLimit
+	s.controlFuncLock.RUnlock()
+	if policy.rate == 0 {
+		return nil, false
+	}
+	return newTokenBucket(policy.rate, policy.burst, time.Now()), policy.delay
+}
+
+// waitForRateLimit takes a token from a session's limiter, returning errRateLimited if there are
+// none left, or if delay is set, waiting for one.  A nil limiter permits every command.
+func waitForRateLimit(limiter *tokenBucket, delay bool, done <-chan struct{}) error {
+	if limiter == nil {
+		return nil
+	}
+	for {
+		ok, wait := limiter.take(time.Now())
+		if ok {
+			return nil
+		}
+		if !delay {
+			return errRateLimited
+		}
+		select {
+		case <-done:
+			return errRateLimited
+		case <-time.After(wait):
+		}
+	}
+}
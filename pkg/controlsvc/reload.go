@@ -0,0 +1,53 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+)
+
+type reloadCommandType struct{}
+type reloadCommand struct{}
+
+func (t *reloadCommandType) Description() string {
+	return "Reload the TLS certificates of this node from disk"
+}
+
+func (t *reloadCommandType) InitFromString(params string) (ControlCommand, error) {
+	if strings.ToLower(strings.TrimSpace(params)) != "tls" {
+		return nil, fmt.Errorf("reload requires the subcommand tls")
+	}
+	return &reloadCommand{}, nil
+}
+
+func (t *reloadCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"].(string)
+	if !ok || strings.ToLower(subCmd) != "tls" {
+		return nil, fmt.Errorf("reload requires the subcommand tls")
+	}
+	return &reloadCommand{}, nil
+}
+
+// Mutates returns true, because reloading replaces the TLS certificates
+func (c *reloadCommand) Mutates() bool {
+	return true
+}
+
+func (c *reloadCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	reloaded, err := nc.ReloadTLSConfigs()
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]interface{}, 0, len(reloaded))
+	for _, rc := range reloaded {
+		configs = append(configs, map[string]interface{}{
+			"Name":         rc.Name,
+			"Kind":         rc.Kind,
+			"Fingerprints": rc.Fingerprints,
+		})
+	}
+	cfr := make(map[string]interface{})
+	cfr["Success"] = true
+	cfr["TLSConfigs"] = configs
+	return cfr, nil
+}
@@ -0,0 +1,193 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type routeCommandType struct{}
+type routeCommand struct {
+	subcommand string
+	change     string
+	node1      string
+	node2      string
+	cost       float64
+	interval   time.Duration
+}
+
+func (t *routeCommandType) Description() string {
+	return "Inspect and adjust the routing table of this node"
+}
+
+func (t *routeCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no route subcommand")
+	}
+	c := &routeCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	switch c.subcommand {
+	case "preview":
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("route preview requires a change type of cost or static")
+		}
+		c.change = strings.ToLower(tokens[1])
+		switch c.change {
+		case "cost":
+			if len(tokens) != 5 {
+				return nil, fmt.Errorf("route preview cost requires two node IDs and a cost")
+			}
+			cost, err := strconv.ParseFloat(tokens[4], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cost %s", tokens[4])
+			}
+			c.cost = cost
+		case "static":
+			if len(tokens) != 4 {
+				return nil, fmt.Errorf("route preview static requires a destination and a next hop")
+			}
+		default:
+			return nil, fmt.Errorf("unknown route change type %s", c.change)
+		}
+		c.node1 = tokens[2]
+		c.node2 = tokens[3]
+	case "interval":
+		if len(tokens) > 2 {
+			return nil, fmt.Errorf("route interval takes at most one parameter, the new interval")
+		}
+		if len(tokens) == 2 {
+			interval, err := time.ParseDuration(tokens[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid interval %s", tokens[1])
+			}
+			c.interval = interval
+		}
+	case "table":
+		if len(tokens) > 1 {
+			return nil, fmt.Errorf("route table does not take parameters")
+		}
+	default:
+		return nil, fmt.Errorf("unknown route subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (t *routeCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no route subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("route subcommand must be string")
+	}
+	c := &routeCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	switch c.subcommand {
+	case "preview":
+		change, ok := config["change"].(string)
+		if !ok {
+			return nil, fmt.Errorf("route preview requires a change type of cost or static")
+		}
+		c.change = strings.ToLower(change)
+		var key1, key2 string
+		switch c.change {
+		case "cost":
+			key1, key2 = "node1", "node2"
+			cost, ok := config["cost"].(float64)
+			if !ok {
+				return nil, fmt.Errorf("route preview cost requires a numeric cost")
+			}
+			c.cost = cost
+		case "static":
+			key1, key2 = "destination", "nexthop"
+		default:
+			return nil, fmt.Errorf("unknown route change type %s", c.change)
+		}
+		c.node1, ok = config[key1].(string)
+		if !ok {
+			return nil, fmt.Errorf("route preview %s requires string parameter %s", c.change, key1)
+		}
+		c.node2, ok = config[key2].(string)
+		if !ok {
+			return nil, fmt.Errorf("route preview %s requires string parameter %s", c.change, key2)
+		}
+	case "interval":
+		intervalIf, ok := config["interval"]
+		if ok {
+			intervalStr, ok := intervalIf.(string)
+			if !ok {
+				return nil, fmt.Errorf("interval must be a string")
+			}
+			interval, err := time.ParseDuration(intervalStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid interval %s", intervalStr)
+			}
+			c.interval = interval
+		}
+	case "table":
+	default:
+		return nil, fmt.Errorf("unknown route subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+// Mutates returns true when the route update interval is being changed
+func (c *routeCommand) Mutates() bool {
+	return c.subcommand == "interval" && c.interval != 0
+}
+
+func (c *routeCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	if c.subcommand == "interval" {
+		if c.interval != 0 {
+			err := nc.SetRouteUpdateInterval(c.interval)
+			if err != nil {
+				cfr["Success"] = false
+				cfr["Error"] = err.Error()
+				return cfr, nil
+			}
+		}
+		interval := nc.RouteUpdateInterval()
+		cfr["Success"] = true
+		cfr["Interval"] = interval
+		cfr["IntervalStr"] = interval.String()
+		return cfr, nil
+	}
+	if c.subcommand == "table" {
+		snapshot := nc.RoutingSnapshot()
+		cfr["Success"] = true
+		cfr["NodeID"] = snapshot.NodeID
+		cfr["Routes"] = snapshot.Routes
+		cfr["Links"] = snapshot.Links
+		return cfr, nil
+	}
+	var preview []*netceptor.RoutePreviewEntry
+	var err error
+	switch c.change {
+	case "cost":
+		preview, err = nc.PreviewCostChange(c.node1, c.node2, c.cost)
+	case "static":
+		preview, err = nc.PreviewStaticRoute(c.node1, c.node2)
+	}
+	if err != nil {
+		cfr["Success"] = false
+		cfr["Error"] = err.Error()
+		return cfr, nil
+	}
+	changes := make(map[string]interface{})
+	for _, entry := range preview {
+		changes[entry.Destination] = map[string]interface{}{
+			"CurrentNextHop":  entry.CurrentNextHop,
+			"ProposedNextHop": entry.ProposedNextHop,
+		}
+	}
+	cfr["Success"] = true
+	cfr["Changes"] = changes
+	return cfr, nil
+}
@@ -0,0 +1,85 @@
+package controlsvc
+
+import (
+	"context"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strconv"
+	"strings"
+)
+
+type routingUpdatesCommandType struct{}
+type routingUpdatesCommand struct {
+	count int
+}
+
+func (t *routingUpdatesCommandType) Description() string {
+	return "Stream changes to the routing table of this node, optionally stopping after a number of them"
+}
+
+func (t *routingUpdatesCommandType) InitFromString(params string) (ControlCommand, error) {
+	c := &routingUpdatesCommand{}
+	params = strings.TrimSpace(params)
+	if params != "" {
+		count, err := strconv.Atoi(params)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("routing-updates takes an optional number of updates")
+		}
+		c.count = count
+	}
+	return c, nil
+}
+
+func (t *routingUpdatesCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	c := &routingUpdatesCommand{}
+	countIf, ok := config["count"]
+	if ok {
+		count, ok := countIf.(float64)
+		if !ok || count < 0 || count != float64(int(count)) {
+			return nil, fmt.Errorf("count must be a non-negative integer")
+		}
+		c.count = int(count)
+	}
+	return c, nil
+}
+
+func (c *routingUpdatesCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	if c.count == 0 {
+		return nil, fmt.Errorf("routing-updates without a count can only be streamed")
+	}
+	return CollectFrames(c, nc, cfo)
+}
+
+// StreamFunc sends a frame for each route change, starting with the routes that currently exist
+func (c *routingUpdatesCommand) StreamFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations,
+	frames chan<- map[string]interface{}) (map[string]interface{}, error) {
+	// The subscription must end with the command, not just with the session
+	ctx, cancel := context.WithCancel(commandContext(cfo))
+	defer cancel()
+	events := nc.SubscribeRoutes(ctx)
+	sent := 0
+	for c.count == 0 || sent < c.count {
+		ev, ok := <-events
+		if !ok {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("node is shutting down")
+		}
+		frame := map[string]interface{}{
+			"Type":    ev.Type,
+			"Node":    ev.Node,
+			"NextHop": ev.NextHop,
+			"Cost":    ev.Cost,
+		}
+		select {
+		case frames <- frame:
+			sent++
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	cfr := make(map[string]interface{})
+	cfr["Updates"] = sent
+	return cfr, nil
+}
@@ -0,0 +1,278 @@
+package controlsvc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ScriptListener is the listener name of the sessions that run control command scripts, as seen
+// by authorizers and the audit log
+const ScriptListener = "script"
+
+// ScriptResult is the outcome of one command of a control command script
+type ScriptResult struct {
+	// Line is the line number of the command in the script
+	Line int
+	// Command is the command as written in the script
+	Command string
+	// Result is the response to the command, if there was one
+	Result map[string]interface{}
+	// Err is the error of the command, if it failed
+	Err error
+}
+
+// scriptLine is a command read from a script
+type scriptLine struct {
+	line    int
+	command string
+}
+
+// parseScript reads the commands of a script, one per line.  Blank lines and lines starting with
+// # are skipped.
+func parseScript(r io.Reader, maxLineLength int) ([]scriptLine, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineLength+1)
+	commands := make([]scriptLine, 0)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		command := strings.TrimSpace(scanner.Text())
+		if command == "" || strings.HasPrefix(command, "#") {
+			continue
+		}
+		if len(command) > maxLineLength {
+			return nil, fmt.Errorf("line %d is longer than the maximum of %d bytes", lineNum, maxLineLength)
+		}
+		commands = append(commands, scriptLine{line: lineNum, command: command})
+	}
+	err := scanner.Err()
+	if err == bufio.ErrTooLong {
+		return nil, fmt.Errorf("line %d is longer than the maximum of %d bytes", lineNum+1, maxLineLength)
+	} else if err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// scriptSession is a framed control session on an internal connection, which runs the commands of
+// a script
+type scriptSession struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// openScriptSession starts a control session on an internal connection and switches it to framing
+func (s *Server) openScriptSession(timeout time.Duration) (*scriptSession, error) {
+	client, server := net.Pipe()
+	go s.runControlSession(server, ScriptListener, nil)
+	// Frames are read through the line reader, which returns anything it read past the handshake
+	lines := newLineReader(client, DefaultMaxLineLength)
+	ss := &scriptSession{
+		conn:    lines,
+		timeout: timeout,
+	}
+	ss.setDeadline()
+	_, err := lines.readLine()
+	if err == nil {
+		_, err = client.Write([]byte(FramedHandshake + "\n"))
+	}
+	var line string
+	if err == nil {
+		line, err = lines.readLine()
+	}
+	if err == nil && strings.TrimSpace(line) != FramedHandshake {
+		err = fmt.Errorf("unexpected handshake response %q", line)
+	}
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("could not start control session: %s", err)
+	}
+	return ss, nil
+}
+
+// setDeadline limits how long the next exchange with the server can take
+func (ss *scriptSession) setDeadline() {
+	if ss.timeout > 0 {
+		_ = ss.conn.SetDeadline(time.Now().Add(ss.timeout))
+	}
+}
+
+// readFrame returns the payload of the next frame from the server
+func (ss *scriptSession) readFrame() ([]byte, error) {
+	var header [frameHeaderLength]byte
+	_, err := io.ReadFull(ss.conn, header[:])
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[:]))
+	_, err = io.ReadFull(ss.conn, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// parseScriptResponse decodes a JSON response, returning false if the frame is not one, which
+// means it is a message from a command that has taken over the connection
+func parseScriptResponse(payload []byte) (map[string]interface{}, bool) {
+	if len(payload) == 0 || payload[0] != '{' {
+		return nil, false
+	}
+	cfr := make(map[string]interface{})
+	err := json.Unmarshal(payload, &cfr)
+	if err != nil {
+		return nil, false
+	}
+	return cfr, true
+}
+
+// run sends a command and returns its response.  A command that asks for input, such as work
+// submit with chunked payloads, is sent the end of its input, so it gets none.
+func (ss *scriptSession) run(command string) (map[string]interface{}, error) {
+	ss.setDeadline()
+	_, err := ss.conn.Write(appendFrame(nil, []byte(command)))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := ss.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	cfr, ok := parseScriptResponse(payload)
+	if !ok {
+		_, err = ss.conn.Write(appendFrame(nil, nil))
+		if err != nil {
+			return nil, err
+		}
+		payload, err = ss.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		cfr, ok = parseScriptResponse(payload)
+		if !ok {
+			return nil, fmt.Errorf("command did not send a JSON response: %s", strings.TrimSpace(string(payload)))
+		}
+	}
+	success, ok := cfr["Success"].(bool)
+	if ok && !success {
+		errStr, _ := cfr["Error"].(string)
+		return cfr, fmt.Errorf("%s", errStr)
+	}
+	return cfr, nil
+}
+
+// close ends the session
+func (ss *scriptSession) close() {
+	_ = ss.conn.Close()
+}
+
+// RunScript runs control commands read from a script, one per line, in order.  Commands are sent
+// as text or JSON, as they would be by a client, on an internal connection to the server, so they
+// go through the same authorization, auditing and statistics as other commands, on the listener
+// named ScriptListener.  Blank lines and lines starting with # are skipped.  Commands that read
+// input, such as work submit with payloadmode chunked, get no input.  Other commands that take
+// over the connection, such as connect, are not supported.  Each command may take up to the
+// timeout to respond, or forever if it is zero.  If stopOnError is set, the script stops at the
+// first command that fails, and its error is returned.  The result of each command is logged.
+func (s *Server) RunScript(ctx context.Context, r io.Reader, stopOnError bool, timeout time.Duration) ([]*ScriptResult, error) {
+	commands, err := parseScript(r, int(atomic.LoadInt32(&s.maxLineLength)))
+	if err != nil {
+		return nil, err
+	}
+	return s.runScript(ctx, commands, stopOnError, timeout)
+}
+
+// runScript runs the parsed commands of a script
+func (s *Server) runScript(ctx context.Context, commands []scriptLine, stopOnError bool, timeout time.Duration) ([]*ScriptResult, error) {
+	results := make([]*ScriptResult, 0, len(commands))
+	var ss *scriptSession
+	defer func() {
+		if ss != nil {
+			ss.close()
+		}
+	}()
+	for _, sl := range commands {
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		result := &ScriptResult{
+			Line:    sl.line,
+			Command: sl.command,
+		}
+		results = append(results, result)
+		if ss == nil {
+			ss, result.Err = s.openScriptSession(timeout)
+		}
+		if ss != nil {
+			result.Result, result.Err = ss.run(sl.command)
+			if result.Err != nil && result.Result == nil {
+				// The connection failed rather than the command, so start again with a new session
+				ss.close()
+				ss = nil
+			}
+		}
+		if result.Err != nil {
+			sublogger.Error("Script command on line %d failed: %s: %s\n", sl.line, sl.command, result.Err)
+			if stopOnError {
+				return results, fmt.Errorf("command on line %d failed: %s", sl.line, result.Err)
+			}
+			continue
+		}
+		resultJSON, _ := json.Marshal(result.Result)
+		sublogger.Info("Script command on line %d succeeded: %s: %s\n", sl.line, sl.command, resultJSON)
+	}
+	return results, nil
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// CmdlineConfigScript is the cmdline configuration object for a script of control commands run at
+// startup
+type CmdlineConfigScript struct {
+	Filename    string `required:"true" description:"File of control commands to run, one per line. Blank lines and lines starting with # are skipped."`
+	StopOnError bool   `description:"Treat a failing command as fatal, stopping the script and shutting down the node" default:"false"`
+	Timeout     int    `description:"Seconds to wait for the response to each command (0 for no limit)" default:"60"`
+}
+
+// Run runs the action.  The script is read now, so that a missing or invalid file stops the node
+// from starting, but runs in the background, once the configuration before it has run.
+func (cfg CmdlineConfigScript) Run() error {
+	data, err := ioutil.ReadFile(cfg.Filename)
+	if err != nil {
+		return err
+	}
+	server := MainInstance
+	commands, err := parseScript(bytes.NewReader(data), int(atomic.LoadInt32(&server.maxLineLength)))
+	if err != nil {
+		return fmt.Errorf("error in control script %s: %s", cfg.Filename, err)
+	}
+	go func() {
+		sublogger.Info("Running %d commands from control script %s\n", len(commands), cfg.Filename)
+		_, err := server.runScript(netceptor.MainInstance.Context(), commands, cfg.StopOnError,
+			time.Duration(cfg.Timeout)*time.Second)
+		if err != nil && cfg.StopOnError && netceptor.MainInstance.Context().Err() == nil {
+			sublogger.Error("Control script %s failed: %s\n", cfg.Filename, err)
+			server.shutdown(false, 0)
+		}
+	}()
+	return nil
+}
+
+func init() {
+	cmdline.AddConfigType("control-script", "Run a script of control commands at startup, after the configuration before it",
+		CmdlineConfigScript{}, false, false, false, false, nil)
+}
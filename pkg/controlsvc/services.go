@@ -0,0 +1,85 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+	"time"
+)
+
+// defaultServicesTimeout is how long services remote waits for a reply, unless the command is
+// cancelled first
+const defaultServicesTimeout = 10 * time.Second
+
+type servicesCommandType struct{}
+type servicesCommand struct {
+	subcommand string
+	node       string
+}
+
+func (t *servicesCommandType) Description() string {
+	return "List the services advertised on the network or by a remote node"
+}
+
+func (t *servicesCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no services subcommand")
+	}
+	c := &servicesCommand{
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	switch c.subcommand {
+	case "remote":
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("services remote requires a node ID")
+		}
+		c.node = tokens[1]
+	default:
+		return nil, fmt.Errorf("unknown services subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (t *servicesCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no services subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("services subcommand must be string")
+	}
+	c := &servicesCommand{
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	switch c.subcommand {
+	case "remote":
+		node, ok := config["node"]
+		if !ok {
+			return nil, fmt.Errorf("services remote requires a node ID")
+		}
+		nodeStr, ok := node.(string)
+		if !ok {
+			return nil, fmt.Errorf("services node must be string")
+		}
+		c.node = nodeStr
+	default:
+		return nil, fmt.Errorf("unknown services subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (c *servicesCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	services, err := nc.QueryRemoteServices(commandContext(cfo), c.node, defaultServicesTimeout)
+	cfr["Node"] = c.node
+	if err == nil {
+		cfr["Success"] = true
+		cfr["Services"] = services
+	} else {
+		cfr["Success"] = false
+		cfr["Error"] = err.Error()
+	}
+	return cfr, nil
+}
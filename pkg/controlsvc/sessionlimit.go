@@ -0,0 +1,95 @@
+package controlsvc
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// errTooManySessions is sent to clients rejected because the session limit has been reached
+var errTooManySessions = fmt.Errorf("too many connections")
+
+// sessionSlots limits the number of concurrent sessions accepted from listeners
+type sessionSlots struct {
+	lock   *sync.Mutex
+	limit  int
+	queue  bool
+	active int
+	freed  chan struct{} // Closed, and replaced, whenever a slot may have become free
+}
+
+// newSessionSlots allocates a new sessionSlots with no limit
+func newSessionSlots() *sessionSlots {
+	return &sessionSlots{
+		lock:  &sync.Mutex{},
+		freed: make(chan struct{}),
+	}
+}
+
+// notify wakes up anything waiting for a slot.  The lock must be held.
+func (ss *sessionSlots) notify() {
+	close(ss.freed)
+	ss.freed = make(chan struct{})
+}
+
+// setLimit changes the limit.  Sessions already running are not affected.
+func (ss *sessionSlots) setLimit(limit int, queue bool) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.limit = limit
+	ss.queue = queue
+	ss.notify()
+}
+
+// acquire takes a slot for a new session, returning false if there is none.  If queueing is
+// enabled, it waits for a slot instead, until done is closed.
+func (ss *sessionSlots) acquire(done <-chan struct{}) bool {
+	for {
+		ss.lock.Lock()
+		if ss.limit == 0 || ss.active < ss.limit {
+			ss.active++
+			ss.lock.Unlock()
+			return true
+		}
+		if !ss.queue {
+			ss.lock.Unlock()
+			return false
+		}
+		freed := ss.freed
+		ss.lock.Unlock()
+		select {
+		case <-freed:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// release frees the slot of a session that has ended
+func (ss *sessionSlots) release() {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.active--
+	ss.notify()
+}
+
+// SetMaxSessions sets the maximum number of sessions the listeners of the server run at once.  When
+// the limit is reached, new connections are either queued until a session ends, or sent an error
+// and closed.  Zero means no limit.  Sessions run by RunControlSession or RunScript do not count
+// towards the limit.
+func (s *Server) SetMaxSessions(limit int, queue bool) error {
+	if limit < 0 {
+		return fmt.Errorf("maximum sessions must not be negative")
+	}
+	s.sessionSlots.setLimit(limit, queue)
+	return nil
+}
+
+// rejectConnection sends a client the reason it cannot start a session, and closes its connection
+func rejectConnection(conn net.Conn, listener string, reason error) {
+	sublogger.Warning("Rejecting control connection on %s: %s\n", listener, reason)
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write([]byte(fmt.Sprintf("ERROR: %s\n", reason)))
+	_ = conn.Close()
+}
@@ -0,0 +1,127 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sessionsCommandType struct {
+	s *Server
+}
+type sessionsCommand struct {
+	s          *Server
+	subcommand string
+	idle       time.Duration
+	minCost    float64
+}
+
+func (t *sessionsCommandType) Description() string {
+	return "List or close control service and backend sessions of this node"
+}
+
+func (t *sessionsCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no sessions subcommand")
+	}
+	c := &sessionsCommand{
+		s:          t.s,
+		subcommand: strings.ToLower(tokens[0]),
+	}
+	switch c.subcommand {
+	case "list":
+		if len(tokens) != 1 {
+			return nil, fmt.Errorf("sessions list does not take parameters")
+		}
+	case "reap":
+		if len(tokens) != 3 {
+			return nil, fmt.Errorf("sessions reap requires an idle time and a minimum cost")
+		}
+		idle, err := time.ParseDuration(tokens[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid idle time %s", tokens[1])
+		}
+		c.idle = idle
+		minCost, err := strconv.ParseFloat(tokens[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cost %s", tokens[2])
+		}
+		c.minCost = minCost
+	default:
+		return nil, fmt.Errorf("unknown sessions subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+func (t *sessionsCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"]
+	if !ok {
+		return nil, fmt.Errorf("no sessions subcommand")
+	}
+	subCmdStr, ok := subCmd.(string)
+	if !ok {
+		return nil, fmt.Errorf("sessions subcommand must be string")
+	}
+	c := &sessionsCommand{
+		s:          t.s,
+		subcommand: strings.ToLower(subCmdStr),
+	}
+	switch c.subcommand {
+	case "list":
+	case "reap":
+		idleStr, ok := config["idle"].(string)
+		if !ok {
+			return nil, fmt.Errorf("sessions reap requires string parameter idle")
+		}
+		idle, err := time.ParseDuration(idleStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idle time %s", idleStr)
+		}
+		c.idle = idle
+		c.minCost, ok = config["mincost"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("sessions reap requires numeric parameter mincost")
+		}
+	default:
+		return nil, fmt.Errorf("unknown sessions subcommand %s", c.subcommand)
+	}
+	return c, nil
+}
+
+// Mutates returns true when idle sessions are being reaped
+func (c *sessionsCommand) Mutates() bool {
+	return c.subcommand == "reap"
+}
+
+func (c *sessionsCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	if c.subcommand == "list" {
+		sessions := make(map[string]interface{})
+		for _, cs := range c.s.ControlSessions() {
+			sessions[strconv.Itoa(cs.ID)] = cs
+		}
+		cfr["Sessions"] = sessions
+		return cfr, nil
+	}
+	reaped, err := nc.ReapIdleSessions(c.idle, c.minCost)
+	if err != nil {
+		cfr["Success"] = false
+		cfr["Error"] = err.Error()
+		return cfr, nil
+	}
+	sessions := make(map[string]interface{})
+	for _, rs := range reaped {
+		sessions[rs.NodeID] = map[string]interface{}{
+			"Backend": rs.Backend,
+			"Cost":    rs.Cost,
+			"Idle":    rs.Idle,
+			"IdleStr": fmt.Sprintf("%s", rs.Idle),
+		}
+	}
+	cfr["Success"] = true
+	cfr["Reaped"] = sessions
+	return cfr, nil
+}
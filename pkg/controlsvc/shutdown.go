@@ -0,0 +1,144 @@
+package controlsvc
+
+import (
+	"context"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDrainTimeout is how long a draining shutdown waits for in-flight work before force-closing
+const DefaultDrainTimeout = 5 * time.Minute
+
+// ShutdownDrainer waits for a subsystem's in-flight work to finish before the node shuts down.  It
+// should give up and return an error when the context is done.
+type ShutdownDrainer func(ctx context.Context) error
+
+// namedDrainer is a shutdown drainer and the subsystem that contributed it
+type namedDrainer struct {
+	name    string
+	drainer ShutdownDrainer
+}
+
+// AddShutdownDrainer registers a function that a draining shutdown waits on before shutting down
+func (s *Server) AddShutdownDrainer(name string, drainer ShutdownDrainer) {
+	s.controlFuncLock.Lock()
+	defer s.controlFuncLock.Unlock()
+	s.drainers = append(s.drainers, namedDrainer{
+		name:    name,
+		drainer: drainer,
+	})
+}
+
+// SetShutdownFunc sets the function the shutdown command calls to stop the node, which is usually
+// the cancel function of the root context shared by the node's subsystems.  If none is set, the
+// shutdown command shuts down the Netceptor instance.
+func (s *Server) SetShutdownFunc(shutdown func()) {
+	s.controlFuncLock.Lock()
+	defer s.controlFuncLock.Unlock()
+	s.shutdownFunc = shutdown
+}
+
+// shutdown optionally drains in-flight work, then stops the node
+func (s *Server) shutdown(drain bool, timeout time.Duration) {
+	s.controlFuncLock.RLock()
+	drainers := make([]namedDrainer, len(s.drainers))
+	copy(drainers, s.drainers)
+	shutdownFunc := s.shutdownFunc
+	s.controlFuncLock.RUnlock()
+	if drain {
+		sublogger.Info("Draining in-flight work before shutdown, for up to %s\n", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		for _, nd := range drainers {
+			err := nd.drainer(ctx)
+			if err != nil {
+				sublogger.Warning("Could not drain %s, shutting down anyway: %s\n", nd.name, err)
+			}
+		}
+		cancel()
+	}
+	sublogger.Info("Shutting down at the request of the control service\n")
+	if shutdownFunc != nil {
+		shutdownFunc()
+	} else {
+		s.nc.Shutdown()
+	}
+}
+
+type shutdownCommandType struct {
+	s *Server
+}
+type shutdownCommand struct {
+	s       *Server
+	drain   bool
+	timeout time.Duration
+}
+
+func (t *shutdownCommandType) Description() string {
+	return "Shut down this node, optionally waiting for in-flight work to finish first"
+}
+
+func (t *shutdownCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	c := &shutdownCommand{
+		s:       t.s,
+		timeout: DefaultDrainTimeout,
+	}
+	if len(tokens) > 0 {
+		if strings.ToLower(tokens[0]) != "drain" || len(tokens) > 2 {
+			return nil, fmt.Errorf("shutdown takes an optional drain keyword, followed by an optional timeout")
+		}
+		c.drain = true
+	}
+	if len(tokens) > 1 {
+		var err error
+		c.timeout, err = parseTimeout(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (t *shutdownCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	c := &shutdownCommand{
+		s:       t.s,
+		timeout: DefaultDrainTimeout,
+	}
+	drainIf, ok := config["drain"]
+	if ok {
+		c.drain, ok = drainIf.(bool)
+		if !ok {
+			return nil, fmt.Errorf("drain must be a boolean")
+		}
+	}
+	timeout, ok := config["timeout"]
+	if ok {
+		var err error
+		c.timeout, err = parseTimeout(timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *shutdownCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	if !atomic.CompareAndSwapInt32(&c.s.shuttingDown, 0, 1) {
+		return nil, fmt.Errorf("shutdown is already in progress")
+	}
+	// Shut down once the confirmation has been sent, so the client is not left without a response
+	cfo.AfterResponse(func() {
+		c.s.shutdown(c.drain, c.timeout)
+	})
+	cfr := make(map[string]interface{})
+	cfr["Success"] = true
+	cfr["Node"] = nc.NodeID()
+	cfr["Drain"] = c.drain
+	if c.drain {
+		cfr["Timeout"] = c.timeout.String()
+	}
+	return cfr, nil
+}
@@ -0,0 +1,209 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+	"sync"
+)
+
+// CommandStats holds the usage counters of a single control command
+type CommandStats struct {
+	Invocations uint64
+	Errors      uint64
+}
+
+// commandStatsRegistry accumulates per-command usage counters
+type commandStatsRegistry struct {
+	lock  *sync.RWMutex
+	stats map[string]*CommandStats
+}
+
+// newCommandStatsRegistry allocates a new, empty commandStatsRegistry
+func newCommandStatsRegistry() *commandStatsRegistry {
+	return &commandStatsRegistry{
+		lock:  &sync.RWMutex{},
+		stats: make(map[string]*CommandStats),
+	}
+}
+
+// count records an invocation of a command
+func (cr *commandStatsRegistry) count(command string, failed bool) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cs, ok := cr.stats[command]
+	if !ok {
+		cs = &CommandStats{}
+		cr.stats[command] = cs
+	}
+	cs.Invocations++
+	if failed {
+		cs.Errors++
+	}
+}
+
+// snapshot returns a copy of the counters of all commands that have been used
+func (cr *commandStatsRegistry) snapshot() map[string]CommandStats {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	stats := make(map[string]CommandStats)
+	for command, cs := range cr.stats {
+		stats[command] = *cs
+	}
+	return stats
+}
+
+// reset zeroes the counters of a command, or of all commands if the name is blank
+func (cr *commandStatsRegistry) reset(command string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if command == "" {
+		cr.stats = make(map[string]*CommandStats)
+	} else {
+		delete(cr.stats, command)
+	}
+}
+
+// CommandStats returns the usage counters of all commands used since the counters were last reset
+func (s *Server) CommandStats() map[string]CommandStats {
+	return s.commandStats.snapshot()
+}
+
+// ResetCommandStats zeroes the usage counters of the named command, or of all commands if the name is blank
+func (s *Server) ResetCommandStats(command string) error {
+	if command != "" {
+		s.controlFuncLock.RLock()
+		_, ok := s.controlTypes[command]
+		s.controlFuncLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown command %s", command)
+		}
+	}
+	s.commandStats.reset(command)
+	s.latency.reset(command)
+	return nil
+}
+
+type statsCommandType struct {
+	s *Server
+}
+type statsCommand struct {
+	s          *Server
+	subcommand string
+	scope      string
+	name       string
+}
+
+// parseStatsParams validates the parameters of a stats command
+func (c *statsCommand) parseStatsParams(params []string) error {
+	switch c.subcommand {
+	case "show", "latency":
+		if len(params) > 0 {
+			return fmt.Errorf("stats %s does not take parameters", c.subcommand)
+		}
+	case "reset":
+		if len(params) == 0 {
+			return nil
+		}
+		if len(params) != 2 {
+			return fmt.Errorf("stats reset takes either no parameters, or backend or command and a name")
+		}
+		c.scope = strings.ToLower(params[0])
+		if c.scope != "backend" && c.scope != "command" {
+			return fmt.Errorf("stats reset scope must be backend or command")
+		}
+		c.name = params[1]
+	default:
+		return fmt.Errorf("unknown stats subcommand %s", c.subcommand)
+	}
+	return nil
+}
+
+func (t *statsCommandType) Description() string {
+	return "Show or reset traffic and command statistics of this node"
+}
+
+func (t *statsCommandType) InitFromString(params string) (ControlCommand, error) {
+	tokens := strings.Fields(params)
+	c := &statsCommand{
+		s:          t.s,
+		subcommand: "show",
+	}
+	if len(tokens) > 0 {
+		c.subcommand = strings.ToLower(tokens[0])
+		tokens = tokens[1:]
+	}
+	err := c.parseStatsParams(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *statsCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	c := &statsCommand{
+		s:          t.s,
+		subcommand: "show",
+	}
+	subCmd, ok := config["subcommand"]
+	if ok {
+		subCmdStr, ok := subCmd.(string)
+		if !ok {
+			return nil, fmt.Errorf("stats subcommand must be string")
+		}
+		c.subcommand = strings.ToLower(subCmdStr)
+	}
+	params := make([]string, 0)
+	for _, key := range []string{"backend", "command"} {
+		value, ok := config[key]
+		if !ok {
+			continue
+		}
+		valueStr, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("stats %s must be string", key)
+		}
+		if len(params) > 0 {
+			return nil, fmt.Errorf("stats reset cannot be scoped to both a backend and a command")
+		}
+		params = append(params, key, valueStr)
+	}
+	err := c.parseStatsParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *statsCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	switch c.subcommand {
+	case "show":
+		backends := make(map[string]interface{})
+		for _, bs := range nc.BackendStats() {
+			backends[bs.Name] = bs
+		}
+		cfr["Backends"] = backends
+		cfr["Commands"] = c.s.CommandStats()
+		cfr["RelayDropped"] = nc.RelayDropped()
+	case "latency":
+		cfr["Window"] = LatencyWindow
+		cfr["WindowStr"] = LatencyWindow.String()
+		cfr["Commands"] = c.s.CommandLatencies()
+	case "reset":
+		var err error
+		if c.scope == "" || c.scope == "backend" {
+			err = nc.ResetBackendStats(c.name)
+		}
+		if err == nil && (c.scope == "" || c.scope == "command") {
+			err = c.s.ResetCommandStats(c.name)
+		}
+		if err != nil {
+			cfr["Success"] = false
+			cfr["Error"] = err.Error()
+		} else {
+			cfr["Success"] = true
+		}
+	}
+	return cfr, nil
+}
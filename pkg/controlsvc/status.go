@@ -8,6 +8,10 @@ import (
 type statusCommandType struct{}
 type statusCommand struct{}
 
+func (t *statusCommandType) Description() string {
+	return "Show the status of this node and the network"
+}
+
 func (t *statusCommandType) InitFromString(params string) (ControlCommand, error) {
 	if params != "" {
 		return nil, fmt.Errorf("status command does not take parameters")
@@ -29,5 +33,6 @@ func (c *statusCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOper
 	cfr["RoutingTable"] = status.RoutingTable
 	cfr["Advertisements"] = status.Advertisements
 	cfr["KnownConnectionCosts"] = status.KnownConnectionCosts
+	cfr["MaintenanceMode"] = status.MaintenanceMode
 	return cfr, nil
 }
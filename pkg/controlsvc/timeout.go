@@ -0,0 +1,125 @@
+package controlsvc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// TimeoutKey is the JSON request field that overrides the server's command timeout for one command.
+// It is distinct from the timeout fields of individual commands, such as the drain timeout of
+// shutdown or the run time limit of a work unit.
+const TimeoutKey = "commandtimeout"
+
+// errCommandTimedOut is returned to clients whose command ran past its deadline
+var errCommandTimedOut = fmt.Errorf("command timed out")
+
+// parseTimeout parses a timeout given as a duration string such as 30s, or as a number of seconds
+func parseTimeout(timeout interface{}) (time.Duration, error) {
+	var d time.Duration
+	switch t := timeout.(type) {
+	case string:
+		var err error
+		d, err = time.ParseDuration(t)
+		if err != nil {
+			secs, serr := strconv.Atoi(t)
+			if serr != nil {
+				return 0, fmt.Errorf("invalid timeout %s", t)
+			}
+			d = time.Duration(secs) * time.Second
+		}
+	case float64:
+		d = time.Duration(t * float64(time.Second))
+	default:
+		return 0, fmt.Errorf("timeout must be a duration or a number of seconds")
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	return d, nil
+}
+
+// commandTimeoutFromRequest returns the timeout requested for a JSON command, or def if there is none
+func commandTimeoutFromRequest(config map[string]interface{}, def time.Duration) (time.Duration, error) {
+	timeout, ok := config[TimeoutKey]
+	if !ok {
+		return def, nil
+	}
+	return parseTimeout(timeout)
+}
+
+// SetCommandTimeout sets how long a command may run before it is cancelled.  Commands that take
+// over the connection, such as connect, are only bound by the timeout until they take over.  A
+// timeout of 0 lets commands run for as long as they like.
+//
+// Cancelling a command cancels the context returned by ControlFuncOperations.Context, and the
+// client is only sent the timeout error once the command returns.  The commands that stop early
+// are those that wait on that context: ping, including ping series, loss, traceroute,
+// routing-updates, the dial of connect, and work tail while it follows output.  Other commands, which
+// do not block for long, run to completion and then report the timeout.
+func (s *Server) SetCommandTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("command timeout must not be negative")
+	}
+	atomic.StoreInt64(&s.commandTimeout, int64(timeout))
+	return nil
+}
+
+// SetIdleTimeout sets how long a client may wait before sending a command, after connecting or
+// after its last command finished, before its session is closed.  Time spent running a command,
+// including commands that take over the connection, does not count.  A timeout of 0 lets clients
+// stay connected indefinitely.  The timeout applies to sessions from their next command onwards.
+func (s *Server) SetIdleTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative")
+	}
+	atomic.StoreInt64(&s.idleTimeout, int64(timeout))
+	return nil
+}
+
+// commandDeadline tracks the deadline of the command a session is running
+type commandDeadline struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	timedOut int32
+}
+
+// newCommandDeadline returns a deadline that cancels its context after the timeout, or never if
+// the timeout is 0
+func newCommandDeadline(timeout time.Duration) *commandDeadline {
+	cd := &commandDeadline{}
+	cd.ctx, cd.cancel = context.WithCancel(context.Background())
+	if timeout > 0 {
+		cd.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&cd.timedOut, 1)
+			cd.cancel()
+		})
+	}
+	return cd
+}
+
+// disarm stops the deadline from firing, if it has not already
+func (cd *commandDeadline) disarm() {
+	if cd.timer != nil {
+		cd.timer.Stop()
+	}
+}
+
+// end releases the deadline's context, returning true if the deadline passed
+func (cd *commandDeadline) end() bool {
+	cd.disarm()
+	cd.cancel()
+	return atomic.LoadInt32(&cd.timedOut) == 1
+}
+
+// commandContext returns the context of a running command, or a background context for a command
+// run without a control session
+func commandContext(cfo ControlFuncOperations) context.Context {
+	if cfo == nil {
+		return context.Background()
+	}
+	return cfo.Context()
+}
@@ -1,22 +1,75 @@
 package controlsvc
 
 import (
+	"context"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/netceptor"
 	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults and limits for traceroute
+const (
+	defaultTraceProbes     = 1
+	maxTraceProbes         = 100
+	defaultTraceHopTimeout = 5 * time.Second
+	maxTraceHopTimeout     = 60 * time.Second
+	maxSilentHops          = 3 // How many hops in a row may not reply before the trace gives up
 )
 
 type tracerouteCommandType struct{}
 type tracerouteCommand struct {
-	target string
+	target     string
+	count      int
+	hopTimeout time.Duration
+}
+
+func (t *tracerouteCommandType) Description() string {
+	return "Trace the route to a node, measuring the latency of each hop"
+}
+
+// validate checks the probe count and hop timeout of a traceroute
+func (c *tracerouteCommand) validate() error {
+	if c.count < 1 || c.count > maxTraceProbes {
+		return fmt.Errorf("probe count must be between 1 and %d", maxTraceProbes)
+	}
+	if c.hopTimeout > maxTraceHopTimeout {
+		return fmt.Errorf("hop timeout must be at most %s", maxTraceHopTimeout)
+	}
+	return nil
 }
 
 func (t *tracerouteCommandType) InitFromString(params string) (ControlCommand, error) {
-	if params == "" {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
 		return nil, fmt.Errorf("no traceroute target")
 	}
+	if len(tokens) > 3 {
+		return nil, fmt.Errorf("traceroute takes a target, optionally followed by a probe count and a hop timeout")
+	}
 	c := &tracerouteCommand{
-		target: params,
+		target:     tokens[0],
+		count:      defaultTraceProbes,
+		hopTimeout: defaultTraceHopTimeout,
+	}
+	if len(tokens) > 1 {
+		count, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe count %s", tokens[1])
+		}
+		c.count = count
+	}
+	if len(tokens) > 2 {
+		hopTimeout, err := parseTimeout(tokens[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hop timeout: %s", err)
+		}
+		c.hopTimeout = hopTimeout
+	}
+	err := c.validate()
+	if err != nil {
+		return nil, err
 	}
 	return c, nil
 }
@@ -31,26 +84,125 @@ func (t *tracerouteCommandType) InitFromJSON(config map[string]interface{}) (Con
 		return nil, fmt.Errorf("traceroute target must be string")
 	}
 	c := &tracerouteCommand{
-		target: targetStr,
+		target:     targetStr,
+		count:      defaultTraceProbes,
+		hopTimeout: defaultTraceHopTimeout,
+	}
+	countIf, ok := config["count"]
+	if ok {
+		count, ok := countIf.(float64)
+		if !ok {
+			return nil, fmt.Errorf("count must be a number")
+		}
+		c.count = int(count)
+	}
+	hopTimeoutIf, ok := config["hoptimeout"]
+	if ok {
+		hopTimeout, err := parseTimeout(hopTimeoutIf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hop timeout: %s", err)
+		}
+		c.hopTimeout = hopTimeout
+	}
+	err := c.validate()
+	if err != nil {
+		return nil, err
 	}
 	return c, nil
 }
 
+// hopResult is the outcome of the probes sent to one hop of a traceroute
+type hopResult struct {
+	from    string
+	sent    int
+	times   []time.Duration
+	elapsed time.Duration
+	reached bool
+	err     error
+}
+
+// probeHop pings a target count times with a limited number of hops, waiting up to timeout for
+// each reply.  Probes that time out are counted as lost.  Any other error ends the probing.
+func probeHop(ctx context.Context, nc *netceptor.Netceptor, target string, hopsToLive byte,
+	count int, timeout time.Duration) *hopResult {
+	hr := &hopResult{
+		times: make([]time.Duration, 0, count),
+	}
+	for i := 0; i < count; i++ {
+		pingTime, pingRemote, err := ping(ctx, nc, target, hopsToLive, timeout)
+		hr.sent++
+		hr.elapsed = pingTime
+		switch {
+		case err == nil:
+			hr.reached = true
+		case err.Error() == netceptor.ProblemExpiredInTransit:
+		case err == errPingTimeout:
+			continue
+		default:
+			hr.from = pingRemote
+			hr.err = err
+			return hr
+		}
+		hr.from = pingRemote
+		hr.times = append(hr.times, pingTime)
+	}
+	return hr
+}
+
+// resultMap converts a hopResult to a control service response.  Time is the average round trip
+// time of the probes that got a reply.  MTU is the largest message the hop's links carry, which
+// is the same on every link of a Receptor network, so it is only reported for hops that replied.
+func (hr *hopResult) resultMap() map[string]interface{} {
+	result := map[string]interface{}{
+		"From":   hr.from,
+		"Probes": hr.sent,
+		"Lost":   hr.sent - len(hr.times),
+	}
+	if len(hr.times) == 0 {
+		result["Time"] = hr.elapsed
+		result["TimeStr"] = fmt.Sprintf("%s", hr.elapsed)
+		if hr.err != nil {
+			result["Error"] = hr.err.Error()
+		} else {
+			result["Error"] = errPingTimeout.Error()
+		}
+		return result
+	}
+	minTime, avgTime, maxTime, _ := summarizeRTTs(hr.times)
+	result["Time"] = avgTime
+	result["TimeStr"] = fmt.Sprintf("%s", avgTime)
+	result["MinTime"] = minTime
+	result["MinTimeStr"] = fmt.Sprintf("%s", minTime)
+	result["MaxTime"] = maxTime
+	result["MaxTimeStr"] = fmt.Sprintf("%s", maxTime)
+	result["MTU"] = netceptor.MTU
+	if hr.err != nil {
+		result["Error"] = hr.err.Error()
+	}
+	return result
+}
+
+// ControlFunc traces the route hop by hop.  Hops whose probes all time out are reported and
+// skipped, so a node that drops expired messages does not end the trace, but the trace gives up
+// after maxSilentHops of them in a row.
 func (c *tracerouteCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
 	cfr := make(map[string]interface{})
+	ctx := commandContext(cfo)
+	silentHops := 0
 	for i := 0; i <= netceptor.MaxForwardingHops; i++ {
-		thisResult := make(map[string]interface{})
-		pingTime, pingRemote, err := ping(nc, c.target, byte(i))
-		thisResult["From"] = pingRemote
-		thisResult["Time"] = pingTime
-		thisResult["TimeStr"] = fmt.Sprintf("%s", pingTime)
-		if err != nil && err.Error() != netceptor.ProblemExpiredInTransit {
-			thisResult["Error"] = err.Error()
-		}
-		cfr[strconv.Itoa(i)] = thisResult
-		if err == nil || err.Error() != netceptor.ProblemExpiredInTransit {
+		hr := probeHop(ctx, nc, c.target, byte(i), c.count, c.hopTimeout)
+		cfr[strconv.Itoa(i)] = hr.resultMap()
+		if hr.reached || hr.err != nil {
 			break
 		}
+		if len(hr.times) == 0 {
+			silentHops++
+			if silentHops >= maxSilentHops {
+				break
+			}
+		} else {
+			silentHops = 0
+		}
 	}
 	return cfr, nil
 }
@@ -0,0 +1,55 @@
+package controlsvc
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"strings"
+)
+
+type validateCommandType struct{}
+type validateCommand struct{}
+
+func (t *validateCommandType) Description() string {
+	return "Check the configuration of this node and report any problems"
+}
+
+func (t *validateCommandType) InitFromString(params string) (ControlCommand, error) {
+	if strings.ToLower(strings.TrimSpace(params)) != "config" {
+		return nil, fmt.Errorf("validate requires the subcommand config")
+	}
+	return &validateCommand{}, nil
+}
+
+func (t *validateCommandType) InitFromJSON(config map[string]interface{}) (ControlCommand, error) {
+	subCmd, ok := config["subcommand"].(string)
+	if !ok || strings.ToLower(subCmd) != "config" {
+		return nil, fmt.Errorf("validate requires the subcommand config")
+	}
+	return &validateCommand{}, nil
+}
+
+func (c *validateCommand) ControlFunc(nc *netceptor.Netceptor, cfo ControlFuncOperations) (map[string]interface{}, error) {
+	cfr := make(map[string]interface{})
+	findings := make([]interface{}, 0)
+	errors := 0
+	warnings := 0
+	for _, f := range nc.ValidateConfig() {
+		switch f.Severity {
+		case netceptor.FindingError:
+			errors++
+		case netceptor.FindingWarning:
+			warnings++
+		}
+		findings = append(findings, map[string]interface{}{
+			"Subsystem": f.Subsystem,
+			"Severity":  f.Severity,
+			"Message":   f.Message,
+		})
+	}
+	cfr["Success"] = true
+	cfr["Valid"] = errors == 0
+	cfr["Errors"] = errors
+	cfr["Warnings"] = warnings
+	cfr["Findings"] = findings
+	return cfr, nil
+}
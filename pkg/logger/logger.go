@@ -1,15 +1,26 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/cmdline"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var logLevel int
+// logLevel is the global log level.  It is accessed atomically, since it can be changed at runtime.
+var logLevel int32
 var showTrace bool
+var jsonFormat bool
+
+// Fields are key/value pairs attached to a log message.  In JSON format they become members of the
+// logged object, and in text format they are appended to the message as key=value pairs.
+type Fields map[string]interface{}
 
 // Log level constants
 const (
@@ -21,12 +32,23 @@ const (
 
 // QuietMode turns off all log output
 func QuietMode() {
-	logLevel = 0
+	atomic.StoreInt32(&logLevel, 0)
 }
 
 // SetLogLevel is a helper function for setting logLevel int
 func SetLogLevel(level int) {
-	logLevel = level
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// SetLevel sets the global log level by name.  It can be called at any time, and applies to
+// subsystems that do not have their own log level.
+func SetLevel(name string) error {
+	level, err := GetLogLevelByName(name)
+	if err != nil {
+		return err
+	}
+	SetLogLevel(level)
+	return nil
 }
 
 // SetShowTrace is a helper function for setting showTrace bool
@@ -34,6 +56,12 @@ func SetShowTrace(trace bool) {
 	showTrace = trace
 }
 
+// SetJSONFormat selects whether log messages are written as JSON objects, one per line, rather
+// than as text
+func SetJSONFormat(enabled bool) {
+	jsonFormat = enabled
+}
+
 // GetLogLevelByName is a helper function for returning level associated with log
 // level string
 func GetLogLevelByName(logName string) (int, error) {
@@ -47,7 +75,7 @@ func GetLogLevelByName(logName string) (int, error) {
 
 // GetLogLevel returns current log level
 func GetLogLevel() int {
-	return logLevel
+	return int(atomic.LoadInt32(&logLevel))
 }
 
 // logLevelMap maps strings to log level int
@@ -59,25 +87,122 @@ var logLevelMap = map[string]int{
 	"debug":   DebugLevel,
 }
 
-// Log sends a log message at a given level
-func Log(level int, format string, v ...interface{}) {
-	var prefix string
+// GetLogLevelName returns the name of a log level, or a blank string if the level is not valid
+func GetLogLevelName(level int) string {
 	for k, v := range logLevelMap {
 		if v == level {
-			prefix = fmt.Sprintf("%s ", strings.ToUpper(k))
-			break
+			return k
 		}
 	}
-	if prefix == "" {
+	return ""
+}
+
+// writeLock keeps JSON log lines from interleaving
+var writeLock = &sync.Mutex{}
+
+// textFields formats fields as key=value pairs, in key order
+func textFields(fields Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(fmt.Sprintf(" %s=%v", k, fields[k]))
+	}
+	return sb.String()
+}
+
+// jsonEntry returns a log message as a JSON object.  The level, time, msg and subsystem members
+// take precedence over fields of the same name.
+func jsonEntry(levelName string, subsystem string, fields Fields, msg string) []byte {
+	entry := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		err, ok := v.(error)
+		if ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["level"] = levelName
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["msg"] = strings.TrimRight(msg, "\n")
+	if subsystem != "" {
+		entry["subsystem"] = subsystem
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		// Some field could not be marshalled, so log all the fields as strings
+		for k, v := range fields {
+			if _, ok := entry[k]; ok && k != "level" && k != "time" && k != "msg" && k != "subsystem" {
+				entry[k] = fmt.Sprint(v)
+			}
+		}
+		data, _ = json.Marshal(entry)
+	}
+	return append(data, '\n')
+}
+
+// writeEntry writes a log message in the current format
+func writeEntry(levelName string, subsystem string, fields Fields, msg string) {
+	if jsonFormat {
+		data := jsonEntry(levelName, subsystem, fields, msg)
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		_, _ = log.Writer().Write(data)
+		return
+	}
+	if len(fields) > 0 {
+		trimmed := strings.TrimRight(msg, "\n")
+		msg = trimmed + textFields(fields) + msg[len(trimmed):]
+	}
+	log.SetPrefix(fmt.Sprintf("%s ", strings.ToUpper(levelName)))
+	log.Print(msg)
+}
+
+// output writes a log message if the given level is enabled by the threshold
+func output(threshold int, level int, subsystem string, fields Fields, format string, v ...interface{}) {
+	name := GetLogLevelName(level)
+	if name == "" {
 		Error("Log entry received with invalid level: %s\n", fmt.Sprintf(format, v...))
 		return
 	}
-	if logLevel >= level {
-		log.SetPrefix(prefix)
-		log.Printf(format, v...)
+	if threshold >= level {
+		writeEntry(name, subsystem, fields, fmt.Sprintf(format, v...))
 	}
 }
 
+// Log sends a log message at a given level
+func Log(level int, format string, v ...interface{}) {
+	output(GetLogLevel(), level, "", nil, format, v...)
+}
+
+// LogFields sends a log message with structured fields at a given level
+func LogFields(level int, fields Fields, format string, v ...interface{}) {
+	output(GetLogLevel(), level, "", fields, format, v...)
+}
+
+// ErrorFields is like Error, with structured fields
+func ErrorFields(fields Fields, format string, v ...interface{}) {
+	LogFields(ErrorLevel, fields, format, v...)
+}
+
+// WarningFields is like Warning, with structured fields
+func WarningFields(fields Fields, format string, v ...interface{}) {
+	LogFields(WarningLevel, fields, format, v...)
+}
+
+// InfoFields is like Info, with structured fields
+func InfoFields(fields Fields, format string, v ...interface{}) {
+	LogFields(InfoLevel, fields, format, v...)
+}
+
+// DebugFields is like Debug, with structured fields
+func DebugFields(fields Fields, format string, v ...interface{}) {
+	LogFields(DebugLevel, fields, format, v...)
+}
+
 // Error reports unexpected behavior, likely to result in termination
 func Error(format string, v ...interface{}) {
 	Log(ErrorLevel, format, v...)
@@ -101,22 +226,157 @@ func Debug(format string, v ...interface{}) {
 // Trace outputs detailed packet traversal
 func Trace(format string, v ...interface{}) {
 	if showTrace {
-		log.SetPrefix("TRACE ")
-		log.Printf(format, v...)
+		writeEntry("trace", "", nil, fmt.Sprintf(format, v...))
 	}
 }
 
+// Sublogger sends log messages on behalf of a named subsystem, whose log level can be set
+// independently of the global one
+type Sublogger struct {
+	name string
+}
+
+var subloggersLock = &sync.RWMutex{}
+var subloggers = make(map[string]*Sublogger)
+var subsystemLevels = make(map[string]int)
+
+// Named returns the sublogger of a subsystem, creating it if this is the first use of the name
+func Named(name string) *Sublogger {
+	subloggersLock.Lock()
+	defer subloggersLock.Unlock()
+	sl, ok := subloggers[name]
+	if !ok {
+		sl = &Sublogger{name: name}
+		subloggers[name] = sl
+	}
+	return sl
+}
+
+// Subsystems returns the names of all subsystems that have subloggers
+func Subsystems() []string {
+	subloggersLock.RLock()
+	defer subloggersLock.RUnlock()
+	names := make([]string, 0, len(subloggers))
+	for name := range subloggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetSubsystemLogLevel sets the log level of a subsystem, overriding the global log level
+func SetSubsystemLogLevel(name string, level int) error {
+	subloggersLock.Lock()
+	defer subloggersLock.Unlock()
+	_, ok := subloggers[name]
+	if !ok {
+		return fmt.Errorf("unknown subsystem %s", name)
+	}
+	subsystemLevels[name] = level
+	return nil
+}
+
+// ResetSubsystemLogLevel removes a subsystem's log level override, so it follows the global log level again
+func ResetSubsystemLogLevel(name string) error {
+	subloggersLock.Lock()
+	defer subloggersLock.Unlock()
+	_, ok := subloggers[name]
+	if !ok {
+		return fmt.Errorf("unknown subsystem %s", name)
+	}
+	delete(subsystemLevels, name)
+	return nil
+}
+
+// GetSubsystemLogLevel returns the log level in effect for a subsystem, and whether it overrides the global log level
+func GetSubsystemLogLevel(name string) (int, bool) {
+	subloggersLock.RLock()
+	defer subloggersLock.RUnlock()
+	level, ok := subsystemLevels[name]
+	if !ok {
+		return GetLogLevel(), false
+	}
+	return level, true
+}
+
+// Log sends a log message at a given level
+func (sl *Sublogger) Log(level int, format string, v ...interface{}) {
+	sl.LogFields(level, nil, format, v...)
+}
+
+// LogFields sends a log message with structured fields at a given level.  In JSON format, the
+// message includes the name of the subsystem.
+func (sl *Sublogger) LogFields(level int, fields Fields, format string, v ...interface{}) {
+	threshold, _ := GetSubsystemLogLevel(sl.name)
+	output(threshold, level, sl.name, fields, format, v...)
+}
+
+// ErrorFields is like Error, with structured fields
+func (sl *Sublogger) ErrorFields(fields Fields, format string, v ...interface{}) {
+	sl.LogFields(ErrorLevel, fields, format, v...)
+}
+
+// WarningFields is like Warning, with structured fields
+func (sl *Sublogger) WarningFields(fields Fields, format string, v ...interface{}) {
+	sl.LogFields(WarningLevel, fields, format, v...)
+}
+
+// InfoFields is like Info, with structured fields
+func (sl *Sublogger) InfoFields(fields Fields, format string, v ...interface{}) {
+	sl.LogFields(InfoLevel, fields, format, v...)
+}
+
+// DebugFields is like Debug, with structured fields
+func (sl *Sublogger) DebugFields(fields Fields, format string, v ...interface{}) {
+	sl.LogFields(DebugLevel, fields, format, v...)
+}
+
+// Error reports unexpected behavior, likely to result in termination
+func (sl *Sublogger) Error(format string, v ...interface{}) {
+	sl.Log(ErrorLevel, format, v...)
+}
+
+// Warning reports unexpected behavior, not necessarily resulting in termination
+func (sl *Sublogger) Warning(format string, v ...interface{}) {
+	sl.Log(WarningLevel, format, v...)
+}
+
+// Info provides general purpose statements useful to end user
+func (sl *Sublogger) Info(format string, v ...interface{}) {
+	sl.Log(InfoLevel, format, v...)
+}
+
+// Debug contains extra information helpful to developers
+func (sl *Sublogger) Debug(format string, v ...interface{}) {
+	sl.Log(DebugLevel, format, v...)
+}
+
+// Trace outputs detailed packet traversal.  Tracing is not scoped to subsystems.
+func (sl *Sublogger) Trace(format string, v ...interface{}) {
+	Trace(format, v...)
+}
+
 type loglevelCfg struct {
 	Level string `description:"Log level: Error, Warning, Info or Debug" barevalue:"yes" default:"error"`
 }
 
 func (cfg loglevelCfg) Init() error {
-	var err error
-	val, err := GetLogLevelByName(cfg.Level)
-	if err != nil {
-		return err
+	return SetLevel(cfg.Level)
+}
+
+type logFormatCfg struct {
+	Format string `description:"Log format: text, or json for one JSON object per message" barevalue:"yes" default:"text"`
+}
+
+func (cfg logFormatCfg) Init() error {
+	switch strings.ToLower(cfg.Format) {
+	case "text":
+		SetJSONFormat(false)
+	case "json":
+		SetJSONFormat(true)
+	default:
+		return fmt.Errorf("%s is not a valid log format", cfg.Format)
 	}
-	SetLogLevel(val)
 	return nil
 }
 
@@ -128,11 +388,12 @@ func (cfg traceCfg) Prepare() error {
 }
 
 func init() {
-	logLevel = InfoLevel
+	SetLogLevel(InfoLevel)
 	showTrace = false
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.Ldate | log.Ltime)
 
-	cmdline.AddConfigType("log-level", "Set specific log level output", loglevelCfg{}, false, true, false, false, nil)
+	cmdline.AddConfigType("log-level", "Set the initial log level, which the loglevel control command can change at runtime", loglevelCfg{}, false, true, false, false, nil)
+	cmdline.AddConfigType("log-format", "Set the format of log output", logFormatCfg{}, false, true, false, false, nil)
 	cmdline.AddConfigType("trace", "Enables packet tracing output", traceCfg{}, false, true, false, false, nil)
 }
@@ -0,0 +1,123 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSubsystemLogLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stdout)
+	SetLogLevel(InfoLevel)
+
+	routing := Named("routing")
+	other := Named("other")
+	err := SetSubsystemLogLevel("routing", DebugLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routing.Debug("routing debug\n")
+	other.Debug("other debug\n")
+	Debug("global debug\n")
+	other.Info("other info\n")
+	out := buf.String()
+	if !strings.Contains(out, "routing debug") {
+		t.Fatalf("debug message of the raised subsystem was not logged: %q", out)
+	}
+	if strings.Contains(out, "other debug") || strings.Contains(out, "global debug") {
+		t.Fatalf("debug messages of other subsystems were logged: %q", out)
+	}
+	if !strings.Contains(out, "other info") {
+		t.Fatalf("info message of another subsystem was not logged: %q", out)
+	}
+
+	err = ResetSubsystemLogLevel("routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	routing.Debug("routing debug\n")
+	if buf.Len() != 0 {
+		t.Fatalf("debug message was logged after the override was removed: %q", buf.String())
+	}
+
+	err = SetSubsystemLogLevel("nonexistent", DebugLevel)
+	if err == nil {
+		t.Fatal("log level of an unknown subsystem was set")
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stdout)
+	defer SetLogLevel(InfoLevel)
+
+	err := SetLevel("Warning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Info("hidden info\n")
+	Warning("shown warning\n")
+	err = SetLevel("debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Debug("shown debug\n")
+	out := buf.String()
+	if strings.Contains(out, "hidden info") || !strings.Contains(out, "shown warning") || !strings.Contains(out, "shown debug") {
+		t.Fatalf("log level was not applied: %q", out)
+	}
+	if SetLevel("verbose") == nil || GetLogLevel() != DebugLevel {
+		t.Fatal("invalid log level name was accepted")
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stdout)
+	SetLogLevel(InfoLevel)
+	SetJSONFormat(true)
+	defer SetJSONFormat(false)
+
+	Named("workers").InfoFields(Fields{"unit": "abc123", "err": errors.New("failed"), "msg": "ignored"}, "Unit %s\n", "done")
+	Debug("debug message\n")
+	Warning("plain warning\n")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %q", buf.String())
+	}
+	entry := make(map[string]interface{})
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatalf("log line is not JSON: %s", err)
+	}
+	expected := map[string]string{"level": "info", "msg": "Unit done", "subsystem": "workers", "unit": "abc123", "err": "failed"}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("expected %s to be %q, got %v", k, v, entry[k])
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("log line has no time")
+	}
+	entry = make(map[string]interface{})
+	err = json.Unmarshal([]byte(lines[1]), &entry)
+	if err != nil || entry["level"] != "warning" || entry["msg"] != "plain warning" {
+		t.Errorf("unexpected plain log line %q", lines[1])
+	}
+
+	SetJSONFormat(false)
+	buf.Reset()
+	InfoFields(Fields{"b": 2, "a": 1}, "text message\n")
+	if !strings.Contains(buf.String(), "INFO ") || !strings.HasSuffix(buf.String(), "text message a=1 b=2\n") {
+		t.Errorf("unexpected text log line %q", buf.String())
+	}
+}
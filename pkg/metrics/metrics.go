@@ -0,0 +1,186 @@
+// Package metrics exposes the counters of a Receptor node to Prometheus.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"github.com/project-receptor/receptor/pkg/controlsvc"
+	"github.com/project-receptor/receptor/pkg/logger"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/workceptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"time"
+)
+
+var sublogger = logger.Named("metrics")
+
+// namespace prefixes the names of all the metrics
+const namespace = "receptor"
+
+var (
+	nodeInfoDesc = prometheus.NewDesc(namespace+"_node_info",
+		"Information about the node, with a constant value of 1", []string{"node"}, nil)
+	connectionsDesc = prometheus.NewDesc(namespace+"_connections",
+		"Number of established backend connections", nil, nil)
+	routesDesc = prometheus.NewDesc(namespace+"_routes",
+		"Number of nodes in the routing table", nil, nil)
+	bytesSentDesc = prometheus.NewDesc(namespace+"_backend_sent_bytes_total",
+		"Bytes sent by the connections of a backend", []string{"backend"}, nil)
+	bytesReceivedDesc = prometheus.NewDesc(namespace+"_backend_received_bytes_total",
+		"Bytes received by the connections of a backend", []string{"backend"}, nil)
+	messagesSentDesc = prometheus.NewDesc(namespace+"_backend_sent_messages_total",
+		"Messages sent by the connections of a backend", []string{"backend"}, nil)
+	messagesReceivedDesc = prometheus.NewDesc(namespace+"_backend_received_messages_total",
+		"Messages received by the connections of a backend", []string{"backend"}, nil)
+	queueDroppedDesc = prometheus.NewDesc(namespace+"_backend_queue_dropped_messages_total",
+		"Forwarded messages dropped because a send queue of a backend was full", []string{"backend"}, nil)
+	workUnitsDesc = prometheus.NewDesc(namespace+"_work_units",
+		"Number of known work units, by work type and state", []string{"work_type", "state"}, nil)
+	controlSessionsDesc = prometheus.NewDesc(namespace+"_control_sessions_total",
+		"Control service sessions started", nil, nil)
+	controlActiveSessionsDesc = prometheus.NewDesc(namespace+"_control_active_sessions",
+		"Control service sessions currently open", nil, nil)
+	controlCommandsDesc = prometheus.NewDesc(namespace+"_control_commands_total",
+		"Control commands run, by command", []string{"command"}, nil)
+	controlCommandErrorsDesc = prometheus.NewDesc(namespace+"_control_command_errors_total",
+		"Control commands that failed, by command", []string{"command"}, nil)
+)
+
+// Collector is a Prometheus collector that reads the counters of a node's subsystems when it is
+// scraped.  The workceptor and control service are optional.
+type Collector struct {
+	nc *netceptor.Netceptor
+	wc *workceptor.Workceptor
+	cs *controlsvc.Server
+}
+
+// NewCollector returns a collector for the subsystems of a node.  wc and cs may be nil.
+func NewCollector(nc *netceptor.Netceptor, wc *workceptor.Workceptor, cs *controlsvc.Server) *Collector {
+	return &Collector{
+		nc: nc,
+		wc: wc,
+		cs: cs,
+	}
+}
+
+// Describe sends the descriptions of all the metrics the collector can collect
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeInfoDesc
+	ch <- connectionsDesc
+	ch <- routesDesc
+	ch <- bytesSentDesc
+	ch <- bytesReceivedDesc
+	ch <- messagesSentDesc
+	ch <- messagesReceivedDesc
+	ch <- queueDroppedDesc
+	if c.wc != nil {
+		ch <- workUnitsDesc
+	}
+	if c.cs != nil {
+		ch <- controlSessionsDesc
+		ch <- controlActiveSessionsDesc
+		ch <- controlCommandsDesc
+		ch <- controlCommandErrorsDesc
+	}
+}
+
+// Collect reads the current counters of the subsystems
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	status := c.nc.Status()
+	ch <- prometheus.MustNewConstMetric(nodeInfoDesc, prometheus.GaugeValue, 1, c.nc.NodeID())
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(len(status.Connections)))
+	ch <- prometheus.MustNewConstMetric(routesDesc, prometheus.GaugeValue, float64(len(status.RoutingTable)))
+	for _, bs := range c.nc.BackendStats() {
+		ch <- prometheus.MustNewConstMetric(bytesSentDesc, prometheus.CounterValue, float64(bs.BytesSent), bs.Name)
+		ch <- prometheus.MustNewConstMetric(bytesReceivedDesc, prometheus.CounterValue, float64(bs.BytesReceived), bs.Name)
+		ch <- prometheus.MustNewConstMetric(messagesSentDesc, prometheus.CounterValue, float64(bs.MessagesSent), bs.Name)
+		ch <- prometheus.MustNewConstMetric(messagesReceivedDesc, prometheus.CounterValue, float64(bs.MessagesReceived), bs.Name)
+		ch <- prometheus.MustNewConstMetric(queueDroppedDesc, prometheus.CounterValue, float64(bs.QueueDropped), bs.Name)
+	}
+	if c.wc != nil {
+		for _, uc := range c.wc.UnitStateCounts() {
+			ch <- prometheus.MustNewConstMetric(workUnitsDesc, prometheus.GaugeValue, float64(uc.Count), uc.WorkType, uc.State)
+		}
+	}
+	if c.cs != nil {
+		m := c.cs.Metrics()
+		ch <- prometheus.MustNewConstMetric(controlSessionsDesc, prometheus.CounterValue, float64(m.SessionsTotal))
+		ch <- prometheus.MustNewConstMetric(controlActiveSessionsDesc, prometheus.GaugeValue, float64(m.ActiveSessions))
+		for command, stats := range m.Commands {
+			ch <- prometheus.MustNewConstMetric(controlCommandsDesc, prometheus.CounterValue, float64(stats.Invocations), command)
+			ch <- prometheus.MustNewConstMetric(controlCommandErrorsDesc, prometheus.CounterValue, float64(stats.Errors), command)
+		}
+	}
+}
+
+// NewHandler returns an HTTP handler that serves the metrics of a node, along with the metrics of
+// the Go runtime and the process, in the Prometheus exposition format
+func NewHandler(nc *netceptor.Netceptor, wc *workceptor.Workceptor, cs *controlsvc.Server) (http.Handler, error) {
+	registry := prometheus.NewRegistry()
+	for _, c := range []prometheus.Collector{
+		NewCollector(nc, wc, cs),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		err := registry.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), nil
+}
+
+// Serve serves the metrics of a node on a listener, at the given path, until the context is done
+func Serve(ctx context.Context, li net.Listener, path string, handler http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		err := server.Serve(li)
+		if err != nil && err != http.ErrServerClosed {
+			sublogger.Error("Error serving metrics: %s\n", err)
+		}
+	}()
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// CmdlineConfig is the cmdline configuration object for the metrics server
+type CmdlineConfig struct {
+	Address string `required:"true" description:"Local address to serve Prometheus metrics on, such as :9100" barevalue:"yes"`
+	Path    string `description:"URL path of the metrics" default:"/metrics"`
+}
+
+// Run runs the action
+func (cfg CmdlineConfig) Run() error {
+	handler, err := NewHandler(netceptor.MainInstance, workceptor.MainInstance, controlsvc.MainInstance)
+	if err != nil {
+		return err
+	}
+	li, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return fmt.Errorf("error listening for metrics on %s: %s", cfg.Address, err)
+	}
+	sublogger.Info("Serving metrics on %s%s\n", li.Addr(), cfg.Path)
+	Serve(netceptor.MainInstance.Context(), li, cfg.Path, handler)
+	return nil
+}
+
+func init() {
+	cmdline.AddConfigType("metrics-server", "Serve Prometheus metrics of this node over HTTP",
+		CmdlineConfig{}, false, true, false, false, nil)
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/controlsvc"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/workceptor"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// idleUnit is a work unit that does nothing
+type idleUnit struct {
+	workceptor.BaseWorkUnit
+}
+
+func (u *idleUnit) Start() error {
+	return nil
+}
+
+func (u *idleUnit) Restart() error {
+	return nil
+}
+
+func (u *idleUnit) Cancel() error {
+	return nil
+}
+
+func TestMetricsServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nc := netceptor.New(ctx, "node1", nil)
+	defer nc.Shutdown()
+	wc, err := workceptor.NewWithStorage(ctx, nc, workceptor.NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wc.RegisterWorker("idle", func() workceptor.WorkUnit {
+		return &idleUnit{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := wc.AllocateUnit("idle", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit.UpdateBasicStatus(workceptor.WorkStateFailed, "Failed", 0)
+	cs := controlsvc.New(true, nc)
+	handler, err := NewHandler(nc, wc, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Serve(ctx, li, "/metrics", handler)
+
+	resp, err := http.Get("http://" + li.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`receptor_node_info{node="node1"} 1`,
+		"receptor_connections 0",
+		"receptor_control_sessions_total 0",
+		`receptor_work_units{state="Failed",work_type="idle"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("metrics did not include %s", expected)
+		}
+	}
+
+	cancel()
+	resp, err = http.Get("http://" + li.Addr().String() + "/metrics")
+	if err == nil {
+		_ = resp.Body.Close()
+		t.Error("metrics were still served after the context was done")
+	}
+}
@@ -0,0 +1,130 @@
+package netceptor
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"strings"
+	"sync"
+)
+
+// ServiceAccessPolicy controls which nodes may open stream connections to a service.  A node must
+// pass every check that is set.
+type ServiceAccessPolicy struct {
+	// Allow lists the only nodes that may connect.  A nil list allows all nodes.
+	Allow []string
+	// Deny lists nodes that may not connect
+	Deny []string
+	// AllowedPeersOnly also requires the node to be in this node's allowed peers list, if one is set
+	AllowedPeersOnly bool
+	// Check, if set, is called with the ID of the connecting node and rejects it by returning false
+	Check func(nodeID string) bool
+}
+
+// serviceAccessRegistry holds the access policies of services, by service name
+type serviceAccessRegistry struct {
+	lock     *sync.RWMutex
+	policies map[string]*ServiceAccessPolicy
+}
+
+func newServiceAccessRegistry() *serviceAccessRegistry {
+	return &serviceAccessRegistry{
+		lock:     &sync.RWMutex{},
+		policies: make(map[string]*ServiceAccessPolicy),
+	}
+}
+
+func containsNode(nodes []string, nodeID string) bool {
+	for i := range nodes {
+		if nodes[i] == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// SetServiceAccessPolicy sets which nodes may connect to a service.  The policy applies to new
+// connections to any listener on the service, including listeners started later.  A nil policy
+// allows all nodes.
+func (s *Netceptor) SetServiceAccessPolicy(service string, policy *ServiceAccessPolicy) {
+	s.serviceAccess.lock.Lock()
+	defer s.serviceAccess.lock.Unlock()
+	if policy == nil {
+		delete(s.serviceAccess.policies, service)
+		return
+	}
+	s.serviceAccess.policies[service] = policy
+}
+
+// serviceAccessAllowed returns true if a node may connect to a service
+func (s *Netceptor) serviceAccessAllowed(service string, nodeID string) bool {
+	s.serviceAccess.lock.RLock()
+	policy, ok := s.serviceAccess.policies[service]
+	s.serviceAccess.lock.RUnlock()
+	if !ok {
+		return true
+	}
+	if policy.Allow != nil && !containsNode(policy.Allow, nodeID) {
+		return false
+	}
+	if containsNode(policy.Deny, nodeID) {
+		return false
+	}
+	if policy.AllowedPeersOnly && !s.peerAllowed(nodeID) {
+		return false
+	}
+	if policy.Check != nil && !policy.Check(nodeID) {
+		return false
+	}
+	return true
+}
+
+// ListenAndAdvertiseWithPolicy is like ListenAndAdvertise, but only accepts connections from nodes
+// allowed by the access policy.  Connections from other nodes are closed without being returned
+// by Accept.
+func (s *Netceptor) ListenAndAdvertiseWithPolicy(service string, tls *tls.Config, tags map[string]string,
+	policy *ServiceAccessPolicy) (*Listener, error) {
+	return s.listenWithPolicy(context.Background(), service, tls, true, tags, policy)
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// ServiceAccessCfg is the cmdline configuration object for a service access policy
+type ServiceAccessCfg struct {
+	Service          string `required:"true" description:"Name of the service to control access to"`
+	Allow            string `description:"Comma separated list of the only node IDs that may connect"`
+	Deny             string `description:"Comma separated list of node IDs that may not connect"`
+	AllowedPeersOnly bool   `description:"Only allow nodes in the node's allowed peers list to connect" default:"false"`
+}
+
+// splitNodeList splits a comma separated list of node IDs, returning nil for an empty list
+func splitNodeList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	nodes := strings.Split(list, ",")
+	for i := range nodes {
+		nodes[i] = strings.TrimSpace(nodes[i])
+	}
+	return nodes
+}
+
+// Prepare sets the policy on the main instance, before any services start listening
+func (cfg ServiceAccessCfg) Prepare() error {
+	if cfg.Allow == "" && cfg.Deny == "" && !cfg.AllowedPeersOnly {
+		return fmt.Errorf("service access policy for %s does not restrict anything", cfg.Service)
+	}
+	MainInstance.SetServiceAccessPolicy(cfg.Service, &ServiceAccessPolicy{
+		Allow:            splitNodeList(cfg.Allow),
+		Deny:             splitNodeList(cfg.Deny),
+		AllowedPeersOnly: cfg.AllowedPeersOnly,
+	})
+	return nil
+}
+
+func init() {
+	cmdline.AddConfigType("service-access", "Restrict which nodes may connect to a service", ServiceAccessCfg{}, false, false, false, false, configSection)
+}
@@ -0,0 +1,112 @@
+package netceptor
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestServiceAccessPolicy(t *testing.T) {
+	n1 := New(context.Background(), "node1", []string{"node2", "node3"})
+	defer n1.Shutdown()
+	n1.SetServiceAccessPolicy("deny", &ServiceAccessPolicy{Deny: []string{"node3"}})
+	n1.SetServiceAccessPolicy("peers", &ServiceAccessPolicy{AllowedPeersOnly: true})
+	n1.SetServiceAccessPolicy("check", &ServiceAccessPolicy{
+		Allow: []string{"node2", "node3", "node4"},
+		Check: func(nodeID string) bool {
+			return nodeID != "node2"
+		},
+	})
+	cases := []struct {
+		service string
+		node    string
+		allowed bool
+	}{
+		{"open", "node4", true},
+		{"deny", "node2", true},
+		{"deny", "node3", false},
+		{"peers", "node3", true},
+		{"peers", "node4", false},
+		{"check", "node2", false},
+		{"check", "node3", true},
+		{"check", "node5", false},
+	}
+	for _, c := range cases {
+		if n1.serviceAccessAllowed(c.service, c.node) != c.allowed {
+			t.Errorf("expected access of %s to %s to be %v", c.node, c.service, c.allowed)
+		}
+	}
+	n1.SetServiceAccessPolicy("deny", nil)
+	if !n1.serviceAccessAllowed("deny", "node3") {
+		t.Error("policy was not removed")
+	}
+}
+
+func TestListenWithPolicy(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	n3 := New(context.Background(), "node3", nil)
+	defer func() {
+		for _, n := range []*Netceptor{n1, n2, n3} {
+			n.Shutdown()
+			n.BackendWait()
+		}
+	}()
+	linkNodes(t, n1, n2, "", 1.0)
+	linkNodes(t, n1, n3, "", 1.0)
+	waitForRoute(t, n2, "node1", "node1")
+	waitForRoute(t, n3, "node1", "node1")
+
+	li, err := n1.ListenAndAdvertiseWithPolicy("echo", nil, nil, &ServiceAccessPolicy{Allow: []string{"node2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn.RemoteAddr().(Addr).node
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	echo := func(n *Netceptor) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := n.DialContext(ctx, "node1", "echo", nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("hello"))
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		return err
+	}
+	err = echo(n2)
+	if err != nil {
+		t.Fatalf("allowed node could not use the service: %s", err)
+	}
+	err = echo(n3)
+	if err == nil {
+		t.Fatal("disallowed node was able to use the service")
+	}
+	if len(accepted) != 1 {
+		t.Fatalf("expected only one connection to reach the service, but %d did", len(accepted))
+	}
+	node := <-accepted
+	if node != "node2" {
+		t.Fatalf("expected only node2 to reach the service, but %s did", node)
+	}
+}
@@ -0,0 +1,75 @@
+package netceptor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// AdvertisementCacheEntry is the public view of the most recent routing advertisement received from a node
+type AdvertisementCacheEntry struct {
+	NodeID       string
+	Epoch        uint64
+	Sequence     uint64
+	LastReceived time.Time
+	Age          time.Duration
+	ReceivedFrom string
+	Connections  map[string]float64
+}
+
+// AdvertisementCache returns the routing advertisements currently known for remote nodes, sorted by node ID
+func (s *Netceptor) AdvertisementCache() []*AdvertisementCacheEntry {
+	s.knownNodeLock.RLock()
+	defer s.knownNodeLock.RUnlock()
+	entries := make([]*AdvertisementCacheEntry, 0, len(s.knownNodeInfo))
+	for node, ni := range s.knownNodeInfo {
+		conns := make(map[string]float64)
+		for k, v := range s.knownConnectionCosts[node] {
+			conns[k] = v
+		}
+		entries = append(entries, &AdvertisementCacheEntry{
+			NodeID:       node,
+			Epoch:        ni.Epoch,
+			Sequence:     ni.Sequence,
+			LastReceived: ni.LastReceived,
+			Age:          time.Since(ni.LastReceived),
+			ReceivedFrom: ni.ReceivedFrom,
+			Connections:  conns,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].NodeID < entries[j].NodeID
+	})
+	return entries
+}
+
+// ClearAdvertisement removes a node's routing advertisement and service advertisements from the cache,
+// along with any links to it advertised by other nodes.  If the node is still alive, it will be
+// re-learned from the next advertisement that reaches us.  Links to our own direct neighbors are
+// kept, since those come from our own connections.
+func (s *Netceptor) ClearAdvertisement(nodeID string) error {
+	if nodeID == s.nodeID {
+		return fmt.Errorf("cannot clear the advertisement of the local node")
+	}
+	s.knownNodeLock.Lock()
+	_, ok := s.knownNodeInfo[nodeID]
+	if !ok {
+		s.knownNodeLock.Unlock()
+		return fmt.Errorf("no advertisement cached for node %s", nodeID)
+	}
+	delete(s.knownNodeInfo, nodeID)
+	delete(s.knownConnectionCosts, nodeID)
+	for node := range s.knownConnectionCosts {
+		if node != s.nodeID {
+			delete(s.knownConnectionCosts[node], nodeID)
+		}
+	}
+	s.knownNodeLock.Unlock()
+	s.serviceAdsLock.Lock()
+	delete(s.serviceAdsReceived, nodeID)
+	s.serviceAdsLock.Unlock()
+	s.pruneStickyRoutes(nodeID, "")
+	sublogger.Info("Cleared cached advertisement for node %s\n", nodeID)
+	s.updateRoutingTableChan <- 0
+	return nil
+}
@@ -0,0 +1,57 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAdvertisementCache(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	defer n1.Shutdown()
+
+	n1.handleRoutingUpdate(&routingUpdate{
+		NodeID:         "ghost",
+		UpdateID:       "update1",
+		UpdateEpoch:    1,
+		UpdateSequence: 5,
+		Connections:    map[string]float64{"node2": 1.0},
+	}, "node2")
+	cache := n1.AdvertisementCache()
+	if len(cache) != 1 {
+		t.Fatalf("expected one cached advertisement, got %d", len(cache))
+	}
+	entry := cache[0]
+	if entry.NodeID != "ghost" || entry.Epoch != 1 || entry.Sequence != 5 || entry.ReceivedFrom != "node2" ||
+		entry.Connections["node2"] != 1.0 || entry.LastReceived.IsZero() {
+		t.Fatalf("unexpected cache entry %v", entry)
+	}
+
+	err := n1.ClearAdvertisement("ghost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n1.AdvertisementCache()) != 0 {
+		t.Fatal("advertisement remained after clearing")
+	}
+	err = n1.ClearAdvertisement("ghost")
+	if err == nil {
+		t.Fatal("clearing an unknown node succeeded")
+	}
+	err = n1.ClearAdvertisement("node1")
+	if err == nil {
+		t.Fatal("clearing the local node succeeded")
+	}
+
+	// A fresh advertisement is accepted even though its sequence number is not newer
+	n1.handleRoutingUpdate(&routingUpdate{
+		NodeID:         "ghost",
+		UpdateID:       "update2",
+		UpdateEpoch:    1,
+		UpdateSequence: 5,
+		Connections:    map[string]float64{"node2": 1.0},
+	}, "node3")
+	cache = n1.AdvertisementCache()
+	if len(cache) != 1 || cache[0].NodeID != "ghost" || cache[0].ReceivedFrom != "node3" {
+		t.Fatalf("advertisement was not re-learned: %v", cache)
+	}
+}
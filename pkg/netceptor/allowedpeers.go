@@ -0,0 +1,168 @@
+package netceptor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Sources of the allowed peers list
+const (
+	// AllowedPeersSourceNone means no list has been set, so all peers are allowed
+	AllowedPeersSourceNone = "none"
+	// AllowedPeersSourceConfig means the list was given in the node configuration or on the command line
+	AllowedPeersSourceConfig = "config"
+	// AllowedPeersSourceFile means the list was loaded from an allowed peers file
+	AllowedPeersSourceFile = "file"
+	// AllowedPeersSourceRuntime means the list was set while the node was running
+	AllowedPeersSourceRuntime = "runtime"
+)
+
+// AllowedPeers returns the node IDs that are allowed to connect to this node, and where the list
+// came from.  A nil list means that all peers are allowed.  The list applies to new connections.
+func (s *Netceptor) AllowedPeers() ([]string, string) {
+	s.allowedPeersLock.RLock()
+	defer s.allowedPeersLock.RUnlock()
+	if s.allowedPeers == nil {
+		return nil, s.allowedPeersSource
+	}
+	peers := make([]string, len(s.allowedPeers))
+	copy(peers, s.allowedPeers)
+	return peers, s.allowedPeersSource
+}
+
+// compileAllowedPeers compiles an allowed peers list.  If the list is invalid, no peers are allowed,
+// so that a bad entry cannot let unexpected peers connect.
+func compileAllowedPeers(peers []string) []*peerPattern {
+	patterns, err := compilePeerPatterns(peers)
+	if err != nil {
+		sublogger.Error("Allowing no peers, since the allowed peers list is invalid: %s\n", err)
+		return []*peerPattern{}
+	}
+	return patterns
+}
+
+// SetAllowedPeers replaces the list of node IDs that are allowed to connect to this node.  Entries
+// may be glob patterns, or regular expressions following PeerRegexPrefix.  A nil list allows all
+// peers.  Existing connections are not affected.
+func (s *Netceptor) SetAllowedPeers(peers []string) {
+	s.allowedPeersLock.Lock()
+	defer s.allowedPeersLock.Unlock()
+	s.allowedPeers = peers
+	s.allowedPeerPatterns = compileAllowedPeers(peers)
+	s.allowedPeersSource = AllowedPeersSourceRuntime
+	if peers == nil {
+		s.allowedPeersSource = AllowedPeersSourceNone
+	}
+}
+
+// DeniedPeers returns the node IDs that may never connect to this node
+func (s *Netceptor) DeniedPeers() []string {
+	s.allowedPeersLock.RLock()
+	defer s.allowedPeersLock.RUnlock()
+	peers := make([]string, len(s.deniedPeers))
+	copy(peers, s.deniedPeers)
+	return peers
+}
+
+// SetDeniedPeers replaces the list of node IDs that may never connect to this node, even if they
+// are allowed peers.  Entries may be patterns, as for SetAllowedPeers.  Existing connections are
+// not affected.
+func (s *Netceptor) SetDeniedPeers(peers []string) error {
+	patterns, err := compilePeerPatterns(peers)
+	if err != nil {
+		return err
+	}
+	s.allowedPeersLock.Lock()
+	defer s.allowedPeersLock.Unlock()
+	s.deniedPeers = peers
+	s.deniedPeerPatterns = patterns
+	return nil
+}
+
+// peerAdmission decides whether a node is allowed to connect to this node, and gives the reason
+func (s *Netceptor) peerAdmission(nodeID string) (bool, string) {
+	s.allowedPeersLock.RLock()
+	defer s.allowedPeersLock.RUnlock()
+	entry, ok := matchPeerPatterns(s.deniedPeerPatterns, nodeID)
+	if ok {
+		return false, fmt.Sprintf("it matches denied peers entry %s", entry)
+	}
+	if s.allowedPeerPatterns == nil {
+		return true, "all peers are allowed"
+	}
+	entry, ok = matchPeerPatterns(s.allowedPeerPatterns, nodeID)
+	if ok {
+		return true, fmt.Sprintf("it matches allowed peers entry %s", entry)
+	}
+	return false, "it is not in the accepted connections list"
+}
+
+// peerAllowed returns true if a node is allowed to connect to this node
+func (s *Netceptor) peerAllowed(nodeID string) bool {
+	allowed, _ := s.peerAdmission(nodeID)
+	return allowed
+}
+
+// readAllowedPeersFile reads a list of node IDs or patterns, one per line.  Blank lines and lines starting
+// with # are ignored.
+func readAllowedPeersFile(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	peers := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// LoadAllowedPeersFile replaces the allowed peers list with the contents of a file, which is
+// remembered so that ReloadAllowedPeers can read it again
+func (s *Netceptor) LoadAllowedPeersFile(filename string) error {
+	peers, err := readAllowedPeersFile(filename)
+	if err != nil {
+		return err
+	}
+	patterns, err := compilePeerPatterns(peers)
+	if err != nil {
+		return err
+	}
+	s.allowedPeersLock.Lock()
+	defer s.allowedPeersLock.Unlock()
+	s.allowedPeers = peers
+	s.allowedPeerPatterns = patterns
+	s.allowedPeersSource = AllowedPeersSourceFile
+	s.allowedPeersFile = filename
+	return nil
+}
+
+// ReloadAllowedPeers reads the allowed peers file again
+func (s *Netceptor) ReloadAllowedPeers() error {
+	s.allowedPeersLock.RLock()
+	filename := s.allowedPeersFile
+	s.allowedPeersLock.RUnlock()
+	if filename == "" {
+		return fmt.Errorf("no allowed peers file has been loaded")
+	}
+	err := s.LoadAllowedPeersFile(filename)
+	if err != nil {
+		return err
+	}
+	sublogger.Info("Reloaded allowed peers from %s\n", filename)
+	return nil
+}
@@ -0,0 +1,87 @@
+package netceptor
+
+import (
+	"context"
+	"github.com/prep/socketpair"
+	"testing"
+	"time"
+)
+
+func TestBackendEnableDisable(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	b1, err := NewExternalBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.AddNamedBackend("ext", b1, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.AddNamedBackend("ext", b1, 1.0, nil)
+	if err == nil {
+		t.Fatal("duplicate backend name was accepted")
+	}
+	n2 := New(context.Background(), "node2", nil)
+	b2, err := NewExternalBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n2.AddBackend(b2, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect := func() {
+		c1, c2, err := socketpair.New("unix")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b1.NewConnection(c1, true)
+		b2.NewConnection(c2, true)
+	}
+	connect()
+	waitForConnection(t, n1, "node2", true)
+
+	bs := n1.BackendStatus()
+	if len(bs) != 1 || bs[0].Name != "ext" || !bs[0].Enabled || len(bs[0].Connections) != 1 {
+		t.Fatalf("unexpected backend status %v", bs[0])
+	}
+
+	// Disabling the backend should drop its connections
+	err = n1.SetBackendEnabled("ext", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.SetBackendEnabled("ext", false)
+	if err == nil {
+		t.Fatal("disabling an already disabled backend succeeded")
+	}
+	waitForConnection(t, n1, "node2", false)
+	if n1.BackendStatus()[0].Enabled {
+		t.Fatal("backend still reported as enabled")
+	}
+
+	// Sessions arriving while the backend is disabled should be refused
+	connect()
+	time.Sleep(500 * time.Millisecond)
+	waitForConnection(t, n1, "node2", false)
+
+	// Re-enabling the backend should allow new connections
+	err = n1.SetBackendEnabled("ext", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	connect()
+	waitForConnection(t, n1, "node2", true)
+
+	err = n1.SetBackendEnabled("nonexistent", true)
+	if err == nil {
+		t.Fatal("enabling a nonexistent backend succeeded")
+	}
+
+	n1.Shutdown()
+	n2.Shutdown()
+	n1.BackendWait()
+	n2.BackendWait()
+}
@@ -0,0 +1,161 @@
+package netceptor
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackendFault is a fault injected into the sessions of a backend, for resilience testing
+type BackendFault struct {
+	// DropRate is the fraction of frames, between 0 and 1, that are silently dropped in each direction
+	DropRate float64
+	// Latency is added before each frame is sent
+	Latency time.Duration
+	// Fail makes every send and receive return an error, tearing down the session
+	Fail bool
+}
+
+// chaosRegistry holds the faults currently injected into each backend
+type chaosRegistry struct {
+	lock    *sync.RWMutex
+	enabled bool
+	faults  map[string]BackendFault
+}
+
+// newChaosRegistry allocates a new chaosRegistry, with fault injection disabled
+func newChaosRegistry() *chaosRegistry {
+	return &chaosRegistry{
+		lock:   &sync.RWMutex{},
+		faults: make(map[string]BackendFault),
+	}
+}
+
+// isEnabled returns true if fault injection has been enabled
+func (cr *chaosRegistry) isEnabled() bool {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.enabled
+}
+
+// fault returns the fault currently injected into a backend, if there is one
+func (cr *chaosRegistry) fault(backendName string) (BackendFault, bool) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	f, ok := cr.faults[backendName]
+	return f, ok
+}
+
+// faultSession injects the faults of its backend into a session.  The fault is looked up on every
+// frame, so changing or clearing it takes effect on sessions that are already running.
+type faultSession struct {
+	sess        BackendSession
+	backendName string
+	chaos       *chaosRegistry
+}
+
+// errInjectedFault is returned by a session whose backend has been set to fail
+var errInjectedFault = fmt.Errorf("injected backend failure")
+
+// Send sends a frame, unless the fault says to fail or drop it
+func (fs *faultSession) Send(data []byte) error {
+	f, ok := fs.chaos.fault(fs.backendName)
+	if !ok {
+		return fs.sess.Send(data)
+	}
+	if f.Fail {
+		return errInjectedFault
+	}
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	if f.DropRate > 0 && rand.Float64() < f.DropRate {
+		return nil
+	}
+	return fs.sess.Send(data)
+}
+
+// Recv returns the next frame that the fault does not say to drop
+func (fs *faultSession) Recv(timeout time.Duration) ([]byte, error) {
+	for {
+		data, err := fs.sess.Recv(timeout)
+		f, ok := fs.chaos.fault(fs.backendName)
+		if !ok {
+			return data, err
+		}
+		if f.Fail {
+			return nil, errInjectedFault
+		}
+		if err != nil || f.DropRate <= 0 || rand.Float64() >= f.DropRate {
+			return data, err
+		}
+	}
+}
+
+// Close closes the underlying session
+func (fs *faultSession) Close() error {
+	return fs.sess.Close()
+}
+
+// EnableChaos allows faults to be injected into backend sessions.  It must be called before any
+// backends are added, and should never be used in production.
+func (s *Netceptor) EnableChaos() {
+	s.chaos.lock.Lock()
+	defer s.chaos.lock.Unlock()
+	s.chaos.enabled = true
+}
+
+// ChaosEnabled returns true if faults can be injected into backend sessions
+func (s *Netceptor) ChaosEnabled() bool {
+	return s.chaos.isEnabled()
+}
+
+// SetBackendFault injects a fault into the current and future sessions of a backend, replacing
+// any fault it already had
+func (s *Netceptor) SetBackendFault(name string, fault BackendFault) error {
+	if !s.chaos.isEnabled() {
+		return fmt.Errorf("fault injection is not enabled on this node")
+	}
+	if fault.DropRate < 0 || fault.DropRate > 1 {
+		return fmt.Errorf("drop rate must be between 0 and 1")
+	}
+	if fault.Latency < 0 {
+		return fmt.Errorf("latency must not be negative")
+	}
+	s.backendLock.RLock()
+	_, ok := s.backends[name]
+	s.backendLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown backend %s", name)
+	}
+	s.chaos.lock.Lock()
+	defer s.chaos.lock.Unlock()
+	s.chaos.faults[name] = fault
+	sublogger.Warning("Injecting fault into backend %s: %+v\n", name, fault)
+	return nil
+}
+
+// ClearBackendFault stops injecting faults into the sessions of a backend
+func (s *Netceptor) ClearBackendFault(name string) error {
+	s.chaos.lock.Lock()
+	defer s.chaos.lock.Unlock()
+	_, ok := s.chaos.faults[name]
+	if !ok {
+		return fmt.Errorf("backend %s has no fault injected", name)
+	}
+	delete(s.chaos.faults, name)
+	sublogger.Warning("Cleared fault from backend %s\n", name)
+	return nil
+}
+
+// BackendFaults returns the faults currently injected into each backend
+func (s *Netceptor) BackendFaults() map[string]BackendFault {
+	s.chaos.lock.RLock()
+	defer s.chaos.lock.RUnlock()
+	faults := make(map[string]BackendFault)
+	for name, f := range s.chaos.faults {
+		faults[name] = f
+	}
+	return faults
+}
@@ -0,0 +1,76 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackendFaults(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	// Faults cannot be injected until chaos is explicitly enabled, which must be done before the
+	// sessions they apply to start
+	err := n1.SetBackendFault("link", BackendFault{DropRate: 1.0})
+	if err == nil {
+		t.Fatal("fault was injected without chaos being enabled")
+	}
+	n1.EnableChaos()
+	linkNodes(t, n1, n2, "link", 1.0)
+	waitForRoute(t, n1, "node2", "node2")
+
+	pc2, err := n2.ListenPacket("chaos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc2.Close()
+	pc1, err := n1.ListenPacket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc1.Close()
+	delivered := func() bool {
+		_, err := pc1.WriteTo([]byte("hello"), n1.NewAddr("node2", "chaos"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = pc2.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := make([]byte, 16)
+		_, _, err = pc2.ReadFrom(buf)
+		return err == nil
+	}
+	if !delivered() {
+		t.Fatal("message was not delivered before any fault was injected")
+	}
+
+	// With every frame dropped, messages no longer reach the other node
+	err = n1.SetBackendFault("link", BackendFault{DropRate: 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered() {
+		t.Fatal("message was delivered with a 100% drop rate")
+	}
+
+	// Clearing the fault restores the link
+	err = n1.ClearBackendFault("link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !delivered() {
+		t.Fatal("message was not delivered after the fault was cleared")
+	}
+
+	// A hard failure tears the session down
+	err = n1.SetBackendFault("link", BackendFault{Fail: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForConnection(t, n1, "node2", false)
+}
@@ -0,0 +1,75 @@
+package netceptor
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// clockService is the reserved service that answers clock probes
+const clockService = ReservedServicePrefix + "clock"
+
+// clockProbeLen is the length of a clock probe request, which holds the client's send time
+const clockProbeLen = 8
+
+// Handles a clock probe request by echoing the client's timestamp along with our receive and send times
+func (s *Netceptor) handleClockProbe(md *messageData) error {
+	recvTime := time.Now()
+	if len(md.Data) != clockProbeLen {
+		return fmt.Errorf("invalid clock probe length %d", len(md.Data))
+	}
+	reply := make([]byte, 3*clockProbeLen)
+	copy(reply, md.Data)
+	binary.BigEndian.PutUint64(reply[8:], uint64(recvTime.UnixNano()))
+	binary.BigEndian.PutUint64(reply[16:], uint64(time.Now().UnixNano()))
+	return s.sendMessage(clockService, md.FromNode, md.FromService, reply)
+}
+
+// MeasureClockSkew exchanges timestamps with a remote node and estimates how far its clock is
+// ahead of ours, using the same offset calculation as NTP.  It also returns the round trip time,
+// excluding the time the remote node spent processing the request.  It gives up after the timeout,
+// or when the context is done.
+func (s *Netceptor) MeasureClockSkew(ctx context.Context, node string, timeout time.Duration) (time.Duration, time.Duration, error) {
+	pc, err := s.ListenPacket("")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = pc.Close()
+	}()
+	startTime := time.Now()
+	req := make([]byte, clockProbeLen)
+	binary.BigEndian.PutUint64(req, uint64(startTime.UnixNano()))
+	_, err = pc.WriteTo(req, s.NewAddr(node, clockService))
+	if err != nil {
+		return 0, 0, err
+	}
+	err = pc.SetReadDeadline(startTime.Add(timeout))
+	if err != nil {
+		return 0, 0, err
+	}
+	buf := make([]byte, MTU)
+	for {
+		n, addr, err := pc.readFromContext(ctx, buf)
+		if err == ErrTimeout {
+			return 0, 0, fmt.Errorf("timeout")
+		} else if err != nil {
+			return 0, 0, err
+		}
+		endTime := time.Now()
+		ncAddr, ok := addr.(Addr)
+		if !ok || ncAddr.node != node || n != 3*clockProbeLen ||
+			binary.BigEndian.Uint64(buf) != uint64(startTime.UnixNano()) {
+			// Not a reply to our probe
+			continue
+		}
+		t0 := startTime.UnixNano()
+		t1 := int64(binary.BigEndian.Uint64(buf[8:]))
+		t2 := int64(binary.BigEndian.Uint64(buf[16:]))
+		t3 := endTime.UnixNano()
+		offset := time.Duration(((t1 - t0) + (t2 - t3)) / 2)
+		rtt := time.Duration((t3 - t0) - (t2 - t1))
+		return offset, rtt, nil
+	}
+}
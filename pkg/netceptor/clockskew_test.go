@@ -0,0 +1,81 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMeasureClockSkew(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	linkNodes(t, n1, n2, "", 1.0)
+	// Wait for routing so the probe can reach node2
+	waitForRoute(t, n1, "node2", "node2")
+
+	offset, rtt, err := n1.MeasureClockSkew(context.Background(), "node2", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both nodes share a clock, so the skew can be no more than the round trip time
+	if offset < -rtt || offset > rtt {
+		t.Fatalf("skew %s between in-process nodes exceeds round trip time %s", offset, rtt)
+	}
+	if offset < -100*time.Millisecond || offset > 100*time.Millisecond {
+		t.Fatalf("skew %s between in-process nodes is not near zero", offset)
+	}
+
+	n1.Shutdown()
+	n2.Shutdown()
+	n1.BackendWait()
+	n2.BackendWait()
+}
+
+func TestMeasureClockSkewCancelled(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	// node2 ignores clock probes, so only the context can end the measurement early
+	n2.reservedServices[clockService] = func(md *messageData) error {
+		return nil
+	}
+	linkNodes(t, n1, n2, "", 1.0)
+	waitForRoute(t, n1, "node2", "node2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := n1.MeasureClockSkew(ctx, "node2", time.Minute)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the context deadline to end the measurement, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("measurement did not stop when the context was done")
+	}
+}
+
+func TestReservedServiceNames(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	defer n1.Shutdown()
+	for _, service := range []string{clockService, ReservedServicePrefix + "mine"} {
+		_, err := n1.ListenPacket(service)
+		if err == nil {
+			t.Fatalf("listened for packets on reserved service %s", service)
+		}
+		_, err = n1.Listen(service, nil)
+		if err == nil {
+			t.Fatalf("listened on reserved service %s", service)
+		}
+	}
+	// Services that merely share a name with an internal service are still allowed
+	pc, err := n1.ListenPacket("clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pc.Close()
+}
@@ -0,0 +1,200 @@
+package netceptor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// MsgTypeCompressed is a message whose type byte is followed by a compression algorithm ID and
+// the compressed message.  It is only sent to peers that advertised support for the algorithm.
+const MsgTypeCompressed = 4
+
+// DefaultCompressionThreshold is the length below which messages are sent uncompressed
+const DefaultCompressionThreshold = 512
+
+// maxDecompressedLength is the longest message a compressed message may expand to
+const maxDecompressedLength = 1 << 20
+
+// compressionAlgorithm is a way of compressing messages
+type compressionAlgorithm struct {
+	id         byte
+	compress   func([]byte) ([]byte, error)
+	decompress func([]byte) (io.ReadCloser, error)
+}
+
+// compressionAlgorithms are the algorithms this node can compress and decompress, by name
+var compressionAlgorithms = map[string]*compressionAlgorithm{
+	"zlib": {
+		id: 1,
+		compress: func(data []byte) ([]byte, error) {
+			buf := &bytes.Buffer{}
+			w := zlib.NewWriter(buf)
+			_, err := w.Write(data)
+			if err != nil {
+				return nil, err
+			}
+			err = w.Close()
+			if err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decompress: func(data []byte) (io.ReadCloser, error) {
+			return zlib.NewReader(bytes.NewReader(data))
+		},
+	},
+}
+
+// supportedCompression returns the names of the algorithms this node can decompress
+func supportedCompression() []string {
+	names := make([]string, 0, len(compressionAlgorithms))
+	for name := range compressionAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compressionByID returns the algorithm with the given ID
+func compressionByID(id byte) (*compressionAlgorithm, bool) {
+	for _, ca := range compressionAlgorithms {
+		if ca.id == id {
+			return ca, true
+		}
+	}
+	return nil, false
+}
+
+// SetCompression sets the algorithm used to compress messages sent to peers, and the length below
+// which messages are sent uncompressed.  Every node advertises the algorithms it supports when a
+// session is established, and a peer that does not advertise the algorithm is sent uncompressed
+// messages.  The algorithm "none" disables compression.  Only sessions established afterwards are
+// affected.
+func (s *Netceptor) SetCompression(algorithm string, threshold int) error {
+	if threshold < 0 {
+		return fmt.Errorf("compression threshold must not be negative")
+	}
+	if algorithm == "none" {
+		algorithm = ""
+	}
+	if algorithm != "" {
+		_, ok := compressionAlgorithms[algorithm]
+		if !ok {
+			return fmt.Errorf("unknown compression algorithm %s", algorithm)
+		}
+	}
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	s.compression = algorithm
+	s.compressionThreshold = threshold
+	return nil
+}
+
+// compressingSession wraps a BackendSession, compressing outgoing messages once the peer has
+// advertised support for the algorithm, and decompressing incoming compressed messages
+type compressingSession struct {
+	sess      BackendSession
+	algorithm *compressionAlgorithm
+	threshold int
+	// negotiated is set to 1 once the peer has advertised support for the algorithm
+	negotiated int32
+}
+
+// newCompressingSession wraps a session.  Sessions are wrapped even if compression is disabled,
+// as they must still decompress messages from peers that compress.
+func (s *Netceptor) newCompressingSession(sess BackendSession) *compressingSession {
+	s.backendLock.RLock()
+	defer s.backendLock.RUnlock()
+	return &compressingSession{
+		sess:      sess,
+		algorithm: compressionAlgorithms[s.compression],
+		threshold: s.compressionThreshold,
+	}
+}
+
+// negotiate enables compression if the peer supports the session's algorithm
+func (cs *compressingSession) negotiate(peerSupports []string) {
+	if cs.algorithm == nil {
+		return
+	}
+	for _, name := range peerSupports {
+		ca, ok := compressionAlgorithms[name]
+		if ok && ca == cs.algorithm {
+			atomic.StoreInt32(&cs.negotiated, 1)
+			return
+		}
+	}
+}
+
+// Send sends a message, compressed if that has been negotiated and makes it shorter
+func (cs *compressingSession) Send(data []byte) error {
+	if atomic.LoadInt32(&cs.negotiated) == 0 || len(data) < cs.threshold {
+		return cs.sess.Send(data)
+	}
+	compressed, err := cs.algorithm.compress(data)
+	if err != nil {
+		return err
+	}
+	if len(compressed)+2 >= len(data) {
+		return cs.sess.Send(data)
+	}
+	msg := make([]byte, len(compressed)+2)
+	msg[0] = MsgTypeCompressed
+	msg[1] = cs.algorithm.id
+	copy(msg[2:], compressed)
+	return cs.sess.Send(msg)
+}
+
+// Recv receives a message, decompressing it if it is compressed.  Messages that cannot be
+// decompressed are dropped.
+func (cs *compressingSession) Recv(timeout time.Duration) ([]byte, error) {
+	for {
+		data, err := cs.sess.Recv(timeout)
+		if err != nil || len(data) == 0 || data[0] != MsgTypeCompressed {
+			return data, err
+		}
+		data, err = decompressMessage(data)
+		if err == nil {
+			return data, nil
+		}
+		sublogger.Warning("Dropping compressed message: %s\n", err)
+	}
+}
+
+// Close closes the underlying session
+func (cs *compressingSession) Close() error {
+	return cs.sess.Close()
+}
+
+// decompressMessage returns the message contained in a compressed message
+func decompressMessage(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("compressed message is too short")
+	}
+	ca, ok := compressionByID(data[1])
+	if !ok {
+		return nil, fmt.Errorf("unknown compression algorithm ID %d", data[1])
+	}
+	r, err := ca.decompress(data[2:])
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	msg, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > maxDecompressedLength {
+		return nil, fmt.Errorf("compressed message expands to more than %d bytes", maxDecompressedLength)
+	}
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("compressed message is empty")
+	}
+	return msg, nil
+}
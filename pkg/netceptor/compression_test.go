@@ -0,0 +1,79 @@
+package netceptor
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// loopbackSession is a BackendSession that receives whatever it sends
+type loopbackSession struct {
+	frames chan []byte
+}
+
+func (ls *loopbackSession) Send(data []byte) error {
+	ls.frames <- data
+	return nil
+}
+
+func (ls *loopbackSession) Recv(timeout time.Duration) ([]byte, error) {
+	select {
+	case data := <-ls.frames:
+		return data, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+func (ls *loopbackSession) Close() error {
+	return nil
+}
+
+func TestCompressingSession(t *testing.T) {
+	wire := &loopbackSession{frames: make(chan []byte, 1)}
+	cs := &compressingSession{
+		sess:      wire,
+		algorithm: compressionAlgorithms["zlib"],
+		threshold: 64,
+	}
+	large := append([]byte{MsgTypeData}, bytes.Repeat([]byte("receptor"), 100)...)
+	small := []byte{MsgTypeData, 'h', 'i'}
+
+	// Nothing is compressed until the peer advertises support
+	cs.negotiate([]string{"lz4"})
+	err := cs.Send(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame := <-wire.frames; !bytes.Equal(frame, large) {
+		t.Fatal("message was compressed for a peer that does not support it")
+	}
+
+	cs.negotiate(supportedCompression())
+	for _, msg := range [][]byte{large, small} {
+		err = cs.Send(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := <-wire.frames
+		compressed := frame[0] == MsgTypeCompressed
+		if compressed != (len(msg) >= cs.threshold) {
+			t.Fatalf("message of length %d compressed: %v", len(msg), compressed)
+		}
+		wire.frames <- frame
+		data, err := cs.Recv(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, msg) {
+			t.Fatal("message did not survive compression")
+		}
+	}
+
+	// A message that fails to decompress is dropped
+	wire.frames <- []byte{MsgTypeCompressed, 1, 'x'}
+	_, err = cs.Recv(100 * time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("expected the corrupt message to be dropped, got %v", err)
+	}
+}
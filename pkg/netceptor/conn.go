@@ -35,8 +35,16 @@ type Listener struct {
 
 // Internal implementation of Listen and ListenAndAdvertise
 func (s *Netceptor) listen(ctx context.Context, service string, tls *tls.Config, advertise bool, adTags map[string]string) (*Listener, error) {
-	if len(service) > 8 {
-		return nil, fmt.Errorf("service name %s too long", service)
+	return s.listenWithPolicy(ctx, service, tls, advertise, adTags, nil)
+}
+
+// Internal implementation of listening with an access policy.  A nil policy leaves any policy
+// already set for the service in place.
+func (s *Netceptor) listenWithPolicy(ctx context.Context, service string, tls *tls.Config, advertise bool,
+	adTags map[string]string, policy *ServiceAccessPolicy) (*Listener, error) {
+	err := checkServiceName(service)
+	if err != nil {
+		return nil, err
 	}
 	if service == "" {
 		service = s.getEphemeralService()
@@ -48,6 +56,9 @@ func (s *Netceptor) listen(ctx context.Context, service string, tls *tls.Config,
 	if isReserved || isListening {
 		return nil, fmt.Errorf("service %s is already listening", service)
 	}
+	if policy != nil {
+		s.SetServiceAccessPolicy(service, policy)
+	}
 	_ = s.addNameHash(service)
 	pc := &PacketConn{
 		s:            s,
@@ -62,8 +73,7 @@ func (s *Netceptor) listen(ctx context.Context, service string, tls *tls.Config,
 	if tls == nil {
 		tls = generateServerTLSConfig()
 	} else {
-		tls = tls.Clone()
-		tls.NextProtos = []string{"netceptor"}
+		tls = WithNextProtos(tls, "netceptor")
 	}
 	ql, err := quic.Listen(pc, tls, nil)
 	if err != nil {
@@ -145,6 +155,12 @@ func (li *Listener) acceptLoop() {
 			li.sendResult(nil, err)
 			continue
 		}
+		rAddr, ok := qc.RemoteAddr().(Addr)
+		if ok && !li.s.serviceAccessAllowed(li.pc.localService, rAddr.node) {
+			sublogger.Warning("Rejected connection to service %s from node %s\n", li.pc.localService, rAddr.node)
+			_ = qc.CloseWithError(403, "Access Denied")
+			continue
+		}
 		go func() {
 			ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
 			qs, err := qc.AcceptStream(ctx)
@@ -248,8 +264,17 @@ func (s *Netceptor) Dial(node string, service string, tls *tls.Config) (*Conn, e
 	return s.DialContext(context.Background(), node, service, tls)
 }
 
-// DialContext is like Dial but uses a context to allow timeout or cancellation.
+// DialContext is like Dial but uses a context to allow timeout or cancellation.  If node is blank,
+// the instance of the service is chosen by SelectServiceInstance, using the sticky key of the
+// context if it has one (see WithStickyKey).
 func (s *Netceptor) DialContext(ctx context.Context, node string, service string, tls *tls.Config) (*Conn, error) {
+	if node == "" {
+		var err error
+		node, err = s.SelectServiceInstance(service, stickyKeyFromContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+	}
 	_ = s.addNameHash(node)
 	_ = s.addNameHash(service)
 	pc, err := s.ListenPacket("")
@@ -264,8 +289,7 @@ func (s *Netceptor) DialContext(ctx context.Context, node string, service string
 	if tls == nil {
 		tls = generateClientTLSConfig()
 	} else {
-		tls = tls.Clone()
-		tls.NextProtos = []string{"netceptor"}
+		tls = WithNextProtos(tls, "netceptor")
 	}
 	okChan := make(chan struct{})
 	closeOnce := sync.Once{}
@@ -392,6 +416,12 @@ func (c *Conn) Close() error {
 	return c.qs.Close()
 }
 
+// CloseWrite closes the writer side of the connection, telling the other end there is no more
+// data, while reads continue
+func (c *Conn) CloseWrite() error {
+	return c.qs.Close()
+}
+
 // LocalAddr returns the local address of this connection
 func (c *Conn) LocalAddr() net.Addr {
 	return c.qc.LocalAddr()
@@ -402,6 +432,27 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.qc.RemoteAddr()
 }
 
+// VerifiedPeerChain returns the certificate chain that the other end of this connection presented
+// and that was verified against the TLS config, starting with the peer's own certificate.  It is
+// nil if the peer's certificate was not verified.
+func (c *Conn) VerifiedPeerChain() []*x509.Certificate {
+	chains := c.qc.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0]
+}
+
+// VerifiedPeerCertificate returns the certificate that the other end of this connection presented
+// and that was verified against the TLS config, or nil if there is none
+func (c *Conn) VerifiedPeerCertificate() *x509.Certificate {
+	chain := c.VerifiedPeerChain()
+	if chain == nil {
+		return nil
+	}
+	return chain[0]
+}
+
 // SetDeadline sets both read and write deadlines
 func (c *Conn) SetDeadline(t time.Time) error {
 	return c.qs.SetDeadline(t)
@@ -443,10 +494,10 @@ func generateServerTLSConfig() *tls.Config {
 	if err != nil {
 		panic(err)
 	}
-	return &tls.Config{
+	return HardenTLSConfig(&tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
 		NextProtos:   []string{"netceptor"},
-	}
+	})
 }
 
 func verifyServerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
@@ -463,10 +514,10 @@ func verifyServerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certifi
 }
 
 func generateClientTLSConfig() *tls.Config {
-	return &tls.Config{
+	return HardenTLSConfig(&tls.Config{
 		InsecureSkipVerify:    true,
 		VerifyPeerCertificate: verifyServerCertificate,
 		NextProtos:            []string{"netceptor"},
 		ServerName:            insecureCommonName,
-	}
+	})
 }
@@ -0,0 +1,123 @@
+package netceptor
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Connection directions
+const (
+	// DirectionInbound is a session accepted by a listening backend
+	DirectionInbound = "inbound"
+	// DirectionOutbound is a session made by a dialing backend
+	DirectionOutbound = "outbound"
+)
+
+// SessionInfo describes the network connection underlying a backend session
+type SessionInfo struct {
+	// Direction is DirectionInbound or DirectionOutbound
+	Direction  string
+	RemoteAddr string
+	TLS        bool
+	// PeerCertificates are the certificates the peer presented during the TLS handshake, if any
+	PeerCertificates []*x509.Certificate
+}
+
+// DescribedSession is a BackendSession that can describe its connection.  Implementing it is
+// optional.  SessionInfo may be called at any time while the session is running, including
+// before a TLS handshake has completed.
+type DescribedSession interface {
+	BackendSession
+	SessionInfo() SessionInfo
+}
+
+// ConnectionStatus describes an established backend session
+type ConnectionStatus struct {
+	// NodeID is the remote node, as it identified itself in the Receptor handshake
+	NodeID  string
+	Backend string
+	// Direction is DirectionInbound, DirectionOutbound, or empty if the backend does not say
+	Direction        string
+	RemoteAddr       string
+	Established      time.Time
+	Cost             float64
+	ReceiveCost      float64
+	BytesSent        uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	MessagesReceived uint64
+	TLS              bool
+	// TLSPeer is the subject of the certificate the peer presented during the TLS handshake, if any
+	TLSPeer string
+}
+
+// Connections returns the established backend sessions of this node, sorted by node ID
+func (s *Netceptor) Connections() []*ConnectionStatus {
+	s.connLock.RLock()
+	conns := make([]*ConnectionStatus, 0, len(s.connections))
+	for node, ci := range s.connections {
+		cs := &ConnectionStatus{
+			NodeID:      node,
+			Backend:     ci.BackendName,
+			Established: ci.established,
+			Cost:        ci.Cost,
+			ReceiveCost: ci.ReceiveCost,
+		}
+		ci.sessionStats.lock.Lock()
+		cs.BytesSent = ci.sessionStats.bytesSent
+		cs.BytesReceived = ci.sessionStats.bytesReceived
+		cs.MessagesSent = ci.sessionStats.messagesSent
+		cs.MessagesReceived = ci.sessionStats.messagesReceived
+		ci.sessionStats.lock.Unlock()
+		if ci.described != nil {
+			si := ci.described.SessionInfo()
+			cs.Direction = si.Direction
+			cs.RemoteAddr = si.RemoteAddr
+			cs.TLS = si.TLS
+			if len(si.PeerCertificates) > 0 {
+				cs.TLSPeer = si.PeerCertificates[0].Subject.String()
+			}
+		}
+		conns = append(conns, cs)
+	}
+	s.connLock.RUnlock()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].NodeID < conns[j].NodeID
+	})
+	return conns
+}
+
+// Disconnect closes the established backend session with a node.  Routes through the node are
+// withdrawn as for any other closed session.  A dialing backend will connect again afterwards.
+func (s *Netceptor) Disconnect(nodeID string) error {
+	s.connLock.RLock()
+	ci, ok := s.connections[nodeID]
+	s.connLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no connection to node %s", nodeID)
+	}
+	sublogger.Info("Disconnecting from %s\n", nodeID)
+	ci.CancelFunc()
+	return nil
+}
+
+// DisconnectAll closes all established backend sessions and returns the IDs of the nodes
+// that were disconnected, sorted
+func (s *Netceptor) DisconnectAll() []string {
+	s.connLock.RLock()
+	nodes := make([]string, 0, len(s.connections))
+	cancels := make([]func(), 0, len(s.connections))
+	for node, ci := range s.connections {
+		nodes = append(nodes, node)
+		cancels = append(cancels, ci.CancelFunc)
+	}
+	s.connLock.RUnlock()
+	for i := range nodes {
+		sublogger.Info("Disconnecting from %s\n", nodes[i])
+		cancels[i]()
+	}
+	sort.Strings(nodes)
+	return nodes
+}
@@ -0,0 +1,68 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConnections(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	if len(n1.Connections()) != 0 {
+		t.Fatal("connections listed before any were established")
+	}
+	linkNodes(t, n1, n2, "link", 2.0)
+	waitForConnection(t, n1, "node2", true)
+	conns := n1.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(conns))
+	}
+	cs := conns[0]
+	if cs.NodeID != "node2" || cs.Backend != "link" || cs.Cost != 2.0 {
+		t.Fatalf("unexpected connection %+v", cs)
+	}
+	if cs.Established.IsZero() || time.Since(cs.Established) > 10*time.Second {
+		t.Fatalf("unexpected established time %s", cs.Established)
+	}
+	if cs.MessagesReceived == 0 || cs.BytesReceived == 0 || cs.MessagesSent == 0 || cs.BytesSent == 0 {
+		t.Fatalf("handshake traffic was not counted: %+v", cs)
+	}
+	// The external backend does not describe its sessions
+	if cs.Direction != "" || cs.TLS {
+		t.Fatalf("unexpected session details %+v", cs)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	linkNodes(t, n1, n2, "", 1.0)
+	waitForConnection(t, n1, "node2", true)
+
+	if n1.Disconnect("node3") == nil {
+		t.Fatal("disconnecting from an unconnected node did not fail")
+	}
+	err := n1.Disconnect("node2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForConnection(t, n1, "node2", false)
+	// The peer notices the session was closed and withdraws its route too
+	waitForConnection(t, n2, "node1", false)
+	if len(n1.DisconnectAll()) != 0 {
+		t.Fatal("disconnected from nodes after all connections were closed")
+	}
+}
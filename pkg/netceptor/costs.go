@@ -0,0 +1,72 @@
+package netceptor
+
+import (
+	"fmt"
+	"math"
+)
+
+// BackendCosts are the routing costs of the connections made by a backend.
+//
+// Each node advertises, in its routing updates, the cost of sending to each of its peers.  Every
+// node builds a directed graph from these advertisements and picks the path to each destination
+// with the lowest sum of the costs of its hops, in the direction traffic flows.  So the path from
+// A to C via B costs the send cost A advertises for B plus the send cost B advertises for C, and
+// the path back may be different if the costs differ by direction.
+//
+// The two ends of a connection must agree on its costs: what one side sends at must be what the
+// other receives at.  If they do not, the connection is dropped.  For an asymmetric link, such as
+// a satellite link with a fast downlink and a slow uplink, configure each side with the other's
+// costs swapped.
+type BackendCosts struct {
+	// Cost is the cost of sending to a peer over a connection
+	Cost float64
+	// ReceiveCost is the cost of a peer sending to this node over a connection.  If 0, it is the
+	// same as the send cost.
+	ReceiveCost float64
+	// NodeCost overrides Cost for the connections to particular peers.  The receive cost of those
+	// connections is then ReceiveCost if it is set, or their send cost if not.
+	NodeCost map[string]float64
+}
+
+// validCost returns an error if a cost is not a finite positive number
+func validCost(cost float64) error {
+	if cost <= 0.0 || math.IsInf(cost, 0) || math.IsNaN(cost) {
+		return fmt.Errorf("connection cost must be positive")
+	}
+	return nil
+}
+
+// Validate checks that all the costs are positive
+func (bc BackendCosts) Validate() error {
+	err := validCost(bc.Cost)
+	if err != nil {
+		return err
+	}
+	if bc.ReceiveCost != 0.0 {
+		err = validCost(bc.ReceiveCost)
+		if err != nil {
+			return fmt.Errorf("receive cost must be positive")
+		}
+	}
+	for node, cost := range bc.NodeCost {
+		err = validCost(cost)
+		if err != nil {
+			return fmt.Errorf("connection cost must be positive for %s", node)
+		}
+	}
+	return nil
+}
+
+// costsTo returns the send and receive costs of a connection to a peer
+func (bc BackendCosts) costsTo(remoteNodeID string) (float64, float64) {
+	sendCost := bc.Cost
+	nodeCost, ok := bc.NodeCost[remoteNodeID]
+	if ok {
+		sendCost = nodeCost
+	}
+	receiveCost := bc.ReceiveCost
+	if receiveCost == 0.0 {
+		receiveCost = sendCost
+	}
+	return sendCost, receiveCost
+}
@@ -0,0 +1,59 @@
+package netceptor
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBackendCosts(t *testing.T) {
+	invalid := []BackendCosts{
+		{Cost: 0},
+		{Cost: -1},
+		{Cost: math.Inf(1)},
+		{Cost: 1, ReceiveCost: -1},
+		{Cost: 1, ReceiveCost: math.NaN()},
+		{Cost: 1, NodeCost: map[string]float64{"node2": 0}},
+	}
+	for _, bc := range invalid {
+		if bc.Validate() == nil {
+			t.Fatalf("invalid costs %+v were accepted", bc)
+		}
+	}
+
+	bc := BackendCosts{Cost: 1, NodeCost: map[string]float64{"node2": 3}}
+	err := bc.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send, receive := bc.costsTo("node3")
+	if send != 1 || receive != 1 {
+		t.Fatalf("unexpected costs %f/%f without a receive cost", send, receive)
+	}
+	send, receive = bc.costsTo("node2")
+	if send != 3 || receive != 3 {
+		t.Fatalf("unexpected costs %f/%f for a node cost without a receive cost", send, receive)
+	}
+	bc.ReceiveCost = 10
+	send, receive = bc.costsTo("node2")
+	if send != 3 || receive != 10 {
+		t.Fatalf("unexpected costs %f/%f with a receive cost", send, receive)
+	}
+}
+
+func TestAsymmetricRoutes(t *testing.T) {
+	// node1 and node2 are joined by a link that is cheap from node1 to node2 and expensive back,
+	// and by a path of symmetric links via node3
+	costs := map[string]map[string]float64{
+		"node1": {"node2": 1.0, "node3": 2.0},
+		"node2": {"node1": 10.0, "node3": 2.0},
+		"node3": {"node1": 2.0, "node2": 2.0},
+	}
+	routes, pathCosts := computeRoutes("node1", costs)
+	if routes["node2"] != "node2" || pathCosts["node2"] != 1.0 {
+		t.Fatalf("unexpected route %s (cost %f) from node1 to node2", routes["node2"], pathCosts["node2"])
+	}
+	routes, pathCosts = computeRoutes("node2", costs)
+	if routes["node1"] != "node3" || pathCosts["node1"] != 4.0 {
+		t.Fatalf("unexpected route %s (cost %f) from node2 to node1", routes["node1"], pathCosts["node1"])
+	}
+}
@@ -0,0 +1,25 @@
+package netceptor
+
+import (
+	"time"
+)
+
+// DefaultHandshakeTimeout is how long a new backend session has to become established
+const DefaultHandshakeTimeout = 30 * time.Second
+
+// SetHandshakeTimeout sets how long a new backend session may take, from the time the backend
+// hands it over until the remote node has identified itself, before it is dropped.  For listeners
+// that use TLS, this includes the TLS handshake, which runs on the first read or write of the
+// session.  Dropped sessions are counted in BackendStats.  Zero disables the limit.
+func (s *Netceptor) SetHandshakeTimeout(timeout time.Duration) {
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	s.handshakeTimeout = timeout
+}
+
+// HandshakeTimeout returns how long a new backend session may take to become established
+func (s *Netceptor) HandshakeTimeout() time.Duration {
+	s.backendLock.RLock()
+	defer s.backendLock.RUnlock()
+	return s.handshakeTimeout
+}
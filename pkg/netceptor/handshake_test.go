@@ -0,0 +1,64 @@
+package netceptor
+
+import (
+	"context"
+	"github.com/prep/socketpair"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	n := New(context.Background(), "node1", nil)
+	defer func() {
+		n.Shutdown()
+		n.BackendWait()
+	}()
+	if n.HandshakeTimeout() != DefaultHandshakeTimeout {
+		t.Fatalf("unexpected default handshake timeout %s", n.HandshakeTimeout())
+	}
+	timeout := 500 * time.Millisecond
+	n.SetHandshakeTimeout(timeout)
+	b, err := NewExternalBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.AddNamedBackend("stalled", b, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2, err := socketpair.New("unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = c2.Close()
+	}()
+	start := time.Now()
+	b.NewConnection(c1, true)
+
+	// Send the start of a frame and then stall, as a peer stuck mid-handshake would
+	_, err = c2.Write([]byte{4, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MTU)
+	for {
+		_, err = c2.Read(buf)
+		if err != nil {
+			break
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < timeout || elapsed > timeout+2*time.Second {
+		t.Fatalf("stalled session was dropped after %s, expected about %s (%v)", elapsed, timeout, err)
+	}
+	for _, bs := range n.BackendStats() {
+		if bs.Name == "stalled" && bs.HandshakeTimeouts != 1 {
+			t.Fatalf("expected one handshake timeout, got %d", bs.HandshakeTimeouts)
+		}
+	}
+	if len(n.Status().Connections) != 0 {
+		t.Fatal("stalled session was established")
+	}
+}
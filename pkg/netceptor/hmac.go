@@ -0,0 +1,285 @@
+package netceptor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hmacKeyring holds the pre-shared keys used to sign and verify backend frames.  Frames are
+// signed with the primary key and accepted if they verify against any key, so a key can be
+// rotated across a mesh by adding the new key everywhere, making it primary, and then removing
+// the old one.
+type hmacKeyring struct {
+	lock    *sync.RWMutex
+	keys    map[string][]byte
+	primary string
+}
+
+// newHMACKeyring allocates a new, empty keyring
+func newHMACKeyring() *hmacKeyring {
+	return &hmacKeyring{
+		lock: &sync.RWMutex{},
+		keys: make(map[string][]byte),
+	}
+}
+
+// enabled returns true if the keyring has any keys
+func (kr *hmacKeyring) enabled() bool {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return len(kr.keys) > 0
+}
+
+// hmacSeqLen is the length of the sequence number that follows the data of a signed frame
+const hmacSeqLen = 8
+
+// hmacNonceLen is the length of the random nonce each side of a session sends when it starts
+const hmacNonceLen = 16
+
+// hmacTag computes the tag of a frame's sequence number and data, bound to the receiving side's
+// session nonce
+func hmacTag(key []byte, nonce []byte, seq []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(nonce)
+	_, _ = mac.Write(seq)
+	_, _ = mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// sign returns the data followed by the sequence number and an HMAC-SHA256 tag of both and the
+// receiver's nonce, computed using the primary key
+func (kr *hmacKeyring) sign(nonce []byte, data []byte, seq uint64) []byte {
+	kr.lock.RLock()
+	key := kr.keys[kr.primary]
+	kr.lock.RUnlock()
+	signed := make([]byte, len(data)+hmacSeqLen, len(data)+hmacSeqLen+sha256.Size)
+	copy(signed, data)
+	seqBytes := signed[len(data):]
+	binary.BigEndian.PutUint64(seqBytes, seq)
+	return append(signed, hmacTag(key, nonce, seqBytes, data)...)
+}
+
+// verify checks the tag of a signed frame against every key and the receiver's nonce, returning
+// the data and sequence number
+func (kr *hmacKeyring) verify(nonce []byte, frame []byte) ([]byte, uint64, bool) {
+	if len(frame) < hmacSeqLen+sha256.Size {
+		return nil, 0, false
+	}
+	data := frame[:len(frame)-hmacSeqLen-sha256.Size]
+	seqBytes := frame[len(data) : len(data)+hmacSeqLen]
+	tag := frame[len(frame)-sha256.Size:]
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	for _, key := range kr.keys {
+		if hmac.Equal(hmacTag(key, nonce, seqBytes, data), tag) {
+			return data, binary.BigEndian.Uint64(seqBytes), true
+		}
+	}
+	return nil, 0, false
+}
+
+// hmacSession wraps a BackendSession, signing outgoing frames and dropping incoming frames that
+// do not verify against the keyring.  Each side starts the session by sending a random nonce, and
+// frames are signed together with the nonce of the side receiving them, so frames recorded on one
+// session do not verify on any other.  Each frame is also signed with a sequence number that
+// increases by one with every frame sent on the session, and frames whose sequence number is not
+// above that of the last frame received are dropped, so frames cannot be replayed or reordered
+// within the session either.
+type hmacSession struct {
+	sess       BackendSession
+	keys       *hmacKeyring
+	localNonce []byte
+	peerNonce  []byte
+	peerReady  chan struct{}
+	closed     chan struct{}
+	closeOnce  sync.Once
+	sendLock   sync.Mutex
+	sendSeq    uint64
+	recvSeq    uint64
+}
+
+// newHMACSession wraps a session and sends it a fresh nonce
+func newHMACSession(sess BackendSession, keys *hmacKeyring) (*hmacSession, error) {
+	hs := &hmacSession{
+		sess:       sess,
+		keys:       keys,
+		localNonce: make([]byte, hmacNonceLen),
+		peerReady:  make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	_, err := rand.Read(hs.localNonce)
+	if err != nil {
+		return nil, err
+	}
+	err = sess.Send(hs.localNonce)
+	if err != nil {
+		return nil, err
+	}
+	return hs, nil
+}
+
+// Send signs and sends a frame, once the peer's nonce has arrived
+func (hs *hmacSession) Send(data []byte) error {
+	select {
+	case <-hs.peerReady:
+	case <-hs.closed:
+		return fmt.Errorf("session closed")
+	}
+	hs.sendLock.Lock()
+	defer hs.sendLock.Unlock()
+	hs.sendSeq++
+	return hs.sess.Send(hs.keys.sign(hs.peerNonce, data, hs.sendSeq))
+}
+
+// Recv returns the next frame that verifies against the keyring
+func (hs *hmacSession) Recv(timeout time.Duration) ([]byte, error) {
+	for {
+		frame, err := hs.sess.Recv(timeout)
+		if err != nil {
+			return nil, err
+		}
+		if hs.peerNonce == nil {
+			if len(frame) != hmacNonceLen {
+				return nil, fmt.Errorf("expected a %d byte HMAC session nonce, got %d bytes", hmacNonceLen, len(frame))
+			}
+			hs.peerNonce = frame
+			close(hs.peerReady)
+			continue
+		}
+		data, seq, ok := hs.keys.verify(hs.localNonce, frame)
+		if !ok {
+			sublogger.Warning("Dropping backend frame that failed HMAC verification\n")
+			continue
+		}
+		if seq <= hs.recvSeq {
+			sublogger.Warning("Dropping replayed or reordered backend frame %d, expected one after %d\n", seq, hs.recvSeq)
+			continue
+		}
+		hs.recvSeq = seq
+		return data, nil
+	}
+}
+
+// Close closes the underlying session
+func (hs *hmacSession) Close() error {
+	hs.closeOnce.Do(func() {
+		close(hs.closed)
+	})
+	return hs.sess.Close()
+}
+
+// AddHMACKey adds a pre-shared key that backend frames are accepted under.  The first key added
+// becomes the primary key, which outgoing frames are signed with.  Sessions only use HMAC if
+// there was at least one key when they were established, so all nodes on a link must be given
+// a key before the link is brought up.
+func (s *Netceptor) AddHMACKey(keyID string, key []byte) error {
+	if keyID == "" {
+		return fmt.Errorf("key ID must not be blank")
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("key must not be empty")
+	}
+	kr := s.hmacKeys
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	_, ok := kr.keys[keyID]
+	if ok {
+		return fmt.Errorf("key %s already exists", keyID)
+	}
+	kr.keys[keyID] = append([]byte{}, key...)
+	if kr.primary == "" {
+		kr.primary = keyID
+	}
+	return nil
+}
+
+// SetPrimaryHMACKey selects the key that outgoing frames are signed with
+func (s *Netceptor) SetPrimaryHMACKey(keyID string) error {
+	kr := s.hmacKeys
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	_, ok := kr.keys[keyID]
+	if !ok {
+		return fmt.Errorf("unknown key %s", keyID)
+	}
+	kr.primary = keyID
+	return nil
+}
+
+// RemoveHMACKey stops accepting frames signed with a key.  The primary key cannot be removed.
+func (s *Netceptor) RemoveHMACKey(keyID string) error {
+	kr := s.hmacKeys
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	_, ok := kr.keys[keyID]
+	if !ok {
+		return fmt.Errorf("unknown key %s", keyID)
+	}
+	if keyID == kr.primary {
+		return fmt.Errorf("cannot remove primary key %s", keyID)
+	}
+	delete(kr.keys, keyID)
+	return nil
+}
+
+// HMACKeys returns the IDs of the accepted keys, sorted, and the ID of the primary key
+func (s *Netceptor) HMACKeys() ([]string, string) {
+	kr := s.hmacKeys
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	keyIDs := make([]string, 0, len(kr.keys))
+	for keyID := range kr.keys {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	return keyIDs, kr.primary
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// HMACKeyCfg is the cmdline configuration object for a backend HMAC key
+type HMACKeyCfg struct {
+	KeyID   string `required:"true" description:"Name of this key"`
+	Key     string `required:"false" description:"The pre-shared key"`
+	KeyFile string `required:"false" description:"File to read the pre-shared key from"`
+	Primary bool   `required:"false" description:"Sign outgoing frames with this key" default:"false"`
+}
+
+// Prepare adds the key to the main instance
+func (cfg HMACKeyCfg) Prepare() error {
+	key := []byte(cfg.Key)
+	if cfg.KeyFile != "" {
+		if cfg.Key != "" {
+			return fmt.Errorf("only one of key and keyfile may be given")
+		}
+		var err error
+		key, err = ioutil.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("error reading key file: %s", err)
+		}
+		key = bytes.TrimSpace(key)
+	}
+	err := MainInstance.AddHMACKey(cfg.KeyID, key)
+	if err != nil {
+		return err
+	}
+	if cfg.Primary {
+		return MainInstance.SetPrimaryHMACKey(cfg.KeyID)
+	}
+	return nil
+}
+
+func init() {
+	cmdline.AddConfigType("hmac-key", "Define a pre-shared key for signing backend frames", HMACKeyCfg{}, false, false, false, false, configSection)
+}
@@ -0,0 +1,297 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHMACKeyRotation(t *testing.T) {
+	n := New(context.Background(), "node1", nil)
+	defer n.Shutdown()
+	if n.hmacKeys.enabled() {
+		t.Fatal("HMAC was enabled without any keys")
+	}
+	err := n.AddHMACKey("old", []byte("old secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello")
+	nonce := []byte("0123456789abcdef")
+	signedOld := n.hmacKeys.sign(nonce, msg, 1)
+
+	// During the rotation window, frames signed with either key are accepted
+	err = n.AddHMACKey("new", []byte("new secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyIDs, primary := n.HMACKeys()
+	if len(keyIDs) != 2 || primary != "old" {
+		t.Fatalf("unexpected keys %v with primary %s", keyIDs, primary)
+	}
+	err = n.SetPrimaryHMACKey("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedNew := n.hmacKeys.sign(nonce, msg, 2)
+	for name, frame := range map[string][]byte{"old": signedOld, "new": signedNew} {
+		data, _, ok := n.hmacKeys.verify(nonce, frame)
+		if !ok || string(data) != "hello" {
+			t.Fatalf("frame signed with the %s key was rejected during rotation", name)
+		}
+	}
+
+	// Once the old key is removed, only the new key is accepted
+	err = n.RemoveHMACKey("new")
+	if err == nil {
+		t.Fatal("the primary key was removed")
+	}
+	err = n.RemoveHMACKey("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ok := n.hmacKeys.verify(nonce, signedOld)
+	if ok {
+		t.Fatal("frame signed with the removed key was accepted")
+	}
+	data, seq, ok := n.hmacKeys.verify(nonce, signedNew)
+	if !ok || string(data) != "hello" || seq != 2 {
+		t.Fatal("frame signed with the new key was rejected after rotation")
+	}
+	tampered := append([]byte{}, signedNew...)
+	tampered[0] = 'j'
+	_, _, ok = n.hmacKeys.verify(nonce, tampered)
+	if ok {
+		t.Fatal("tampered frame was accepted")
+	}
+	renumbered := append([]byte{}, signedNew...)
+	renumbered[len(msg)+hmacSeqLen-1] = 9
+	_, _, ok = n.hmacKeys.verify(nonce, renumbered)
+	if ok {
+		t.Fatal("frame with a changed sequence number was accepted")
+	}
+	_, _, ok = n.hmacKeys.verify([]byte("fedcba9876543210"), signedNew)
+	if ok {
+		t.Fatal("frame signed for another session nonce was accepted")
+	}
+}
+
+// pipeSession is one end of a pair of sessions that sends and receives on separate channels
+type pipeSession struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (ps *pipeSession) Send(data []byte) error {
+	ps.out <- data
+	return nil
+}
+
+func (ps *pipeSession) Recv(timeout time.Duration) ([]byte, error) {
+	select {
+	case data := <-ps.in:
+		return data, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+func (ps *pipeSession) Close() error {
+	return nil
+}
+
+// newTestHMACSession starts an HMAC session that sends on out and receives on in
+func newTestHMACSession(t *testing.T, kr *hmacKeyring, in chan []byte, out chan []byte) *hmacSession {
+	hs, err := newHMACSession(&pipeSession{in: in, out: out}, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hs
+}
+
+// receiveNonce has an HMAC session take in the nonce its peer has sent, so that it can send
+func receiveNonce(t *testing.T, hs *hmacSession) {
+	_, err := hs.Recv(10 * time.Millisecond)
+	if err != ErrTimeout || hs.peerNonce == nil {
+		t.Fatalf("session did not receive a nonce: %v", err)
+	}
+}
+
+// expectFrames checks that an HMAC session receives the given frames and then nothing more
+func expectFrames(t *testing.T, hs *hmacSession, want ...string) {
+	for _, w := range want {
+		data, err := hs.Recv(time.Second)
+		if err != nil {
+			t.Fatalf("expected %s: %s", w, err)
+		}
+		if string(data) != w {
+			t.Fatalf("expected %s, got %s", w, data)
+		}
+	}
+	_, err := hs.Recv(100 * time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("expected no more frames, got %v", err)
+	}
+}
+
+func TestHMACSessionReplay(t *testing.T) {
+	kr := newHMACKeyring()
+	kr.keys["key"] = []byte("secret")
+	kr.primary = "key"
+	toReceiver := make(chan []byte, 10)
+	toSender := make(chan []byte, 10)
+	sender := newTestHMACSession(t, kr, toSender, toReceiver)
+	receiver := newTestHMACSession(t, kr, toReceiver, toSender)
+	receiveNonce(t, sender)
+	for _, msg := range []string{"one", "two", "three"} {
+		err := sender.Send([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorded := make([][]byte, 0)
+	for i := 0; i < 4; i++ {
+		recorded = append(recorded, <-toReceiver)
+	}
+
+	// Replayed and reordered frames are dropped, so only "one", "three" and "four" arrive
+	for _, frame := range [][]byte{recorded[0], recorded[1], recorded[1], recorded[3], recorded[2], recorded[3]} {
+		toReceiver <- frame
+	}
+	err := sender.Send([]byte("four"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFrames(t, receiver, "one", "three", "four")
+}
+
+func TestHMACSessionCrossSessionReplay(t *testing.T) {
+	kr := newHMACKeyring()
+	kr.keys["key"] = []byte("secret")
+	kr.primary = "key"
+
+	// Record a whole session, including the sender's nonce
+	toReceiver := make(chan []byte, 10)
+	toSender := make(chan []byte, 10)
+	sender := newTestHMACSession(t, kr, toSender, toReceiver)
+	receiver := newTestHMACSession(t, kr, toReceiver, toSender)
+	receiveNonce(t, sender)
+	for _, msg := range []string{"one", "two"} {
+		err := sender.Send([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorded := make([][]byte, 0)
+	for i := 0; i < 3; i++ {
+		frame := <-toReceiver
+		recorded = append(recorded, frame)
+		toReceiver <- frame
+	}
+	expectFrames(t, receiver, "one", "two")
+
+	// Replaying the recording on a fresh session delivers nothing, as that session has a new nonce
+	toVictim := make(chan []byte, 10)
+	toAttacker := make(chan []byte, 10)
+	victim := newTestHMACSession(t, kr, toVictim, toAttacker)
+	for _, frame := range recorded {
+		toVictim <- frame
+	}
+	expectFrames(t, victim)
+
+	// Frames a session sends are not accepted if reflected back to it
+	err := victim.Send([]byte("reflected"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-toAttacker
+	toVictim <- <-toAttacker
+	expectFrames(t, victim)
+}
+
+// sendHello sends a packet from one node to another and waits for it to arrive
+func sendHello(t *testing.T, from *Netceptor, to *Netceptor, service string) {
+	listener, err := to.ListenPacket(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sender, err := from.ListenPacket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	_, err = sender.WriteTo([]byte("hello"), from.NewAddr(to.NodeID(), service))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_ = listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("packet from %s to %s was not delivered: %s", from.NodeID(), to.NodeID(), err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected data %q", buf[:n])
+	}
+}
+
+func TestHMACLink(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	n3 := New(context.Background(), "node3", nil)
+	defer func() {
+		for _, n := range []*Netceptor{n1, n2, n3} {
+			n.Shutdown()
+		}
+		for _, n := range []*Netceptor{n1, n2, n3} {
+			n.BackendWait()
+		}
+	}()
+	for _, n := range []*Netceptor{n1, n2} {
+		err := n.AddHMACKey("old", []byte("old secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	linkNodes(t, n1, n2, "", 1.0)
+	waitForRoute(t, n1, "node2", "node2")
+	waitForRoute(t, n2, "node1", "node1")
+	sendHello(t, n1, n2, "hello1")
+	sendHello(t, n2, n1, "hello2")
+
+	// Rotate the key one node at a time, while the link stays up
+	for _, n := range []*Netceptor{n1, n2} {
+		err := n.AddHMACKey("new", []byte("new secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := n1.SetPrimaryHMACKey("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendHello(t, n1, n2, "hello3")
+	sendHello(t, n2, n1, "hello4")
+	err = n2.SetPrimaryHMACKey("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []*Netceptor{n1, n2} {
+		err = n.RemoveHMACKey("old")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendHello(t, n1, n2, "hello5")
+	sendHello(t, n2, n1, "hello6")
+
+	// A node that only has the old key cannot connect
+	err = n3.AddHMACKey("old", []byte("old secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkNodes(t, n1, n3, "", 1.0)
+	time.Sleep(time.Second)
+	waitForConnection(t, n1, "node3", false)
+}
@@ -2,9 +2,9 @@ package netceptor
 
 import (
 	"context"
-	"github.com/prep/socketpair"
 	"github.com/project-receptor/receptor/pkg/logger"
 	"log"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -40,50 +40,19 @@ func TestHopCountLimit(t *testing.T) {
 	}
 	log.SetOutput(lw)
 	logger.SetShowTrace(true)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		logger.SetShowTrace(false)
+	}()
 
-	// Create two Netceptor nodes using external backends
+	// Create two Netceptor nodes and connect them
 	n1 := New(context.Background(), "node1", nil)
-	b1, err := NewExternalBackend()
-	if err != nil {
-		t.Fatal(err)
-	}
-	err = n1.AddBackend(b1, 1.0, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
 	n2 := New(context.Background(), "node2", nil)
-	b2, err := NewExternalBackend()
-	if err != nil {
-		t.Fatal(err)
-	}
-	err = n2.AddBackend(b2, 1.0, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// Create a Unix socket pair and use it to connect the backends
-	c1, c2, err := socketpair.New("unix")
-	if err != nil {
-		t.Fatal(err)
-	}
-	b1.NewConnection(c1, true)
-	b2.NewConnection(c2, true)
+	linkNodes(t, n1, n2, "", 1.0)
 
 	// Wait for the nodes to establish routing to each other
-	timeout, _ := context.WithTimeout(context.Background(), 2*time.Second)
-	for {
-		if timeout.Err() != nil {
-			t.Fatal(timeout.Err())
-		}
-		_, ok := n1.Status().RoutingTable["node2"]
-		if ok {
-			_, ok := n2.Status().RoutingTable["node1"]
-			if ok {
-				break
-			}
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
+	waitForRoute(t, n1, "node2", "node2")
+	waitForRoute(t, n2, "node1", "node1")
 
 	// Inject a fake node3 that both nodes think the other node has a route to
 	n1.addNameHash("node3")
@@ -106,7 +75,7 @@ func TestHopCountLimit(t *testing.T) {
 	}
 
 	// If the hop count limit is not working, the connections will never become inactive
-	timeout, _ = context.WithTimeout(context.Background(), 2*time.Second)
+	timeout, _ := context.WithTimeout(context.Background(), 2*time.Second)
 	for {
 		c, ok := n1.connections["node2"]
 		if !ok {
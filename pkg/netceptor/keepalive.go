@@ -0,0 +1,75 @@
+package netceptor
+
+import (
+	"fmt"
+	"time"
+)
+
+// MsgTypeKeepalive is an empty message sent regularly to a peer so it can tell the link is alive.
+// It is only sent to peers that advertised a keepalive interval of their own.
+const MsgTypeKeepalive = 5
+
+// Defaults for keepalives, which declare a link dead after about as long as the route update
+// based timeout used with peers that do not send keepalives
+const (
+	DefaultKeepaliveInterval = RouteUpdateTime
+	DefaultKeepaliveMissed   = 2
+)
+
+// MinKeepaliveInterval is the shortest interval at which keepalives can be sent
+const MinKeepaliveInterval = 100 * time.Millisecond
+
+// legacyConnectionTimeout is how long a link to a peer that does not send keepalives may be
+// silent before it is declared dead.  Such peers still send a route update every RouteUpdateTime.
+const legacyConnectionTimeout = 2*RouteUpdateTime + 1*time.Second
+
+// SetKeepalive sets the interval at which keepalives are sent to peers, and how many of a peer's
+// keepalives may be missed in a row before its link is declared dead and routes through it are
+// withdrawn.  Each node advertises its interval when a session is established, so a link is
+// judged by the interval its peer sends at.  Only sessions established afterwards are affected.
+func (s *Netceptor) SetKeepalive(interval time.Duration, missed int) error {
+	if interval < MinKeepaliveInterval {
+		return fmt.Errorf("keepalive interval must be at least %s", MinKeepaliveInterval)
+	}
+	if missed < 1 {
+		return fmt.Errorf("missed keepalive threshold must be at least 1")
+	}
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	s.keepaliveInterval = interval
+	s.keepaliveMissed = missed
+	return nil
+}
+
+// Keepalive returns the interval at which keepalives are sent, and how many may be missed
+func (s *Netceptor) Keepalive() (time.Duration, int) {
+	s.backendLock.RLock()
+	defer s.backendLock.RUnlock()
+	return s.keepaliveInterval, s.keepaliveMissed
+}
+
+// deadAfter returns how long the link to a peer may be silent before it is declared dead
+func (ci *connInfo) deadAfter() time.Duration {
+	if ci.peerKeepalive <= 0 {
+		return legacyConnectionTimeout
+	}
+	return ci.peerKeepalive * time.Duration(ci.keepaliveMissed)
+}
+
+// sendKeepalives sends a keepalive to the peer at the given interval, until the session ends
+func (ci *connInfo) sendKeepalives(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case ci.WriteChan <- []byte{MsgTypeKeepalive}:
+			case <-ci.Context.Done():
+				return
+			}
+		case <-ci.Context.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveDeadLink(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	if n1.SetKeepalive(time.Millisecond, 2) == nil || n1.SetKeepalive(time.Second, 0) == nil {
+		t.Fatal("invalid keepalive settings were accepted")
+	}
+	for _, n := range []*Netceptor{n1, n2} {
+		err := n.SetKeepalive(200*time.Millisecond, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n1.EnableChaos()
+	linkNodes(t, n1, n2, "link", 1.0)
+	waitForRoute(t, n1, "node2", "node2")
+	timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Keepalives keep a link up through periods without other traffic
+	time.Sleep(time.Second)
+	if _, ok := n1.Status().RoutingTable["node2"]; !ok {
+		t.Fatal("link with keepalives was declared dead")
+	}
+
+	// Silencing the peer, without closing the socket, gets the link declared dead well before the
+	// route update based timeout
+	routes := n1.SubscribeRoutes(timeout)
+	<-routes
+	start := time.Now()
+	err := n1.SetBackendFault("link", BackendFault{DropRate: 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-routes:
+		if ev.Type != RouteRemoved || ev.Node != "node2" {
+			t.Fatalf("unexpected route event %v", ev)
+		}
+	case <-timeout.Done():
+		t.Fatal("dead link was not detected")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("dead link took %s to detect", elapsed)
+	}
+}
@@ -0,0 +1,73 @@
+package netceptor
+
+import (
+	"context"
+	"github.com/prep/socketpair"
+	"testing"
+	"time"
+)
+
+// linkNodes connects two nodes over a socket pair, using a new external backend on each node.  If
+// name is not empty, both backends are added with that name, so they can be managed by name.
+func linkNodes(t *testing.T, n1 *Netceptor, n2 *Netceptor, name string, cost float64) {
+	addBackend := func(n *Netceptor) *ExternalBackend {
+		b, err := NewExternalBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "" {
+			err = n.AddBackend(b, cost, nil)
+		} else {
+			err = n.AddNamedBackend(name, b, cost, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	b1 := addBackend(n1)
+	b2 := addBackend(n2)
+	c1, c2, err := socketpair.New("unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1.NewConnection(c1, true)
+	b2.NewConnection(c2, true)
+}
+
+// waitForRoute waits until n routes traffic for dest via the given neighbor
+func waitForRoute(t *testing.T, n *Netceptor, dest string, via string) {
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		if n.Status().RoutingTable[dest] == via {
+			return
+		}
+		if timeout.Err() != nil {
+			t.Fatalf("timed out waiting for %s to route to %s via %s", n.NodeID(), dest, via)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitForConnection waits until n has (or does not have) a connection to the given node
+func waitForConnection(t *testing.T, n *Netceptor, node string, want bool) {
+	timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		if timeout.Err() != nil {
+			t.Fatalf("timed out waiting for connection state %t to %s", want, node)
+		}
+		found := false
+		for _, conn := range n.Status().Connections {
+			if conn.NodeID == node {
+				found = true
+				break
+			}
+		}
+		if found == want {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,33 @@
+package netceptor
+
+// MaintenanceCostMultiplier is applied to the cost of all connections of a node in maintenance
+// mode when other nodes compute their routes, so that they stop routing transit traffic through it
+const MaintenanceCostMultiplier = 1000.0
+
+// SetMaintenanceMode puts the node into or out of maintenance mode.  While in maintenance mode,
+// the node flags its routing updates, and other nodes treat its connections as costing much more,
+// so traffic between other nodes is routed around it when an alternative path exists.  The
+// advertised costs do not change, so neighbors still agree on them.  The node itself remains
+// reachable.
+func (s *Netceptor) SetMaintenanceMode(enabled bool) {
+	s.connLock.Lock()
+	changed := s.maintenanceMode != enabled
+	s.maintenanceMode = enabled
+	s.connLock.Unlock()
+	if !changed {
+		return
+	}
+	if enabled {
+		sublogger.Info("Entering maintenance mode\n")
+	} else {
+		sublogger.Info("Leaving maintenance mode\n")
+	}
+	s.sendRouteFloodChan <- 0
+}
+
+// MaintenanceMode returns true if the node is in maintenance mode
+func (s *Netceptor) MaintenanceMode() bool {
+	s.connLock.RLock()
+	defer s.connLock.RUnlock()
+	return s.maintenanceMode
+}
@@ -0,0 +1,47 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMaintenanceModeReroutes(t *testing.T) {
+	// Two paths from nodeA to nodeD: a cheaper one through nodeB and a costlier one through nodeC
+	nodes := make(map[string]*Netceptor)
+	for _, id := range []string{"nodeA", "nodeB", "nodeC", "nodeD"} {
+		nodes[id] = New(context.Background(), id, nil)
+	}
+	linkNodes(t, nodes["nodeA"], nodes["nodeB"], "", 1.0)
+	linkNodes(t, nodes["nodeB"], nodes["nodeD"], "", 1.0)
+	linkNodes(t, nodes["nodeA"], nodes["nodeC"], "", 1.0)
+	linkNodes(t, nodes["nodeC"], nodes["nodeD"], "", 2.0)
+	waitForRoute(t, nodes["nodeA"], "nodeD", "nodeB")
+
+	nodes["nodeB"].SetMaintenanceMode(true)
+	if !nodes["nodeB"].Status().MaintenanceMode {
+		t.Fatal("status does not report maintenance mode")
+	}
+	waitForRoute(t, nodes["nodeA"], "nodeD", "nodeC")
+	// The node in maintenance is still reachable directly, and its neighbors did not drop it
+	waitForRoute(t, nodes["nodeA"], "nodeB", "nodeB")
+	cost, err := nodes["nodeA"].PathCost("nodeB")
+	if err != nil || cost != 1.0 {
+		t.Fatalf("unexpected path cost %f to the node in maintenance: %v", cost, err)
+	}
+	for _, id := range []string{"nodeA", "nodeD"} {
+		_, ok := nodes[id].Status().KnownConnectionCosts[id]["nodeB"]
+		if !ok {
+			t.Fatalf("%s dropped its connection to the node in maintenance", id)
+		}
+	}
+
+	nodes["nodeB"].SetMaintenanceMode(false)
+	waitForRoute(t, nodes["nodeA"], "nodeD", "nodeB")
+
+	for _, n := range nodes {
+		n.Shutdown()
+	}
+	for _, n := range nodes {
+		n.BackendWait()
+	}
+}
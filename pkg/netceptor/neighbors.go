@@ -0,0 +1,92 @@
+package netceptor
+
+import (
+	"sort"
+	"time"
+)
+
+// NeighborStatus holds information about a directly connected peer
+type NeighborStatus struct {
+	NodeID    string
+	Backend   string
+	Cost      float64
+	RTT       time.Duration
+	LastHeard time.Time
+}
+
+// Neighbors returns the directly connected peers of this node, sorted by node ID.  This is a
+// cheaper alternative to Status when only the local connections are of interest.  RTT is zero
+// if the neighbor's latency has not yet been measured.
+func (s *Netceptor) Neighbors() []*NeighborStatus {
+	s.connLock.RLock()
+	neighbors := make([]*NeighborStatus, 0, len(s.connections))
+	for node, ci := range s.connections {
+		neighbors = append(neighbors, &NeighborStatus{
+			NodeID:    node,
+			Backend:   ci.BackendName,
+			Cost:      ci.Cost,
+			RTT:       ci.rtt,
+			LastHeard: ci.lastReceivedData,
+		})
+	}
+	s.connLock.RUnlock()
+	sort.Slice(neighbors, func(i, j int) bool {
+		return neighbors[i].NodeID < neighbors[j].NodeID
+	})
+	return neighbors
+}
+
+// measureNeighborLatency pings each directly connected peer and records the round trip time
+func (s *Netceptor) measureNeighborLatency() {
+	s.connLock.RLock()
+	neighbors := make([]string, 0, len(s.connections))
+	for node := range s.connections {
+		neighbors = append(neighbors, node)
+	}
+	s.connLock.RUnlock()
+	if len(neighbors) == 0 {
+		return
+	}
+	pc, err := s.ListenPacket("")
+	if err != nil {
+		sublogger.Error("Error measuring neighbor latency: %s\n", err)
+		return
+	}
+	defer func() {
+		_ = pc.Close()
+	}()
+	pc.SetHopsToLive(1)
+	sent := make(map[string]time.Time)
+	for _, node := range neighbors {
+		sent[node] = time.Now()
+		_, err = pc.WriteTo([]byte{}, s.NewAddr(node, "ping"))
+		if err != nil {
+			sublogger.Debug("Error sending latency ping to %s: %s\n", node, err)
+			delete(sent, node)
+		}
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(RouteUpdateTime / 2))
+	buf := make([]byte, MTU)
+	for len(sent) > 0 {
+		_, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ncAddr, ok := addr.(Addr)
+		if !ok {
+			continue
+		}
+		start, ok := sent[ncAddr.node]
+		if !ok {
+			continue
+		}
+		delete(sent, ncAddr.node)
+		rtt := time.Since(start)
+		s.connLock.Lock()
+		ci, ok := s.connections[ncAddr.node]
+		if ok {
+			ci.rtt = rtt
+		}
+		s.connLock.Unlock()
+	}
+}
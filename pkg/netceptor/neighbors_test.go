@@ -0,0 +1,47 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNeighbors(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	linkNodes(t, n1, n2, "link", 2.5)
+	waitForConnection(t, n1, "node2", true)
+
+	// Wait for the initial latency measurement to complete
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var neighbors []*NeighborStatus
+	for {
+		neighbors = n1.Neighbors()
+		if len(neighbors) == 1 && neighbors[0].RTT > 0 {
+			break
+		}
+		if timeout.Err() != nil {
+			t.Fatal("timed out waiting for neighbor latency to be measured")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	nb := neighbors[0]
+	if nb.NodeID != "node2" {
+		t.Fatalf("expected neighbor node2, got %s", nb.NodeID)
+	}
+	if nb.Backend != "link" {
+		t.Fatalf("expected backend link, got %s", nb.Backend)
+	}
+	if nb.Cost != 2.5 {
+		t.Fatalf("expected cost 2.5, got %f", nb.Cost)
+	}
+	if time.Since(nb.LastHeard) > 2*RouteUpdateTime {
+		t.Fatalf("last heard time %s is too old", nb.LastHeard)
+	}
+
+	n1.Shutdown()
+	n2.Shutdown()
+	n1.BackendWait()
+	n2.BackendWait()
+}
@@ -7,24 +7,29 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	priorityQueue "github.com/jupp0r/go-priority-queue"
 	"github.com/minio/highwayhash"
 	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/randstr"
 	"github.com/project-receptor/receptor/pkg/tickrunner"
+	"github.com/project-receptor/receptor/pkg/tracing"
 	"github.com/project-receptor/receptor/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
-	"math"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+// sublogger sends the log messages of the netceptor subsystem
+var sublogger = logger.Named("netceptor")
+
 // MTU is the largest message sendable over the Netecptor network
 const MTU = 16384
 
-// RouteUpdateTime is the interval at which regular route updates will be sent
+// RouteUpdateTime is the default interval at which regular route updates will be sent
 const RouteUpdateTime = 10 * time.Second
 
 // ServiceAdTime is the interval at which regular service advertisements will be sent
@@ -33,6 +38,9 @@ const ServiceAdTime = 60 * time.Second
 // SeenUpdateExpireTime is the age after which routing update IDs can be discarded
 const SeenUpdateExpireTime = 1 * time.Hour
 
+// MaxPingEcho is the largest ping payload that is echoed back in the reply
+const MaxPingEcho = 64
+
 // MaxForwardingHops is the maximum number of times that Netceptor will forward a data packet
 const MaxForwardingHops = 30
 
@@ -77,10 +85,17 @@ type BackendSession interface {
 type Netceptor struct {
 	nodeID                 string
 	allowedPeers           []string
+	allowedPeerPatterns    []*peerPattern
+	deniedPeers            []string
+	deniedPeerPatterns     []*peerPattern
+	allowedPeersSource     string
+	allowedPeersFile       string
+	allowedPeersLock       *sync.RWMutex
 	epoch                  uint64
 	sequence               uint64
 	connLock               *sync.RWMutex
 	connections            map[string]*connInfo
+	maintenanceMode        bool
 	knownNodeLock          *sync.RWMutex
 	seenUpdates            map[string]time.Time
 	knownNodeInfo          map[string]*nodeInfo
@@ -88,9 +103,16 @@ type Netceptor struct {
 	routingTableLock       *sync.RWMutex
 	routingTable           map[string]string
 	routingPathCosts       map[string]float64
+	routeSubs              *routeSubscriptions
 	listenerLock           *sync.RWMutex
 	listenerRegistry       map[string]*PacketConn
+	serviceQueriesRefused  bool
+	relayLock              *sync.RWMutex
+	relayAllowedServices   map[string]bool
+	relayDropped           map[string]uint64
 	sendRouteFloodChan     chan time.Duration
+	routeIntervalChan      chan time.Duration
+	routeUpdateInterval    time.Duration
 	updateRoutingTableChan chan time.Duration
 	context                context.Context
 	cancelFunc             context.CancelFunc
@@ -99,19 +121,47 @@ type Netceptor struct {
 	reservedServices       map[string]func(*messageData) error
 	serviceAdsLock         *sync.RWMutex
 	serviceAdsReceived     map[string]map[string]*ServiceAdvertisement
+	stickyLock             *sync.RWMutex
+	stickyRoutes           map[stickyPin]*stickyOverride
+	stickyInstances        map[string]map[string]time.Time
 	sendServiceAdsChan     chan time.Duration
+	measureLatencyChan     chan time.Duration
 	backendWaitGroup       sync.WaitGroup
 	backendCount           int
+	backendLock            *sync.RWMutex
+	backends               map[string]*backendInfo
+	handshakeTimeout       time.Duration
+	compression            string
+	compressionThreshold   int
+	keepaliveInterval      time.Duration
+	keepaliveMissed        int
+	hmacKeys               *hmacKeyring
+	chaos                  *chaosRegistry
+	configValidator        *configValidator
+	serviceAccess          *serviceAccessRegistry
+	sendQueueSize          int
+	sendQueuePolicy        string
 	networkName            string
+	tlsConfigLock          *sync.RWMutex
 	serverTLSConfigs       map[string]*tls.Config
 	clientTLSConfigs       map[string]*tls.Config
+	serverTLSLoaders       map[string]tlsLoader
+	clientTLSLoaders       map[string]tlsLoader
 	unreachableBroker      *utils.Broker
 }
 
 // ConnStatus holds information about a single connection in the Status struct.
 type ConnStatus struct {
-	NodeID string
-	Cost   float64
+	NodeID  string
+	Cost    float64
+	Backend string
+}
+
+// BackendStatus holds information about a single registered backend.
+type BackendStatus struct {
+	Name        string
+	Enabled     bool
+	Connections []string
 }
 
 // Status is the struct returned by Netceptor.Status().  It represents a public
@@ -122,6 +172,7 @@ type Status struct {
 	RoutingTable         map[string]string
 	Advertisements       []*ServiceAdvertisement
 	KnownConnectionCosts map[string]map[string]float64
+	MaintenanceMode      bool
 }
 
 const (
@@ -149,20 +200,53 @@ type messageData struct {
 	ToService   string
 	HopsToLive  byte
 	Data        []byte
+	// TraceContext is the span of the node that last handled the message, if it was traced
+	TraceContext trace.SpanContext
 }
 
 type connInfo struct {
+	// lastActivity is accessed atomically, so it comes first to keep it 64-bit aligned
+	lastActivity     int64
 	ReadChan         chan []byte
 	WriteChan        chan []byte
+	sendQueue        *sendQueue
 	Context          context.Context
 	CancelFunc       context.CancelFunc
 	Cost             float64
+	ReceiveCost      float64
+	BackendName      string
 	lastReceivedData time.Time
+	rtt              time.Duration
+	stats            *trafficCounters
+	sessionStats     *trafficCounters
+	established      time.Time
+	described        DescribedSession
+	// peerKeepalive is the interval the peer sends keepalives at, or zero if it does not send them
+	peerKeepalive   time.Duration
+	keepaliveMissed int
+	// peerTracing is true if the peer accepts trace contexts in data messages
+	peerTracing bool
+}
+
+// backendInfo is the registration record of a backend added to this Netceptor.  Its ctx is the
+// context of the backend's sessions, which is cancelled when the backend is disabled.
+type backendInfo struct {
+	name    string
+	backend Backend
+	costs   BackendCosts
+	enabled bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stats   *trafficCounters
+	limiter *rateLimiter
 }
 
 type nodeInfo struct {
-	Epoch    uint64
-	Sequence uint64
+	Epoch        uint64
+	Sequence     uint64
+	Maintenance  bool
+	LastReceived time.Time
+	ReceivedFrom string
 }
 
 type routingUpdate struct {
@@ -172,6 +256,18 @@ type routingUpdate struct {
 	UpdateSequence uint64
 	Connections    map[string]float64
 	ForwardingNode string
+	// Maintenance is set by nodes in maintenance mode, whose connections other nodes then treat
+	// as costing MaintenanceCostMultiplier times their advertised cost
+	Maintenance bool
+	// Compression lists the compression algorithms the forwarding node supports.  It is only sent
+	// in the initial connect message of a session.
+	Compression []string `json:",omitempty"`
+	// KeepaliveInterval is the interval at which the forwarding node sends keepalives.  It is only
+	// sent in the initial connect message of a session.
+	KeepaliveInterval time.Duration `json:",omitempty"`
+	// Tracing is set if the forwarding node accepts trace contexts in data messages.  It is only
+	// sent in the initial connect message of a session.
+	Tracing bool `json:",omitempty"`
 }
 
 // ServiceAdvertisement is the data associated with a service advertisement
@@ -219,6 +315,8 @@ func New(ctx context.Context, NodeID string, AllowedPeers []string) *Netceptor {
 	s := Netceptor{
 		nodeID:                 NodeID,
 		allowedPeers:           AllowedPeers,
+		allowedPeersSource:     AllowedPeersSourceNone,
+		allowedPeersLock:       &sync.RWMutex{},
 		epoch:                  uint64(time.Now().Unix()),
 		sequence:               0,
 		connLock:               &sync.RWMutex{},
@@ -230,35 +328,68 @@ func New(ctx context.Context, NodeID string, AllowedPeers []string) *Netceptor {
 		routingTableLock:       &sync.RWMutex{},
 		routingTable:           make(map[string]string),
 		routingPathCosts:       make(map[string]float64),
+		routeSubs:              newRouteSubscriptions(),
 		listenerLock:           &sync.RWMutex{},
 		listenerRegistry:       make(map[string]*PacketConn),
+		relayLock:              &sync.RWMutex{},
+		relayDropped:           make(map[string]uint64),
 		sendRouteFloodChan:     nil,
+		routeUpdateInterval:    RouteUpdateTime,
 		updateRoutingTableChan: nil,
 		hashLock:               &sync.RWMutex{},
 		nameHashes:             make(map[uint64]string),
 		serviceAdsLock:         &sync.RWMutex{},
 		serviceAdsReceived:     make(map[string]map[string]*ServiceAdvertisement),
+		stickyLock:             &sync.RWMutex{},
+		stickyRoutes:           make(map[stickyPin]*stickyOverride),
+		stickyInstances:        make(map[string]map[string]time.Time),
 		sendServiceAdsChan:     nil,
+		measureLatencyChan:     nil,
 		backendWaitGroup:       sync.WaitGroup{},
 		backendCount:           0,
+		backendLock:            &sync.RWMutex{},
+		backends:               make(map[string]*backendInfo),
+		handshakeTimeout:       DefaultHandshakeTimeout,
+		compressionThreshold:   DefaultCompressionThreshold,
+		keepaliveInterval:      DefaultKeepaliveInterval,
+		keepaliveMissed:        DefaultKeepaliveMissed,
+		hmacKeys:               newHMACKeyring(),
+		chaos:                  newChaosRegistry(),
+		configValidator:        newConfigValidator(),
+		serviceAccess:          newServiceAccessRegistry(),
+		sendQueueSize:          DefaultSendQueueSize,
+		sendQueuePolicy:        SendQueueBlock,
 		networkName:            makeNetworkName(NodeID),
+		tlsConfigLock:          &sync.RWMutex{},
 		clientTLSConfigs:       make(map[string]*tls.Config),
 		serverTLSConfigs:       make(map[string]*tls.Config),
+		serverTLSLoaders:       make(map[string]tlsLoader),
+		clientTLSLoaders:       make(map[string]tlsLoader),
 	}
 	s.reservedServices = map[string]func(*messageData) error{
-		"ping":    s.handlePing,
-		"unreach": s.handleUnreachable,
+		"ping":              s.handlePing,
+		"unreach":           s.handleUnreachable,
+		clockService:        s.handleClockProbe,
+		serviceQueryService: s.handleServiceQuery,
 	}
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	s.clientTLSConfigs["default"] = &tls.Config{}
+	s.clientTLSConfigs["default"] = HardenTLSConfig(&tls.Config{})
+	if AllowedPeers != nil {
+		s.allowedPeersSource = AllowedPeersSourceConfig
+		s.allowedPeerPatterns = compileAllowedPeers(AllowedPeers)
+	}
+	s.AddConfigCheck("tls", s.checkTLSConfigs)
+	s.AddConfigCheck("peers", s.checkAllowedPeers)
 	s.addNameHash(NodeID)
 	s.context, s.cancelFunc = context.WithCancel(ctx)
 	s.unreachableBroker = utils.NewBroker(s.context)
 	s.updateRoutingTableChan = tickrunner.Run(s.context, s.updateRoutingTable, time.Hour*24, time.Millisecond*100)
-	s.sendRouteFloodChan = tickrunner.Run(s.context, s.sendRoutingUpdate, RouteUpdateTime, time.Millisecond*100)
+	s.sendRouteFloodChan, s.routeIntervalChan = tickrunner.RunAdjustable(s.context, s.sendRoutingUpdate,
+		RouteUpdateTime, time.Millisecond*100)
 	s.sendServiceAdsChan = tickrunner.Run(s.context, s.sendServiceAds, ServiceAdTime, time.Second*5)
+	s.measureLatencyChan = tickrunner.Run(s.context, s.measureNeighborLatency, RouteUpdateTime, time.Second*1)
 	go s.monitorConnectionAging()
 	go s.expireSeenUpdates()
 	return &s
@@ -288,39 +419,165 @@ func (s *Netceptor) NodeID() string {
 	return s.nodeID
 }
 
-// AddBackend adds a backend to the Netceptor system
+// AddBackend adds a backend to the Netceptor system, with an automatically generated name
 func (s *Netceptor) AddBackend(backend Backend, connectionCost float64, nodeCost map[string]float64) error {
+	return s.AddNamedBackend("", backend, connectionCost, nodeCost)
+}
+
+// AddNamedBackend adds a backend to the Netceptor system.  The name is used to refer to the
+// backend in later operations such as SetBackendEnabled.  If blank, a name is generated.
+func (s *Netceptor) AddNamedBackend(name string, backend Backend, connectionCost float64, nodeCost map[string]float64) error {
+	return s.AddLimitedBackend(name, backend, connectionCost, nodeCost, BackendRateLimit{})
+}
+
+// AddLimitedBackend adds a backend to the Netceptor system, capping the bandwidth its sessions
+// may use.  The name is used as in AddNamedBackend.
+func (s *Netceptor) AddLimitedBackend(name string, backend Backend, connectionCost float64, nodeCost map[string]float64,
+	limit BackendRateLimit) error {
+	return s.AddBackendWithCosts(name, backend, BackendCosts{
+		Cost:     connectionCost,
+		NodeCost: nodeCost,
+	}, limit)
+}
+
+// AddBackendWithCosts adds a backend to the Netceptor system, whose connections may cost more in
+// one direction than the other.  The name and rate limit are used as in AddLimitedBackend.
+func (s *Netceptor) AddBackendWithCosts(name string, backend Backend, costs BackendCosts, limit BackendRateLimit) error {
+	err := costs.Validate()
+	if err != nil {
+		return err
+	}
+	err = limit.Validate()
+	if err != nil {
+		return err
+	}
+	s.backendLock.Lock()
+	if name == "" {
+		for i := len(s.backends) + 1; ; i++ {
+			name = fmt.Sprintf("backend%d", i)
+			_, ok := s.backends[name]
+			if !ok {
+				break
+			}
+		}
+	}
+	_, ok := s.backends[name]
+	if ok {
+		s.backendLock.Unlock()
+		return fmt.Errorf("backend %s already exists", name)
+	}
+	bi := &backendInfo{
+		name:    name,
+		backend: backend,
+		costs:   costs,
+		enabled: true,
+		stats:   newTrafficCounters(),
+		limiter: newRateLimiter(limit),
+	}
 	sessChan, err := backend.Start(s.context)
 	if err != nil {
+		s.backendLock.Unlock()
 		return err
 	}
+	bi.ctx, bi.cancel = context.WithCancel(s.context)
+	s.backends[name] = bi
 	s.backendWaitGroup.Add(1)
 	s.backendCount++
-	go func() {
-		defer s.backendWaitGroup.Done()
-		for {
-			select {
-			case sess, ok := <-sessChan:
-				if ok {
-					s.backendWaitGroup.Add(1)
-					go func() {
-						err := s.runProtocol(sess, connectionCost, nodeCost)
-						s.backendWaitGroup.Done()
-						if err != nil {
-							logger.Error("Backend error: %s\n", err)
-						}
-					}()
-				} else {
-					return
-				}
-			case <-s.context.Done():
+	s.backendLock.Unlock()
+	go s.runBackend(bi, sessChan)
+	return nil
+}
+
+// runBackend accepts sessions from a backend until it exits.  Sessions produced while the backend
+// is disabled are closed straight away, so the backend itself only ever runs once.
+func (s *Netceptor) runBackend(bi *backendInfo, sessChan chan BackendSession) {
+	defer s.backendWaitGroup.Done()
+	for {
+		select {
+		case sess, ok := <-sessChan:
+			if !ok {
 				return
 			}
+			s.backendLock.RLock()
+			enabled := bi.enabled
+			sctx := bi.ctx
+			s.backendLock.RUnlock()
+			if !enabled {
+				sublogger.Debug("Closing session of disabled backend %s\n", bi.name)
+				_ = sess.Close()
+				continue
+			}
+			s.backendWaitGroup.Add(1)
+			go func() {
+				err := s.runProtocol(sctx, bi.name, sess, bi.costs)
+				s.backendWaitGroup.Done()
+				if err != nil {
+					sublogger.Error("Backend error: %s\n", err)
+				}
+			}()
+		case <-s.context.Done():
+			return
 		}
-	}()
+	}
+}
+
+// SetBackendEnabled enables or disables a backend by name.  Disabling a backend closes its sessions
+// and refuses new ones, without removing it.  Enabling a disabled backend accepts sessions again.
+func (s *Netceptor) SetBackendEnabled(name string, enabled bool) error {
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	bi, ok := s.backends[name]
+	if !ok {
+		return fmt.Errorf("unknown backend %s", name)
+	}
+	if bi.enabled == enabled {
+		if enabled {
+			return fmt.Errorf("backend %s is already enabled", name)
+		}
+		return fmt.Errorf("backend %s is already disabled", name)
+	}
+	bi.enabled = enabled
+	if enabled {
+		bi.ctx, bi.cancel = context.WithCancel(s.context)
+		sublogger.Info("Backend %s enabled\n", name)
+	} else {
+		bi.cancel()
+		sublogger.Info("Backend %s disabled\n", name)
+	}
 	return nil
 }
 
+// BackendStatus returns information about the registered backends, sorted by name
+func (s *Netceptor) BackendStatus() []*BackendStatus {
+	s.backendLock.RLock()
+	backends := make([]*BackendStatus, 0, len(s.backends))
+	for name, bi := range s.backends {
+		backends = append(backends, &BackendStatus{
+			Name:        name,
+			Enabled:     bi.enabled,
+			Connections: make([]string, 0),
+		})
+	}
+	s.backendLock.RUnlock()
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Name < backends[j].Name
+	})
+	s.connLock.RLock()
+	for node, ci := range s.connections {
+		for _, bs := range backends {
+			if bs.Name == ci.BackendName {
+				bs.Connections = append(bs.Connections, node)
+				break
+			}
+		}
+	}
+	s.connLock.RUnlock()
+	for _, bs := range backends {
+		sort.Strings(bs.Connections)
+	}
+	return backends
+}
+
 // BackendWait waits for the backend wait group
 func (s *Netceptor) BackendWait() {
 	s.backendWaitGroup.Wait()
@@ -337,8 +594,9 @@ func (s *Netceptor) Status() Status {
 	conns := make([]*ConnStatus, 0)
 	for conn := range s.connections {
 		conns = append(conns, &ConnStatus{
-			NodeID: conn,
-			Cost:   s.connections[conn].Cost,
+			NodeID:  conn,
+			Cost:    s.connections[conn].Cost,
+			Backend: s.connections[conn].BackendName,
 		})
 	}
 	s.connLock.RUnlock()
@@ -375,6 +633,7 @@ func (s *Netceptor) Status() Status {
 		RoutingTable:         routes,
 		Advertisements:       serviceAds,
 		KnownConnectionCosts: knownConnectionCosts,
+		MaintenanceMode:      s.MaintenanceMode(),
 	}
 }
 
@@ -413,6 +672,7 @@ func (s *Netceptor) removeLocalServiceAdvertisement(service string) error {
 	if ok {
 		delete(n, service)
 	}
+	s.pruneStickyRoutes(s.nodeID, service)
 	sa := &serviceAdvertisementFull{
 		ServiceAdvertisement: &ServiceAdvertisement{
 			NodeID:  s.nodeID,
@@ -432,7 +692,7 @@ func (s *Netceptor) removeLocalServiceAdvertisement(service string) error {
 
 // Send a single service broadcast
 func (s *Netceptor) sendServiceAd(si *ServiceAdvertisement) error {
-	logger.Debug("Sending service advertisement: %s\n", si)
+	sublogger.Debug("Sending service advertisement: %s\n", si)
 	sf := serviceAdvertisementFull{
 		ServiceAdvertisement: si,
 		Cancel:               false,
@@ -464,26 +724,37 @@ func (s *Netceptor) sendServiceAds() {
 	for i := range ads {
 		err := s.sendServiceAd(&ads[i])
 		if err != nil {
-			logger.Error("Error sending service advertisement: %s\n", err)
+			sublogger.Error("Error sending service advertisement: %s\n", err)
 		}
 	}
 }
 
-// Watches connections and expires any that haven't seen traffic in too long
+// Watches connections and expires any that haven't seen traffic in too long.  Closing a
+// connection withdraws the routes through it and floods a route update right away.
 func (s *Netceptor) monitorConnectionAging() {
+	var checkInterval time.Duration
 	for {
 		select {
-		case <-time.After(5 * time.Second):
+		case <-time.After(checkInterval):
 			timedOut := make([]context.CancelFunc, 0)
+			checkInterval = 5 * time.Second
+			if interval, missed := s.Keepalive(); interval*time.Duration(missed)/4 < checkInterval {
+				checkInterval = interval * time.Duration(missed) / 4
+			}
 			s.connLock.RLock()
-			for i := range s.connections {
-				if time.Since(s.connections[i].lastReceivedData) > (2*RouteUpdateTime + 1*time.Second) {
-					timedOut = append(timedOut, s.connections[i].CancelFunc)
+			for node, ci := range s.connections {
+				deadAfter := ci.deadAfter()
+				if silence := time.Since(ci.lastReceivedData); silence > deadAfter {
+					sublogger.Warning("Link to %s declared dead after %s without traffic\n", node, silence.Round(time.Millisecond))
+					timedOut = append(timedOut, ci.CancelFunc)
+				}
+				// Check often enough to notice a dead link soon after it dies
+				if deadAfter/4 < checkInterval {
+					checkInterval = deadAfter / 4
 				}
 			}
 			s.connLock.RUnlock()
 			for i := range timedOut {
-				logger.Warning("Timing out connection\n")
 				timedOut[i]()
 			}
 		case <-s.context.Done():
@@ -515,51 +786,17 @@ func (s *Netceptor) expireSeenUpdates() {
 func (s *Netceptor) updateRoutingTable() {
 	s.knownNodeLock.RLock()
 	defer s.knownNodeLock.RUnlock()
-	logger.Debug("Re-calculating routing table\n")
-
-	// Dijkstra's algorithm
-	Q := priorityQueue.New()
-	Q.Insert(s.nodeID, 0.0)
-	cost := make(map[string]float64)
-	prev := make(map[string]string)
-	for node := range s.knownConnectionCosts {
-		if node == s.nodeID {
-			cost[node] = 0.0
-		} else {
-			cost[node] = math.MaxFloat64
-		}
-		prev[node] = ""
-		Q.Insert(node, cost[node])
-	}
-	for Q.Len() > 0 {
-		nodeIf, _ := Q.Pop()
-		node := fmt.Sprintf("%v", nodeIf)
-		for neighbor, edgeCost := range s.knownConnectionCosts[node] {
-			pathCost := cost[node] + edgeCost
-			if pathCost < cost[neighbor] {
-				cost[neighbor] = pathCost
-				prev[neighbor] = node
-				Q.Insert(neighbor, pathCost)
-			}
-		}
-	}
+	sublogger.Debug("Re-calculating routing table\n")
+
+	routingTable, cost := computeRoutes(s.nodeID, s.routingCosts())
 	s.routingTableLock.Lock()
 	defer s.routingTableLock.Unlock()
-	s.routingTable = make(map[string]string)
-	for dest := range s.knownConnectionCosts {
-		p := dest
-		for {
-			if prev[p] == s.nodeID {
-				s.routingTable[dest] = p
-				break
-			} else if prev[p] == "" {
-				break
-			}
-			p = prev[p]
-		}
-	}
+	events := routeEvents(s.routingTable, s.routingPathCosts, routingTable, cost)
+	s.routingTable = routingTable
 	s.routingPathCosts = cost
+	s.pruneUnreachableStickyRoutes(routingTable)
 	s.printRoutingTable()
+	s.routeSubs.publish(events)
 }
 
 // Forwards a message to all neighbors, possibly excluding one
@@ -583,11 +820,30 @@ func (s *Netceptor) GetServerTLSConfig(name string) (*tls.Config, error) {
 	if name == "" {
 		return nil, nil
 	}
+	s.tlsConfigLock.RLock()
 	sc, ok := s.serverTLSConfigs[name]
+	_, reloadable := s.serverTLSLoaders[name]
+	s.tlsConfigLock.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unknown TLS config %s", name)
 	}
-	return sc.Clone(), nil
+	sc = sc.Clone()
+	if reloadable && sc.GetCertificate == nil && sc.GetConfigForClient == nil {
+		// Look up the config at each handshake, so listeners pick up reloaded certificates and CAs
+		sc.GetConfigForClient = s.serverConfigGetter(name, sc.Clone())
+	}
+	return sc, nil
+}
+
+// GetServerTLSConfigWithClientAuth retrieves a server TLS config by name, overriding its client
+// authentication with the given mode, so that services sharing a config can differ in whether
+// they accept anonymous clients
+func (s *Netceptor) GetServerTLSConfigWithClientAuth(name string, clientAuth string) (*tls.Config, error) {
+	tlscfg, err := s.GetServerTLSConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyClientAuth(tlscfg, clientAuth)
 }
 
 // SetServerTLSConfig stores a server TLS config by name
@@ -595,7 +851,10 @@ func (s *Netceptor) SetServerTLSConfig(name string, config *tls.Config) error {
 	if name == "" {
 		return fmt.Errorf("must provide a name")
 	}
+	logTLSAudit(name, config)
+	s.tlsConfigLock.Lock()
 	s.serverTLSConfigs[name] = config
+	s.tlsConfigLock.Unlock()
 	return nil
 }
 
@@ -604,12 +863,26 @@ func (s *Netceptor) GetClientTLSConfig(name string, expectedHostName string) (*t
 	if name == "" {
 		return nil, nil
 	}
+	s.tlsConfigLock.RLock()
 	cc, ok := s.clientTLSConfigs[name]
+	_, reloadable := s.clientTLSLoaders[name]
+	s.tlsConfigLock.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unknown TLS config %s", name)
 	}
 	cc = cc.Clone()
 	cc.ServerName = expectedHostName
+	if reloadable && cc.GetClientCertificate == nil {
+		// Fetch the certificate at each handshake, so backends pick up reloaded certificates
+		cc.Certificates = nil
+		cc.GetClientCertificate = s.clientCertificateGetter(name)
+	}
+	if reloadable && !cc.InsecureSkipVerify && cc.VerifyPeerCertificate == nil && expectedHostName != "" {
+		// Verify the server against the CA bundle that is current at each handshake, so backends
+		// pick up reloaded CAs.  The standard verification is replaced, not skipped.
+		cc.InsecureSkipVerify = true
+		cc.VerifyPeerCertificate = s.serverCertificateVerifier(name, expectedHostName)
+	}
 	return cc, nil
 }
 
@@ -618,7 +891,10 @@ func (s *Netceptor) SetClientTLSConfig(name string, config *tls.Config) error {
 	if name == "" {
 		return fmt.Errorf("must provide a name")
 	}
+	logTLSAudit(name, config)
+	s.tlsConfigLock.Lock()
 	s.clientTLSConfigs[name] = config
+	s.tlsConfigLock.Unlock()
 	return nil
 }
 
@@ -695,19 +971,36 @@ func (s *Netceptor) translateDataToMessage(data []byte) (*messageData, error) {
 		HopsToLive:  data[1],
 		Data:        data[36:],
 	}
+	if data[2]&msgFlagTraced != 0 {
+		md.TraceContext, err = getTraceContext(data[36:])
+		if err != nil {
+			return nil, err
+		}
+		md.Data = data[36+traceContextLen:]
+	}
 	return md, nil
 }
 
-// Translates an outgoing message from a messageData object to wire protocol.
-func (s *Netceptor) translateDataFromMessage(msg *messageData) ([]byte, error) {
-	data := make([]byte, 36+len(msg.Data))
+// Translates an outgoing message from a messageData object to wire protocol.  The trace context,
+// if any, is only included if traced is true.
+func (s *Netceptor) translateDataFromMessage(msg *messageData, traced bool) ([]byte, error) {
+	headerLen := 36
+	traced = traced && msg.TraceContext.IsValid()
+	if traced {
+		headerLen += traceContextLen
+	}
+	data := make([]byte, headerLen+len(msg.Data))
 	data[0] = MsgTypeData
 	data[1] = msg.HopsToLive
 	binary.BigEndian.PutUint64(data[4:12], s.addNameHash(msg.FromNode))
 	binary.BigEndian.PutUint64(data[12:20], s.addNameHash(msg.ToNode))
 	copy(data[20:28], fixedLenBytesFromString(msg.FromService, 8))
 	copy(data[28:36], fixedLenBytesFromString(msg.ToService, 8))
-	copy(data[36:], msg.Data)
+	if traced {
+		data[2] |= msgFlagTraced
+		putTraceContext(data[36:], msg.TraceContext)
+	}
+	copy(data[headerLen:], msg.Data)
 	return data, nil
 }
 
@@ -725,6 +1018,19 @@ func (s *Netceptor) forwardMessage(md *messageData) error {
 		}
 		return nil
 	}
+	if !s.relayAllowed(md) {
+		return nil
+	}
+	if tracing.Enabled() {
+		// Each hop's span is a child of the previous hop's, so the whole path is one trace
+		_, span := tracing.StartSpan(s.messageTraceContext(md), "forward",
+			attribute.String("receptor.node", s.nodeID),
+			attribute.String("receptor.from", md.FromNode+":"+md.FromService),
+			attribute.String("receptor.to", md.ToNode+":"+md.ToService),
+			attribute.Int("receptor.hops_to_live", int(md.HopsToLive)))
+		defer span.End()
+		md.TraceContext = span.SpanContext()
+	}
 	s.routingTableLock.RLock()
 	nextHop, ok := s.routingTable[md.ToNode]
 	s.routingTableLock.RUnlock()
@@ -737,15 +1043,14 @@ func (s *Netceptor) forwardMessage(md *messageData) error {
 	if !ok || c.WriteChan == nil {
 		return fmt.Errorf("no connection to next hop")
 	}
-	message, err := s.translateDataFromMessage(md)
+	message, err := s.translateDataFromMessage(md, c.peerTracing)
 	if err != nil {
 		return err
 	}
 	// decrement HopsToLive
 	message[1]--
-	logger.Trace("    Forwarding data length %d via %s\n", len(md.Data), nextHop)
-	c.WriteChan <- message
-	return nil
+	sublogger.Trace("    Forwarding data length %d via %s\n", len(md.Data), nextHop)
+	return c.sendQueue.push(c.Context, message)
 }
 
 // Generates and sends a message over the Receptor network, specifying HopsToLive
@@ -764,7 +1069,7 @@ func (s *Netceptor) sendMessageWithHopsToLive(fromService string, toNode string,
 		HopsToLive:  hopsToLive,
 		Data:        data,
 	}
-	logger.Trace("--- Sending data length %d from %s:%s to %s:%s\n", len(md.Data),
+	sublogger.Trace("--- Sending data length %d from %s:%s to %s:%s\n", len(md.Data),
 		md.FromNode, md.FromService, md.ToNode, md.ToService)
 	return s.handleMessageData(md)
 }
@@ -774,6 +1079,23 @@ func (s *Netceptor) sendMessage(fromService string, toNode string, toService str
 	return s.sendMessageWithHopsToLive(fromService, toNode, toService, data, MaxForwardingHops)
 }
 
+// ReservedServicePrefix starts the names of services that are handled internally by every node,
+// other than the original ping and unreach services.  Services with names starting with it
+// cannot be listened on.
+const ReservedServicePrefix = "~"
+
+// checkServiceName returns an error if a service name cannot be listened on
+func checkServiceName(service string) error {
+	if len(service) > 8 {
+		return fmt.Errorf("service name %s too long", service)
+	}
+	if strings.HasPrefix(service, ReservedServicePrefix) {
+		return fmt.Errorf("service name %s is reserved, as names starting with %s are used internally",
+			service, ReservedServicePrefix)
+	}
+	return nil
+}
+
 // Returns an unused random service name to use as the equivalent of a TCP/IP ephemeral port number.
 func (s *Netceptor) getEphemeralService() string {
 	s.listenerLock.RLock()
@@ -799,7 +1121,7 @@ func (s *Netceptor) printRoutingTable() {
 	if logger.GetLogLevel() < logLevel {
 		return
 	}
-	logger.Log(logLevel, "Known Connections:\n")
+	sublogger.Log(logLevel, "Known Connections:\n")
 	for conn := range s.knownConnectionCosts {
 		sb := &strings.Builder{}
 		_, _ = fmt.Fprintf(sb, "   %s: ", conn)
@@ -807,30 +1129,33 @@ func (s *Netceptor) printRoutingTable() {
 			_, _ = fmt.Fprintf(sb, "%s(%.2f) ", peer, s.knownConnectionCosts[conn][peer])
 		}
 		_, _ = fmt.Fprintf(sb, "\n")
-		logger.Log(logLevel, sb.String())
+		sublogger.Log(logLevel, sb.String())
 	}
-	logger.Log(logLevel, "Routing Table:\n")
+	sublogger.Log(logLevel, "Routing Table:\n")
 	for node := range s.routingTable {
-		logger.Log(logLevel, "   %s via %s\n", node, s.routingTable[node])
+		sublogger.Log(logLevel, "   %s via %s\n", node, s.routingTable[node])
 	}
 }
 
 // Constructs a routing update message
 func (s *Netceptor) makeRoutingUpdate() *routingUpdate {
+	s.connLock.Lock()
 	s.sequence++
-	s.connLock.RLock()
+	sequence := s.sequence
 	conns := make(map[string]float64)
 	for conn := range s.connections {
 		conns[conn] = s.connections[conn].Cost
 	}
-	s.connLock.RUnlock()
+	maintenance := s.maintenanceMode
+	s.connLock.Unlock()
 	update := &routingUpdate{
 		NodeID:         s.nodeID,
 		UpdateID:       randstr.RandomString(8),
 		UpdateEpoch:    s.epoch,
-		UpdateSequence: s.sequence,
+		UpdateSequence: sequence,
 		Connections:    conns,
 		ForwardingNode: s.nodeID,
+		Maintenance:    maintenance,
 	}
 	return update
 }
@@ -849,7 +1174,10 @@ func (s *Netceptor) translateStructToNetwork(messageType byte, content interface
 
 // Sends a routing update to all neighbors.
 func (s *Netceptor) sendRoutingUpdate() {
-	if len(s.connections) == 0 {
+	s.connLock.RLock()
+	connCount := len(s.connections)
+	s.connLock.RUnlock()
+	if connCount == 0 {
 		return
 	}
 	ru := s.makeRoutingUpdate()
@@ -857,7 +1185,7 @@ func (s *Netceptor) sendRoutingUpdate() {
 	for conn := range ru.Connections {
 		sb = append(sb, fmt.Sprintf("%s(%.2f)", conn, ru.Connections[conn]))
 	}
-	logger.Debug("Sending routing update. Connections: %s\n", strings.Join(sb, " "))
+	sublogger.Debug("Sending routing update. Connections: %s\n", strings.Join(sb, " "))
 	message, err := s.translateStructToNetwork(MsgTypeRoute, ru)
 	if err != nil {
 		return
@@ -867,7 +1195,7 @@ func (s *Netceptor) sendRoutingUpdate() {
 
 // Processes a routing update received from a connection.
 func (s *Netceptor) handleRoutingUpdate(ri *routingUpdate, recvConn string) {
-	logger.Debug("Received routing update from %s via %s\n", ri.NodeID, recvConn)
+	sublogger.Debug("Received routing update from %s via %s\n", ri.NodeID, recvConn)
 	if ri.NodeID == s.nodeID || ri.NodeID == "" {
 		return
 	}
@@ -892,17 +1220,20 @@ func (s *Netceptor) handleRoutingUpdate(ri *routingUpdate, recvConn string) {
 		s.sendRouteFloodChan <- 0
 		ni = &nodeInfo{}
 	}
-	ni.Epoch = ri.UpdateEpoch
-	ni.Sequence = ri.UpdateSequence
 	s.knownNodeLock.Lock()
 	changed := false
-	if !reflect.DeepEqual(ri.Connections, s.knownConnectionCosts[ri.NodeID]) {
+	if !reflect.DeepEqual(ri.Connections, s.knownConnectionCosts[ri.NodeID]) || ni.Maintenance != ri.Maintenance {
 		changed = true
 	}
+	ni.Epoch = ri.UpdateEpoch
+	ni.Sequence = ri.UpdateSequence
+	ni.Maintenance = ri.Maintenance
 	_, ok = s.knownNodeInfo[ri.NodeID]
 	if !ok {
 		_ = s.addNameHash(ri.NodeID)
 	}
+	ni.LastReceived = time.Now()
+	ni.ReceivedFrom = recvConn
 	s.knownNodeInfo[ri.NodeID] = ni
 	s.knownConnectionCosts[ri.NodeID] = make(map[string]float64)
 	for k, v := range ri.Connections {
@@ -931,7 +1262,12 @@ func (s *Netceptor) handleRoutingUpdate(ri *routingUpdate, recvConn string) {
 
 // Handles a ping request
 func (s *Netceptor) handlePing(md *messageData) error {
-	return s.sendMessage("ping", md.FromNode, md.FromService, []byte{})
+	// Echo a short payload, so that senders can match replies to probes
+	data := md.Data
+	if len(data) > MaxPingEcho {
+		data = data[:MaxPingEcho]
+	}
+	return s.sendMessage("ping", md.FromNode, md.FromService, data)
 }
 
 // Handles an unreachable response
@@ -942,7 +1278,7 @@ func (s *Netceptor) handleUnreachable(md *messageData) error {
 		return err
 	}
 	unrData["ReceivedFromNode"] = md.FromNode
-	logger.Warning("Received unreachable message from %s", md.FromNode)
+	sublogger.Warning("Received unreachable message from %s", md.FromNode)
 	s.unreachableBroker.Publish(unrData)
 	return nil
 }
@@ -995,12 +1331,27 @@ func (s *Netceptor) handleMessageData(md *messageData) error {
 			})
 			return nil
 		}
+		if tracing.Enabled() && md.TraceContext.IsValid() {
+			_, span := tracing.StartSpan(s.messageTraceContext(md), "deliver",
+				attribute.String("receptor.node", s.nodeID),
+				attribute.String("receptor.from", md.FromNode+":"+md.FromService),
+				attribute.String("receptor.to", md.ToNode+":"+md.ToService))
+			span.End()
+		}
 		pc.recvChan <- md
 		return nil
 	}
 	return s.forwardMessage(md)
 }
 
+// messageTraceContext returns a context carrying the trace context of a message, if it has one
+func (s *Netceptor) messageTraceContext(md *messageData) context.Context {
+	if !md.TraceContext.IsValid() {
+		return context.Background()
+	}
+	return trace.ContextWithRemoteSpanContext(context.Background(), md.TraceContext)
+}
+
 // GetServiceInfo returns the advertising info, if any, for a service on a node
 func (s *Netceptor) GetServiceInfo(NodeID string, Service string) (*ServiceAdvertisement, bool) {
 	s.serviceAdsLock.RLock()
@@ -1027,7 +1378,7 @@ func (s *Netceptor) handleServiceAdvertisement(data []byte, receivedFrom string)
 	if err != nil {
 		return err
 	}
-	logger.Debug("Received service advertisement %v\n", si)
+	sublogger.Debug("Received service advertisement %v\n", si)
 	s.serviceAdsLock.Lock()
 	defer s.serviceAdsLock.Unlock()
 	n, ok := s.serviceAdsReceived[si.NodeID]
@@ -1049,6 +1400,7 @@ func (s *Netceptor) handleServiceAdvertisement(data []byte, receivedFrom string)
 		if len(s.serviceAdsReceived[si.NodeID]) == 0 {
 			delete(s.serviceAdsReceived, si.NodeID)
 		}
+		s.pruneStickyRoutes(si.NodeID, si.Service)
 	} else {
 		s.serviceAdsReceived[si.NodeID][si.Service] = si.ServiceAdvertisement
 	}
@@ -1070,12 +1422,15 @@ func (ci *connInfo) protoReader(sess BackendSession) {
 		}
 		if err != nil {
 			if err != io.EOF {
-				logger.Error("Backend receiving error %s\n", err)
+				sublogger.Error("Backend receiving error %s\n", err)
 			}
 			ci.CancelFunc()
 			return
 		}
 		ci.lastReceivedData = time.Now()
+		ci.noteActivity(buf)
+		ci.stats.countReceived(len(buf))
+		ci.sessionStats.countReceived(len(buf))
 		ci.ReadChan <- buf
 	}
 }
@@ -1090,31 +1445,59 @@ func (ci *connInfo) protoWriter(sess BackendSession) {
 			if !more {
 				return
 			}
-			err := sess.Send(message)
-			if err != nil {
-				logger.Error("Backend sending error %s\n", err)
-				ci.CancelFunc()
+			if !ci.send(sess, message) {
 				return
 			}
+		case <-ci.sendQueue.ready:
+			for {
+				message, ok := ci.sendQueue.pop()
+				if !ok {
+					break
+				}
+				if !ci.send(sess, message) {
+					return
+				}
+			}
 		}
-
 	}
 }
 
+// send writes a message to the backend, cancelling the connection and returning false on error
+func (ci *connInfo) send(sess BackendSession, message []byte) bool {
+	err := sess.Send(message)
+	if err != nil {
+		sublogger.Error("Backend sending error %s\n", err)
+		ci.CancelFunc()
+		return false
+	}
+	ci.noteActivity(message)
+	ci.stats.countSent(len(message))
+	ci.sessionStats.countSent(len(message))
+	return true
+}
+
 // Continuously sends routing updates to let the other end know who we are on initial connection
 func (s *Netceptor) sendInitialConnectMessage(ci *connInfo, initDoneChan chan bool) {
 	count := 0
 	for {
-		ri, err := s.translateStructToNetwork(MsgTypeRoute, s.makeRoutingUpdate())
+		ru := s.makeRoutingUpdate()
+		ru.Compression = supportedCompression()
+		ru.KeepaliveInterval, _ = s.Keepalive()
+		ru.Tracing = true
+		ri, err := s.translateStructToNetwork(MsgTypeRoute, ru)
 		if err != nil {
-			logger.Error("Error Sending initial connection message: %s\n", err)
+			sublogger.Error("Error Sending initial connection message: %s\n", err)
+			return
+		}
+		sublogger.Debug("Sending initial connection message\n")
+		select {
+		case ci.WriteChan <- ri:
+		case <-ci.Context.Done():
 			return
 		}
-		logger.Debug("Sending initial connection message\n")
-		ci.WriteChan <- ri
 		count++
 		if count > 10 {
-			logger.Warning("Giving up on connection initialization\n")
+			sublogger.Warning("Giving up on connection initialization\n")
 			ci.CancelFunc()
 			return
 		}
@@ -1122,7 +1505,7 @@ func (s *Netceptor) sendInitialConnectMessage(ci *connInfo, initDoneChan chan bo
 		case <-time.After(1 * time.Second):
 			continue
 		case <-initDoneChan:
-			logger.Debug("Stopping initial updates\n")
+			sublogger.Debug("Stopping initial updates\n")
 			return
 		}
 	}
@@ -1141,10 +1524,39 @@ func (s *Netceptor) sendAndLogConnectionRejection(remoteNodeID string, ci *connI
 }
 
 // Main Netceptor protocol loop
-func (s *Netceptor) runProtocol(sess BackendSession, connectionCost float64, nodeCost map[string]float64) error {
-	if connectionCost <= 0.0 {
-		return fmt.Errorf("connection cost must be positive")
+func (s *Netceptor) runProtocol(ctx context.Context, backendName string, sess BackendSession, costs BackendCosts) error {
+	err := costs.Validate()
+	if err != nil {
+		return err
+	}
+	connectionCost, receiveCost := costs.costsTo("")
+	// The session is described before it is wrapped, as the wrappers hide the connection
+	described, _ := sess.(DescribedSession)
+	limiter := s.backendRateLimiter(backendName)
+	if limiter != nil {
+		sess = &rateLimitedSession{
+			ctx:     ctx,
+			sess:    sess,
+			limiter: limiter,
+		}
+	}
+	if s.chaos.isEnabled() {
+		sess = &faultSession{
+			sess:        sess,
+			backendName: backendName,
+			chaos:       s.chaos,
+		}
+	}
+	if s.hmacKeys.enabled() {
+		hs, err := newHMACSession(sess, s.hmacKeys)
+		if err != nil {
+			_ = sess.Close()
+			return fmt.Errorf("could not start HMAC session: %s", err)
+		}
+		sess = hs
 	}
+	compressor := s.newCompressingSession(sess)
+	sess = compressor
 	established := false
 	remoteNodeID := ""
 	defer func() {
@@ -1170,15 +1582,30 @@ func (s *Netceptor) runProtocol(sess BackendSession, connectionCost float64, nod
 		}
 	}()
 	ci := &connInfo{
-		ReadChan:  make(chan []byte),
-		WriteChan: make(chan []byte),
-		Cost:      connectionCost,
-	}
-	ci.Context, ci.CancelFunc = context.WithCancel(s.context)
+		ReadChan:     make(chan []byte),
+		WriteChan:    make(chan []byte),
+		Cost:         connectionCost,
+		ReceiveCost:  receiveCost,
+		BackendName:  backendName,
+		stats:        s.backendCounters(backendName),
+		sessionStats: newTrafficCounters(),
+		described:    described,
+	}
+	keepaliveInterval, keepaliveMissed := s.Keepalive()
+	ci.keepaliveMissed = keepaliveMissed
+	ci.sendQueue = s.newSessionSendQueue(ci.stats)
+	ci.lastActivity = time.Now().UnixNano()
+	ci.Context, ci.CancelFunc = context.WithCancel(ctx)
 	go ci.protoReader(sess)
 	go ci.protoWriter(sess)
 	initDoneChan := make(chan bool)
 	go s.sendInitialConnectMessage(ci, initDoneChan)
+	var handshakeExpired <-chan time.Time
+	if timeout := s.HandshakeTimeout(); timeout > 0 {
+		handshakeTimer := time.NewTimer(timeout)
+		defer handshakeTimer.Stop()
+		handshakeExpired = handshakeTimer.C
+	}
 	for {
 		select {
 		case data := <-ci.ReadChan:
@@ -1187,20 +1614,20 @@ func (s *Netceptor) runProtocol(sess BackendSession, connectionCost float64, nod
 				if msgType == MsgTypeData {
 					message, err := s.translateDataToMessage(data)
 					if err != nil {
-						logger.Error("Error translating data to message struct: %s\n", err)
+						sublogger.Error("Error translating data to message struct: %s\n", err)
 						continue
 					}
-					logger.Trace("--- Received data length %d from %s:%s to %s:%s via %s\n", len(message.Data),
+					sublogger.Trace("--- Received data length %d from %s:%s to %s:%s via %s\n", len(message.Data),
 						message.FromNode, message.FromService, message.ToNode, message.ToService, remoteNodeID)
 					err = s.handleMessageData(message)
 					if err != nil {
-						logger.Error("Error handling message data: %s\n", err)
+						sublogger.Error("Error handling message data: %s\n", err)
 					}
 				} else if msgType == MsgTypeRoute {
 					ri := &routingUpdate{}
 					err := json.Unmarshal(data[1:], ri)
 					if err != nil {
-						logger.Error("Error unpacking routing update: %s\n", err)
+						sublogger.Error("Error unpacking routing update: %s\n", err)
 						continue
 					}
 					if ri.ForwardingNode != remoteNodeID {
@@ -1214,22 +1641,25 @@ func (s *Netceptor) runProtocol(sess BackendSession, connectionCost float64, nod
 						if !ok {
 							return s.sendAndLogConnectionRejection(remoteNodeID, ci, "remote node no longer lists us as a connection")
 						}
-						if ok && remoteCost != connectionCost {
+						// The remote node sends to us at our receive cost
+						if ok && remoteCost != receiveCost {
 							return s.sendAndLogConnectionRejection(remoteNodeID, ci, "we disagree about the connection cost")
 						}
 					}
 					s.handleRoutingUpdate(ri, remoteNodeID)
+				} else if msgType == MsgTypeKeepalive {
+					// Receiving it was all that mattered
 				} else if msgType == MsgTypeServiceAdvertisement {
 					err := s.handleServiceAdvertisement(data, remoteNodeID)
 					if err != nil {
-						logger.Error("Error handling service advertisement: %s\n", err)
+						sublogger.Error("Error handling service advertisement: %s\n", err)
 						continue
 					}
 				} else if msgType == MsgTypeReject {
-					logger.Warning("Received a rejection message from peer.")
+					sublogger.Warning("Received a rejection message from peer.")
 					return fmt.Errorf("remote node rejected the connection")
 				} else {
-					logger.Warning("Unknown message type %d\n", msgType)
+					sublogger.Warning("Unknown message type %d\n", msgType)
 				}
 			} else {
 				// Connection not established
@@ -1237,40 +1667,34 @@ func (s *Netceptor) runProtocol(sess BackendSession, connectionCost float64, nod
 					ri := &routingUpdate{}
 					err := json.Unmarshal(data[1:], ri)
 					if err != nil {
-						logger.Error("Error unpacking routing update: %s\n", err)
+						sublogger.Error("Error unpacking routing update: %s\n", err)
 						continue
 					}
 					remoteNodeID = ri.ForwardingNode
+					compressor.negotiate(ri.Compression)
+					ci.peerKeepalive = ri.KeepaliveInterval
+					ci.peerTracing = ri.Tracing
 					// Decide whether the remote node is acceptable
-					remoteNodeAccepted := true
-					if s.allowedPeers != nil {
-						remoteNodeAccepted = false
-						for i := range s.allowedPeers {
-							if s.allowedPeers[i] == remoteNodeID {
-								remoteNodeAccepted = true
-								break
-							}
-						}
-					}
-					if !remoteNodeAccepted {
-						return s.sendAndLogConnectionRejection(remoteNodeID, ci, "it is not in the accepted connections list")
+					allowed, reason := s.peerAdmission(remoteNodeID)
+					if !allowed {
+						return s.sendAndLogConnectionRejection(remoteNodeID, ci, reason)
 					}
+					sublogger.Info("Admitted peer %s because %s\n", remoteNodeID, reason)
 
-					remoteNodeCost, ok := nodeCost[remoteNodeID]
-					if ok {
-						ci.Cost = remoteNodeCost
-						connectionCost = remoteNodeCost
-					}
+					connectionCost, receiveCost = costs.costsTo(remoteNodeID)
+					ci.Cost = connectionCost
+					ci.ReceiveCost = receiveCost
 
 					// Establish the connection
 					initDoneChan <- true
-					logger.Info("Connection established with %s\n", remoteNodeID)
+					sublogger.Info("Connection established with %s\n", remoteNodeID)
 					s.addNameHash(remoteNodeID)
+					ci.established = time.Now()
 					s.connLock.Lock()
 					s.connections[remoteNodeID] = ci
 					s.connLock.Unlock()
 					s.knownNodeLock.Lock()
-					_, ok = s.knownConnectionCosts[s.nodeID]
+					_, ok := s.knownConnectionCosts[s.nodeID]
 					if !ok {
 						s.knownConnectionCosts[s.nodeID] = make(map[string]float64)
 					}
@@ -1279,16 +1703,30 @@ func (s *Netceptor) runProtocol(sess BackendSession, connectionCost float64, nod
 					if !ok {
 						s.knownConnectionCosts[remoteNodeID] = make(map[string]float64)
 					}
-					s.knownConnectionCosts[remoteNodeID][s.nodeID] = connectionCost
+					s.knownConnectionCosts[remoteNodeID][s.nodeID] = receiveCost
 					s.knownNodeLock.Unlock()
 					s.sendRouteFloodChan <- 0
 					s.updateRoutingTableChan <- 0
+					select {
+					case s.measureLatencyChan <- 0:
+					default:
+						// A measurement is already in progress
+					}
 					established = true
+					handshakeExpired = nil
+					if ci.peerKeepalive > 0 {
+						// Peers that do not send keepalives would not know what to do with ours
+						go ci.sendKeepalives(keepaliveInterval)
+					}
 				} else if msgType == MsgTypeReject {
-					logger.Warning("Received a rejection message from peer.")
+					sublogger.Warning("Received a rejection message from peer.")
 					return fmt.Errorf("remote node rejected the connection")
 				}
 			}
+		case <-handshakeExpired:
+			ci.stats.countHandshakeTimeout()
+			ci.CancelFunc()
+			return fmt.Errorf("session on %s did not complete its handshake within %s", backendName, s.HandshakeTimeout())
 		case <-ci.Context.Done():
 			return nil
 		}
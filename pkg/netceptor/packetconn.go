@@ -27,8 +27,9 @@ type PacketConn struct {
 // ListenPacket returns a datagram connection compatible with Go's net.PacketConn.
 // If service is blank, generates and uses an ephemeral service name.
 func (s *Netceptor) ListenPacket(service string) (*PacketConn, error) {
-	if len(service) > 8 {
-		return nil, fmt.Errorf("service name %s too long", service)
+	err := checkServiceName(service)
+	if err != nil {
+		return nil, err
 	}
 	if service == "" {
 		service = s.getEphemeralService()
@@ -125,6 +126,27 @@ func (pc *PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	return nCopied, fromAddr, nil
 }
 
+// readFromContext is like ReadFrom, but also returns when the context is done.  The PacketConn
+// must then be closed, so that the read still in progress returns.
+func (pc *PacketConn) readFromContext(ctx context.Context, p []byte) (int, net.Addr, error) {
+	type readResult struct {
+		n    int
+		addr net.Addr
+		err  error
+	}
+	resultChan := make(chan readResult, 1)
+	go func() {
+		n, addr, err := pc.ReadFrom(p)
+		resultChan <- readResult{n: n, addr: addr, err: err}
+	}()
+	select {
+	case r := <-resultChan:
+		return r.n, r.addr, r.err
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
 // WriteTo writes a packet to an address on the network.
 func (pc *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	ncaddr, ok := addr.(Addr)
@@ -0,0 +1,96 @@
+package netceptor
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PeerRegexPrefix marks an allowed or denied peers entry as a regular expression.  The expression
+// must match the whole node ID.
+const PeerRegexPrefix = "re:"
+
+// peerPattern is a compiled allowed or denied peers entry.  Entries are exact node IDs, glob
+// patterns such as worker-*, or regular expressions following PeerRegexPrefix.
+type peerPattern struct {
+	entry string
+	glob  bool
+	re    *regexp.Regexp
+}
+
+// compilePeerPattern compiles an allowed or denied peers entry
+func compilePeerPattern(entry string) (*peerPattern, error) {
+	pp := &peerPattern{entry: entry}
+	if strings.HasPrefix(entry, PeerRegexPrefix) {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(entry, PeerRegexPrefix) + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer regular expression %s: %s", entry, err)
+		}
+		pp.re = re
+		return pp, nil
+	}
+	if strings.ContainsAny(entry, "*?[") {
+		_, err := path.Match(entry, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer pattern %s: %s", entry, err)
+		}
+		pp.glob = true
+	}
+	return pp, nil
+}
+
+// matches returns true if a node ID matches the entry
+func (pp *peerPattern) matches(nodeID string) bool {
+	switch {
+	case pp.re != nil:
+		return pp.re.MatchString(nodeID)
+	case pp.glob:
+		matched, _ := path.Match(pp.entry, nodeID)
+		return matched
+	default:
+		return pp.entry == nodeID
+	}
+}
+
+// compilePeerPatterns compiles a list of allowed or denied peers entries.  A nil list stays nil.
+func compilePeerPatterns(entries []string) ([]*peerPattern, error) {
+	if entries == nil {
+		return nil, nil
+	}
+	patterns := make([]*peerPattern, 0, len(entries))
+	for _, entry := range entries {
+		pp, err := compilePeerPattern(entry)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pp)
+	}
+	return patterns, nil
+}
+
+// matchPeerPatterns returns the first entry that a node ID matches, and whether there was one
+func matchPeerPatterns(patterns []*peerPattern, nodeID string) (string, bool) {
+	for _, pp := range patterns {
+		if pp.matches(nodeID) {
+			return pp.entry, true
+		}
+	}
+	return "", false
+}
+
+// ValidatePeerPatterns checks that a list of allowed or denied peers entries can be used
+func ValidatePeerPatterns(entries []string) error {
+	_, err := compilePeerPatterns(entries)
+	return err
+}
+
+// MatchPeerPattern returns true if a node ID matches an allowed or denied peers entry, which is an
+// exact node ID, a glob pattern, or a regular expression following PeerRegexPrefix
+func MatchPeerPattern(entry string, nodeID string) (bool, error) {
+	pp, err := compilePeerPattern(entry)
+	if err != nil {
+		return false, err
+	}
+	return pp.matches(nodeID), nil
+}
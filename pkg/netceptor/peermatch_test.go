@@ -0,0 +1,100 @@
+package netceptor
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMatchPeerPattern(t *testing.T) {
+	cases := []struct {
+		entry   string
+		nodeID  string
+		matches bool
+	}{
+		{"node1", "node1", true},
+		{"node1", "node10", false},
+		{"node1", "Node1", false},
+		{"worker-*", "worker-1", true},
+		{"worker-*", "worker-", true},
+		{"worker-*", "worker", false},
+		{"worker-*", "my-worker-1", false},
+		{"worker-?", "worker-12", false},
+		{"worker-[0-4]", "worker-3", true},
+		{"worker-[0-4]", "worker-5", false},
+		{"*", "anything", true},
+		{"re:worker-[0-9]+", "worker-42", true},
+		{"re:worker-[0-9]+", "worker-42x", false},
+		{"re:worker-[0-9]+", "xworker-42", false},
+		{"re:a|b", "a", true},
+		{"re:a|b", "ab", false},
+		{"re:.*\\.example\\.com", "node.example.com", true},
+		{"re:.*\\.example\\.com", "node.example.org", false},
+	}
+	for _, c := range cases {
+		matches, err := MatchPeerPattern(c.entry, c.nodeID)
+		if err != nil {
+			t.Errorf("%s: %s", c.entry, err)
+			continue
+		}
+		if matches != c.matches {
+			t.Errorf("expected %s matching %s to be %v", c.entry, c.nodeID, c.matches)
+		}
+	}
+	for _, bad := range []string{"worker-[", "re:worker-(", "re:[z-a]"} {
+		_, err := MatchPeerPattern(bad, "worker-1")
+		if err == nil {
+			t.Errorf("accepted invalid pattern %s", bad)
+		}
+	}
+	if ValidatePeerPatterns([]string{"node1", "worker-*", "re:x+"}) != nil {
+		t.Error("rejected a valid list")
+	}
+	if ValidatePeerPatterns([]string{"node1", "worker-["}) == nil {
+		t.Error("accepted a list with an invalid entry")
+	}
+}
+
+func TestPeerAdmission(t *testing.T) {
+	n1 := New(context.Background(), "node1", []string{"worker-*", "re:db[0-9]", "control"})
+	defer n1.Shutdown()
+	err := n1.SetDeniedPeers([]string{"worker-bad*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		nodeID  string
+		allowed bool
+		reason  string
+	}{
+		{"worker-1", true, "worker-*"},
+		{"db3", true, "re:db[0-9]"},
+		{"control", true, "control"},
+		{"worker-bad1", false, "denied peers entry worker-bad*"},
+		{"db10", false, "not in the accepted connections list"},
+	}
+	for _, c := range cases {
+		allowed, reason := n1.peerAdmission(c.nodeID)
+		if allowed != c.allowed || !strings.Contains(reason, c.reason) {
+			t.Errorf("unexpected admission %v (%s) of %s", allowed, reason, c.nodeID)
+		}
+	}
+
+	// Denied peers apply even when all peers are allowed
+	n1.SetAllowedPeers(nil)
+	if n1.peerAllowed("worker-bad1") || !n1.peerAllowed("anyone") {
+		t.Error("denied peers were not applied with no allowed peers list")
+	}
+	if n1.SetDeniedPeers([]string{"re:("}) == nil {
+		t.Error("accepted an invalid denied peers list")
+	}
+	if len(n1.DeniedPeers()) != 1 {
+		t.Error("invalid denied peers list replaced the existing one")
+	}
+
+	// An invalid allowed peers list allows nobody
+	n1.SetAllowedPeers([]string{"worker-["})
+	if n1.peerAllowed("worker-1") {
+		t.Error("invalid allowed peers list let a peer connect")
+	}
+}
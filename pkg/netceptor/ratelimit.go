@@ -0,0 +1,164 @@
+package netceptor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReferenceBandwidth is the rate, in bytes per second, of a link whose bandwidth-derived cost is 1.0
+const ReferenceBandwidth = 1250000
+
+// BackendRateLimit caps the bandwidth used by the sessions of a backend.  Sending and receiving
+// are limited independently, each to BytesPerSec, and the sessions of a backend share its limit.
+type BackendRateLimit struct {
+	// BytesPerSec is the sustained rate allowed in each direction, or 0 for no limit
+	BytesPerSec int64
+	// Burst is how many bytes may be sent or received at once after an idle period.  If 0, it is
+	// one second's worth of BytesPerSec.
+	Burst int64
+}
+
+// Enabled returns true if the limit caps bandwidth
+func (rl BackendRateLimit) Enabled() bool {
+	return rl.BytesPerSec > 0
+}
+
+// Validate checks that the limit is usable
+func (rl BackendRateLimit) Validate() error {
+	if rl.BytesPerSec < 0 {
+		return fmt.Errorf("rate limit must not be negative")
+	}
+	if rl.Burst < 0 {
+		return fmt.Errorf("rate limit burst must not be negative")
+	}
+	return nil
+}
+
+// BandwidthCost returns a connection cost for a link of the given bandwidth, in bytes per second,
+// so that routing prefers faster links.  A link of ReferenceBandwidth costs 1.0.
+func BandwidthCost(bytesPerSec int64) (float64, error) {
+	if bytesPerSec <= 0 {
+		return 0, fmt.Errorf("bandwidth must be positive to derive a cost from it")
+	}
+	return float64(ReferenceBandwidth) / float64(bytesPerSec), nil
+}
+
+// tokenBucket throttles a stream of messages to a rate
+type tokenBucket struct {
+	lock   *sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket allocates a new tokenBucket, initially full
+func newTokenBucket(rate int64, burst int64) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		lock:   &sync.Mutex{},
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before using them.  A message
+// larger than the burst is allowed through, leaving the bucket in debt until it refills.
+func (tb *tokenBucket) reserve(n int) time.Duration {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may be used, or the context ends
+func (tb *tokenBucket) wait(ctx context.Context, n int) error {
+	delay := tb.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimiter holds the buckets of a backend, one for each direction
+type rateLimiter struct {
+	send *tokenBucket
+	recv *tokenBucket
+}
+
+// newRateLimiter allocates a new rateLimiter, or returns nil if the limit is not enabled
+func newRateLimiter(limit BackendRateLimit) *rateLimiter {
+	if !limit.Enabled() {
+		return nil
+	}
+	return &rateLimiter{
+		send: newTokenBucket(limit.BytesPerSec, limit.Burst),
+		recv: newTokenBucket(limit.BytesPerSec, limit.Burst),
+	}
+}
+
+// rateLimitedSession throttles the frames sent and received over a session
+type rateLimitedSession struct {
+	ctx     context.Context
+	sess    BackendSession
+	limiter *rateLimiter
+}
+
+// Send waits until the send limit allows the frame, then sends it
+func (rs *rateLimitedSession) Send(data []byte) error {
+	err := rs.limiter.send.wait(rs.ctx, len(data))
+	if err != nil {
+		return err
+	}
+	return rs.sess.Send(data)
+}
+
+// Recv receives a frame, then waits until the receive limit allows it.  Delaying the frame keeps
+// the session from reading further until the peer's traffic is back within the limit.
+func (rs *rateLimitedSession) Recv(timeout time.Duration) ([]byte, error) {
+	data, err := rs.sess.Recv(timeout)
+	if err != nil {
+		return data, err
+	}
+	err = rs.limiter.recv.wait(rs.ctx, len(data))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close closes the underlying session
+func (rs *rateLimitedSession) Close() error {
+	return rs.sess.Close()
+}
+
+// backendRateLimiter returns the rate limiter of a backend, or nil if it is not limited
+func (s *Netceptor) backendRateLimiter(name string) *rateLimiter {
+	s.backendLock.RLock()
+	defer s.backendLock.RUnlock()
+	bi, ok := s.backends[name]
+	if !ok {
+		return nil
+	}
+	return bi.limiter
+}
@@ -0,0 +1,50 @@
+package netceptor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(1000, 0)
+	if d := tb.reserve(1000); d != 0 {
+		t.Fatalf("full bucket delayed a burst by %s", d)
+	}
+	d := tb.reserve(500)
+	if d < 450*time.Millisecond || d > 550*time.Millisecond {
+		t.Fatalf("expected a delay of about 500ms, got %s", d)
+	}
+
+	// A message larger than the burst goes through, and the debt delays the next one
+	tb = newTokenBucket(1000, 100)
+	if d := tb.reserve(300); d < 150*time.Millisecond || d > 250*time.Millisecond {
+		t.Fatalf("expected a delay of about 200ms, got %s", d)
+	}
+	if d := tb.reserve(100); d < 250*time.Millisecond {
+		t.Fatalf("expected the debt to delay the next message, got %s", d)
+	}
+
+	if newRateLimiter(BackendRateLimit{}) != nil {
+		t.Fatal("limiter created for an unlimited backend")
+	}
+	rl := newRateLimiter(BackendRateLimit{BytesPerSec: 1000})
+	if rl.send == rl.recv {
+		t.Fatal("send and receive share a bucket")
+	}
+}
+
+func TestBandwidthCost(t *testing.T) {
+	cost, err := BandwidthCost(ReferenceBandwidth)
+	if err != nil || cost != 1.0 {
+		t.Fatalf("expected cost 1.0 at the reference bandwidth, got %f, %v", cost, err)
+	}
+	slow, _ := BandwidthCost(ReferenceBandwidth / 10)
+	fast, _ := BandwidthCost(ReferenceBandwidth * 10)
+	if slow <= fast {
+		t.Fatal("slower link does not cost more")
+	}
+	_, err = BandwidthCost(0)
+	if err == nil {
+		t.Fatal("cost derived from a zero bandwidth")
+	}
+}
@@ -0,0 +1,71 @@
+package netceptor
+
+import (
+	"sort"
+)
+
+// SetRelayAllowedServices restricts the transit traffic this node will forward to messages
+// destined for the given service names, and the replies those services send back.  Traffic to
+// or from the local node is not affected.  An empty list removes the restriction.
+func (s *Netceptor) SetRelayAllowedServices(services []string) {
+	s.relayLock.Lock()
+	defer s.relayLock.Unlock()
+	if len(services) == 0 {
+		s.relayAllowedServices = nil
+		return
+	}
+	s.relayAllowedServices = make(map[string]bool)
+	for _, svc := range services {
+		s.relayAllowedServices[svc] = true
+	}
+}
+
+// RelayAllowedServices returns the service names this node will relay transit traffic for,
+// or nil if all transit traffic is relayed
+func (s *Netceptor) RelayAllowedServices() []string {
+	s.relayLock.RLock()
+	defer s.relayLock.RUnlock()
+	if s.relayAllowedServices == nil {
+		return nil
+	}
+	services := make([]string, 0, len(s.relayAllowedServices))
+	for svc := range s.relayAllowedServices {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// RelayDropped returns the number of transit messages dropped because their destination
+// service is not in the relay allowlist, by destination service
+func (s *Netceptor) RelayDropped() map[string]uint64 {
+	s.relayLock.RLock()
+	defer s.relayLock.RUnlock()
+	dropped := make(map[string]uint64)
+	for k, v := range s.relayDropped {
+		dropped[k] = v
+	}
+	return dropped
+}
+
+// relayAllowed returns true if a message may be forwarded through this node, counting it as
+// dropped if not.  Messages sent from an allowed service are replies to its clients, whose
+// ephemeral service names cannot be in the allowlist.
+func (s *Netceptor) relayAllowed(md *messageData) bool {
+	if md.FromNode == s.nodeID {
+		return true
+	}
+	s.relayLock.RLock()
+	allowed := s.relayAllowedServices == nil || s.relayAllowedServices[md.ToService] ||
+		s.relayAllowedServices[md.FromService]
+	s.relayLock.RUnlock()
+	if allowed {
+		return true
+	}
+	s.relayLock.Lock()
+	s.relayDropped[md.ToService]++
+	s.relayLock.Unlock()
+	sublogger.Debug("Dropping transit message from %s:%s to %s:%s: service not allowed for relay\n",
+		md.FromNode, md.FromService, md.ToNode, md.ToService)
+	return false
+}
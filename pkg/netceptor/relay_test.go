@@ -0,0 +1,140 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRelayAllowedServices(t *testing.T) {
+	nodes := make(map[string]*Netceptor)
+	for _, id := range []string{"nodeA", "nodeB", "nodeC"} {
+		nodes[id] = New(context.Background(), id, nil)
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.Shutdown()
+		}
+		for _, n := range nodes {
+			n.BackendWait()
+		}
+	}()
+	nodes["nodeB"].SetRelayAllowedServices([]string{"http"})
+	linkNodes(t, nodes["nodeA"], nodes["nodeB"], "", 1.0)
+	linkNodes(t, nodes["nodeB"], nodes["nodeC"], "", 1.0)
+	waitForRoute(t, nodes["nodeA"], "nodeC", "nodeB")
+
+	httpListener, err := nodes["nodeC"].ListenPacket("http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherListener, err := nodes["nodeC"].ListenPacket("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := nodes["nodeA"].ListenPacket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sender.WriteTo([]byte("hello"), nodes["nodeA"].NewAddr("nodeC", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sender.WriteTo([]byte("hello"), nodes["nodeA"].NewAddr("nodeC", "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	_ = httpListener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := httpListener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("traffic to an allowed service was not relayed: %s", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected data %q", buf[:n])
+	}
+
+	// The disallowed message was sent first, so it has already been dropped if it is not here now
+	_ = otherListener.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err = otherListener.ReadFrom(buf)
+	if err == nil {
+		t.Fatal("traffic to a disallowed service was relayed")
+	}
+	dropped := nodes["nodeB"].RelayDropped()
+	if dropped["other"] != 1 || dropped["http"] != 0 {
+		t.Fatalf("unexpected relay drop counters %v", dropped)
+	}
+
+	nodes["nodeB"].SetRelayAllowedServices(nil)
+	if nodes["nodeB"].RelayAllowedServices() != nil {
+		t.Fatal("relay restriction was not removed")
+	}
+}
+
+func TestRelayRoundTrip(t *testing.T) {
+	nodes := make(map[string]*Netceptor)
+	for _, id := range []string{"nodeA", "nodeB", "nodeC"} {
+		nodes[id] = New(context.Background(), id, nil)
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.Shutdown()
+		}
+		for _, n := range nodes {
+			n.BackendWait()
+		}
+	}()
+	nodes["nodeB"].SetRelayAllowedServices([]string{"echo"})
+	linkNodes(t, nodes["nodeA"], nodes["nodeB"], "", 1.0)
+	linkNodes(t, nodes["nodeB"], nodes["nodeC"], "", 1.0)
+	waitForRoute(t, nodes["nodeA"], "nodeC", "nodeB")
+
+	li, err := nodes["nodeC"].Listen("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 16)
+				n, err := conn.Read(buf)
+				if err == nil {
+					_, _ = conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	// A connection to the allowed service only works if the replies are relayed too
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := nodes["nodeA"].DialContext(ctx, "nodeC", "echo", nil)
+	if err != nil {
+		t.Fatalf("could not connect through the relay: %s", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("reply was not relayed: %s", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected reply %q", buf[:n])
+	}
+	dropped := nodes["nodeB"].RelayDropped()
+	if len(dropped) != 0 {
+		t.Fatalf("messages of an allowed connection were dropped: %v", dropped)
+	}
+}
@@ -0,0 +1,40 @@
+package netceptor
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bounds on the interval at which regular route updates are sent
+const (
+	MinRouteUpdateInterval = 1 * time.Second
+	MaxRouteUpdateInterval = 10 * time.Minute
+)
+
+// SetRouteUpdateInterval changes the interval at which this node sends regular route updates,
+// which defaults to RouteUpdateTime.  The new interval applies immediately, counting from the
+// last update.  Updates triggered by topology changes are still sent right away, and connection
+// keepalives are not affected.
+func (s *Netceptor) SetRouteUpdateInterval(interval time.Duration) error {
+	if interval < MinRouteUpdateInterval || interval > MaxRouteUpdateInterval {
+		return fmt.Errorf("route update interval must be between %s and %s",
+			MinRouteUpdateInterval, MaxRouteUpdateInterval)
+	}
+	s.backendLock.Lock()
+	s.routeUpdateInterval = interval
+	s.backendLock.Unlock()
+	select {
+	case s.routeIntervalChan <- interval:
+	case <-s.context.Done():
+		return fmt.Errorf("netceptor is shutting down")
+	}
+	sublogger.Info("Route update interval set to %s\n", interval)
+	return nil
+}
+
+// RouteUpdateInterval returns the interval at which this node sends regular route updates
+func (s *Netceptor) RouteUpdateInterval() time.Duration {
+	s.backendLock.RLock()
+	defer s.backendLock.RUnlock()
+	return s.routeUpdateInterval
+}
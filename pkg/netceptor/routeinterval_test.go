@@ -0,0 +1,51 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRouteUpdateInterval(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	if n1.RouteUpdateInterval() != RouteUpdateTime {
+		t.Fatalf("unexpected default route update interval %s", n1.RouteUpdateInterval())
+	}
+	for _, bad := range []time.Duration{100 * time.Millisecond, time.Hour} {
+		if n1.SetRouteUpdateInterval(bad) == nil {
+			t.Fatalf("route update interval of %s was accepted", bad)
+		}
+	}
+
+	linkNodes(t, n1, n2, "", 1.0)
+	waitForRoute(t, n2, "node1", "node1")
+	// Let the updates triggered by the new connection settle
+	time.Sleep(time.Second)
+
+	// Each routing update has a new ID, so node2 sees one new ID per update node1 sends
+	seenUpdates := func() int {
+		n2.knownNodeLock.RLock()
+		defer n2.knownNodeLock.RUnlock()
+		return len(n2.seenUpdates)
+	}
+	err := n1.SetRouteUpdateInterval(MinRouteUpdateInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := seenUpdates()
+	time.Sleep(3500 * time.Millisecond)
+	updates := seenUpdates() - before
+	if updates < 3 || updates > 5 {
+		t.Fatalf("expected about 3 routing updates at a 1s interval, got %d", updates)
+	}
+	if n1.RouteUpdateInterval() != MinRouteUpdateInterval {
+		t.Fatalf("route update interval is %s after being set", n1.RouteUpdateInterval())
+	}
+}
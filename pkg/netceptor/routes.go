@@ -0,0 +1,267 @@
+package netceptor
+
+import (
+	"fmt"
+	priorityQueue "github.com/jupp0r/go-priority-queue"
+	"math"
+	"sort"
+)
+
+// computeRoutes runs Dijkstra's algorithm over a connection cost table and returns the next hop
+// and path cost from the given node to every reachable destination.
+func computeRoutes(nodeID string, connectionCosts map[string]map[string]float64) (map[string]string, map[string]float64) {
+	Q := priorityQueue.New()
+	Q.Insert(nodeID, 0.0)
+	cost := make(map[string]float64)
+	prev := make(map[string]string)
+	for node := range connectionCosts {
+		if node == nodeID {
+			cost[node] = 0.0
+		} else {
+			cost[node] = math.MaxFloat64
+		}
+		prev[node] = ""
+		Q.Insert(node, cost[node])
+	}
+	for Q.Len() > 0 {
+		nodeIf, _ := Q.Pop()
+		node := fmt.Sprintf("%v", nodeIf)
+		for neighbor, edgeCost := range connectionCosts[node] {
+			pathCost := cost[node] + edgeCost
+			if pathCost < cost[neighbor] {
+				cost[neighbor] = pathCost
+				prev[neighbor] = node
+				Q.Insert(neighbor, pathCost)
+			}
+		}
+	}
+	routingTable := make(map[string]string)
+	for dest := range connectionCosts {
+		p := dest
+		for {
+			if prev[p] == nodeID {
+				routingTable[dest] = p
+				break
+			} else if prev[p] == "" {
+				break
+			}
+			p = prev[p]
+		}
+	}
+	return routingTable, cost
+}
+
+// RoutePreviewEntry describes how a proposed change would affect the route to one destination.
+// An empty next hop means the destination is unreachable.
+type RoutePreviewEntry struct {
+	Destination     string
+	CurrentNextHop  string
+	ProposedNextHop string
+}
+
+// cloneConnectionCosts returns a deep copy of the known connection costs.  The caller must
+// hold knownNodeLock.
+func (s *Netceptor) cloneConnectionCosts() map[string]map[string]float64 {
+	costs := make(map[string]map[string]float64)
+	for k1, v1 := range s.knownConnectionCosts {
+		costs[k1] = make(map[string]float64)
+		for k2, v2 := range v1 {
+			costs[k1][k2] = v2
+		}
+	}
+	return costs
+}
+
+// costMultiplier returns the factor routes apply to the costs of a node's connections, which is
+// MaintenanceCostMultiplier for remote nodes in maintenance mode.  The caller must hold
+// knownNodeLock.
+func (s *Netceptor) costMultiplier(nodeID string) float64 {
+	ni, ok := s.knownNodeInfo[nodeID]
+	if ok && ni.Maintenance {
+		return MaintenanceCostMultiplier
+	}
+	return 1.0
+}
+
+// routingCosts returns a copy of the known connection costs as routes are computed from them,
+// with the costs of each node's connections multiplied by its costMultiplier.  The caller must
+// hold knownNodeLock.
+func (s *Netceptor) routingCosts() map[string]map[string]float64 {
+	costs := s.cloneConnectionCosts()
+	for node, conns := range costs {
+		multiplier := s.costMultiplier(node)
+		for neighbor := range conns {
+			conns[neighbor] *= multiplier
+		}
+	}
+	return costs
+}
+
+// diffRoutes returns the destinations whose next hop differs between two routing tables
+func diffRoutes(current map[string]string, proposed map[string]string) []*RoutePreviewEntry {
+	entries := make([]*RoutePreviewEntry, 0)
+	for dest, nextHop := range current {
+		if proposed[dest] != nextHop {
+			entries = append(entries, &RoutePreviewEntry{
+				Destination:     dest,
+				CurrentNextHop:  nextHop,
+				ProposedNextHop: proposed[dest],
+			})
+		}
+	}
+	for dest, nextHop := range proposed {
+		_, ok := current[dest]
+		if !ok {
+			entries = append(entries, &RoutePreviewEntry{
+				Destination:     dest,
+				ProposedNextHop: nextHop,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Destination < entries[j].Destination
+	})
+	return entries
+}
+
+// PreviewCostChange returns the destinations whose next hop would change if the cost of the
+// connection between node1 and node2 were set to the given value.  The live routing table is
+// not modified.
+func (s *Netceptor) PreviewCostChange(node1 string, node2 string, cost float64) ([]*RoutePreviewEntry, error) {
+	if cost <= 0.0 {
+		return nil, fmt.Errorf("connection cost must be positive")
+	}
+	s.knownNodeLock.RLock()
+	_, ok1 := s.knownConnectionCosts[node1][node2]
+	_, ok2 := s.knownConnectionCosts[node2][node1]
+	if !ok1 && !ok2 {
+		s.knownNodeLock.RUnlock()
+		return nil, fmt.Errorf("no known connection between %s and %s", node1, node2)
+	}
+	costs := s.routingCosts()
+	multiplier1 := s.costMultiplier(node1)
+	multiplier2 := s.costMultiplier(node2)
+	s.knownNodeLock.RUnlock()
+	if ok1 {
+		costs[node1][node2] = cost * multiplier1
+	}
+	if ok2 {
+		costs[node2][node1] = cost * multiplier2
+	}
+	proposed, _ := computeRoutes(s.nodeID, costs)
+	return diffRoutes(s.Status().RoutingTable, proposed), nil
+}
+
+// PreviewStaticRoute returns the destinations whose next hop would change if traffic to dest
+// were always sent via nextHop, which must be a direct neighbor.  The live routing table is
+// not modified.
+func (s *Netceptor) PreviewStaticRoute(dest string, nextHop string) ([]*RoutePreviewEntry, error) {
+	if dest == s.nodeID {
+		return nil, fmt.Errorf("cannot add a static route to the local node")
+	}
+	s.knownNodeLock.RLock()
+	_, ok := s.knownConnectionCosts[s.nodeID][nextHop]
+	costs := s.routingCosts()
+	s.knownNodeLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s is not a direct neighbor", nextHop)
+	}
+	proposed, _ := computeRoutes(s.nodeID, costs)
+	proposed[dest] = nextHop
+	return diffRoutes(s.Status().RoutingTable, proposed), nil
+}
+
+// RouteEntry is the route from this node to one destination
+type RouteEntry struct {
+	Destination string
+	// NextHop is the neighbor that traffic to the destination is sent to, or empty if the
+	// destination is unreachable
+	NextHop string
+	// Cost is the total cost of the path to the destination, or zero if it is unreachable
+	Cost      float64
+	Reachable bool
+}
+
+// LinkEntry is a connection between two nodes, as advertised by the node it starts from
+type LinkEntry struct {
+	From string
+	To   string
+	Cost float64
+	// Up is true if the nodes at both ends advertise the connection and, for connections of this
+	// node, the backend session is established
+	Up bool
+}
+
+// RoutingSnapshot is a consistent copy of the routing state of a node
+type RoutingSnapshot struct {
+	NodeID string
+	// Routes are the routes to every other known node, sorted by destination
+	Routes []*RouteEntry
+	// Links are the connections between known nodes, sorted by the node they start from and then
+	// the node they lead to
+	Links []*LinkEntry
+}
+
+// RoutingSnapshot returns a copy of the routing table, with the path cost to each destination,
+// and of the connections it was computed from.  The routes and links are taken at the same time,
+// so they are consistent with each other, and sorted, so snapshots of different nodes can be
+// compared.
+func (s *Netceptor) RoutingSnapshot() *RoutingSnapshot {
+	s.knownNodeLock.RLock()
+	links := make([]*LinkEntry, 0)
+	for from, conns := range s.knownConnectionCosts {
+		for to, cost := range conns {
+			_, reverse := s.knownConnectionCosts[to][from]
+			links = append(links, &LinkEntry{
+				From: from,
+				To:   to,
+				Cost: cost,
+				Up:   reverse,
+			})
+		}
+	}
+	s.routingTableLock.RLock()
+	routes := make([]*RouteEntry, 0, len(s.routingPathCosts))
+	for dest, cost := range s.routingPathCosts {
+		if dest == s.nodeID {
+			continue
+		}
+		route := &RouteEntry{
+			Destination: dest,
+		}
+		nextHop, ok := s.routingTable[dest]
+		if ok {
+			route.NextHop = nextHop
+			route.Cost = cost
+			route.Reachable = true
+		}
+		routes = append(routes, route)
+	}
+	s.routingTableLock.RUnlock()
+	s.knownNodeLock.RUnlock()
+	s.connLock.RLock()
+	for _, link := range links {
+		if link.From == s.nodeID {
+			_, ok := s.connections[link.To]
+			link.Up = link.Up && ok
+		} else if link.To == s.nodeID {
+			_, ok := s.connections[link.From]
+			link.Up = link.Up && ok
+		}
+	}
+	s.connLock.RUnlock()
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Destination < routes[j].Destination
+	})
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].From != links[j].From {
+			return links[i].From < links[j].From
+		}
+		return links[i].To < links[j].To
+	})
+	return &RoutingSnapshot{
+		NodeID: s.nodeID,
+		Routes: routes,
+		Links:  links,
+	}
+}
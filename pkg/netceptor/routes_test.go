@@ -0,0 +1,121 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPreviewCostChange(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	defer n1.Shutdown()
+	n1.knownNodeLock.Lock()
+	n1.knownConnectionCosts = map[string]map[string]float64{
+		"node1": {"node2": 1.0, "node3": 1.0},
+		"node2": {"node1": 1.0, "node4": 1.0},
+		"node3": {"node1": 1.0, "node4": 5.0},
+		"node4": {"node2": 1.0, "node3": 5.0},
+	}
+	n1.knownNodeLock.Unlock()
+	n1.updateRoutingTable()
+	if n1.Status().RoutingTable["node4"] != "node2" {
+		t.Fatalf("unexpected initial routing table %v", n1.Status().RoutingTable)
+	}
+
+	preview, err := n1.PreviewCostChange("node1", "node2", 10.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposed := make(map[string]string)
+	for _, entry := range preview {
+		proposed[entry.Destination] = entry.ProposedNextHop
+	}
+	if len(proposed) != 2 || proposed["node2"] != "node3" || proposed["node4"] != "node3" {
+		t.Fatalf("unexpected route preview %v", proposed)
+	}
+
+	live := n1.Status().RoutingTable
+	if live["node2"] != "node2" || live["node4"] != "node2" {
+		t.Fatalf("route preview modified the live routing table: %v", live)
+	}
+	n1.knownNodeLock.RLock()
+	liveCost := n1.knownConnectionCosts["node1"]["node2"]
+	n1.knownNodeLock.RUnlock()
+	if liveCost != 1.0 {
+		t.Fatalf("route preview modified the live connection cost: %f", liveCost)
+	}
+
+	_, err = n1.PreviewCostChange("node1", "node4", 1.0)
+	if err == nil {
+		t.Fatal("cost change for an unknown connection was accepted")
+	}
+	_, err = n1.PreviewStaticRoute("node4", "node4")
+	if err == nil {
+		t.Fatal("static route via a non-neighbor was accepted")
+	}
+	preview, err = n1.PreviewStaticRoute("node4", "node3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preview) != 1 || preview[0].Destination != "node4" || preview[0].CurrentNextHop != "node2" ||
+		preview[0].ProposedNextHop != "node3" {
+		t.Fatalf("unexpected static route preview %v", preview)
+	}
+}
+
+func TestRoutingSnapshot(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	defer n1.Shutdown()
+	n1.knownNodeLock.Lock()
+	n1.knownConnectionCosts = map[string]map[string]float64{
+		"node1": {"node2": 1.0, "node3": 2.0},
+		"node2": {"node1": 1.0, "node4": 3.0},
+		"node3": {"node1": 2.0},
+		"node4": {"node2": 3.0},
+		// node5 advertises a connection to node4 that node4 does not
+		"node5": {"node4": 1.0},
+	}
+	n1.knownNodeLock.Unlock()
+	n1.connLock.Lock()
+	n1.connections["node2"] = &connInfo{}
+	n1.connLock.Unlock()
+	defer func() {
+		n1.connLock.Lock()
+		delete(n1.connections, "node2")
+		n1.connLock.Unlock()
+	}()
+	n1.updateRoutingTable()
+
+	snapshot := n1.RoutingSnapshot()
+	if snapshot.NodeID != "node1" || len(snapshot.Routes) != 4 {
+		t.Fatalf("unexpected routing snapshot %+v", snapshot)
+	}
+	expectedRoutes := []RouteEntry{
+		{Destination: "node2", NextHop: "node2", Cost: 1.0, Reachable: true},
+		{Destination: "node3", NextHop: "node3", Cost: 2.0, Reachable: true},
+		{Destination: "node4", NextHop: "node2", Cost: 4.0, Reachable: true},
+		{Destination: "node5"},
+	}
+	for i, route := range snapshot.Routes {
+		if *route != expectedRoutes[i] {
+			t.Fatalf("unexpected route %+v, expected %+v", route, expectedRoutes[i])
+		}
+	}
+	expectedLinks := []LinkEntry{
+		{From: "node1", To: "node2", Cost: 1.0, Up: true},
+		// There is no backend session with node3
+		{From: "node1", To: "node3", Cost: 2.0, Up: false},
+		{From: "node2", To: "node1", Cost: 1.0, Up: true},
+		{From: "node2", To: "node4", Cost: 3.0, Up: true},
+		{From: "node3", To: "node1", Cost: 2.0, Up: false},
+		{From: "node4", To: "node2", Cost: 3.0, Up: true},
+		{From: "node5", To: "node4", Cost: 1.0, Up: false},
+	}
+	if len(snapshot.Links) != len(expectedLinks) {
+		t.Fatalf("unexpected links %+v", snapshot.Links)
+	}
+	for i, link := range snapshot.Links {
+		if *link != expectedLinks[i] {
+			t.Fatalf("unexpected link %+v, expected %+v", link, expectedLinks[i])
+		}
+	}
+}
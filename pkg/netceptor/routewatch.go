@@ -0,0 +1,182 @@
+package netceptor
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Route event types
+const (
+	// RouteAdded is a node that has become reachable
+	RouteAdded = "added"
+	// RouteRemoved is a node that is no longer reachable
+	RouteRemoved = "removed"
+	// RouteUpdated is a node whose next hop or cost has changed
+	RouteUpdated = "updated"
+)
+
+// RouteEvent is a change to the route to a node.  For removed nodes, NextHop and Cost are empty.
+type RouteEvent struct {
+	Type    string
+	Node    string
+	NextHop string
+	Cost    float64
+}
+
+// routeSubscriber is a subscription to route changes.  Changes that have not been delivered yet
+// are kept in pending, one per node, so a burst of changes to a node is delivered as one event.
+type routeSubscriber struct {
+	lock    *sync.Mutex
+	pending map[string]RouteEvent
+	notify  chan struct{}
+}
+
+// routeSubscriptions holds the current subscriptions to route changes
+type routeSubscriptions struct {
+	lock *sync.Mutex
+	subs map[*routeSubscriber]struct{}
+}
+
+// newRouteSubscriptions allocates a new routeSubscriptions
+func newRouteSubscriptions() *routeSubscriptions {
+	return &routeSubscriptions{
+		lock: &sync.Mutex{},
+		subs: make(map[*routeSubscriber]struct{}),
+	}
+}
+
+// coalesce merges an event into one that has not been delivered yet.  It returns false if the
+// two cancel out, such as a node that appeared and disappeared again.
+func coalesce(prev RouteEvent, next RouteEvent) (RouteEvent, bool) {
+	switch {
+	case prev.Type == RouteAdded && next.Type == RouteRemoved:
+		return RouteEvent{}, false
+	case prev.Type == RouteAdded:
+		next.Type = RouteAdded
+	case prev.Type == RouteRemoved && next.Type == RouteAdded:
+		next.Type = RouteUpdated
+	}
+	return next, true
+}
+
+// queue adds events to the subscriber's pending events and wakes it up
+func (rs *routeSubscriber) queue(events []RouteEvent) {
+	rs.lock.Lock()
+	for _, ev := range events {
+		prev, ok := rs.pending[ev.Node]
+		if ok {
+			var keep bool
+			ev, keep = coalesce(prev, ev)
+			if !keep {
+				delete(rs.pending, prev.Node)
+				continue
+			}
+		}
+		rs.pending[ev.Node] = ev
+	}
+	rs.lock.Unlock()
+	select {
+	case rs.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns the pending events, sorted by node
+func (rs *routeSubscriber) take() []RouteEvent {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	events := make([]RouteEvent, 0, len(rs.pending))
+	for _, ev := range rs.pending {
+		events = append(events, ev)
+	}
+	rs.pending = make(map[string]RouteEvent)
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Node < events[j].Node
+	})
+	return events
+}
+
+// publish queues events for every subscriber
+func (rsubs *routeSubscriptions) publish(events []RouteEvent) {
+	if len(events) == 0 {
+		return
+	}
+	rsubs.lock.Lock()
+	defer rsubs.lock.Unlock()
+	for rs := range rsubs.subs {
+		rs.queue(events)
+	}
+}
+
+// routeEvents returns the events that turn one routing table into another
+func routeEvents(oldTable map[string]string, oldCosts map[string]float64, newTable map[string]string,
+	newCosts map[string]float64) []RouteEvent {
+	events := make([]RouteEvent, 0)
+	for node, nextHop := range newTable {
+		oldNextHop, ok := oldTable[node]
+		switch {
+		case !ok:
+			events = append(events, RouteEvent{Type: RouteAdded, Node: node, NextHop: nextHop, Cost: newCosts[node]})
+		case oldNextHop != nextHop || oldCosts[node] != newCosts[node]:
+			events = append(events, RouteEvent{Type: RouteUpdated, Node: node, NextHop: nextHop, Cost: newCosts[node]})
+		}
+	}
+	for node := range oldTable {
+		_, ok := newTable[node]
+		if !ok {
+			events = append(events, RouteEvent{Type: RouteRemoved, Node: node})
+		}
+	}
+	return events
+}
+
+// SubscribeRoutes returns a channel that receives a RouteEvent for each change to the routing
+// table.  It first receives an added event for each node that is currently reachable.  Changes
+// that happen while the subscriber is not reading are coalesced, so the subscriber only sees
+// the latest state of each node.  The channel is closed once the context is cancelled or the
+// node shuts down.
+func (s *Netceptor) SubscribeRoutes(ctx context.Context) <-chan RouteEvent {
+	rs := &routeSubscriber{
+		lock:    &sync.Mutex{},
+		pending: make(map[string]RouteEvent),
+		notify:  make(chan struct{}, 1),
+	}
+	// Holding the routing table lock while subscribing means no change is missed or seen twice
+	s.routingTableLock.RLock()
+	current := routeEvents(nil, nil, s.routingTable, s.routingPathCosts)
+	s.routeSubs.lock.Lock()
+	s.routeSubs.subs[rs] = struct{}{}
+	s.routeSubs.lock.Unlock()
+	rs.queue(current)
+	s.routingTableLock.RUnlock()
+
+	events := make(chan RouteEvent)
+	go func() {
+		defer close(events)
+		defer func() {
+			s.routeSubs.lock.Lock()
+			delete(s.routeSubs.subs, rs)
+			s.routeSubs.lock.Unlock()
+		}()
+		for {
+			select {
+			case <-rs.notify:
+			case <-ctx.Done():
+				return
+			case <-s.context.Done():
+				return
+			}
+			for _, ev := range rs.take() {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				case <-s.context.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
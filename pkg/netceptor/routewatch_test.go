@@ -0,0 +1,92 @@
+package netceptor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRouteEventCoalescing(t *testing.T) {
+	rs := &routeSubscriber{
+		lock:    &sync.Mutex{},
+		pending: make(map[string]RouteEvent),
+		notify:  make(chan struct{}, 1),
+	}
+	rs.queue([]RouteEvent{
+		{Type: RouteAdded, Node: "a", NextHop: "a", Cost: 1},
+		{Type: RouteAdded, Node: "b", NextHop: "b", Cost: 1},
+		{Type: RouteRemoved, Node: "c"},
+	})
+	rs.queue([]RouteEvent{
+		{Type: RouteUpdated, Node: "a", NextHop: "b", Cost: 2},
+		{Type: RouteRemoved, Node: "b"},
+		{Type: RouteAdded, Node: "c", NextHop: "a", Cost: 3},
+	})
+	events := rs.take()
+	expected := []RouteEvent{
+		{Type: RouteAdded, Node: "a", NextHop: "b", Cost: 2},
+		{Type: RouteUpdated, Node: "c", NextHop: "a", Cost: 3},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, events)
+		}
+	}
+	if len(rs.take()) != 0 {
+		t.Fatal("events were delivered twice")
+	}
+}
+
+func TestSubscribeRoutes(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := n1.SubscribeRoutes(ctx)
+
+	linkNodes(t, n1, n2, "", 1.0)
+
+	select {
+	case ev := <-events:
+		if ev.Type != RouteAdded || ev.Node != "node2" || ev.NextHop != "node2" || ev.Cost != 1.0 {
+			t.Fatalf("unexpected route event %v", ev)
+		}
+	case <-ctx.Done():
+		t.Fatal("no route event for the new connection")
+	}
+
+	// A later subscriber first sees the routes that already exist
+	laterCtx, laterCancel := context.WithCancel(ctx)
+	later := n1.SubscribeRoutes(laterCtx)
+	ev := <-later
+	if ev.Type != RouteAdded || ev.Node != "node2" {
+		t.Fatalf("unexpected initial route event %v", ev)
+	}
+
+	// Cancelling the context ends the subscription
+	laterCancel()
+	select {
+	case _, ok := <-later:
+		if ok {
+			t.Fatal("received an event after the subscription was cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription channel was not closed")
+	}
+	n1.routeSubs.lock.Lock()
+	subs := len(n1.routeSubs.subs)
+	n1.routeSubs.lock.Unlock()
+	if subs != 1 {
+		t.Fatalf("expected 1 remaining subscription, found %d", subs)
+	}
+}
@@ -0,0 +1,133 @@
+package netceptor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Policies for when a session's send queue is full
+const (
+	// SendQueueBlock makes the forwarder wait for space in the queue.  This is the default.
+	SendQueueBlock = "block"
+	// SendQueueDropOldest discards the message at the head of the queue to make room
+	SendQueueDropOldest = "drop-oldest"
+	// SendQueueDropNewest discards the message being queued
+	SendQueueDropNewest = "drop-newest"
+)
+
+// DefaultSendQueueSize is the number of forwarded messages a session holds while its backend is busy
+const DefaultSendQueueSize = 128
+
+// sendQueue is a bounded queue of data messages waiting to be written to a backend session
+type sendQueue struct {
+	lock     *sync.Mutex
+	messages [][]byte
+	limit    int
+	policy   string
+	ready    chan struct{}
+	space    chan struct{}
+	stats    *trafficCounters
+}
+
+// newSendQueue allocates a new, empty sendQueue
+func newSendQueue(limit int, policy string, stats *trafficCounters) *sendQueue {
+	return &sendQueue{
+		lock:     &sync.Mutex{},
+		messages: make([][]byte, 0, limit),
+		limit:    limit,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		stats:    stats,
+	}
+}
+
+// signal wakes up a waiter on a channel, if one is not already due to wake up
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push adds a message to the queue.  If the queue is full, the queue's policy decides whether to
+// drop a message or to wait until there is space or the context is cancelled.
+func (q *sendQueue) push(ctx context.Context, message []byte) error {
+	for {
+		q.lock.Lock()
+		if len(q.messages) < q.limit {
+			q.messages = append(q.messages, message)
+			q.lock.Unlock()
+			signal(q.ready)
+			return nil
+		}
+		switch q.policy {
+		case SendQueueDropNewest:
+			q.lock.Unlock()
+			q.stats.countQueueDrop()
+			return nil
+		case SendQueueDropOldest:
+			q.messages[0] = nil
+			q.messages = append(q.messages[1:], message)
+			q.lock.Unlock()
+			q.stats.countQueueDrop()
+			signal(q.ready)
+			return nil
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pop removes and returns the message at the head of the queue, if there is one
+func (q *sendQueue) pop() ([]byte, bool) {
+	q.lock.Lock()
+	if len(q.messages) == 0 {
+		q.lock.Unlock()
+		return nil, false
+	}
+	message := q.messages[0]
+	q.messages[0] = nil
+	q.messages = q.messages[1:]
+	q.lock.Unlock()
+	signal(q.space)
+	return message, true
+}
+
+// length returns the number of messages in the queue
+func (q *sendQueue) length() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.messages)
+}
+
+// SetSendQueue sets the size of the queue of forwarded messages each new backend session holds
+// while its backend is busy writing, and what happens when the queue is full.  Messages dropped
+// from the queue are counted in BackendStats.
+func (s *Netceptor) SetSendQueue(size int, policy string) error {
+	if size <= 0 {
+		return fmt.Errorf("send queue size must be positive")
+	}
+	switch policy {
+	case SendQueueBlock, SendQueueDropOldest, SendQueueDropNewest:
+	default:
+		return fmt.Errorf("invalid send queue policy %s", policy)
+	}
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	s.sendQueueSize = size
+	s.sendQueuePolicy = policy
+	return nil
+}
+
+// newSessionSendQueue allocates a send queue for a new session using the configured size and policy
+func (s *Netceptor) newSessionSendQueue(stats *trafficCounters) *sendQueue {
+	s.backendLock.RLock()
+	defer s.backendLock.RUnlock()
+	return newSendQueue(s.sendQueueSize, s.sendQueuePolicy, stats)
+}
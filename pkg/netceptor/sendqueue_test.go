@@ -0,0 +1,171 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// slowSession is a BackendSession whose Send waits until it is released
+type slowSession struct {
+	release chan struct{}
+	sent    chan []byte
+}
+
+func (s *slowSession) Send(data []byte) error {
+	<-s.release
+	s.sent <- data
+	return nil
+}
+
+func (s *slowSession) Recv(timeout time.Duration) ([]byte, error) {
+	time.Sleep(timeout)
+	return nil, ErrTimeout
+}
+
+func (s *slowSession) Close() error {
+	return nil
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	messages := [][]byte{[]byte("m0"), []byte("m1"), []byte("m2"), []byte("m3"), []byte("m4")}
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{SendQueueDropNewest, []string{"m0", "m1", "m2"}},
+		{SendQueueDropOldest, []string{"m0", "m3", "m4"}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stats := newTrafficCounters()
+			ci := &connInfo{
+				WriteChan:    make(chan []byte),
+				sendQueue:    newSendQueue(2, test.policy, stats),
+				Context:      ctx,
+				CancelFunc:   cancel,
+				stats:        stats,
+				sessionStats: newTrafficCounters(),
+			}
+			sess := &slowSession{
+				release: make(chan struct{}),
+				sent:    make(chan []byte, len(messages)),
+			}
+			go ci.protoWriter(sess)
+
+			// The writer takes the first message and stalls in Send, so the rest pile up in the queue
+			err := ci.sendQueue.push(ctx, messages[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			for ci.sendQueue.length() > 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			for _, m := range messages[1:] {
+				err = ci.sendQueue.push(ctx, m)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if ci.sendQueue.length() != 2 {
+				t.Fatalf("queue grew to %d messages, expected 2", ci.sendQueue.length())
+			}
+			if stats.queueDropped != 2 {
+				t.Fatalf("expected 2 dropped messages, got %d", stats.queueDropped)
+			}
+
+			close(sess.release)
+			for _, e := range test.expected {
+				select {
+				case m := <-sess.sent:
+					if string(m) != e {
+						t.Fatalf("expected %s to be sent, got %s", e, m)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for %s to be sent", e)
+				}
+			}
+		})
+	}
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stats := newTrafficCounters()
+	q := newSendQueue(1, SendQueueBlock, stats)
+	err := q.push(ctx, []byte("m0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A push to the full queue waits until a message is taken off it
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.push(ctx, []byte("m1"))
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push to a full queue did not block")
+	case <-time.After(100 * time.Millisecond):
+	}
+	m, ok := q.pop()
+	if !ok || string(m) != "m0" {
+		t.Fatalf("unexpected message %s popped", m)
+	}
+	select {
+	case err = <-pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("push did not complete after space was made")
+	}
+
+	// A blocked push gives up when its context is cancelled
+	go func() {
+		pushed <- q.push(ctx, []byte("m2"))
+	}()
+	cancel()
+	select {
+	case err = <-pushed:
+		if err == nil {
+			t.Fatal("cancelled push did not return an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("push did not return after its context was cancelled")
+	}
+	if stats.queueDropped != 0 {
+		t.Fatalf("block policy dropped %d messages", stats.queueDropped)
+	}
+}
+
+func TestSetSendQueue(t *testing.T) {
+	n := New(context.Background(), "node1", nil)
+	defer func() {
+		n.Shutdown()
+		n.BackendWait()
+	}()
+	for _, bad := range []struct {
+		size   int
+		policy string
+	}{
+		{0, SendQueueBlock},
+		{10, "drop-everything"},
+	} {
+		err := n.SetSendQueue(bad.size, bad.policy)
+		if err == nil {
+			t.Fatalf("send queue of size %d with policy %s was accepted", bad.size, bad.policy)
+		}
+	}
+	err := n.SetSendQueue(10, SendQueueDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := n.newSessionSendQueue(newTrafficCounters())
+	if q.limit != 10 || q.policy != SendQueueDropOldest {
+		t.Fatalf("new session got a queue of size %d with policy %s", q.limit, q.policy)
+	}
+}
@@ -0,0 +1,155 @@
+package netceptor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// serviceQueryService is the reserved service that answers service queries
+const serviceQueryService = ReservedServicePrefix + "svcs"
+
+// lastServiceQueryID is the ID of the most recent service query, so that each query gets its own
+var lastServiceQueryID int64
+
+// serviceQuery is a request for the list of services advertised by a node
+type serviceQuery struct {
+	QueryID int64
+}
+
+// serviceQueryReply is the response to a serviceQuery
+type serviceQueryReply struct {
+	QueryID   int64
+	Refused   bool
+	Truncated bool
+	Services  []*ServiceAdvertisement
+}
+
+// SetServiceQueriesAllowed controls whether this node answers requests from remote nodes for
+// its list of advertised services.  Nodes that opt out reply with a refusal.
+func (s *Netceptor) SetServiceQueriesAllowed(allowed bool) {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	s.serviceQueriesRefused = !allowed
+}
+
+// localServices returns the services advertised by this node, sorted by name
+func (s *Netceptor) localServices() []*ServiceAdvertisement {
+	s.listenerLock.RLock()
+	defer s.listenerLock.RUnlock()
+	services := make([]*ServiceAdvertisement, 0)
+	for sn, pc := range s.listenerRegistry {
+		if pc.advertise {
+			services = append(services, &ServiceAdvertisement{
+				NodeID:  s.nodeID,
+				Service: sn,
+				Time:    time.Now(),
+				Tags:    pc.adTags,
+			})
+		}
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Service < services[j].Service
+	})
+	return services
+}
+
+// Handles a service query by replying with our advertised services, or a refusal if we have opted out
+func (s *Netceptor) handleServiceQuery(md *messageData) error {
+	query := &serviceQuery{}
+	err := json.Unmarshal(md.Data, query)
+	if err != nil {
+		return fmt.Errorf("invalid service query: %s", err)
+	}
+	s.listenerLock.RLock()
+	refused := s.serviceQueriesRefused
+	s.listenerLock.RUnlock()
+	reply := &serviceQueryReply{
+		QueryID: query.QueryID,
+		Refused: refused,
+	}
+	if !refused {
+		reply.Services = s.localServices()
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	// Drop services from the end of the list until the reply fits in a single message
+	for len(data) > MTU && len(reply.Services) > 0 {
+		reply.Services = reply.Services[:len(reply.Services)-1]
+		reply.Truncated = true
+		data, err = json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+	}
+	return s.sendMessage(serviceQueryService, md.FromNode, md.FromService, data)
+}
+
+// QueryRemoteServices asks a node for the list of services it is advertising.  Unlike the service
+// advertisements received by flooding, the answer comes directly from the node and is current.
+// It gives up after the timeout, or when the context is done.
+func (s *Netceptor) QueryRemoteServices(ctx context.Context, node string, timeout time.Duration) ([]*ServiceAdvertisement, error) {
+	if node == s.nodeID {
+		return s.localServices(), nil
+	}
+	s.routingTableLock.RLock()
+	_, ok := s.routingTable[node]
+	s.routingTableLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("node %s is unreachable", node)
+	}
+	pc, err := s.ListenPacket("")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = pc.Close()
+	}()
+	startTime := time.Now()
+	query := &serviceQuery{
+		QueryID: atomic.AddInt64(&lastServiceQueryID, 1),
+	}
+	data, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	_, err = pc.WriteTo(data, s.NewAddr(node, serviceQueryService))
+	if err != nil {
+		return nil, err
+	}
+	err = pc.SetReadDeadline(startTime.Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, MTU)
+	for {
+		n, addr, err := pc.readFromContext(ctx, buf)
+		if err == ErrTimeout {
+			return nil, fmt.Errorf("no response from node %s", node)
+		} else if err != nil {
+			return nil, err
+		}
+		ncAddr, ok := addr.(Addr)
+		if !ok || ncAddr.node != node {
+			continue
+		}
+		reply := &serviceQueryReply{}
+		err = json.Unmarshal(buf[:n], reply)
+		if err != nil || reply.QueryID != query.QueryID {
+			// Not a reply to our query
+			continue
+		}
+		if reply.Refused {
+			return nil, fmt.Errorf("node %s does not allow service queries", node)
+		}
+		if reply.Truncated {
+			sublogger.Warning("Service list from node %s was truncated\n", node)
+		}
+		return reply.Services, nil
+	}
+}
@@ -0,0 +1,106 @@
+package netceptor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueryRemoteServices(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+
+	// The unadvertised listener must not be reported
+	pc1, err := n2.ListenPacketAndAdvertise("echo", map[string]string{"type": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc1.Close()
+	pc2, err := n2.ListenPacket("hidden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc2.Close()
+	// A user service can share its name with the internal service that answers queries
+	pc3, err := n2.ListenPacketAndAdvertise("services", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc3.Close()
+
+	_, err = n1.QueryRemoteServices(context.Background(), "node2", time.Second)
+	if err == nil {
+		t.Fatal("query to unreachable node succeeded")
+	}
+
+	linkNodes(t, n1, n2, "", 1.0)
+	// Wait for routing so the query can reach node2
+	waitForRoute(t, n1, "node2", "node2")
+
+	services, err := n1.QueryRemoteServices(context.Background(), "node2", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].Service != "echo" || services[0].NodeID != "node2" ||
+		services[0].Tags["type"] != "test" || services[1].Service != "services" {
+		t.Fatalf("unexpected service list %v", services)
+	}
+
+	// Queries made at the same time each get their own reply
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			services, err := n1.QueryRemoteServices(context.Background(), "node2", 5*time.Second)
+			if err == nil && len(services) != 2 {
+				err = fmt.Errorf("unexpected service list %v", services)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		err = <-errs
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n2.SetServiceQueriesAllowed(false)
+	_, err = n1.QueryRemoteServices(context.Background(), "node2", 5*time.Second)
+	if err == nil {
+		t.Fatal("query to opted-out node succeeded")
+	}
+
+	n1.Shutdown()
+	n2.Shutdown()
+	n1.BackendWait()
+	n2.BackendWait()
+}
+
+func TestQueryRemoteServicesCancelled(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	defer func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	}()
+	// node2 ignores service queries, so only the context can end the query early
+	n2.reservedServices[serviceQueryService] = func(md *messageData) error {
+		return nil
+	}
+	linkNodes(t, n1, n2, "", 1.0)
+	waitForRoute(t, n1, "node2", "node2")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := n1.QueryRemoteServices(ctx, "node2", time.Minute)
+	if err != context.Canceled {
+		t.Fatalf("expected cancelling the context to end the query, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("query did not stop when the context was cancelled")
+	}
+}
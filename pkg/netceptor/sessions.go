@@ -0,0 +1,69 @@
+package netceptor
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ReapedSession describes a backend session closed by ReapIdleSessions
+type ReapedSession struct {
+	NodeID  string
+	Backend string
+	Cost    float64
+	Idle    time.Duration
+}
+
+// noteActivity records that a message carrying user data crossed the session.  Routing updates,
+// service advertisements and latency pings keep a session alive but do not count as activity.
+func (ci *connInfo) noteActivity(msg []byte) {
+	if len(msg) < 36 || msg[0] != MsgTypeData {
+		return
+	}
+	if stringFromFixedLenBytes(msg[20:28]) == "ping" || stringFromFixedLenBytes(msg[28:36]) == "ping" {
+		return
+	}
+	atomic.StoreInt64(&ci.lastActivity, time.Now().UnixNano())
+}
+
+// idleTime returns how long it has been since user data last crossed the session
+func (ci *connInfo) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&ci.lastActivity)))
+}
+
+// ReapIdleSessions gracefully closes backend sessions that have carried no user data for longer
+// than idle and whose cost is greater than minCost.  Cheaper or active sessions are left alone.
+// The closed sessions are returned, sorted by node ID.  Backends that redial will establish a
+// new session, which starts out active.
+func (s *Netceptor) ReapIdleSessions(idle time.Duration, minCost float64) ([]*ReapedSession, error) {
+	if idle <= 0 {
+		return nil, fmt.Errorf("idle time must be positive")
+	}
+	reaped := make([]*ReapedSession, 0)
+	s.connLock.RLock()
+	for node, ci := range s.connections {
+		if ci.Cost <= minCost {
+			continue
+		}
+		idleTime := ci.idleTime()
+		if idleTime <= idle {
+			continue
+		}
+		reaped = append(reaped, &ReapedSession{
+			NodeID:  node,
+			Backend: ci.BackendName,
+			Cost:    ci.Cost,
+			Idle:    idleTime,
+		})
+		ci.CancelFunc()
+	}
+	s.connLock.RUnlock()
+	for _, rs := range reaped {
+		sublogger.Info("Closed idle session to %s on %s (cost %.2f, idle %s)\n", rs.NodeID, rs.Backend, rs.Cost, rs.Idle)
+	}
+	sort.Slice(reaped, func(i, j int) bool {
+		return reaped[i].NodeID < reaped[j].NodeID
+	})
+	return reaped, nil
+}
@@ -0,0 +1,83 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReapIdleSessions(t *testing.T) {
+	nodes := make(map[string]*Netceptor)
+	for _, id := range []string{"hub", "idle", "active", "cheap"} {
+		nodes[id] = New(context.Background(), id, nil)
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.Shutdown()
+		}
+		for _, n := range nodes {
+			n.BackendWait()
+		}
+	}()
+	hub := nodes["hub"]
+	linkNodes(t, hub, nodes["idle"], "", 5.0)
+	linkNodes(t, hub, nodes["active"], "", 5.0)
+	linkNodes(t, hub, nodes["cheap"], "", 1.0)
+	for _, id := range []string{"idle", "active", "cheap"} {
+		waitForRoute(t, hub, id, id)
+	}
+
+	listener, err := nodes["active"].ListenPacket("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := hub.ListenPacket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	_, err = sender.WriteTo([]byte("hello"), hub.NewAddr("active", "echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_ = listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = hub.ReapIdleSessions(0, 2.0)
+	if err == nil {
+		t.Fatal("a zero idle time was accepted")
+	}
+	reaped, err := hub.ReapIdleSessions(300*time.Millisecond, 2.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reaped) != 1 || reaped[0].NodeID != "idle" || reaped[0].Cost != 5.0 {
+		t.Fatalf("unexpected reaped sessions %v", reaped)
+	}
+	if reaped[0].Idle <= 300*time.Millisecond {
+		t.Fatalf("reaped session was only idle for %s", reaped[0].Idle)
+	}
+
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		remaining := make(map[string]bool)
+		for _, ns := range hub.Neighbors() {
+			remaining[ns.NodeID] = true
+		}
+		if !remaining["idle"] {
+			if !remaining["active"] || !remaining["cheap"] {
+				t.Fatalf("sessions that should have been kept were closed: %v", remaining)
+			}
+			break
+		}
+		if timeout.Err() != nil {
+			t.Fatal("timed out waiting for the idle session to close")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,135 @@
+package netceptor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// trafficCounters accumulates the traffic passing through a backend's connections
+type trafficCounters struct {
+	lock              *sync.Mutex
+	bytesSent         uint64
+	bytesReceived     uint64
+	messagesSent      uint64
+	messagesReceived  uint64
+	handshakeTimeouts uint64
+	queueDropped      uint64
+}
+
+// newTrafficCounters allocates a new, zeroed set of counters
+func newTrafficCounters() *trafficCounters {
+	return &trafficCounters{
+		lock: &sync.Mutex{},
+	}
+}
+
+// countSent records a message sent to the backend
+func (tc *trafficCounters) countSent(length int) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.messagesSent++
+	tc.bytesSent += uint64(length)
+}
+
+// countReceived records a message received from the backend
+func (tc *trafficCounters) countReceived(length int) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.messagesReceived++
+	tc.bytesReceived += uint64(length)
+}
+
+// countHandshakeTimeout records a session dropped for not completing its handshake in time
+func (tc *trafficCounters) countHandshakeTimeout() {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.handshakeTimeouts++
+}
+
+// countQueueDrop records a message dropped because a session's send queue was full
+func (tc *trafficCounters) countQueueDrop() {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.queueDropped++
+}
+
+// reset sets all the counters back to zero
+func (tc *trafficCounters) reset() {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.bytesSent = 0
+	tc.bytesReceived = 0
+	tc.messagesSent = 0
+	tc.messagesReceived = 0
+	tc.handshakeTimeouts = 0
+	tc.queueDropped = 0
+}
+
+// BackendStats holds the traffic counters of a single backend, accumulated since it was added
+// or since the counters were last reset.
+type BackendStats struct {
+	Name             string
+	BytesSent        uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	MessagesReceived uint64
+	// HandshakeTimeouts counts sessions dropped for not completing their handshake in time
+	HandshakeTimeouts uint64
+	// QueueDropped counts forwarded messages dropped because a session's send queue was full
+	QueueDropped uint64
+}
+
+// BackendStats returns the traffic counters of all registered backends, sorted by name
+func (s *Netceptor) BackendStats() []*BackendStats {
+	s.backendLock.RLock()
+	stats := make([]*BackendStats, 0, len(s.backends))
+	for name, bi := range s.backends {
+		bi.stats.lock.Lock()
+		stats = append(stats, &BackendStats{
+			Name:              name,
+			BytesSent:         bi.stats.bytesSent,
+			BytesReceived:     bi.stats.bytesReceived,
+			MessagesSent:      bi.stats.messagesSent,
+			MessagesReceived:  bi.stats.messagesReceived,
+			HandshakeTimeouts: bi.stats.handshakeTimeouts,
+			QueueDropped:      bi.stats.queueDropped,
+		})
+		bi.stats.lock.Unlock()
+	}
+	s.backendLock.RUnlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// ResetBackendStats zeroes the traffic counters of the named backend, or of all backends if the name is blank
+func (s *Netceptor) ResetBackendStats(name string) error {
+	s.backendLock.RLock()
+	defer s.backendLock.RUnlock()
+	if name == "" {
+		for _, bi := range s.backends {
+			bi.stats.reset()
+		}
+		return nil
+	}
+	bi, ok := s.backends[name]
+	if !ok {
+		return fmt.Errorf("unknown backend %s", name)
+	}
+	bi.stats.reset()
+	return nil
+}
+
+// backendCounters returns the traffic counters of a backend, or a set of counters not attached
+// to any backend if it is not registered
+func (s *Netceptor) backendCounters(name string) *trafficCounters {
+	s.backendLock.RLock()
+	defer s.backendLock.RUnlock()
+	bi, ok := s.backends[name]
+	if !ok {
+		return newTrafficCounters()
+	}
+	return bi.stats
+}
@@ -0,0 +1,79 @@
+package netceptor
+
+import (
+	"context"
+	"testing"
+)
+
+// findBackendStats returns the stats of the named backend
+func findBackendStats(t *testing.T, n *Netceptor, name string) *BackendStats {
+	for _, bs := range n.BackendStats() {
+		if bs.Name == name {
+			return bs
+		}
+	}
+	t.Fatalf("no stats for backend %s", name)
+	return nil
+}
+
+func TestBackendStatsReset(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	idle, err := NewExternalBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.AddNamedBackend("idle", idle, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2 := New(context.Background(), "node2", nil)
+	linkNodes(t, n1, n2, "ext", 1.0)
+	waitForConnection(t, n1, "node2", true)
+
+	before := findBackendStats(t, n1, "ext")
+	if before.BytesSent == 0 || before.BytesReceived == 0 || before.MessagesSent == 0 || before.MessagesReceived == 0 {
+		t.Fatalf("connection traffic was not counted: %v", before)
+	}
+	n1.backends["idle"].stats.countSent(100)
+	n1.backends["idle"].stats.countReceived(200)
+
+	// Resetting one backend leaves the others alone
+	err = n1.ResetBackendStats("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := findBackendStats(t, n1, "idle")
+	if bs.BytesSent != 0 || bs.BytesReceived != 0 || bs.MessagesSent != 0 || bs.MessagesReceived != 0 {
+		t.Fatalf("idle backend counters were not reset: %v", bs)
+	}
+	bs = findBackendStats(t, n1, "ext")
+	if bs.BytesSent < before.BytesSent || bs.BytesReceived < before.BytesReceived {
+		t.Fatalf("counters of another backend were reset: %v", bs)
+	}
+
+	err = n1.ResetBackendStats("nonexistent")
+	if err == nil {
+		t.Fatal("reset of an unknown backend succeeded")
+	}
+
+	// Resetting everything zeroes the counters while the connection keeps running.  New traffic may
+	// arrive immediately, but the counters must restart from zero.
+	n1.backends["idle"].stats.countSent(100)
+	err = n1.ResetBackendStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findBackendStats(t, n1, "idle").BytesSent != 0 {
+		t.Fatal("idle backend counters were not reset")
+	}
+	bs = findBackendStats(t, n1, "ext")
+	if bs.BytesSent >= before.BytesSent || bs.BytesReceived >= before.BytesReceived {
+		t.Fatalf("counters were not reset: %v", bs)
+	}
+	waitForConnection(t, n1, "node2", true)
+
+	n1.Shutdown()
+	n2.Shutdown()
+	n1.BackendWait()
+	n2.BackendWait()
+}
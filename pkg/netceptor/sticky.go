@@ -0,0 +1,210 @@
+package netceptor
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// ServiceInstances returns the reachable nodes that advertise the given service, sorted by node ID
+func (s *Netceptor) ServiceInstances(service string) []string {
+	s.serviceAdsLock.RLock()
+	candidates := make([]string, 0)
+	for node, ads := range s.serviceAdsReceived {
+		_, ok := ads[service]
+		if ok {
+			candidates = append(candidates, node)
+		}
+	}
+	s.serviceAdsLock.RUnlock()
+	instances := make([]string, 0, len(candidates))
+	s.routingTableLock.RLock()
+	for _, node := range candidates {
+		_, ok := s.routingTable[node]
+		if ok || node == s.nodeID {
+			instances = append(instances, node)
+		}
+	}
+	s.routingTableLock.RUnlock()
+	sort.Strings(instances)
+	return instances
+}
+
+// stickyPin identifies the sticky key of a service whose connections are pinned to an instance
+type stickyPin struct {
+	service   string
+	stickyKey string
+}
+
+// stickyOverride pins a sticky key to the instance it failed over to
+type stickyOverride struct {
+	node     string
+	lastUsed time.Time
+}
+
+// stickyOverrideLimit is how many failover overrides are kept.  When there are more, the least
+// recently used ones are forgotten.
+const stickyOverrideLimit = 4096
+
+// stickyOverrideTTL is how long an unused failover override is kept, and how long an instance that
+// has gone away is remembered, so that the keys it had fail over instead of being rehashed
+const stickyOverrideTTL = time.Hour
+
+// stickyKeyContextKey is the context key under which DialContext looks for a sticky key
+type stickyKeyContextKey struct{}
+
+// WithStickyKey returns a context that makes DialContext, when given no node, select the instance of
+// the service using the given sticky key
+func WithStickyKey(ctx context.Context, stickyKey string) context.Context {
+	return context.WithValue(ctx, stickyKeyContextKey{}, stickyKey)
+}
+
+// stickyKeyFromContext returns the sticky key set by WithStickyKey, or a blank key
+func stickyKeyFromContext(ctx context.Context) string {
+	stickyKey, _ := ctx.Value(stickyKeyContextKey{}).(string)
+	return stickyKey
+}
+
+// stickyWeight computes the rendezvous hash weight of a node for a sticky key
+func stickyWeight(stickyKey string, node string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(stickyKey))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(node))
+	return h.Sum64()
+}
+
+// rendezvousSelect returns the node with the highest rendezvous hash weight for a sticky key
+func rendezvousSelect(stickyKey string, nodes []string) string {
+	var selected string
+	var selectedWeight uint64
+	for _, node := range nodes {
+		weight := stickyWeight(stickyKey, node)
+		if selected == "" || weight > selectedWeight {
+			selected = node
+			selectedWeight = weight
+		}
+	}
+	return selected
+}
+
+// SelectServiceInstance chooses which node to use for a service that may be advertised by several
+// nodes.  Keys are assigned using rendezvous hashing, so that different clients agree on the
+// instance for a given key, and a key only moves when instances come or go.  When the instance a
+// key hashes to goes away, the key fails over to another instance, and stays there even if the
+// original instance comes back, for as long as the override is used within stickyOverrideTTL.
+// Only these overrides are stored, so the memory used does not grow with the number of keys.
+func (s *Netceptor) SelectServiceInstance(service string, stickyKey string) (string, error) {
+	instances := s.ServiceInstances(service)
+	if len(instances) == 0 {
+		return "", fmt.Errorf("no reachable instances of service %s", service)
+	}
+	now := time.Now()
+	present := make(map[string]bool, len(instances))
+	for _, node := range instances {
+		present[node] = true
+	}
+	pinKey := stickyPin{service: service, stickyKey: stickyKey}
+	s.stickyLock.Lock()
+	defer s.stickyLock.Unlock()
+	override, ok := s.stickyRoutes[pinKey]
+	if ok {
+		if present[override.node] && now.Sub(override.lastUsed) < stickyOverrideTTL {
+			override.lastUsed = now
+			return override.node, nil
+		}
+		delete(s.stickyRoutes, pinKey)
+	}
+
+	// Remember the instances seen, so that a key whose instance has gone away can be told apart from
+	// one that simply hashes to a remaining instance
+	seen, ok := s.stickyInstances[service]
+	if !ok {
+		seen = make(map[string]time.Time)
+		s.stickyInstances[service] = seen
+	}
+	candidates := append([]string{}, instances...)
+	for node, lastSeen := range seen {
+		if present[node] {
+			continue
+		}
+		if now.Sub(lastSeen) >= stickyOverrideTTL {
+			delete(seen, node)
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+	for _, node := range instances {
+		seen[node] = now
+	}
+	selected := rendezvousSelect(stickyKey, candidates)
+	if present[selected] {
+		return selected, nil
+	}
+	selected = rendezvousSelect(stickyKey, instances)
+	s.addStickyOverride(pinKey, selected, now)
+	return selected, nil
+}
+
+// addStickyOverride pins a key that has failed over, forgetting expired and, if there are still
+// too many, least recently used overrides.  The caller must hold stickyLock.
+func (s *Netceptor) addStickyOverride(pinKey stickyPin, node string, now time.Time) {
+	if len(s.stickyRoutes) >= stickyOverrideLimit {
+		var oldestPin stickyPin
+		var oldest time.Time
+		for pin, override := range s.stickyRoutes {
+			if now.Sub(override.lastUsed) >= stickyOverrideTTL {
+				delete(s.stickyRoutes, pin)
+				continue
+			}
+			if oldest.IsZero() || override.lastUsed.Before(oldest) {
+				oldestPin = pin
+				oldest = override.lastUsed
+			}
+		}
+		if len(s.stickyRoutes) >= stickyOverrideLimit {
+			delete(s.stickyRoutes, oldestPin)
+		}
+	}
+	s.stickyRoutes[pinKey] = &stickyOverride{
+		node:     node,
+		lastUsed: now,
+	}
+}
+
+// pruneStickyRoutes forgets the keys that failed over to a node, for one service or, if service is
+// blank, for all services.  Their next dial selects a new instance.
+func (s *Netceptor) pruneStickyRoutes(node string, service string) {
+	s.stickyLock.Lock()
+	defer s.stickyLock.Unlock()
+	for pin, override := range s.stickyRoutes {
+		if override.node == node && (service == "" || pin.service == service) {
+			delete(s.stickyRoutes, pin)
+		}
+	}
+}
+
+// pruneUnreachableStickyRoutes forgets the keys that failed over to nodes missing from a routing table
+func (s *Netceptor) pruneUnreachableStickyRoutes(routingTable map[string]string) {
+	s.stickyLock.Lock()
+	defer s.stickyLock.Unlock()
+	for pin, override := range s.stickyRoutes {
+		_, ok := routingTable[override.node]
+		if !ok && override.node != s.nodeID {
+			delete(s.stickyRoutes, pin)
+		}
+	}
+}
+
+// DialService connects to an instance of a service chosen by SelectServiceInstance
+func (s *Netceptor) DialService(service string, stickyKey string, tls *tls.Config) (*Conn, error) {
+	return s.DialServiceContext(context.Background(), service, stickyKey, tls)
+}
+
+// DialServiceContext is like DialService but uses a context to allow timeout or cancellation.
+func (s *Netceptor) DialServiceContext(ctx context.Context, service string, stickyKey string, tls *tls.Config) (*Conn, error) {
+	return s.DialContext(WithStickyKey(ctx, stickyKey), "", service, tls)
+}
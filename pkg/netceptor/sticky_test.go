@@ -0,0 +1,223 @@
+package netceptor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// setServiceInstance makes a node appear reachable and advertising a service, or removes it
+func setServiceInstance(s *Netceptor, node string, service string, present bool) {
+	s.serviceAdsLock.Lock()
+	s.routingTableLock.Lock()
+	if present {
+		s.serviceAdsReceived[node] = map[string]*ServiceAdvertisement{
+			service: {NodeID: node, Service: service, Time: time.Now()},
+		}
+		s.routingTable[node] = node
+	} else {
+		delete(s.serviceAdsReceived, node)
+		delete(s.routingTable, node)
+	}
+	s.routingTableLock.Unlock()
+	s.serviceAdsLock.Unlock()
+}
+
+func TestStickyServiceSelection(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	defer n1.Shutdown()
+
+	_, err := n1.SelectServiceInstance("svc", "client-a")
+	if err == nil {
+		t.Fatal("selected an instance of a service nobody advertises")
+	}
+
+	setServiceInstance(n1, "node2", "svc", true)
+	setServiceInstance(n1, "node3", "svc", true)
+	if instances := n1.ServiceInstances("svc"); len(instances) != 2 {
+		t.Fatalf("expected two instances, got %v", instances)
+	}
+
+	// Find a key that lands on each instance, to exercise failover in both directions
+	selected := make(map[string]string)
+	for i := 0; len(selected) < 2 && i < 100; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		node, err := n1.SelectServiceInstance("svc", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected[node] = key
+	}
+	if len(selected) != 2 {
+		t.Fatal("all keys selected the same instance")
+	}
+	keyOn2 := selected["node2"]
+	for i := 0; i < 10; i++ {
+		node, err := n1.SelectServiceInstance("svc", keyOn2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node != "node2" {
+			t.Fatalf("sticky key %s moved from node2 to %s", keyOn2, node)
+		}
+	}
+
+	// When node2 disappears, its keys fail over to node3 and stay there
+	setServiceInstance(n1, "node2", "svc", false)
+	node, err := n1.SelectServiceInstance("svc", keyOn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != "node3" {
+		t.Fatalf("expected failover to node3, got %s", node)
+	}
+	setServiceInstance(n1, "node2", "svc", true)
+	node, err = n1.SelectServiceInstance("svc", keyOn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != "node3" {
+		t.Fatalf("sticky key %s moved back to %s after failover", keyOn2, node)
+	}
+
+	// Keys pinned to node3 are unaffected by node2 coming and going
+	node, err = n1.SelectServiceInstance("svc", selected["node3"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != "node3" {
+		t.Fatalf("sticky key %s moved from node3 to %s", selected["node3"], node)
+	}
+}
+
+func TestStickyOverridesBounded(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	defer n1.Shutdown()
+	setServiceInstance(n1, "node2", "svc", true)
+	setServiceInstance(n1, "node3", "svc", true)
+	countOverrides := func() int {
+		n1.stickyLock.RLock()
+		defer n1.stickyLock.RUnlock()
+		return len(n1.stickyRoutes)
+	}
+
+	// Keys that select their rendezvous instance are not stored
+	for i := 0; i < 1000; i++ {
+		_, err := n1.SelectServiceInstance("svc", fmt.Sprintf("request-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := countOverrides(); count != 0 {
+		t.Fatalf("%d sticky keys were stored without failing over", count)
+	}
+
+	// Keys that fail over are stored, but only up to the limit
+	setServiceInstance(n1, "node2", "svc", false)
+	for i := 0; i < 3*stickyOverrideLimit; i++ {
+		_, err := n1.SelectServiceInstance("svc", fmt.Sprintf("request-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := countOverrides(); count == 0 || count > stickyOverrideLimit {
+		t.Fatalf("%d failover overrides were stored, expected up to %d", count, stickyOverrideLimit)
+	}
+}
+
+// acceptAndClose closes each connection made to a listener, until the listener is closed
+func acceptAndClose(li *Listener) {
+	for {
+		conn, err := li.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}
+}
+
+// dialServiceNode dials a service with a sticky key and returns the node of the instance it reached
+func dialServiceNode(t *testing.T, n *Netceptor, service string, stickyKey string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := n.DialServiceContext(ctx, service, stickyKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.RemoteAddr().(Addr).Node()
+}
+
+func TestStickyDial(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	n2 := New(context.Background(), "node2", nil)
+	n3 := New(context.Background(), "node3", nil)
+	defer func() {
+		for _, n := range []*Netceptor{n1, n2, n3} {
+			n.Shutdown()
+			n.BackendWait()
+		}
+	}()
+	linkNodes(t, n1, n2, "", 1.0)
+	linkNodes(t, n1, n3, "", 1.0)
+	li2, err := n2.ListenAndAdvertise("svc", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptAndClose(li2)
+	li3, err := n3.ListenAndAdvertise("svc", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li3.Close()
+	go acceptAndClose(li3)
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for len(n1.ServiceInstances("svc")) < 2 {
+		if timeout.Err() != nil {
+			t.Fatal("timed out waiting for both instances to be advertised")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var keyOn2 string
+	for i := 0; keyOn2 == "" && i < 100; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		if dialServiceNode(t, n1, "svc", key) == "node2" {
+			keyOn2 = key
+		}
+	}
+	if keyOn2 == "" {
+		t.Fatal("no key selected node2")
+	}
+	for i := 0; i < 3; i++ {
+		node := dialServiceNode(t, n1, "svc", keyOn2)
+		if node != "node2" {
+			t.Fatalf("sticky key %s moved from node2 to %s", keyOn2, node)
+		}
+	}
+
+	// Withdrawing node2's advertisement forgets its pins and fails its keys over to node3
+	err = li2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(n1.ServiceInstances("svc")) > 1 {
+		if timeout.Err() != nil {
+			t.Fatal("timed out waiting for node2's advertisement to be withdrawn")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	n1.stickyLock.RLock()
+	for pin, override := range n1.stickyRoutes {
+		if override.node == "node2" {
+			t.Errorf("sticky key %s still pinned to node2", pin.stickyKey)
+		}
+	}
+	n1.stickyLock.RUnlock()
+	node := dialServiceNode(t, n1, "svc", keyOn2)
+	if node != "node3" {
+		t.Fatalf("expected failover to node3, got %s", node)
+	}
+}
@@ -6,8 +6,113 @@ import (
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/cmdline"
 	"io/ioutil"
+	"strings"
 )
 
+// **************************************************************************
+// Hardening and audit
+// **************************************************************************
+
+// tlsVersions maps the version names accepted in configuration to TLS version numbers
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion converts a configured version name to a TLS version number
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %s", version)
+	}
+	return v, nil
+}
+
+// HardenTLSConfig applies secure defaults to a TLS config: TLS 1.2 or later unless a minimum version
+// is already set, no renegotiation and no session tickets.  It returns the same config.
+func HardenTLSConfig(cfg *tls.Config) *tls.Config {
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	cfg.Renegotiation = tls.RenegotiateNever
+	cfg.SessionTicketsDisabled = true
+	return cfg
+}
+
+// AuditTLSConfig checks a TLS config for risky settings, returning a description of each one found
+func AuditTLSConfig(cfg *tls.Config) []string {
+	warnings := make([]string, 0)
+	if cfg.MinVersion < tls.VersionTLS12 {
+		warnings = append(warnings, "minimum TLS version is below 1.2")
+	}
+	if cfg.MaxVersion != 0 && cfg.MaxVersion < tls.VersionTLS12 {
+		warnings = append(warnings, "maximum TLS version is below 1.2")
+	}
+	if cfg.Renegotiation != tls.RenegotiateNever {
+		warnings = append(warnings, "renegotiation is allowed")
+	}
+	if cfg.InsecureSkipVerify && cfg.VerifyPeerCertificate == nil {
+		warnings = append(warnings, "peer certificates are not verified")
+	}
+	insecureSuites := make(map[uint16]string)
+	for _, cs := range tls.InsecureCipherSuites() {
+		insecureSuites[cs.ID] = cs.Name
+	}
+	for _, id := range cfg.CipherSuites {
+		name, ok := insecureSuites[id]
+		if ok {
+			warnings = append(warnings, fmt.Sprintf("insecure cipher suite %s is enabled", name))
+		}
+	}
+	return warnings
+}
+
+// logTLSAudit logs a warning for each risky setting in a named TLS config
+func logTLSAudit(name string, cfg *tls.Config) {
+	for _, w := range AuditTLSConfig(cfg) {
+		sublogger.Warning("TLS config %s: %s\n", name, w)
+	}
+}
+
+// Client authentication modes that a service can apply to its TLS server config
+const (
+	// ClientAuthDefault keeps the client authentication of the named TLS server config
+	ClientAuthDefault = ""
+	// ClientAuthRequire rejects clients that do not present a verified certificate
+	ClientAuthRequire = "require"
+	// ClientAuthOptional verifies a client certificate if one is presented, and otherwise allows anonymous clients
+	ClientAuthOptional = "optional"
+	// ClientAuthNone allows anonymous clients and does not ask for a certificate
+	ClientAuthNone = "none"
+)
+
+// clientAuthTypes maps the client authentication mode names to TLS client authentication types
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	ClientAuthRequire:  tls.RequireAndVerifyClientCert,
+	ClientAuthOptional: tls.VerifyClientCertIfGiven,
+	ClientAuthNone:     tls.NoClientCert,
+}
+
+// ApplyClientAuth returns a copy of a server TLS config with the client authentication mode applied
+func ApplyClientAuth(tlscfg *tls.Config, mode string) (*tls.Config, error) {
+	mode = strings.ToLower(mode)
+	if mode == ClientAuthDefault {
+		return tlscfg, nil
+	}
+	authType, ok := clientAuthTypes[mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth mode %s", mode)
+	}
+	if tlscfg == nil {
+		return nil, fmt.Errorf("client auth mode %s requires a TLS server config", mode)
+	}
+	return changeTLSConfig(tlscfg, func(cfg *tls.Config) {
+		cfg.ClientAuth = authType
+	}), nil
+}
+
 // **************************************************************************
 // Command line
 // **************************************************************************
@@ -24,23 +129,25 @@ type TLSServerCfg struct {
 	Key               string `required:"true" description:"Server private key filename"`
 	RequireClientCert bool   `description:"Require client certificates" default:"false"`
 	ClientCAs         string `description:"Filename of CA bundle to verify client certs with"`
+	MinVersion        string `description:"Minimum TLS version to accept (1.0, 1.1, 1.2 or 1.3)" default:"1.2"`
+	SessionTickets    bool   `description:"Allow TLS session tickets" default:"false"`
 }
 
-// Prepare creates the tls.config and stores it in the global map
-func (cfg TLSServerCfg) Prepare() error {
+// makeTLSConfig creates a hardened tls.Config from the configuration options
+func (cfg TLSServerCfg) makeTLSConfig() (*tls.Config, error) {
 	tlscfg := &tls.Config{}
 
 	certbytes, err := ioutil.ReadFile(cfg.Cert)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	keybytes, err := ioutil.ReadFile(cfg.Key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cert, err := tls.X509KeyPair(certbytes, keybytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	tlscfg.Certificates = []tls.Certificate{cert}
@@ -48,7 +155,7 @@ func (cfg TLSServerCfg) Prepare() error {
 	if cfg.ClientCAs != "" {
 		bytes, err := ioutil.ReadFile(cfg.ClientCAs)
 		if err != nil {
-			return fmt.Errorf("error reading client CAs file: %s", err)
+			return nil, fmt.Errorf("error reading client CAs file: %s", err)
 		}
 		clientCAs := x509.NewCertPool()
 		clientCAs.AppendCertsFromPEM(bytes)
@@ -63,7 +170,50 @@ func (cfg TLSServerCfg) Prepare() error {
 		tlscfg.ClientAuth = tls.NoClientCert
 	}
 
-	return MainInstance.SetServerTLSConfig(cfg.Name, tlscfg)
+	return applyVersionAndTickets(tlscfg, cfg.MinVersion, cfg.SessionTickets)
+}
+
+// Prepare creates the tls.config and stores it in the global map
+func (cfg TLSServerCfg) Prepare() error {
+	tlscfg, err := cfg.makeTLSConfig()
+	if err != nil {
+		return err
+	}
+	MainInstance.AddConfigCheck("tls", func() []ConfigFinding {
+		return checkTLSFiles(cfg.Name, cfg.makeTLSConfig)
+	})
+	err = MainInstance.SetServerTLSConfig(cfg.Name, tlscfg)
+	if err != nil {
+		return err
+	}
+	MainInstance.setServerTLSLoader(cfg.Name, cfg.makeTLSConfig)
+	return nil
+}
+
+// checkTLSFiles checks that the files a TLS config was loaded from can still be loaded
+func checkTLSFiles(name string, makeTLSConfig func() (*tls.Config, error)) []ConfigFinding {
+	_, err := makeTLSConfig()
+	if err != nil {
+		return []ConfigFinding{{
+			Severity: FindingError,
+			Message:  fmt.Sprintf("TLS config %s could not be reloaded: %s", name, err),
+		}}
+	}
+	return nil
+}
+
+// applyVersionAndTickets hardens a config, then applies the configured minimum version and session ticket setting
+func applyVersionAndTickets(tlscfg *tls.Config, minVersion string, sessionTickets bool) (*tls.Config, error) {
+	HardenTLSConfig(tlscfg)
+	if minVersion != "" {
+		v, err := parseTLSVersion(minVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlscfg.MinVersion = v
+	}
+	tlscfg.SessionTicketsDisabled = !sessionTickets
+	return tlscfg, nil
 }
 
 // TLSClientCfg stores the configuration options for a TLS client
@@ -73,27 +223,29 @@ type TLSClientCfg struct {
 	Key                string `required:"false" description:"Client private key filename"`
 	RootCAs            string `required:"false" description:"Root CA bundle to use instead of system trust"`
 	InsecureSkipVerify bool   `required:"false" description:"Accept any server cert" default:"false"`
+	MinVersion         string `required:"false" description:"Minimum TLS version to accept (1.0, 1.1, 1.2 or 1.3)" default:"1.2"`
+	SessionTickets     bool   `required:"false" description:"Allow TLS session tickets" default:"false"`
 }
 
-// Prepare creates the tls.config and stores it in the global map
-func (cfg TLSClientCfg) Prepare() error {
+// makeTLSConfig creates a hardened tls.Config from the configuration options
+func (cfg TLSClientCfg) makeTLSConfig() (*tls.Config, error) {
 	tlscfg := &tls.Config{}
 
 	if cfg.Cert != "" || cfg.Key != "" {
 		if cfg.Cert == "" || cfg.Key == "" {
-			return fmt.Errorf("cert and key must both be supplied or neither")
+			return nil, fmt.Errorf("cert and key must both be supplied or neither")
 		}
 		certbytes, err := ioutil.ReadFile(cfg.Cert)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		keybytes, err := ioutil.ReadFile(cfg.Key)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		cert, err := tls.X509KeyPair(certbytes, keybytes)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		tlscfg.Certificates = []tls.Certificate{cert}
 	}
@@ -101,7 +253,7 @@ func (cfg TLSClientCfg) Prepare() error {
 	if cfg.RootCAs != "" {
 		bytes, err := ioutil.ReadFile(cfg.RootCAs)
 		if err != nil {
-			return fmt.Errorf("error reading root CAs file: %s", err)
+			return nil, fmt.Errorf("error reading root CAs file: %s", err)
 		}
 
 		rootCAs := x509.NewCertPool()
@@ -111,7 +263,24 @@ func (cfg TLSClientCfg) Prepare() error {
 
 	tlscfg.InsecureSkipVerify = cfg.InsecureSkipVerify
 
-	return MainInstance.SetClientTLSConfig(cfg.Name, tlscfg)
+	return applyVersionAndTickets(tlscfg, cfg.MinVersion, cfg.SessionTickets)
+}
+
+// Prepare creates the tls.config and stores it in the global map
+func (cfg TLSClientCfg) Prepare() error {
+	tlscfg, err := cfg.makeTLSConfig()
+	if err != nil {
+		return err
+	}
+	MainInstance.AddConfigCheck("tls", func() []ConfigFinding {
+		return checkTLSFiles(cfg.Name, cfg.makeTLSConfig)
+	})
+	err = MainInstance.SetClientTLSConfig(cfg.Name, tlscfg)
+	if err != nil {
+		return err
+	}
+	MainInstance.setClientTLSLoader(cfg.Name, cfg.makeTLSConfig)
+	return nil
 }
 
 func init() {
@@ -0,0 +1,167 @@
+package netceptor
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHardenedTLSDefaults(t *testing.T) {
+	cfg := TLSClientCfg{
+		Name: "test",
+	}
+	tlscfg, err := cfg.makeTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlscfg.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("minimum version %x is not TLS 1.2", tlscfg.MinVersion)
+	}
+	if tlscfg.Renegotiation != tls.RenegotiateNever {
+		t.Fatal("renegotiation is not disabled")
+	}
+	if !tlscfg.SessionTicketsDisabled {
+		t.Fatal("session tickets are not disabled")
+	}
+	warnings := AuditTLSConfig(tlscfg)
+	if len(warnings) != 0 {
+		t.Fatalf("hardened config failed audit: %v", warnings)
+	}
+
+	// Explicit settings are kept
+	cfg.MinVersion = "1.3"
+	cfg.SessionTickets = true
+	tlscfg, err = cfg.makeTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlscfg.MinVersion != tls.VersionTLS13 || tlscfg.SessionTicketsDisabled {
+		t.Fatal("explicit TLS settings were not applied")
+	}
+
+	cfg.MinVersion = "ssl3"
+	_, err = cfg.makeTLSConfig()
+	if err == nil {
+		t.Fatal("SSLv3 was accepted as a minimum version")
+	}
+}
+
+func TestAuditWeakTLSConfig(t *testing.T) {
+	tlscfg := HardenTLSConfig(&tls.Config{
+		MinVersion: tls.VersionTLS10,
+	})
+	if tlscfg.MinVersion != tls.VersionTLS10 {
+		t.Fatal("hardening replaced an explicit minimum version")
+	}
+	warnings := AuditTLSConfig(tlscfg)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "minimum TLS version") {
+		t.Fatalf("unexpected audit warnings %v", warnings)
+	}
+
+	warnings = AuditTLSConfig(&tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		Renegotiation:      tls.RenegotiateFreelyAsClient,
+		InsecureSkipVerify: true,
+		CipherSuites:       []uint16{tls.TLS_RSA_WITH_RC4_128_SHA},
+	})
+	if len(warnings) != 3 {
+		t.Fatalf("expected 3 audit warnings, got %v", warnings)
+	}
+}
+
+func TestApplyClientAuth(t *testing.T) {
+	base := &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven}
+	tlscfg, err := ApplyClientAuth(base, ClientAuthDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlscfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatal("default mode changed the client auth of the config")
+	}
+	tlscfg, err = ApplyClientAuth(base, "Require")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlscfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatal("require mode did not require client certs")
+	}
+	if base.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatal("applying a mode modified the shared config")
+	}
+	_, err = ApplyClientAuth(base, "sometimes")
+	if err == nil {
+		t.Fatal("unknown client auth mode was accepted")
+	}
+	_, err = ApplyClientAuth(nil, ClientAuthNone)
+	if err == nil {
+		t.Fatal("client auth mode was accepted without a TLS config")
+	}
+}
+
+func TestServiceClientAuth(t *testing.T) {
+	n1 := New(context.Background(), "node1", nil)
+	defer func() {
+		n1.Shutdown()
+		n1.BackendWait()
+	}()
+	err := n1.SetServerTLSConfig("server", generateServerTLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two services share a TLS config, but only one of them accepts anonymous clients
+	listen := func(service string, clientAuth string) {
+		tlscfg, err := n1.GetServerTLSConfigWithClientAuth("server", clientAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		li, err := n1.ListenAndAdvertise(service, tlscfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := li.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(conn, conn)
+					_ = conn.Close()
+				}()
+			}
+		}()
+	}
+	listen("secure", ClientAuthRequire)
+	listen("public", ClientAuthNone)
+
+	// The client does not present a certificate
+	echo := func(service string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := n1.DialContext(ctx, "node1", service, generateClientTLSConfig())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("hello"))
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		return err
+	}
+	err = echo("public")
+	if err != nil {
+		t.Fatalf("anonymous client was rejected by a service that allows it: %s", err)
+	}
+	err = echo("secure")
+	if err == nil {
+		t.Fatal("anonymous client was accepted by a service that requires client certs")
+	}
+}
@@ -0,0 +1,241 @@
+package netceptor
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tlsLoader loads a TLS config from the files named in its configuration
+type tlsLoader func() (*tls.Config, error)
+
+// Kinds of TLS config, as reported by ReloadTLSConfigs
+const (
+	TLSKindServer = "server"
+	TLSKindClient = "client"
+)
+
+// ReloadedTLSConfig describes a TLS config that was reloaded from disk
+type ReloadedTLSConfig struct {
+	Name string
+	Kind string
+	// Fingerprints are the SHA-256 fingerprints of the config's certificates
+	Fingerprints []string
+}
+
+// setServerTLSLoader records how a named server TLS config can be reloaded
+func (s *Netceptor) setServerTLSLoader(name string, loader tlsLoader) {
+	s.tlsConfigLock.Lock()
+	defer s.tlsConfigLock.Unlock()
+	s.serverTLSLoaders[name] = loader
+}
+
+// setClientTLSLoader records how a named client TLS config can be reloaded
+func (s *Netceptor) setClientTLSLoader(name string, loader tlsLoader) {
+	s.tlsConfigLock.Lock()
+	defer s.tlsConfigLock.Unlock()
+	s.clientTLSLoaders[name] = loader
+}
+
+// currentCertificates returns the certificates of a stored TLS config
+func (s *Netceptor) currentCertificates(configs map[string]*tls.Config, name string) []tls.Certificate {
+	s.tlsConfigLock.RLock()
+	defer s.tlsConfigLock.RUnlock()
+	tlscfg, ok := configs[name]
+	if !ok {
+		return nil
+	}
+	return tlscfg.Certificates
+}
+
+// serverConfigGetter returns a GetConfigForClient function that serves a copy of a template
+// config with the current certificates and client CA bundle of a named server TLS config
+func (s *Netceptor) serverConfigGetter(name string, template *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		s.tlsConfigLock.RLock()
+		current, ok := s.serverTLSConfigs[name]
+		s.tlsConfigLock.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS config %s", name)
+		}
+		if len(current.Certificates) == 0 {
+			return nil, fmt.Errorf("TLS config %s has no certificate", name)
+		}
+		tlscfg := template.Clone()
+		tlscfg.GetConfigForClient = nil
+		tlscfg.Certificates = current.Certificates
+		tlscfg.ClientCAs = current.ClientCAs
+		return tlscfg, nil
+	}
+}
+
+// serverCertificateVerifier returns a VerifyPeerCertificate function that verifies a server's
+// certificate chain and host name against the current CA bundle of a named client TLS config
+func (s *Netceptor) serverCertificateVerifier(name string, serverName string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		s.tlsConfigLock.RLock()
+		current, ok := s.clientTLSConfigs[name]
+		s.tlsConfigLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown TLS config %s", name)
+		}
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server presented no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         current.RootCAs,
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+		}
+		var leaf *x509.Certificate
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				leaf = cert
+			} else {
+				opts.Intermediates.AddCert(cert)
+			}
+		}
+		_, err := leaf.Verify(opts)
+		return err
+	}
+}
+
+// changeTLSConfig returns a copy of a TLS config with a change applied.  If the config serves a
+// different config to each client, as reloaded server configs do, the change is also applied to
+// those.
+func changeTLSConfig(tlscfg *tls.Config, change func(*tls.Config)) *tls.Config {
+	tlscfg = tlscfg.Clone()
+	change(tlscfg)
+	getConfig := tlscfg.GetConfigForClient
+	if getConfig != nil {
+		tlscfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			clientCfg, err := getConfig(hello)
+			if err != nil || clientCfg == nil {
+				return clientCfg, err
+			}
+			clientCfg = clientCfg.Clone()
+			change(clientCfg)
+			return clientCfg, nil
+		}
+	}
+	return tlscfg
+}
+
+// WithNextProtos returns a copy of a TLS config that negotiates the given application protocols
+func WithNextProtos(tlscfg *tls.Config, protos ...string) *tls.Config {
+	return changeTLSConfig(tlscfg, func(cfg *tls.Config) {
+		cfg.NextProtos = protos
+	})
+}
+
+// clientCertificateGetter returns a GetClientCertificate function that presents the current
+// certificate of a named client TLS config
+func (s *Netceptor) clientCertificateGetter(name string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		certs := s.currentCertificates(s.clientTLSConfigs, name)
+		for i := range certs {
+			if cri.SupportsCertificate(&certs[i]) == nil {
+				return &certs[i], nil
+			}
+		}
+		// An empty certificate tells the server that we have none to offer
+		return &tls.Certificate{}, nil
+	}
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of a DER-encoded certificate, as
+// colon-separated hex bytes
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// certificateFingerprints parses the leaf certificates of a TLS config, returning their fingerprints
+func certificateFingerprints(tlscfg *tls.Config) ([]string, error) {
+	fingerprints := make([]string, 0, len(tlscfg.Certificates))
+	for _, cert := range tlscfg.Certificates {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		_, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		fingerprints = append(fingerprints, CertificateFingerprint(cert.Certificate[0]))
+	}
+	return fingerprints, nil
+}
+
+// ReloadTLSConfigs re-reads the certificates, keys and CA bundles of every TLS config that was
+// loaded from files.  All of them are loaded and checked before any is replaced, so if one fails,
+// none are changed.  Listeners and backends look up the current certificates and CA bundles at
+// each handshake, so new connections use the reloaded ones without a restart, while established
+// connections are unaffected.
+func (s *Netceptor) ReloadTLSConfigs() ([]*ReloadedTLSConfig, error) {
+	s.tlsConfigLock.RLock()
+	loaders := map[string]map[string]tlsLoader{
+		TLSKindServer: make(map[string]tlsLoader, len(s.serverTLSLoaders)),
+		TLSKindClient: make(map[string]tlsLoader, len(s.clientTLSLoaders)),
+	}
+	for name, loader := range s.serverTLSLoaders {
+		loaders[TLSKindServer][name] = loader
+	}
+	for name, loader := range s.clientTLSLoaders {
+		loaders[TLSKindClient][name] = loader
+	}
+	s.tlsConfigLock.RUnlock()
+
+	reloaded := make([]*ReloadedTLSConfig, 0)
+	configs := map[string]map[string]*tls.Config{
+		TLSKindServer: make(map[string]*tls.Config),
+		TLSKindClient: make(map[string]*tls.Config),
+	}
+	for _, kind := range []string{TLSKindServer, TLSKindClient} {
+		names := make([]string, 0, len(loaders[kind]))
+		for name := range loaders[kind] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tlscfg, err := loaders[kind][name]()
+			if err != nil {
+				return nil, fmt.Errorf("TLS %s config %s could not be reloaded: %s", kind, name, err)
+			}
+			fingerprints, err := certificateFingerprints(tlscfg)
+			if err != nil {
+				return nil, fmt.Errorf("TLS %s config %s has an invalid certificate: %s", kind, name, err)
+			}
+			configs[kind][name] = tlscfg
+			reloaded = append(reloaded, &ReloadedTLSConfig{
+				Name:         name,
+				Kind:         kind,
+				Fingerprints: fingerprints,
+			})
+		}
+	}
+
+	s.tlsConfigLock.Lock()
+	for name, tlscfg := range configs[TLSKindServer] {
+		s.serverTLSConfigs[name] = tlscfg
+	}
+	for name, tlscfg := range configs[TLSKindClient] {
+		s.clientTLSConfigs[name] = tlscfg
+	}
+	s.tlsConfigLock.Unlock()
+	for _, rc := range reloaded {
+		logTLSAudit(rc.Name, configs[rc.Kind][rc.Name])
+		sublogger.Info("Reloaded TLS %s config %s\n", rc.Kind, rc.Name)
+	}
+	return reloaded, nil
+}
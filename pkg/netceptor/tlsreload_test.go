@@ -0,0 +1,276 @@
+package netceptor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key to files, returning the fingerprint
+func writeTestCert(t *testing.T, certFile string, keyFile string, commonName string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		DNSNames:  []string{commonName},
+		NotBefore: time.Now().Add(-1 * time.Minute),
+		NotAfter:  time.Now().Add(24 * time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	err = ioutil.WriteFile(certFile, certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CertificateFingerprint(certDER)
+}
+
+func TestReloadTLSConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receptor-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	oldFingerprint := writeTestCert(t, certFile, keyFile, "old")
+
+	n1 := New(context.Background(), "node1", nil)
+	defer func() {
+		n1.Shutdown()
+		n1.BackendWait()
+	}()
+	cfg := TLSServerCfg{
+		Name: "server",
+		Cert: certFile,
+		Key:  keyFile,
+	}
+	tlscfg, err := cfg.makeTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.SetServerTLSConfig(cfg.Name, tlscfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n1.setServerTLSLoader(cfg.Name, cfg.makeTLSConfig)
+
+	// A listener's config serves whichever certificate is current at the time of the handshake
+	listenerCfg, err := n1.GetServerTLSConfig("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		clientCfg, err := listenerCfg.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CertificateFingerprint(clientCfg.Certificates[0].Certificate[0])
+	}
+	if served() != oldFingerprint {
+		t.Fatal("listener did not serve the loaded certificate")
+	}
+
+	newFingerprint := writeTestCert(t, certFile, keyFile, "new")
+	reloaded, err := n1.ReloadTLSConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded) != 1 || reloaded[0].Name != "server" || reloaded[0].Kind != TLSKindServer ||
+		len(reloaded[0].Fingerprints) != 1 || reloaded[0].Fingerprints[0] != newFingerprint {
+		t.Fatalf("unexpected reload result %v", reloaded)
+	}
+	if served() != newFingerprint {
+		t.Fatal("listener did not serve the reloaded certificate")
+	}
+
+	// A broken key leaves the current certificate in place
+	err = ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = n1.ReloadTLSConfigs()
+	if err == nil {
+		t.Fatal("reload succeeded with a broken key")
+	}
+	if served() != newFingerprint {
+		t.Fatal("failed reload replaced the certificate")
+	}
+}
+
+// tlsHandshake runs a TLS handshake between a server and a client config over a pipe
+func tlsHandshake(serverCfg *tls.Config, clientCfg *tls.Config) error {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		err := tls.Server(serverConn, serverCfg).Handshake()
+		if err != nil {
+			// Unblock the client if the server gives up first
+			_ = serverConn.Close()
+		}
+		serverErr <- err
+	}()
+	err := tls.Client(clientConn, clientCfg).Handshake()
+	if err != nil {
+		_ = clientConn.Close()
+		<-serverErr
+		return err
+	}
+	// The server may still reject the client after the client has finished, so read its alert
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, clientConn)
+	}()
+	return <-serverErr
+}
+
+func TestReloadTLSCAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receptor-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	copyFile := func(from string, to string) {
+		data, err := ioutil.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(to, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each side trusts the other's self-signed certificate
+	writeTestCert(t, file("server.crt"), file("server.key"), "server")
+	writeTestCert(t, file("client.crt"), file("client.key"), "client")
+	copyFile(file("server.crt"), file("server-ca.crt"))
+	copyFile(file("client.crt"), file("client-ca.crt"))
+
+	n1 := New(context.Background(), "node1", nil)
+	defer func() {
+		n1.Shutdown()
+		n1.BackendWait()
+	}()
+	serverCfg := TLSServerCfg{
+		Name:              "server",
+		Cert:              file("server.crt"),
+		Key:               file("server.key"),
+		RequireClientCert: true,
+		ClientCAs:         file("client-ca.crt"),
+	}
+	tlscfg, err := serverCfg.makeTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.SetServerTLSConfig(serverCfg.Name, tlscfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n1.setServerTLSLoader(serverCfg.Name, serverCfg.makeTLSConfig)
+	clientCfg := TLSClientCfg{
+		Name:    "client",
+		Cert:    file("client.crt"),
+		Key:     file("client.key"),
+		RootCAs: file("server-ca.crt"),
+	}
+	tlscfg, err = clientCfg.makeTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.SetClientTLSConfig(clientCfg.Name, tlscfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n1.setClientTLSLoader(clientCfg.Name, clientCfg.makeTLSConfig)
+
+	// The configs are fetched once, as a running listener and backend would
+	listenerCfg, err := n1.GetServerTLSConfig("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialerCfg, err := n1.GetClientTLSConfig("client", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tlsHandshake(listenerCfg, dialerCfg)
+	if err != nil {
+		t.Fatalf("handshake failed before rotation: %s", err)
+	}
+
+	// Replace both certificates and both CA bundles, so that only the reloaded CAs trust the
+	// reloaded certificates
+	writeTestCert(t, file("server.crt"), file("server.key"), "server")
+	writeTestCert(t, file("client.crt"), file("client.key"), "client")
+	copyFile(file("server.crt"), file("server-ca.crt"))
+	copyFile(file("client.crt"), file("client-ca.crt"))
+	_, err = n1.ReloadTLSConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tlsHandshake(listenerCfg, dialerCfg)
+	if err != nil {
+		t.Fatalf("handshake failed after rotation: %s", err)
+	}
+	requireCfg, err := ApplyClientAuth(WithNextProtos(listenerCfg, "test"), ClientAuthRequire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tlsHandshake(requireCfg, WithNextProtos(dialerCfg, "test"))
+	if err != nil {
+		t.Fatalf("handshake with client auth override failed after rotation: %s", err)
+	}
+
+	// The client still verifies the server, against the reloaded CA bundle
+	writeTestCert(t, file("other.crt"), file("other.key"), "server")
+	copyFile(file("other.crt"), file("server-ca.crt"))
+	_, err = n1.ReloadTLSConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tlsHandshake(listenerCfg, dialerCfg)
+	if err == nil {
+		t.Fatal("client accepted a server certificate from an untrusted CA")
+	}
+	dialerCfg, err = n1.GetClientTLSConfig("client", "elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyFile(file("server.crt"), file("server-ca.crt"))
+	_, err = n1.ReloadTLSConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tlsHandshake(listenerCfg, dialerCfg)
+	if err == nil {
+		t.Fatal("client accepted a server certificate for the wrong host name")
+	}
+}
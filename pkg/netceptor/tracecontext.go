@@ -0,0 +1,45 @@
+package netceptor
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// msgFlagTraced is set in the flags byte of a data message whose header is followed by the trace
+// context of the span that sent it.  It is only set on messages sent to peers that advertised
+// support for trace contexts.
+const msgFlagTraced = 0x01
+
+// traceContextLen is the length of a trace context on the wire: the trace ID, the span ID and the
+// trace flags
+const traceContextLen = 16 + 8 + 1
+
+// putTraceContext writes a span context in wire format
+func putTraceContext(data []byte, sc trace.SpanContext) {
+	traceID := sc.TraceID()
+	spanID := sc.SpanID()
+	copy(data[0:16], traceID[:])
+	copy(data[16:24], spanID[:])
+	data[24] = byte(sc.TraceFlags())
+}
+
+// getTraceContext reads a span context in wire format, as sent by a remote node
+func getTraceContext(data []byte) (trace.SpanContext, error) {
+	if len(data) < traceContextLen {
+		return trace.SpanContext{}, fmt.Errorf("data too short to contain a trace context")
+	}
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	copy(traceID[:], data[0:16])
+	copy(spanID[:], data[16:24])
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.TraceFlags(data[24]),
+		Remote:     true,
+	})
+	if !sc.IsValid() {
+		return trace.SpanContext{}, fmt.Errorf("invalid trace context")
+	}
+	return sc, nil
+}
@@ -0,0 +1,126 @@
+package netceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+)
+
+func TestForwardingTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	oldProvider := tracing.TracerProvider()
+	tracing.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer tracing.SetTracerProvider(oldProvider)
+
+	nodes := make(map[string]*Netceptor)
+	for _, id := range []string{"nodeA", "nodeB", "nodeC"} {
+		nodes[id] = New(context.Background(), id, nil)
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.Shutdown()
+		}
+		for _, n := range nodes {
+			n.BackendWait()
+		}
+	}()
+	linkNodes(t, nodes["nodeA"], nodes["nodeB"], "", 1.0)
+	linkNodes(t, nodes["nodeB"], nodes["nodeC"], "", 1.0)
+	waitForRoute(t, nodes["nodeA"], "nodeC", "nodeB")
+
+	listener, err := nodes["nodeC"].ListenPacket("traced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := nodes["nodeA"].ListenPacket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sender.WriteTo([]byte("hello"), nodes["nodeA"].NewAddr("nodeC", "traced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_ = listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected data %q", buf[:n])
+	}
+
+	// Other traffic between the nodes is traced too, so only look at spans of this message
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		var node, to string
+		for _, attr := range span.Attributes {
+			switch attr.Key {
+			case "receptor.node":
+				node = attr.Value.AsString()
+			case "receptor.to":
+				to = attr.Value.AsString()
+			}
+		}
+		if to == "nodeC:traced" {
+			spans[span.Name+" "+node] = span
+		}
+	}
+	first, ok1 := spans["forward nodeA"]
+	relay, ok2 := spans["forward nodeB"]
+	deliver, ok3 := spans["deliver nodeC"]
+	if !ok1 || !ok2 || !ok3 || len(spans) != 3 {
+		t.Fatalf("expected a span on each hop, got %v", spans)
+	}
+	if first.Parent.IsValid() {
+		t.Fatal("the first hop's span has a parent")
+	}
+	if relay.Parent.SpanID() != first.SpanContext.SpanID() || deliver.Parent.SpanID() != relay.SpanContext.SpanID() {
+		t.Fatal("the spans of successive hops are not linked")
+	}
+	if relay.SpanContext.TraceID() != first.SpanContext.TraceID() ||
+		deliver.SpanContext.TraceID() != first.SpanContext.TraceID() {
+		t.Fatal("the spans of successive hops are in different traces")
+	}
+}
+
+func TestTraceContextWireFormat(t *testing.T) {
+	s := New(context.Background(), "node1", nil)
+	defer s.Shutdown()
+	sc, err := getTraceContext([]byte("0123456789abcdefSPANSPAN\x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &messageData{
+		FromNode:     "node1",
+		FromService:  "a",
+		ToNode:       "node1",
+		ToService:    "b",
+		HopsToLive:   5,
+		Data:         []byte("payload"),
+		TraceContext: sc,
+	}
+	for _, traced := range []bool{true, false} {
+		data, err := s.translateDataFromMessage(md, traced)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.translateDataToMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Data) != "payload" {
+			t.Fatalf("traced=%t: unexpected data %q", traced, got.Data)
+		}
+		if got.TraceContext.IsValid() != traced {
+			t.Fatalf("traced=%t: trace context valid is %t", traced, got.TraceContext.IsValid())
+		}
+		if traced && (got.TraceContext.TraceID() != sc.TraceID() || got.TraceContext.SpanID() != sc.SpanID() ||
+			!got.TraceContext.IsSampled()) {
+			t.Fatalf("trace context changed on the wire: %v", got.TraceContext)
+		}
+	}
+}
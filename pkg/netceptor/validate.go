@@ -0,0 +1,189 @@
+package netceptor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Severities of configuration findings
+const (
+	// FindingOK means a subsystem's checks found no problems
+	FindingOK = "ok"
+	// FindingWarning means a problem that does not stop the node from working, but may in future
+	FindingWarning = "warning"
+	// FindingError means a problem that stops part of the configuration from working
+	FindingError = "error"
+)
+
+// CertExpiryWarning is how long before a certificate expires that validation starts warning about it
+const CertExpiryWarning = 30 * 24 * time.Hour
+
+// ConfigFinding is one result of validating the node's configuration
+type ConfigFinding struct {
+	Subsystem string
+	Severity  string
+	Message   string
+}
+
+// ConfigCheck inspects part of the node's configuration, returning a finding for each problem found
+type ConfigCheck func() []ConfigFinding
+
+// namedConfigCheck is a config check and the subsystem that contributed it
+type namedConfigCheck struct {
+	subsystem string
+	check     ConfigCheck
+}
+
+// configValidator coordinates the config checks contributed by each subsystem
+type configValidator struct {
+	lock   *sync.RWMutex
+	checks []namedConfigCheck
+}
+
+func newConfigValidator() *configValidator {
+	return &configValidator{
+		lock:   &sync.RWMutex{},
+		checks: make([]namedConfigCheck, 0),
+	}
+}
+
+// AddConfigCheck contributes a check to the node's configuration validation
+func (s *Netceptor) AddConfigCheck(subsystem string, check ConfigCheck) {
+	s.configValidator.lock.Lock()
+	defer s.configValidator.lock.Unlock()
+	s.configValidator.checks = append(s.configValidator.checks, namedConfigCheck{
+		subsystem: subsystem,
+		check:     check,
+	})
+}
+
+// ValidateConfig runs every contributed config check and returns their findings.  Subsystems
+// whose checks found no problems are reported with a single OK finding.
+func (s *Netceptor) ValidateConfig() []ConfigFinding {
+	s.configValidator.lock.RLock()
+	checks := make([]namedConfigCheck, len(s.configValidator.checks))
+	copy(checks, s.configValidator.checks)
+	s.configValidator.lock.RUnlock()
+	subsystems := make([]string, 0)
+	problems := make(map[string][]ConfigFinding)
+	for _, nc := range checks {
+		_, ok := problems[nc.subsystem]
+		if !ok {
+			subsystems = append(subsystems, nc.subsystem)
+			problems[nc.subsystem] = make([]ConfigFinding, 0)
+		}
+		for _, f := range nc.check() {
+			f.Subsystem = nc.subsystem
+			problems[nc.subsystem] = append(problems[nc.subsystem], f)
+		}
+	}
+	findings := make([]ConfigFinding, 0)
+	for _, subsystem := range subsystems {
+		if len(problems[subsystem]) == 0 {
+			findings = append(findings, ConfigFinding{
+				Subsystem: subsystem,
+				Severity:  FindingOK,
+				Message:   "no problems found",
+			})
+			continue
+		}
+		findings = append(findings, problems[subsystem]...)
+	}
+	return findings
+}
+
+// CertificateFindings checks the certificates of a TLS config for expiry
+func CertificateFindings(name string, tlscfg *tls.Config, now time.Time) []ConfigFinding {
+	findings := make([]ConfigFinding, 0)
+	for _, cert := range tlscfg.Certificates {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			findings = append(findings, ConfigFinding{
+				Severity: FindingError,
+				Message:  fmt.Sprintf("TLS config %s: could not parse certificate: %s", name, err),
+			})
+			continue
+		}
+		switch {
+		case now.After(leaf.NotAfter):
+			findings = append(findings, ConfigFinding{
+				Severity: FindingError,
+				Message: fmt.Sprintf("TLS config %s: certificate %s expired at %s", name,
+					leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339)),
+			})
+		case now.Before(leaf.NotBefore):
+			findings = append(findings, ConfigFinding{
+				Severity: FindingError,
+				Message: fmt.Sprintf("TLS config %s: certificate %s is not valid until %s", name,
+					leaf.Subject.CommonName, leaf.NotBefore.Format(time.RFC3339)),
+			})
+		case now.Add(CertExpiryWarning).After(leaf.NotAfter):
+			findings = append(findings, ConfigFinding{
+				Severity: FindingWarning,
+				Message: fmt.Sprintf("TLS config %s: certificate %s expires at %s", name,
+					leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339)),
+			})
+		}
+	}
+	return findings
+}
+
+// checkTLSConfigs checks the stored TLS configs for expired certificates and risky settings
+func (s *Netceptor) checkTLSConfigs() []ConfigFinding {
+	findings := make([]ConfigFinding, 0)
+	now := time.Now()
+	s.tlsConfigLock.RLock()
+	defer s.tlsConfigLock.RUnlock()
+	for _, configs := range []map[string]*tls.Config{s.serverTLSConfigs, s.clientTLSConfigs} {
+		names := make([]string, 0, len(configs))
+		for name := range configs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			findings = append(findings, CertificateFindings(name, configs[name], now)...)
+			for _, w := range AuditTLSConfig(configs[name]) {
+				findings = append(findings, ConfigFinding{
+					Severity: FindingWarning,
+					Message:  fmt.Sprintf("TLS config %s: %s", name, w),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// checkAllowedPeers checks that the allowed peers file, if there is one, can still be read
+func (s *Netceptor) checkAllowedPeers() []ConfigFinding {
+	s.allowedPeersLock.RLock()
+	filename := s.allowedPeersFile
+	peers := s.allowedPeers
+	s.allowedPeersLock.RUnlock()
+	findings := make([]ConfigFinding, 0)
+	if filename != "" {
+		filePeers, err := readAllowedPeersFile(filename)
+		if err == nil {
+			err = ValidatePeerPatterns(filePeers)
+		}
+		if err != nil {
+			findings = append(findings, ConfigFinding{
+				Severity: FindingError,
+				Message:  fmt.Sprintf("could not read allowed peers file: %s", err),
+			})
+		}
+	}
+	if peers != nil && len(peers) == 0 {
+		findings = append(findings, ConfigFinding{
+			Severity: FindingWarning,
+			Message:  "the allowed peers list is empty, so no peers can connect",
+		})
+	}
+	return findings
+}
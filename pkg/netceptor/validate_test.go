@@ -0,0 +1,125 @@
+package netceptor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedTLSConfig returns a server TLS config with a self-signed certificate valid until notAfter
+func selfSignedTLSConfig(t *testing.T, notAfter time.Time) *tls.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "node1",
+		},
+		NotBefore: time.Now().Add(-1 * time.Minute),
+		NotAfter:  notAfter,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return HardenTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{certDER},
+			PrivateKey:  key,
+		}},
+	})
+}
+
+func TestValidateConfig(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	peersFile := path.Join(tmpdir, "peers")
+	err = ioutil.WriteFile(peersFile, []byte("node2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n1 := New(context.Background(), "node1", nil)
+	defer func() {
+		n1.Shutdown()
+		n1.BackendWait()
+	}()
+	err = n1.SetServerTLSConfig("server", selfSignedTLSConfig(t, time.Now().Add(2*CertExpiryWarning)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.LoadAllowedPeersFile(peersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n1.AddConfigCheck("custom", func() []ConfigFinding {
+		return nil
+	})
+	findingsBySubsystem := func() map[string][]ConfigFinding {
+		bySubsystem := make(map[string][]ConfigFinding)
+		for _, f := range n1.ValidateConfig() {
+			bySubsystem[f.Subsystem] = append(bySubsystem[f.Subsystem], f)
+		}
+		return bySubsystem
+	}
+	for subsystem, findings := range findingsBySubsystem() {
+		if len(findings) != 1 || findings[0].Severity != FindingOK {
+			t.Fatalf("valid subsystem %s reported findings %v", subsystem, findings)
+		}
+	}
+
+	// Once the allowed peers file is gone, only the peers subsystem reports a problem
+	err = os.Remove(peersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bySubsystem := findingsBySubsystem()
+	for _, subsystem := range []string{"tls", "peers", "custom"} {
+		if len(bySubsystem[subsystem]) == 0 {
+			t.Fatalf("subsystem %s was not validated", subsystem)
+		}
+	}
+	for subsystem, findings := range bySubsystem {
+		if subsystem == "peers" {
+			if len(findings) != 1 || findings[0].Severity != FindingError ||
+				!strings.Contains(findings[0].Message, "allowed peers file") {
+				t.Fatalf("missing allowed peers file was not reported: %v", findings)
+			}
+			continue
+		}
+		if len(findings) != 1 || findings[0].Severity != FindingOK {
+			t.Fatalf("valid subsystem %s reported findings %v", subsystem, findings)
+		}
+	}
+}
+
+func TestCertificateFindings(t *testing.T) {
+	now := time.Now()
+	findings := CertificateFindings("server", selfSignedTLSConfig(t, now.Add(2*CertExpiryWarning)), now)
+	if len(findings) != 0 {
+		t.Fatalf("long-lived certificate reported findings %v", findings)
+	}
+	findings = CertificateFindings("server", selfSignedTLSConfig(t, now.Add(CertExpiryWarning/2)), now)
+	if len(findings) != 1 || findings[0].Severity != FindingWarning {
+		t.Fatalf("expiring certificate was not reported: %v", findings)
+	}
+	findings = CertificateFindings("server", selfSignedTLSConfig(t, now.Add(-time.Hour)), now)
+	if len(findings) != 1 || findings[0].Severity != FindingError {
+		t.Fatalf("expired certificate was not reported: %v", findings)
+	}
+}
@@ -52,15 +52,16 @@ func CommandService(s *netceptor.Netceptor, service string, tlscfg *tls.Config,
 
 // CommandSvcCfg is the cmdline configuration object for a command service
 type CommandSvcCfg struct {
-	Service string `required:"true" description:"Receptor service name to bind to"`
-	Command string `required:"true" description:"Command to execute on a connection"`
-	TLS     string `description:"Name of TLS server config"`
+	Service    string `required:"true" description:"Receptor service name to bind to"`
+	Command    string `required:"true" description:"Command to execute on a connection"`
+	TLS        string `description:"Name of TLS server config"`
+	ClientAuth string `description:"Client authentication for the Receptor service (require, optional or none), overriding the TLS config"`
 }
 
 // Run runs the action
 func (cfg CommandSvcCfg) Run() error {
 	logger.Info("Running command service %s\n", cfg)
-	tlscfg, err := netceptor.MainInstance.GetServerTLSConfig(cfg.TLS)
+	tlscfg, err := netceptor.MainInstance.GetServerTLSConfigWithClientAuth(cfg.TLS, cfg.ClientAuth)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"github.com/project-receptor/receptor/pkg/logger"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// newStreamingProxy returns a reverse proxy that passes response bodies on as they arrive, rather
+// than buffering them.  The proxy removes hop-by-hop headers in both directions.
+func newStreamingProxy(director func(*http.Request), transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:      director,
+		Transport:     transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Error("Error proxying HTTP request for %s: %s\n", r.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// serveHTTP serves HTTP on a listener until the context is cancelled
+func serveHTTP(ctx context.Context, li net.Listener, handler http.Handler, name string) {
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		err := srv.Serve(li)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("Error serving %s: %s\n", name, err)
+		}
+	}()
+}
+
+// HTTPProxyServiceInbound listens for HTTP requests on a local address and forwards them to a
+// service on a remote Receptor node, which passes them on to its upstream server.  Returns the
+// address being listened on.
+func HTTPProxyServiceInbound(ctx context.Context, s *netceptor.Netceptor, address string, node string,
+	service string, tlsClient *tls.Config) (net.Addr, error) {
+	li, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on TCP: %s", err)
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return s.DialContext(ctx, node, service, tlsClient)
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		transport.CloseIdleConnections()
+	}()
+	proxy := newStreamingProxy(func(req *http.Request) {
+		// The host is only used to pool connections, since every connection goes to the same service
+		req.URL.Scheme = "http"
+		req.URL.Host = node
+	}, transport)
+	serveHTTP(ctx, li, proxy, "HTTP proxy")
+	return li.Addr(), nil
+}
+
+// HTTPProxyServiceOutbound listens on the Receptor network for HTTP requests, and passes them on to
+// an upstream server.  Request paths are appended to the path of the upstream URL.
+func HTTPProxyServiceOutbound(ctx context.Context, s *netceptor.Netceptor, service string, tlsServer *tls.Config,
+	upstream string, tlsClient *tls.Config) error {
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream URL %s: %s", upstream, err)
+	}
+	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
+		return fmt.Errorf("upstream URL %s must be http or https", upstream)
+	}
+	qli, err := s.ListenAndAdvertise(service, tlsServer, map[string]string{
+		"type":     "HTTP Proxy",
+		"upstream": upstream,
+	})
+	if err != nil {
+		return fmt.Errorf("error listening on Receptor network: %s", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsClient
+	director := httputil.NewSingleHostReverseProxy(upstreamURL).Director
+	proxy := newStreamingProxy(func(req *http.Request) {
+		director(req)
+		req.Host = upstreamURL.Host
+	}, transport)
+	serveHTTP(ctx, qli, proxy, "HTTP proxy endpoint")
+	return nil
+}
+
+// HTTPProxyInboundCfg is the cmdline configuration object for the listening end of an HTTP proxy
+type HTTPProxyInboundCfg struct {
+	BindAddr      string `required:"true" description:"Local address to listen for HTTP on, as host:port"`
+	RemoteNode    string `required:"true" description:"Receptor node to connect to"`
+	RemoteService string `required:"true" description:"Receptor service name to connect to"`
+	TLS           string `description:"Name of TLS client config for the Receptor connection"`
+}
+
+// Run runs the action
+func (cfg HTTPProxyInboundCfg) Run() error {
+	logger.Debug("Running HTTP proxy service %v\n", cfg)
+	tlsClientCfg, err := netceptor.MainInstance.GetClientTLSConfig(cfg.TLS, cfg.RemoteNode)
+	if err != nil {
+		return err
+	}
+	_, err = HTTPProxyServiceInbound(netceptor.MainInstance.Context(), netceptor.MainInstance, cfg.BindAddr,
+		cfg.RemoteNode, cfg.RemoteService, tlsClientCfg)
+	return err
+}
+
+// HTTPProxyOutboundCfg is the cmdline configuration object for the upstream end of an HTTP proxy
+type HTTPProxyOutboundCfg struct {
+	Service   string `required:"true" description:"Receptor service name to bind to"`
+	Upstream  string `required:"true" description:"Base URL of the upstream HTTP server"`
+	TLSServer string `description:"Name of TLS server config for the Receptor service"`
+	TLSClient string `description:"Name of TLS client config for an https upstream"`
+}
+
+// Run runs the action
+func (cfg HTTPProxyOutboundCfg) Run() error {
+	logger.Debug("Running HTTP proxy endpoint %v\n", cfg)
+	tlsServerCfg, err := netceptor.MainInstance.GetServerTLSConfig(cfg.TLSServer)
+	if err != nil {
+		return err
+	}
+	upstreamURL, err := url.Parse(cfg.Upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream URL %s: %s", cfg.Upstream, err)
+	}
+	tlsClientCfg, err := netceptor.MainInstance.GetClientTLSConfig(cfg.TLSClient, upstreamURL.Hostname())
+	if err != nil {
+		return err
+	}
+	return HTTPProxyServiceOutbound(netceptor.MainInstance.Context(), netceptor.MainInstance, cfg.Service,
+		tlsServerCfg, cfg.Upstream, tlsClientCfg)
+}
+
+func init() {
+	cmdline.AddConfigType("http-proxy",
+		"Listen for HTTP and forward requests to a remote Receptor node", HTTPProxyInboundCfg{}, false, false, false, false, servicesSection)
+	cmdline.AddConfigType("http-proxy-endpoint",
+		"Listen on a Receptor service and forward HTTP requests to an upstream server", HTTPProxyOutboundCfg{}, false, false, false, false, servicesSection)
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	n1, n2 := newLinkedNodes(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan *http.Request, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Header().Set("Connection", "X-Response-Hop")
+		w.Header().Set("X-Response-Hop", "dropped")
+		w.Header().Set("X-Response", "kept")
+		_, _ = w.Write([]byte("hello from upstream"))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = HTTPProxyServiceOutbound(ctx, n2, "http", nil, upstream.URL+"/base", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := HTTPProxyServiceInbound(ctx, n1, "127.0.0.1:0", "node2", "http", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The request is written by hand, so that its hop-by-hop headers are sent as given
+	conn, err := net.DialTimeout("tcp", addr.String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = fmt.Fprintf(conn, "GET /path?q=1 HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Connection: X-Request-Hop\r\n"+
+		"X-Request-Hop: dropped\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"Proxy-Authorization: Basic c2VjcmV0\r\n"+
+		"X-Request: kept\r\n"+
+		"\r\n", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The request arrives upstream under the upstream path, without its hop-by-hop headers
+	var req *http.Request
+	select {
+	case req = <-requests:
+	default:
+		t.Fatal("request did not reach the upstream server")
+	}
+	if req.URL.Path != "/base/path" || req.URL.Query().Get("q") != "1" {
+		t.Fatalf("upstream received a request for %s", req.URL)
+	}
+	if req.Host != upstreamURL.Host {
+		t.Fatalf("upstream received a request for host %s instead of %s", req.Host, upstreamURL.Host)
+	}
+	if req.Header.Get("X-Request") != "kept" {
+		t.Fatal("end-to-end request header was not forwarded")
+	}
+	for _, h := range []string{"X-Request-Hop", "Keep-Alive", "Proxy-Authorization"} {
+		if req.Header.Get(h) != "" {
+			t.Fatalf("hop-by-hop request header %s was forwarded", h)
+		}
+	}
+
+	// The response comes back without its hop-by-hop headers
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from upstream" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Response") != "kept" {
+		t.Fatal("end-to-end response header was not forwarded")
+	}
+	if resp.Header.Get("X-Response-Hop") != "" {
+		t.Fatal("hop-by-hop response header was forwarded")
+	}
+}
@@ -33,6 +33,7 @@ type IPRouterService struct {
 	tunIfName       string
 	localNet        *net.IPNet
 	advertiseRoutes []*net.IPNet
+	staticRoutes    []ipRoute
 	linkIP          net.IP
 	destIP          net.IP
 	tunIf           *water.Interface
@@ -42,9 +43,12 @@ type IPRouterService struct {
 	knownRoutesLock *sync.RWMutex
 }
 
-// NewIPRouter creates a new IP router service.
+// NewIPRouter creates a new IP router service.  Routes is a comma separated list of subnets to
+// advertise, and staticRoutes is a comma separated list of subnet=node pairs, giving subnets to send
+// to a node whether or not it advertises them.  The tun interface is removed when the Netceptor
+// instance shuts down.
 func NewIPRouter(nc *netceptor.Netceptor, networkName string, tunInterface string,
-	localNet string, routes string) (*IPRouterService, error) {
+	localNet string, routes string, staticRoutes string) (*IPRouterService, error) {
 	ipr := &IPRouterService{
 		nc:              nc,
 		networkName:     networkName,
@@ -75,6 +79,10 @@ func NewIPRouter(nc *netceptor.Netceptor, networkName string, tunInterface strin
 			ipr.advertiseRoutes = append(ipr.advertiseRoutes, ipNet)
 		}
 	}
+	ipr.staticRoutes, err = parseStaticRoutes(staticRoutes)
+	if err != nil {
+		return nil, err
+	}
 	err = ipr.run()
 	if err != nil {
 		return nil, err
@@ -82,8 +90,32 @@ func NewIPRouter(nc *netceptor.Netceptor, networkName string, tunInterface strin
 	return ipr, nil
 }
 
+// parseStaticRoutes parses a comma separated list of subnet=node pairs
+func parseStaticRoutes(staticRoutes string) ([]ipRoute, error) {
+	routes := make([]ipRoute, 0)
+	if staticRoutes == "" {
+		return routes, nil
+	}
+	for _, sr := range strings.Split(staticRoutes, ",") {
+		parts := strings.SplitN(sr, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("static route %s must be in the form subnet=node", sr)
+		}
+		_, ipNet, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s as a CIDR address", parts[0])
+		}
+		routes = append(routes, ipRoute{
+			dest: ipNet,
+			via:  parts[1],
+		})
+	}
+	return routes, nil
+}
+
 func (ipr *IPRouterService) updateKnownRoutes() {
 	newRoutes := make([]ipRoute, 0)
+	newRoutes = append(newRoutes, ipr.staticRoutes...)
 	status := ipr.nc.Status()
 	for i := range status.Advertisements {
 		ad := status.Advertisements[i]
@@ -202,9 +234,15 @@ func (ipr *IPRouterService) runTunToNetceptor() {
 		}
 		n, err := ipr.tunIf.Read(buf)
 		if err != nil {
+			if ipr.nc.Context().Err() != nil {
+				return
+			}
 			logger.Error("Error reading from tun device: %s\n", err)
 			continue
 		}
+		if n == 0 {
+			continue
+		}
 		packet := buf[:n]
 
 		// Get the destination address from the received packet
@@ -214,12 +252,14 @@ func (ipr *IPRouterService) runTunToNetceptor() {
 			header, err := ipv4.ParseHeader(packet)
 			if err != nil {
 				logger.Debug("Malformed ipv4 packet received: %s", err)
+				continue
 			}
 			destIP = header.Dst
 		} else if ipVersion == 6 {
 			header, err := ipv6.ParseHeader(packet)
 			if err != nil {
 				logger.Debug("Malformed ipv6 packet received: %s", err)
+				continue
 			}
 			destIP = header.Dst
 		} else {
@@ -266,6 +306,9 @@ func (ipr *IPRouterService) runNetceptorToTun() {
 		}
 		n, addr, err := ipr.nConn.ReadFrom(buf)
 		if err != nil {
+			if ipr.nc.Context().Err() != nil {
+				return
+			}
 			logger.Error("Error reading from Receptor: %s\n", err)
 			continue
 		}
@@ -278,6 +321,22 @@ func (ipr *IPRouterService) runNetceptorToTun() {
 	}
 }
 
+// runShutdownWatcher tears down the tun interface when the Netceptor instance shuts down
+func (ipr *IPRouterService) runShutdownWatcher() {
+	<-ipr.nc.Context().Done()
+	logger.Debug("Removing tun interface %s\n", ipr.tunIf.Name())
+	_ = ipr.nConn.Close()
+	err := netlink.LinkSetDown(ipr.link)
+	if err != nil {
+		logger.Error("Error setting link down: %s\n", err)
+	}
+	// The interface is not persistent, so the kernel removes it, along with its routes, once closed
+	err = ipr.tunIf.Close()
+	if err != nil {
+		logger.Error("Error closing tun device: %s\n", err)
+	}
+}
+
 func (ipr *IPRouterService) addRoute(route *net.IPNet) error {
 	err := netlink.RouteAdd(&netlink.Route{
 		LinkIndex: ipr.link.Attrs().Index,
@@ -298,12 +357,13 @@ func (ipr *IPRouterService) run() error {
 	}
 	cfg.Name = ipr.tunIfName
 	var err error
-	ipr.tunIf, err = water.New(water.Config{DeviceType: water.TUN})
+	ipr.tunIf, err = water.New(cfg)
 	if err != nil {
 		return fmt.Errorf("error opening tun device: %s", err)
 	}
 	ipr.link, err = netlink.LinkByName(ipr.tunIf.Name())
 	if err != nil {
+		_ = ipr.tunIf.Close()
 		return fmt.Errorf("error accessing link for tun device: %s", err)
 	}
 	baseIP := ipr.localNet.IP.To4()
@@ -314,6 +374,7 @@ func (ipr *IPRouterService) run() error {
 	copy(ipr.destIP, ipr.linkIP)
 	ipr.destIP[3]++
 	if !ipr.localNet.Contains(ipr.linkIP) || !ipr.localNet.Contains(ipr.destIP) {
+		_ = ipr.tunIf.Close()
 		return fmt.Errorf("error calculating link and remote addresses")
 	}
 	addr := &netlink.Addr{
@@ -322,10 +383,12 @@ func (ipr *IPRouterService) run() error {
 	}
 	err = netlink.AddrAdd(ipr.link, addr)
 	if err != nil {
+		_ = ipr.tunIf.Close()
 		return fmt.Errorf("error adding IP address to link: %s", err)
 	}
 	err = netlink.LinkSetUp(ipr.link)
 	if err != nil {
+		_ = ipr.tunIf.Close()
 		return fmt.Errorf("error setting link up: %s", err)
 	}
 	advertisement := map[string]string{
@@ -338,8 +401,10 @@ func (ipr *IPRouterService) run() error {
 	}
 	ipr.nConn, err = ipr.nc.ListenPacketAndAdvertise(ipr.networkName, advertisement)
 	if err != nil {
+		_ = ipr.tunIf.Close()
 		return fmt.Errorf("error listening for service %s: %s", ipr.networkName, err)
 	}
+	go ipr.runShutdownWatcher()
 	go ipr.runAdvertisingWatcher()
 	go ipr.runTunToNetceptor()
 	go ipr.runNetceptorToTun()
@@ -348,16 +413,17 @@ func (ipr *IPRouterService) run() error {
 
 // IPRouterCfg is the cmdline configuration object for an IP router
 type IPRouterCfg struct {
-	NetworkName string `required:"true" description:"Name of this network and service."`
-	Interface   string `description:"Name of the local tun interface"`
-	LocalNet    string `required:"true" description:"Local /30 CIDR address"`
-	Routes      string `description:"Comma separated list of CIDR subnets to advertise"`
+	NetworkName  string `required:"true" description:"Name of this network and service."`
+	Interface    string `description:"Name of the local tun interface"`
+	LocalNet     string `required:"true" description:"Local /30 CIDR address"`
+	Routes       string `description:"Comma separated list of CIDR subnets to advertise"`
+	StaticRoutes string `description:"Comma separated list of subnet=node pairs, routing CIDR subnets to nodes that do not advertise them"`
 }
 
 // Run runs the action
 func (cfg IPRouterCfg) Run() error {
 	logger.Debug("Running tun router service %s\n", cfg)
-	_, err := NewIPRouter(netceptor.MainInstance, cfg.NetworkName, cfg.Interface, cfg.LocalNet, cfg.Routes)
+	_, err := NewIPRouter(netceptor.MainInstance, cfg.NetworkName, cfg.Interface, cfg.LocalNet, cfg.Routes, cfg.StaticRoutes)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,26 @@
+//+build !linux
+
+package services
+
+import (
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+)
+
+// IPRouterCfg is the cmdline configuration object for an IP router
+type IPRouterCfg struct {
+	NetworkName  string `required:"true" description:"Name of this network and service."`
+	Interface    string `description:"Name of the local tun interface"`
+	LocalNet     string `required:"true" description:"Local /30 CIDR address"`
+	Routes       string `description:"Comma separated list of CIDR subnets to advertise"`
+	StaticRoutes string `description:"Comma separated list of subnet=node pairs, routing CIDR subnets to nodes that do not advertise them"`
+}
+
+// Run runs the action
+func (cfg IPRouterCfg) Run() error {
+	return fmt.Errorf("the IP router requires tun interfaces, which are only supported on Linux")
+}
+
+func init() {
+	cmdline.AddConfigType("ip-router", "Run an IP router using a tun interface", IPRouterCfg{}, false, false, false, false, servicesSection)
+}
@@ -0,0 +1,60 @@
+//+build linux
+
+package services
+
+import (
+	"testing"
+)
+
+func TestParseStaticRoutes(t *testing.T) {
+	type route struct {
+		dest string
+		via  string
+	}
+	tests := []struct {
+		name    string
+		input   string
+		want    []route
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: []route{}},
+		{name: "single", input: "10.1.0.0/16=node1", want: []route{{"10.1.0.0/16", "node1"}}},
+		{
+			name:  "multiple",
+			input: "10.1.0.0/16=node1,192.168.5.0/24=node2",
+			want:  []route{{"10.1.0.0/16", "node1"}, {"192.168.5.0/24", "node2"}},
+		},
+		{name: "host bits masked", input: "10.1.2.3/16=node1", want: []route{{"10.1.0.0/16", "node1"}}},
+		{name: "ipv6", input: "fd00::/64=node1", want: []route{{"fd00::/64", "node1"}}},
+		{name: "node name containing =", input: "10.1.0.0/16=a=b", want: []route{{"10.1.0.0/16", "a=b"}}},
+		{name: "missing node", input: "10.1.0.0/16", wantErr: true},
+		{name: "empty node", input: "10.1.0.0/16=", wantErr: true},
+		{name: "bad subnet", input: "10.1.0.0=node1", wantErr: true},
+		{name: "empty subnet", input: "=node1", wantErr: true},
+		{name: "trailing comma", input: "10.1.0.0/16=node1,", wantErr: true},
+		{name: "one bad entry", input: "10.1.0.0/16=node1,bogus=node2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := parseStaticRoutes(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error parsing %q, got %v", tt.input, routes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(routes) != len(tt.want) {
+				t.Fatalf("parsed %d routes from %q, expected %d", len(routes), tt.input, len(tt.want))
+			}
+			for i := range routes {
+				if routes[i].dest.String() != tt.want[i].dest || routes[i].via != tt.want[i].via {
+					t.Fatalf("route %d parsed as %s=%s, expected %s=%s", i,
+						routes[i].dest, routes[i].via, tt.want[i].dest, tt.want[i].via)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"context"
+	"github.com/prep/socketpair"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"testing"
+	"time"
+)
+
+// newLinkedNodes returns two nodes connected over a socket pair, once each has a route to the other
+func newLinkedNodes(t *testing.T) (*netceptor.Netceptor, *netceptor.Netceptor) {
+	n1 := netceptor.New(context.Background(), "node1", nil)
+	n2 := netceptor.New(context.Background(), "node2", nil)
+	t.Cleanup(func() {
+		n1.Shutdown()
+		n2.Shutdown()
+		n1.BackendWait()
+		n2.BackendWait()
+	})
+	b1, err := netceptor.NewExternalBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n1.AddBackend(b1, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := netceptor.NewExternalBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n2.AddBackend(b2, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2, err := socketpair.New("unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1.NewConnection(c1, true)
+	b2.NewConnection(c2, true)
+	deadline := time.Now().Add(10 * time.Second)
+	for n1.Status().RoutingTable["node2"] != "node2" || n2.Status().RoutingTable["node1"] != "node1" {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the nodes to connect")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return n1, n2
+}
@@ -1,39 +1,90 @@
 package services
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/cmdline"
 	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
 	"github.com/project-receptor/receptor/pkg/utils"
+	"io"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 )
 
-// TCPProxyServiceInbound listens on a TCP port and forwards the connection over the Receptor network
-func TCPProxyServiceInbound(s *netceptor.Netceptor, host string, port int, tlsServer *tls.Config,
+// TCPProxyServiceInbound listens on a TCP port and forwards each connection over the Receptor
+// network.  Connections are forwarded concurrently.  When the context is cancelled, the listener
+// and all forwarded connections are closed.
+func TCPProxyServiceInbound(ctx context.Context, s *netceptor.Netceptor, host string, port int, tlsServer *tls.Config,
 	node string, rservice string, tlsClient *tls.Config) error {
-	tli, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	tli, err := net.Listen("tcp", utils.JoinHostPort(host, port))
+	if err != nil {
+		return fmt.Errorf("error listening on TCP: %s", err)
+	}
 	if tlsServer != nil {
 		tli = tls.NewListener(tli, tlsServer)
 	}
-	if err != nil {
-		return fmt.Errorf("error listening on TCP: %s", err)
+	connsLock := &sync.Mutex{}
+	conns := make(map[io.Closer]bool)
+	closeConn := func(c io.Closer) {
+		connsLock.Lock()
+		delete(conns, c)
+		connsLock.Unlock()
+		_ = c.Close()
 	}
+	go func() {
+		<-ctx.Done()
+		_ = tli.Close()
+		connsLock.Lock()
+		defer connsLock.Unlock()
+		for c := range conns {
+			_ = c.Close()
+		}
+	}()
 	go func() {
 		for {
 			tc, err := tli.Accept()
 			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				ne, ok := err.(net.Error)
+				if ok && ne.Temporary() {
+					logger.Warning("Temporary error accepting TCP connection: %s\n", err)
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
 				logger.Error("Error accepting TCP connection: %s\n", err)
 				return
 			}
-			qc, err := s.Dial(node, rservice, tlsClient)
-			if err != nil {
-				logger.Error("Error connecting on Receptor network: %s\n", err)
-				continue
+			connsLock.Lock()
+			if ctx.Err() != nil {
+				connsLock.Unlock()
+				_ = tc.Close()
+				return
 			}
-			go utils.BridgeConns(tc, "tcp service", qc, "receptor connection")
+			conns[tc] = true
+			connsLock.Unlock()
+			go func() {
+				defer closeConn(tc)
+				qc, err := s.DialContext(ctx, node, rservice, tlsClient)
+				if err != nil {
+					logger.Error("Error connecting on Receptor network: %s\n", err)
+					return
+				}
+				connsLock.Lock()
+				if ctx.Err() != nil {
+					connsLock.Unlock()
+					_ = qc.Close()
+					return
+				}
+				conns[qc] = true
+				connsLock.Unlock()
+				defer closeConn(qc)
+				utils.BridgeConns(tc, "tcp service", qc, "receptor connection")
+			}()
 		}
 	}()
 	return nil
@@ -93,22 +144,23 @@ func (cfg TCPProxyInboundCfg) Run() error {
 	if err != nil {
 		return err
 	}
-	return TCPProxyServiceInbound(netceptor.MainInstance, cfg.BindAddr, cfg.Port, tlsServerCfg,
-		cfg.RemoteNode, cfg.RemoteService, tlsClientCfg)
+	return TCPProxyServiceInbound(netceptor.MainInstance.Context(), netceptor.MainInstance, cfg.BindAddr, cfg.Port,
+		tlsServerCfg, cfg.RemoteNode, cfg.RemoteService, tlsClientCfg)
 }
 
 // TCPProxyOutboundCfg is the cmdline configuration object for a TCP outbound proxy
 type TCPProxyOutboundCfg struct {
-	Service   string `required:"true" description:"Receptor service name to bind to"`
-	Address   string `required:"true" description:"Address for outbound TCP connection"`
-	TLSServer string `description:"Name of TLS server config for the Receptor service"`
-	TLSClient string `description:"Name of TLS client config for the TCP connection"`
+	Service    string `required:"true" description:"Receptor service name to bind to"`
+	Address    string `required:"true" description:"Address for outbound TCP connection"`
+	TLSServer  string `description:"Name of TLS server config for the Receptor service"`
+	TLSClient  string `description:"Name of TLS client config for the TCP connection"`
+	ClientAuth string `description:"Client authentication for the Receptor service (require, optional or none), overriding the TLS config"`
 }
 
 // Run runs the action
 func (cfg TCPProxyOutboundCfg) Run() error {
 	logger.Debug("Running TCP inbound proxy service %s\n", cfg)
-	tlsServerCfg, err := netceptor.MainInstance.GetServerTLSConfig(cfg.TLSServer)
+	tlsServerCfg, err := netceptor.MainInstance.GetServerTLSConfigWithClientAuth(cfg.TLSServer, cfg.ClientAuth)
 	if err != nil {
 		return err
 	}
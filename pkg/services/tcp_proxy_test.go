@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freeTCPPort returns a loopback TCP port that is not in use
+func freeTCPPort(t *testing.T) int {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.Close()
+	return li.Addr().(*net.TCPAddr).Port
+}
+
+// echoService answers each connection to a Receptor service by echoing what it receives
+func echoService(t *testing.T, nc *netceptor.Netceptor, service string) {
+	li, err := nc.Listen(service, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func TestTCPProxyInbound(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	echoService(t, nc, "echo")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port := freeTCPPort(t)
+	err := TCPProxyServiceInbound(ctx, nc, "127.0.0.1", port, nil, "node1", "echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+
+	// Connections are forwarded concurrently, so each is answered while the others are still open
+	conns := make([]net.Conn, 10)
+	for i := range conns {
+		conns[i], err = net.DialTimeout("tcp", address, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+	}
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(conns))
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := fmt.Sprintf("hello %d", i)
+			_ = conns[i].SetDeadline(time.Now().Add(10 * time.Second))
+			_, err := conns[i].Write([]byte(msg))
+			if err != nil {
+				errs <- err
+				return
+			}
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(conns[i], buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(buf) != msg {
+				errs <- fmt.Errorf("connection %d received %q", i, buf)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Cancelling the context closes the open connections and the listener
+	cancel()
+	_ = conns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conns[0].Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Fatalf("forwarded connection was not closed when the context was cancelled: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener was not closed when the context was cancelled")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
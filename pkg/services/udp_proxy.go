@@ -1,19 +1,144 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/cmdline"
 	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
+	"github.com/project-receptor/receptor/pkg/utils"
+	"io"
 	"net"
+	"sync"
+	"time"
 )
 
-// UDPProxyServiceInbound listens on a UDP port and forwards packets to a remote Receptor service
-func UDPProxyServiceInbound(s *netceptor.Netceptor, host string, port int, node string, service string) error {
-	connMap := make(map[string]*netceptor.PacketConn)
+// DefaultUDPProxyIdleTimeout is how long a UDP proxy keeps the connection it opened for a peer
+// after the last packet to or from that peer
+const DefaultUDPProxyIdleTimeout = 60 * time.Second
+
+// udpProxyConn is a connection a UDP proxy opened for one of its peers
+type udpProxyConn struct {
+	conn     io.Closer
+	lastUsed time.Time
+}
+
+// udpProxyConns are the connections of a UDP proxy, keyed by the address of the peer they belong
+// to.  Connections that go unused for the idle timeout are closed, so a proxy with many
+// short-lived peers does not hold on to a connection for each of them.
+type udpProxyConns struct {
+	lock        *sync.Mutex
+	conns       map[string]*udpProxyConn
+	idleTimeout time.Duration
+}
+
+// newUDPProxyConns returns an empty set of connections.  A zero idle timeout means the default.
+func newUDPProxyConns(idleTimeout time.Duration) *udpProxyConns {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultUDPProxyIdleTimeout
+	}
+	return &udpProxyConns{
+		lock:        &sync.Mutex{},
+		conns:       make(map[string]*udpProxyConn),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// get returns the connection of a peer, and records that it was used
+func (uc *udpProxyConns) get(key string) (io.Closer, bool) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	c, ok := uc.conns[key]
+	if !ok {
+		return nil, false
+	}
+	c.lastUsed = time.Now()
+	return c.conn, true
+}
+
+// add stores the connection of a peer
+func (uc *udpProxyConns) add(key string, conn io.Closer) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	uc.conns[key] = &udpProxyConn{
+		conn:     conn,
+		lastUsed: time.Now(),
+	}
+}
+
+// touch records that the connection of a peer was used
+func (uc *udpProxyConns) touch(key string) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	c, ok := uc.conns[key]
+	if ok {
+		c.lastUsed = time.Now()
+	}
+}
+
+// remove forgets and closes the connection of a peer, unless it has already been closed
+func (uc *udpProxyConns) remove(key string, conn io.Closer) {
+	uc.lock.Lock()
+	c, ok := uc.conns[key]
+	if !ok || c.conn != conn {
+		uc.lock.Unlock()
+		return
+	}
+	delete(uc.conns, key)
+	uc.lock.Unlock()
+	_ = conn.Close()
+}
+
+// len returns the number of open connections
+func (uc *udpProxyConns) len() int {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	return len(uc.conns)
+}
+
+// expireIdle closes the connections that have gone unused for the idle timeout
+func (uc *udpProxyConns) expireIdle() {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	for key, c := range uc.conns {
+		if time.Since(c.lastUsed) >= uc.idleTimeout {
+			logger.Debug("Closing UDP proxy connection for %s after %s idle\n", key, uc.idleTimeout)
+			delete(uc.conns, key)
+			_ = c.conn.Close()
+		}
+	}
+}
+
+// run expires idle connections until the context is cancelled, and then closes the rest
+func (uc *udpProxyConns) run(ctx context.Context) {
+	ticker := time.NewTicker(uc.idleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			uc.expireIdle()
+		case <-ctx.Done():
+			uc.lock.Lock()
+			defer uc.lock.Unlock()
+			for key, c := range uc.conns {
+				delete(uc.conns, key)
+				_ = c.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// UDPProxyServiceInbound listens on a UDP port and forwards packets to a remote Receptor service.
+// Each UDP peer gets its own Receptor connection, which is closed once no packet has passed in
+// either direction for the idle timeout.  When the context is cancelled, the listener and all
+// connections are closed.
+func UDPProxyServiceInbound(ctx context.Context, s *netceptor.Netceptor, host string, port int, node string,
+	service string, idleTimeout time.Duration) error {
+	conns := newUDPProxyConns(idleTimeout)
 	buffer := make([]byte, netceptor.MTU)
 
-	addrStr := fmt.Sprintf("%s:%d", host, port)
+	addrStr := utils.JoinHostPort(host, port)
 	udpAddr, err := net.ResolveUDPAddr("udp", addrStr)
 	if err != nil {
 		return fmt.Errorf("could not resolve address %s", addrStr)
@@ -26,20 +151,34 @@ func UDPProxyServiceInbound(s *netceptor.Netceptor, host string, port int, node
 
 	ncAddr := s.NewAddr(node, service)
 
+	go conns.run(ctx)
+	go func() {
+		<-ctx.Done()
+		_ = uc.Close()
+	}()
 	go func() {
 		for {
 			n, addr, err := uc.ReadFrom(buffer)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error("Error reading from UDP: %s\n", err)
+				}
+				return
+			}
 			raddrStr := addr.String()
-			pc, ok := connMap[raddrStr]
-			if !ok {
+			var pc *netceptor.PacketConn
+			conn, ok := conns.get(raddrStr)
+			if ok {
+				pc = conn.(*netceptor.PacketConn)
+			} else {
 				pc, err = s.ListenPacket("")
 				if err != nil {
 					logger.Error("Error listening on Receptor network: %s\n", err)
 					return
 				}
 				logger.Debug("Received new UDP connection from %s\n", raddrStr)
-				connMap[raddrStr] = pc
-				go runNetceptorToUDPInbound(pc, uc, addr, s.NewAddr(node, service))
+				conns.add(raddrStr, pc)
+				go runNetceptorToUDPInbound(pc, uc, addr, ncAddr, conns, raddrStr)
 			}
 			wn, err := pc.WriteTo(buffer[:n], ncAddr)
 			if err != nil {
@@ -55,18 +194,22 @@ func UDPProxyServiceInbound(s *netceptor.Netceptor, host string, port int, node
 	return nil
 }
 
-func runNetceptorToUDPInbound(pc *netceptor.PacketConn, uc *net.UDPConn, udpAddr net.Addr, expectedAddr netceptor.Addr) {
+func runNetceptorToUDPInbound(pc *netceptor.PacketConn, uc *net.UDPConn, udpAddr net.Addr, expectedAddr netceptor.Addr,
+	conns *udpProxyConns, key string) {
+	defer conns.remove(key, pc)
 	buf := make([]byte, netceptor.MTU)
 	for {
 		n, addr, err := pc.ReadFrom(buf)
 		if err != nil {
-			logger.Error("Error reading from Receptor network: %s\n", err)
-			continue
+			// The connection is closed when it expires
+			logger.Debug("Stopped reading from Receptor network for %s: %s\n", key, err)
+			return
 		}
 		if addr != expectedAddr {
 			logger.Debug("Received packet from unexpected source %s\n", addr)
 			continue
 		}
+		conns.touch(key)
 		wn, err := uc.WriteTo(buf[:n], udpAddr)
 		if err != nil {
 			logger.Error("Error sending packet via UDP: %s\n", err)
@@ -79,9 +222,13 @@ func runNetceptorToUDPInbound(pc *netceptor.PacketConn, uc *net.UDPConn, udpAddr
 	}
 }
 
-// UDPProxyServiceOutbound listens on the Receptor network and forwards packets via UDP
-func UDPProxyServiceOutbound(s *netceptor.Netceptor, service string, address string) error {
-	connMap := make(map[string]*net.UDPConn)
+// UDPProxyServiceOutbound listens on the Receptor network and forwards packets via UDP.  Each
+// Receptor peer gets its own UDP connection, which is closed once no packet has passed in either
+// direction for the idle timeout.  When the context is cancelled, the service and all connections
+// are closed.
+func UDPProxyServiceOutbound(ctx context.Context, s *netceptor.Netceptor, service string, address string,
+	idleTimeout time.Duration) error {
+	conns := newUDPProxyConns(idleTimeout)
 	buffer := make([]byte, netceptor.MTU)
 	udpAddr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
@@ -94,24 +241,34 @@ func UDPProxyServiceOutbound(s *netceptor.Netceptor, service string, address str
 	if err != nil {
 		return fmt.Errorf("error listening on service %s: %s", service, err)
 	}
+	go conns.run(ctx)
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+	}()
 	go func() {
 		for {
 			n, addr, err := pc.ReadFrom(buffer)
 			if err != nil {
-				logger.Error("Error reading from Receptor network: %s\n", err)
+				if ctx.Err() == nil {
+					logger.Error("Error reading from Receptor network: %s\n", err)
+				}
 				return
 			}
 			raddrStr := addr.String()
-			uc, ok := connMap[raddrStr]
-			if !ok {
+			var uc *net.UDPConn
+			conn, ok := conns.get(raddrStr)
+			if ok {
+				uc = conn.(*net.UDPConn)
+			} else {
 				uc, err = net.DialUDP("udp", nil, udpAddr)
 				if err != nil {
 					logger.Error("Error connecting via UDP: %s\n", err)
 					return
 				}
 				logger.Debug("Opened new UDP connection to %s\n", raddrStr)
-				connMap[raddrStr] = uc
-				go runUDPToNetceptorOutbound(uc, pc, addr)
+				conns.add(raddrStr, uc)
+				go runUDPToNetceptorOutbound(uc, pc, addr, conns, raddrStr)
 			}
 			wn, err := uc.Write(buffer[:n])
 			if err != nil {
@@ -127,14 +284,18 @@ func UDPProxyServiceOutbound(s *netceptor.Netceptor, service string, address str
 	return nil
 }
 
-func runUDPToNetceptorOutbound(uc *net.UDPConn, pc *netceptor.PacketConn, addr net.Addr) {
+func runUDPToNetceptorOutbound(uc *net.UDPConn, pc *netceptor.PacketConn, addr net.Addr, conns *udpProxyConns,
+	key string) {
+	defer conns.remove(key, uc)
 	buf := make([]byte, netceptor.MTU)
 	for {
 		n, err := uc.Read(buf)
 		if err != nil {
-			logger.Error("Error reading from UDP: %s\n", err)
+			// The connection is closed when it expires
+			logger.Debug("Stopped reading from UDP for %s: %s\n", key, err)
 			return
 		}
+		conns.touch(key)
 		wn, err := pc.WriteTo(buf[:n], addr)
 		if err != nil {
 			logger.Error("Error writing to the Receptor network: %s\n", err)
@@ -153,24 +314,28 @@ type UDPProxyInboundCfg struct {
 	BindAddr      string `description:"Address to bind UDP listener to" default:"0.0.0.0"`
 	RemoteNode    string `required:"true" description:"Receptor node to connect to"`
 	RemoteService string `required:"true" description:"Receptor service name to connect to"`
+	IdleTimeout   int    `description:"Seconds a UDP peer's connection may go without traffic before it is closed" default:"60"`
 }
 
 // Run runs the action
 func (cfg UDPProxyInboundCfg) Run() error {
 	logger.Debug("Running UDP inbound proxy service %v\n", cfg)
-	return UDPProxyServiceInbound(netceptor.MainInstance, cfg.BindAddr, cfg.Port, cfg.RemoteNode, cfg.RemoteService)
+	return UDPProxyServiceInbound(netceptor.MainInstance.Context(), netceptor.MainInstance, cfg.BindAddr, cfg.Port,
+		cfg.RemoteNode, cfg.RemoteService, time.Duration(cfg.IdleTimeout)*time.Second)
 }
 
 // UDPProxyOutboundCfg is the cmdline configuration object for a UDP outbound proxy
 type UDPProxyOutboundCfg struct {
-	Service string `required:"true" description:"Receptor service name to bind to"`
-	Address string `required:"true" description:"Address for outbound UDP connection"`
+	Service     string `required:"true" description:"Receptor service name to bind to"`
+	Address     string `required:"true" description:"Address for outbound UDP connection"`
+	IdleTimeout int    `description:"Seconds a Receptor peer's connection may go without traffic before it is closed" default:"60"`
 }
 
 // Run runs the action
 func (cfg UDPProxyOutboundCfg) Run() error {
-	logger.Debug("Running UDP outbound proxy service %s\n", cfg)
-	return UDPProxyServiceOutbound(netceptor.MainInstance, cfg.Service, cfg.Address)
+	logger.Debug("Running UDP outbound proxy service %v\n", cfg)
+	return UDPProxyServiceOutbound(netceptor.MainInstance.Context(), netceptor.MainInstance, cfg.Service, cfg.Address,
+		time.Duration(cfg.IdleTimeout)*time.Second)
 }
 
 func init() {
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCloser records whether it was closed
+type testCloser struct {
+	lock   sync.Mutex
+	closed bool
+}
+
+func (c *testCloser) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *testCloser) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+func TestUDPProxyConnsExpire(t *testing.T) {
+	conns := newUDPProxyConns(200 * time.Millisecond)
+	idle := &testCloser{}
+	busy := &testCloser{}
+	conns.add("idle", idle)
+	conns.add("busy", busy)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go conns.run(ctx)
+
+	// A connection that keeps being used outlives the idle one
+	for i := 0; i < 8; i++ {
+		time.Sleep(50 * time.Millisecond)
+		conns.touch("busy")
+	}
+	if !idle.isClosed() {
+		t.Fatal("idle connection was not closed")
+	}
+	if _, ok := conns.get("idle"); ok {
+		t.Fatal("idle connection was not forgotten")
+	}
+	if busy.isClosed() {
+		t.Fatal("connection in use was closed")
+	}
+	if conns.len() != 1 {
+		t.Fatalf("expected 1 connection, have %d", conns.len())
+	}
+
+	// Removing a connection that was replaced leaves the new one alone
+	replaced := &testCloser{}
+	conns.remove("busy", replaced)
+	if replaced.isClosed() || busy.isClosed() || conns.len() != 1 {
+		t.Fatal("removing a replaced connection affected the stored one")
+	}
+
+	// The remaining connections are closed when the context is cancelled
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for !busy.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not closed when the context was cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conns.len() != 0 {
+		t.Fatalf("expected no connections, have %d", conns.len())
+	}
+}
+
+func TestUDPProxy(t *testing.T) {
+	n1, n2 := newLinkedNodes(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The echo server reports the address each packet came from
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	sources := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			sources <- addr.String()
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	idleTimeout := 200 * time.Millisecond
+	err = UDPProxyServiceOutbound(ctx, n2, "udpecho", echo.LocalAddr().String(), idleTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	_ = probe.Close()
+	err = UDPProxyServiceInbound(ctx, n1, "127.0.0.1", port, "node2", "udpecho", idleTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip := func(msg string) string {
+		_, err := client.Write([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("received %q instead of %q", buf[:n], msg)
+		}
+		return <-sources
+	}
+
+	// Packets sent close together share a connection
+	first := roundTrip("hello 1")
+	if second := roundTrip("hello 2"); second != first {
+		t.Fatalf("packets in quick succession came from %s and %s", first, second)
+	}
+
+	// Once the connections have expired, the next packet gets new ones
+	time.Sleep(3 * idleTimeout)
+	if third := roundTrip("hello 3"); third == first {
+		t.Fatalf("packet after the idle timeout still came from %s", third)
+	}
+}
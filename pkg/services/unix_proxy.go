@@ -7,7 +7,6 @@ import (
 	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
 	"github.com/project-receptor/receptor/pkg/utils"
-	"net"
 	"os"
 	"runtime"
 )
@@ -57,7 +56,7 @@ func UnixProxyServiceOutbound(s *netceptor.Netceptor, service string, tlscfg *tl
 				return
 
 			}
-			uc, err := net.Dial("unix", filename)
+			uc, err := utils.UnixSocketDial(filename)
 			if err != nil {
 				logger.Error("Error connecting via Unix socket: %s\n", err)
 				continue
@@ -70,8 +69,8 @@ func UnixProxyServiceOutbound(s *netceptor.Netceptor, service string, tlscfg *tl
 
 // UnixProxyInboundCfg is the cmdline configuration object for a Unix socket inbound proxy
 type UnixProxyInboundCfg struct {
-	Filename      string `required:"true" description:"Socket filename, which will be overwritten"`
-	Permissions   int    `description:"Socket file permissions" default:"0600"`
+	Filename      string `required:"true" description:"Socket filename, which will be overwritten, or @name for a Linux abstract socket"`
+	Permissions   int    `description:"Socket file permissions, not used for abstract sockets" default:"0600"`
 	RemoteNode    string `required:"true" description:"Receptor node to connect to"`
 	RemoteService string `required:"true" description:"Receptor service name to connect to"`
 	TLS           string `description:"Name of TLS client config for the Receptor connection"`
@@ -90,15 +89,16 @@ func (cfg UnixProxyInboundCfg) Run() error {
 
 // UnixProxyOutboundCfg is the cmdline configuration object for a Unix socket outbound proxy
 type UnixProxyOutboundCfg struct {
-	Service  string `required:"true" description:"Receptor service name to bind to"`
-	Filename string `required:"true" description:"Socket filename, which must already exist"`
-	TLS      string `description:"Name of TLS server config for the Receptor connection"`
+	Service    string `required:"true" description:"Receptor service name to bind to"`
+	Filename   string `required:"true" description:"Socket filename, which must already exist, or @name for a Linux abstract socket"`
+	TLS        string `description:"Name of TLS server config for the Receptor connection"`
+	ClientAuth string `description:"Client authentication for the Receptor service (require, optional or none), overriding the TLS config"`
 }
 
 // Run runs the action
 func (cfg UnixProxyOutboundCfg) Run() error {
 	logger.Debug("Running Unix socket inbound proxy service %s\n", cfg)
-	tlscfg, err := netceptor.MainInstance.GetServerTLSConfig(cfg.TLS)
+	tlscfg, err := netceptor.MainInstance.GetServerTLSConfigWithClientAuth(cfg.TLS, cfg.ClientAuth)
 	if err != nil {
 		return err
 	}
@@ -10,13 +10,26 @@ import (
 // Callers can ask for the task to be run within a given amount of time, which
 // overrides defaltReqDelay. Sending a zero to the channel runs it immediately.
 func Run(ctx context.Context, f func(), periodicInterval time.Duration, defaultReqDelay time.Duration) chan time.Duration {
+	runChan, _ := RunAdjustable(ctx, f, periodicInterval, defaultReqDelay)
+	return runChan
+}
+
+// RunAdjustable is like Run, but also returns a channel that changes the periodic interval.
+// A new interval takes effect immediately, counting from when the task last ran.
+func RunAdjustable(ctx context.Context, f func(), periodicInterval time.Duration,
+	defaultReqDelay time.Duration) (chan time.Duration, chan time.Duration) {
 	runChan := make(chan time.Duration)
+	intervalChan := make(chan time.Duration)
 	go func() {
-		nextRunTime := time.Now().Add(periodicInterval)
+		lastRunTime := time.Now()
+		nextRunTime := lastRunTime.Add(periodicInterval)
+		periodicRunTime := nextRunTime
 		for {
 			select {
 			case <-time.After(time.Until(nextRunTime)):
-				nextRunTime = time.Now().Add(periodicInterval)
+				lastRunTime = time.Now()
+				nextRunTime = lastRunTime.Add(periodicInterval)
+				periodicRunTime = nextRunTime
 				f()
 			case req := <-runChan:
 				proposedTime := time.Now()
@@ -28,10 +41,17 @@ func Run(ctx context.Context, f func(), periodicInterval time.Duration, defaultR
 				if proposedTime.Before(nextRunTime) {
 					nextRunTime = proposedTime
 				}
+			case periodicInterval = <-intervalChan:
+				// Keep any earlier run that was requested over runChan
+				proposedTime := lastRunTime.Add(periodicInterval)
+				if proposedTime.Before(nextRunTime) || nextRunTime.Equal(periodicRunTime) {
+					nextRunTime = proposedTime
+				}
+				periodicRunTime = proposedTime
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
-	return runChan
+	return runChan, intervalChan
 }
@@ -0,0 +1,42 @@
+package tickrunner
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunAdjustable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lock := &sync.Mutex{}
+	runs := 0
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		n := runs
+		runs = 0
+		return n
+	}
+	_, intervalChan := RunAdjustable(ctx, func() {
+		lock.Lock()
+		runs++
+		lock.Unlock()
+	}, time.Hour, time.Millisecond)
+
+	intervalChan <- 100 * time.Millisecond
+	time.Sleep(1050 * time.Millisecond)
+	n := count()
+	if n < 8 || n > 11 {
+		t.Fatalf("expected about 10 runs at a 100ms interval, got %d", n)
+	}
+
+	intervalChan <- 500 * time.Millisecond
+	_ = count()
+	time.Sleep(1050 * time.Millisecond)
+	n = count()
+	if n < 1 || n > 3 {
+		t.Fatalf("expected about 2 runs at a 500ms interval, got %d", n)
+	}
+}
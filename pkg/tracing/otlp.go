@@ -0,0 +1,218 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// otlpExporter sends spans to an OpenTelemetry collector using OTLP/HTTP with JSON encoding
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newOTLPExporter(collectorURL string) (*otlpExporter, error) {
+	u, err := url.Parse(collectorURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no collector host in %s", collectorURL)
+	}
+	return &otlpExporter{
+		url:    collectorURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// The following types are the JSON mapping of the OTLP trace protobuf messages
+
+type otlpRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource      `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		var value map[string]interface{}
+		switch attr.Value.Type() {
+		case attribute.BOOL:
+			value = map[string]interface{}{"boolValue": attr.Value.AsBool()}
+		case attribute.INT64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(attr.Value.AsInt64(), 10)}
+		case attribute.FLOAT64:
+			value = map[string]interface{}{"doubleValue": attr.Value.AsFloat64()}
+		default:
+			value = map[string]interface{}{"stringValue": attr.Value.Emit()}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: string(attr.Key), Value: value})
+	}
+	return kvs
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpStatusCode converts a span status code to its OTLP value, which orders Ok and Error the other way round
+func otlpStatusCode(code codes.Code) int {
+	switch code {
+	case codes.Ok:
+		return 1
+	case codes.Error:
+		return 2
+	}
+	return 0
+}
+
+func newOTLPSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	out := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		Name:              span.Name(),
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: otlpTime(span.StartTime()),
+		EndTimeUnixNano:   otlpTime(span.EndTime()),
+		Attributes:        otlpAttributes(span.Attributes()),
+		Status: otlpStatus{
+			Code:    otlpStatusCode(span.Status().Code),
+			Message: span.Status().Description,
+		},
+	}
+	if span.Parent().IsValid() {
+		out.ParentSpanID = span.Parent().SpanID().String()
+	}
+	for _, event := range span.Events() {
+		out.Events = append(out.Events, otlpEvent{
+			TimeUnixNano: otlpTime(event.Time),
+			Name:         event.Name,
+			Attributes:   otlpAttributes(event.Attributes),
+		})
+	}
+	return out
+}
+
+// newOTLPRequest groups spans by their resource and instrumentation library
+func newOTLPRequest(spans []sdktrace.ReadOnlySpan) *otlpRequest {
+	req := &otlpRequest{}
+	resources := make(map[attribute.Distinct]*otlpResourceSpans)
+	type scopeKey struct {
+		resource attribute.Distinct
+		name     string
+		version  string
+	}
+	scopes := make(map[scopeKey]*otlpScopeSpans)
+	for _, span := range spans {
+		resKey := span.Resource().Equivalent()
+		rs, ok := resources[resKey]
+		if !ok {
+			rs = &otlpResourceSpans{
+				Resource: otlpResource{Attributes: otlpAttributes(span.Resource().Attributes())},
+			}
+			resources[resKey] = rs
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+		}
+		lib := span.InstrumentationLibrary()
+		sk := scopeKey{resource: resKey, name: lib.Name, version: lib.Version}
+		ss, ok := scopes[sk]
+		if !ok {
+			ss = &otlpScopeSpans{Scope: otlpScope{Name: lib.Name, Version: lib.Version}}
+			scopes[sk] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+		ss.Spans = append(ss.Spans, newOTLPSpan(span))
+	}
+	return req
+}
+
+// ExportSpans sends a batch of spans to the collector
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(newOTLPRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Shutdown releases the exporter's idle connections
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,99 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- body
+	}))
+	defer server.Close()
+	exporter, err := newOTLPExporter(server.URL + "/v1/traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "receptor"))),
+	)
+	defer func() {
+		_ = tp.Shutdown(context.Background())
+	}()
+	ctx, parent := tp.Tracer(InstrumentationName).Start(context.Background(), "parent")
+	_, child := tp.Tracer(InstrumentationName).Start(ctx, "child")
+	child.SetAttributes(attribute.Int("receptor.hops_to_live", 3))
+	EndSpan(child, fmt.Errorf("failed"))
+	body := <-requests
+	parent.End()
+	<-requests
+
+	req := otlpRequest{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 ||
+		len(req.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("unexpected request %s", body)
+	}
+	rs := req.ResourceSpans[0]
+	if len(rs.Resource.Attributes) != 1 || rs.Resource.Attributes[0].Value["stringValue"] != "receptor" {
+		t.Fatalf("unexpected resource %v", rs.Resource)
+	}
+	if rs.ScopeSpans[0].Scope.Name != InstrumentationName {
+		t.Fatalf("unexpected scope %v", rs.ScopeSpans[0].Scope)
+	}
+	span := rs.ScopeSpans[0].Spans[0]
+	if span.Name != "child" || span.TraceID != parent.SpanContext().TraceID().String() ||
+		span.ParentSpanID != parent.SpanContext().SpanID().String() {
+		t.Fatalf("unexpected span %v", span)
+	}
+	if span.Status.Code != 2 || span.Status.Message != "failed" || len(span.Events) != 1 {
+		t.Fatalf("error was not recorded: %v", span)
+	}
+	if len(span.Attributes) != 1 || span.Attributes[0].Value["intValue"] != "3" {
+		t.Fatalf("unexpected attributes %v", span.Attributes)
+	}
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	exporter, err := newOTLPExporter(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := sdktrace.NewTracerProvider()
+	_, span := tp.Tracer(InstrumentationName).Start(context.Background(), "span")
+	span.End()
+	ro, ok := span.(sdktrace.ReadOnlySpan)
+	if !ok {
+		t.Fatal("span is not readable")
+	}
+	err = exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{ro})
+	if err == nil {
+		t.Fatal("a collector error was not reported")
+	}
+	_, err = newOTLPExporter("not a url")
+	if err == nil {
+		t.Fatal("an invalid collector URL was accepted")
+	}
+}
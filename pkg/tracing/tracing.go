@@ -0,0 +1,100 @@
+// Package tracing provides optional OpenTelemetry tracing of control commands and message forwarding.
+// Until a tracer provider is configured, all spans are no-ops.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"sync/atomic"
+)
+
+// InstrumentationName is the name of the tracer used for all Receptor spans
+const InstrumentationName = "github.com/project-receptor/receptor"
+
+// providerHolder lets a nil provider be stored in an atomic.Value
+type providerHolder struct {
+	tp trace.TracerProvider
+}
+
+var provider atomic.Value
+
+var noopTracer = trace.NewNoopTracerProvider().Tracer(InstrumentationName)
+
+// SetTracerProvider sets the provider that receives Receptor spans.  A nil provider disables tracing.
+func SetTracerProvider(tp trace.TracerProvider) {
+	provider.Store(providerHolder{tp: tp})
+}
+
+// TracerProvider returns the provider that receives Receptor spans, or nil if tracing is disabled
+func TracerProvider() trace.TracerProvider {
+	ph, _ := provider.Load().(providerHolder)
+	return ph.tp
+}
+
+// Enabled returns true if a tracer provider has been configured.  Code on hot paths can use this
+// to skip building span attributes when tracing is off.
+func Enabled() bool {
+	return TracerProvider() != nil
+}
+
+// Tracer returns the tracer used for Receptor spans
+func Tracer() trace.Tracer {
+	tp := TracerProvider()
+	if tp == nil {
+		return noopTracer
+	}
+	return tp.Tracer(InstrumentationName)
+}
+
+// StartSpan starts a new span with the given attributes
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records an error, if any, on a span and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+type tracingCfg struct {
+	Endpoint    string `description:"OTLP/HTTP collector endpoint, as host:port" barevalue:"yes" required:"yes"`
+	URLPath     string `description:"URL path to send traces to" default:"/v1/traces"`
+	Insecure    bool   `description:"Send traces over plain HTTP instead of HTTPS" default:"false"`
+	ServiceName string `description:"Service name to report spans under" default:"receptor"`
+}
+
+func (cfg tracingCfg) Prepare() error {
+	scheme := "https"
+	if cfg.Insecure {
+		scheme = "http"
+	}
+	exporter, err := newOTLPExporter(fmt.Sprintf("%s://%s%s", scheme, cfg.Endpoint, cfg.URLPath))
+	if err != nil {
+		return fmt.Errorf("could not create OTLP exporter: %s", err)
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))
+	SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	))
+	return nil
+}
+
+func init() {
+	cmdline.AddConfigType("otel-tracing", "Export OpenTelemetry spans for control commands and forwarded messages",
+		tracingCfg{}, false, true, false, false, nil)
+}
@@ -4,48 +4,170 @@ import (
 	"github.com/project-receptor/receptor/pkg/logger"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// BridgeConns bridges two connections, like netcat.
-func BridgeConns(c1 io.ReadWriteCloser, c1Name string, c2 io.ReadWriteCloser, c2Name string) {
-	doneChan := make(chan bool)
-	go bridgeHalf(c1, c1Name, c2, c2Name, doneChan)
-	go bridgeHalf(c2, c2Name, c1, c1Name, doneChan)
-	<-doneChan
+// BridgeOptions are the optional settings of a bridge
+type BridgeOptions struct {
+	// IdleTimeout, if not zero, closes both connections once no data has flowed in either direction
+	// for this long
+	IdleTimeout time.Duration
 }
 
-// BridgeHalf bridges the read side of c1 to the write side of c2.
-func bridgeHalf(c1 io.ReadWriteCloser, c1Name string, c2 io.ReadWriteCloser, c2Name string, done chan bool) {
-	logger.Trace("    Bridging %s to %s\n", c1Name, c2Name)
-	defer func() {
-		done <- true
+// BridgeResult is the outcome of a bridge
+type BridgeResult struct {
+	// C1ToC2 is the number of bytes copied from the first connection to the second
+	C1ToC2 int64
+	// C2ToC1 is the number of bytes copied from the second connection to the first
+	C2ToC1 int64
+	// IdleTimedOut is true if the bridge was closed by its idle timeout
+	IdleTimedOut bool
+}
+
+// closeWriter is a connection that can be half-closed, such as a TCP or Unix socket
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// readCanceler is a connection whose pending reads are not ended by closing it, such as a
+// Receptor connection
+type readCanceler interface {
+	CancelRead()
+}
+
+// bridgeConn is one of the connections of a bridge, which is closed only once
+type bridgeConn struct {
+	conn      io.ReadWriteCloser
+	name      string
+	closeOnce sync.Once
+}
+
+// close closes the connection, ending any read in progress
+func (bc *bridgeConn) close() {
+	bc.closeOnce.Do(func() {
+		if rc, ok := bc.conn.(readCanceler); ok {
+			rc.CancelRead()
+		}
+		_ = bc.conn.Close()
+	})
+}
+
+// bridge is the shared state of the two halves of a bridge
+type bridge struct {
+	lastActivity int64 // Unix nanoseconds of the last data copied in either direction
+	closing      int32 // Set once the bridge has closed the connections itself
+	c1           *bridgeConn
+	c2           *bridgeConn
+}
+
+// closeBoth closes both connections, stopping both halves of the bridge
+func (b *bridge) closeBoth() {
+	atomic.StoreInt32(&b.closing, 1)
+	b.c1.close()
+	b.c2.close()
+}
+
+// BridgeConns bridges two connections, like netcat, until both directions are done, returning
+// the number of bytes copied each way.
+func BridgeConns(c1 io.ReadWriteCloser, c1Name string, c2 io.ReadWriteCloser, c2Name string) BridgeResult {
+	return BridgeConnsWithOptions(c1, c1Name, c2, c2Name, BridgeOptions{})
+}
+
+// BridgeConnsWithOptions bridges two connections, like netcat, until both directions are done,
+// returning the number of bytes copied each way.  When one connection reaches EOF, the other is
+// half-closed if it supports CloseWrite, so that data can keep flowing the other way until it
+// also ends.  Otherwise, or if there is an error, both connections are closed.
+func BridgeConnsWithOptions(c1 io.ReadWriteCloser, c1Name string, c2 io.ReadWriteCloser, c2Name string,
+	opts BridgeOptions) BridgeResult {
+	b := &bridge{
+		lastActivity: time.Now().UnixNano(),
+		c1:           &bridgeConn{conn: c1, name: c1Name},
+		c2:           &bridgeConn{conn: c2, name: c2Name},
+	}
+	result := BridgeResult{}
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.C1ToC2 = b.copyHalf(b.c1, b.c2)
 	}()
-	buf := make([]byte, 65536)
-	shouldClose := false
+	go func() {
+		defer wg.Done()
+		result.C2ToC1 = b.copyHalf(b.c2, b.c1)
+	}()
+	finished := make(chan struct{})
+	idleDone := make(chan bool, 1)
+	if opts.IdleTimeout > 0 {
+		go func() {
+			idleDone <- b.watchIdle(opts.IdleTimeout, finished)
+		}()
+	} else {
+		idleDone <- false
+	}
+	wg.Wait()
+	close(finished)
+	result.IdleTimedOut = <-idleDone
+	b.closeBoth()
+	return result
+}
+
+// watchIdle closes both connections once no data has been copied for the timeout, returning true
+// if it did so before the bridge finished
+func (b *bridge) watchIdle(timeout time.Duration, finished chan struct{}) bool {
 	for {
-		n, err := c1.Read(buf)
-		if err != nil {
-			if err.Error() != "EOF" && !strings.Contains(err.Error(), "use of closed network connection") {
-				logger.Error("Connection read error: %s\n", err)
-			}
-			shouldClose = true
+		idleUntil := time.Unix(0, atomic.LoadInt64(&b.lastActivity)).Add(timeout)
+		wait := time.Until(idleUntil)
+		if wait <= 0 {
+			logger.Trace("    Closing bridge %s to %s: idle for %s\n", b.c1.name, b.c2.name, timeout)
+			b.closeBoth()
+			return true
+		}
+		select {
+		case <-time.After(wait):
+		case <-finished:
+			return false
 		}
+	}
+}
+
+// copyHalf copies from the read side of src to the write side of dst, returning the number of
+// bytes copied.
+func (b *bridge) copyHalf(src *bridgeConn, dst *bridgeConn) int64 {
+	logger.Trace("    Bridging %s to %s\n", src.name, dst.name)
+	buf := make([]byte, 65536)
+	var copied int64
+	for {
+		n, err := src.conn.Read(buf)
 		if n > 0 {
-			logger.Trace("    Copied %d bytes from %s to %s\n", n, c1Name, c2Name)
-			wn, err := c2.Write(buf[:n])
-			if err != nil {
-				logger.Error("Connection write error: %s\n", err)
-				shouldClose = true
+			atomic.StoreInt64(&b.lastActivity, time.Now().UnixNano())
+			logger.Trace("    Copied %d bytes from %s to %s\n", n, src.name, dst.name)
+			wn, werr := dst.conn.Write(buf[:n])
+			copied += int64(wn)
+			if werr == nil && wn != n {
+				werr = io.ErrShortWrite
 			}
-			if wn != n {
-				logger.Error("Not all bytes written\n")
-				shouldClose = true
+			if werr != nil {
+				logger.Error("Connection write error: %s\n", werr)
+				b.closeBoth()
+				return copied
 			}
 		}
-		if shouldClose {
-			logger.Trace("    Stopping bridge %s to %s\n", c1Name, c2Name)
-			_ = c2.Close()
-			return
+		if err == io.EOF {
+			logger.Trace("    Stopping bridge %s to %s: end of data\n", src.name, dst.name)
+			cw, ok := dst.conn.(closeWriter)
+			if !ok || cw.CloseWrite() != nil {
+				b.closeBoth()
+			}
+			return copied
+		} else if err != nil {
+			if atomic.LoadInt32(&b.closing) == 0 && !strings.Contains(err.Error(), "use of closed network connection") {
+				logger.Error("Connection read error: %s\n", err)
+			}
+			logger.Trace("    Stopping bridge %s to %s\n", src.name, dst.name)
+			b.closeBoth()
+			return copied
 		}
 	}
 }
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// halfPipeEnd is one end of an in-memory connection that can be half-closed
+type halfPipeEnd struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (e *halfPipeEnd) Read(b []byte) (int, error) {
+	return e.r.Read(b)
+}
+
+func (e *halfPipeEnd) Write(b []byte) (int, error) {
+	return e.w.Write(b)
+}
+
+func (e *halfPipeEnd) CloseWrite() error {
+	return e.w.Close()
+}
+
+func (e *halfPipeEnd) Close() error {
+	_ = e.w.Close()
+	return e.r.Close()
+}
+
+// newHalfPipe returns the two ends of an in-memory connection that can be half-closed
+func newHalfPipe() (*halfPipeEnd, *halfPipeEnd) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return &halfPipeEnd{r: r1, w: w2}, &halfPipeEnd{r: r2, w: w1}
+}
+
+// runBridge bridges two connections in the background, returning a channel for the result
+func runBridge(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, opts BridgeOptions) chan BridgeResult {
+	resultChan := make(chan BridgeResult, 1)
+	go func() {
+		resultChan <- BridgeConnsWithOptions(c1, "c1", c2, "c2", opts)
+	}()
+	return resultChan
+}
+
+// waitBridge returns the result of a bridge, failing if it does not finish in time
+func waitBridge(t *testing.T, resultChan chan BridgeResult) BridgeResult {
+	select {
+	case result := <-resultChan:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge did not finish")
+	}
+	return BridgeResult{}
+}
+
+func TestBridgeHalfClose(t *testing.T) {
+	client1, bridge1 := newHalfPipe()
+	bridge2, client2 := newHalfPipe()
+	resultChan := runBridge(bridge1, bridge2, BridgeOptions{})
+
+	// client1 finishes sending first, and still gets client2's reply
+	go func() {
+		_, _ = client1.Write([]byte("hello"))
+		_ = client1.CloseWrite()
+	}()
+	data, err := ioutil.ReadAll(client2)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected data from c1: %q %v", data, err)
+	}
+	go func() {
+		_, _ = client2.Write([]byte("hello, world"))
+		_ = client2.CloseWrite()
+	}()
+	data, err = ioutil.ReadAll(client1)
+	if err != nil || string(data) != "hello, world" {
+		t.Fatalf("unexpected data from c2: %q %v", data, err)
+	}
+	result := waitBridge(t, resultChan)
+	if result.C1ToC2 != 5 || result.C2ToC1 != 12 || result.IdleTimedOut {
+		t.Fatalf("unexpected bridge result %+v", result)
+	}
+}
+
+func TestBridgeWithoutHalfClose(t *testing.T) {
+	// net.Pipe cannot be half-closed, so EOF in one direction ends the bridge
+	client1, bridge1 := net.Pipe()
+	bridge2, client2 := net.Pipe()
+	resultChan := runBridge(bridge1, bridge2, BridgeOptions{})
+	go func() {
+		_, _ = client1.Write([]byte("hello"))
+		_ = client1.Close()
+	}()
+	data, err := ioutil.ReadAll(client2)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected data from c1: %q %v", data, err)
+	}
+	result := waitBridge(t, resultChan)
+	if result.C1ToC2 != 5 || result.C2ToC1 != 0 {
+		t.Fatalf("unexpected bridge result %+v", result)
+	}
+}
+
+func TestBridgeIdleTimeout(t *testing.T) {
+	client1, bridge1 := newHalfPipe()
+	bridge2, client2 := newHalfPipe()
+	startTime := time.Now()
+	resultChan := runBridge(bridge1, bridge2, BridgeOptions{IdleTimeout: 200 * time.Millisecond})
+
+	// Data keeps the bridge open past the idle timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		go func() {
+			_, _ = client1.Write([]byte("ping"))
+		}()
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(client2, buf)
+		if err != nil {
+			t.Fatalf("bridge closed while data was flowing: %s", err)
+		}
+	}
+	result := waitBridge(t, resultChan)
+	if !result.IdleTimedOut || result.C1ToC2 != 16 || time.Since(startTime) < 600*time.Millisecond {
+		t.Fatalf("unexpected bridge result %+v after %s", result, time.Since(startTime))
+	}
+	_, err := client2.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("connection was not closed by the idle timeout")
+	}
+}
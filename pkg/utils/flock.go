@@ -32,7 +32,10 @@ func TryFLock(filename string) (*FLock, error) {
 	return &FLock{fd: fd}, nil
 }
 
-// Unlock unlocks the file lock
+// Unlock unlocks the file lock.  Unlocking a nil lock does nothing.
 func (lock *FLock) Unlock() error {
+	if lock == nil {
+		return nil
+	}
 	return syscall.Close(lock.fd)
 }
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// JoinHostPort combines a host and port into a network address.  The host may be a hostname, an
+// IPv4 address, or an IPv6 address with or without brackets, so "::1" and "[::1]" both give
+// "[::1]:port".
+func JoinHostPort(host string, port int) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
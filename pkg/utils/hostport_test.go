@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestJoinHostPort(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"0.0.0.0", "0.0.0.0:2222"},
+		{"localhost", "localhost:2222"},
+		{"::", "[::]:2222"},
+		{"2001:db8::1", "[2001:db8::1]:2222"},
+		{"[2001:db8::1]", "[2001:db8::1]:2222"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:2222"},
+	}
+	for _, test := range tests {
+		addr := JoinHostPort(test.host, 2222)
+		if addr != test.expected {
+			t.Errorf("JoinHostPort(%q) gave %s, expected %s", test.host, addr, test.expected)
+		}
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Errorf("JoinHostPort(%q) gave an address that does not split: %s", test.host, err)
+		}
+	}
+}
+
+func TestJoinHostPortIPv6Listen(t *testing.T) {
+	li, err := net.Listen("tcp", JoinHostPort("[::1]", 0))
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %s", err)
+	}
+	defer li.Close()
+	go func() {
+		c, err := li.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+	}()
+	host, _, err := net.SplitHostPort(li.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "::1" {
+		t.Fatalf("listener bound to %s instead of ::1", host)
+	}
+	c, err := net.Dial("tcp", li.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
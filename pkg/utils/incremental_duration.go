@@ -2,6 +2,7 @@ package utils
 
 import (
 	"math"
+	"math/rand"
 	"time"
 )
 
@@ -11,6 +12,7 @@ type IncrementalDuration struct {
 	initialDuration time.Duration
 	maxDuration     time.Duration
 	multiplier      float64
+	jitter          float64
 }
 
 // NewIncrementalDuration returns an IncrementalDuration object with initialized values
@@ -28,13 +30,27 @@ func (ID *IncrementalDuration) Reset() {
 	ID.duration = ID.initialDuration
 }
 
+// SetJitter randomizes each timeout by up to the given fraction of the current duration, in either
+// direction, so that many clients backing off at once do not retry in lockstep
+func (ID *IncrementalDuration) SetJitter(jitter float64) {
+	ID.jitter = math.Max(0, math.Min(1, jitter))
+}
+
+// jittered returns the current duration, randomized by the jitter fraction
+func (ID *IncrementalDuration) jittered() time.Duration {
+	if ID.jitter == 0 {
+		return ID.duration
+	}
+	return time.Duration(float64(ID.duration) * (1 + ID.jitter*(2*rand.Float64()-1)))
+}
+
 func (ID *IncrementalDuration) increaseDuration() {
 	ID.duration = time.Duration(math.Min(ID.multiplier*float64(ID.duration), float64(ID.maxDuration)))
 }
 
 // NextTimeout returns a timeout channel based on current duration
 func (ID *IncrementalDuration) NextTimeout() <-chan time.Time {
-	ch := time.After(ID.duration)
+	ch := time.After(ID.jittered())
 	ID.increaseDuration()
 	return ch
 }
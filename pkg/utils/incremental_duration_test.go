@@ -27,3 +27,21 @@ func TestIncrementalDuration(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestIncrementalDurationJitter(t *testing.T) {
+	delay := NewIncrementalDuration(1*time.Second, 10*time.Second, 2.0)
+	delay.SetJitter(0.5)
+	varied := false
+	for i := 0; i < 100; i++ {
+		d := delay.jittered()
+		if d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("jittered duration %s is outside the jitter range", d)
+		}
+		if d != 1*time.Second {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Fatal("jitter did not vary the duration")
+	}
+}
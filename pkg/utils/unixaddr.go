@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// errAbstractUnixSocket is returned for abstract Unix socket names on platforms without them
+var errAbstractUnixSocket = fmt.Errorf("abstract Unix sockets are only supported on Linux")
+
+// IsAbstractUnixSocket returns true if a Unix socket name is of the form @name, which means a
+// socket in the Linux abstract namespace rather than a file
+func IsAbstractUnixSocket(filename string) bool {
+	return strings.HasPrefix(filename, "@")
+}
+
+// UnixSocketDial connects to a Unix socket, which may be an abstract socket named @name
+func UnixSocketDial(filename string) (net.Conn, error) {
+	if IsAbstractUnixSocket(filename) && !abstractUnixSocketsSupported {
+		return nil, errAbstractUnixSocket
+	}
+	return net.Dial("unix", filename)
+}
@@ -0,0 +1,4 @@
+package utils
+
+// abstractUnixSocketsSupported is true if Unix sockets can be bound in the abstract namespace
+const abstractUnixSocketsSupported = true
@@ -0,0 +1,6 @@
+//+build !linux
+
+package utils
+
+// abstractUnixSocketsSupported is true if Unix sockets can be bound in the abstract namespace
+const abstractUnixSocketsSupported = false
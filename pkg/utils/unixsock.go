@@ -8,8 +8,20 @@ import (
 	"os"
 )
 
-// UnixSocketListen listens on a Unix socket, handling file locking and permissions
+// UnixSocketListen listens on a Unix socket, handling file locking and permissions.  A name of the
+// form @name is bound in the Linux abstract namespace instead, which has no file to lock or set
+// permissions on, so the returned lock is nil.
 func UnixSocketListen(filename string, permissions os.FileMode) (net.Listener, *FLock, error) {
+	if IsAbstractUnixSocket(filename) {
+		if !abstractUnixSocketsSupported {
+			return nil, nil, errAbstractUnixSocket
+		}
+		uli, err := net.Listen("unix", filename)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not listen on abstract socket: %s", err)
+		}
+		return uli, nil, nil
+	}
 	lock, err := TryFLock(filename + ".lock")
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not acquire lock on socket file: %s", err)
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAbstractUnixSocket(t *testing.T) {
+	name := fmt.Sprintf("@receptor-test-%d", os.Getpid())
+	uli, lock, err := UnixSocketListen(name, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uli.Close()
+	if lock != nil {
+		t.Fatal("got a file lock for an abstract socket")
+	}
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(name)
+	if !os.IsNotExist(err) {
+		t.Fatalf("abstract socket created a file: %v", err)
+	}
+	_, _, err = UnixSocketListen(name, 0600)
+	if err == nil {
+		t.Fatal("listened twice on the same abstract socket")
+	}
+
+	go func() {
+		conn, err := uli.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.Close()
+	}()
+	conn, err := UnixSocketDial(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected data %q", buf)
+	}
+}
@@ -5,7 +5,8 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/google/shlex"
 	"github.com/project-receptor/receptor/pkg/cmdline"
-	"github.com/project-receptor/receptor/pkg/logger"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -20,12 +21,12 @@ type commandUnit struct {
 	BaseWorkUnit
 	command    string
 	baseParams string
-	done       bool
 }
 
 // commandExtraData is the content of the ExtraData JSON field for a command worker
 type commandExtraData struct {
-	Pid int
+	Pid    int
+	Limits ResourceLimits
 }
 
 func termThenKill(cmd *exec.Cmd) {
@@ -47,14 +48,37 @@ func cmdWaiter(cmd *exec.Cmd, doneChan chan bool) {
 }
 
 // commandRunner is run in a separate process, to monitor the subprocess and report back metadata
-func commandRunner(command string, params string, unitdir string) error {
+func commandRunner(command string, params string, unitdir string, limits ResourceLimits) error {
 	status := StatusFileData{}
 	status.ExtraData = &commandExtraData{}
 	statusFilename := path.Join(unitdir, "status")
 	err := status.UpdateBasicStatus(statusFilename, WorkStatePending, "Not started yet", 0)
 	if err != nil {
-		logger.Error("Error updating status file %s: %s", statusFilename, err)
+		sublogger.Error("Error updating status file %s: %s", statusFilename, err)
 	}
+	// The runner joins the cgroup itself, so the command is limited from the moment it starts
+	var cg *unitCgroup
+	if !limits.IsZero() {
+		cg, err = newUnitCgroup(path.Base(unitdir), limits)
+		if err != nil {
+			return fmt.Errorf("Error setting up resource limits: %s", err)
+		}
+		err = cg.join()
+		if err != nil {
+			_ = cg.remove()
+			return fmt.Errorf("Error setting up resource limits: %s", err)
+		}
+	}
+	removeCgroup := func() {
+		if cg == nil {
+			return
+		}
+		err := cg.remove()
+		if err != nil {
+			sublogger.Error("Error removing cgroup of %s: %s", unitdir, err)
+		}
+	}
+	defer removeCgroup()
 	var cmd *exec.Cmd
 	if params == "" {
 		cmd = exec.Command(command)
@@ -71,9 +95,10 @@ func commandRunner(command string, params string, unitdir string) error {
 		<-termChan
 		sigKilled = true
 		termThenKill(cmd)
+		removeCgroup()
 		err = status.UpdateBasicStatus(statusFilename, WorkStateFailed, "Killed", stdoutSize(unitdir))
 		if err != nil {
-			logger.Error("Error updating status file %s: %s", statusFilename, err)
+			sublogger.Error("Error updating status file %s: %s", statusFilename, err)
 		}
 		os.Exit(-1)
 	}()
@@ -87,8 +112,15 @@ func commandRunner(command string, params string, unitdir string) error {
 	if err != nil {
 		return err
 	}
+	stderr, err := os.OpenFile(path.Join(unitdir, "stderr"), os.O_CREATE+os.O_WRONLY+os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	progressFilename := path.Join(unitdir, "progress")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", ProgressFileEnvVar, progressFilename))
 	cmd.Stdout = stdout
-	cmd.Stderr = stdout
+	// Stderr is kept in its own file, and also merged into stdout so results include it as before
+	cmd.Stderr = io.MultiWriter(stdout, stderr)
 	err = cmd.Start()
 	if err != nil {
 		return err
@@ -103,33 +135,49 @@ loop:
 		case <-time.After(250 * time.Millisecond):
 			err = status.UpdateBasicStatus(statusFilename, WorkStateRunning, fmt.Sprintf("Running: PID %d", cmd.Process.Pid), stdoutSize(unitdir))
 			if err != nil {
-				logger.Error("Error updating status file %s: %s", statusFilename, err)
+				sublogger.Error("Error updating status file %s: %s", statusFilename, err)
+			}
+			progress, ok := readProgressFile(progressFilename)
+			if ok && progress != status.Progress {
+				err := status.UpdateFullStatus(statusFilename, func(status *StatusFileData) {
+					status.Progress = progress
+				})
+				if err != nil {
+					sublogger.Error("Error updating status file %s: %s", statusFilename, err)
+				}
 			}
-
 		}
 	}
+	recordFileChecksums(&status, statusFilename, unitdir)
 	if err != nil {
 		if sigKilled {
 			time.Sleep(50 * time.Millisecond)
 		} else {
 			err = status.UpdateBasicStatus(statusFilename, WorkStateFailed, fmt.Sprintf("Error: %s", err), stdoutSize(unitdir))
 			if err != nil {
-				logger.Error("Error updating status file %s: %s", statusFilename, err)
+				sublogger.Error("Error updating status file %s: %s", statusFilename, err)
 			}
 		}
 		return err
 	}
-	if cmd.ProcessState.Success() {
+	if cg != nil && cg.oomKilled() {
+		err = status.UpdateBasicStatus(statusFilename, WorkStateFailed,
+			fmt.Sprintf("Killed: exceeded memory limit of %d bytes", limits.MemoryBytes), stdoutSize(unitdir))
+		if err != nil {
+			sublogger.Error("Error updating status file %s: %s", statusFilename, err)
+		}
+	} else if cmd.ProcessState.Success() {
 		err = status.UpdateBasicStatus(statusFilename, WorkStateSucceeded, cmd.ProcessState.String(), stdoutSize(unitdir))
 		if err != nil {
-			logger.Error("Error updating status file %s: %s", statusFilename, err)
+			sublogger.Error("Error updating status file %s: %s", statusFilename, err)
 		}
 	} else {
 		err = status.UpdateBasicStatus(statusFilename, WorkStateFailed, cmd.ProcessState.String(), stdoutSize(unitdir))
 		if err != nil {
-			logger.Error("Error updating status file %s: %s", statusFilename, err)
+			sublogger.Error("Error updating status file %s: %s", statusFilename, err)
 		}
 	}
+	removeCgroup()
 	os.Exit(cmd.ProcessState.ExitCode())
 	return nil
 }
@@ -197,7 +245,7 @@ func (cw *commandUnit) monitorLocalStatus() {
 			if event.Op&fsnotify.Write == fsnotify.Write {
 				err = cw.Load()
 				if err != nil {
-					logger.Error("Error reading %s: %s", statusFile, err)
+					sublogger.Error("Error reading %s: %s", statusFile, err)
 				}
 			}
 		case <-time.After(time.Second):
@@ -207,7 +255,7 @@ func (cw *commandUnit) monitorLocalStatus() {
 					fi = newFi
 					err = cw.Load()
 					if err != nil {
-						logger.Error("Error reading %s: %s", statusFile, err)
+						sublogger.Error("Error reading %s: %s", statusFile, err)
 					}
 				}
 			}
@@ -222,7 +270,6 @@ func (cw *commandUnit) monitorLocalStatus() {
 // runCommand actually runs the exec.Cmd.  This is in a separate function so the Python worker can call it.
 func (cw *commandUnit) runCommand(cmd *exec.Cmd) error {
 	cmdSetDetach(cmd)
-	cw.done = false
 	err := cmd.Start()
 	if err != nil {
 		cw.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Failed to start command runner: %s", err), 0)
@@ -237,9 +284,12 @@ func (cw *commandUnit) runCommand(cmd *exec.Cmd) error {
 	doneChan := make(chan bool)
 	go func() {
 		<-doneChan
-		cw.done = true
 		cw.UpdateFullStatus(func(status *StatusFileData) {
-			status.ExtraData = nil
+			// If the unit is being retried, the PID may already be that of the next attempt
+			ced, ok := status.ExtraData.(*commandExtraData)
+			if ok && ced.Pid == cmd.Process.Pid {
+				ced.Pid = 0
+			}
 		})
 	}()
 	go cmdWaiter(cmd, doneChan)
@@ -249,11 +299,16 @@ func (cw *commandUnit) runCommand(cmd *exec.Cmd) error {
 
 // Start launches a job with given parameters.
 func (cw *commandUnit) Start() error {
+	err := cw.requireUnitDir()
+	if err != nil {
+		return err
+	}
 	cw.UpdateBasicStatus(WorkStatePending, "Launching command runner", 0)
-	cmd := exec.Command(os.Args[0], "--command-runner",
+	args := []string{"--command-runner",
 		fmt.Sprintf("command=%s", cw.command),
 		fmt.Sprintf("params=%s", cw.Status().Params),
-		fmt.Sprintf("unitdir=%s", cw.UnitDir()))
+		fmt.Sprintf("unitdir=%s", cw.UnitDir())}
+	cmd := exec.Command(os.Args[0], append(args, cw.resourceLimitArgs()...)...)
 	return cw.runCommand(cmd)
 }
 
@@ -268,6 +323,10 @@ func (cw *commandUnit) Restart() error {
 		// Job already complete - no need to restart monitoring
 		return nil
 	}
+	err = cw.requireUnitDir()
+	if err != nil {
+		return err
+	}
 	if state == WorkStatePending {
 		// Job never started - mark it failed
 		cw.UpdateBasicStatus(WorkStateFailed, "Pending at restart", stdoutSize(cw.UnitDir()))
@@ -313,9 +372,10 @@ func (cw *commandUnit) Release(force bool) error {
 
 // CommandCfg is the cmdline configuration object for a worker that runs a command
 type CommandCfg struct {
-	WorkType string `required:"true" description:"Name for this worker type"`
-	Command  string `required:"true" description:"Command to run to process units of work"`
-	Params   string `description:"Command-line parameters"`
+	WorkType      string `required:"true" description:"Name for this worker type"`
+	Command       string `required:"true" description:"Command to run to process units of work"`
+	Params        string `description:"Command-line parameters"`
+	MaxConcurrent int    `description:"Maximum number of units of this type to run at once (0 for no limit)" default:"0"`
 }
 
 func (cfg CommandCfg) newWorker() WorkUnit {
@@ -325,29 +385,51 @@ func (cfg CommandCfg) newWorker() WorkUnit {
 	}
 }
 
+// checkCommand is a config check that the command of a worker type can be found
+func (cfg CommandCfg) checkCommand() []netceptor.ConfigFinding {
+	_, err := exec.LookPath(cfg.Command)
+	if err != nil {
+		return []netceptor.ConfigFinding{{
+			Severity: netceptor.FindingError,
+			Message:  fmt.Sprintf("work type %s: %s", cfg.WorkType, err),
+		}}
+	}
+	return nil
+}
+
 // Run runs the action
 func (cfg CommandCfg) Run() error {
+	MainInstance.nc.AddConfigCheck("workceptor", cfg.checkCommand)
 	err := MainInstance.RegisterWorker(cfg.WorkType, cfg.newWorker)
-	return err
+	if err != nil {
+		return err
+	}
+	return MainInstance.SetWorkTypeLimit(cfg.WorkType, cfg.MaxConcurrent)
 }
 
 // CommandRunnerCfg is a hidden command line option for a command runner process
 type CommandRunnerCfg struct {
-	Command string `required:"true"`
-	Params  string `required:"true"`
-	UnitDir string `required:"true"`
+	Command     string  `required:"true"`
+	Params      string  `required:"true"`
+	UnitDir     string  `required:"true"`
+	MemoryLimit int64   `default:"0"`
+	CPULimit    float64 `default:"0"`
 }
 
 // Run runs the action
 func (cfg CommandRunnerCfg) Run() error {
-	err := commandRunner(cfg.Command, cfg.Params, cfg.UnitDir)
+	limits := ResourceLimits{
+		MemoryBytes: cfg.MemoryLimit,
+		CPUs:        cfg.CPULimit,
+	}
+	err := commandRunner(cfg.Command, cfg.Params, cfg.UnitDir, limits)
 	if err != nil {
 		statusFilename := path.Join(cfg.UnitDir, "status")
 		err = (&StatusFileData{}).UpdateBasicStatus(statusFilename, WorkStateFailed, err.Error(), stdoutSize(cfg.UnitDir))
 		if err != nil {
-			logger.Error("Error updating status file %s: %s", statusFilename, err)
+			sublogger.Error("Error updating status file %s: %s", statusFilename, err)
 		}
-		logger.Error("Command runner exited with error: %s\n", err)
+		sublogger.Error("Command runner exited with error: %s\n", err)
 		os.Exit(-1)
 	} else {
 		os.Exit(0)
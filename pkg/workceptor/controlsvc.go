@@ -1,13 +1,13 @@
 package workceptor
 
 import (
+	"context"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/controlsvc"
 	"github.com/project-receptor/receptor/pkg/netceptor"
-	"os"
-	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type workceptorCommandType struct {
@@ -20,6 +20,19 @@ type workceptorCommand struct {
 	params     map[string]interface{}
 }
 
+func (t *workceptorCommandType) Description() string {
+	return "Submit, monitor and manage units of work"
+}
+
+// Redact hides the parameters of submitted work from the audit log, since they can contain credentials
+func (t *workceptorCommandType) Redact(params string, config map[string]interface{}) (string, map[string]interface{}) {
+	tokens := strings.Fields(params)
+	if len(tokens) > 3 && strings.ToLower(tokens[0]) == "submit" {
+		params = strings.Join(append(tokens[:3], controlsvc.RedactedValue), " ")
+	}
+	return params, controlsvc.RedactFields(config, "params")
+}
+
 func (t *workceptorCommandType) InitFromString(params string) (controlsvc.ControlCommand, error) {
 	tokens := strings.Split(params, " ")
 	if len(tokens) == 0 {
@@ -42,11 +55,11 @@ func (t *workceptorCommandType) InitFromString(params string) (controlsvc.Contro
 		} else {
 			c.params["params"] = ""
 		}
-	case "list":
+	case "list", "pending":
 		if len(tokens) > 1 {
-			return nil, fmt.Errorf("work list does not take parameters")
+			return nil, fmt.Errorf("work %s does not take parameters", c.subcommand)
 		}
-	case "status", "cancel", "release", "force-release":
+	case "status", "verify", "cancel", "cancel-pending", "release", "force-release":
 		if len(tokens) < 2 {
 			return nil, fmt.Errorf("work %s requires a unit ID", c.subcommand)
 		}
@@ -71,10 +84,57 @@ func (t *workceptorCommandType) InitFromString(params string) (controlsvc.Contro
 		} else {
 			c.params["startpos"] = int64(0)
 		}
+	case "tail":
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("work tail requires a unit ID")
+		}
+		if len(tokens) > 5 {
+			return nil, fmt.Errorf("work tail only takes a unit ID, optional stream name, optional frames keyword and optional offset")
+		}
+		c.params["unitid"] = tokens[1]
+		c.params["stream"] = "stdout"
+		c.params["offset"] = int64(0)
+		for _, token := range tokens[2:] {
+			offset, err := strconv.ParseInt(token, 10, 64)
+			if err == nil {
+				c.params["offset"] = offset
+			} else if strings.ToLower(token) == "frames" {
+				c.params["frames"] = true
+			} else {
+				c.params["stream"] = strings.ToLower(token)
+			}
+		}
+		err := checkTailStream(c.params["stream"].(string))
+		if err != nil {
+			return nil, err
+		}
+		err = checkTailOffset(c.params["offset"].(int64))
+		if err != nil {
+			return nil, err
+		}
+		if c.params["frames"] == true {
+			return newWorkTailCommand(c), nil
+		}
 	}
 	return c, nil
 }
 
+// checkTailOffset returns an error if a tail cannot start from an offset
+func checkTailOffset(offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("work tail offset must not be negative")
+	}
+	return nil
+}
+
+// checkTailStream returns an error if a stream cannot be tailed
+func checkTailStream(stream string) error {
+	if stream != "stdout" && stream != "stderr" {
+		return fmt.Errorf("work tail stream must be stdout or stderr")
+	}
+	return nil
+}
+
 // strFromMap extracts a string from a map[string]interface{}, handling errors
 func strFromMap(config map[string]interface{}, name string) (string, error) {
 	value, ok := config[name]
@@ -105,13 +165,164 @@ func intFromMap(config map[string]interface{}, name string) (int64, error) {
 	valueStr, ok := value.(string)
 	if ok {
 		valueInt, err := strconv.ParseInt(valueStr, 10, 64)
-		if err != nil {
+		if err == nil {
 			return valueInt, nil
 		}
 	}
 	return 0, fmt.Errorf("field %s value %s is not convertible to an int", name, value)
 }
 
+// startTimeFromMap extracts the deferred start time of a work submission, given either as an
+// RFC3339 "startat" timestamp or as a "delay" duration from now.  Returns a zero time if neither
+// is present.
+func startTimeFromMap(config map[string]interface{}) (time.Time, error) {
+	_, hasStartAt := config["startat"]
+	_, hasDelay := config["delay"]
+	if hasStartAt && hasDelay {
+		return time.Time{}, fmt.Errorf("only one of startat and delay can be given")
+	}
+	if hasStartAt {
+		startAtStr, err := strFromMap(config, "startat")
+		if err != nil {
+			return time.Time{}, err
+		}
+		startAt, err := time.Parse(time.RFC3339, startAtStr)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid startat timestamp: %s", err)
+		}
+		return startAt, nil
+	}
+	if hasDelay {
+		delayStr, err := strFromMap(config, "delay")
+		if err != nil {
+			return time.Time{}, err
+		}
+		delay, err := time.ParseDuration(delayStr)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid delay: %s", err)
+		}
+		if delay < 0 {
+			return time.Time{}, fmt.Errorf("delay must not be negative")
+		}
+		return time.Now().Add(delay), nil
+	}
+	return time.Time{}, nil
+}
+
+// timeoutFromMap extracts the timeout of a work submission, given as a "timeout" duration.
+// Returns zero if it is not present.
+func timeoutFromMap(config map[string]interface{}) (time.Duration, error) {
+	_, ok := config["timeout"]
+	if !ok {
+		return 0, nil
+	}
+	timeoutStr, err := strFromMap(config, "timeout")
+	if err != nil {
+		return 0, err
+	}
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %s", err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	return timeout, nil
+}
+
+// limitsFromMap extracts the resource limits of a work submission, given as a "memlimit" size
+// such as 512M and a "cpulimit" number of CPUs.  Either can also be given as a JSON number.
+// Returns zero limits if neither is present.
+func limitsFromMap(config map[string]interface{}) (ResourceLimits, error) {
+	var err error
+	limits := ResourceLimits{}
+	switch memLimit := config["memlimit"].(type) {
+	case nil:
+	case float64:
+		limits.MemoryBytes = int64(memLimit)
+	case string:
+		limits.MemoryBytes, err = ParseMemoryLimit(memLimit)
+		if err != nil {
+			return limits, err
+		}
+	default:
+		return limits, fmt.Errorf("field memlimit must be a string or number")
+	}
+	switch cpuLimit := config["cpulimit"].(type) {
+	case nil:
+	case float64:
+		limits.CPUs = cpuLimit
+	case string:
+		limits.CPUs, err = strconv.ParseFloat(cpuLimit, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid cpulimit %s", cpuLimit)
+		}
+	default:
+		return limits, fmt.Errorf("field cpulimit must be a string or number")
+	}
+	return limits, limits.Validate()
+}
+
+// retryPolicyFromMap extracts the retry policy of a work submission, given as a "maxattempts"
+// count, an optional "retrydelay" duration and an optional "retrybackoff" boolean.  Returns a
+// policy with zero attempts if maxattempts is not present.
+func retryPolicyFromMap(config map[string]interface{}) (RetryPolicy, error) {
+	policy := RetryPolicy{}
+	_, ok := config["maxattempts"]
+	if !ok {
+		for _, field := range []string{"retrydelay", "retrybackoff"} {
+			_, ok = config[field]
+			if ok {
+				return policy, fmt.Errorf("%s requires maxattempts", field)
+			}
+		}
+		return policy, nil
+	}
+	maxAttempts, err := intFromMap(config, "maxattempts")
+	if err != nil {
+		return policy, err
+	}
+	policy.MaxAttempts = int(maxAttempts)
+	_, ok = config["retrydelay"]
+	if ok {
+		delayStr, err := strFromMap(config, "retrydelay")
+		if err != nil {
+			return policy, err
+		}
+		policy.Delay, err = time.ParseDuration(delayStr)
+		if err != nil {
+			return policy, fmt.Errorf("invalid retrydelay: %s", err)
+		}
+	}
+	_, ok = config["retrybackoff"]
+	if ok {
+		policy.Backoff, ok = config["retrybackoff"].(bool)
+		if !ok {
+			return policy, fmt.Errorf("retrybackoff must be a boolean")
+		}
+	}
+	return policy, policy.Validate()
+}
+
+// outputModeFromMap extracts how the output of work results or work tail is sent: "raw", which
+// ends the output by closing the connection, or "chunked", which sends it as length-prefixed
+// chunks followed by a trailer that says whether the output is complete
+func outputModeFromMap(config map[string]interface{}) (string, error) {
+	_, ok := config["outputmode"]
+	if !ok {
+		return "raw", nil
+	}
+	outputMode, err := strFromMap(config, "outputmode")
+	if err != nil {
+		return "", err
+	}
+	outputMode = strings.ToLower(outputMode)
+	if outputMode != "raw" && outputMode != "chunked" {
+		return "", fmt.Errorf("unknown output mode %s", outputMode)
+	}
+	return outputMode, nil
+}
+
 func (t *workceptorCommandType) InitFromJSON(config map[string]interface{}) (controlsvc.ControlCommand, error) {
 	subCmd, err := strFromMap(config, "subcommand")
 	if err != nil {
@@ -136,7 +347,56 @@ func (t *workceptorCommandType) InitFromJSON(config map[string]interface{}) (con
 		if err != nil {
 			return nil, err
 		}
-	case "status", "cancel", "release", "force-release":
+		_, ok := config["payloadmode"]
+		if ok {
+			payloadMode, err := strFromMap(config, "payloadmode")
+			if err != nil {
+				return nil, err
+			}
+			payloadMode = strings.ToLower(payloadMode)
+			if payloadMode != "eof" && payloadMode != "chunked" {
+				return nil, fmt.Errorf("unknown payload mode %s", payloadMode)
+			}
+			c.params["payloadmode"] = payloadMode
+		}
+		startAt, err := startTimeFromMap(config)
+		if err != nil {
+			return nil, err
+		}
+		if !startAt.IsZero() {
+			c.params["startat"] = startAt
+		}
+		timeout, err := timeoutFromMap(config)
+		if err != nil {
+			return nil, err
+		}
+		if timeout > 0 {
+			c.params["timeout"] = timeout
+		}
+		for _, field := range []string{"signature", "signedat"} {
+			_, ok = config[field]
+			if ok {
+				c.params[field], err = strFromMap(config, field)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		limits, err := limitsFromMap(config)
+		if err != nil {
+			return nil, err
+		}
+		if !limits.IsZero() {
+			c.params["limits"] = limits
+		}
+		retry, err := retryPolicyFromMap(config)
+		if err != nil {
+			return nil, err
+		}
+		if retry.MaxAttempts > 0 {
+			c.params["retry"] = retry
+		}
+	case "status", "verify", "cancel", "cancel-pending", "release", "force-release":
 		c.params["unitid"], err = strFromMap(config, "unitid")
 		if err != nil {
 			return nil, err
@@ -150,6 +410,54 @@ func (t *workceptorCommandType) InitFromJSON(config map[string]interface{}) (con
 		if err != nil {
 			return nil, err
 		}
+		c.params["outputmode"], err = outputModeFromMap(config)
+		if err != nil {
+			return nil, err
+		}
+	case "tail":
+		c.params["unitid"], err = strFromMap(config, "unitid")
+		if err != nil {
+			return nil, err
+		}
+		c.params["stream"] = "stdout"
+		_, ok := config["stream"]
+		if ok {
+			stream, err := strFromMap(config, "stream")
+			if err != nil {
+				return nil, err
+			}
+			c.params["stream"] = strings.ToLower(stream)
+		}
+		err = checkTailStream(c.params["stream"].(string))
+		if err != nil {
+			return nil, err
+		}
+		c.params["offset"] = int64(0)
+		_, ok = config["offset"]
+		if ok {
+			c.params["offset"], err = intFromMap(config, "offset")
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = checkTailOffset(c.params["offset"].(int64))
+		if err != nil {
+			return nil, err
+		}
+		c.params["outputmode"], err = outputModeFromMap(config)
+		if err != nil {
+			return nil, err
+		}
+		_, ok = config["frames"]
+		if ok {
+			c.params["frames"], ok = config["frames"].(bool)
+			if !ok {
+				return nil, fmt.Errorf("frames must be a boolean")
+			}
+		}
+		if c.params["frames"] == true {
+			return newWorkTailCommand(c), nil
+		}
 	}
 	return c, nil
 }
@@ -170,6 +478,12 @@ func (c *workceptorCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.
 		if err != nil {
 			return nil, err
 		}
+		signature, _ := strFromMap(c.params, "signature")
+		signedAt, _ := strFromMap(c.params, "signedat")
+		err = c.w.checkSubmission(cfo.ConnectionInfo(), workType, params, signature, signedAt)
+		if err != nil {
+			return nil, err
+		}
 		var worker WorkUnit
 		if workNode == nc.NodeID() || strings.EqualFold(workNode, "localhost") {
 			worker, err = c.w.AllocateUnit(workType, params)
@@ -179,12 +493,41 @@ func (c *workceptorCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.
 		if err != nil {
 			return nil, err
 		}
-		stdin, err := os.OpenFile(path.Join(worker.UnitDir(), "stdin"), os.O_CREATE+os.O_WRONLY, 0600)
+		timeout, ok := c.params["timeout"].(time.Duration)
+		if ok {
+			err = setUnitTimeout(worker, timeout)
+			if err != nil {
+				worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Error setting timeout: %s", err), 0)
+				return nil, err
+			}
+		}
+		limits, ok := c.params["limits"].(ResourceLimits)
+		if ok {
+			err = setUnitResourceLimits(worker, limits)
+			if err != nil {
+				worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Error setting resource limits: %s", err), 0)
+				return nil, err
+			}
+		}
+		retry, ok := c.params["retry"].(RetryPolicy)
+		if ok {
+			err = setUnitRetryPolicy(worker, retry)
+			if err != nil {
+				worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Error setting retry policy: %s", err), 0)
+				return nil, err
+			}
+		}
+		stdin, err := c.w.storage.OpenWriter(worker.ID(), "stdin", false)
 		if err != nil {
 			return nil, err
 		}
+		payloadMode, _ := strFromMap(c.params, "payloadmode")
 		worker.UpdateBasicStatus(WorkStatePending, "Waiting for Input Data", 0)
-		err = cfo.ReadFromConn(fmt.Sprintf("Work unit created with ID %s. Send stdin data and EOF.\n", worker.ID()), stdin)
+		if payloadMode == "chunked" {
+			err = cfo.ReadChunksFromConn(fmt.Sprintf("Work unit created with ID %s. Send stdin data as chunks and a zero-length chunk.\n", worker.ID()), stdin)
+		} else {
+			err = cfo.ReadFromConn(fmt.Sprintf("Work unit created with ID %s. Send stdin data and EOF.\n", worker.ID()), stdin)
+		}
 		if err != nil {
 			worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Error reading input data: %s", err), 0)
 			return nil, err
@@ -195,14 +538,21 @@ func (c *workceptorCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.
 			return nil, err
 		}
 		worker.UpdateBasicStatus(WorkStatePending, "Starting Worker", 0)
-		err = worker.Start()
+		startAt, deferred := c.params["startat"].(time.Time)
+		if deferred {
+			err = c.w.deferUnit(worker, startAt)
+		} else {
+			err = c.w.scheduleUnit(worker)
+		}
 		if err != nil && !IsPending(err) {
 			worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Error starting worker: %s", err), 0)
 			return nil, err
 		}
 		cfr := make(map[string]interface{})
 		cfr["unitid"] = worker.ID()
-		if IsPending(err) {
+		if deferred && startAt.After(time.Now()) {
+			cfr["result"] = "Job Scheduled"
+		} else if IsPending(err) {
 			cfr["result"] = "Job Submitted"
 		} else {
 			cfr["result"] = "Job Started"
@@ -220,6 +570,34 @@ func (c *workceptorCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.
 			cfr[unitID] = status
 		}
 		return cfr, nil
+	case "pending":
+		cfr := make(map[string]interface{})
+		for _, pu := range c.w.PendingUnits() {
+			entry := map[string]interface{}{
+				"WorkType": pu.WorkType,
+				"Reason":   pu.Reason,
+			}
+			switch pu.Reason {
+			case PendingScheduled:
+				entry["StartAt"] = pu.StartAt
+			case PendingQueued:
+				entry["QueuePosition"] = pu.QueuePosition
+			}
+			cfr[pu.UnitID] = entry
+		}
+		return cfr, nil
+	case "cancel-pending":
+		unitid, err := strFromMap(c.params, "unitid")
+		if err != nil {
+			return nil, err
+		}
+		err = c.w.CancelPendingUnit(unitid)
+		if err != nil {
+			return nil, err
+		}
+		cfr := make(map[string]interface{})
+		cfr["cancelled"] = unitid
+		return cfr, nil
 	case "status":
 		unitid, err := strFromMap(c.params, "unitid")
 		if err != nil {
@@ -230,6 +608,20 @@ func (c *workceptorCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.
 			return nil, err
 		}
 		return cfr, nil
+	case "verify":
+		unitid, err := strFromMap(c.params, "unitid")
+		if err != nil {
+			return nil, err
+		}
+		problems, err := c.w.VerifyUnit(unitid)
+		if err != nil {
+			return nil, err
+		}
+		cfr := make(map[string]interface{})
+		cfr["UnitID"] = unitid
+		cfr["OK"] = len(problems) == 0
+		cfr["Problems"] = problems
+		return cfr, nil
 	case "cancel", "release", "force-release":
 		unitid, err := strFromMap(c.params, "unitid")
 		if err != nil {
@@ -249,6 +641,7 @@ func (c *workceptorCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.
 		if err != nil {
 			cfr["already gone"] = unitid
 		} else {
+			c.w.cancelQueuedUnit(unit)
 			if c.subcommand == "cancel" {
 				err = unit.Cancel()
 			} else {
@@ -274,14 +667,42 @@ func (c *workceptorCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.
 			return nil, err
 		}
 		doneChan := make(chan struct{})
-		defer func() {
-			doneChan <- struct{}{}
-		}()
-		resultChan, err := c.w.GetResults(unitid, startPos, doneChan)
+		defer close(doneChan)
+		resultChan, errChan, err := c.w.getStreamWithErrors(unitid, "stdout", startPos, doneChan)
+		if err != nil {
+			return nil, err
+		}
+		err = c.writeOutput(cfo, fmt.Sprintf("Streaming results for work unit %s\n", unitid), resultChan, errChan)
+		if err != nil {
+			return nil, err
+		}
+		err = cfo.Close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	case "tail":
+		unitid, err := strFromMap(c.params, "unitid")
+		if err != nil {
+			return nil, err
+		}
+		stream, err := strFromMap(c.params, "stream")
+		if err != nil {
+			return nil, err
+		}
+		offset, err := intFromMap(c.params, "offset")
+		if err != nil {
+			return nil, err
+		}
+		doneChan := make(chan struct{})
+		defer close(doneChan)
+		// Output already written from the offset on is sent first, so a client that reconnects
+		// can resume from the number of bytes it has received
+		streamChan, errChan, err := c.w.getStreamWithErrors(unitid, stream, offset, doneChan)
 		if err != nil {
 			return nil, err
 		}
-		err = cfo.WriteToConn(fmt.Sprintf("Streaming results for work unit %s\n", unitid), resultChan)
+		err = c.writeOutput(cfo, fmt.Sprintf("Streaming %s for work unit %s\n", stream, unitid), streamChan, errChan)
 		if err != nil {
 			return nil, err
 		}
@@ -293,3 +714,80 @@ func (c *workceptorCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.
 	}
 	return nil, fmt.Errorf("bad command")
 }
+
+// writeOutput sends the output of a unit to the client in the requested output mode
+func (c *workceptorCommand) writeOutput(cfo controlsvc.ControlFuncOperations, message string, in chan []byte,
+	errChan chan error) error {
+	if c.params["outputmode"] == "chunked" {
+		return cfo.WriteChunksToConn(message, in, errChan)
+	}
+	return cfo.WriteStreamToConn(message, in, errChan)
+}
+
+// workTailCommand follows the output of a work unit, sending it to the client as a frame for each
+// piece of output, rather than as a raw stream
+type workTailCommand struct {
+	w      *Workceptor
+	unitID string
+	stream string
+	offset int64
+}
+
+// newWorkTailCommand converts a parsed work tail command to one that sends frames
+func newWorkTailCommand(c *workceptorCommand) *workTailCommand {
+	return &workTailCommand{
+		w:      c.w,
+		unitID: c.params["unitid"].(string),
+		stream: c.params["stream"].(string),
+		offset: c.params["offset"].(int64),
+	}
+}
+
+// ControlFunc follows the output until the unit completes, returning all of it at once
+func (c *workTailCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.ControlFuncOperations) (map[string]interface{}, error) {
+	return controlsvc.CollectFrames(c, nc, cfo)
+}
+
+// StreamFunc sends the output of the unit as frames until the unit completes
+func (c *workTailCommand) StreamFunc(nc *netceptor.Netceptor, cfo controlsvc.ControlFuncOperations,
+	frames chan<- map[string]interface{}) (map[string]interface{}, error) {
+	ctx := context.Background()
+	if cfo != nil {
+		ctx = cfo.Context()
+	}
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+	streamChan, errChan, err := c.w.getStreamWithErrors(c.unitID, c.stream, c.offset, doneChan)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for {
+		select {
+		case data, ok := <-streamChan:
+			if !ok {
+				cfr := make(map[string]interface{})
+				cfr["Success"] = true
+				cfr["Unit"] = c.unitID
+				cfr["Stream"] = c.stream
+				cfr["Bytes"] = total
+				return cfr, nil
+			}
+			frame := make(map[string]interface{})
+			frame["Unit"] = c.unitID
+			frame["Stream"] = c.stream
+			frame["Offset"] = c.offset + total
+			frame["Data"] = string(data)
+			total += int64(len(data))
+			select {
+			case frames <- frame:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case err := <-errChan:
+			return nil, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package workceptor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/controlsvc"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startControlSession runs a control session of a server with the work commands of w, returning
+// the client end of the connection and a reader positioned after the server's greeting
+func startControlSession(t *testing.T, nc *netceptor.Netceptor, w *Workceptor) (net.Conn, *bufio.Reader) {
+	cs := controlsvc.New(false, nc)
+	err := w.RegisterWithControlService(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	go cs.RunControlSession(server)
+	reader := bufio.NewReader(client)
+	_, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, reader
+}
+
+func TestChunkedSubmit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := New(context.Background(), nc, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("upper", newUpperWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, reader := startControlSession(t, nc, w)
+	defer client.Close()
+
+	payload := make([]byte, 6*1024*1024+321)
+	_, err = rand.Read(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte(`{"command": "work", "subcommand": "submit", "node": "node1", "worktype": "upper", ` +
+		`"params": "", "payloadmode": "chunked"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unitID string
+	_, err = fmt.Sscanf(line, "Work unit created with ID %s", &unitID)
+	if err != nil {
+		t.Fatalf("unexpected submit response %q", line)
+	}
+	unitID = strings.TrimSuffix(unitID, ".")
+
+	writeErr := make(chan error, 1)
+	go func() {
+		chunkSize := 100 * 1024
+		for pos := 0; pos < len(payload); pos += chunkSize {
+			end := pos + chunkSize
+			if end > len(payload) {
+				end = len(payload)
+			}
+			_, err := client.Write([]byte(fmt.Sprintf("%d\n", end-pos)))
+			if err == nil {
+				_, err = client.Write(payload[pos:end])
+			}
+			if err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		_, err := client.Write([]byte("0\n"))
+		writeErr <- err
+	}()
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, unitID) || strings.HasPrefix(line, "ERROR") {
+		t.Fatalf("unexpected response after payload: %q", line)
+	}
+	err = <-writeErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin, err := ioutil.ReadFile(path.Join(tmpdir, "node1", unitID, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stdin, payload) {
+		t.Fatalf("unit stdin has %d bytes that do not match the %d byte payload", len(stdin), len(payload))
+	}
+}
+
+// failingReadStorage is a Storage whose stdout readers fail once they reach the end of the data
+type failingReadStorage struct {
+	Storage
+	fail bool
+}
+
+// failingReader returns an error instead of EOF
+type failingReader struct{}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("disk on fire")
+}
+
+func (fs *failingReadStorage) OpenReader(unitID string, stream string, offset int64) (io.ReadCloser, error) {
+	reader, err := fs.Storage.OpenReader(unitID, stream, offset)
+	if err != nil || !fs.fail || stream != "stdout" {
+		return reader, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(reader, failingReader{}), reader}, nil
+}
+
+func TestChunkedResults(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	storage := &failingReadStorage{Storage: NewFileStorage(tmpdir)}
+	w, err := NewWithStorage(context.Background(), nc, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("output", func() WorkUnit {
+		return &outputUnit{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := w.AllocateUnit("output", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// results sends the output as chunks, followed by a trailer that reports any read error
+	results := func(outputMode string) (string, *bufio.Reader) {
+		client, reader := startControlSession(t, nc, w)
+		t.Cleanup(func() {
+			_ = client.Close()
+		})
+		_ = client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err := client.Write([]byte(fmt.Sprintf(`{"command": "work", "subcommand": "results", "unitid": "%s", `+
+			`"startpos": 0, "outputmode": "%s"}`+"\n", unit.ID(), outputMode)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "Streaming results") {
+			t.Fatalf("unexpected results response %q", line)
+		}
+		if outputMode == "raw" {
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data), nil
+		}
+		data := make([]byte, 0)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := strconv.Atoi(strings.TrimSpace(line))
+			if err != nil {
+				t.Fatalf("invalid chunk length %q", line)
+			}
+			if size == 0 {
+				return string(data), reader
+			}
+			chunk := make([]byte, size)
+			_, err = io.ReadFull(reader, chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, chunk...)
+		}
+	}
+	trailer := func(reader *bufio.Reader) map[string]string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := make(map[string]string)
+		err = json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("trailer %q is not JSON: %s", line, err)
+		}
+		return record
+	}
+	data, reader := results("chunked")
+	if data != "hello\n" {
+		t.Fatalf("unexpected results %q", data)
+	}
+	if record := trailer(reader); len(record) != 0 {
+		t.Fatalf("trailer of complete results has an error: %v", record)
+	}
+
+	storage.fail = true
+	data, reader = results("chunked")
+	if data != "hello\n" {
+		t.Fatalf("unexpected results %q", data)
+	}
+	if record := trailer(reader); !strings.Contains(record[controlsvc.StreamErrorKey], "disk on fire") {
+		t.Fatalf("trailer of failed results does not have the error: %v", record)
+	}
+
+	// Raw output has nowhere to report the error, so nothing is added to the data
+	data, _ = results("raw")
+	if data != "hello\n" {
+		t.Fatalf("unexpected raw results %q", data)
+	}
+}
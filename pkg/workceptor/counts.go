@@ -0,0 +1,48 @@
+package workceptor
+
+import (
+	"sort"
+)
+
+// UnitStateCount is the number of known units of a work type in a state
+type UnitStateCount struct {
+	WorkType string
+	State    string
+	Count    int
+}
+
+// UnitStateCounts returns the number of known units of each work type in each state, sorted by
+// work type and state.  Unlike ListKnownUnitIDs, it does not scan the data directory, so it is
+// cheap enough to call often, such as when metrics are scraped.
+func (w *Workceptor) UnitStateCounts() []*UnitStateCount {
+	w.activeUnitsLock.RLock()
+	units := make([]WorkUnit, 0, len(w.activeUnits))
+	for _, unit := range w.activeUnits {
+		units = append(units, unit)
+	}
+	w.activeUnitsLock.RUnlock()
+	type countKey struct {
+		workType string
+		state    string
+	}
+	counts := make(map[countKey]int)
+	for _, unit := range units {
+		status := unit.Status()
+		counts[countKey{workType: status.WorkType, state: WorkStateToString(status.State)}]++
+	}
+	result := make([]*UnitStateCount, 0, len(counts))
+	for key, count := range counts {
+		result = append(result, &UnitStateCount{
+			WorkType: key.workType,
+			State:    key.state,
+			Count:    count,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].WorkType != result[j].WorkType {
+			return result[i].WorkType < result[j].WorkType
+		}
+		return result[i].State < result[j].State
+	})
+	return result
+}
@@ -0,0 +1,55 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"sync"
+	"testing"
+)
+
+func TestUnitStateCounts(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := make(chan struct{})
+	defer close(gate)
+	tracker := &concurrencyTracker{
+		lock:    &sync.Mutex{},
+		current: make(map[string]int),
+		max:     make(map[string]int),
+	}
+	err = w.RegisterWorker("gated", func() WorkUnit {
+		return &gatedUnit{
+			gate:    gate,
+			tracker: tracker,
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		unit, err := w.AllocateUnit("gated", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			err = w.StartUnit(unit.ID())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	counts := w.UnitStateCounts()
+	if len(counts) != 2 {
+		t.Fatalf("expected counts of 2 states, got %d", len(counts))
+	}
+	if counts[0].WorkType != "gated" || counts[0].State != "Pending" || counts[0].Count != 1 {
+		t.Errorf("unexpected pending count %+v", counts[0])
+	}
+	if counts[1].WorkType != "gated" || counts[1].State != "Running" || counts[1].Count != 2 {
+		t.Errorf("unexpected running count %+v", counts[1])
+	}
+}
@@ -0,0 +1,80 @@
+package workceptor
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeferUnit schedules a unit to start at a future time.  The start time is saved in the unit's
+// status, so the unit is scheduled again if the node restarts before then.  A start time that
+// is not in the future starts the unit immediately.  Deferred units return ErrPending.
+func (w *Workceptor) DeferUnit(unitID string, startAt time.Time) error {
+	unit, err := w.findUnit(unitID)
+	if err != nil {
+		return err
+	}
+	return w.deferUnit(unit, startAt)
+}
+
+// deferUnit saves the start time of a unit and arms its start timer
+func (w *Workceptor) deferUnit(unit WorkUnit, startAt time.Time) error {
+	if !startAt.After(time.Now()) {
+		return w.scheduleUnit(unit)
+	}
+	unit.UpdateFullStatus(func(status *StatusFileData) {
+		status.State = WorkStatePending
+		status.Detail = fmt.Sprintf("Scheduled to start at %s", startAt.Format(time.RFC3339))
+		status.StartAt = startAt
+	})
+	err := unit.LastUpdateError()
+	if err != nil {
+		return err
+	}
+	w.armDeferredStart(unit, startAt)
+	return ErrPending
+}
+
+// armDeferredStart starts a timer that hands the unit to the scheduler at its start time
+func (w *Workceptor) armDeferredStart(unit WorkUnit, startAt time.Time) {
+	sch := w.scheduler
+	sch.lock.Lock()
+	defer sch.lock.Unlock()
+	oldTimer, ok := sch.deferred[unit.ID()]
+	if ok {
+		oldTimer.Stop()
+	}
+	sch.deferred[unit.ID()] = time.AfterFunc(time.Until(startAt), func() {
+		if !w.undeferUnit(unit.ID()) || w.ctx.Err() != nil {
+			return
+		}
+		sublogger.Info("Starting deferred unit %s\n", unit.ID())
+		// Clear the start time, so a restart from here on is handled like any other pending unit
+		unit.UpdateFullStatus(func(status *StatusFileData) {
+			status.StartAt = time.Time{}
+		})
+		err := w.scheduleUnit(unit)
+		if err != nil && !IsPending(err) {
+			sublogger.Error("Error starting deferred unit %s: %s\n", unit.ID(), err)
+			unit.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Error starting worker: %s", err), 0)
+		}
+	})
+}
+
+// undeferUnit stops the start timer of a unit, returning true if the unit was deferred
+func (w *Workceptor) undeferUnit(unitID string) bool {
+	sch := w.scheduler
+	sch.lock.Lock()
+	defer sch.lock.Unlock()
+	timer, ok := sch.deferred[unitID]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(sch.deferred, unitID)
+	return true
+}
+
+// isDeferred returns true if a unit loaded from storage is waiting for its start time
+func isDeferred(status *StatusFileData) bool {
+	return status.State == WorkStatePending && !status.StartAt.IsZero()
+}
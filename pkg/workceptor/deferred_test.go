@@ -0,0 +1,162 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// startRecordingUnit is a work unit that reports the time it was started and then succeeds
+type startRecordingUnit struct {
+	BaseWorkUnit
+	started chan time.Time
+}
+
+func (su *startRecordingUnit) Start() error {
+	su.started <- time.Now()
+	su.UpdateBasicStatus(WorkStateSucceeded, "Done", 0)
+	return nil
+}
+
+func (su *startRecordingUnit) Restart() error {
+	return nil
+}
+
+func (su *startRecordingUnit) Cancel() error {
+	return nil
+}
+
+// newStartRecordingWorkceptor returns a Workceptor with a "recorder" work type whose units report
+// their start time on the given channel
+func newStartRecordingWorkceptor(ctx context.Context, t *testing.T, nc *netceptor.Netceptor, storage Storage,
+	started chan time.Time) *Workceptor {
+	w, err := NewWithStorage(ctx, nc, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("recorder", func() WorkUnit {
+		return &startRecordingUnit{started: started}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// waitForStart returns the time a unit started, failing the test if it takes too long
+func waitForStart(t *testing.T, started chan time.Time) time.Time {
+	select {
+	case startTime := <-started:
+		return startTime
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for deferred unit to start")
+	}
+	return time.Time{}
+}
+
+func TestDeferredStart(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	started := make(chan time.Time, 1)
+	w := newStartRecordingWorkceptor(context.Background(), t, nc, NewMemoryStorage(), started)
+
+	unit, err := w.AllocateUnit("recorder", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAt := time.Now().Add(500 * time.Millisecond)
+	err = w.DeferUnit(unit.ID(), startAt)
+	if !IsPending(err) {
+		t.Fatalf("deferring a unit returned %v", err)
+	}
+	status := unit.Status()
+	if status.State != WorkStatePending || !status.StartAt.Equal(startAt) {
+		t.Fatalf("unexpected status of deferred unit %v", status)
+	}
+	startTime := waitForStart(t, started)
+	if startTime.Before(startAt) || startTime.After(startAt.Add(2*time.Second)) {
+		t.Fatalf("unit scheduled for %s started at %s", startAt, startTime)
+	}
+
+	// A start time in the past starts the unit immediately
+	unit, err = w.AllocateUnit("recorder", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.DeferUnit(unit.ID(), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	default:
+		t.Fatal("unit with a past start time did not start immediately")
+	}
+
+	// A cancelled deferred unit never starts
+	unit, err = w.AllocateUnit("recorder", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.DeferUnit(unit.ID(), time.Now().Add(200*time.Millisecond))
+	if !IsPending(err) {
+		t.Fatalf("deferring a unit returned %v", err)
+	}
+	err = w.CancelUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+		t.Fatal("cancelled deferred unit was started")
+	case <-time.After(time.Second):
+	}
+	if unit.Status().State != WorkStateFailed {
+		t.Fatalf("cancelled deferred unit is in state %s", WorkStateToString(unit.Status().State))
+	}
+}
+
+func TestDeferredStartSurvivesRestart(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	started1 := make(chan time.Time, 1)
+	w1 := newStartRecordingWorkceptor(ctx1, t, nc, NewFileStorage(path.Join(tmpdir, "node1")), started1)
+	unit, err := w1.AllocateUnit("recorder", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAt := time.Now().Add(time.Second)
+	err = w1.DeferUnit(unit.ID(), startAt)
+	if !IsPending(err) {
+		t.Fatalf("deferring a unit returned %v", err)
+	}
+	// Shut down the first instance before the unit starts, and bring up a new one on the same storage
+	cancel1()
+	started2 := make(chan time.Time, 1)
+	w2 := newStartRecordingWorkceptor(context.Background(), t, nc, NewFileStorage(path.Join(tmpdir, "node1")), started2)
+	ids := w2.ListKnownUnitIDs()
+	if len(ids) != 1 || ids[0] != unit.ID() {
+		t.Fatalf("unexpected unit list %v", ids)
+	}
+
+	startTime := waitForStart(t, started2)
+	if startTime.Before(startAt) || startTime.After(startAt.Add(2*time.Second)) {
+		t.Fatalf("unit scheduled for %s started at %s after restart", startAt, startTime)
+	}
+	select {
+	case <-started1:
+		t.Fatal("deferred unit was started by the instance that was shut down")
+	default:
+	}
+}
@@ -0,0 +1,163 @@
+package workceptor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// checksummedStreams are the data streams whose checksums are recorded when a unit completes
+var checksummedStreams = []string{"stdin", "stdout", "stderr"}
+
+// checksumReader returns the hex SHA256 of everything read from r
+func checksumReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// streamChecksum returns the checksum of a unit's data stream.  If the stream does not exist, the
+// error satisfies os.IsNotExist.
+func (w *Workceptor) streamChecksum(unitID string, stream string) (string, error) {
+	reader, err := w.storage.OpenReader(unitID, stream, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	return checksumReader(reader)
+}
+
+// streamChecksums returns the checksums of whichever of a unit's checksummed streams exist
+func (w *Workceptor) streamChecksums(unitID string) (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, stream := range checksummedStreams {
+		sum, err := w.streamChecksum(unitID, stream)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sums[stream] = sum
+	}
+	return sums, nil
+}
+
+// recordChecksums saves the checksums of the unit's data streams in its status, so VerifyUnit can
+// detect later corruption.  It should be called once the streams are no longer being written.
+func (bwu *BaseWorkUnit) recordChecksums() {
+	sums, err := bwu.w.streamChecksums(bwu.unitID)
+	if err != nil {
+		sublogger.Error("Error computing checksums of unit %s: %s\n", bwu.unitID, err)
+		return
+	}
+	bwu.statusLock.Lock()
+	defer bwu.statusLock.Unlock()
+	err = bwu.w.storage.UpdateStatus(bwu.unitID, &bwu.status, func(status *StatusFileData) {
+		status.Checksums = sums
+	})
+	if err != nil {
+		sublogger.Error("Error recording checksums of unit %s: %s\n", bwu.unitID, err)
+	}
+}
+
+// recordFileChecksums is used by processes that write a unit's files directly, such as the
+// command runner, to save the checksums of the files in the unit directory
+func recordFileChecksums(status *StatusFileData, statusFilename string, unitdir string) {
+	sums := make(map[string]string)
+	for _, stream := range checksummedStreams {
+		file, err := os.Open(path.Join(unitdir, stream))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			sublogger.Error("Error opening %s for checksum: %s\n", stream, err)
+			return
+		}
+		sum, err := checksumReader(file)
+		_ = file.Close()
+		if err != nil {
+			sublogger.Error("Error computing checksum of %s: %s\n", stream, err)
+			return
+		}
+		sums[stream] = sum
+	}
+	err := status.UpdateFullStatus(statusFilename, func(status *StatusFileData) {
+		status.Checksums = sums
+	})
+	if err != nil {
+		sublogger.Error("Error updating status file %s: %s\n", statusFilename, err)
+	}
+}
+
+// VerifyUnit checks that a unit's persisted data is intact: that its metadata can be read, that
+// its data streams exist and are as long as its status says, and that their contents match any
+// recorded checksums.  It returns a description of each problem found, which is empty if the
+// unit is OK.
+func (w *Workceptor) VerifyUnit(unitID string) ([]string, error) {
+	units, err := w.storage.ListUnits()
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, u := range units {
+		if u == unitID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown work unit %s", unitID)
+	}
+	problems := make([]string, 0)
+	status := &StatusFileData{}
+	err = w.storage.GetStatus(unitID, status)
+	if err != nil {
+		return append(problems, fmt.Sprintf("metadata could not be read: %s", err)), nil
+	}
+	if status.State != WorkStatePending {
+		_, err = w.storage.StreamSize(unitID, "stdin")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("stdin could not be read: %s", err))
+		}
+	}
+	if status.StdoutSize > 0 {
+		size, err := w.storage.StreamSize(unitID, "stdout")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("stdout could not be read: %s", err))
+		} else if size < status.StdoutSize {
+			problems = append(problems, fmt.Sprintf("stdout is %d bytes but should be at least %d", size, status.StdoutSize))
+		}
+	}
+	streams := make([]string, 0, len(status.Checksums))
+	for stream := range status.Checksums {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	for _, stream := range streams {
+		sum, err := w.streamChecksum(unitID, stream)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s could not be read: %s", stream, err))
+		} else if sum != status.Checksums[stream] {
+			problems = append(problems, fmt.Sprintf("checksum of %s does not match", stream))
+		}
+	}
+	return problems, nil
+}
+
+// SetVerifyOnStartup controls whether units found in storage are checked with VerifyUnit before
+// they are restarted.  Incomplete units that fail the check are marked as failed.
+func (w *Workceptor) SetVerifyOnStartup(verify bool) {
+	w.activeUnitsLock.Lock()
+	w.verifyOnStartup = verify
+	w.activeUnitsLock.Unlock()
+}
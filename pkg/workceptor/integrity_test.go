@@ -0,0 +1,137 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// outputUnit is a work unit that writes a fixed output and succeeds
+type outputUnit struct {
+	BaseWorkUnit
+}
+
+func (ou *outputUnit) Start() error {
+	stdout, err := ou.w.storage.OpenWriter(ou.ID(), "stdout", false)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write([]byte("hello\n"))
+	_ = stdout.Close()
+	if err != nil {
+		return err
+	}
+	ou.UpdateBasicStatus(WorkStateSucceeded, "Done", 6)
+	return nil
+}
+
+func (ou *outputUnit) Restart() error {
+	return nil
+}
+
+func (ou *outputUnit) Cancel() error {
+	return nil
+}
+
+func TestVerifyUnit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpdir)
+	}()
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewFileStorage(tmpdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("output", func() WorkUnit {
+		return &outputUnit{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := w.AllocateUnit("output", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := w.storage.OpenWriter(unit.ID(), "stdin", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stdin.Close()
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unit.Status().Checksums) != 2 {
+		t.Fatalf("expected checksums of stdin and stdout, got %v", unit.Status().Checksums)
+	}
+
+	problems, err := w.VerifyUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("intact unit failed verification: %v", problems)
+	}
+
+	// Corrupt the output without changing its length
+	err = ioutil.WriteFile(path.Join(tmpdir, unit.ID(), "stdout"), []byte("jello\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err = w.VerifyUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0] != "checksum of stdout does not match" {
+		t.Fatalf("corrupted output was not detected: %v", problems)
+	}
+
+	err = ioutil.WriteFile(path.Join(tmpdir, unit.ID(), "status"), []byte("{\"State\": 2, \"Det"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err = w.VerifyUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "metadata could not be read") {
+		t.Fatalf("corrupted metadata was not detected: %v", problems)
+	}
+
+	_, err = w.VerifyUnit("nonexistent")
+	if err == nil {
+		t.Fatal("an unknown unit was verified")
+	}
+
+	// Checksums are only computed when a unit completes, not each time its status is read
+	unit, err = w.AllocateUnit("output", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unit.Status().Checksums) != 1 {
+		t.Fatalf("expected the checksum of stdout, got %v", unit.Status().Checksums)
+	}
+	unit.UpdateFullStatus(func(status *StatusFileData) {
+		status.Checksums = nil
+	})
+	err = unit.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unit.Status().Checksums != nil {
+		t.Fatalf("checksums of a completed unit were computed again: %v", unit.Status().Checksums)
+	}
+}
@@ -0,0 +1,442 @@
+package workceptor
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/shlex"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"io"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watch2 "k8s.io/client-go/tools/watch"
+	"strings"
+)
+
+// kubeJobUnit implements the WorkUnit interface, running each unit as a Kubernetes Job
+type kubeJobUnit struct {
+	BaseWorkUnit
+	ctx            context.Context
+	cancel         context.CancelFunc
+	kubeConfig     string
+	namespace      string
+	namePrefix     string
+	image          string
+	serviceAccount string
+	entrypoint     []string
+	command        []string
+	args           []string
+	clientset      kubernetes.Interface
+}
+
+// kubeJobExtraData is the content of the ExtraData JSON field for a Kubernetes Job worker
+type kubeJobExtraData struct {
+	JobName   string
+	Namespace string
+}
+
+// jobUnitLabel is the label identifying the work unit that created a job
+const jobUnitLabel = "receptor-unit"
+
+// jobPodStarted is a completion criterion for the pod of a job having started running
+func jobPodStarted(event watch.Event) (bool, error) {
+	switch event.Type {
+	case watch.Deleted:
+		return false, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, "")
+	}
+	pod, ok := event.Object.(*corev1.Pod)
+	if !ok {
+		return false, nil
+	}
+	switch pod.Status.Phase {
+	case corev1.PodRunning, corev1.PodSucceeded, corev1.PodFailed:
+		return true, nil
+	}
+	return false, nil
+}
+
+// jobFinished is a completion criterion for a job having succeeded or failed
+func jobFinished(event watch.Event) (bool, error) {
+	switch event.Type {
+	case watch.Deleted:
+		return false, errors.NewNotFound(schema.GroupResource{Group: "batch", Resource: "jobs"}, "")
+	}
+	job, ok := event.Object.(*batchv1.Job)
+	if !ok {
+		return false, nil
+	}
+	_, _, finished := jobResult(job)
+	return finished, nil
+}
+
+// jobResult returns the work state and detail that a job's conditions map to, and whether the
+// job has finished
+func jobResult(job *batchv1.Job) (int, string, bool) {
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch cond.Type {
+		case batchv1.JobComplete:
+			return WorkStateSucceeded, "Finished", true
+		case batchv1.JobFailed:
+			if cond.Message == "" {
+				return WorkStateFailed, "Job failed", true
+			}
+			return WorkStateFailed, fmt.Sprintf("Job failed: %s", cond.Message), true
+		}
+	}
+	return WorkStatePending, "", false
+}
+
+// podFailureDetail describes why the worker container of a pod failed, or returns an empty string
+// if it has not terminated
+func podFailureDetail(pod *corev1.Pod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		term := cs.State.Terminated
+		if cs.Name != "worker" || term == nil {
+			continue
+		}
+		if term.Reason == "" {
+			return fmt.Sprintf("Pod failed: exit code %d", term.ExitCode)
+		}
+		return fmt.Sprintf("Pod failed: exit code %d (%s)", term.ExitCode, term.Reason)
+	}
+	return ""
+}
+
+// newJob returns the job to create for this unit
+func (kj *kubeJobUnit) newJob() *batchv1.Job {
+	// Failed units are retried by their retry policy, not by Kubernetes
+	backoffLimit := int32(0)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: kj.namePrefix,
+			Namespace:    kj.namespace,
+			Labels:       map[string]string{jobUnitLabel: kj.unitID},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{jobUnitLabel: kj.unitID},
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: kj.serviceAccount,
+					Containers: []corev1.Container{{
+						Name:    "worker",
+						Image:   kj.image,
+						Command: kj.command,
+						Args:    kj.args,
+					}},
+					RestartPolicy: corev1.RestartPolicyNever,
+				},
+			},
+		},
+	}
+}
+
+// fail marks the unit as failed, or as cancelled if it failed because it was cancelled
+func (kj *kubeJobUnit) fail(detail string, stdoutSize int64) {
+	if kj.ctx.Err() != nil {
+		kj.UpdateBasicStatus(WorkStateFailed, "Cancelled", stdoutSize)
+		return
+	}
+	sublogger.Error(detail)
+	kj.UpdateBasicStatus(WorkStateFailed, detail, stdoutSize)
+}
+
+func (kj *kubeJobUnit) runWork() {
+	// Create the job
+	job, err := kj.clientset.BatchV1().Jobs(kj.namespace).Create(kj.ctx, kj.newJob(), metav1.CreateOptions{})
+	if err != nil {
+		kj.fail(fmt.Sprintf("Error creating job: %s", err), 0)
+		return
+	}
+	kj.UpdateFullStatus(func(status *StatusFileData) {
+		status.State = WorkStatePending
+		status.Detail = "Job created"
+		status.StdoutSize = 0
+		status.ExtraData = &kubeJobExtraData{
+			JobName:   job.Name,
+			Namespace: job.Namespace,
+		}
+	})
+	select {
+	case <-kj.ctx.Done():
+		// The job may have been created after Cancel looked for it
+		err = kj.deleteJob()
+		if err != nil {
+			sublogger.Error("Error deleting job %s: %s", job.Name, err)
+		}
+		kj.UpdateBasicStatus(WorkStateFailed, "Cancelled", 0)
+		return
+	default:
+	}
+
+	// Wait for the job's pod to be running
+	podSelector := labels.Set{"job-name": job.Name}.String()
+	plw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = podSelector
+			return kj.clientset.CoreV1().Pods(kj.namespace).List(kj.ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = podSelector
+			return kj.clientset.CoreV1().Pods(kj.namespace).Watch(kj.ctx, options)
+		},
+	}
+	ev, err := watch2.UntilWithSync(kj.ctx, plw, &corev1.Pod{}, nil, jobPodStarted)
+	if err != nil {
+		kj.fail(fmt.Sprintf("Error waiting for job pod to be running: %s", err), 0)
+		return
+	}
+	if ev == nil {
+		kj.fail("Pod disappeared during watch", 0)
+		return
+	}
+	pod := ev.Object.(*corev1.Pod)
+	kj.UpdateBasicStatus(WorkStateRunning, "Pod running", 0)
+
+	// Copy the pod log to stdout.  This blocks until the pod finishes.
+	stdout, err := newStdoutWriter(kj.UnitDir())
+	if err != nil {
+		kj.fail(fmt.Sprintf("Error opening stdout file: %s", err), 0)
+		return
+	}
+	logStream, err := kj.clientset.CoreV1().Pods(kj.namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: "worker",
+		Follow:    true,
+	}).Stream(kj.ctx)
+	if err != nil {
+		kj.fail(fmt.Sprintf("Error opening pod log: %s", err), 0)
+		return
+	}
+	_, err = io.Copy(stdout, logStream)
+	_ = logStream.Close()
+	if err != nil {
+		kj.fail(fmt.Sprintf("Error streaming pod log: %s", err), stdout.Size())
+		return
+	}
+
+	// Wait for the job to record the outcome of its pod
+	jobSelector := fields.OneTermEqualSelector("metadata.name", job.Name).String()
+	jlw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = jobSelector
+			return kj.clientset.BatchV1().Jobs(kj.namespace).List(kj.ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = jobSelector
+			return kj.clientset.BatchV1().Jobs(kj.namespace).Watch(kj.ctx, options)
+		},
+	}
+	ev, err = watch2.UntilWithSync(kj.ctx, jlw, &batchv1.Job{}, nil, jobFinished)
+	if err != nil {
+		kj.fail(fmt.Sprintf("Error waiting for job to finish: %s", err), stdout.Size())
+		return
+	}
+	if ev == nil {
+		kj.fail("Job disappeared during watch", stdout.Size())
+		return
+	}
+	state, detail, _ := jobResult(ev.Object.(*batchv1.Job))
+	if state == WorkStateFailed {
+		pod, err = kj.clientset.CoreV1().Pods(kj.namespace).Get(kj.ctx, pod.Name, metav1.GetOptions{})
+		if err == nil && podFailureDetail(pod) != "" {
+			detail = podFailureDetail(pod)
+		}
+	}
+	kj.UpdateBasicStatus(state, detail, stdout.Size())
+}
+
+// connect connects to the Kubernetes API, if not already connected
+func (kj *kubeJobUnit) connect() error {
+	if kj.clientset != nil {
+		return nil
+	}
+	_, clientset, namespace, err := kubeConnect(kj.kubeConfig, kj.namespace)
+	if err != nil {
+		return err
+	}
+	kj.clientset = clientset
+	kj.namespace = namespace
+	return nil
+}
+
+// deleteJob deletes the job created for this unit, along with its pod, if there is one
+func (kj *kubeJobUnit) deleteJob() error {
+	ed, ok := kj.Status().ExtraData.(*kubeJobExtraData)
+	if !ok || ed.JobName == "" {
+		return nil
+	}
+	err := kj.connect()
+	if err != nil {
+		return err
+	}
+	propagation := metav1.DeletePropagationBackground
+	err = kj.clientset.BatchV1().Jobs(ed.Namespace).Delete(context.Background(), ed.JobName, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Init initializes the work unit
+func (kj *kubeJobUnit) Init(w *Workceptor, ident string, workType string, params string) {
+	kj.BaseWorkUnit.Init(w, ident, workType, params)
+	kj.status.ExtraData = &kubeJobExtraData{}
+}
+
+// Status returns a copy of the status currently loaded in memory
+func (kj *kubeJobUnit) Status() *StatusFileData {
+	kj.statusLock.RLock()
+	defer kj.statusLock.RUnlock()
+	status := kj.getStatus()
+	ed, ok := kj.status.ExtraData.(*kubeJobExtraData)
+	if ok {
+		edCopy := *ed
+		status.ExtraData = &edCopy
+	}
+	return status
+}
+
+// Start launches a job with given parameters.
+func (kj *kubeJobUnit) Start() error {
+	err := kj.requireUnitDir()
+	if err != nil {
+		return err
+	}
+	kj.UpdateBasicStatus(WorkStatePending, "Connecting to Kubernetes", 0)
+	kj.ctx, kj.cancel = context.WithCancel(kj.w.ctx)
+
+	// Figure out command and args
+	args, err := shlex.Split(kj.Status().Params)
+	if err != nil {
+		return err
+	}
+	kj.command = nil
+	if len(kj.entrypoint) > 0 {
+		kj.command = append(append([]string{}, kj.entrypoint...), args...)
+		args = nil
+	}
+	kj.args = args
+
+	// Connect to the Kubernetes API
+	err = kj.connect()
+	if err != nil {
+		return err
+	}
+
+	// Launch runner process
+	go kj.runWork()
+
+	return nil
+}
+
+// Restart resumes monitoring a job after a Receptor restart
+func (kj *kubeJobUnit) Restart() error {
+	err := kj.Load()
+	if err != nil {
+		return err
+	}
+	if IsComplete(kj.Status().State) {
+		return nil
+	}
+	// Nothing is collecting the output of a job that was running, so stop it
+	err = kj.deleteJob()
+	if err != nil {
+		sublogger.Error("Error deleting job of work unit %s: %s", kj.unitID, err)
+	}
+	return fmt.Errorf("restart of Kubernetes job not implemented")
+}
+
+// Cancel releases resources associated with a job, including cancelling it if running.
+func (kj *kubeJobUnit) Cancel() error {
+	if kj.cancel != nil {
+		kj.cancel()
+	}
+	err := kj.deleteJob()
+	if err != nil {
+		return fmt.Errorf("error deleting job: %s", err)
+	}
+	return nil
+}
+
+// Release releases resources associated with a job.  Implies Cancel.
+func (kj *kubeJobUnit) Release(force bool) error {
+	err := kj.Cancel()
+	if err != nil && !force {
+		return err
+	}
+	return kj.BaseWorkUnit.Release(force)
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// WorkKubeJobCfg is the cmdline configuration object for a worker plugin that runs Kubernetes Jobs
+type WorkKubeJobCfg struct {
+	WorkType       string `required:"true" description:"Name for this worker type"`
+	KubeConfig     string `description:"Kubeconfig file (default: in-cluster or environment)"`
+	Namespace      string `required:"true" description:"Kubernetes namespace to create jobs in"`
+	Image          string `required:"true" description:"Container image to use for the job's pod"`
+	ServiceAccount string `description:"Service account to run the job's pod as (default: the namespace default)"`
+	Command        string `description:"Command to run in the container (default: entrypoint)"`
+	MaxConcurrent  int    `description:"Maximum number of units of this type to run at once (0 for no limit)" default:"0"`
+}
+
+// newWorker is a factory to produce worker instances
+func (cfg WorkKubeJobCfg) newWorker() WorkUnit {
+	return &kubeJobUnit{
+		namePrefix:     fmt.Sprintf("%s-", strings.ToLower(cfg.WorkType)),
+		kubeConfig:     cfg.KubeConfig,
+		namespace:      cfg.Namespace,
+		image:          cfg.Image,
+		serviceAccount: cfg.ServiceAccount,
+		entrypoint:     cfg.splitCommand(),
+	}
+}
+
+// splitCommand returns the configured command split into words, or nil to use the entrypoint
+func (cfg WorkKubeJobCfg) splitCommand() []string {
+	command, err := shlex.Split(cfg.Command)
+	if err != nil || len(command) == 0 {
+		return nil
+	}
+	return command
+}
+
+// Prepare verifies the parameters are correct
+func (cfg WorkKubeJobCfg) Prepare() error {
+	_, err := shlex.Split(cfg.Command)
+	if err != nil {
+		return fmt.Errorf("invalid command: %s", err)
+	}
+	return nil
+}
+
+// Run runs the action
+func (cfg WorkKubeJobCfg) Run() error {
+	err := MainInstance.RegisterWorker(cfg.WorkType, cfg.newWorker)
+	if err != nil {
+		return err
+	}
+	return MainInstance.SetWorkTypeLimit(cfg.WorkType, cfg.MaxConcurrent)
+}
+
+func init() {
+	cmdline.AddConfigType("work-kubernetes-job", "Run a worker as Kubernetes Jobs", WorkKubeJobCfg{},
+		false, false, false, false, workersSection)
+}
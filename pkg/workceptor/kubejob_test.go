@@ -0,0 +1,111 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestKubeJobSpec(t *testing.T) {
+	cfg := WorkKubeJobCfg{
+		WorkType:       "Echo",
+		Namespace:      "receptor",
+		Image:          "busybox",
+		ServiceAccount: "runner",
+		Command:        "sh -c",
+	}
+	kj := cfg.newWorker().(*kubeJobUnit)
+	kj.unitID = "abc123"
+	kj.command = append(kj.entrypoint, "echo hello")
+	job := kj.newJob()
+	if job.GenerateName != "echo-" || job.Namespace != "receptor" || job.Labels[jobUnitLabel] != "abc123" {
+		t.Fatalf("unexpected job metadata %+v", job.ObjectMeta)
+	}
+	if job.Spec.BackoffLimit == nil || *job.Spec.BackoffLimit != 0 {
+		t.Fatal("job pods should not be retried by Kubernetes")
+	}
+	pod := job.Spec.Template.Spec
+	if pod.ServiceAccountName != "runner" || pod.RestartPolicy != corev1.RestartPolicyNever {
+		t.Fatalf("unexpected pod spec %+v", pod)
+	}
+	command := pod.Containers[0].Command
+	if pod.Containers[0].Image != "busybox" || len(command) != 3 || command[0] != "sh" || command[2] != "echo hello" {
+		t.Fatalf("unexpected container %+v", pod.Containers[0])
+	}
+}
+
+func TestKubeJobResult(t *testing.T) {
+	job := &batchv1.Job{}
+	_, _, finished := jobResult(job)
+	if finished {
+		t.Fatal("job without conditions reported as finished")
+	}
+	job.Status.Conditions = []batchv1.JobCondition{{
+		Type:   batchv1.JobComplete,
+		Status: corev1.ConditionFalse,
+	}}
+	_, _, finished = jobResult(job)
+	if finished {
+		t.Fatal("job with a false condition reported as finished")
+	}
+	job.Status.Conditions[0].Status = corev1.ConditionTrue
+	state, _, finished := jobResult(job)
+	if !finished || state != WorkStateSucceeded {
+		t.Fatal("complete job did not succeed")
+	}
+	job.Status.Conditions[0] = batchv1.JobCondition{
+		Type:    batchv1.JobFailed,
+		Status:  corev1.ConditionTrue,
+		Message: "Job has reached the specified backoff limit",
+	}
+	state, detail, finished := jobResult(job)
+	if !finished || state != WorkStateFailed || detail != "Job failed: Job has reached the specified backoff limit" {
+		t.Fatalf("unexpected result %d %q for failed job", state, detail)
+	}
+
+	pod := &corev1.Pod{}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name: "worker",
+		State: corev1.ContainerState{
+			Terminated: &corev1.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"},
+		},
+	}}
+	if podFailureDetail(pod) != "Pod failed: exit code 137 (OOMKilled)" {
+		t.Fatalf("unexpected pod failure detail %q", podFailureDetail(pod))
+	}
+}
+
+func TestKubeJobCancelDeletesJob(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "echo-xyz", Namespace: "receptor"},
+	})
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kj := &kubeJobUnit{namespace: "receptor", clientset: clientset}
+	kj.Init(w, "abc123", "echo", "")
+	kj.status.ExtraData = &kubeJobExtraData{JobName: "echo-xyz", Namespace: "receptor"}
+	err = kj.Cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := clientset.BatchV1().Jobs("receptor").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Fatalf("job was not deleted: %v", jobs.Items)
+	}
+	// Cancelling again is not an error, although the job is gone
+	err = kj.Cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
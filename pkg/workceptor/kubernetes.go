@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/google/shlex"
 	"github.com/project-receptor/receptor/pkg/cmdline"
-	"github.com/project-receptor/receptor/pkg/logger"
 	"io"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -100,7 +99,7 @@ func (kw *kubeUnit) runWork() {
 	}, metav1.CreateOptions{})
 	if err != nil {
 		errStr := fmt.Sprintf("Error creating pod: %s", err)
-		logger.Error(errStr)
+		sublogger.Error(errStr)
 		kw.UpdateBasicStatus(WorkStateFailed, errStr, 0)
 		return
 	}
@@ -135,13 +134,13 @@ func (kw *kubeUnit) runWork() {
 		skipStdin = true
 	} else if err != nil {
 		errStr := fmt.Sprintf("Error waiting for pod to be running: %s", err)
-		logger.Error(errStr)
+		sublogger.Error(errStr)
 		kw.UpdateBasicStatus(WorkStateFailed, errStr, 0)
 		return
 	}
 	if ev == nil {
 		errStr := "Pod disappeared during watch"
-		logger.Error(errStr)
+		sublogger.Error(errStr)
 		kw.UpdateBasicStatus(WorkStateFailed, errStr, 0)
 		return
 	}
@@ -194,7 +193,7 @@ func (kw *kubeUnit) runWork() {
 		stdin, err = newStdinReader(kw.UnitDir())
 		if err != nil {
 			errStr := fmt.Sprintf("Error opening stdin file: %s", err)
-			logger.Error(errStr)
+			sublogger.Error(errStr)
 			kw.UpdateBasicStatus(WorkStateFailed, errStr, 0)
 			return
 		}
@@ -204,7 +203,7 @@ func (kw *kubeUnit) runWork() {
 	stdout, err := newStdoutWriter(kw.UnitDir())
 	if err != nil {
 		errStr := fmt.Sprintf("Error opening stdout file: %s", err)
-		logger.Error(errStr)
+		sublogger.Error(errStr)
 		kw.UpdateBasicStatus(WorkStateFailed, errStr, 0)
 		return
 	}
@@ -268,37 +267,46 @@ func (kw *kubeUnit) runWork() {
 
 func (kw *kubeUnit) connectToKube() error {
 	var err error
-	kw.config = nil
-	if kw.kubeConfig == "" {
+	kw.config, kw.clientset, kw.namespace, err = kubeConnect(kw.kubeConfig, kw.namespace)
+	return err
+}
+
+// kubeConnect connects to the Kubernetes API, using the in-cluster configuration if no kubeconfig
+// file is given and that is available.  If no namespace is given, the namespace of the current
+// kubeconfig context is returned.
+func kubeConnect(kubeConfig string, namespace string) (*rest.Config, *kubernetes.Clientset, string, error) {
+	var config *rest.Config
+	var err error
+	if kubeConfig == "" {
 		// Use in-cluster config/auth, if possible
-		config, err := rest.InClusterConfig()
-		if err == nil {
-			kw.config = config
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			config = nil
 		}
 	}
-	if kw.config == nil {
+	if config == nil {
 		// Set up Kubernetes API connection
 		clr := clientcmd.NewDefaultClientConfigLoadingRules()
-		if kw.kubeConfig != "" {
-			clr.ExplicitPath = kw.kubeConfig
+		if kubeConfig != "" {
+			clr.ExplicitPath = kubeConfig
 		}
-		if kw.namespace == "" {
+		if namespace == "" {
 			c, err := clr.Load()
 			if err != nil {
-				return err
+				return nil, nil, "", err
 			}
-			kw.namespace = c.Contexts[c.CurrentContext].Namespace
+			namespace = c.Contexts[c.CurrentContext].Namespace
 		}
-		kw.config, err = clientcmd.BuildConfigFromFlags("", clr.GetDefaultFilename())
+		config, err = clientcmd.BuildConfigFromFlags("", clr.GetDefaultFilename())
 		if err != nil {
-			return err
+			return nil, nil, "", err
 		}
 	}
-	kw.clientset, err = kubernetes.NewForConfig(kw.config)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return err
+		return nil, nil, "", err
 	}
-	return nil
+	return config, clientset, namespace, nil
 }
 
 // Init initializes the work unit
@@ -322,6 +330,10 @@ func (kw *kubeUnit) Status() *StatusFileData {
 
 // Start launches a job with given parameters.
 func (kw *kubeUnit) Start() error {
+	err := kw.requireUnitDir()
+	if err != nil {
+		return err
+	}
 	kw.UpdateBasicStatus(WorkStatePending, "Connecting to Kubernetes", 0)
 	kw.ctx, kw.cancel = context.WithCancel(kw.w.ctx)
 
@@ -365,7 +377,7 @@ func (kw *kubeUnit) Cancel() error {
 		go func(pod string) {
 			err := kw.clientset.CoreV1().Pods(kw.namespace).Delete(context.Background(), pod, metav1.DeleteOptions{})
 			if err != nil {
-				logger.Error("Error deleting pod %s: %s", pod, err)
+				sublogger.Error("Error deleting pod %s: %s", pod, err)
 			}
 		}(kw.pod.Name)
 	}
@@ -390,11 +402,12 @@ func (kw *kubeUnit) Release(force bool) error {
 
 // WorkKubeCfg is the cmdline configuration object for a Kubernetes worker plugin
 type WorkKubeCfg struct {
-	WorkType   string `required:"true" description:"Name for this worker type"`
-	KubeConfig string `description:"Kubeconfig file (default: in-cluster or environment)"`
-	Namespace  string `required:"true" description:"Kubernetes namespace to create pods in"`
-	Image      string `required:"true" description:"Container image to use for the worker pod"`
-	Command    string `description:"Command to run in the container (default: entrypoint)"`
+	WorkType      string `required:"true" description:"Name for this worker type"`
+	KubeConfig    string `description:"Kubeconfig file (default: in-cluster or environment)"`
+	Namespace     string `required:"true" description:"Kubernetes namespace to create pods in"`
+	Image         string `required:"true" description:"Container image to use for the worker pod"`
+	Command       string `description:"Command to run in the container (default: entrypoint)"`
+	MaxConcurrent int    `description:"Maximum number of units of this type to run at once (0 for no limit)" default:"0"`
 }
 
 // newWorker is a factory to produce worker instances
@@ -415,7 +428,10 @@ func (cfg WorkKubeCfg) newWorker() WorkUnit {
 // Run runs the action
 func (cfg WorkKubeCfg) Run() error {
 	err := MainInstance.RegisterWorker(cfg.WorkType, cfg.newWorker)
-	return err
+	if err != nil {
+		return err
+	}
+	return MainInstance.SetWorkTypeLimit(cfg.WorkType, cfg.MaxConcurrent)
 }
 
 func init() {
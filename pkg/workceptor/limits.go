@@ -0,0 +1,109 @@
+package workceptor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ResourceLimits caps the resources a local command work unit may use
+type ResourceLimits struct {
+	MemoryBytes int64   // Maximum memory use in bytes, 0 for no limit
+	CPUs        float64 // Maximum CPU use as a number of CPUs, such as 0.5, 0 for no limit
+}
+
+// IsZero returns true if no limits are set
+func (rl ResourceLimits) IsZero() bool {
+	return rl.MemoryBytes == 0 && rl.CPUs == 0
+}
+
+// Validate checks that the limits are usable
+func (rl ResourceLimits) Validate() error {
+	if rl.MemoryBytes < 0 {
+		return fmt.Errorf("memory limit must not be negative")
+	}
+	if rl.CPUs < 0 {
+		return fmt.Errorf("CPU limit must not be negative")
+	}
+	return nil
+}
+
+// ParseMemoryLimit parses a memory size given in bytes, or with a K, M, G or T suffix (powers of 1024)
+func ParseMemoryLimit(limit string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(limit))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory limit %s", limit)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("memory limit must not be negative")
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// SetUnitResourceLimits sets the memory and CPU limits of a local command unit.  The limits are
+// enforced using cgroups on Linux, and ignored with a warning elsewhere.  They must be set before
+// the unit starts.
+func (w *Workceptor) SetUnitResourceLimits(unitID string, limits ResourceLimits) error {
+	unit, err := w.findUnit(unitID)
+	if err != nil {
+		return err
+	}
+	return setUnitResourceLimits(unit, limits)
+}
+
+// setUnitResourceLimits saves the resource limits of a unit in its status
+func setUnitResourceLimits(unit WorkUnit, limits ResourceLimits) error {
+	err := limits.Validate()
+	if err != nil {
+		return err
+	}
+	_, ok := unit.(*remoteUnit)
+	if ok {
+		return fmt.Errorf("resource limits can only be set on local work units")
+	}
+	_, ok = unit.(*commandUnit)
+	if !ok {
+		return fmt.Errorf("work type %s does not support resource limits", unit.Status().WorkType)
+	}
+	unit.UpdateFullStatus(func(status *StatusFileData) {
+		if status.ExtraData == nil {
+			status.ExtraData = &commandExtraData{}
+		}
+		status.ExtraData.(*commandExtraData).Limits = limits
+	})
+	return unit.LastUpdateError()
+}
+
+// resourceLimitArgs returns the command runner arguments that apply the resource limits of a unit
+func (cw *commandUnit) resourceLimitArgs() []string {
+	ced, ok := cw.Status().ExtraData.(*commandExtraData)
+	if !ok || ced.Limits.IsZero() {
+		return nil
+	}
+	if !resourceLimitsSupported {
+		sublogger.Warning("Resource limits are not supported on this platform. Ignoring limits of work unit %s.\n", cw.ID())
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("memorylimit=%d", ced.Limits.MemoryBytes),
+		fmt.Sprintf("cpulimit=%g", ced.Limits.CPUs),
+	}
+}
@@ -0,0 +1,132 @@
+//+build linux
+
+package workceptor
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// resourceLimitsSupported is true on platforms where the command runner can enforce resource limits
+const resourceLimitsSupported = true
+
+// cgroupRoot is where the unified (v2) cgroup hierarchy is expected to be mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupParent is the cgroup, under the root, that holds the cgroups of limited work units
+const cgroupParent = "receptor"
+
+// cpuPeriod is the period, in microseconds, over which CPU limits are enforced
+const cpuPeriod = 100000
+
+// unitCgroup is a cgroup that the command runner places itself in, so the command it runs is
+// limited along with any processes the command starts
+type unitCgroup struct {
+	dir       string
+	origProcs string
+	limits    ResourceLimits
+}
+
+// writeCgroupFile writes a value to a cgroup control file
+func writeCgroupFile(dir string, name string, value string) error {
+	return ioutil.WriteFile(path.Join(dir, name), []byte(value), 0600)
+}
+
+// newUnitCgroup creates a cgroup for a work unit and applies the limits to it
+func newUnitCgroup(name string, limits ResourceLimits) (*unitCgroup, error) {
+	_, err := os.Stat(path.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("resource limits require cgroup v2 mounted at %s", cgroupRoot)
+	}
+	parent := path.Join(cgroupRoot, cgroupParent)
+	err = os.MkdirAll(parent, 0755)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		err = writeCgroupFile(dir, "cgroup.subtree_control", "+memory +cpu")
+		if err != nil {
+			return nil, fmt.Errorf("could not enable cgroup controllers in %s: %s", dir, err)
+		}
+	}
+	cg := &unitCgroup{
+		dir:    path.Join(parent, name),
+		limits: limits,
+	}
+	err = os.Mkdir(cg.dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if limits.MemoryBytes > 0 {
+		err = writeCgroupFile(cg.dir, "memory.max", strconv.FormatInt(limits.MemoryBytes, 10))
+		if err != nil {
+			_ = cg.remove()
+			return nil, err
+		}
+		// Without this, memory over the limit would be swapped out instead of killing the unit
+		err = writeCgroupFile(cg.dir, "memory.swap.max", "0")
+		if err != nil && !os.IsNotExist(err) {
+			_ = cg.remove()
+			return nil, err
+		}
+	}
+	if limits.CPUs > 0 {
+		err = writeCgroupFile(cg.dir, "cpu.max", fmt.Sprintf("%d %d", int64(limits.CPUs*cpuPeriod), cpuPeriod))
+		if err != nil {
+			_ = cg.remove()
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+// join moves the current process into the cgroup.  Processes started afterwards are created in it.
+func (cg *unitCgroup) join() error {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			cg.origProcs = path.Join(cgroupRoot, strings.TrimPrefix(line, "0::"), "cgroup.procs")
+			break
+		}
+	}
+	return writeCgroupFile(cg.dir, "cgroup.procs", strconv.Itoa(os.Getpid()))
+}
+
+// oomKilled returns true if the kernel killed a process in the cgroup for exceeding its memory limit
+func (cg *unitCgroup) oomKilled() bool {
+	file, err := os.Open(path.Join(cg.dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, err := strconv.Atoi(fields[1])
+			return err == nil && count > 0
+		}
+	}
+	return false
+}
+
+// remove moves the current process back to its original cgroup and removes the unit's cgroup
+func (cg *unitCgroup) remove() error {
+	if cg.origProcs != "" {
+		err := ioutil.WriteFile(cg.origProcs, []byte(strconv.Itoa(os.Getpid())), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(cg.dir)
+}
@@ -0,0 +1,32 @@
+//+build !linux
+
+package workceptor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// resourceLimitsSupported is true on platforms where the command runner can enforce resource limits
+const resourceLimitsSupported = false
+
+// unitCgroup is a placeholder, since cgroups only exist on Linux
+type unitCgroup struct {
+	limits ResourceLimits
+}
+
+func newUnitCgroup(name string, limits ResourceLimits) (*unitCgroup, error) {
+	return nil, fmt.Errorf("resource limits are not supported on %s", runtime.GOOS)
+}
+
+func (cg *unitCgroup) join() error {
+	return nil
+}
+
+func (cg *unitCgroup) oomKilled() bool {
+	return false
+}
+
+func (cg *unitCgroup) remove() error {
+	return nil
+}
@@ -0,0 +1,116 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"testing"
+)
+
+func TestParseMemoryLimit(t *testing.T) {
+	tests := map[string]int64{
+		"1000":   1000,
+		"512K":   512 << 10,
+		"512M":   512 << 20,
+		"1.5g":   3 << 29,
+		"2GiB":   2 << 30,
+		"1T":     1 << 40,
+		" 64MB ": 64 << 20,
+	}
+	for limit, expected := range tests {
+		value, err := ParseMemoryLimit(limit)
+		if err != nil {
+			t.Fatalf("error parsing %q: %s", limit, err)
+		}
+		if value != expected {
+			t.Fatalf("parsed %q as %d, expected %d", limit, value, expected)
+		}
+	}
+	for _, limit := range []string{"", "M", "lots", "-5M"} {
+		_, err := ParseMemoryLimit(limit)
+		if err == nil {
+			t.Fatalf("accepted invalid memory limit %q", limit)
+		}
+	}
+}
+
+func TestLimitsFromMap(t *testing.T) {
+	limits, err := limitsFromMap(map[string]interface{}{})
+	if err != nil || !limits.IsZero() {
+		t.Fatalf("unexpected limits %+v from empty submission, error %v", limits, err)
+	}
+	limits, err = limitsFromMap(map[string]interface{}{"memlimit": "256M", "cpulimit": "0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.MemoryBytes != 256<<20 || limits.CPUs != 0.5 {
+		t.Fatalf("unexpected limits %+v", limits)
+	}
+	limits, err = limitsFromMap(map[string]interface{}{"memlimit": float64(4096), "cpulimit": float64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.MemoryBytes != 4096 || limits.CPUs != 2 {
+		t.Fatalf("unexpected limits %+v", limits)
+	}
+	for _, config := range []map[string]interface{}{
+		{"cpulimit": "-1"},
+		{"cpulimit": "fast"},
+		{"memlimit": true},
+	} {
+		_, err = limitsFromMap(config)
+		if err == nil {
+			t.Fatalf("accepted invalid limits %v", config)
+		}
+	}
+}
+
+func TestSetUnitResourceLimits(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("command", newCommandWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("hang", func() WorkUnit {
+		return &hangingUnit{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cw, err := w.AllocateUnit("command", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := ResourceLimits{MemoryBytes: 64 << 20, CPUs: 0.25}
+	err = w.SetUnitResourceLimits(cw.ID(), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ced, ok := cw.Status().ExtraData.(*commandExtraData)
+	if !ok || ced.Limits != limits {
+		t.Fatalf("limits were not saved in the unit status: %+v", cw.Status().ExtraData)
+	}
+	args := cw.(*commandUnit).resourceLimitArgs()
+	if resourceLimitsSupported && len(args) != 2 {
+		t.Fatalf("unexpected command runner arguments %v", args)
+	}
+	if !resourceLimitsSupported && len(args) != 0 {
+		t.Fatalf("passed unsupported limits to the command runner: %v", args)
+	}
+	if w.SetUnitResourceLimits(cw.ID(), ResourceLimits{CPUs: -1}) == nil {
+		t.Fatal("accepted a negative CPU limit")
+	}
+
+	hu, err := w.AllocateUnit("hang", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.SetUnitResourceLimits(hu.ID(), limits) == nil {
+		t.Fatal("set resource limits on a work type that does not support them")
+	}
+}
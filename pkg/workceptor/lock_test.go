@@ -33,12 +33,15 @@ func TestStatusFileLock(t *testing.T) {
 		totalWaitTime = totalWaitTime + waitTime
 		go func(iter int, waitTime time.Duration) {
 			sfd := StatusFileData{}
-			err = sfd.UpdateFullStatus(statusFilename, func(status *StatusFileData) {
+			err := sfd.UpdateFullStatus(statusFilename, func(status *StatusFileData) {
 				time.Sleep(waitTime)
 				status.State = iter
 				status.StdoutSize = int64(iter)
 				status.Detail = fmt.Sprintf("%d", iter)
 			})
+			if err != nil {
+				t.Errorf("Error updating status file: %s", err)
+			}
 			wg.Done()
 		}(i, waitTime)
 	}
@@ -0,0 +1,169 @@
+package workceptor
+
+import (
+	"context"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/controlsvc"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policies for handling running work when entering maintenance mode
+const (
+	// MaintenanceKeepWork lets running units finish
+	MaintenanceKeepWork = "keep"
+	// MaintenanceCancelWork cancels running units
+	MaintenanceCancelWork = "cancel"
+)
+
+// SetMaintenanceMode puts the Workceptor into or out of maintenance mode.  While in maintenance
+// mode, no new units can be allocated.  If cancelRunning is set, units that are not yet complete
+// are cancelled.  Returns the IDs of the cancelled units.
+func (w *Workceptor) SetMaintenanceMode(enabled bool, cancelRunning bool) []string {
+	w.activeUnitsLock.Lock()
+	w.maintenanceMode = enabled
+	units := make([]WorkUnit, 0)
+	if enabled && cancelRunning {
+		for _, unit := range w.activeUnits {
+			if !IsComplete(unit.Status().State) {
+				units = append(units, unit)
+			}
+		}
+	}
+	w.activeUnitsLock.Unlock()
+	cancelled := make([]string, 0, len(units))
+	for _, unit := range units {
+		w.stopRetries(unit)
+		err := unit.Cancel()
+		if err != nil {
+			sublogger.Error("Error cancelling unit %s for maintenance: %s\n", unit.ID(), err)
+			continue
+		}
+		cancelled = append(cancelled, unit.ID())
+	}
+	sort.Strings(cancelled)
+	return cancelled
+}
+
+// MaintenanceMode returns true if the Workceptor is in maintenance mode
+func (w *Workceptor) MaintenanceMode() bool {
+	w.activeUnitsLock.RLock()
+	defer w.activeUnitsLock.RUnlock()
+	return w.maintenanceMode
+}
+
+// drainPollInterval is how often Drain checks whether running units have finished
+const drainPollInterval = 250 * time.Millisecond
+
+// runningUnitIDs returns the IDs of the units that are currently running
+func (w *Workceptor) runningUnitIDs() []string {
+	w.activeUnitsLock.RLock()
+	defer w.activeUnitsLock.RUnlock()
+	running := make([]string, 0)
+	for id, unit := range w.activeUnits {
+		if unit.Status().State == WorkStateRunning {
+			running = append(running, id)
+		}
+	}
+	sort.Strings(running)
+	return running
+}
+
+// Drain puts the Workceptor into maintenance mode, so that no new units are accepted, and waits for
+// the running units to reach a terminal state.  If the context is done first, it returns an error
+// listing the units that are still running.
+func (w *Workceptor) Drain(ctx context.Context) error {
+	w.SetMaintenanceMode(true, false)
+	for {
+		running := w.runningUnitIDs()
+		if len(running) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d work units still running: %s", len(running), strings.Join(running, ", "))
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+// =============================================================================================== //
+
+type maintenanceCommandType struct {
+	w *Workceptor
+}
+
+// maintenanceCommand does not implement controlsvc.MutatingCommand, so the control service still
+// runs it while the node is in maintenance mode, and maintenance mode can be turned off
+type maintenanceCommand struct {
+	w       *Workceptor
+	enabled bool
+	policy  string
+}
+
+func (t *maintenanceCommandType) Description() string {
+	return "Turn maintenance mode on or off for this node"
+}
+
+func (t *maintenanceCommandType) InitFromString(params string) (controlsvc.ControlCommand, error) {
+	tokens := strings.Fields(params)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("maintenance requires on or off")
+	}
+	config := map[string]interface{}{
+		"mode": tokens[0],
+	}
+	if len(tokens) > 1 {
+		config["policy"] = tokens[1]
+	}
+	if len(tokens) > 2 {
+		return nil, fmt.Errorf("maintenance only takes a mode and optional work policy")
+	}
+	return t.InitFromJSON(config)
+}
+
+func (t *maintenanceCommandType) InitFromJSON(config map[string]interface{}) (controlsvc.ControlCommand, error) {
+	mode, err := strFromMap(config, "mode")
+	if err != nil {
+		return nil, err
+	}
+	c := &maintenanceCommand{
+		w:      t.w,
+		policy: MaintenanceKeepWork,
+	}
+	switch strings.ToLower(mode) {
+	case "on":
+		c.enabled = true
+	case "off":
+		c.enabled = false
+	default:
+		return nil, fmt.Errorf("maintenance mode must be on or off")
+	}
+	_, ok := config["policy"]
+	if ok {
+		c.policy, err = strFromMap(config, "policy")
+		if err != nil {
+			return nil, err
+		}
+		c.policy = strings.ToLower(c.policy)
+		if !c.enabled {
+			return nil, fmt.Errorf("work policy only applies when entering maintenance mode")
+		}
+		if c.policy != MaintenanceKeepWork && c.policy != MaintenanceCancelWork {
+			return nil, fmt.Errorf("unknown work policy %s", c.policy)
+		}
+	}
+	return c, nil
+}
+
+// Worker function called by the control service to process a "maintenance" command
+func (c *maintenanceCommand) ControlFunc(nc *netceptor.Netceptor, cfo controlsvc.ControlFuncOperations) (map[string]interface{}, error) {
+	cancelled := c.w.SetMaintenanceMode(c.enabled, c.policy == MaintenanceCancelWork)
+	nc.SetMaintenanceMode(c.enabled)
+	cfr := make(map[string]interface{})
+	cfr["MaintenanceMode"] = c.enabled
+	cfr["CancelledUnits"] = cancelled
+	return cfr, nil
+}
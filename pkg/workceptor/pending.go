@@ -0,0 +1,81 @@
+package workceptor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Reasons a unit can be waiting to start
+const (
+	// PendingScheduled means the unit is deferred until its start time
+	PendingScheduled = "scheduled"
+	// PendingQueued means the unit is waiting for a free slot of its work type
+	PendingQueued = "queued"
+)
+
+// PendingUnit describes a unit that has not started yet, and why
+type PendingUnit struct {
+	UnitID   string
+	WorkType string
+	Reason   string
+	// StartAt is the time a scheduled unit will start
+	StartAt time.Time
+	// QueuePosition is the one-based position of a queued unit among queued units of its work type
+	QueuePosition int
+}
+
+// PendingUnits returns the units that are waiting to start, sorted by unit ID
+func (w *Workceptor) PendingUnits() []*PendingUnit {
+	pending := make([]*PendingUnit, 0)
+	sch := w.scheduler
+	sch.lock.Lock()
+	positions := make(map[string]int)
+	for _, qu := range sch.pending {
+		positions[qu.typeName]++
+		pending = append(pending, &PendingUnit{
+			UnitID:        qu.unit.ID(),
+			WorkType:      qu.typeName,
+			Reason:        PendingQueued,
+			QueuePosition: positions[qu.typeName],
+		})
+	}
+	deferredIDs := make([]string, 0, len(sch.deferred))
+	for unitID := range sch.deferred {
+		deferredIDs = append(deferredIDs, unitID)
+	}
+	sch.lock.Unlock()
+
+	w.activeUnitsLock.RLock()
+	for _, unitID := range deferredIDs {
+		unit, ok := w.activeUnits[unitID]
+		if !ok {
+			continue
+		}
+		status := unit.Status()
+		pending = append(pending, &PendingUnit{
+			UnitID:   unitID,
+			WorkType: status.WorkType,
+			Reason:   PendingScheduled,
+			StartAt:  status.StartAt,
+		})
+	}
+	w.activeUnitsLock.RUnlock()
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].UnitID < pending[j].UnitID
+	})
+	return pending
+}
+
+// CancelPendingUnit cancels a unit that is waiting to start.  Unlike CancelUnit, it returns an
+// error and leaves the unit alone if the unit has already started.
+func (w *Workceptor) CancelPendingUnit(unitID string) error {
+	unit, err := w.findUnit(unitID)
+	if err != nil {
+		return err
+	}
+	if !w.cancelQueuedUnit(unit) {
+		return fmt.Errorf("work unit %s is not waiting to start", unitID)
+	}
+	return nil
+}
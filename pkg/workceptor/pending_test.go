@@ -0,0 +1,100 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPendingUnits(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := make(chan struct{})
+	defer close(gate)
+	tracker := &concurrencyTracker{
+		lock:    &sync.Mutex{},
+		current: make(map[string]int),
+		max:     make(map[string]int),
+	}
+	err = w.RegisterWorker("gated", func() WorkUnit {
+		return &gatedUnit{
+			gate:    gate,
+			tracker: tracker,
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.SetWorkTypeLimit("gated", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, err := w.AllocateUnit("gated", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(running.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := w.AllocateUnit("gated", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(queued.ID())
+	if !IsPending(err) {
+		t.Fatalf("unit beyond the limit was not queued: %v", err)
+	}
+	scheduled, err := w.AllocateUnit("gated", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAt := time.Now().Add(time.Hour)
+	err = w.DeferUnit(scheduled.ID(), startAt)
+	if !IsPending(err) {
+		t.Fatalf("deferring a unit returned %v", err)
+	}
+
+	pending := make(map[string]*PendingUnit)
+	for _, pu := range w.PendingUnits() {
+		pending[pu.UnitID] = pu
+	}
+	if len(pending) != 2 {
+		t.Fatalf("expected two pending units, got %d", len(pending))
+	}
+	pu := pending[queued.ID()]
+	if pu == nil || pu.Reason != PendingQueued || pu.QueuePosition != 1 || pu.WorkType != "gated" {
+		t.Fatalf("unexpected pending entry for the queued unit: %v", pu)
+	}
+	pu = pending[scheduled.ID()]
+	if pu == nil || pu.Reason != PendingScheduled || !pu.StartAt.Equal(startAt) || pu.WorkType != "gated" {
+		t.Fatalf("unexpected pending entry for the scheduled unit: %v", pu)
+	}
+
+	err = w.CancelPendingUnit(running.ID())
+	if err == nil {
+		t.Fatal("a running unit was cancelled as pending")
+	}
+	for _, unit := range []WorkUnit{queued, scheduled} {
+		err = w.CancelPendingUnit(unit.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.Status().State != WorkStateFailed {
+			t.Fatalf("cancelled pending unit is in state %s", WorkStateToString(unit.Status().State))
+		}
+	}
+	if len(w.PendingUnits()) != 0 {
+		t.Fatalf("units still pending after cancel: %v", w.PendingUnits())
+	}
+	if running.Status().State != WorkStateRunning {
+		t.Fatal("cancelling pending units affected the running unit")
+	}
+}
@@ -0,0 +1,63 @@
+package workceptor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// WorkProgress is the most recent progress reported by the worker of a unit
+type WorkProgress struct {
+	// Percent is how far the unit has got, from 0 to 100
+	Percent float64
+	// Step describes what the unit is currently doing
+	Step string
+}
+
+// UpdateProgress records progress reported by the worker.  It is shown in the unit's status.
+func (bwu *BaseWorkUnit) UpdateProgress(percent float64, step string) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("progress must be between 0 and 100 percent")
+	}
+	bwu.statusLock.Lock()
+	defer bwu.statusLock.Unlock()
+	err := bwu.w.storage.UpdateStatus(bwu.unitID, &bwu.status, func(status *StatusFileData) {
+		status.Progress = WorkProgress{
+			Percent: percent,
+			Step:    step,
+		}
+	})
+	bwu.lastUpdateError = err
+	if err != nil {
+		sublogger.Error("Error updating progress of unit %s: %s.", bwu.unitID, err)
+	}
+	return err
+}
+
+// ProgressFileEnvVar names the environment variable that tells a command where it can report
+// progress.  The command writes a line to the file with the percentage complete, optionally
+// followed by a space and a description of the current step.  The file is checked periodically
+// and only the latest line is used.
+const ProgressFileEnvVar = "RECEPTOR_PROGRESS_FILE"
+
+// readProgressFile parses the last line of a progress file written by a command
+func readProgressFile(filename string) (WorkProgress, bool) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return WorkProgress{}, false
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	fields := strings.SplitN(strings.TrimSpace(lines[len(lines)-1]), " ", 2)
+	percent, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return WorkProgress{}, false
+	}
+	progress := WorkProgress{
+		Percent: percent,
+	}
+	if len(fields) > 1 {
+		progress.Step = strings.TrimSpace(fields[1])
+	}
+	return progress, true
+}
@@ -0,0 +1,114 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// progressUnit is a work unit that reports each progress value it is given
+type progressUnit struct {
+	BaseWorkUnit
+	updates chan WorkProgress
+	done    chan struct{}
+}
+
+func (pu *progressUnit) Start() error {
+	pu.UpdateBasicStatus(WorkStateRunning, "Running", 0)
+	go func() {
+		for p := range pu.updates {
+			_ = pu.UpdateProgress(p.Percent, p.Step)
+			pu.done <- struct{}{}
+		}
+	}()
+	return nil
+}
+
+func (pu *progressUnit) Restart() error {
+	return nil
+}
+
+func (pu *progressUnit) Cancel() error {
+	return nil
+}
+
+func TestProgressReporting(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan WorkProgress)
+	defer close(updates)
+	done := make(chan struct{})
+	err = w.RegisterWorker("progress", func() WorkUnit {
+		return &progressUnit{updates: updates, done: done}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := w.AllocateUnit("progress", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []WorkProgress{{Percent: 10, Step: "downloading"}, {Percent: 55.5, Step: "building"}} {
+		updates <- p
+		<-done
+	}
+
+	// The work status command reports the unit's status through unitStatusForCFR
+	status, err := w.unitStatusForCFR(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, ok := status["Progress"].(WorkProgress)
+	if !ok || progress.Percent != 55.5 || progress.Step != "building" {
+		t.Fatalf("unexpected progress in status: %v", status["Progress"])
+	}
+	err = unit.UpdateProgress(101, "")
+	if err == nil {
+		t.Fatal("progress over 100 percent was accepted")
+	}
+	if unit.Status().Progress.Percent != 55.5 {
+		t.Fatal("invalid progress replaced the latest value")
+	}
+}
+
+func TestReadProgressFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpdir)
+	}()
+	filename := path.Join(tmpdir, "progress")
+	_, ok := readProgressFile(filename)
+	if ok {
+		t.Fatal("progress was read from a missing file")
+	}
+	err = ioutil.WriteFile(filename, []byte("20 starting\n75 copying files\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, ok := readProgressFile(filename)
+	if !ok || progress.Percent != 75 || progress.Step != "copying files" {
+		t.Fatalf("unexpected progress %v", progress)
+	}
+	err = ioutil.WriteFile(filename, []byte("lots\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok = readProgressFile(filename)
+	if ok {
+		t.Fatal("malformed progress was accepted")
+	}
+}
@@ -17,6 +17,10 @@ type pythonUnit struct {
 
 // Start launches a job with given parameters.
 func (pw *pythonUnit) Start() error {
+	err := pw.requireUnitDir()
+	if err != nil {
+		return err
+	}
 	pw.UpdateBasicStatus(WorkStatePending, "Launching Python runner", 0)
 	config := make(map[string]interface{})
 	for k, v := range pw.config {
@@ -38,10 +42,11 @@ func (pw *pythonUnit) Start() error {
 
 // WorkPythonCfg is the cmdline configuration object for a Python worker plugin
 type WorkPythonCfg struct {
-	WorkType string                 `required:"true" description:"Name for this worker type"`
-	Plugin   string                 `required:"true" description:"Python module name of the worker plugin"`
-	Function string                 `required:"true" description:"Receptor-exported function to call"`
-	Config   map[string]interface{} `description:"Plugin-specific configuration"`
+	WorkType      string                 `required:"true" description:"Name for this worker type"`
+	Plugin        string                 `required:"true" description:"Python module name of the worker plugin"`
+	Function      string                 `required:"true" description:"Receptor-exported function to call"`
+	Config        map[string]interface{} `description:"Plugin-specific configuration"`
+	MaxConcurrent int                    `description:"Maximum number of units of this type to run at once (0 for no limit)" default:"0"`
 }
 
 // newWorker is a factory to produce worker instances
@@ -56,7 +61,10 @@ func (cfg WorkPythonCfg) newWorker() WorkUnit {
 // Run runs the action
 func (cfg WorkPythonCfg) Run() error {
 	err := MainInstance.RegisterWorker(cfg.WorkType, cfg.newWorker)
-	return err
+	if err != nil {
+		return err
+	}
+	return MainInstance.SetWorkTypeLimit(cfg.WorkType, cfg.MaxConcurrent)
 }
 
 func init() {
@@ -5,12 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/utils"
 	"io"
 	"net"
-	"os"
-	"path"
 	"regexp"
 	"strings"
 	"sync"
@@ -73,7 +70,7 @@ func (rw *remoteUnit) getConnection(ctx context.Context) (net.Conn, *bufio.Reade
 		if err == nil {
 			return conn, reader
 		}
-		logger.Debug("Connection to %s failed with error: %s",
+		sublogger.Debug("Connection to %s failed with error: %s",
 			rw.Status().ExtraData.(*remoteExtraData).RemoteNode, err)
 		select {
 		case <-ctx.Done():
@@ -113,6 +110,31 @@ func (rw *remoteUnit) getConnectionAndRun(ctx context.Context, firstTimeSync boo
 	return ErrPending
 }
 
+// submitCommand returns the control command that submits the work to the remote node.  If this
+// node has a signing key, the work is submitted as JSON along with its signature.
+func (rw *remoteUnit) submitCommand(remoteNode string, remoteWorkType string, params string) ([]byte, error) {
+	signature, signedAt, err := rw.w.signSubmission(remoteNode, remoteWorkType, params)
+	if err != nil {
+		return nil, fmt.Errorf("error signing work: %s", err)
+	}
+	if signature == "" {
+		return []byte(fmt.Sprintf("work submit localhost %s\n", remoteWorkType)), nil
+	}
+	submitCmd, err := json.Marshal(map[string]interface{}{
+		"command":    "work",
+		"subcommand": "submit",
+		"node":       "localhost",
+		"worktype":   remoteWorkType,
+		"params":     params,
+		"signature":  signature,
+		"signedat":   signedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(submitCmd, '\n'), nil
+}
+
 // startRemoteUnit makes a single attempt to start a remote unit.
 func (rw *remoteUnit) startRemoteUnit(ctx context.Context, conn net.Conn, reader *bufio.Reader) error {
 	closeOnce := sync.Once{}
@@ -124,8 +146,13 @@ func (rw *remoteUnit) startRemoteUnit(ctx context.Context, conn net.Conn, reader
 		return err
 	}
 	defer doClose()
-	red := rw.Status().ExtraData.(*remoteExtraData)
-	_, err := conn.Write([]byte(fmt.Sprintf("work submit localhost %s\n", red.RemoteWorkType)))
+	status := rw.Status()
+	red := status.ExtraData.(*remoteExtraData)
+	submitCmd, err := rw.submitCommand(red.RemoteNode, red.RemoteWorkType, status.Params)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(submitCmd)
 	if err != nil {
 		return fmt.Errorf("write error sending to %s: %s", red.RemoteNode, err)
 	}
@@ -144,7 +171,7 @@ func (rw *remoteUnit) startRemoteUnit(ctx context.Context, conn net.Conn, reader
 		ed := status.ExtraData.(*remoteExtraData)
 		ed.RemoteUnitID = red.RemoteUnitID
 	})
-	stdin, err := os.Open(path.Join(rw.UnitDir(), "stdin"))
+	stdin, err := rw.w.storage.OpenReader(rw.ID(), "stdin", 0)
 	if err != nil {
 		return fmt.Errorf("error opening stdin file: %s", err)
 	}
@@ -208,7 +235,7 @@ func (rw *remoteUnit) monitorRemoteStatus(mw *utils.JobContext, forRelease bool)
 	status := rw.Status()
 	red, ok := status.ExtraData.(*remoteExtraData)
 	if !ok {
-		logger.Error("remote ExtraData missing")
+		sublogger.Error("remote ExtraData missing")
 		return
 	}
 	remoteNode := red.RemoteNode
@@ -226,14 +253,14 @@ func (rw *remoteUnit) monitorRemoteStatus(mw *utils.JobContext, forRelease bool)
 		}
 		_, err := conn.Write([]byte(fmt.Sprintf("work status %s\n", remoteUnitID)))
 		if err != nil {
-			logger.Debug("Write error sending to %s: %s\n", remoteUnitID, err)
+			sublogger.Debug("Write error sending to %s: %s\n", remoteUnitID, err)
 			_ = conn.Close()
 			conn = nil
 			continue
 		}
 		status, err := utils.ReadStringContext(mw, reader, '\n')
 		if err != nil {
-			logger.Debug("Read error reading from %s: %s\n", remoteNode, err)
+			sublogger.Debug("Read error reading from %s: %s\n", remoteNode, err)
 			_ = conn.Close()
 			conn = nil
 			continue
@@ -241,7 +268,7 @@ func (rw *remoteUnit) monitorRemoteStatus(mw *utils.JobContext, forRelease bool)
 		if status[:5] == "ERROR" {
 			if strings.Contains(status, "unknown work unit") {
 				if !forRelease {
-					logger.Debug("Work unit %s on node %s is gone.\n", remoteUnitID, remoteNode)
+					sublogger.Debug("Work unit %s on node %s is gone.\n", remoteUnitID, remoteNode)
 					rw.UpdateFullStatus(func(status *StatusFileData) {
 						status.State = WorkStateFailed
 						status.Detail = "Remote work unit is gone"
@@ -249,18 +276,21 @@ func (rw *remoteUnit) monitorRemoteStatus(mw *utils.JobContext, forRelease bool)
 				}
 				return
 			}
-			logger.Error("Remote error: %s\n", strings.TrimRight(status[6:], "\n"))
+			sublogger.Error("Remote error: %s\n", strings.TrimRight(status[6:], "\n"))
 			return
 		}
 		si := StatusFileData{}
 		err = json.Unmarshal([]byte(status), &si)
 		if err != nil {
-			logger.Error("Error unmarshalling JSON: %s\n", status)
+			sublogger.Error("Error unmarshalling JSON: %s\n", status)
 			return
 		}
 		rw.UpdateBasicStatus(si.State, si.Detail, si.StdoutSize)
+		if si.Progress != rw.Status().Progress {
+			_ = rw.UpdateProgress(si.Progress.Percent, si.Progress.Step)
+		}
 		if err != nil {
-			logger.Error("Error saving local status file: %s\n", err)
+			sublogger.Error("Error saving local status file: %s\n", err)
 			return
 		}
 		if sleepOrDone(mw.Done(), 1*time.Second) {
@@ -279,7 +309,7 @@ func (rw *remoteUnit) monitorRemoteStdout(mw *utils.JobContext) {
 	status := rw.Status()
 	red, ok := status.ExtraData.(*remoteExtraData)
 	if !ok {
-		logger.Error("remote ExtraData missing")
+		sublogger.Error("remote ExtraData missing")
 		return
 	}
 	remoteNode := red.RemoteNode
@@ -297,13 +327,19 @@ func (rw *remoteUnit) monitorRemoteStdout(mw *utils.JobContext) {
 		}
 		err := rw.Load()
 		if err != nil {
-			logger.Error("Could not read status file %s: %s\n", rw.statusFileName, err)
+			sublogger.Error("Could not read status of unit %s: %s\n", rw.ID(), err)
 			return
 		}
 		status := rw.Status()
-		diskStdoutSize := stdoutSize(rw.UnitDir())
+		diskStdoutSize := rw.w.unitStdoutSize(rw.ID())
 		remoteStdoutSize := status.StdoutSize
 		if IsComplete(status.State) && diskStdoutSize >= remoteStdoutSize {
+			// The results may have finished downloading after the unit completed, or the unit may have
+			// completed while the node was down, so it might not have been checksummed yet
+			if status.Checksums == nil {
+				rw.takeChecksumsDue()
+				rw.recordChecksums()
+			}
 			return
 		} else if diskStdoutSize < remoteStdoutSize {
 			conn, reader := rw.getConnection(mw)
@@ -312,21 +348,21 @@ func (rw *remoteUnit) monitorRemoteStdout(mw *utils.JobContext) {
 			}
 			_, err := conn.Write([]byte(fmt.Sprintf("work results %s %d\n", remoteUnitID, diskStdoutSize)))
 			if err != nil {
-				logger.Warning("Write error sending to %s: %s\n", remoteNode, err)
+				sublogger.Warning("Write error sending to %s: %s\n", remoteNode, err)
 				continue
 			}
 			status, err := utils.ReadStringContext(mw, reader, '\n')
 			if err != nil {
-				logger.Warning("Read error reading from %s: %s\n", remoteNode, err)
+				sublogger.Warning("Read error reading from %s: %s\n", remoteNode, err)
 				continue
 			}
 			if !strings.Contains(status, "Streaming results") {
-				logger.Warning("Remote node %s did not stream results\n", remoteNode)
+				sublogger.Warning("Remote node %s did not stream results\n", remoteNode)
 				continue
 			}
-			stdout, err := os.OpenFile(rw.stdoutFileName, os.O_CREATE+os.O_APPEND+os.O_WRONLY, 0600)
+			stdout, err := rw.w.storage.OpenWriter(rw.ID(), "stdout", true)
 			if err != nil {
-				logger.Error("Could not open stdout file %s: %s\n", rw.stdoutFileName, err)
+				sublogger.Error("Could not open stdout of unit %s: %s\n", rw.ID(), err)
 				return
 			}
 			doneChan := make(chan struct{})
@@ -346,7 +382,7 @@ func (rw *remoteUnit) monitorRemoteStdout(mw *utils.JobContext) {
 			_, err = io.Copy(stdout, conn)
 			close(doneChan)
 			if err != nil {
-				logger.Warning("Error copying to stdout file %s: %s\n", rw.stdoutFileName, err)
+				sublogger.Warning("Error copying to stdout file %s: %s\n", rw.stdoutFileName, err)
 				continue
 			}
 		}
@@ -400,7 +436,7 @@ func (rw *remoteUnit) runAndMonitor(mw *utils.JobContext, forRelease bool, actio
 			if forRelease {
 				err := rw.BaseWorkUnit.Release(false)
 				if err != nil {
-					logger.Error("Error releasing unit %s: %s", rw.UnitDir(), err)
+					sublogger.Error("Error releasing unit %s: %s", rw.ID(), err)
 				}
 			}
 			mw.WorkerDone()
@@ -0,0 +1,163 @@
+package workceptor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retention holds the policy for automatically releasing completed units, and tracks which units
+// are being read by control clients so they are not released underneath them
+type retention struct {
+	lock       *sync.Mutex
+	ttl        time.Duration
+	interval   time.Duration
+	started    bool
+	readers    map[string]int
+	collecting map[string]bool
+}
+
+func newRetention() *retention {
+	return &retention{
+		lock:       &sync.Mutex{},
+		readers:    make(map[string]int),
+		collecting: make(map[string]bool),
+	}
+}
+
+// SetRetention sets how long units are kept after they complete before they are released
+// automatically, and how often to check for units past that age.  A ttl of zero keeps completed
+// units until they are explicitly released.
+func (w *Workceptor) SetRetention(ttl time.Duration, interval time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("retention time must not be negative")
+	}
+	if ttl > 0 && interval <= 0 {
+		return fmt.Errorf("sweep interval must be positive")
+	}
+	r := w.retention
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ttl = ttl
+	r.interval = interval
+	if ttl > 0 && !r.started {
+		r.started = true
+		go w.sweepLoop()
+	}
+	return nil
+}
+
+// sweepLoop periodically releases completed units that are past their retention time
+func (w *Workceptor) sweepLoop() {
+	for {
+		r := w.retention
+		r.lock.Lock()
+		interval := r.interval
+		r.lock.Unlock()
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(interval):
+			w.sweepUnits()
+		}
+	}
+}
+
+// sweepUnits releases completed units that are past their retention time, and returns their IDs
+func (w *Workceptor) sweepUnits() []string {
+	r := w.retention
+	r.lock.Lock()
+	ttl := r.ttl
+	r.lock.Unlock()
+	if ttl <= 0 {
+		return nil
+	}
+	w.scanForUnits()
+	w.activeUnitsLock.RLock()
+	units := make([]WorkUnit, 0, len(w.activeUnits))
+	for _, unit := range w.activeUnits {
+		units = append(units, unit)
+	}
+	w.activeUnitsLock.RUnlock()
+	released := make([]string, 0)
+	now := time.Now()
+	for _, unit := range units {
+		status := unit.Status()
+		if !IsComplete(status.State) {
+			continue
+		}
+		if status.CompletedAt.IsZero() {
+			// The unit completed before completion times were recorded, so start counting from now
+			unit.UpdateFullStatus(func(status *StatusFileData) {
+				if IsComplete(status.State) && status.CompletedAt.IsZero() {
+					status.CompletedAt = now
+				}
+			})
+			continue
+		}
+		if now.Sub(status.CompletedAt) < ttl {
+			continue
+		}
+		if w.releaseUnreadUnit(unit, ttl) {
+			released = append(released, unit.ID())
+		}
+	}
+	sort.Strings(released)
+	return released
+}
+
+// releaseUnreadUnit releases a unit unless a control client is reading its output.  Returns true
+// if the unit was released.
+func (w *Workceptor) releaseUnreadUnit(unit WorkUnit, ttl time.Duration) bool {
+	r := w.retention
+	r.lock.Lock()
+	if r.readers[unit.ID()] > 0 {
+		r.lock.Unlock()
+		sublogger.Debug("Not releasing expired work unit %s while its output is being read\n", unit.ID())
+		return false
+	}
+	r.collecting[unit.ID()] = true
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		delete(r.collecting, unit.ID())
+		r.lock.Unlock()
+	}()
+	// The unit may have been retried or restarted since the sweep looked at it
+	status := unit.Status()
+	if !IsComplete(status.State) || status.CompletedAt.IsZero() || time.Since(status.CompletedAt) < ttl {
+		return false
+	}
+	err := unit.Release(false)
+	if err != nil && !IsPending(err) {
+		sublogger.Error("Error releasing expired work unit %s: %s\n", unit.ID(), err)
+		return false
+	}
+	sublogger.Info("Released work unit %s, which completed more than %s ago\n", unit.ID(), ttl)
+	return true
+}
+
+// addUnitReader records that a control client is reading the output of a unit, so it is not
+// released by the retention policy.  Fails if the unit is being released.
+func (w *Workceptor) addUnitReader(unitID string) error {
+	r := w.retention
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.collecting[unitID] {
+		return fmt.Errorf("work unit %s is being released", unitID)
+	}
+	r.readers[unitID]++
+	return nil
+}
+
+// removeUnitReader records that a control client has stopped reading the output of a unit
+func (w *Workceptor) removeUnitReader(unitID string) {
+	r := w.retention
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.readers[unitID]--
+	if r.readers[unitID] <= 0 {
+		delete(r.readers, unitID)
+	}
+}
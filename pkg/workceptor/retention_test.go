@@ -0,0 +1,107 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"sort"
+	"testing"
+	"time"
+)
+
+// allocateCompletedUnit allocates a hanging unit and marks it as succeeded
+func allocateCompletedUnit(t *testing.T, w *Workceptor) WorkUnit {
+	unit, err := w.AllocateUnit("hang", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit.UpdateBasicStatus(WorkStateSucceeded, "Done", 0)
+	return unit
+}
+
+// knownUnitIDs returns the sorted IDs of the units known to a Workceptor
+func knownUnitIDs(w *Workceptor) []string {
+	ids := w.ListKnownUnitIDs()
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRetention(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w := newHangingWorkceptor(context.Background(), t, nc, NewMemoryStorage(), make(chan struct{}, 1), make(chan struct{}, 1))
+	if w.SetRetention(-time.Second, time.Minute) == nil {
+		t.Fatal("accepted a negative retention time")
+	}
+	if w.SetRetention(time.Second, 0) == nil {
+		t.Fatal("accepted a zero sweep interval")
+	}
+
+	expired := allocateCompletedUnit(t, w)
+	read := allocateCompletedUnit(t, w)
+	running, err := w.AllocateUnit("hang", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(running.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := w.AllocateUnit("hang", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.UpdateFullStatus(func(status *StatusFileData) {
+		status.State = WorkStateSucceeded
+	})
+
+	// Keep a client reading the output of one of the completed units
+	stdout, err := w.storage.OpenWriter(read.ID(), "stdout", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stdout.Write([]byte("output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stdout.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doneChan := make(chan struct{})
+	_, err = w.GetResults(read.ID(), 0, doneChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sweep interval is long, so only the sweeps made by the test run
+	err = w.SetRetention(100*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	released := w.sweepUnits()
+	if len(released) != 1 || released[0] != expired.ID() {
+		t.Fatalf("expected only %s to be released, but released %v", expired.ID(), released)
+	}
+	expected := []string{legacy.ID(), read.ID(), running.ID()}
+	sort.Strings(expected)
+	ids := knownUnitIDs(w)
+	if len(ids) != 3 || ids[0] != expected[0] || ids[1] != expected[1] || ids[2] != expected[2] {
+		t.Fatalf("expected units %v to remain, but found %v", expected, ids)
+	}
+	if legacy.Status().CompletedAt.IsZero() {
+		t.Fatal("completion time was not recorded for a unit that completed without one")
+	}
+
+	// Once the client stops reading, the unit can be released
+	close(doneChan)
+	time.Sleep(500 * time.Millisecond)
+	released = w.sweepUnits()
+	if len(released) != 2 {
+		t.Fatalf("expected the read and legacy units to be released, but released %v", released)
+	}
+	ids = knownUnitIDs(w)
+	if len(ids) != 1 || ids[0] != running.ID() {
+		t.Fatalf("expected only %s to remain, but found %v", running.ID(), ids)
+	}
+}
@@ -0,0 +1,163 @@
+package workceptor
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxRetryBackoff is the delay beyond which an exponential backoff stops doubling
+const maxRetryBackoff = time.Hour
+
+// RetryPolicy controls how a unit that fails is started again
+type RetryPolicy struct {
+	MaxAttempts int           // Number of times the unit may be started, including the first
+	Delay       time.Duration // Time to wait after a failure before starting the unit again
+	Backoff     bool          // Double the delay after each further failure
+}
+
+// Validate checks that the policy is usable
+func (rp RetryPolicy) Validate() error {
+	if rp.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1")
+	}
+	if rp.Delay < 0 {
+		return fmt.Errorf("retry delay must not be negative")
+	}
+	return nil
+}
+
+// delayAfter returns how long to wait before starting the unit again after the given attempt failed
+func (rp RetryPolicy) delayAfter(attempt int) time.Duration {
+	delay := rp.Delay
+	if rp.Backoff {
+		for i := 1; i < attempt && delay > 0 && delay < maxRetryBackoff; i++ {
+			delay *= 2
+		}
+	}
+	return delay
+}
+
+// SetUnitRetryPolicy sets how many times a unit is started if it fails, and how long to wait
+// between attempts.  The policy must be set before the unit starts.
+func (w *Workceptor) SetUnitRetryPolicy(unitID string, policy RetryPolicy) error {
+	unit, err := w.findUnit(unitID)
+	if err != nil {
+		return err
+	}
+	return setUnitRetryPolicy(unit, policy)
+}
+
+// setUnitRetryPolicy saves the retry policy of a unit in its status
+func setUnitRetryPolicy(unit WorkUnit, policy RetryPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	_, ok := unit.(*remoteUnit)
+	if ok {
+		return fmt.Errorf("retry policies can only be set on local work units")
+	}
+	unit.UpdateFullStatus(func(status *StatusFileData) {
+		status.Retry = policy
+		status.Attempt = 1
+	})
+	return unit.LastUpdateError()
+}
+
+// canRetry returns true if a unit has failed with attempts remaining, and was not stopped on purpose
+func canRetry(status *StatusFileData) bool {
+	return status.State == WorkStateFailed && status.Attempt < status.Retry.MaxAttempts &&
+		!status.Cancelled && !status.TimedOut
+}
+
+// retriesExhausted returns true if a unit has failed on its last allowed attempt
+func retriesExhausted(status *StatusFileData) bool {
+	return status.State == WorkStateFailed && status.Retry.MaxAttempts > 1 &&
+		status.Attempt >= status.Retry.MaxAttempts && !status.Cancelled && !status.TimedOut
+}
+
+// retryIfFailed puts a unit that has failed with attempts remaining back into the pending state,
+// with a start time after the retry delay.  The start time is saved in the unit's status, so the
+// retry is scheduled again if the node restarts.  Returns true if the unit will be retried.
+func (bwu *BaseWorkUnit) retryIfFailed(status *StatusFileData) bool {
+	if retriesExhausted(status) && !status.RetriesExhausted {
+		bwu.UpdateFullStatus(func(status *StatusFileData) {
+			if retriesExhausted(status) && !status.RetriesExhausted {
+				status.RetriesExhausted = true
+				status.Detail = fmt.Sprintf("Failed after %d attempts: %s", status.Attempt, status.Detail)
+			}
+		})
+		return false
+	}
+	if !canRetry(status) {
+		return false
+	}
+	startAt := time.Now().Add(status.Retry.delayAfter(status.Attempt))
+	retrying := false
+	bwu.UpdateFullStatus(func(s *StatusFileData) {
+		// Another status update may have already handled this failure
+		if !canRetry(s) || s.Attempt != status.Attempt {
+			return
+		}
+		retrying = true
+		s.Attempt++
+		s.State = WorkStatePending
+		s.Detail = fmt.Sprintf("Attempt %d of %d failed (%s). Retrying at %s", status.Attempt,
+			s.Retry.MaxAttempts, status.Detail, startAt.Format(time.RFC3339))
+		s.StartAt = startAt
+		s.StdoutSize = 0
+		s.Deadline = time.Time{}
+		s.CompletedAt = time.Time{}
+		s.Progress = WorkProgress{}
+		s.Checksums = nil
+	})
+	if !retrying {
+		return false
+	}
+	sublogger.Warning("Work unit %s failed on attempt %d of %d. Retrying at %s\n", bwu.unitID,
+		status.Attempt, status.Retry.MaxAttempts, startAt.Format(time.RFC3339))
+	// Results come from the last attempt only
+	for _, stream := range []string{"stdout", "stderr"} {
+		_, err := bwu.w.storage.StreamSize(bwu.unitID, stream)
+		if err != nil {
+			continue
+		}
+		writer, err := bwu.w.storage.OpenWriter(bwu.unitID, stream, false)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			sublogger.Error("Error clearing %s of work unit %s: %s\n", stream, bwu.unitID, err)
+		}
+	}
+	go bwu.w.armRetry(bwu.unitID, startAt)
+	return true
+}
+
+// armRetry arms the deferred start of a unit that is being retried.  This runs separately from
+// the status update that schedules the retry, since that may happen while units are being loaded.
+func (w *Workceptor) armRetry(unitID string, startAt time.Time) {
+	unit, err := w.findUnit(unitID)
+	if err != nil {
+		sublogger.Error("Error retrying work unit %s: %s\n", unitID, err)
+		return
+	}
+	if !isDeferred(unit.Status()) {
+		return
+	}
+	w.armDeferredStart(unit, startAt)
+	// A cancel that came in before the timer was armed could not stop it, so stop it here
+	if unit.Status().Cancelled && w.undeferUnit(unitID) {
+		unit.UpdateBasicStatus(WorkStateFailed, "Cancelled before starting", 0)
+	}
+}
+
+// stopRetries makes sure a unit that is being cancelled is not started again
+func (w *Workceptor) stopRetries(unit WorkUnit) {
+	if unit.Status().Retry.MaxAttempts <= 1 {
+		return
+	}
+	unit.UpdateFullStatus(func(status *StatusFileData) {
+		status.Cancelled = true
+	})
+}
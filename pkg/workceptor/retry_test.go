@@ -0,0 +1,193 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyUnit is a work unit that fails until it has been started a given number of times
+type flakyUnit struct {
+	BaseWorkUnit
+	starts    *int32
+	succeedOn int32
+}
+
+func (fu *flakyUnit) Start() error {
+	start := atomic.AddInt32(fu.starts, 1)
+	fu.UpdateBasicStatus(WorkStateRunning, "Running", 0)
+	go func() {
+		if fu.succeedOn > 0 && start >= fu.succeedOn {
+			fu.UpdateBasicStatus(WorkStateSucceeded, "Done", 0)
+		} else {
+			fu.UpdateBasicStatus(WorkStateFailed, "Flaky failure", 0)
+		}
+	}()
+	return nil
+}
+
+func (fu *flakyUnit) Restart() error {
+	return nil
+}
+
+func (fu *flakyUnit) Cancel() error {
+	return nil
+}
+
+// newFlakyWorkceptor returns a Workceptor with a "flaky" work type whose units succeed on the
+// succeedOn'th start, or never if it is zero
+func newFlakyWorkceptor(ctx context.Context, t *testing.T, nc *netceptor.Netceptor, storage Storage,
+	starts *int32, succeedOn int32) *Workceptor {
+	w, err := NewWithStorage(ctx, nc, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("flaky", func() WorkUnit {
+		return &flakyUnit{starts: starts, succeedOn: succeedOn}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// startFlakyUnit allocates a flaky unit with a retry policy and starts it
+func startFlakyUnit(t *testing.T, w *Workceptor, policy RetryPolicy) WorkUnit {
+	unit, err := w.AllocateUnit("flaky", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.SetUnitRetryPolicy(unit.ID(), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unit
+}
+
+// waitForComplete waits for a unit to reach a completed state and returns its status
+func waitForComplete(t *testing.T, w *Workceptor, unitID string) *StatusFileData {
+	timeout := time.Now().Add(10 * time.Second)
+	for time.Now().Before(timeout) {
+		status, err := w.UnitStatus(unitID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsComplete(status.State) {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for unit to complete")
+	return nil
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, Delay: time.Second}
+	if policy.delayAfter(3) != time.Second {
+		t.Fatal("delay changed without backoff")
+	}
+	policy.Backoff = true
+	if policy.delayAfter(1) != time.Second || policy.delayAfter(3) != 4*time.Second {
+		t.Fatal("delay did not double after each attempt")
+	}
+	if policy.delayAfter(20) > 2*maxRetryBackoff {
+		t.Fatalf("backoff grew to %s", policy.delayAfter(20))
+	}
+	if (RetryPolicy{}).Validate() == nil {
+		t.Fatal("accepted a policy with no attempts")
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	var starts int32
+	w := newFlakyWorkceptor(context.Background(), t, nc, NewMemoryStorage(), &starts, 3)
+	start := time.Now()
+	unit := startFlakyUnit(t, w, RetryPolicy{MaxAttempts: 5, Delay: 100 * time.Millisecond, Backoff: true})
+	status := waitForComplete(t, w, unit.ID())
+	if status.State != WorkStateSucceeded || status.Attempt != 3 || atomic.LoadInt32(&starts) != 3 {
+		t.Fatalf("unexpected status %+v after %d starts", status, atomic.LoadInt32(&starts))
+	}
+	// Waited 100ms after the first failure and 200ms after the second
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatal("unit was retried without waiting")
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	var starts int32
+	w := newFlakyWorkceptor(context.Background(), t, nc, NewMemoryStorage(), &starts, 0)
+	unit := startFlakyUnit(t, w, RetryPolicy{MaxAttempts: 2})
+	status := waitForComplete(t, w, unit.ID())
+	if status.State != WorkStateFailed || !status.RetriesExhausted || status.Detail != "Failed after 2 attempts: Flaky failure" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if atomic.LoadInt32(&starts) != 2 {
+		t.Fatalf("unit was started %d times", atomic.LoadInt32(&starts))
+	}
+}
+
+func TestCancelStopsRetries(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	var starts int32
+	w := newFlakyWorkceptor(context.Background(), t, nc, NewMemoryStorage(), &starts, 0)
+	unit := startFlakyUnit(t, w, RetryPolicy{MaxAttempts: 3, Delay: 300 * time.Millisecond})
+	time.Sleep(100 * time.Millisecond)
+	if unit.Status().State != WorkStatePending || unit.Status().Attempt != 2 {
+		t.Fatalf("failed unit was not waiting to retry: %+v", unit.Status())
+	}
+	err := w.CancelUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	status := unit.Status()
+	if status.State != WorkStateFailed || status.RetriesExhausted || atomic.LoadInt32(&starts) != 1 {
+		t.Fatalf("unexpected status %+v after %d starts", status, atomic.LoadInt32(&starts))
+	}
+}
+
+func TestRetrySurvivesRestart(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	var starts int32
+	w1 := newFlakyWorkceptor(ctx1, t, nc, NewFileStorage(path.Join(tmpdir, "node1")), &starts, 2)
+	unit := startFlakyUnit(t, w1, RetryPolicy{MaxAttempts: 3, Delay: 500 * time.Millisecond})
+	time.Sleep(100 * time.Millisecond)
+	// Shut down the first instance while the retry is waiting, and bring up a new one
+	cancel1()
+	time.Sleep(600 * time.Millisecond)
+	if atomic.LoadInt32(&starts) != 1 {
+		t.Fatal("unit was retried by an instance that was shut down")
+	}
+	w2 := newFlakyWorkceptor(context.Background(), t, nc, NewFileStorage(path.Join(tmpdir, "node1")), &starts, 2)
+	ids := w2.ListKnownUnitIDs()
+	if len(ids) != 1 || ids[0] != unit.ID() {
+		t.Fatalf("unexpected unit list %v", ids)
+	}
+	status := waitForComplete(t, w2, unit.ID())
+	if status.State != WorkStateSucceeded || status.Attempt != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
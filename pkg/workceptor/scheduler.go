@@ -0,0 +1,177 @@
+package workceptor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// scheduler limits the number of units of each work type that run at once.  Units started while
+// their work type is at its limit wait in a pending queue, and are started in order as running
+// units of the same type complete.  Units deferred to a future start time wait on a timer, as do
+// running units with a timeout.
+type scheduler struct {
+	lock     *sync.Mutex
+	running  map[string]map[string]bool
+	pending  []*queuedUnit
+	deferred map[string]*time.Timer
+	timeouts map[string]*time.Timer
+}
+
+// queuedUnit is a unit waiting in the pending queue
+type queuedUnit struct {
+	unit     WorkUnit
+	typeName string
+}
+
+// newScheduler allocates a new scheduler
+func newScheduler() *scheduler {
+	return &scheduler{
+		lock:     &sync.Mutex{},
+		running:  make(map[string]map[string]bool),
+		pending:  make([]*queuedUnit, 0),
+		deferred: make(map[string]*time.Timer),
+		timeouts: make(map[string]*time.Timer),
+	}
+}
+
+// SetWorkTypeLimit sets the maximum number of units of a registered work type that can run at
+// once.  Zero means no limit.
+func (w *Workceptor) SetWorkTypeLimit(typeName string, limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("work type limit must not be negative")
+	}
+	w.workTypesLock.Lock()
+	defer w.workTypesLock.Unlock()
+	wt, ok := w.workTypes[typeName]
+	if !ok {
+		return fmt.Errorf("unknown work type %s", typeName)
+	}
+	wt.maxConcurrent = limit
+	return nil
+}
+
+// workTypeLimit returns the concurrency limit of a work type
+func (w *Workceptor) workTypeLimit(typeName string) int {
+	w.workTypesLock.RLock()
+	defer w.workTypesLock.RUnlock()
+	wt, ok := w.workTypes[typeName]
+	if !ok {
+		return 0
+	}
+	return wt.maxConcurrent
+}
+
+// RunningCount returns the number of units of a work type that the scheduler has started and
+// that have not yet completed
+func (w *Workceptor) RunningCount(typeName string) int {
+	w.scheduler.lock.Lock()
+	defer w.scheduler.lock.Unlock()
+	return len(w.scheduler.running[typeName])
+}
+
+// scheduleUnit starts a unit if its work type is below its concurrency limit, or queues it
+// otherwise.  Queued units return ErrPending.
+func (w *Workceptor) scheduleUnit(unit WorkUnit) error {
+	typeName := unit.Status().WorkType
+	limit := w.workTypeLimit(typeName)
+	sch := w.scheduler
+	sch.lock.Lock()
+	if limit > 0 && len(sch.running[typeName]) >= limit {
+		sch.pending = append(sch.pending, &queuedUnit{
+			unit:     unit,
+			typeName: typeName,
+		})
+		sch.lock.Unlock()
+		unit.UpdateBasicStatus(WorkStatePending, fmt.Sprintf("Waiting for one of %d %s slots", limit, typeName), 0)
+		return ErrPending
+	}
+	sch.markRunning(typeName, unit.ID())
+	sch.lock.Unlock()
+	w.armUnitTimeout(unit)
+	err := unit.Start()
+	if err != nil && !IsPending(err) {
+		w.unitCompleted(unit.ID(), typeName)
+	}
+	return err
+}
+
+// restoreRunningUnit counts a unit found running when units are loaded from storage, so that it
+// holds a slot of its work type until it completes
+func (w *Workceptor) restoreRunningUnit(unit WorkUnit) {
+	sch := w.scheduler
+	sch.lock.Lock()
+	defer sch.lock.Unlock()
+	sch.markRunning(unit.Status().WorkType, unit.ID())
+}
+
+// markRunning records a unit as running.  The caller must already hold the lock.
+func (sch *scheduler) markRunning(typeName string, unitID string) {
+	units, ok := sch.running[typeName]
+	if !ok {
+		units = make(map[string]bool)
+		sch.running[typeName] = units
+	}
+	units[unitID] = true
+}
+
+// unitCompleted is called when a unit reaches a completed state, to free its slot and start the
+// next queued unit of the same work type
+func (w *Workceptor) unitCompleted(unitID string, typeName string) {
+	sch := w.scheduler
+	sch.lock.Lock()
+	units := sch.running[typeName]
+	if !units[unitID] {
+		sch.lock.Unlock()
+		return
+	}
+	delete(units, unitID)
+	var next WorkUnit
+	for i, qu := range sch.pending {
+		if qu.typeName == typeName {
+			next = qu.unit
+			sch.pending = append(sch.pending[:i], sch.pending[i+1:]...)
+			sch.markRunning(typeName, next.ID())
+			break
+		}
+	}
+	sch.lock.Unlock()
+	if next == nil {
+		return
+	}
+	go func() {
+		w.armUnitTimeout(next)
+		err := next.Start()
+		if err != nil && !IsPending(err) {
+			sublogger.Error("Error starting queued unit %s: %s\n", next.ID(), err)
+			next.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Error starting worker: %s", err), 0)
+			w.unitCompleted(next.ID(), typeName)
+		}
+	}()
+}
+
+// dequeueUnit removes a unit from the pending queue, returning true if it was queued
+func (w *Workceptor) dequeueUnit(unitID string) bool {
+	sch := w.scheduler
+	sch.lock.Lock()
+	defer sch.lock.Unlock()
+	for i, qu := range sch.pending {
+		if qu.unit.ID() == unitID {
+			sch.pending = append(sch.pending[:i], sch.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// cancelQueuedUnit removes a unit from the pending queue or stops its deferred start, if it is
+// waiting for either, and marks it as failed.  Returns true if the unit was waiting.  The unit
+// is not retried after this, whether or not it was waiting.
+func (w *Workceptor) cancelQueuedUnit(unit WorkUnit) bool {
+	w.stopRetries(unit)
+	if w.dequeueUnit(unit.ID()) || w.undeferUnit(unit.ID()) {
+		unit.UpdateBasicStatus(WorkStateFailed, "Cancelled before starting", 0)
+		return true
+	}
+	return false
+}
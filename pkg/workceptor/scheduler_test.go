@@ -0,0 +1,223 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyTracker records how many units of each work type are running, and the most seen at once
+type concurrencyTracker struct {
+	lock    *sync.Mutex
+	current map[string]int
+	max     map[string]int
+}
+
+func (ct *concurrencyTracker) start(typeName string) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	ct.current[typeName]++
+	if ct.current[typeName] > ct.max[typeName] {
+		ct.max[typeName] = ct.current[typeName]
+	}
+}
+
+func (ct *concurrencyTracker) stop(typeName string) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	ct.current[typeName]--
+}
+
+// gatedUnit is a work unit that runs until its gate is closed
+type gatedUnit struct {
+	BaseWorkUnit
+	gate    chan struct{}
+	tracker *concurrencyTracker
+}
+
+func (gu *gatedUnit) Start() error {
+	typeName := gu.Status().WorkType
+	gu.tracker.start(typeName)
+	gu.UpdateBasicStatus(WorkStateRunning, "Running", 0)
+	go func() {
+		<-gu.gate
+		gu.tracker.stop(typeName)
+		gu.UpdateBasicStatus(WorkStateSucceeded, "Done", 0)
+	}()
+	return nil
+}
+
+func (gu *gatedUnit) Restart() error {
+	return nil
+}
+
+func (gu *gatedUnit) Cancel() error {
+	return nil
+}
+
+func TestWorkTypeLimits(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := make(chan struct{})
+	tracker := &concurrencyTracker{
+		lock:    &sync.Mutex{},
+		current: make(map[string]int),
+		max:     make(map[string]int),
+	}
+	newGatedWorker := func() WorkUnit {
+		return &gatedUnit{
+			gate:    gate,
+			tracker: tracker,
+		}
+	}
+	limits := map[string]int{"heavy": 2, "light": 5}
+	for typeName, limit := range limits {
+		err = w.RegisterWorker(typeName, newGatedWorker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.SetWorkTypeLimit(typeName, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.SetWorkTypeLimit("nonexistent", 1)
+	if err == nil {
+		t.Fatal("limit was set on an unregistered work type")
+	}
+
+	units := make([]WorkUnit, 0)
+	for typeName, limit := range limits {
+		for i := 0; i < limit+2; i++ {
+			unit, err := w.AllocateUnit(typeName, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			units = append(units, unit)
+			err = w.StartUnit(unit.ID())
+			if i < limit && err != nil {
+				t.Fatalf("unit %d of %s did not start: %s", i, typeName, err)
+			}
+			if i >= limit && !IsPending(err) {
+				t.Fatalf("unit %d of %s beyond the limit was not queued: %v", i, typeName, err)
+			}
+		}
+	}
+	for typeName, limit := range limits {
+		if w.RunningCount(typeName) != limit {
+			t.Fatalf("%s has %d running units, expected %d", typeName, w.RunningCount(typeName), limit)
+		}
+	}
+
+	// Let everything finish, which starts the queued units
+	close(gate)
+	deadline := time.Now().Add(10 * time.Second)
+	for _, unit := range units {
+		for unit.Status().State != WorkStateSucceeded {
+			if time.Now().After(deadline) {
+				t.Fatalf("unit %s did not complete: %v", unit.ID(), unit.Status())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	for typeName, limit := range limits {
+		if tracker.max[typeName] != limit {
+			t.Fatalf("%s ran %d units at once, expected at most %d", typeName, tracker.max[typeName], limit)
+		}
+		for w.RunningCount(typeName) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s still has running units after completion", typeName)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestRestoredUnitsHoldSlots(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	gate := make(chan struct{})
+	defer close(gate)
+	tracker := &concurrencyTracker{
+		lock:    &sync.Mutex{},
+		current: make(map[string]int),
+		max:     make(map[string]int),
+	}
+	newLimitedWorkceptor := func() *Workceptor {
+		w, err := New(context.Background(), nc, tmpdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.RegisterWorker("heavy", func() WorkUnit {
+			return &gatedUnit{
+				gate:    gate,
+				tracker: tracker,
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.SetWorkTypeLimit("heavy", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w1 := newLimitedWorkceptor()
+	unit, err := w1.AllocateUnit("heavy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w1.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart, the running unit still holds the only slot
+	w2 := newLimitedWorkceptor()
+	ids := w2.ListKnownUnitIDs()
+	if len(ids) != 1 || ids[0] != unit.ID() {
+		t.Fatalf("unexpected unit list %v", ids)
+	}
+	if w2.RunningCount("heavy") != 1 {
+		t.Fatalf("restored unit was not counted as running, count is %d", w2.RunningCount("heavy"))
+	}
+	unit2, err := w2.AllocateUnit("heavy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w2.StartUnit(unit2.ID())
+	if !IsPending(err) {
+		t.Fatalf("unit beyond the limit was not queued: %v", err)
+	}
+
+	// Completing the restored unit frees its slot for the queued one
+	restored, err := w2.findUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.UpdateBasicStatus(WorkStateSucceeded, "Done", 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for unit2.Status().State != WorkStateRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("queued unit did not start: %v", unit2.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,240 @@
+package workceptor
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/cmdline"
+	"github.com/project-receptor/receptor/pkg/controlsvc"
+	"io/ioutil"
+	"time"
+)
+
+// signatureMaxAge is how far the signing time of a work submission may be from the current time
+// before its signature is no longer accepted
+const signatureMaxAge = 5 * time.Minute
+
+// workSignaturePayload is the data covered by the signature of a work submission.  The submitting
+// and target nodes are included so a signed submission cannot be replayed from or to another node.
+type workSignaturePayload struct {
+	Submitter string
+	Target    string
+	WorkType  string
+	Params    string
+	SignedAt  string
+}
+
+// readPEMBlock reads the first PEM block of a file
+func readPEMBlock(filename string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", filename)
+	}
+	return block, nil
+}
+
+// LoadSigningKey loads an RSA or Ed25519 private key from a PEM file
+func LoadSigningKey(filename string) (crypto.Signer, error) {
+	block, err := readPEMBlock(filename)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err == nil {
+		return rsaKey, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key in %s: %s", filename, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("private key in %s is not an RSA or Ed25519 key", filename)
+}
+
+// LoadVerificationKey loads an RSA or Ed25519 public key from a PEM file
+func LoadVerificationKey(filename string) (crypto.PublicKey, error) {
+	block, err := readPEMBlock(filename)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err == nil {
+		return rsaKey, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse public key in %s: %s", filename, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("public key in %s is not an RSA or Ed25519 key", filename)
+}
+
+// signData signs data with an RSA (PKCS #1 v1.5 over SHA-256) or Ed25519 key
+func signData(key crypto.Signer, data []byte) ([]byte, error) {
+	_, ok := key.(ed25519.PrivateKey)
+	if ok {
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(data)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// verifyData returns true if sig is a valid signature of data by the holder of key
+func verifyData(key crypto.PublicKey, data []byte, sig []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, sig)
+	}
+	return false
+}
+
+// SetSigningKey sets the key used to sign work this node submits to other nodes
+func (w *Workceptor) SetSigningKey(key crypto.Signer) {
+	w.signingKey = key
+}
+
+// AddVerificationKey adds a key trusted to sign work submitted to this node.  Once any key is
+// added, work submitted by other nodes is only accepted if it is signed by a trusted key.
+func (w *Workceptor) AddVerificationKey(key crypto.PublicKey) {
+	w.verificationKeys = append(w.verificationKeys, key)
+}
+
+// signSubmission signs a work submission to a target node.  It returns the signature and the
+// signing time, or empty strings if this node has no signing key.
+func (w *Workceptor) signSubmission(target string, workType string, params string) (string, string, error) {
+	if w.signingKey == nil {
+		return "", "", nil
+	}
+	payload := workSignaturePayload{
+		Submitter: w.nc.NodeID(),
+		Target:    target,
+		WorkType:  workType,
+		Params:    params,
+		SignedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", "", err
+	}
+	sig, err := signData(w.signingKey, data)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), payload.SignedAt, nil
+}
+
+// verifySubmission checks the signature of a work submission made by another node
+func (w *Workceptor) verifySubmission(submitter string, workType string, params string,
+	signature string, signedAt string) error {
+	if signature == "" {
+		return fmt.Errorf("work is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %s", err)
+	}
+	signedTime, err := time.Parse(time.RFC3339Nano, signedAt)
+	if err != nil {
+		return fmt.Errorf("malformed signing time: %s", err)
+	}
+	age := time.Since(signedTime)
+	if age > signatureMaxAge || age < -signatureMaxAge {
+		return fmt.Errorf("signature was made at %s, which is too far from the current time", signedAt)
+	}
+	data, err := json.Marshal(workSignaturePayload{
+		Submitter: submitter,
+		Target:    w.nc.NodeID(),
+		WorkType:  workType,
+		Params:    params,
+		SignedAt:  signedAt,
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range w.verificationKeys {
+		if verifyData(key, data, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature does not match any trusted key")
+}
+
+// checkSubmission rejects work submitted by another node over the Receptor network, unless it
+// is signed by a trusted key.  Work submitted through local control sockets is always accepted.
+// Does nothing if no verification keys are configured.
+func (w *Workceptor) checkSubmission(info *controlsvc.ConnectionInfo, workType string, params string,
+	signature string, signedAt string) error {
+	if len(w.verificationKeys) == 0 || info == nil || info.NodeID == "" {
+		return nil
+	}
+	err := w.verifySubmission(info.NodeID, workType, params, signature, signedAt)
+	if err != nil {
+		sublogger.Warning("Rejected %s work submitted by node %s: %s\n", workType, info.NodeID, err)
+		return fmt.Errorf("work submission rejected: %s", err)
+	}
+	return nil
+}
+
+// **************************************************************************
+// Command line
+// **************************************************************************
+
+// WorkSigningCfg is the cmdline configuration object for signing work submitted to other nodes
+type WorkSigningCfg struct {
+	PrivateKey string `required:"true" description:"PEM file containing the RSA or Ed25519 private key to sign work with"`
+}
+
+// Prepare sets the signing key of the main instance
+func (cfg WorkSigningCfg) Prepare() error {
+	key, err := LoadSigningKey(cfg.PrivateKey)
+	if err != nil {
+		return err
+	}
+	MainInstance.SetSigningKey(key)
+	return nil
+}
+
+// WorkVerificationCfg is the cmdline configuration object for a key trusted to sign work
+type WorkVerificationCfg struct {
+	PublicKey string `required:"true" description:"PEM file containing an RSA or Ed25519 public key trusted to sign work"`
+}
+
+// Prepare adds the key to the main instance
+func (cfg WorkVerificationCfg) Prepare() error {
+	key, err := LoadVerificationKey(cfg.PublicKey)
+	if err != nil {
+		return err
+	}
+	MainInstance.AddVerificationKey(key)
+	return nil
+}
+
+func init() {
+	cmdline.AddConfigType("work-signing", "Sign work submitted to other nodes", WorkSigningCfg{}, false, true, false, false, workersSection)
+	cmdline.AddConfigType("work-verification", "Only run work from other nodes if it is signed by this or another trusted key",
+		WorkVerificationCfg{}, false, false, false, false, workersSection)
+}
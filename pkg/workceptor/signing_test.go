@@ -0,0 +1,130 @@
+package workceptor
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/project-receptor/receptor/pkg/controlsvc"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes the private and public halves of a key to PEM files, and returns their names
+func writeKeyPair(t *testing.T, dir string, name string, key crypto.Signer) (string, string) {
+	privBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privFile := path.Join(dir, name+".key")
+	pubFile := path.Join(dir, name+".pub")
+	err = ioutil.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privFile, pubFile
+}
+
+// newSigningWorkceptor returns a Workceptor for a node, with the key pair in the given files loaded
+func newSigningWorkceptor(t *testing.T, nodeID string, privFile string, pubFile string) *Workceptor {
+	w, err := NewWithStorage(context.Background(), netceptor.New(context.Background(), nodeID, nil), NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privFile != "" {
+		key, err := LoadSigningKey(privFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetSigningKey(key)
+	}
+	if pubFile != "" {
+		key, err := LoadVerificationKey(pubFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.AddVerificationKey(key)
+	}
+	return w
+}
+
+func TestWorkSigning(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ed25519": edKey} {
+		privFile, pubFile := writeKeyPair(t, tmpdir, name, key)
+		submitter := newSigningWorkceptor(t, "node1", privFile, "")
+		executor := newSigningWorkceptor(t, "node2", "", pubFile)
+		bystander := newSigningWorkceptor(t, "node3", "", pubFile)
+		remote := &controlsvc.ConnectionInfo{NodeID: "node1"}
+
+		signature, signedAt, err := submitter.signSubmission("node2", "echo", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = executor.checkSubmission(remote, "echo", "hello", signature, signedAt)
+		if err != nil {
+			t.Fatalf("%s: valid signature rejected: %s", name, err)
+		}
+		err = executor.checkSubmission(remote, "echo", "goodbye", signature, signedAt)
+		if err == nil {
+			t.Fatalf("%s: accepted a signature over different params", name)
+		}
+		err = executor.checkSubmission(&controlsvc.ConnectionInfo{NodeID: "node4"}, "echo", "hello", signature, signedAt)
+		if err == nil {
+			t.Fatalf("%s: accepted a signature replayed by another node", name)
+		}
+		err = bystander.checkSubmission(remote, "echo", "hello", signature, signedAt)
+		if err == nil {
+			t.Fatalf("%s: accepted a signature made for another node", name)
+		}
+		err = executor.checkSubmission(remote, "echo", "hello", "", "")
+		if err == nil {
+			t.Fatalf("%s: accepted unsigned work", name)
+		}
+		err = executor.checkSubmission(&controlsvc.ConnectionInfo{Listener: "unix:/tmp/receptor.sock"}, "echo", "hello", "", "")
+		if err != nil {
+			t.Fatalf("%s: rejected unsigned work from a local control socket: %s", name, err)
+		}
+
+		oldTime := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+		err = executor.verifySubmission("node1", "echo", "hello", signature, oldTime)
+		if err == nil || !strings.Contains(err.Error(), "too far") {
+			t.Fatalf("%s: unexpected error from expired signature: %v", name, err)
+		}
+	}
+
+	// Without verification keys, unsigned work from other nodes is accepted
+	w := newSigningWorkceptor(t, "node2", "", "")
+	err = w.checkSubmission(&controlsvc.ConnectionInfo{NodeID: "node1"}, "echo", "hello", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,343 @@
+package workceptor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// Storage is the persistence layer for work units.  Each unit has a metadata record, which is
+// its StatusFileData, and any number of named data streams, such as "stdin" and "stdout".
+type Storage interface {
+	// CreateUnit allocates storage for a new unit, returning an error satisfying os.IsExist if it already exists
+	CreateUnit(unitID string) error
+	// ListUnits returns the IDs of all units in the storage
+	ListUnits() ([]string, error)
+	// DeleteUnit removes a unit's metadata and data streams
+	DeleteUnit(unitID string) error
+	// GetStatus loads a unit's metadata into sfd
+	GetStatus(unitID string, sfd *StatusFileData) error
+	// PutStatus replaces a unit's metadata with sfd
+	PutStatus(unitID string, sfd *StatusFileData) error
+	// UpdateStatus atomically loads a unit's metadata into sfd, calls statusFunc to modify it, and saves it
+	UpdateStatus(unitID string, sfd *StatusFileData, statusFunc func(*StatusFileData)) error
+	// OpenWriter opens a data stream for writing, truncating it unless appendData is set
+	OpenWriter(unitID string, stream string, appendData bool) (io.WriteCloser, error)
+	// OpenReader opens a data stream for reading, starting at the given offset.  If the stream
+	// does not exist, the error satisfies os.IsNotExist.
+	OpenReader(unitID string, stream string, offset int64) (io.ReadCloser, error)
+	// StreamSize returns the current length of a data stream.  If the stream does not exist, the
+	// error satisfies os.IsNotExist.
+	StreamSize(unitID string, stream string) (int64, error)
+	// LocalDir returns a directory on the local filesystem holding the unit's files, or an empty
+	// string if the storage is not backed by the local filesystem.
+	LocalDir(unitID string) string
+}
+
+// =============================================================================================== //
+
+// FileStorage is a Storage that keeps each unit in a directory on the local filesystem
+type FileStorage struct {
+	dataDir string
+}
+
+// NewFileStorage creates a new FileStorage rooted at the given directory
+func NewFileStorage(dataDir string) *FileStorage {
+	return &FileStorage{
+		dataDir: dataDir,
+	}
+}
+
+// CreateUnit creates the unit directory
+func (fs *FileStorage) CreateUnit(unitID string) error {
+	unitdir := path.Join(fs.dataDir, unitID)
+	_, err := os.Stat(unitdir)
+	if err == nil {
+		return &os.PathError{Op: "create", Path: unitdir, Err: os.ErrExist}
+	}
+	return os.MkdirAll(unitdir, 0700)
+}
+
+// ListUnits returns the names of the unit directories
+func (fs *FileStorage) ListUnits() ([]string, error) {
+	files, err := ioutil.ReadDir(fs.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	units := make([]string, 0, len(files))
+	for i := range files {
+		if files[i].IsDir() {
+			units = append(units, files[i].Name())
+		}
+	}
+	return units, nil
+}
+
+// DeleteUnit removes the unit directory
+func (fs *FileStorage) DeleteUnit(unitID string) error {
+	return os.RemoveAll(path.Join(fs.dataDir, unitID))
+}
+
+// GetStatus loads the unit's status file
+func (fs *FileStorage) GetStatus(unitID string, sfd *StatusFileData) error {
+	return sfd.Load(path.Join(fs.dataDir, unitID, "status"))
+}
+
+// PutStatus saves the unit's status file
+func (fs *FileStorage) PutStatus(unitID string, sfd *StatusFileData) error {
+	return sfd.Save(path.Join(fs.dataDir, unitID, "status"))
+}
+
+// UpdateStatus atomically updates the unit's status file
+func (fs *FileStorage) UpdateStatus(unitID string, sfd *StatusFileData, statusFunc func(*StatusFileData)) error {
+	return sfd.UpdateFullStatus(path.Join(fs.dataDir, unitID, "status"), statusFunc)
+}
+
+// OpenWriter opens a file in the unit directory for writing
+func (fs *FileStorage) OpenWriter(unitID string, stream string, appendData bool) (io.WriteCloser, error) {
+	flags := os.O_CREATE + os.O_WRONLY
+	if appendData {
+		flags += os.O_APPEND
+	} else {
+		flags += os.O_TRUNC
+	}
+	return os.OpenFile(path.Join(fs.dataDir, unitID, stream), flags, 0600)
+}
+
+// OpenReader opens a file in the unit directory for reading
+func (fs *FileStorage) OpenReader(unitID string, stream string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(path.Join(fs.dataDir, unitID, stream))
+	if err != nil {
+		return nil, err
+	}
+	newPos, err := file.Seek(offset, 0)
+	if err == nil && newPos != offset {
+		err = fmt.Errorf("seek to %d returned %d", offset, newPos)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// StreamSize returns the size of a file in the unit directory
+func (fs *FileStorage) StreamSize(unitID string, stream string) (int64, error) {
+	stat, err := os.Stat(path.Join(fs.dataDir, unitID, stream))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// LocalDir returns the unit directory
+func (fs *FileStorage) LocalDir(unitID string) string {
+	return path.Join(fs.dataDir, unitID)
+}
+
+// =============================================================================================== //
+
+// MemoryStorage is a Storage that keeps all units in memory, for nodes that do not need their
+// work units to survive a restart.  Work types that launch external processes cannot use it.
+type MemoryStorage struct {
+	lock  *sync.RWMutex
+	units map[string]*memoryUnit
+}
+
+// memoryUnit holds the data of a single unit in a MemoryStorage
+type memoryUnit struct {
+	status  []byte
+	streams map[string][]byte
+}
+
+// NewMemoryStorage creates a new, empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		lock:  &sync.RWMutex{},
+		units: make(map[string]*memoryUnit),
+	}
+}
+
+// getUnit returns a unit's record.  The caller must already hold the lock.
+func (ms *MemoryStorage) getUnit(unitID string) (*memoryUnit, error) {
+	mu, ok := ms.units[unitID]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: unitID, Err: os.ErrNotExist}
+	}
+	return mu, nil
+}
+
+// CreateUnit creates an empty unit record
+func (ms *MemoryStorage) CreateUnit(unitID string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	_, ok := ms.units[unitID]
+	if ok {
+		return &os.PathError{Op: "create", Path: unitID, Err: os.ErrExist}
+	}
+	ms.units[unitID] = &memoryUnit{
+		streams: make(map[string][]byte),
+	}
+	return nil
+}
+
+// ListUnits returns the IDs of the stored units, in sorted order
+func (ms *MemoryStorage) ListUnits() ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	units := make([]string, 0, len(ms.units))
+	for unitID := range ms.units {
+		units = append(units, unitID)
+	}
+	sort.Strings(units)
+	return units, nil
+}
+
+// DeleteUnit removes a unit record
+func (ms *MemoryStorage) DeleteUnit(unitID string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.units, unitID)
+	return nil
+}
+
+// GetStatus decodes the unit's stored status
+func (ms *MemoryStorage) GetStatus(unitID string, sfd *StatusFileData) error {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	mu, err := ms.getUnit(unitID)
+	if err != nil {
+		return err
+	}
+	if mu.status == nil {
+		return &os.PathError{Op: "open", Path: unitID + "/status", Err: os.ErrNotExist}
+	}
+	return sfd.loadFromFile(bytes.NewReader(mu.status))
+}
+
+// PutStatus encodes and stores the unit's status
+func (ms *MemoryStorage) PutStatus(unitID string, sfd *StatusFileData) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	mu, err := ms.getUnit(unitID)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	err = sfd.saveToFile(buf)
+	if err != nil {
+		return err
+	}
+	mu.status = buf.Bytes()
+	return nil
+}
+
+// UpdateStatus atomically updates the unit's stored status
+func (ms *MemoryStorage) UpdateStatus(unitID string, sfd *StatusFileData, statusFunc func(*StatusFileData)) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	mu, err := ms.getUnit(unitID)
+	if err != nil {
+		return err
+	}
+	if mu.status != nil {
+		err = sfd.loadFromFile(bytes.NewReader(mu.status))
+		if err != nil {
+			return err
+		}
+	}
+	statusFunc(sfd)
+	buf := &bytes.Buffer{}
+	err = sfd.saveToFile(buf)
+	if err != nil {
+		return err
+	}
+	mu.status = buf.Bytes()
+	return nil
+}
+
+// memoryWriter appends written data to a stream of a MemoryStorage
+type memoryWriter struct {
+	ms     *MemoryStorage
+	unitID string
+	stream string
+}
+
+// Write appends data to the stream
+func (mw *memoryWriter) Write(p []byte) (int, error) {
+	mw.ms.lock.Lock()
+	defer mw.ms.lock.Unlock()
+	mu, err := mw.ms.getUnit(mw.unitID)
+	if err != nil {
+		return 0, err
+	}
+	mu.streams[mw.stream] = append(mu.streams[mw.stream], p...)
+	return len(p), nil
+}
+
+// Close does nothing, since data is stored as soon as it is written
+func (mw *memoryWriter) Close() error {
+	return nil
+}
+
+// OpenWriter returns a writer that appends to the stream, truncating it first unless appendData is set
+func (ms *MemoryStorage) OpenWriter(unitID string, stream string, appendData bool) (io.WriteCloser, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	mu, err := ms.getUnit(unitID)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := mu.streams[stream]
+	if !ok || !appendData {
+		mu.streams[stream] = make([]byte, 0)
+	}
+	return &memoryWriter{
+		ms:     ms,
+		unitID: unitID,
+		stream: stream,
+	}, nil
+}
+
+// OpenReader returns a reader over a snapshot of the stream's current contents
+func (ms *MemoryStorage) OpenReader(unitID string, stream string, offset int64) (io.ReadCloser, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	mu, err := ms.getUnit(unitID)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := mu.streams[stream]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: unitID + "/" + stream, Err: os.ErrNotExist}
+	}
+	if offset > int64(len(data)) {
+		return nil, fmt.Errorf("offset %d is beyond the end of %s", offset, stream)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+// StreamSize returns the length of the stream
+func (ms *MemoryStorage) StreamSize(unitID string, stream string) (int64, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	mu, err := ms.getUnit(unitID)
+	if err != nil {
+		return 0, err
+	}
+	data, ok := mu.streams[stream]
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: unitID + "/" + stream, Err: os.ErrNotExist}
+	}
+	return int64(len(data)), nil
+}
+
+// LocalDir returns an empty string, because a MemoryStorage has no local files
+func (ms *MemoryStorage) LocalDir(unitID string) string {
+	return ""
+}
@@ -0,0 +1,164 @@
+package workceptor
+
+import (
+	"bytes"
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// upperUnit is a work unit that copies its stdin to stdout in upper case, using only the Storage interface
+type upperUnit struct {
+	BaseWorkUnit
+}
+
+func newUpperWorker() WorkUnit {
+	return &upperUnit{}
+}
+
+func (uu *upperUnit) Start() error {
+	stdin, err := uu.w.storage.OpenReader(uu.ID(), "stdin", 0)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(stdin)
+	_ = stdin.Close()
+	if err != nil {
+		return err
+	}
+	stdout, err := uu.w.storage.OpenWriter(uu.ID(), "stdout", false)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(bytes.ToUpper(data))
+	_ = stdout.Close()
+	if err != nil {
+		return err
+	}
+	uu.UpdateBasicStatus(WorkStateSucceeded, "Done", int64(len(data)))
+	return nil
+}
+
+func (uu *upperUnit) Restart() error {
+	return nil
+}
+
+func (uu *upperUnit) Cancel() error {
+	return nil
+}
+
+// runStorageFlow submits a unit, collects its results and releases it, checking each step
+func runStorageFlow(t *testing.T, w *Workceptor) {
+	err := w.RegisterWorker("upper", newUpperWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := w.AllocateUnit("upper", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := w.storage.OpenWriter(unit.ID(), "stdin", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stdin.Write([]byte("hello, storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stdin.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := w.UnitStatus(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != WorkStateSucceeded || status.WorkType != "upper" {
+		t.Fatalf("unexpected unit status %v", status)
+	}
+	ids := w.ListKnownUnitIDs()
+	if len(ids) != 1 || ids[0] != unit.ID() {
+		t.Fatalf("unexpected unit list %v", ids)
+	}
+
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+	resultChan, err := w.GetResults(unit.ID(), 6, doneChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]byte, 0)
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case data, ok := <-resultChan:
+			if !ok {
+				done = true
+				continue
+			}
+			results = append(results, data...)
+		case <-timeout:
+			t.Fatal("timed out waiting for results")
+		}
+	}
+	if string(results) != " STORAGE" {
+		t.Fatalf("unexpected results %q", results)
+	}
+
+	err = w.ReleaseUnit(unit.ID(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = w.ListKnownUnitIDs()
+	if len(ids) != 0 {
+		t.Fatalf("units remain after release: %v", ids)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStorageFlow(t, w)
+
+	// Work types that run external processes need a unit directory
+	err = w.RegisterWorker("command", newCommandWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := w.AllocateUnit("command", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unit.Start()
+	if err == nil {
+		t.Fatal("command unit started without filesystem storage")
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewFileStorage(path.Join(tmpdir, "node1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStorageFlow(t, w)
+}
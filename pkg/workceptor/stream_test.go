@@ -0,0 +1,172 @@
+package workceptor
+
+import (
+	"context"
+	"fmt"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"testing"
+	"time"
+)
+
+// stderrUnit is a work unit that writes each line it is given to stderr, until its channel is closed
+type stderrUnit struct {
+	BaseWorkUnit
+	lines chan string
+}
+
+func (su *stderrUnit) Start() error {
+	stderr, err := su.w.storage.OpenWriter(su.ID(), "stderr", false)
+	if err != nil {
+		return err
+	}
+	su.UpdateBasicStatus(WorkStateRunning, "Running", 0)
+	go func() {
+		for line := range su.lines {
+			_, _ = stderr.Write([]byte(line))
+		}
+		_ = stderr.Close()
+		su.UpdateBasicStatus(WorkStateSucceeded, "Done", 0)
+	}()
+	return nil
+}
+
+func (su *stderrUnit) Restart() error {
+	return nil
+}
+
+func (su *stderrUnit) Cancel() error {
+	return nil
+}
+
+func TestStreamStderr(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	err = w.RegisterWorker("stderr", func() WorkUnit {
+		return &stderrUnit{lines: lines}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := w.AllocateUnit("stderr", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written before we attach, so must be sent first
+	lines <- "first\n"
+
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+	streamChan, err := w.GetStream(unit.ID(), "stderr", 0, doneChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want string) {
+		got := ""
+		timeout := time.After(5 * time.Second)
+		for len(got) < len(want) {
+			select {
+			case data, ok := <-streamChan:
+				if !ok {
+					t.Fatalf("stream closed after %q, expected %q", got, want)
+				}
+				got += string(data)
+			case <-timeout:
+				t.Fatalf("timed out after receiving %q, expected %q", got, want)
+			}
+		}
+		if got != want {
+			t.Fatalf("received %q, expected %q", got, want)
+		}
+	}
+	expect("first\n")
+	lines <- "second\n"
+	expect("second\n")
+	lines <- "third\n"
+	expect("third\n")
+
+	close(lines)
+	select {
+	case data, ok := <-streamChan:
+		if ok {
+			t.Fatalf("unexpected data %q after unit completed", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed after the unit completed")
+	}
+}
+
+func TestTailOffset(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	err = w.RegisterWorker("stderr", func() WorkUnit {
+		return &stderrUnit{lines: lines}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := w.AllocateUnit("stderr", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines <- "first\n"
+
+	ct := &workceptorCommandType{w: w}
+	_, err = ct.InitFromString(fmt.Sprintf("tail %s stderr frames -1", unit.ID()))
+	if err == nil {
+		t.Fatal("accepted a negative offset")
+	}
+	// Resume after the first line, as a client that had already received it would
+	cmd, err := ct.InitFromString(fmt.Sprintf("tail %s stderr frames 6", unit.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, ok := cmd.(*workTailCommand)
+	if !ok {
+		t.Fatalf("tail with frames parsed as %T", cmd)
+	}
+	frames := make(chan map[string]interface{})
+	resultChan := make(chan map[string]interface{}, 1)
+	go func() {
+		cfr, err := tc.StreamFunc(nc, nil, frames)
+		if err != nil {
+			t.Error(err)
+		}
+		resultChan <- cfr
+	}()
+	lines <- "second\n"
+	select {
+	case frame := <-frames:
+		if frame["Data"] != "second\n" || frame["Offset"] != int64(6) {
+			t.Fatalf("unexpected frame %v", frame)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for output")
+	}
+	close(lines)
+	select {
+	case cfr := <-resultChan:
+		if cfr["Bytes"] != int64(7) {
+			t.Fatalf("unexpected result %v", cfr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tail did not finish after the unit completed")
+	}
+}
@@ -0,0 +1,116 @@
+package workceptor
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeoutGracePeriod is how long a unit that timed out may take to stop after it is cancelled,
+// before it is marked as failed regardless
+const timeoutGracePeriod = 5 * time.Second
+
+// SetUnitTimeout limits how long a unit may run.  Once the unit has been running for the timeout,
+// it is cancelled and marked as failed.  The timeout must be set before the unit starts.
+func (w *Workceptor) SetUnitTimeout(unitID string, timeout time.Duration) error {
+	unit, err := w.findUnit(unitID)
+	if err != nil {
+		return err
+	}
+	return setUnitTimeout(unit, timeout)
+}
+
+// setUnitTimeout saves the timeout of a unit in its status
+func setUnitTimeout(unit WorkUnit, timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	unit.UpdateFullStatus(func(status *StatusFileData) {
+		status.Timeout = timeout
+	})
+	return unit.LastUpdateError()
+}
+
+// timeoutExpired returns true if a unit loaded from storage is unfinished but has already run
+// past its deadline
+func timeoutExpired(status *StatusFileData) bool {
+	if IsComplete(status.State) {
+		return false
+	}
+	return status.TimedOut || (!status.Deadline.IsZero() && !time.Now().Before(status.Deadline))
+}
+
+// armUnitTimeout starts a timer that expires the unit once it has run for its timeout, if it has
+// one.  The deadline is saved in the unit's status when the unit first starts, so it still
+// applies if the node restarts.
+func (w *Workceptor) armUnitTimeout(unit WorkUnit) {
+	status := unit.Status()
+	if status.Timeout <= 0 || IsComplete(status.State) {
+		return
+	}
+	deadline := status.Deadline
+	if deadline.IsZero() {
+		unit.UpdateFullStatus(func(status *StatusFileData) {
+			if status.Deadline.IsZero() {
+				status.Deadline = time.Now().Add(status.Timeout)
+			}
+			deadline = status.Deadline
+		})
+	}
+	sch := w.scheduler
+	sch.lock.Lock()
+	defer sch.lock.Unlock()
+	oldTimer, ok := sch.timeouts[unit.ID()]
+	if ok {
+		oldTimer.Stop()
+	}
+	sch.timeouts[unit.ID()] = time.AfterFunc(time.Until(deadline), func() {
+		w.expireUnit(unit)
+	})
+}
+
+// disarmUnitTimeout stops the timeout timer of a unit, if it has one
+func (w *Workceptor) disarmUnitTimeout(unitID string) {
+	sch := w.scheduler
+	sch.lock.Lock()
+	defer sch.lock.Unlock()
+	timer, ok := sch.timeouts[unitID]
+	if !ok {
+		return
+	}
+	timer.Stop()
+	delete(sch.timeouts, unitID)
+}
+
+// expireUnit cancels a unit that has run past its deadline.  The unit is marked as timed out
+// first, so however the cancelled work ends, the unit is reported as failed due to the timeout.
+func (w *Workceptor) expireUnit(unit WorkUnit) {
+	w.disarmUnitTimeout(unit.ID())
+	if w.ctx.Err() != nil {
+		return
+	}
+	// The unit may complete at any moment, so check and mark it under the status lock
+	expired := false
+	var timeout time.Duration
+	unit.UpdateFullStatus(func(status *StatusFileData) {
+		if !IsComplete(status.State) {
+			status.TimedOut = true
+			expired = true
+		}
+		timeout = status.Timeout
+	})
+	if !expired {
+		return
+	}
+	sublogger.Warning("Work unit %s timed out after %s\n", unit.ID(), timeout)
+	err := unit.Cancel()
+	if err != nil && !IsPending(err) {
+		sublogger.Error("Error cancelling timed out unit %s: %s\n", unit.ID(), err)
+	}
+	time.AfterFunc(timeoutGracePeriod, func() {
+		unit.UpdateFullStatus(func(status *StatusFileData) {
+			if !IsComplete(status.State) {
+				status.setBasicStatus(WorkStateFailed, fmt.Sprintf("Timed out after %s", timeout), -1)
+			}
+		})
+	})
+}
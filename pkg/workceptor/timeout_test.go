@@ -0,0 +1,154 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// hangingUnit is a work unit that runs until it is cancelled
+type hangingUnit struct {
+	BaseWorkUnit
+	restarted chan struct{}
+	cancelled chan struct{}
+}
+
+func (hu *hangingUnit) Start() error {
+	hu.UpdateBasicStatus(WorkStateRunning, "Hanging", 0)
+	return nil
+}
+
+func (hu *hangingUnit) Restart() error {
+	hu.restarted <- struct{}{}
+	return nil
+}
+
+func (hu *hangingUnit) Cancel() error {
+	hu.cancelled <- struct{}{}
+	hu.UpdateBasicStatus(WorkStateFailed, "Killed", -1)
+	return nil
+}
+
+// newHangingWorkceptor returns a Workceptor with a "hang" work type whose units run until cancelled
+func newHangingWorkceptor(ctx context.Context, t *testing.T, nc *netceptor.Netceptor, storage Storage,
+	restarted chan struct{}, cancelled chan struct{}) *Workceptor {
+	w, err := NewWithStorage(ctx, nc, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("hang", func() WorkUnit {
+		return &hangingUnit{restarted: restarted, cancelled: cancelled}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// waitForTimedOut waits for a unit to fail due to its timeout
+func waitForTimedOut(t *testing.T, w *Workceptor, unitID string) {
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		status, err := w.UnitStatus(unitID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsComplete(status.State) {
+			if status.State != WorkStateFailed || !status.TimedOut || status.Detail != "Timed out after 300ms" {
+				t.Fatalf("unexpected status of timed out unit %+v", status)
+			}
+			return
+		}
+		if timeout.Err() != nil {
+			t.Fatal("timed out waiting for unit to time out")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestUnitTimeout(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	cancelled := make(chan struct{}, 1)
+	w := newHangingWorkceptor(context.Background(), t, nc, NewMemoryStorage(), make(chan struct{}, 1), cancelled)
+
+	unit, err := w.AllocateUnit("hang", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.SetUnitTimeout(unit.ID(), 0) == nil {
+		t.Fatal("accepted a zero timeout")
+	}
+	err = w.SetUnitTimeout(unit.ID(), 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForTimedOut(t, w, unit.ID())
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatal("unit timed out early")
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("timed out unit was not cancelled")
+	}
+}
+
+func TestUnitTimeoutSurvivesRestart(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	w1 := newHangingWorkceptor(ctx1, t, nc, NewFileStorage(path.Join(tmpdir, "node1")),
+		make(chan struct{}, 1), make(chan struct{}, 1))
+	unit, err := w1.AllocateUnit("hang", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w1.SetUnitTimeout(unit.ID(), 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w1.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shut down the first instance before the deadline, and bring up a new one on the same
+	// storage after it has passed
+	cancel1()
+	time.Sleep(500 * time.Millisecond)
+	restarted := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	w2 := newHangingWorkceptor(context.Background(), t, nc, NewFileStorage(path.Join(tmpdir, "node1")),
+		restarted, cancelled)
+	ids := w2.ListKnownUnitIDs()
+	if len(ids) != 1 || ids[0] != unit.ID() {
+		t.Fatalf("unexpected unit list %v", ids)
+	}
+	waitForTimedOut(t, w2, unit.ID())
+	select {
+	case <-restarted:
+		t.Fatal("unit was restarted after its deadline had passed")
+	default:
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("unit that ran past its deadline was not cancelled after restart")
+	}
+}
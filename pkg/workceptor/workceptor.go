@@ -2,55 +2,86 @@ package workceptor
 
 import (
 	"context"
+	"crypto"
 	"fmt"
 	"github.com/project-receptor/receptor/pkg/controlsvc"
 	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/project-receptor/receptor/pkg/netceptor"
 	"github.com/project-receptor/receptor/pkg/randstr"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// sublogger sends the log messages of the workceptor subsystem
+var sublogger = logger.Named("workceptor")
+
+// Policies for handling units found on disk whose work type is not registered
+const (
+	// UnknownWorkTypePending leaves the unit as-is, so it can resume if its work type is registered later
+	UnknownWorkTypePending = "pending"
+	// UnknownWorkTypeFail marks the unit as failed
+	UnknownWorkTypeFail = "fail"
+)
+
 // Workceptor is the main object that handles unit-of-work management
 type Workceptor struct {
-	ctx             context.Context
-	nc              *netceptor.Netceptor
-	dataDir         string
-	workTypesLock   *sync.RWMutex
-	workTypes       map[string]*workType
-	activeUnitsLock *sync.RWMutex
-	activeUnits     map[string]WorkUnit
+	ctx                   context.Context
+	nc                    *netceptor.Netceptor
+	storage               Storage
+	workTypesLock         *sync.RWMutex
+	workTypes             map[string]*workType
+	activeUnitsLock       *sync.RWMutex
+	activeUnits           map[string]WorkUnit
+	unknownWorkTypePolicy string
+	maintenanceMode       bool
+	verifyOnStartup       bool
+	scheduler             *scheduler
+	retention             *retention
+	signingKey            crypto.Signer
+	verificationKeys      []crypto.PublicKey
+	unitsScanned          int32
 }
 
 // workType is the record for a registered type of work
 type workType struct {
 	newWorkerFunc NewWorkerFunc
+	maxConcurrent int
 }
 
-// New constructs a new Workceptor instance
+// New constructs a new Workceptor instance that stores work units in the local filesystem
 func New(ctx context.Context, nc *netceptor.Netceptor, dataDir string) (*Workceptor, error) {
 	if dataDir == "" {
 		dataDir = path.Join(os.TempDir(), "receptor")
 	}
 	dataDir = path.Join(dataDir, nc.NodeID())
+	return NewWithStorage(ctx, nc, NewFileStorage(dataDir))
+}
+
+// NewWithStorage constructs a new Workceptor instance that stores work units in the given Storage
+func NewWithStorage(ctx context.Context, nc *netceptor.Netceptor, storage Storage) (*Workceptor, error) {
 	w := &Workceptor{
-		ctx:             ctx,
-		nc:              nc,
-		dataDir:         dataDir,
-		workTypesLock:   &sync.RWMutex{},
-		workTypes:       make(map[string]*workType),
-		activeUnitsLock: &sync.RWMutex{},
-		activeUnits:     make(map[string]WorkUnit),
+		ctx:                   ctx,
+		nc:                    nc,
+		storage:               storage,
+		workTypesLock:         &sync.RWMutex{},
+		workTypes:             make(map[string]*workType),
+		activeUnitsLock:       &sync.RWMutex{},
+		activeUnits:           make(map[string]WorkUnit),
+		unknownWorkTypePolicy: UnknownWorkTypePending,
+		scheduler:             newScheduler(),
+		retention:             newRetention(),
 	}
 	err := w.RegisterWorker("remote", newRemoteWorker)
 	if err != nil {
 		return nil, fmt.Errorf("could not register remote worker function: %s", err)
 	}
+	nc.AddConfigCheck("workceptor", w.checkWorkTypes)
 	return w, nil
 }
 
@@ -66,6 +97,15 @@ func stdoutSize(unitdir string) int64 {
 	return stat.Size()
 }
 
+// unitStdoutSize returns the size of a unit's stdout in storage, if it exists, or 0 otherwise
+func (w *Workceptor) unitStdoutSize(unitID string) int64 {
+	size, err := w.storage.StreamSize(unitID, "stdout")
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
 // RegisterWithControlService registers this workceptor instance with a control service instance
 func (w *Workceptor) RegisterWithControlService(cs *controlsvc.Server) error {
 	err := cs.AddControlFunc("work", &workceptorCommandType{
@@ -74,6 +114,25 @@ func (w *Workceptor) RegisterWithControlService(cs *controlsvc.Server) error {
 	if err != nil {
 		return fmt.Errorf("could not add work control function: %s", err)
 	}
+	err = cs.AddControlFunc("maintenance", &maintenanceCommandType{
+		w: w,
+	})
+	if err != nil {
+		return fmt.Errorf("could not add maintenance control function: %s", err)
+	}
+	cs.AddShutdownDrainer("workceptor", w.Drain)
+	cs.AddHealthCheck("workceptor", w.checkHealth)
+	return nil
+}
+
+// checkHealth reports the workceptor as ready once it has loaded the stored work units
+func (w *Workceptor) checkHealth() error {
+	if w.ctx.Err() != nil {
+		return fmt.Errorf("workceptor is shutting down")
+	}
+	if atomic.LoadInt32(&w.unitsScanned) == 0 {
+		return fmt.Errorf("stored work units have not been loaded yet")
+	}
 	return nil
 }
 
@@ -103,6 +162,40 @@ func (w *Workceptor) RegisterWorker(typeName string, newWorkerFunc NewWorkerFunc
 	return nil
 }
 
+// SetUnknownWorkTypePolicy sets how units with an unregistered work type are handled when found on disk
+func (w *Workceptor) SetUnknownWorkTypePolicy(policy string) error {
+	switch policy {
+	case UnknownWorkTypePending, UnknownWorkTypeFail:
+	default:
+		return fmt.Errorf("invalid unknown work type policy %s", policy)
+	}
+	w.activeUnitsLock.Lock()
+	w.unknownWorkTypePolicy = policy
+	w.activeUnitsLock.Unlock()
+	return nil
+}
+
+// checkWorkTypes is a config check that finds unfinished units whose work type is not registered
+func (w *Workceptor) checkWorkTypes() []netceptor.ConfigFinding {
+	findings := make([]netceptor.ConfigFinding, 0)
+	w.activeUnitsLock.RLock()
+	defer w.activeUnitsLock.RUnlock()
+	for id, worker := range w.activeUnits {
+		_, ok := worker.(*unknownUnit)
+		if !ok || IsComplete(worker.Status().State) {
+			continue
+		}
+		findings = append(findings, netceptor.ConfigFinding{
+			Severity: netceptor.FindingWarning,
+			Message:  fmt.Sprintf("work unit %s has unregistered work type %s", id, worker.Status().WorkType),
+		})
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		return findings[i].Message < findings[j].Message
+	})
+	return findings
+}
+
 func (w *Workceptor) generateUnitID(lock bool) (string, error) {
 	if lock {
 		w.activeUnitsLock.RLock()
@@ -113,12 +206,11 @@ func (w *Workceptor) generateUnitID(lock bool) (string, error) {
 		ident = randstr.RandomString(8)
 		_, ok := w.activeUnits[ident]
 		if !ok {
-			unitdir := path.Join(w.dataDir, ident)
-			_, err := os.Stat(unitdir)
-			if err == nil {
+			err := w.storage.CreateUnit(ident)
+			if os.IsExist(err) {
 				continue
 			}
-			return ident, os.MkdirAll(unitdir, 0700)
+			return ident, err
 		}
 	}
 }
@@ -133,6 +225,9 @@ func (w *Workceptor) AllocateUnit(workTypeName string, params string) (WorkUnit,
 	}
 	w.activeUnitsLock.Lock()
 	defer w.activeUnitsLock.Unlock()
+	if w.maintenanceMode {
+		return nil, fmt.Errorf("node is in maintenance mode")
+	}
 	ident, err := w.generateUnitID(false)
 	if err != nil {
 		return nil, err
@@ -162,44 +257,73 @@ func (w *Workceptor) AllocateRemoteUnit(remoteNode string, remoteWorkType string
 }
 
 func (w *Workceptor) scanForUnits() {
-	files, err := ioutil.ReadDir(w.dataDir)
+	units, err := w.storage.ListUnits()
 	if err != nil {
 		return
 	}
+	defer atomic.StoreInt32(&w.unitsScanned, 1)
 	w.activeUnitsLock.Lock()
 	defer w.activeUnitsLock.Unlock()
-	for i := range files {
-		fi := files[i]
-		if fi.IsDir() {
-			ident := fi.Name()
-			unitdir := path.Join(w.dataDir, ident)
-			_, ok := w.activeUnits[ident]
-			if !ok {
-				sfd := &StatusFileData{}
-				statusFilename := path.Join(unitdir, "status")
-				_ = sfd.Load(statusFilename)
-				w.workTypesLock.RLock()
-				wt, ok := w.workTypes[sfd.WorkType]
-				w.workTypesLock.RUnlock()
-				var worker WorkUnit
-				if ok {
-					worker = wt.newWorkerFunc()
-				} else {
-					worker = newUnknownWorker()
-				}
-				worker.Init(w, ident, sfd.WorkType, sfd.Params)
-				err = worker.Load()
+	for _, ident := range units {
+		_, ok := w.activeUnits[ident]
+		if !ok {
+			sfd := &StatusFileData{}
+			_ = w.storage.GetStatus(ident, sfd)
+			w.workTypesLock.RLock()
+			wt, ok := w.workTypes[sfd.WorkType]
+			w.workTypesLock.RUnlock()
+			var worker WorkUnit
+			if ok {
+				worker = wt.newWorkerFunc()
+			} else {
+				worker = newUnknownWorker()
+			}
+			worker.Init(w, ident, sfd.WorkType, sfd.Params)
+			var problems []string
+			if w.verifyOnStartup {
+				problems, err = w.VerifyUnit(ident)
 				if err != nil {
-					logger.Warning("Failed to restart worker %s due to read error: %s", unitdir, err)
-					worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Failed to restart: %s", err), stdoutSize(unitdir))
+					problems = []string{err.Error()}
 				}
-				err = worker.Restart()
-				if err != nil && !IsPending(err) {
-					logger.Warning("Failed to restart worker %s: %s", unitdir, err)
-					worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Failed to restart: %s", err), stdoutSize(unitdir))
+				for _, p := range problems {
+					sublogger.Warning("Work unit %s failed integrity check: %s\n", ident, p)
 				}
+			}
+			err = worker.Load()
+			if err != nil {
+				sublogger.Warning("Failed to restart worker %s due to read error: %s", ident, err)
+				worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Failed to restart: %s", err), w.unitStdoutSize(ident))
+			}
+			if len(problems) > 0 && !IsComplete(worker.Status().State) {
+				worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Integrity check failed: %s", problems[0]), w.unitStdoutSize(ident))
+			}
+			if !ok && w.unknownWorkTypePolicy == UnknownWorkTypeFail && !IsComplete(worker.Status().State) {
+				sublogger.Warning("Failing worker %s because work type %s is not registered\n", ident, sfd.WorkType)
+				worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Unknown work type %s", sfd.WorkType), w.unitStdoutSize(ident))
+			}
+			if ok && isDeferred(worker.Status()) {
+				w.armDeferredStart(worker, worker.Status().StartAt)
 				w.activeUnits[ident] = worker
+				continue
 			}
+			if ok && worker.Status().State == WorkStateRunning {
+				w.restoreRunningUnit(worker)
+			}
+			if ok && timeoutExpired(worker.Status()) {
+				// Rather than resume a unit whose time is up, make sure it is stopped
+				w.activeUnits[ident] = worker
+				go w.expireUnit(worker)
+				continue
+			}
+			err = worker.Restart()
+			if err != nil && !IsPending(err) {
+				sublogger.Warning("Failed to restart worker %s: %s", ident, err)
+				worker.UpdateBasicStatus(WorkStateFailed, fmt.Sprintf("Failed to restart: %s", err), w.unitStdoutSize(ident))
+			}
+			if ok {
+				w.armUnitTimeout(worker)
+			}
+			w.activeUnits[ident] = worker
 		}
 	}
 }
@@ -215,13 +339,13 @@ func (w *Workceptor) findUnit(unitID string) (WorkUnit, error) {
 	return unit, nil
 }
 
-// StartUnit starts a unit of work
+// StartUnit starts a unit of work, or queues it if its work type is at its concurrency limit
 func (w *Workceptor) StartUnit(unitID string) error {
 	unit, err := w.findUnit(unitID)
 	if err != nil {
 		return err
 	}
-	return unit.Start()
+	return w.scheduleUnit(unit)
 }
 
 // ListKnownUnitIDs returns a slice containing the known unit IDs
@@ -251,6 +375,7 @@ func (w *Workceptor) CancelUnit(unitID string) error {
 	if err != nil {
 		return err
 	}
+	w.cancelQueuedUnit(unit)
 	return unit.Cancel()
 }
 
@@ -260,6 +385,7 @@ func (w *Workceptor) ReleaseUnit(unitID string, force bool) error {
 	if err != nil {
 		return err
 	}
+	w.cancelQueuedUnit(unit)
 	return unit.Release(force)
 }
 
@@ -291,79 +417,115 @@ func sleepOrDone(doneChan <-chan struct{}, interval time.Duration) bool {
 
 // GetResults returns a live stream of the results of a unit
 func (w *Workceptor) GetResults(unitID string, startPos int64, doneChan chan struct{}) (chan []byte, error) {
+	return w.GetStream(unitID, "stdout", startPos, doneChan)
+}
+
+// GetStream returns a live stream of one of the data streams of a unit, such as stdout or stderr,
+// starting from the given position.  Data already written is sent first, followed by new data as
+// it is written, until the unit completes.
+func (w *Workceptor) GetStream(unitID string, stream string, startPos int64, doneChan chan struct{}) (chan []byte, error) {
+	resultChan, _, err := w.getStreamWithErrors(unitID, stream, startPos, doneChan)
+	return resultChan, err
+}
+
+// getStreamWithErrors is like GetStream, but if the stream cannot be read to completion, the
+// error is sent on the returned error channel, instead of the data channel being closed
+func (w *Workceptor) getStreamWithErrors(unitID string, stream string, startPos int64,
+	doneChan chan struct{}) (chan []byte, chan error, error) {
+	// Registering as a reader first means the unit cannot be released by the retention policy
+	// between being looked up and being streamed
+	err := w.addUnitReader(unitID)
+	if err != nil {
+		return nil, nil, err
+	}
 	w.scanForUnits()
 	w.activeUnitsLock.RLock()
 	unit, ok := w.activeUnits[unitID]
 	w.activeUnitsLock.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("unknown work unit %s", unitID)
+		w.removeUnitReader(unitID)
+		return nil, nil, fmt.Errorf("unknown work unit %s", unitID)
 	}
 	resultChan := make(chan []byte)
+	errChan := make(chan error, 1)
 	go func() {
-		unitdir := path.Join(w.dataDir, unitID)
-		stdoutFilename := path.Join(unitdir, "stdout")
-		// Wait for stdout file to exist
+		defer w.removeUnitReader(unitID)
+		// Wait for the stream to exist
 		for {
-			_, err := os.Stat(stdoutFilename)
+			_, err := w.storage.StreamSize(unitID, stream)
 			if err == nil {
 				break
 			} else if os.IsNotExist(err) {
 				if IsComplete(unit.Status().State) {
 					close(resultChan)
-					logger.Warning("Unit completed without producing any stdout\n")
+					sublogger.Warning("Unit completed without producing any %s\n", stream)
 					return
 				}
 				if sleepOrDone(doneChan, 250*time.Millisecond) {
 					return
 				}
 			} else {
-				logger.Error("Error accessing stdout file: %s\n", err)
+				sublogger.Error("Error accessing %s: %s\n", stream, err)
+				errChan <- fmt.Errorf("error accessing %s: %s", stream, err)
 				return
 			}
 		}
-		var stdout *os.File
+		var reader io.ReadCloser
 		var err error
 		filePos := startPos
+		completeSeen := false
 		buf := make([]byte, 1024)
 		for {
 			if sleepOrDone(doneChan, 250*time.Millisecond) {
 				return
 			}
-			if stdout == nil {
-				stdout, err = os.Open(stdoutFilename)
+			if reader == nil {
+				reader, err = w.storage.OpenReader(unitID, stream, filePos)
 				if err != nil {
 					continue
 				}
 			}
-			newPos, err := stdout.Seek(filePos, 0)
-			if newPos != filePos {
-				logger.Warning("Seek error processing stdout\n")
-				return
-			}
-			n, err := stdout.Read(buf)
+			n, err := reader.Read(buf)
 			if n > 0 {
 				filePos += int64(n)
-				resultChan <- buf[:n]
+				select {
+				case resultChan <- buf[:n]:
+				case <-doneChan:
+					_ = reader.Close()
+					return
+				}
 			}
 			if err == io.EOF {
-				err = stdout.Close()
+				err = reader.Close()
 				if err != nil {
-					logger.Error("Error closing stdout\n")
+					sublogger.Error("Error closing %s\n", stream)
+					errChan <- fmt.Errorf("error closing %s: %s", stream, err)
 					return
 				}
-				stdout = nil
-				stdoutSize := stdoutSize(unitdir)
-				if IsComplete(unit.Status().State) && stdoutSize >= unit.Status().StdoutSize {
+				reader = nil
+				if stream == "stdout" {
+					stdoutSize := w.unitStdoutSize(unitID)
+					if IsComplete(unit.Status().State) && stdoutSize >= unit.Status().StdoutSize {
+						close(resultChan)
+						sublogger.Info("Stdout complete - closing channel\n")
+						return
+					}
+				} else if completeSeen {
+					// The unit had already completed before this read reached the end of the stream
 					close(resultChan)
-					logger.Info("Stdout complete - closing channel\n")
+					sublogger.Info("%s complete - closing channel\n", stream)
 					return
+				} else if IsComplete(unit.Status().State) {
+					completeSeen = true
 				}
 				continue
 			} else if err != nil {
-				logger.Error("Error reading stdout: %s\n", err)
+				sublogger.Error("Error reading %s: %s\n", stream, err)
+				_ = reader.Close()
+				errChan <- fmt.Errorf("error reading %s: %s", stream, err)
 				return
 			}
 		}
 	}()
-	return resultChan, nil
+	return resultChan, errChan, nil
 }
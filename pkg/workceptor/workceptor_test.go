@@ -0,0 +1,185 @@
+package workceptor
+
+import (
+	"context"
+	"github.com/project-receptor/receptor/pkg/netceptor"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// persistUnknownUnit stores a running unit with an unregistered work type
+func persistUnknownUnit(t *testing.T, w *Workceptor, unitID string) {
+	err := w.storage.CreateUnit(unitID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sfd := &StatusFileData{
+		State:    WorkStateRunning,
+		Detail:   "Running",
+		WorkType: "no-such-plugin",
+	}
+	err = w.storage.PutStatus(unitID, sfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnknownWorkTypePolicy(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "receptor-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+
+	for _, tc := range []struct {
+		policy    string
+		wantState int
+	}{
+		{UnknownWorkTypePending, WorkStateRunning},
+		{UnknownWorkTypeFail, WorkStateFailed},
+	} {
+		w, err := New(context.Background(), nc, path.Join(tmpdir, tc.policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.SetUnknownWorkTypePolicy(tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		persistUnknownUnit(t, w, "unit1")
+		ids := w.ListKnownUnitIDs()
+		if len(ids) != 1 || ids[0] != "unit1" {
+			t.Fatalf("policy %s: unexpected unit list %v", tc.policy, ids)
+		}
+		status, err := w.UnitStatus("unit1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != tc.wantState {
+			t.Fatalf("policy %s: expected state %s, got %s (%s)", tc.policy,
+				WorkStateToString(tc.wantState), WorkStateToString(status.State), status.Detail)
+		}
+	}
+
+	w, err := New(context.Background(), nc, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.SetUnknownWorkTypePolicy("ignore")
+	if err == nil {
+		t.Fatal("invalid policy was accepted")
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.RegisterWorker("upper", newUpperWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := w.AllocateUnit("upper", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct := &maintenanceCommandType{w: w}
+	cc, err := ct.InitFromString("on cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfr, err := cc.ControlFunc(nc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled := cfr["CancelledUnits"].([]string)
+	if len(cancelled) != 1 || cancelled[0] != pending.ID() {
+		t.Fatalf("expected unit %s to be cancelled, got %v", pending.ID(), cancelled)
+	}
+	if !nc.MaintenanceMode() || !w.MaintenanceMode() {
+		t.Fatal("maintenance mode was not entered")
+	}
+	_, err = w.AllocateUnit("upper", "")
+	if err == nil {
+		t.Fatal("new work was accepted in maintenance mode")
+	}
+
+	cc, err = ct.InitFromString("off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cc.ControlFunc(nc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc.MaintenanceMode() || w.MaintenanceMode() {
+		t.Fatal("maintenance mode was not left")
+	}
+	_, err = w.AllocateUnit("upper", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	nc := netceptor.New(context.Background(), "node1", nil)
+	defer nc.Shutdown()
+	w, err := NewWithStorage(context.Background(), nc, NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := make(chan struct{})
+	tracker := &concurrencyTracker{
+		lock:    &sync.Mutex{},
+		current: make(map[string]int),
+		max:     make(map[string]int),
+	}
+	err = w.RegisterWorker("gated", func() WorkUnit {
+		return &gatedUnit{
+			gate:    gate,
+			tracker: tracker,
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := w.AllocateUnit("gated", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.StartUnit(unit.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	err = w.Drain(ctx)
+	cancel()
+	if err == nil {
+		t.Fatal("drain finished while a unit was still running")
+	}
+	if !w.MaintenanceMode() {
+		t.Fatal("drain did not enter maintenance mode")
+	}
+
+	close(gate)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = w.Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unit.Status().State != WorkStateSucceeded {
+		t.Fatalf("drained unit is in state %s", WorkStateToString(unit.Status().State))
+	}
+}
@@ -3,7 +3,6 @@ package workceptor
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/project-receptor/receptor/pkg/logger"
 	"github.com/rogpeppe/go-internal/lockedfile"
 	"io"
 	"io/ioutil"
@@ -59,6 +58,7 @@ type WorkUnit interface {
 	Load() error
 	UpdateBasicStatus(state int, detail string, stdoutSize int64)
 	UpdateFullStatus(statusFunc func(*StatusFileData))
+	UpdateProgress(percent float64, step string) error
 	LastUpdateError() error
 	Status() *StatusFileData
 	Start() error
@@ -81,12 +81,23 @@ type NewWorkerFunc func() WorkUnit
 // StatusFileData is the structure of the JSON data saved to a status file.
 // This struct should only contain value types, except for ExtraData.
 type StatusFileData struct {
-	State      int
-	Detail     string
-	StdoutSize int64
-	WorkType   string
-	Params     string
-	ExtraData  interface{}
+	State            int
+	Detail           string
+	StdoutSize       int64
+	WorkType         string
+	Params           string
+	StartAt          time.Time
+	Timeout          time.Duration
+	Deadline         time.Time
+	TimedOut         bool
+	Retry            RetryPolicy
+	Attempt          int
+	Cancelled        bool
+	RetriesExhausted bool
+	CompletedAt      time.Time
+	Progress         WorkProgress
+	Checksums        map[string]string
+	ExtraData        interface{}
 }
 
 // BaseWorkUnit includes data common to all work units, and partially implements the WorkUnit interface
@@ -99,6 +110,10 @@ type BaseWorkUnit struct {
 	stdoutFileName  string
 	statusLock      *sync.RWMutex
 	lastUpdateError error
+	// loaded is set once the unit's status has been read from storage
+	loaded bool
+	// checksumsDue is set when the unit reaches a terminal state, until its checksums are recorded
+	checksumsDue bool
 }
 
 // Init initializes the work unit data
@@ -109,19 +124,41 @@ func (bwu *BaseWorkUnit) Init(w *Workceptor, unitID string, workType string, par
 	bwu.status.StdoutSize = 0
 	bwu.status.WorkType = workType
 	bwu.status.Params = params
+	bwu.status.StartAt = time.Time{}
+	bwu.status.Timeout = 0
+	bwu.status.Deadline = time.Time{}
+	bwu.status.TimedOut = false
+	bwu.status.Retry = RetryPolicy{}
+	bwu.status.Attempt = 0
+	bwu.status.Cancelled = false
+	bwu.status.RetriesExhausted = false
+	bwu.status.CompletedAt = time.Time{}
+	bwu.status.Progress = WorkProgress{}
+	bwu.status.Checksums = nil
 	bwu.status.ExtraData = nil
 	bwu.unitID = unitID
-	bwu.unitDir = path.Join(w.dataDir, unitID)
-	bwu.statusFileName = path.Join(bwu.unitDir, "status")
-	bwu.stdoutFileName = path.Join(bwu.unitDir, "stdout")
+	bwu.unitDir = w.storage.LocalDir(unitID)
+	if bwu.unitDir != "" {
+		bwu.statusFileName = path.Join(bwu.unitDir, "status")
+		bwu.stdoutFileName = path.Join(bwu.unitDir, "stdout")
+	}
 	bwu.statusLock = &sync.RWMutex{}
 }
 
-// UnitDir returns the unit directory of this work unit
+// UnitDir returns the unit directory of this work unit, or an empty string if its storage is not
+// on the local filesystem
 func (bwu *BaseWorkUnit) UnitDir() string {
 	return bwu.unitDir
 }
 
+// requireUnitDir returns an error if this work unit's storage is not on the local filesystem
+func (bwu *BaseWorkUnit) requireUnitDir() error {
+	if bwu.unitDir == "" {
+		return fmt.Errorf("work type %s requires filesystem storage", bwu.status.WorkType)
+	}
+	return nil
+}
+
 // ID returns the unique identifier of this work unit
 func (bwu *BaseWorkUnit) ID() string {
 	return bwu.unitID
@@ -151,7 +188,7 @@ func (sfd *StatusFileData) lockStatusFile(filename string) (*lockedfile.File, er
 func (sfd *StatusFileData) unlockStatusFile(filename string, lockFile *lockedfile.File) {
 	err := lockFile.Close()
 	if err != nil {
-		logger.Error("Error closing %s.lock: %s", filename, err)
+		sublogger.Error("Error closing %s.lock: %s", filename, err)
 	}
 }
 
@@ -185,11 +222,11 @@ func (sfd *StatusFileData) Save(filename string) error {
 	return file.Close()
 }
 
-// Save saves status to a file
+// Save saves status to storage
 func (bwu *BaseWorkUnit) Save() error {
 	bwu.statusLock.RLock()
 	defer bwu.statusLock.RUnlock()
-	return bwu.status.Save(bwu.statusFileName)
+	return bwu.w.storage.PutStatus(bwu.unitID, &bwu.status)
 }
 
 // loadFromFile loads status from an already open file
@@ -220,11 +257,48 @@ func (sfd *StatusFileData) Load(filename string) error {
 	return file.Close()
 }
 
-// Load loads status from a file
+// Load loads status from storage
 func (bwu *BaseWorkUnit) Load() error {
+	defer bwu.notifyIfComplete()
 	bwu.statusLock.Lock()
 	defer bwu.statusLock.Unlock()
-	return bwu.status.Load(bwu.statusFileName)
+	wasComplete := IsComplete(bwu.status.State)
+	err := bwu.w.storage.GetStatus(bwu.unitID, &bwu.status)
+	if err != nil {
+		return err
+	}
+	// The first load only finds out what state the unit was left in, so it is not a completion
+	if bwu.loaded {
+		bwu.trackCompletion(wasComplete)
+	}
+	bwu.loaded = true
+	return nil
+}
+
+// trackCompletion notes whether a change to the status has just brought the unit to a terminal
+// state, in which case its checksums are due.  The caller must already hold the statusLock.
+func (bwu *BaseWorkUnit) trackCompletion(wasComplete bool) {
+	if !IsComplete(bwu.status.State) {
+		bwu.checksumsDue = false
+	} else if !wasComplete && bwu.status.Checksums == nil {
+		bwu.checksumsDue = true
+	}
+}
+
+// checksumsPending returns true if the unit's checksums are due
+func (bwu *BaseWorkUnit) checksumsPending() bool {
+	bwu.statusLock.RLock()
+	defer bwu.statusLock.RUnlock()
+	return bwu.checksumsDue
+}
+
+// takeChecksumsDue returns true, only once, if the unit's checksums are due
+func (bwu *BaseWorkUnit) takeChecksumsDue() bool {
+	bwu.statusLock.Lock()
+	defer bwu.statusLock.Unlock()
+	due := bwu.checksumsDue
+	bwu.checksumsDue = false
+	return due
 }
 
 // UpdateFullStatus atomically updates the status metadata file.  Changes should be made in the callback function.
@@ -242,7 +316,7 @@ func (sfd *StatusFileData) UpdateFullStatus(filename string, statusFunc func(*St
 	defer func() {
 		err := file.Close()
 		if err != nil {
-			logger.Error("Error closing %s: %s", filename, err)
+			sublogger.Error("Error closing %s: %s", filename, err)
 		}
 	}()
 	size, err := file.Seek(0, 2)
@@ -278,10 +352,17 @@ func (sfd *StatusFileData) UpdateFullStatus(filename string, statusFunc func(*St
 // UpdateFullStatus atomically updates the whole status record.  Changes should be made in the callback function.
 // Errors are logged rather than returned.
 func (bwu *BaseWorkUnit) UpdateFullStatus(statusFunc func(*StatusFileData)) {
-	err := bwu.status.UpdateFullStatus(bwu.statusFileName, statusFunc)
+	defer bwu.notifyIfComplete()
+	bwu.statusLock.Lock()
+	defer bwu.statusLock.Unlock()
+	wasComplete := IsComplete(bwu.status.State)
+	err := bwu.w.storage.UpdateStatus(bwu.unitID, &bwu.status, statusFunc)
+	if err == nil {
+		bwu.trackCompletion(wasComplete)
+	}
 	bwu.lastUpdateError = err
 	if err != nil {
-		logger.Error("Error updating status file %s: %s.", bwu.statusFileName, err)
+		sublogger.Error("Error updating status of unit %s: %s.", bwu.unitID, err)
 	}
 }
 
@@ -289,23 +370,59 @@ func (bwu *BaseWorkUnit) UpdateFullStatus(statusFunc func(*StatusFileData)) {
 // Passing -1 as stdoutSize leaves it unchanged.
 func (sfd *StatusFileData) UpdateBasicStatus(filename string, state int, detail string, stdoutSize int64) error {
 	return sfd.UpdateFullStatus(filename, func(status *StatusFileData) {
-		status.State = state
-		status.Detail = detail
-		if stdoutSize >= 0 {
-			status.StdoutSize = stdoutSize
-		}
+		status.setBasicStatus(state, detail, stdoutSize)
 	})
 }
 
+// setBasicStatus sets the key fields of the status.  A unit that timed out stays failed with a
+// detail saying so, however the work it was running ended.
+func (sfd *StatusFileData) setBasicStatus(state int, detail string, stdoutSize int64) {
+	if sfd.TimedOut && IsComplete(state) {
+		state = WorkStateFailed
+		detail = fmt.Sprintf("Timed out after %s", sfd.Timeout)
+	}
+	if IsComplete(state) && !IsComplete(sfd.State) {
+		sfd.CompletedAt = time.Now()
+	}
+	sfd.State = state
+	sfd.Detail = detail
+	if stdoutSize >= 0 {
+		sfd.StdoutSize = stdoutSize
+	}
+}
+
 // UpdateBasicStatus atomically updates key fields in the status metadata file.  Errors are logged rather than returned.
 // Passing -1 as stdoutSize leaves it unchanged.
 func (bwu *BaseWorkUnit) UpdateBasicStatus(state int, detail string, stdoutSize int64) {
+	defer bwu.notifyIfComplete()
 	bwu.statusLock.Lock()
 	defer bwu.statusLock.Unlock()
-	err := bwu.status.UpdateBasicStatus(bwu.statusFileName, state, detail, stdoutSize)
+	wasComplete := IsComplete(bwu.status.State)
+	err := bwu.w.storage.UpdateStatus(bwu.unitID, &bwu.status, func(status *StatusFileData) {
+		status.setBasicStatus(state, detail, stdoutSize)
+	})
+	if err == nil {
+		bwu.trackCompletion(wasComplete)
+	}
 	bwu.lastUpdateError = err
 	if err != nil {
-		logger.Error("Error updating status file %s: %s.", bwu.statusFileName, err)
+		sublogger.Error("Error updating status of unit %s: %s.", bwu.unitID, err)
+	}
+}
+
+// notifyIfComplete tells the scheduler when the unit has completed, so its slot can be reused
+func (bwu *BaseWorkUnit) notifyIfComplete() {
+	status := bwu.Status()
+	if IsComplete(status.State) {
+		bwu.w.disarmUnitTimeout(bwu.unitID)
+		bwu.w.unitCompleted(bwu.unitID, status.WorkType)
+		if bwu.retryIfFailed(status) {
+			return
+		}
+		// Checksums are only computed once, when the unit first completes with all of its output
+		if bwu.checksumsPending() && bwu.w.unitStdoutSize(bwu.unitID) >= status.StdoutSize && bwu.takeChecksumsDue() {
+			bwu.recordChecksums()
+		}
 	}
 }
 
@@ -319,6 +436,12 @@ func (bwu *BaseWorkUnit) getStatus() *StatusFileData {
 	var status StatusFileData
 	status = bwu.status
 	status.ExtraData = nil
+	if bwu.status.Checksums != nil {
+		status.Checksums = make(map[string]string)
+		for k, v := range bwu.status.Checksums {
+			status.Checksums[k] = v
+		}
+	}
 	return &status
 }
 
@@ -333,10 +456,11 @@ func (bwu *BaseWorkUnit) Status() *StatusFileData {
 func (bwu *BaseWorkUnit) Release(force bool) error {
 	bwu.statusLock.Lock()
 	defer bwu.statusLock.Unlock()
-	err := os.RemoveAll(bwu.UnitDir())
+	err := bwu.w.storage.DeleteUnit(bwu.unitID)
 	if err != nil && !force {
 		return err
 	}
+	bwu.w.disarmUnitTimeout(bwu.unitID)
 	bwu.w.activeUnitsLock.Lock()
 	defer bwu.w.activeUnitsLock.Unlock()
 	delete(bwu.w.activeUnits, bwu.unitID)
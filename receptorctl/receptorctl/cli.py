@@ -1,6 +1,6 @@
 import sys
+import json
 import os
-import time
 import select
 import fcntl
 import tty
@@ -9,7 +9,7 @@ import click
 from pprint import pprint
 from functools import partial
 import dateutil.parser
-from .socket_interface import ReceptorControl
+from .socket_interface import ReceptorControl, StreamError
 
 
 class IgnoreRequiredWithHelp(click.Group):
@@ -104,6 +104,95 @@ def status(ctx):
         pprint(status)
 
 
+@cli.command(help="Check whether the local node is ready, exiting with an error if it is not.")
+@click.pass_context
+def healthz(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("healthz")
+    longest_name = max([5] + [len(c['Name']) for c in results['Checks']])
+    for c in results['Checks']:
+        state = "ready" if c['Ready'] else "NOT READY"
+        print(f"{c['Name']:<{longest_name}}  {state:<9}  {c['Detail']}")
+    if not results['Ready']:
+        sys.exit(1)
+
+
+@cli.command(help="List the control commands available on the local node.")
+@click.pass_context
+def commands(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("commands")
+    longest_name = max([7] + [len(c['Name']) for c in results['Commands']])
+    for c in results['Commands']:
+        print(f"{c['Name']:<{longest_name}}  {c['Description']}")
+
+
+@cli.command(help="Show the directly connected peers of the local node.")
+@click.pass_context
+def neighbors(ctx):
+    rc = get_rc(ctx)
+    neighbors = rc.simple_command("neighbors")
+    longest_node = max([12] + [len(node) for node in neighbors])
+    print(f"{'Neighbor':<{longest_node}} Backend          Cost  RTT           Last Heard")
+    for node in sorted(neighbors):
+        nb = neighbors[node]
+        heard = dateutil.parser.parse(nb['LastHeard'])
+        print(f"{node:<{longest_node}} {nb['Backend']:<16} {nb['Cost']:<5} {nb['RTTStr']:<13} {heard:%Y-%m-%d %H:%M:%S}")
+
+
+@cli.command(help="Show the established backend sessions of the local node and their traffic.")
+@click.pass_context
+def connections(ctx):
+    rc = get_rc(ctx)
+    conns = rc.simple_command("connections")["Connections"]
+    longest_node = max([12] + [len(c['NodeID']) for c in conns])
+    print(f"{'Node':<{longest_node}} Backend          Dir  Cost      Uptime       Sent       Received   TLS Peer")
+    for c in conns:
+        direction = {"inbound": "in", "outbound": "out"}.get(c['Direction'], "?")
+        tls = c['TLSPeer'] or ("yes" if c['TLS'] else "no")
+        cost = str(c['Cost'])
+        receive_cost = c.get('ReceiveCost', c['Cost'])
+        if receive_cost != c['Cost']:
+            cost += f"/{receive_cost}"
+        print(f"{c['NodeID']:<{longest_node}} {c['Backend']:<16} {direction:<4} {cost:<9} {c['UptimeStr']:<12} "
+              f"{c['BytesSent']:<10} {c['BytesReceived']:<10} {tls}")
+
+
+@cli.command(help="Close the backend session between the local node and a peer, or all peers if NODE is \"all\".")
+@click.pass_context
+@click.argument('node')
+def disconnect(ctx, node):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"disconnect {node}")
+    for n in results['Disconnected']:
+        print(f"Disconnected from {n}")
+
+
+@cli.command(help="Show or set the global log level, or the log levels of subsystems, of the local node. "
+                  "Give a level to set the global level, or a subsystem and a level to set a subsystem's level.")
+@click.pass_context
+@click.argument('subsystem', required=False)
+@click.argument('level', required=False)
+def loglevel(ctx, subsystem, level):
+    rc = get_rc(ctx)
+    if subsystem:
+        if level:
+            results = rc.simple_command(f"loglevel {subsystem} {level}")
+        else:
+            results = rc.simple_command(f"loglevel {subsystem}")
+        if not results.get("Success"):
+            print(f"Error: {results['Error']}")
+            sys.exit(1)
+        print(f"Changed log level from {results['Previous']} to {results['New']}")
+    else:
+        results = rc.simple_command("loglevel")
+    print(f"Global: {results['Global']}")
+    for name in sorted(results['Subsystems']):
+        s = results['Subsystems'][name]
+        override = " (overridden)" if s['Overridden'] else ""
+        print(f"  {name}: {s['Level']}{override}")
+
+
 @cli.command(help="Ping a Receptor node.")
 @click.pass_context
 @click.argument('node')
@@ -111,31 +200,102 @@ def status(ctx):
 @click.option('--delay', default=1.0, help="Time to wait between pings", show_default=True)
 def ping(ctx, node, count, delay):
     rc = get_rc(ctx)
-    for i in range(count):
-        results = rc.simple_command(f"ping {node}")
-        if "Success" in results and results["Success"]:
+    results = rc.simple_command(f"ping {node} {count} {delay}s frames")
+    while not results.get("StreamComplete"):
+        if results["Success"]:
             print(f"Reply from {results['From']} in {results['TimeStr']}")
+        elif results["From"]:
+            print(f"Error {results['Error']} from {results['From']} in {results['TimeStr']}")
         else:
-            if "From" in results and "TimeStr" in results:
-                print(f"Error {results['Error']} from {results['From']} in {results['TimeStr']}")
-            else:
-                print(f"Error: {results['Error']}")
-        if i < count-1:
-            time.sleep(delay)
+            print(f"Error: {results['Error']}")
+        sys.stdout.flush()
+        results = rc.read_and_parse_json()
+    print(f"{results['Received']}/{results['Sent']} replies from {node}, {results['Loss']:.1f}% loss")
+    if results["Received"]:
+        print(f"min/avg/max/stddev = {results['MinTimeStr']}/{results['AvgTimeStr']}/"
+              f"{results['MaxTimeStr']}/{results['StdDevTimeStr']}")
+
+
+@cli.command(help="Estimate the clock skew between the local node and a remote node.")
+@click.pass_context
+@click.argument('node')
+def clockskew(ctx, node):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"clockskew {node}")
+    if results.get("Success"):
+        print(f"Clock of {results['From']} is ahead by {results['SkewStr']} (round trip {results['RTTStr']})")
+    else:
+        print(f"Error: {results['Error']}")
+
+
+@cli.command(help="Measure packet loss to a Receptor node.")
+@click.pass_context
+@click.argument('node')
+@click.option('--count', default=20, help="Number of probes to send", show_default=True)
+@click.option('--hops', is_flag=True, help="Also measure the loss to each hop along the path")
+def loss(ctx, node, count, hops):
+    rc = get_rc(ctx)
+    if hops:
+        results = rc.simple_command(f"loss {node} {count} hops")
+    else:
+        results = rc.simple_command(f"loss {node} {count}")
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    if hops:
+        for hop in sorted(results['Hops'], key=int):
+            h = results['Hops'][hop]
+            print(f"{hop}: {h['From'] or '?'} {h['Received']}/{h['Sent']} replies, {h['Loss']:.1f}% loss")
+    else:
+        print(f"{results['Received']}/{results['Sent']} replies from {node}, {results['Loss']:.1f}% loss")
 
 
 @cli.command(help="Do a traceroute to a Receptor node.")
 @click.pass_context
 @click.argument('node')
-def traceroute(ctx, node):
+@click.option('--count', type=int, default=1, help="Number of probes to send to each hop")
+@click.option('--hop-timeout', type=str, default=None, help="How long to wait for each probe, such as 2s")
+def traceroute(ctx, node, count, hop_timeout):
     rc = get_rc(ctx)
-    results = rc.simple_command(f"traceroute {node}")
+    command = f"traceroute {node} {count}"
+    if hop_timeout:
+        command += f" {hop_timeout}"
+    results = rc.simple_command(command)
     for resno in sorted(results, key=lambda r: int(r)):
         resval = results[resno]
+        if 'MinTimeStr' in resval and resval.get('Probes', 1) > 1:
+            times = f"{resval['MinTimeStr']}/{resval['TimeStr']}/{resval['MaxTimeStr']} (min/avg/max)"
+        else:
+            times = resval['TimeStr']
+        if resval.get('Lost'):
+            times += f", {resval['Lost']}/{resval['Probes']} lost"
         if 'Error' in resval:
-            print(f"{resno}: Error {resval['Error']} from {resval['From']} in {resval['TimeStr']}")
+            print(f"{resno}: Error {resval['Error']} from {resval['From']} in {times}")
         else:
-            print(f"{resno}: {resval['From']} in {resval['TimeStr']}")
+            print(f"{resno}: {resval['From']} in {times}, MTU {resval.get('MTU')}")
+
+
+@cli.command(help="Check that a service on a Receptor node accepts connections.")
+@click.pass_context
+@click.argument('node')
+@click.argument('service')
+@click.option('--tls', type=str, help="Name of the TLS client config to connect with")
+@click.option('--server-name', type=str, help="Name to verify the service's TLS certificate against, instead of the node ID")
+def testconnect(ctx, node, service, tls, server_name):
+    rc = get_rc(ctx)
+    command = f"testconnect {node} {service}"
+    if tls:
+        command += f" {tls}"
+        if server_name:
+            command += f" {server_name}"
+    results = rc.simple_command(command)
+    if results.get("Success"):
+        print(f"Connected to {node}:{service} in {results['LatencyStr']}")
+        if results.get("TLSPeer"):
+            print(f"Verified TLS peer: {results['TLSPeer']}")
+    else:
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
 
 
 @cli.command(help="Connect the local terminal to a Receptor service on a remote node.")
@@ -143,9 +303,11 @@ def traceroute(ctx, node):
 @click.argument('node')
 @click.argument('service')
 @click.option('--raw', '-r', default=False, is_flag=True, help="Set terminal to raw mode")
-def connect(ctx, node, service, raw):
+@click.option('--tls', type=str, help="Name of the TLS client config to connect with")
+@click.option('--server-name', type=str, help="Name to verify the service's TLS certificate against, instead of the node ID")
+def connect(ctx, node, service, raw, tls, server_name):
     rc = get_rc(ctx)
-    rc.connect_to_service(node, service)
+    rc.connect_to_service(node, service, tls=tls, server_name=server_name)
 
     stdin_tattrs = termios.tcgetattr(sys.stdin)
     stdin_fcntl = fcntl.fcntl(sys.stdin, fcntl.F_GETFL)
@@ -176,6 +338,526 @@ def connect(ctx, node, service, raw):
         print()
 
 
+@cli.command(help="Turn maintenance mode on or off for the local node.")
+@click.pass_context
+@click.argument('mode', type=click.Choice(['on', 'off']))
+@click.option('--cancel-work', is_flag=True, help="Cancel running work units when entering maintenance mode")
+def maintenance(ctx, mode, cancel_work):
+    rc = get_rc(ctx)
+    command = f"maintenance {mode}"
+    if cancel_work:
+        command += " cancel"
+    results = rc.simple_command(command)
+    print(f"Maintenance mode: {'on' if results['MaintenanceMode'] else 'off'}")
+    if results.get('CancelledUnits'):
+        print("Cancelled:", results['CancelledUnits'])
+
+
+@cli.command(help="Shut down the local node.")
+@click.pass_context
+@click.option('--drain', is_flag=True, help="Wait for running work units to finish before shutting down")
+@click.option('--timeout', type=str, help="How long to wait for work to drain before shutting down anyway, such as 10m")
+def shutdown(ctx, drain, timeout):
+    if timeout and not drain:
+        print("Cannot provide --timeout without --drain.")
+        sys.exit(1)
+    rc = get_rc(ctx)
+    command = "shutdown"
+    if drain:
+        command += " drain"
+        if timeout:
+            command += f" {timeout}"
+    results = rc.simple_command(command)
+    if results.get('Drain'):
+        print(f"Node {results['Node']} is shutting down once work has drained, or after {results['Timeout']}")
+    else:
+        print(f"Node {results['Node']} is shutting down")
+
+
+@cli.group(help="Commands related to services on the Receptor network")
+def services():
+    pass
+
+
+@services.command(name="remote", help="List the services a remote node is advertising.")
+@click.argument('node', type=str, required=True)
+@click.pass_context
+def services_remote(ctx, node):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"services remote {node}")
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    for svc in results['Services']:
+        tags = ", ".join(f"{k}: {v}" for k, v in sorted((svc.get('Tags') or {}).items()))
+        print(f"{svc['Service']}" + (f" ({tags})" if tags else ""))
+
+
+@cli.group(help="Commands related to the routing advertisement cache of the local node")
+def adcache():
+    pass
+
+
+@adcache.command(name="list", help="List the cached routing advertisements of remote nodes.")
+@click.pass_context
+def adcache_list(ctx):
+    rc = get_rc(ctx)
+    entries = rc.simple_command("adcache list")
+    for node in sorted(entries):
+        e = entries[node]
+        print(f"{node}: epoch {e['Epoch']} sequence {e['Sequence']}, age {e['AgeStr']}, from {e['ReceivedFrom']}")
+
+
+@adcache.command(name="clear", help="Remove a node's cached advertisements so they are re-learned.")
+@click.argument('node', type=str, required=True)
+@click.pass_context
+def adcache_clear(ctx, node):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"adcache clear {node}")
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    print(f"Cleared: {node}")
+
+
+@cli.group(help="Commands related to traffic and command statistics of the local node")
+def stats():
+    pass
+
+
+@stats.command(name="show", help="Show backend traffic and control command counters.")
+@click.pass_context
+def stats_show(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("stats show")
+    print("Backends:")
+    for name in sorted(results['Backends']):
+        b = results['Backends'][name]
+        print(f"  {name}: sent {b['BytesSent']} bytes in {b['MessagesSent']} messages, "
+              f"received {b['BytesReceived']} bytes in {b['MessagesReceived']} messages")
+        if b.get('HandshakeTimeouts'):
+            print(f"    {b['HandshakeTimeouts']} sessions dropped for handshake timeout")
+        if b.get('QueueDropped'):
+            print(f"    {b['QueueDropped']} messages dropped from full send queues")
+    print("Commands:")
+    for name in sorted(results['Commands']):
+        c = results['Commands'][name]
+        print(f"  {name}: {c['Invocations']} invocations, {c['Errors']} errors")
+    dropped = results.get('RelayDropped')
+    if dropped:
+        print("Transit messages dropped by relay allowlist:")
+        for name in sorted(dropped):
+            print(f"  {name}: {dropped[name]}")
+
+
+@stats.command(name="latency", help="Show recent control command latencies.")
+@click.pass_context
+def stats_latency(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("stats latency")
+    print(f"Command latencies over the last {results['WindowStr']}:")
+    for name in sorted(results['Commands']):
+        h = results['Commands'][name]
+        ms = {k: h[k] / 1e6 for k in ('P50', 'P95', 'P99', 'Max')}
+        print(f"  {name}: {h['Count']} runs, p50 {ms['P50']:.1f}ms, p95 {ms['P95']:.1f}ms, "
+              f"p99 {ms['P99']:.1f}ms, max {ms['Max']:.1f}ms")
+
+
+@stats.command(name="reset", help="Reset statistics counters to zero.")
+@click.option('--backend', type=str, help="Only reset the counters of this backend")
+@click.option('--command', type=str, help="Only reset the counters of this control command")
+@click.pass_context
+def stats_reset(ctx, backend, command):
+    if backend and command:
+        print("Error: --backend and --command cannot be used together")
+        sys.exit(1)
+    rc = get_rc(ctx)
+    if backend:
+        results = rc.simple_command(f"stats reset backend {backend}")
+    elif command:
+        results = rc.simple_command(f"stats reset command {command}")
+    else:
+        results = rc.simple_command("stats reset")
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    print("Statistics reset")
+
+
+@cli.command(help="Show the session and command counters of the control service.")
+@click.option('--reset', is_flag=True, help="Reset the counters after showing them")
+@click.pass_context
+def metrics(ctx, reset):
+    rc = get_rc(ctx)
+    results = rc.simple_command("metrics reset" if reset else "metrics")
+    print(f"Since {results['Since']}:")
+    print(f"  Sessions: {results['ActiveSessions']} active, {results['SessionsTotal']} total")
+    print(f"  Commands: {results['CommandsTotal']} total, {results['CommandErrors']} errors, "
+          f"{results['UnknownCommands']} unknown")
+    for name in sorted(results['Commands']):
+        c = results['Commands'][name]
+        print(f"    {name}: {c['Invocations']} invocations, {c['Errors']} errors")
+    longest = results.get('LongestCommand')
+    if longest:
+        print(f"  Longest running: {longest['Command']} in session {longest['SessionID']} "
+              f"for {longest['ElapsedStr']}")
+    if reset:
+        print("Counters reset")
+
+
+@cli.group(help="Commands related to the routing table of the local node")
+def route():
+    pass
+
+
+def print_route_preview(results):
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    changes = results["Changes"]
+    if not changes:
+        print("No routes would change")
+        return
+    for dest in sorted(changes):
+        c = changes[dest]
+        current = c['CurrentNextHop'] or "unreachable"
+        proposed = c['ProposedNextHop'] or "unreachable"
+        print(f"{dest}: {current} -> {proposed}")
+
+
+@route.command(name="table", help="Show the next hop and path cost to every known node, and the connections between nodes.")
+@click.option('--json', 'as_json', is_flag=True, help="Print the table as JSON, for comparing nodes")
+@click.pass_context
+def route_table(ctx, as_json):
+    rc = get_rc(ctx)
+    results = rc.simple_command("route table")
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    if as_json:
+        print(json.dumps({"NodeID": results["NodeID"], "Routes": results["Routes"], "Links": results["Links"]},
+                         indent=2, sort_keys=True))
+        return
+    longest_node = max([11] + [len(r['Destination']) for r in results['Routes']])
+    print(f"{'Destination':<{longest_node}} {'Next Hop':<{longest_node}} Cost")
+    for r in results['Routes']:
+        if r['Reachable']:
+            print(f"{r['Destination']:<{longest_node}} {r['NextHop']:<{longest_node}} {r['Cost']}")
+        else:
+            print(f"{r['Destination']:<{longest_node}} {'unreachable':<{longest_node}}")
+    print()
+    longest_link = max([4] + [len(link['From']) for link in results['Links']])
+    print(f"{'From':<{longest_link}} {'To':<{longest_link}} Cost  State")
+    for link in results['Links']:
+        state = "up" if link['Up'] else "down"
+        print(f"{link['From']:<{longest_link}} {link['To']:<{longest_link}} {link['Cost']:<5} {state}")
+
+
+@route.command(name="preview-cost", help="Preview route changes if a connection had a different cost.")
+@click.argument('node1', type=str, required=True)
+@click.argument('node2', type=str, required=True)
+@click.argument('cost', type=float, required=True)
+@click.pass_context
+def route_preview_cost(ctx, node1, node2, cost):
+    rc = get_rc(ctx)
+    print_route_preview(rc.simple_command(f"route preview cost {node1} {node2} {cost}"))
+
+
+@route.command(name="preview-static", help="Preview route changes if a destination were always reached via a neighbor.")
+@click.argument('destination', type=str, required=True)
+@click.argument('nexthop', type=str, required=True)
+@click.pass_context
+def route_preview_static(ctx, destination, nexthop):
+    rc = get_rc(ctx)
+    print_route_preview(rc.simple_command(f"route preview static {destination} {nexthop}"))
+
+
+@route.command(name="interval", help="Show or change the interval at which route updates are sent.")
+@click.argument('interval', type=str, required=False)
+@click.pass_context
+def route_interval(ctx, interval):
+    rc = get_rc(ctx)
+    if interval:
+        results = rc.simple_command(f"route interval {interval}")
+    else:
+        results = rc.simple_command("route interval")
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    print(f"Route update interval: {results['IntervalStr']}")
+
+
+@route.command(name="watch", help="Show routes as they change, starting with the current ones.")
+@click.option('--count', type=int, default=0, help="Stop after this many changes")
+@click.pass_context
+def route_watch(ctx, count):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"routing-updates {count}" if count else "routing-updates")
+    while not results.get("StreamComplete"):
+        if results['Type'] == "removed":
+            print(f"{results['Node']}: removed")
+        else:
+            print(f"{results['Node']}: {results['Type']}, via {results['NextHop']} at cost {results['Cost']}")
+        sys.stdout.flush()
+        results = rc.read_and_parse_json()
+
+
+@cli.group(help="Commands related to control service and backend sessions of the local node")
+def sessions():
+    pass
+
+
+@sessions.command(name="list", help="List the clients connected to the control service and what they are running.")
+@click.pass_context
+def sessions_list(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("sessions list")
+    sessions = results["Sessions"]
+    for session_id in sorted(sessions, key=int):
+        s = sessions[session_id]
+        who = s['Remote'] or "local"
+        if s['Identity']:
+            who = f"{who} ({s['Identity']})"
+        command = s['Command'] or "idle"
+        print(f"{session_id}: {who} on {s['Listener']} since {s['Connected']}: {command}")
+
+
+@sessions.command(name="reap", help="Close sessions that have been idle longer than IDLE (e.g. 10m) and cost more than MIN_COST.")
+@click.argument('idle', type=str, required=True)
+@click.argument('min_cost', type=float, required=True)
+@click.pass_context
+def sessions_reap(ctx, idle, min_cost):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"sessions reap {idle} {min_cost}")
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    reaped = results["Reaped"]
+    if not reaped:
+        print("No sessions were closed")
+        return
+    for node in sorted(reaped):
+        r = reaped[node]
+        print(f"{node}: closed {r['Backend']} session (cost {r['Cost']}, idle {r['IdleStr']})")
+
+
+@cli.group(help="Commands related to the pre-shared keys that sign backend frames")
+def hmac():
+    pass
+
+
+def print_hmac_result(results, message):
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    print(message)
+
+
+@hmac.command(name="list", help="List the accepted keys.")
+@click.pass_context
+def hmac_list(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("hmac list")
+    for key_id in results["Keys"]:
+        if key_id == results["Primary"]:
+            print(f"{key_id} (primary)")
+        else:
+            print(key_id)
+
+
+@hmac.command(name="add", help="Accept frames signed with a new key.")
+@click.argument('key_id', type=str, required=True)
+@click.option('--key', type=str, prompt=True, hide_input=True, help="The pre-shared key")
+@click.pass_context
+def hmac_add(ctx, key_id, key):
+    rc = get_rc(ctx)
+    results = rc.simple_command(json.dumps({"command": "hmac", "subcommand": "add", "keyid": key_id, "key": key}))
+    print_hmac_result(results, f"Added key {key_id}")
+
+
+@hmac.command(name="primary", help="Sign outgoing frames with a key.")
+@click.argument('key_id', type=str, required=True)
+@click.pass_context
+def hmac_primary(ctx, key_id):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"hmac primary {key_id}")
+    print_hmac_result(results, f"Key {key_id} is now primary")
+
+
+@hmac.command(name="remove", help="Stop accepting frames signed with a key.")
+@click.argument('key_id', type=str, required=True)
+@click.pass_context
+def hmac_remove(ctx, key_id):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"hmac remove {key_id}")
+    print_hmac_result(results, f"Removed key {key_id}")
+
+
+@cli.group(help="Commands related to the peers allowed to connect to the local node")
+def peers():
+    pass
+
+
+def print_allowed_peers(results):
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+    print(f"Source: {results['Source']}")
+    if results['AllowAll']:
+        print("All peers are allowed")
+    else:
+        for peer in sorted(results['AllowedPeers']):
+            print(f"  {peer}")
+    denied = results.get('DeniedPeers')
+    if denied:
+        print("Denied peers:")
+        for peer in sorted(denied):
+            print(f"  {peer}")
+
+
+@peers.command(name="allowed", help="Show the peers currently allowed to connect, and where the list came from.")
+@click.pass_context
+def peers_allowed(ctx):
+    rc = get_rc(ctx)
+    print_allowed_peers(rc.simple_command("peers allowed"))
+
+
+@peers.command(name="reload", help="Reload the allowed peers file.")
+@click.pass_context
+def peers_reload(ctx):
+    rc = get_rc(ctx)
+    print_allowed_peers(rc.simple_command("peers reload"))
+
+
+@cli.group(help="Commands for validating the node's configuration")
+def validate():
+    pass
+
+
+@validate.command(name="config", help="Check the configuration of each subsystem and list any problems found.")
+@click.pass_context
+def validate_config(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("validate config")
+    for f in results['Findings']:
+        print(f"{f['Severity'].upper():8} {f['Subsystem']}: {f['Message']}")
+    print(f"{results['Errors']} errors, {results['Warnings']} warnings")
+    if not results['Valid']:
+        sys.exit(1)
+
+
+@cli.group(help="Commands for reloading parts of the node's configuration")
+def reload():
+    pass
+
+
+@reload.command(name="tls", help="Reload TLS certificates from disk, for use in new connections.")
+@click.pass_context
+def reload_tls(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("reload tls")
+    for c in results['TLSConfigs']:
+        print(f"{c['Kind']} {c['Name']}:")
+        for fp in c['Fingerprints']:
+            print(f"    {fp}")
+
+
+@cli.group(help="Commands for injecting faults into backends, for resilience testing")
+def chaos():
+    pass
+
+
+@chaos.command(name="list", help="List the faults injected into backends.")
+@click.pass_context
+def chaos_list(ctx):
+    rc = get_rc(ctx)
+    results = rc.simple_command("chaos list")
+    if not results['Enabled']:
+        print("Fault injection is not enabled on this node")
+        return
+    for name in sorted(results['Faults']):
+        f = results['Faults'][name]
+        print(f"{name}: drop rate {f['DropRate']}, latency {f['LatencyStr']}, fail {f['Fail']}")
+
+
+def chaos_command(ctx, command):
+    rc = get_rc(ctx)
+    results = rc.simple_command(command)
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+
+
+@chaos.command(name="drop", help="Drop a fraction of the frames sent and received by a backend.")
+@click.argument('backend')
+@click.argument('rate', type=float)
+@click.pass_context
+def chaos_drop(ctx, backend, rate):
+    chaos_command(ctx, f"chaos drop {backend} {rate}")
+
+
+@chaos.command(name="latency", help="Add latency to the frames sent by a backend.")
+@click.argument('backend')
+@click.argument('latency')
+@click.pass_context
+def chaos_latency(ctx, backend, latency):
+    chaos_command(ctx, f"chaos latency {backend} {latency}")
+
+
+@chaos.command(name="fail", help="Make the sessions of a backend fail.")
+@click.argument('backend')
+@click.pass_context
+def chaos_fail(ctx, backend):
+    chaos_command(ctx, f"chaos fail {backend}")
+
+
+@chaos.command(name="clear", help="Stop injecting faults into a backend.")
+@click.argument('backend')
+@click.pass_context
+def chaos_clear(ctx, backend):
+    chaos_command(ctx, f"chaos clear {backend}")
+
+
+@cli.group(help="Commands related to backends on the local node")
+def backend():
+    pass
+
+
+@backend.command(name="list", help="List backends and their connections.")
+@click.pass_context
+def backend_list(ctx):
+    rc = get_rc(ctx)
+    backends = rc.simple_command("backend list")
+    for name in sorted(backends):
+        b = backends[name]
+        state = "enabled" if b['Enabled'] else "disabled"
+        print(f"{name}: {state}, connections: {', '.join(b['Connections'])}")
+
+
+def set_backend_enabled(ctx, op, name):
+    rc = get_rc(ctx)
+    results = rc.simple_command(f"backend {op} {name}")
+    if not results.get("Success"):
+        print(f"Error: {results['Error']}")
+        sys.exit(1)
+
+
+@backend.command(name="enable", help="Enable a previously disabled backend.")
+@click.argument('name', type=str, required=True)
+@click.pass_context
+def backend_enable(ctx, name):
+    set_backend_enabled(ctx, "enable", name)
+    print(f"Enabled: {name}")
+
+
+@backend.command(name="disable", help="Disable a backend, closing its connections.")
+@click.argument('name', type=str, required=True)
+@click.pass_context
+def backend_disable(ctx, name):
+    set_backend_enabled(ctx, "disable", name)
+    print(f"Disabled: {name}")
+
+
 @cli.group(help="Commands related to unit-of-work processing")
 def work():
     pass
@@ -202,14 +884,30 @@ def list(ctx, quiet):
 @click.option('--payload-literal', '-l', type=str, help="Use the command line string as the literal unit of work data.")
 @click.option('--follow', '-f', help="Remain attached to the job and print its results to stdout", is_flag=True)
 @click.option('--rm', help="Release unit after completion", is_flag=True)
+@click.option('--chunked', help="Send the payload as length-prefixed chunks instead of until EOF", is_flag=True)
+@click.option('--start-at', type=str, help="Defer the start of the work until this RFC3339 timestamp")
+@click.option('--delay', type=str, help="Defer the start of the work by this duration, such as 30m")
+@click.option('--timeout', type=str, help="Cancel the work if it runs for longer than this duration, such as 2h")
+@click.option('--mem-limit', type=str, help="Kill the work if it uses more memory than this, such as 512M (command work types on Linux only)")
+@click.option('--cpu-limit', type=str, help="Limit the work to this many CPUs, such as 0.5 (command work types on Linux only)")
+@click.option('--max-attempts', type=int, help="Start the work again if it fails, up to this many attempts in total")
+@click.option('--retry-delay', type=str, help="How long to wait after a failure before starting the work again, such as 30s")
+@click.option('--retry-backoff', help="Double the retry delay after each further failure", is_flag=True)
 @click.argument('params', nargs=-1, type=click.UNPROCESSED)
-def submit(ctx, worktype, node, payload, payload_literal, follow, rm, params):
+def submit(ctx, worktype, node, payload, payload_literal, follow, rm, chunked, start_at, delay, timeout, mem_limit, cpu_limit,
+           max_attempts, retry_delay, retry_backoff, params):
     if not payload and not payload_literal:
         print("Must provide one of --payload or --payload-literal.")
         sys.exit(1)
     if payload and payload_literal:
         print("Cannot provide both --payload and --payload-literal.")
         sys.exit(1)
+    if start_at and delay:
+        print("Cannot provide both --start-at and --delay.")
+        sys.exit(1)
+    if (retry_delay or retry_backoff) and not max_attempts:
+        print("Cannot provide --retry-delay or --retry-backoff without --max-attempts.")
+        sys.exit(1)
     if rm and not follow:
         print("Warning: using --rm without --follow. Unit results will never be seen.")
     if payload_literal:
@@ -224,7 +922,10 @@ def submit(ctx, worktype, node, payload, payload_literal, follow, rm, params):
         rc = get_rc(ctx)
         if node == "":
             node = None
-        work = rc.submit_work(node, worktype, " ".join(params), payload_data)
+        work = rc.submit_work(node, worktype, " ".join(params), payload_data, chunked=chunked,
+                              start_at=start_at, delay=delay, timeout=timeout,
+                              mem_limit=mem_limit, cpu_limit=cpu_limit, max_attempts=max_attempts,
+                              retry_delay=retry_delay, retry_backoff=retry_backoff)
         result = work.pop('result')
         unitid = work.pop('unitid')
         if follow:
@@ -237,18 +938,38 @@ def submit(ctx, worktype, node, payload, payload_literal, follow, rm, params):
             op_on_unit_ids(ctx, "release", [unitid])
 
 
+def print_stream(streamfile):
+    try:
+        for text in iter(partial(streamfile.readline, 256), b''):
+            sys.stdout.buffer.write(text)
+            sys.stdout.buffer.flush()
+    except StreamError as e:
+        sys.stdout.buffer.flush()
+        print(f"Error: stream ended early: {e}", file=sys.stderr)
+        sys.exit(1)
+    except Exception as e:
+        print("Exception:", e)
+
+
 @work.command(help="Get results for a previously run unit of work.")
 @click.pass_context
 @click.argument('unit_id', type=str, required=True)
 def results(ctx, unit_id):
     rc = get_rc(ctx)
     resultsfile = rc.get_work_results(unit_id)
-    try:
-        for text in iter(partial(resultsfile.readline, 256), b''):
-            sys.stdout.buffer.write(text)
-            sys.stdout.buffer.flush()
-    except Exception as e:
-        print("Exception:", e)
+    print_stream(resultsfile)
+
+
+@work.command(help="Follow the output of a unit of work as it is produced.")
+@click.pass_context
+@click.argument('unit_id', type=str, required=True)
+@click.option('--stderr', 'stream', flag_value='stderr', help="Follow stderr only")
+@click.option('--stdout', 'stream', flag_value='stdout', default=True, help="Follow stdout (default)")
+@click.option('--offset', type=int, default=0, help="Start from this byte position, such as to resume an earlier tail")
+def tail(ctx, unit_id, stream, offset):
+    rc = get_rc(ctx)
+    streamfile = rc.tail_work_stream(unit_id, stream, offset=offset)
+    print_stream(streamfile)
 
 
 def op_on_unit_ids(ctx, op, unit_ids):
@@ -271,6 +992,59 @@ def cancel(ctx, unit_ids):
     print("Cancelled:", unit_ids)
 
 
+@work.command(help="List units of work that are waiting to start, and why.")
+@click.pass_context
+def pending(ctx):
+    rc = get_rc(ctx)
+    units = rc.simple_command("work pending")
+    for unit_id in sorted(units):
+        u = units[unit_id]
+        if u['Reason'] == "scheduled":
+            detail = f"starts at {u['StartAt']}"
+        elif u['Reason'] == "queued":
+            detail = f"position {u['QueuePosition']} in the {u['WorkType']} queue"
+        else:
+            detail = ""
+        print(f"{unit_id}: {u['WorkType']} {u['Reason']} {detail}".rstrip())
+
+
+@work.command(name="cancel-pending", help="Cancel one or more units of work that have not started yet.")
+@click.argument('unit_ids', nargs=-1)
+@click.pass_context
+def cancel_pending(ctx, unit_ids):
+    if len(unit_ids) == 0:
+        print("No unit IDs supplied: Not doing anything")
+        return
+    op_on_unit_ids(ctx, "cancel-pending", unit_ids)
+    print("Cancelled:", unit_ids)
+
+
+@work.command(help="Check that the stored data of one or more units of work is intact.")
+@click.argument('unit_ids', nargs=-1)
+@click.pass_context
+def verify(ctx, unit_ids):
+    if len(unit_ids) == 0:
+        print("No unit IDs supplied: Not doing anything")
+        return
+    rc = get_rc(ctx)
+    failed = False
+    for unit_id in unit_ids:
+        try:
+            results = rc.simple_command(f"work verify {unit_id}")
+        except Exception as e:
+            print(f"{unit_id}: ERROR: {e}")
+            failed = True
+            continue
+        if results['OK']:
+            print(f"{unit_id}: OK")
+        else:
+            failed = True
+            for problem in results['Problems']:
+                print(f"{unit_id}: {problem}")
+    if failed:
+        sys.exit(1)
+
+
 @work.command(help="Release (delete) one or more units of work.")
 @click.option('--force', help="Delete locally even if we can't reach the remote node", is_flag=True)
 @click.argument('unit_ids', nargs=-1)
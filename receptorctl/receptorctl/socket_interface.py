@@ -7,11 +7,50 @@ import shutil
 import json
 
 
+class StreamError(RuntimeError):
+    pass
+
+
+class ChunkedStreamReader:
+    """Reads a stream sent as length-prefixed chunks. The chunks are followed by a trailer, which
+    holds the error if the stream failed partway."""
+
+    def __init__(self, sockfile):
+        self.sockfile = sockfile
+        self.buf = b''
+        self.done = False
+
+    def readline(self, size=-1):
+        while not self.buf and not self.done:
+            line = self.sockfile.readline()
+            if not line:
+                raise StreamError("connection closed before the end of the stream")
+            length = int(line)
+            if length == 0:
+                self.done = True
+                trailer = json.loads(self.sockfile.readline())
+                if "StreamError" in trailer:
+                    raise StreamError(trailer["StreamError"])
+                break
+            self.buf = self.sockfile.read(length)
+            if len(self.buf) < length:
+                raise StreamError("connection closed before the end of the stream")
+        end = self.buf.find(b'\n') + 1
+        if end == 0:
+            end = len(self.buf)
+        if 0 <= size < end:
+            end = size
+        data, self.buf = self.buf[:end], self.buf[end:]
+        return data
+
+
 class ReceptorControl:
     def __init__(self):
         self.socket = None
         self.sockfile = None
         self.remote_node = None
+        self.protocol_version = None
+        self.capabilities = []
 
     def readstr(self):
         return self.sockfile.readline().decode().strip()
@@ -21,10 +60,16 @@ class ReceptorControl:
         self.sockfile.flush()
 
     def handshake(self):
-        m = re.compile("Receptor Control, node (.+)").fullmatch(self.readstr())
+        m = re.compile("Receptor Control, node (.+?)(?:, protocol ([0-9]+)(?:, capabilities (.*))?)?").fullmatch(self.readstr())
         if not m:
             raise RuntimeError("Failed to handshake with Receptor socket")
         self.remote_node = m[1]
+        # Servers that send no protocol version speak version 1
+        self.protocol_version = int(m[2]) if m[2] else 1
+        self.capabilities = m[3].split() if m[3] else []
+
+    def has_capability(self, capability):
+        return capability in self.capabilities
 
     def read_and_parse_json(self):
         text = self.readstr()
@@ -40,12 +85,18 @@ class ReceptorControl:
     def connect(self, address):
         if self.socket is not None:
             raise ValueError("Already connected")
-        m = re.compile("tcp:(//)?([a-zA-Z0-9-]+):([0-9]+)|(unix:(//)?)?([^:]+)").fullmatch(address)
+        m = re.compile(r"tcp:(//)?(\[[0-9a-fA-F:.%]+\]|[a-zA-Z0-9.-]+):([0-9]+)|(unix:(//)?)?([^:]+)").fullmatch(address)
         if m:
             if m[6]:
-                path = os.path.expanduser(m[6])
-                if not os.path.exists(path):
-                    raise ValueError(f"Socket path does not exist: {path}")
+                if m[6].startswith("@"):
+                    # @name is a socket in the Linux abstract namespace, which has no file
+                    if not sys.platform.startswith("linux"):
+                        raise ValueError(f"Abstract sockets are only supported on Linux: {m[6]}")
+                    path = "\0" + m[6][1:]
+                else:
+                    path = os.path.expanduser(m[6])
+                    if not os.path.exists(path):
+                        raise ValueError(f"Socket path does not exist: {path}")
                 self.socket = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
                 self.socket.connect(path)
                 self.sockfile = self.socket.makefile('rwb')
@@ -53,8 +104,11 @@ class ReceptorControl:
                 return
             elif m[2] and m[3]:
                 host = m[2]
-                port = m[3]
-                print(f"TCP socket, host {host} port {port}")
+                if host.startswith("["):
+                    host = host[1:-1]
+                port = int(m[3])
+                self.socket = socket.create_connection((host, port))
+                self.sockfile = self.socket.makefile('rwb')
                 self.handshake()
                 return
         raise ValueError(f"Invalid socket address {address}")
@@ -74,41 +128,99 @@ class ReceptorControl:
                 pass
             self.socket = None
 
-    def connect_to_service(self, node, service):
-        self.writestr(f"connect {node} {service}\n")
+    def connect_to_service(self, node, service, tls=None, server_name=None):
+        command = f"connect {node} {service}"
+        if tls:
+            command += f" {tls}"
+            if server_name:
+                command += f" {server_name}"
+        self.writestr(f"{command}\n")
         text = self.readstr()
         if not str.startswith(text, "Connecting"):
             raise RuntimeError(text)
 
-    def submit_work(self, node, worktype, params, payload):
+    def submit_work(self, node, worktype, params, payload, chunked=False, start_at=None, delay=None, timeout=None,
+                    mem_limit=None, cpu_limit=None, max_attempts=None, retry_delay=None, retry_backoff=False):
         if node is None:
             node = "localhost"
-        command = f"work submit {node} {worktype} {params}\n"
+        if chunked or start_at or delay or timeout or mem_limit or cpu_limit or max_attempts:
+            commandobj = {
+                "command": "work",
+                "subcommand": "submit",
+                "node": node,
+                "worktype": worktype,
+                "params": params,
+            }
+            if chunked:
+                commandobj["payloadmode"] = "chunked"
+            if start_at:
+                commandobj["startat"] = start_at
+            if delay:
+                commandobj["delay"] = delay
+            if timeout:
+                commandobj["timeout"] = timeout
+            if mem_limit:
+                commandobj["memlimit"] = mem_limit
+            if cpu_limit:
+                commandobj["cpulimit"] = cpu_limit
+            if max_attempts:
+                commandobj["maxattempts"] = max_attempts
+                if retry_delay:
+                    commandobj["retrydelay"] = retry_delay
+                if retry_backoff:
+                    commandobj["retrybackoff"] = True
+            command = json.dumps(commandobj) + "\n"
+        else:
+            command = f"work submit {node} {worktype} {params}\n"
         self.writestr(command)
         text = self.readstr()
-        m = re.compile("Work unit created with ID (.+). Send stdin data and EOF.").fullmatch(text)
+        m = re.compile("Work unit created with ID (.+)\\. Send stdin data .*").fullmatch(text)
         if not m:
             errmsg = "Failed to start work unit"
             if str.startswith(text, "ERROR: "):
                 errmsg = errmsg + ": " + text[7:]
             raise RuntimeError(errmsg)
-        if isinstance(payload, io.IOBase):
-            shutil.copyfileobj(payload, self.sockfile)
-        elif isinstance(payload, str):
-            self.writestr(str)
-        elif isinstance(payload, bytes):
-            self.sockfile.write(payload)
+        if isinstance(payload, str):
+            payload = payload.encode()
+        if chunked:
+            if isinstance(payload, bytes):
+                payload = io.BytesIO(payload)
+            elif not isinstance(payload, io.IOBase):
+                raise RuntimeError("Unknown payload type")
+            while True:
+                chunk = payload.read(65536)
+                if not chunk:
+                    break
+                self.sockfile.write(f"{len(chunk)}\n".encode())
+                self.sockfile.write(chunk)
+            self.sockfile.write(b"0\n")
+            self.sockfile.flush()
         else:
-            raise RuntimeError("Unknown payload type")
-        self.sockfile.flush()
-        self.socket.shutdown(socket.SHUT_WR)
+            if isinstance(payload, io.IOBase):
+                shutil.copyfileobj(payload, self.sockfile)
+            elif isinstance(payload, bytes):
+                self.sockfile.write(payload)
+            else:
+                raise RuntimeError("Unknown payload type")
+            self.sockfile.flush()
+            self.socket.shutdown(socket.SHUT_WR)
         text = self.readstr()
         self.close()
         result = json.loads(text)
         return result
 
     def get_work_results(self, unit_id):
-        self.writestr(f"work results {unit_id}\n")
+        if self.has_capability("chunkedoutput"):
+            command = json.dumps({
+                "command": "work",
+                "subcommand": "results",
+                "unitid": unit_id,
+                "startpos": 0,
+                "outputmode": "chunked",
+            })
+        else:
+            command = f"work results {unit_id}"
+        self.writestr(f"{command}\n")
         text = self.readstr()
         m = re.compile("Streaming results for work unit (.+)").fullmatch(text)
         if not m:
@@ -117,4 +229,34 @@ class ReceptorControl:
                 errmsg = errmsg + ": " + text[7:]
             raise RuntimeError(errmsg)
         self.socket.shutdown(socket.SHUT_WR)
-        return self.sockfile
\ No newline at end of file
+        return self.output_stream()
+
+    def tail_work_stream(self, unit_id, stream="stdout", offset=0):
+        if self.has_capability("chunkedoutput"):
+            command = json.dumps({
+                "command": "work",
+                "subcommand": "tail",
+                "unitid": unit_id,
+                "stream": stream,
+                "offset": offset,
+                "outputmode": "chunked",
+            })
+        else:
+            command = f"work tail {unit_id} {stream} {offset}"
+        self.writestr(f"{command}\n")
+        text = self.readstr()
+        m = re.compile("Streaming (.+) for work unit (.+)").fullmatch(text)
+        if not m:
+            errmsg = f"Failed to tail {stream}"
+            if str.startswith(text, "ERROR: "):
+                errmsg = errmsg + ": " + text[7:]
+            raise RuntimeError(errmsg)
+        self.socket.shutdown(socket.SHUT_WR)
+        return self.output_stream()
+
+    def output_stream(self):
+        # Servers that can send output in chunks report errors after the output, rather than just
+        # closing the connection
+        if self.has_capability("chunkedoutput"):
+            return ChunkedStreamReader(self.sockfile)
+        return self.sockfile